@@ -0,0 +1,40 @@
+// Package address defines the interface of the external backends validating,
+// normalizing and geocoding the addresses orders ship to.
+package address
+
+// Verdicts of a validated address.
+const (
+	// VerdictValid is the verdict of addresses the backend confirmed as is.
+	VerdictValid = "valid"
+	// VerdictCorrected is the verdict of deliverable addresses the backend
+	// had to correct or complete.
+	VerdictCorrected = "corrected"
+	// VerdictUndeliverable is the verdict of addresses the backend couldn't
+	// confirm as deliverable.
+	VerdictUndeliverable = "undeliverable"
+)
+
+// Validator validates addresses.
+type Validator interface {
+	// Validate returns the verdict on the address and its normalized form.
+	Validate(address Address) (*Result, error)
+}
+
+// Address is an address to validate. Country is the ISO 3166 country code.
+type Address struct {
+	Country  string `json:"country"`
+	Zip      string `json:"zip"`
+	State    string `json:"state"`
+	City     string `json:"city"`
+	Address1 string `json:"address1"`
+	Address2 string `json:"address2"`
+}
+
+// Result is the verdict of the backend on an address, with the address as
+// normalized by it and its coordinates, if it could geocode it.
+type Result struct {
+	Verdict   string
+	Address   Address
+	Latitude  float64
+	Longitude float64
+}
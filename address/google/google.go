@@ -0,0 +1,166 @@
+// Package google validates addresses with the Google Maps Platform Address
+// Validation API.
+package google
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/netlify/gocommerce/address"
+)
+
+const apiURL = "https://addressvalidation.googleapis.com/v1"
+
+// Config contains the Google Address Validation specific configuration.
+type Config struct {
+	APIKey string `json:"api_key"`
+	// URL replaces the URL of the Address Validation API, used for testing.
+	URL string `json:"url"`
+}
+
+// Client calls the Address Validation API. It implements address.Validator.
+type Client struct {
+	client *http.Client
+	apiKey string
+	url    string
+}
+
+// NewClient creates a new Address Validation client using the provided
+// configuration.
+func NewClient(config Config) (*Client, error) {
+	if config.APIKey == "" {
+		return nil, errors.New("Google address validation configuration missing api_key")
+	}
+	c := &Client{
+		client: &http.Client{Timeout: 10 * time.Second},
+		apiKey: config.APIKey,
+		url:    apiURL,
+	}
+	if config.URL != "" {
+		c.url = config.URL
+	}
+	return c, nil
+}
+
+type postalAddress struct {
+	RegionCode         string   `json:"regionCode"`
+	PostalCode         string   `json:"postalCode,omitempty"`
+	AdministrativeArea string   `json:"administrativeArea,omitempty"`
+	Locality           string   `json:"locality,omitempty"`
+	AddressLines       []string `json:"addressLines,omitempty"`
+}
+
+type validationResponse struct {
+	Result struct {
+		Verdict struct {
+			AddressComplete          bool `json:"addressComplete"`
+			HasUnconfirmedComponents bool `json:"hasUnconfirmedComponents"`
+			HasInferredComponents    bool `json:"hasInferredComponents"`
+			HasReplacedComponents    bool `json:"hasReplacedComponents"`
+		} `json:"verdict"`
+		Address struct {
+			PostalAddress postalAddress `json:"postalAddress"`
+		} `json:"address"`
+		Geocode struct {
+			Location struct {
+				Latitude  float64 `json:"latitude"`
+				Longitude float64 `json:"longitude"`
+			} `json:"location"`
+		} `json:"geocode"`
+	} `json:"result"`
+}
+
+// Validate validates the address. Addresses that are incomplete or have
+// components Google couldn't confirm are undeliverable, those it had to
+// infer or replace components of are corrected.
+func (c *Client) Validate(a address.Address) (*address.Result, error) {
+	params := struct {
+		Address postalAddress `json:"address"`
+	}{postalAddress{
+		RegionCode:         a.Country,
+		PostalCode:         a.Zip,
+		AdministrativeArea: a.State,
+		Locality:           a.City,
+		AddressLines:       []string{a.Address1},
+	}}
+	if a.Address2 != "" {
+		params.Address.AddressLines = append(params.Address.AddressLines, a.Address2)
+	}
+
+	rsp := &validationResponse{}
+	if err := c.call(":validateAddress", params, rsp); err != nil {
+		return nil, err
+	}
+
+	verdict := rsp.Result.Verdict
+	result := &address.Result{
+		Verdict:   address.VerdictValid,
+		Address:   a,
+		Latitude:  rsp.Result.Geocode.Location.Latitude,
+		Longitude: rsp.Result.Geocode.Location.Longitude,
+	}
+	switch {
+	case !verdict.AddressComplete || verdict.HasUnconfirmedComponents:
+		result.Verdict = address.VerdictUndeliverable
+		return result, nil
+	case verdict.HasInferredComponents || verdict.HasReplacedComponents:
+		result.Verdict = address.VerdictCorrected
+	}
+
+	normalized := rsp.Result.Address.PostalAddress
+	result.Address.Zip = normalized.PostalCode
+	result.Address.State = normalized.AdministrativeArea
+	result.Address.City = normalized.Locality
+	result.Address.Address1 = ""
+	result.Address.Address2 = ""
+	if len(normalized.AddressLines) > 0 {
+		result.Address.Address1 = normalized.AddressLines[0]
+	}
+	if len(normalized.AddressLines) > 1 {
+		result.Address.Address2 = normalized.AddressLines[1]
+	}
+	return result, nil
+}
+
+type googleError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (c *Client) call(path string, payload interface{}, v interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.url+path+"?key="+url.QueryEscape(c.apiKey), bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "Error creating address validation request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "Error calling the Address Validation API")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		apiErr := &googleError{}
+		if json.Unmarshal(data, apiErr) == nil && apiErr.Error.Message != "" {
+			return fmt.Errorf("Address Validation API returned %d: %s", resp.StatusCode, apiErr.Error.Message)
+		}
+		return fmt.Errorf("Address Validation API returned %d: %s", resp.StatusCode, string(data))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -35,6 +35,7 @@ type API struct {
 	db         *gorm.DB
 	config     *conf.GlobalConfiguration
 	httpClient *http.Client
+	rateLimits rateLimitStore
 	version    string
 }
 
@@ -83,6 +84,7 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 		config:     globalConfig,
 		db:         db,
 		httpClient: &http.Client{},
+		rateLimits: newRateLimitStore(globalConfig, log),
 		version:    version,
 	}
 
@@ -107,41 +109,123 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 		r.Route("/orders", api.orderRoutes)
 		r.Route("/users", api.userRoutes)
 
+		r.Route("/carts", func(r *router) {
+			r.Post("/", api.CartCreate)
+			r.Route("/{cart_id}", func(r *router) {
+				r.Get("/", api.CartView)
+				r.Put("/items", api.CartItemsUpdate)
+				r.WithBypass(api.withIdempotency).Post("/checkout", api.CartCheckout)
+			})
+		})
+
 		r.Route("/downloads", func(r *router) {
 			r.With(authRequired).Get("/", api.DownloadList)
-			r.Get("/{download_id}", api.DownloadURL)
+			r.Get("/redeem/{token}", api.DownloadRedeem)
+			r.With(permissionRequired(writeOrdersPermission)).Post("/refresh_all", api.DownloadRefreshAll)
+			r.With(api.rateLimited(downloadsRateLimit)).Get("/{download_id}", api.DownloadURL)
+			r.With(permissionRequired(writeOrdersPermission)).Post("/{download_id}/extend", api.DownloadExtend)
+		})
+
+		r.Get("/exports/{export_id}", api.UserExportDownload)
+
+		r.Route("/unsubscribe/{token}", func(r *router) {
+			r.Get("/", api.UnsubscribeConfirm)
+			r.Post("/", api.Unsubscribe)
 		})
 
 		r.Route("/vatnumbers", func(r *router) {
 			r.Get("/{vat_number}", api.VatNumberLookup)
 		})
 
+		r.Get("/shipping_rates", api.ShippingRateList)
+
+		r.Route("/taxes", func(r *router) {
+			r.With(authRequired).Get("/rate", api.TaxRateView)
+		})
+
 		r.Route("/payments", func(r *router) {
-			r.With(adminRequired).Get("/", api.PaymentList)
+			r.With(permissionRequired(readPaymentsPermission)).Get("/", api.PaymentList)
 			r.Route("/{payment_id}", func(r *router) {
-				r.With(adminRequired).Get("/", api.PaymentView)
-				r.With(adminRequired).With(addGetBody).Post("/refund", api.PaymentRefund)
+				r.With(permissionRequired(readPaymentsPermission)).Get("/", api.PaymentView)
+				r.With(permissionRequired(writePaymentsPermission)).With(addGetBody).Post("/refund", api.PaymentRefund)
 				r.Post("/confirm", api.PaymentConfirm)
 			})
 		})
 
+		r.Route("/disputes", func(r *router) {
+			r.With(permissionRequired(readPaymentsPermission)).Get("/", api.DisputeList)
+			r.With(permissionRequired(readPaymentsPermission)).Get("/impact", api.DisputeImpact)
+			r.Route("/{dispute_id}", func(r *router) {
+				r.With(permissionRequired(readPaymentsPermission)).Get("/", api.DisputeView)
+				r.With(permissionRequired(writePaymentsPermission)).Put("/evidence", api.DisputeEvidence)
+			})
+		})
+
+		r.With(permissionRequired(readOrdersPermission)).Get("/returns", api.ReturnList)
+
+		r.Route("/subscriptions/{subscription_id}", func(r *router) {
+			r.With(permissionRequired(readPaymentsPermission)).Get("/usage", api.UsageRecordList)
+			r.WithBypass(api.withIdempotency).With(permissionRequired(writePaymentsPermission)).Post("/usage", api.UsageRecordCreate)
+		})
+
 		r.Route("/paypal", func(r *router) {
 			r.With(addGetBody).Post("/", api.PreauthorizePayment)
 		})
 
+		r.Route("/webhooks", func(r *router) {
+			r.Post("/stripe", api.StripeWebhook)
+			r.Post("/paypal", api.PayPalWebhook)
+			r.Post("/coinbase", api.CoinbaseWebhook)
+			r.Post("/klarna", api.KlarnaWebhook)
+			r.Post("/easypost", api.EasyPostWebhook)
+		})
+
 		r.Route("/reports", func(r *router) {
-			r.Use(adminRequired)
+			r.Use(permissionRequired(readReportsPermission))
 
+			r.Get("/dashboard", api.DashboardReport)
 			r.Get("/sales", api.SalesReport)
 			r.Get("/products", api.ProductsReport)
+			r.Get("/cohorts", api.CohortsReport)
+			r.Get("/downloads", api.DownloadsReport)
+			r.Get("/payments/reconciliation", api.PaymentReconciliationReport)
+			r.Get("/referrals", api.ReferralsReport)
+			r.Get("/vat", api.VATReport)
+			r.Get("/inventory/low_stock", api.LowStockReport)
+			r.Get("/runs", api.ReportRunList)
+		})
+
+		r.Route("/api_keys", func(r *router) {
+			r.Use(adminRequired)
+			r.Get("/", api.APIKeyList)
+			r.Post("/", api.APIKeyCreate)
+			r.Post("/{key_id}/rotate", api.APIKeyRotate)
+			r.Delete("/{key_id}", api.APIKeyRevoke)
 		})
 
 		r.Route("/coupons", func(r *router) {
 			r.With(adminRequired).Get("/", api.CouponList)
-			r.Get("/{coupon_code}", api.CouponView)
+			r.With(adminRequired).Post("/", api.CouponCreate)
+			r.With(adminRequired).Post("/batch", api.CouponBatchCreate)
+			r.With(api.rateLimited(couponsRateLimit)).Get("/{coupon_code}", api.CouponView)
+			r.With(api.rateLimited(couponsRateLimit)).Post("/{coupon_code}/check", api.CouponCheck)
+			r.With(adminRequired).Put("/{coupon_code}", api.CouponUpdate)
+			r.With(adminRequired).Delete("/{coupon_code}", api.CouponDelete)
+		})
+
+		r.Route("/stock", func(r *router) {
+			r.Use(permissionRequired(writeStockPermission))
+			r.Get("/", api.StockList)
+			r.Get("/locations", api.StockLocationList)
+			r.Put("/locations/{location_id}", api.StockLocationUpdate)
+			r.Delete("/locations/{location_id}", api.StockLocationDelete)
+			r.Put("/{sku}", api.StockUpdate)
+			r.Delete("/{sku}", api.StockDelete)
 		})
 
 		r.Get("/settings", api.ViewSettings)
+		r.Get("/payment_methods", api.AvailablePaymentMethods)
+		r.Get("/.well-known/apple-developer-merchantid-domain-association", api.ApplePayDomainAssociation)
 
 		r.With(authRequired).Post("/claim", api.ClaimOrders)
 	})
@@ -167,8 +251,8 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 
 	corsHandler := cors.New(cors.Options{
 		AllowedMethods:   []string{"GET", "POST", "PATCH", "PUT", "DELETE"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type"},
-		ExposedHeaders:   []string{"Link", "X-Total-Count"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", idempotencyKeyHeader},
+		ExposedHeaders:   []string{"Link", "X-Total-Count", idempotencyReplayedHeader},
 		AllowCredentials: true,
 	})
 
@@ -178,21 +262,62 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 
 func (a *API) orderRoutes(r *router) {
 	r.With(authRequired).Get("/", a.OrderList)
-	r.Post("/", a.OrderCreate)
+	r.With(a.rateLimited(ordersRateLimit)).WithBypass(a.withIdempotency).Post("/", a.OrderCreate)
+	r.With(permissionRequired(writeOrdersPermission)).Post("/batch", a.OrderBatchUpdate)
+	r.With(permissionRequired(readOrdersPermission)).Get("/abandoned", a.AbandonedOrderList)
 
 	r.Route("/{order_id}", func(r *router) {
 		r.Use(a.withOrderID)
 		r.Get("/", a.OrderView)
-		r.With(adminRequired).Put("/", a.OrderUpdate)
+		r.With(permissionRequired(writeOrdersPermission)).Put("/", a.OrderUpdate)
+		r.With(permissionRequired(writeOrdersPermission)).Patch("/line_items", a.OrderLineItemsUpdate)
+		r.With(permissionRequired(writeOrdersPermission)).Post("/cancel", a.OrderCancel)
+		r.With(permissionRequired(writeOrdersPermission)).Post("/archive", a.OrderArchive)
+		r.With(permissionRequired(writeOrdersPermission)).Post("/unarchive", a.OrderUnarchive)
+		r.WithBypass(a.withIdempotency).With(authRequired).Post("/reorder", a.OrderReorder)
 
 		r.Route("/payments", func(r *router) {
 			r.With(authRequired).Get("/", a.PaymentListForOrder)
-			r.With(addGetBody).Post("/", a.PaymentCreate)
+			r.WithBypass(a.withIdempotency).With(addGetBody).Post("/", a.PaymentCreate)
+			r.With(permissionRequired(writePaymentsPermission)).Put("/confirm", a.ManualPaymentConfirm)
+			r.Post("/{payment_id}/confirm", a.PaymentConfirm)
+			r.With(addGetBody).Post("/{payment_id}/callback", a.PaymentCallback)
+			r.With(permissionRequired(writePaymentsPermission)).With(addGetBody).Post("/{payment_id}/refund", a.PaymentRefund)
+			r.With(permissionRequired(writePaymentsPermission)).Post("/{payment_id}/capture", a.PaymentCapture)
+			r.With(permissionRequired(writePaymentsPermission)).Post("/{payment_id}/void", a.PaymentVoid)
+		})
+
+		r.Route("/shipments", func(r *router) {
+			r.With(authRequired).Get("/", a.ShipmentList)
+			r.With(permissionRequired(writeShipmentsPermission)).Post("/", a.ShipmentCreate)
+			r.With(permissionRequired(writeShipmentsPermission)).Put("/{shipment_id}", a.ShipmentUpdate)
+			r.With(permissionRequired(writeShipmentsPermission)).Post("/{shipment_id}/label", a.ShipmentLabel)
+		})
+
+		r.Route("/notes", func(r *router) {
+			r.With(authRequired).Get("/", a.OrderNoteList)
+			r.With(permissionRequired(writeOrdersPermission)).Post("/", a.OrderNoteCreate)
+			r.With(permissionRequired(writeOrdersPermission)).Delete("/{note_id}", a.OrderNoteDelete)
+		})
+		r.With(permissionRequired(readOrdersPermission)).Get("/timeline", a.OrderTimeline)
+		r.With(authRequired).Get("/credit_notes", a.CreditNoteList)
+		r.With(authRequired).Get("/credit_notes/{credit_note_id}/pdf", a.CreditNotePDF)
+
+		r.Route("/returns", func(r *router) {
+			r.Use(authRequired)
+			r.Get("/", a.ReturnListForOrder)
+			r.Post("/", a.ReturnCreate)
+			r.Route("/{return_id}", func(r *router) {
+				r.Get("/", a.ReturnView)
+				r.With(permissionRequired(writePaymentsPermission)).Post("/approve", a.ReturnApprove)
+				r.With(permissionRequired(writeOrdersPermission)).Post("/reject", a.ReturnReject)
+			})
 		})
 
 		r.Route("/downloads", func(r *router) {
 			r.Get("/", a.DownloadList)
 			r.Post("/refresh", a.DownloadRefresh)
+			r.With(authRequired).Get("/{download_id}/accesses", a.DownloadAccessList)
 		})
 		r.Get("/receipt", a.ReceiptView)
 		r.Post("/receipt", a.ResendOrderReceipt)
@@ -201,7 +326,7 @@ func (a *API) orderRoutes(r *router) {
 
 func (a *API) userRoutes(r *router) {
 	r.Use(authRequired)
-	r.With(adminRequired).Get("/", a.UserList)
+	r.With(permissionRequired(readUsersPermission)).Get("/", a.UserList)
 	r.With(adminRequired).Delete("/", a.UserBulkDelete)
 
 	r.Route("/{user_id}", func(r *router) {
@@ -210,16 +335,61 @@ func (a *API) userRoutes(r *router) {
 
 		r.Get("/", a.UserView)
 		r.With(adminRequired).Delete("/", a.UserDelete)
+		r.With(permissionRequired(writeUsersPermission)).Post("/merge", a.UserMerge)
+		r.Get("/export", a.UserExportCreate)
+		r.Get("/exports/{export_id}", a.UserExportView)
 
 		r.Get("/payments", a.PaymentListForUser)
 		r.Get("/orders", a.OrderList)
 
+		r.Route("/credits", func(r *router) {
+			r.Get("/", a.CreditList)
+			r.With(permissionRequired(writePaymentsPermission)).Post("/", a.CreditCreate)
+		})
+		r.Get("/referrals", a.ReferralView)
+		r.Route("/wishlist", func(r *router) {
+			r.Get("/", a.WishlistList)
+			r.Post("/", a.WishlistItemCreate)
+			r.Post("/order", a.WishlistOrder)
+			r.Route("/{item_id}", func(r *router) {
+				r.Put("/", a.WishlistItemUpdate)
+				r.Delete("/", a.WishlistItemDelete)
+			})
+		})
+		r.Get("/notifications", a.NotificationPreferencesView)
+		r.Put("/notifications", a.NotificationPreferencesUpdate)
+		r.With(permissionRequired(writeUsersPermission)).Put("/tax_exemption", a.UserTaxExemptionUpdate)
+		r.With(permissionRequired(writeUsersPermission)).Delete("/tax_exemption", a.UserTaxExemptionDelete)
+		r.With(permissionRequired(writeUsersPermission)).Put("/customer_group", a.UserCustomerGroupUpdate)
+		r.With(permissionRequired(writeUsersPermission)).Delete("/customer_group", a.UserCustomerGroupDelete)
+
 		r.Route("/addresses", func(r *router) {
 			r.Get("/", a.AddressList)
-			r.With(adminRequired).Post("/", a.CreateNewAddress)
+			r.With(permissionRequired(writeUsersPermission)).Post("/", a.CreateNewAddress)
 			r.Route("/{addr_id}", func(r *router) {
 				r.Get("/", a.AddressView)
-				r.With(adminRequired).Delete("/", a.AddressDelete)
+				r.With(permissionRequired(writeUsersPermission)).Delete("/", a.AddressDelete)
+				r.Put("/default", a.AddressDefaultUpdate)
+			})
+		})
+
+		r.Route("/payment_methods", func(r *router) {
+			r.Get("/", a.PaymentMethodList)
+			r.With(addGetBody).Post("/", a.PaymentMethodCreate)
+			r.Route("/{method_id}", func(r *router) {
+				r.Get("/", a.PaymentMethodView)
+				r.Delete("/", a.PaymentMethodDelete)
+			})
+		})
+
+		r.Route("/subscriptions", func(r *router) {
+			r.Get("/", a.SubscriptionList)
+			r.Post("/", a.SubscriptionCreate)
+			r.Route("/{subscription_id}", func(r *router) {
+				r.Get("/", a.SubscriptionView)
+				r.Post("/cancel", a.SubscriptionCancel)
+				r.Post("/pause", a.SubscriptionPause)
+				r.Post("/resume", a.SubscriptionResume)
 			})
 		})
 	})
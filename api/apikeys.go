@@ -0,0 +1,115 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// APIKeyParams are the parameters of a new API key.
+type APIKeyParams struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+// apiKeyResponse includes the key of a created or rotated API key, which is
+// only ever returned once.
+type apiKeyResponse struct {
+	*models.APIKey
+	Key string `json:"key"`
+}
+
+// APIKeyList lists the API keys of the instance, including revoked ones.
+func (a *API) APIKeyList(w http.ResponseWriter, r *http.Request) error {
+	keys := []*models.APIKey{}
+	rsp := a.DB(r).Where("instance_id = ?", gcontext.GetInstanceID(r.Context())).Order("created_at desc").Find(&keys)
+	if rsp.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, keys)
+}
+
+// APIKeyCreate creates an API key scoped to the permissions.
+func (a *API) APIKeyCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	params := &APIKeyParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read API key params: %v", err)
+	}
+	if params.Name == "" {
+		return badRequestError("An API key requires a name")
+	}
+	if len(params.Permissions) == 0 {
+		return badRequestError("An API key requires at least one permission")
+	}
+	for _, p := range params.Permissions {
+		if !validPermission(p) {
+			return badRequestError("Unknown permission %v", p)
+		}
+	}
+
+	apiKey, key, err := models.NewAPIKey(gcontext.GetInstanceID(ctx), params.Name, params.Permissions, gcontext.GetClaims(ctx).Subject)
+	if err != nil {
+		return internalServerError("Error generating API key").WithInternalError(err)
+	}
+	if rsp := a.DB(r).Create(apiKey); rsp.Error != nil {
+		return internalServerError("Error saving API key").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusCreated, &apiKeyResponse{apiKey, key})
+}
+
+// APIKeyRotate replaces the key of an API key, so the previous one stops
+// working right away.
+func (a *API) APIKeyRotate(w http.ResponseWriter, r *http.Request) error {
+	apiKey, httpErr := a.loadAPIKey(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if apiKey.Revoked() {
+		return badRequestError("This API key has been revoked")
+	}
+
+	key, err := apiKey.Rotate()
+	if err != nil {
+		return internalServerError("Error generating API key").WithInternalError(err)
+	}
+	now := time.Now()
+	apiKey.RotatedAt = &now
+	if rsp := a.DB(r).Save(apiKey); rsp.Error != nil {
+		return internalServerError("Error saving API key").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, &apiKeyResponse{apiKey, key})
+}
+
+// APIKeyRevoke revokes an API key. Revoked keys are kept for their history.
+func (a *API) APIKeyRevoke(w http.ResponseWriter, r *http.Request) error {
+	apiKey, httpErr := a.loadAPIKey(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if !apiKey.Revoked() {
+		now := time.Now()
+		apiKey.RevokedAt = &now
+		if rsp := a.DB(r).Save(apiKey); rsp.Error != nil {
+			return internalServerError("Error saving API key").WithInternalError(rsp.Error)
+		}
+	}
+	return sendJSON(w, http.StatusOK, apiKey)
+}
+
+func (a *API) loadAPIKey(r *http.Request) (*models.APIKey, *HTTPError) {
+	apiKey := &models.APIKey{}
+	rsp := a.DB(r).Where("instance_id = ? AND id = ?", gcontext.GetInstanceID(r.Context()), chi.URLParam(r, "key_id")).First(apiKey)
+	if rsp.RecordNotFound() {
+		return nil, notFoundError("API key not found")
+	}
+	if rsp.Error != nil {
+		return nil, internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	return apiKey, nil
+}
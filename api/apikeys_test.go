@@ -0,0 +1,129 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestAPIKeys(t *testing.T) {
+	test := NewRouteTest(t)
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	withKey := func(method, url, key string) *httptest.ResponseRecorder {
+		return test.TestEndpointWithHeaders(method, url, nil, nil, map[string]string{"Authorization": "Bearer " + key})
+	}
+
+	recorder := test.TestEndpoint(http.MethodPost, "/api_keys", strings.NewReader(`{"name": "Accounting", "permissions": ["reports:read"]}`), token)
+	require.Equal(t, http.StatusCreated, recorder.Code, recorder.Body.String())
+	created := struct {
+		ID          string   `json:"id"`
+		Key         string   `json:"key"`
+		Hint        string   `json:"hint"`
+		Permissions []string `json:"permissions"`
+		CreatedBy   string   `json:"created_by"`
+	}{}
+	extractPayload(t, http.StatusCreated, recorder, &created)
+	assert.True(t, strings.HasPrefix(created.Key, models.APIKeyPrefix))
+	assert.True(t, strings.HasPrefix(created.Key, created.Hint))
+	assert.Equal(t, []string{"reports:read"}, created.Permissions)
+	assert.Equal(t, "admin-yo", created.CreatedBy)
+
+	stored := &models.APIKey{}
+	require.NoError(t, test.DB.First(stored, "id = ?", created.ID).Error)
+	assert.Equal(t, models.HashAPIKey(created.Key), stored.KeyHash)
+	assert.NotContains(t, stored.KeyHash+stored.RawPermissions, created.Key)
+
+	t.Run("Scoped", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, withKey(http.MethodGet, "/reports/sales", created.Key).Code)
+		validateError(t, http.StatusUnauthorized, withKey(http.MethodGet, "/payments", created.Key), "Permission payments:read required")
+		validateError(t, http.StatusUnauthorized, withKey(http.MethodGet, "/api_keys", created.Key), "Admin permissions required")
+		validateError(t, http.StatusUnauthorized, withKey(http.MethodGet, "/reports/sales", models.APIKeyPrefix+"unknown"), "Invalid API key")
+
+		require.NoError(t, test.DB.First(stored, "id = ?", created.ID).Error)
+		require.NotNil(t, stored.LastUsedAt)
+
+		// the use is only recorded again after a while
+		lastUsedAt := *stored.LastUsedAt
+		withKey(http.MethodGet, "/reports/sales", created.Key)
+		require.NoError(t, test.DB.First(stored, "id = ?", created.ID).Error)
+		assert.True(t, lastUsedAt.Equal(*stored.LastUsedAt))
+		require.NoError(t, test.DB.Model(stored).UpdateColumn("last_used_at", time.Now().Add(-2*apiKeyUsageInterval)).Error)
+		withKey(http.MethodGet, "/reports/sales", created.Key)
+		require.NoError(t, test.DB.First(stored, "id = ?", created.ID).Error)
+		assert.True(t, stored.LastUsedAt.After(time.Now().Add(-apiKeyUsageInterval)))
+	})
+	t.Run("Validation", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodPost, "/api_keys", strings.NewReader(`{"name": "Accounting", "permissions": ["coupons:write"]}`), token)
+		validateError(t, http.StatusBadRequest, recorder, "Unknown permission coupons:write")
+		recorder = test.TestEndpoint(http.MethodPost, "/api_keys", strings.NewReader(`{"permissions": ["reports:read"]}`), token)
+		validateError(t, http.StatusBadRequest, recorder, "An API key requires a name")
+		recorder = test.TestEndpoint(http.MethodPost, "/api_keys", strings.NewReader(`{"name": "Accounting", "permissions": ["reports:read"]}`), testRoleToken("accountant", "accountant@wayneindustries.com", "finance"))
+		validateError(t, http.StatusUnauthorized, recorder, "Admin permissions required")
+	})
+	t.Run("List", func(t *testing.T) {
+		keys := []*models.APIKey{}
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/api_keys", nil, token), &keys)
+		require.Len(t, keys, 1)
+		assert.Equal(t, created.ID, keys[0].ID)
+		assert.NotContains(t, test.TestEndpoint(http.MethodGet, "/api_keys", nil, token).Body.String(), stored.KeyHash)
+	})
+
+	t.Run("Orders", func(t *testing.T) {
+		server := startTestSite()
+		defer server.Close()
+		test.Config.SiteURL = server.URL
+		recorder := test.TestEndpoint(http.MethodPost, "/api_keys", strings.NewReader(`{"name": "Shop", "permissions": ["orders:read", "orders:write"]}`), token)
+		key := struct {
+			ID  string `json:"id"`
+			Key string `json:"key"`
+		}{}
+		extractPayload(t, http.StatusCreated, recorder, &key)
+		headers := map[string]string{"Authorization": "Bearer " + key.Key}
+
+		// orders created with an API key are guest orders
+		recorder = test.TestEndpointWithHeaders(http.MethodPost, "/orders", strings.NewReader(defaultPayload), nil, headers)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, "", order.UserID)
+		assert.Equal(t, "info@example.com", order.Email)
+		var users int
+		require.NoError(t, test.DB.Model(&models.User{}).Where("id = ?", "api_key:"+key.ID).Count(&users).Error)
+		assert.Equal(t, 0, users)
+
+		// API keys list all orders rather than their own
+		orders := []*models.Order{}
+		extractPayload(t, http.StatusOK, test.TestEndpointWithHeaders(http.MethodGet, "/orders", nil, nil, headers), &orders)
+		var total int
+		require.NoError(t, test.DB.Model(&models.Order{}).Count(&total).Error)
+		assert.Len(t, orders, total)
+		validateError(t, http.StatusUnauthorized, withKey(http.MethodGet, "/orders", created.Key), "Permission orders:read required")
+	})
+
+	rotated := struct {
+		Key string `json:"key"`
+	}{}
+	t.Run("Rotate", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodPost, "/api_keys/"+created.ID+"/rotate", nil, token)
+		extractPayload(t, http.StatusOK, recorder, &rotated)
+		assert.NotEqual(t, created.Key, rotated.Key)
+
+		validateError(t, http.StatusUnauthorized, withKey(http.MethodGet, "/reports/sales", created.Key), "Invalid API key")
+		assert.Equal(t, http.StatusOK, withKey(http.MethodGet, "/reports/sales", rotated.Key).Code)
+	})
+	t.Run("Revoke", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, test.TestEndpoint(http.MethodDelete, "/api_keys/"+created.ID, nil, token).Code)
+		validateError(t, http.StatusUnauthorized, withKey(http.MethodGet, "/reports/sales", rotated.Key), "Invalid API key")
+
+		recorder := test.TestEndpoint(http.MethodPost, "/api_keys/"+created.ID+"/rotate", nil, token)
+		validateError(t, http.StatusBadRequest, recorder, "This API key has been revoked")
+		recorder = test.TestEndpoint(http.MethodDelete, "/api_keys/unknown", nil, token)
+		validateError(t, http.StatusNotFound, recorder, "API key not found")
+	})
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// OrderArchive hides an order from the order listings and reports. Archived
+// orders are kept for accounting and can be listed with archived=true.
+func (a *API) OrderArchive(w http.ResponseWriter, r *http.Request) error {
+	order, httpErr := a.loadOrder(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if order.ArchivedAt != nil {
+		return badRequestError("This order has already been archived")
+	}
+
+	now := time.Now()
+	return a.setArchivedAt(w, r, order, &now)
+}
+
+// OrderUnarchive restores an archived order to the order listings and reports.
+func (a *API) OrderUnarchive(w http.ResponseWriter, r *http.Request) error {
+	order, httpErr := a.loadOrder(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if order.ArchivedAt == nil {
+		return badRequestError("This order hasn't been archived")
+	}
+
+	return a.setArchivedAt(w, r, order, nil)
+}
+
+func (a *API) setArchivedAt(w http.ResponseWriter, r *http.Request, order *models.Order, archivedAt *time.Time) error {
+	claims := gcontext.GetClaims(r.Context())
+
+	tx := a.DB(r).Begin()
+	if rsp := tx.Model(&models.Order{}).Where("id = ?", order.ID).Update("archived_at", archivedAt); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error updating order").WithInternalError(rsp.Error)
+	}
+	models.LogEvent(tx, r.RemoteAddr, claims.Subject, order.ID, models.EventUpdated, []string{"archived_at"})
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error updating order").WithInternalError(rsp.Error)
+	}
+
+	order.ArchivedAt = archivedAt
+	return sendJSON(w, http.StatusOK, order)
+}
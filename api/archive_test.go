@@ -0,0 +1,67 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestOrderArchive(t *testing.T) {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	listOrders := func(t *testing.T, test *RouteTest, query string) []models.Order {
+		recorder := test.TestEndpoint(http.MethodGet, "/orders"+query, nil, test.Data.testUserToken)
+		orders := []models.Order{}
+		extractPayload(t, http.StatusOK, recorder, &orders)
+		return orders
+	}
+
+	t.Run("Archive", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/archive", nil, token)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.NotNil(t, order.ArchivedAt)
+
+		orders := listOrders(t, test, "")
+		require.Len(t, orders, 1)
+		assert.Equal(t, test.Data.secondOrder.ID, orders[0].ID)
+
+		orders = listOrders(t, test, "?archived=true")
+		require.Len(t, orders, 1)
+		assert.Equal(t, test.Data.firstOrder.ID, orders[0].ID)
+
+		// archived orders can still be viewed
+		recorder = test.TestEndpoint(http.MethodGet, "/orders/first-order", nil, test.Data.testUserToken)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		recorder = test.TestEndpoint(http.MethodPost, "/orders/first-order/archive", nil, token)
+		validateError(t, http.StatusBadRequest, recorder, "already been archived")
+	})
+	t.Run("Unarchive", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/unarchive", nil, token)
+		validateError(t, http.StatusBadRequest, recorder)
+
+		recorder = test.TestEndpoint(http.MethodPost, "/orders/first-order/archive", nil, token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		recorder = test.TestEndpoint(http.MethodPost, "/orders/first-order/unarchive", nil, token)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Nil(t, order.ArchivedAt)
+		assert.Len(t, listOrders(t, test, ""), 2)
+	})
+	t.Run("BadParam", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders?archived=maybe", nil, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/archive", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
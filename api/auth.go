@@ -3,6 +3,8 @@ package api
 import (
 	"context"
 	"net/http"
+	"strings"
+	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/netlify/gocommerce/claims"
@@ -43,25 +45,25 @@ func (a *API) withToken(w http.ResponseWriter, r *http.Request) (context.Context
 		return ctx, nil
 	}
 
+	if strings.HasPrefix(bearerToken, models.APIKeyPrefix) {
+		return a.withAPIKey(r, bearerToken)
+	}
+
 	claims := claims.JWTClaims{}
-	p := jwt.Parser{ValidMethods: []string{jwt.SigningMethodHS256.Name}}
-	token, err := p.ParseWithClaims(bearerToken, &claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(config.JWT.Secret), nil
-	})
+	p := jwt.Parser{ValidMethods: []string{jwt.SigningMethodHS256.Name, jwt.SigningMethodRS256.Name}}
+	token, err := p.ParseWithClaims(bearerToken, &claims, jwtKeyFunc(config))
 	if err != nil {
 		return nil, unauthorizedError("Invalid token").WithInternalError(err)
 	}
+	if err := verifyTokenClaims(config, &claims); err != nil {
+		return nil, unauthorizedError("Invalid token").WithInternalError(err)
+	}
 
+	roles := claimRoles(config, &claims)
 	isAdmin := false
-	roles, ok := claims.AppMetaData["roles"]
-	if ok {
-		roleStrings, _ := roles.([]interface{})
-		for _, data := range roleStrings {
-			role, _ := data.(string)
-			if role == config.JWT.AdminGroupName {
-				isAdmin = true
-				break
-			}
+	for _, role := range roles {
+		if role == superadminRole {
+			isAdmin = true
 		}
 	}
 
@@ -73,10 +75,65 @@ func (a *API) withToken(w http.ResponseWriter, r *http.Request) (context.Context
 	}).Debug("successfully parsed claims")
 
 	ctx = gcontext.WithAdminFlag(ctx, isAdmin)
+	ctx = gcontext.WithRoles(ctx, roles)
 	ctx = gcontext.WithToken(ctx, token)
 	return ctx, nil
 }
 
+// withAPIKey authenticates the request with an API key of the instance. The
+// claims of the request name the key as their subject.
+func (a *API) withAPIKey(r *http.Request, key string) (context.Context, error) {
+	ctx := r.Context()
+	db := a.DB(r)
+	apiKey, err := models.FindAPIKey(db, gcontext.GetInstanceID(ctx), key)
+	if err != nil {
+		return nil, internalServerError("Error during database query").WithInternalError(err)
+	}
+	if apiKey == nil {
+		return nil, unauthorizedError("Invalid API key")
+	}
+
+	now := time.Now()
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) >= apiKeyUsageInterval {
+		if rsp := db.Model(apiKey).UpdateColumn("last_used_at", now); rsp.Error != nil {
+			getLogEntry(r).WithError(rsp.Error).Warn("Failed to record the use of the API key")
+		}
+	}
+	logEntrySetField(r, "api_key_id", apiKey.ID)
+
+	token := &jwt.Token{
+		Raw:   key,
+		Valid: true,
+		Claims: &claims.JWTClaims{
+			StandardClaims: jwt.StandardClaims{Subject: apiKeySubject(apiKey)},
+		},
+	}
+	ctx = gcontext.WithAdminFlag(ctx, false)
+	ctx = gcontext.WithPermissions(ctx, apiKey.Permissions)
+	ctx = gcontext.WithToken(ctx, token)
+	return ctx, nil
+}
+
+// apiKeySubjectPrefix starts the subject of the claims of requests made with
+// an API key.
+const apiKeySubjectPrefix = "api_key:"
+
+// apiKeyUsageInterval is how often the use of an API key is recorded, so
+// requests don't each write to the database.
+const apiKeyUsageInterval = 5 * time.Minute
+
+// apiKeySubject returns the subject of the claims of requests made with the
+// API key.
+func apiKeySubject(apiKey *models.APIKey) string {
+	return apiKeySubjectPrefix + apiKey.ID
+}
+
+// isAPIKeySubject reports whether the subject of the claims is an API key
+// rather than a user. API keys never own orders or carts.
+func isAPIKeySubject(subject string) bool {
+	return strings.HasPrefix(subject, apiKeySubjectPrefix)
+}
+
 func authRequired(w http.ResponseWriter, r *http.Request) (context.Context, error) {
 	ctx := r.Context()
 	claims := gcontext.GetClaims(ctx)
@@ -103,9 +160,13 @@ func adminRequired(w http.ResponseWriter, r *http.Request) (context.Context, err
 func ensureUserAccess(w http.ResponseWriter, r *http.Request) (context.Context, error) {
 	ctx := r.Context()
 
-	// ensure userID matches authenticated user OR is admin
+	// ensure userID matches authenticated user OR is allowed to access users
 	claims := gcontext.GetClaims(ctx)
-	if gcontext.IsAdmin(ctx) {
+	required := writeUsersPermission
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		required = readUsersPermission
+	}
+	if hasPermission(ctx, required) {
 		logEntrySetField(r, "admin_id", claims.Subject)
 		return ctx, nil
 	}
@@ -122,7 +183,7 @@ func hasOrderAccess(ctx context.Context, order *models.Order) bool {
 	if order.UserID == "" {
 		return true
 	}
-	if gcontext.IsAdmin(ctx) {
+	if hasPermission(ctx, readOrdersPermission) {
 		return true
 	}
 
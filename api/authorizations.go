@@ -0,0 +1,289 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+const authorizationVoidInterval = time.Minute
+
+// CaptureParams holds the parameters for capturing an authorized payment
+type CaptureParams struct {
+	// Amount defaults to the full authorized amount.
+	Amount uint64 `json:"amount"`
+}
+
+// PaymentCapture captures a previously authorized payment, e.g. once the order
+// has been shipped. Capturing less than the authorized amount releases the rest.
+func (a *API) PaymentCapture(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	db := a.DB(r)
+
+	params := CaptureParams{}
+	if r.Body != nil && r.Body != http.NoBody {
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			return badRequestError("Could not read params: %v", err)
+		}
+	}
+
+	trans, order, provider, httpErr := a.loadAuthorization(r)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	amount := params.Amount
+	if amount == 0 {
+		amount = trans.AuthorizedAmount
+	}
+	if amount > trans.AuthorizedAmount {
+		return badRequestError("The capture exceeds the authorized amount of %d", trans.AuthorizedAmount)
+	}
+
+	capture, err := provider.NewCapturer(ctx, r, log.WithField("component", "payment_provider"))
+	if err != nil {
+		return badRequestError("Error creating payment provider: %v", err)
+	}
+	if httpErr := checkStock(db, gcontext.GetConfig(ctx), order); httpErr != nil {
+		return httpErr
+	}
+
+	// claim the authorization so concurrent captures and voids don't reach the provider
+	rsp := db.Model(&models.Transaction{}).
+		Where("id = ? AND status = ?", trans.ID, models.AuthorizedState).
+		UpdateColumn("status", models.CapturingState)
+	if rsp.Error != nil {
+		return internalServerError("Error claiming the authorization").WithInternalError(rsp.Error)
+	}
+	if rsp.RowsAffected == 0 {
+		return httpError(http.StatusConflict, "The authorization of this transaction is already being captured or voided")
+	}
+
+	processorID, err := capture(trans.ProcessorID, amount, trans.Currency)
+	if err != nil {
+		db.Model(&models.Transaction{}).
+			Where("id = ? AND status = ?", trans.ID, models.CapturingState).
+			UpdateColumn("status", models.AuthorizedState)
+		return internalServerError("Error on provider while trying to capture: %v. Try again later.", err).WithInternalError(err)
+	}
+	if processorID != "" {
+		trans.ProcessorID = processorID
+	}
+	trans.Amount = amount
+
+	tx := db.Begin()
+	complete, err := paymentComplete(r, tx, trans, order)
+	if err != nil {
+		tx.Rollback()
+		log.WithError(err).WithField("amount", amount).Error("Captured authorized payment couldn't be recorded")
+		return err
+	}
+	models.LogEvent(tx, r.RemoteAddr, gcontext.GetClaims(ctx).Subject, order.ID, models.EventUpdated, []string{"payment_state"})
+	if err := tx.Commit().Error; err != nil {
+		return internalServerError("Saving payment failed").WithInternalError(err)
+	}
+
+	if complete {
+		go sendOrderConfirmation(ctx, a.DB(r), log, trans)
+	}
+	log.WithField("amount", amount).Info("Captured authorized payment")
+	return sendJSON(w, http.StatusOK, trans)
+}
+
+// PaymentVoid releases a previously authorized payment without capturing it.
+func (a *API) PaymentVoid(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	db := a.DB(r)
+
+	trans, order, _, httpErr := a.loadAuthorization(r)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	voided, err := voidAuthorization(ctx, db, log, trans, order)
+	if err != nil {
+		if httpErr, ok := err.(*HTTPError); ok {
+			return httpErr
+		}
+		return internalServerError("Error on provider while trying to void: %v. Try again later.", err).WithInternalError(err)
+	}
+	if !voided {
+		return httpError(http.StatusConflict, "The authorization of this transaction is already being captured or voided")
+	}
+	if err := authorizationVoided(db, r.RemoteAddr, trans); err != nil {
+		return internalServerError("Error saving the voided payment").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusOK, trans)
+}
+
+// loadAuthorization loads the authorized transaction of the request together
+// with its order and payment provider.
+func (a *API) loadAuthorization(r *http.Request) (*models.Transaction, *models.Order, payments.CapturingProvider, *HTTPError) {
+	ctx := r.Context()
+	db := a.DB(r)
+
+	trans, httpErr := getTransaction(db, chi.URLParam(r, "payment_id"))
+	if httpErr != nil {
+		return nil, nil, nil, httpErr
+	}
+	if trans.OrderID != gcontext.GetOrderID(ctx) {
+		return nil, nil, nil, notFoundError("Transaction not found")
+	}
+	if trans.Status != models.AuthorizedState {
+		return nil, nil, nil, badRequestError("Only authorized transactions can be captured or voided")
+	}
+	if trans.AuthorizationExpired() {
+		return nil, nil, nil, badRequestError("The authorization of this transaction has expired")
+	}
+
+	order := &models.Order{}
+	if rsp := db.Find(order, "id = ?", trans.OrderID); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil, nil, notFoundError("Order not found")
+		}
+		return nil, nil, nil, internalServerError("Error while querying for order").WithInternalError(rsp.Error)
+	}
+
+	provider, httpErr := transactionProvider(ctx, trans, order)
+	if httpErr != nil {
+		return nil, nil, nil, httpErr
+	}
+	capturingProvider, ok := provider.(payments.CapturingProvider)
+	if !ok {
+		return nil, nil, nil, badRequestError("Payment provider '%s' does not support capturing payments", provider.Name())
+	}
+	return trans, order, capturingProvider, nil
+}
+
+// voidAuthorization releases the authorization of the transaction with its
+// provider and marks the transaction as voided. The authorization is claimed
+// first, so it isn't captured while it's voided, and given back if the void
+// fails. It reports false if the authorization is being captured or voided
+// already. db can be a transaction, which then holds the claim until it ends.
+func voidAuthorization(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, trans *models.Transaction, order *models.Order) (bool, error) {
+	provider, httpErr := transactionProvider(ctx, trans, order)
+	if httpErr != nil {
+		return false, httpErr
+	}
+	capturingProvider, ok := provider.(payments.CapturingProvider)
+	if !ok {
+		return false, badRequestError("Payment provider '%s' can't void authorizations", provider.Name())
+	}
+	void, err := capturingProvider.NewVoider(ctx, log.WithField("component", "payment_provider"))
+	if err != nil {
+		return false, err
+	}
+
+	rsp := db.Model(&models.Transaction{}).
+		Where("id = ? AND status = ?", trans.ID, models.AuthorizedState).
+		UpdateColumn("status", models.CapturingState)
+	if rsp.Error != nil {
+		return false, rsp.Error
+	}
+	if rsp.RowsAffected == 0 {
+		return false, nil
+	}
+	if err := void(trans.ProcessorID); err != nil {
+		db.Model(&models.Transaction{}).
+			Where("id = ? AND status = ?", trans.ID, models.CapturingState).
+			UpdateColumn("status", models.AuthorizedState)
+		return false, err
+	}
+	trans.Status = models.VoidedState
+	return true, db.Model(&models.Transaction{}).Where("id = ?", trans.ID).UpdateColumn("status", models.VoidedState).Error
+}
+
+// authorizationVoided marks the order of a voided authorization as voided.
+func authorizationVoided(db *gorm.DB, ip string, trans *models.Transaction) error {
+	tx := db.Begin()
+	tx.Model(&models.Order{}).Where("id = ?", trans.OrderID).Update("payment_state", models.VoidedState)
+	models.LogEvent(tx, ip, trans.UserID, trans.OrderID, models.EventUpdated, []string{"payment_state"})
+	return tx.Commit().Error
+}
+
+// RunAuthorizationVoider creates a goroutine that voids expired payment
+// authorizations every minute. In single instance mode the payment providers
+// are taken from ctx, otherwise from the configuration of each instance.
+func (a *API) RunAuthorizationVoider(ctx context.Context, db *gorm.DB, log logrus.FieldLogger) {
+	go func() {
+		for {
+			a.voidExpiredAuthorizations(ctx, db, log)
+			time.Sleep(authorizationVoidInterval)
+		}
+	}()
+}
+
+func (a *API) voidExpiredAuthorizations(ctx context.Context, db *gorm.DB, log logrus.FieldLogger) {
+	expired := []*models.Transaction{}
+	rsp := db.Where("type = ? AND status = ? AND authorization_expires_at < ?", models.ChargeTransactionType, models.AuthorizedState, time.Now()).Find(&expired)
+	if rsp.Error != nil {
+		log.WithError(rsp.Error).Error("Error querying for expired authorizations")
+		return
+	}
+
+	instances := map[string]context.Context{}
+	for _, trans := range expired {
+		log := log.WithField("transaction_id", trans.ID)
+
+		instanceCtx, ok := instances[trans.InstanceID]
+		if !ok {
+			var err error
+			if instanceCtx, err = a.instanceContext(ctx, db, trans.InstanceID); err != nil {
+				log.WithError(err).Error("Error loading instance configuration")
+				continue
+			}
+			instances[trans.InstanceID] = instanceCtx
+		}
+
+		order := &models.Order{}
+		if rsp := db.Find(order, "id = ?", trans.OrderID); rsp.Error != nil {
+			log.WithError(rsp.Error).Error("Error querying for order of expired authorization")
+			continue
+		}
+		voided, err := voidAuthorization(instanceCtx, db, log, trans, order)
+		if err != nil {
+			log.WithError(err).Error("Failed to void expired authorization")
+			continue
+		}
+		if !voided {
+			log.Debug("Skipped authorization that is being captured or voided")
+			continue
+		}
+		if err := authorizationVoided(db, "", trans); err != nil {
+			log.WithError(err).Error("Failed to save the voided authorization")
+			continue
+		}
+		log.Info("Voided expired authorization")
+	}
+}
+
+// instanceContext returns a context with the configuration, mailer and payment
+// providers of the instance for work done outside of a request. In single
+// instance mode ctx already holds them.
+func (a *API) instanceContext(ctx context.Context, db *gorm.DB, instanceID string) (context.Context, error) {
+	if !a.config.MultiInstanceMode {
+		return ctx, nil
+	}
+
+	instance, err := models.GetInstance(db, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	config, err := instance.Config()
+	if err != nil {
+		return nil, err
+	}
+	return WithInstanceConfig(ctx, a.config.SMTP, config, instanceID)
+}
@@ -0,0 +1,283 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+// authorizeFirstTransaction turns the paid fixture transaction into an
+// uncaptured authorization expiring at the given time.
+func authorizeFirstTransaction(t *testing.T, test *RouteTest, expiresAt time.Time) *models.Transaction {
+	trans := test.Data.firstTransaction
+	trans.ProcessorID = stripePaymentIntentID
+	trans.Status = models.AuthorizedState
+	trans.AuthorizedAmount = trans.Amount
+	trans.AuthorizationExpiresAt = &expiresAt
+	require.NoError(t, test.DB.Save(trans).Error)
+	require.NoError(t, test.DB.Model(&models.Order{}).Where("id = ?", trans.OrderID).Update("payment_state", models.AuthorizedState).Error)
+	return trans
+}
+
+func TestPaymentAuthorize(t *testing.T) {
+	test := NewRouteTest(t)
+	stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+		switch path {
+		case "/v1/payment_intents":
+			intentParams := params.(*stripe.PaymentIntentParams)
+			assert.Equal(t, string(stripe.PaymentIntentCaptureMethodManual), *intentParams.CaptureMethod)
+			intent := v.(*stripe.PaymentIntent)
+			intent.ID = stripePaymentIntentID
+			intent.Status = stripe.PaymentIntentStatusRequiresCapture
+			return nil
+		default:
+			t.Fatalf("unknown Stripe API call to %s", path)
+			return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+		}
+	}))
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	test.Data.firstOrder.PaymentState = models.PendingState
+	require.NoError(t, test.DB.Save(test.Data.firstOrder).Error, "Failed to update order")
+
+	body, err := json.Marshal(map[string]interface{}{
+		"amount":                   test.Data.firstOrder.Total,
+		"currency":                 test.Data.firstOrder.Currency,
+		"provider":                 payments.StripeProvider,
+		"stripe_payment_method_id": "payment-method-simple",
+		"authorize_only":           true,
+	})
+	require.NoError(t, err)
+
+	recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+	trans := models.Transaction{}
+	extractPayload(t, http.StatusOK, recorder, &trans)
+	assert.Equal(t, models.AuthorizedState, trans.Status)
+	assert.Equal(t, test.Data.firstOrder.Total, trans.AuthorizedAmount)
+	require.NotNil(t, trans.AuthorizationExpiresAt)
+	assert.True(t, trans.AuthorizationExpiresAt.After(time.Now()))
+
+	order := &models.Order{}
+	require.NoError(t, test.DB.Find(order, "id = ?", trans.OrderID).Error)
+	assert.Equal(t, models.AuthorizedState, order.PaymentState)
+}
+
+func TestPaymentCapture(t *testing.T) {
+	url := "/orders/first-order/payments/first-trans/capture"
+
+	t.Run("Partial", func(t *testing.T) {
+		test := NewRouteTest(t)
+		trans := authorizeFirstTransaction(t, test, time.Now().Add(time.Hour))
+		url := "/orders/first-order/payments/" + trans.ID + "/capture"
+
+		captureCalls := 0
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+			switch path {
+			case "/v1/payment_intents/" + stripePaymentIntentID + "/capture":
+				captureCalls++
+				assert.EqualValues(t, 60, *params.(*stripe.PaymentIntentCaptureParams).AmountToCapture)
+				intent := v.(*stripe.PaymentIntent)
+				intent.ID = stripePaymentIntentID
+				intent.Status = stripe.PaymentIntentStatusSucceeded
+				return nil
+			default:
+				t.Fatalf("unknown Stripe API call to %s", path)
+				return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+			}
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodPost, url, bytes.NewBufferString(`{"amount": 60}`), token)
+		captured := models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, &captured)
+		assert.Equal(t, models.PaidState, captured.Status)
+		assert.EqualValues(t, 60, captured.Amount)
+		assert.EqualValues(t, 100, captured.AuthorizedAmount)
+		assert.Equal(t, 1, captureCalls)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.Find(order, "id = ?", trans.OrderID).Error)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+
+		// a captured payment can't be captured again
+		recorder = test.TestEndpoint(http.MethodPost, url, nil, token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+	t.Run("InProgress", func(t *testing.T) {
+		test := NewRouteTest(t)
+		trans := authorizeFirstTransaction(t, test, time.Now().Add(time.Hour))
+		url := "/orders/first-order/payments/" + trans.ID + "/capture"
+		token := testAdminToken("magical-unicorn", "")
+
+		captureCalls := 0
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+			switch path {
+			case "/v1/payment_intents/" + stripePaymentIntentID + "/capture":
+				captureCalls++
+				if captureCalls == 1 {
+					// a second capture while the provider captures the first one
+					assert.NotEqual(t, http.StatusOK, test.TestEndpoint(http.MethodPost, url, nil, token).Code)
+					return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+				}
+				intent := v.(*stripe.PaymentIntent)
+				intent.ID = stripePaymentIntentID
+				intent.Status = stripe.PaymentIntentStatusSucceeded
+				return nil
+			default:
+				t.Fatalf("unknown Stripe API call to %s", path)
+				return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+			}
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		validateError(t, http.StatusInternalServerError, test.TestEndpoint(http.MethodPost, url, nil, token))
+		assert.Equal(t, 1, captureCalls)
+
+		// the authorization can be captured again once the provider failed
+		stored := &models.Transaction{}
+		require.NoError(t, test.DB.First(stored, "id = ?", trans.ID).Error)
+		assert.Equal(t, models.AuthorizedState, stored.Status)
+		assert.Equal(t, http.StatusOK, test.TestEndpoint(http.MethodPost, url, nil, token).Code)
+		assert.Equal(t, 2, captureCalls)
+	})
+	t.Run("OutOfStock", func(t *testing.T) {
+		test := NewRouteTest(t)
+		trans := authorizeFirstTransaction(t, test, time.Now().Add(time.Hour))
+		url := "/orders/first-order/payments/" + trans.ID + "/capture"
+		stock := &models.StockItem{InstanceID: test.Data.firstOrder.InstanceID, Sku: test.Data.firstLineItem.Sku}
+		require.NoError(t, test.DB.Create(stock).Error)
+
+		// the provider isn't asked to capture items that aren't in stock anymore
+		recorder := test.TestEndpoint(http.MethodPost, url, nil, testAdminToken("magical-unicorn", ""))
+		validateError(t, http.StatusBadRequest, recorder, "in stock")
+		stored := &models.Transaction{}
+		require.NoError(t, test.DB.First(stored, "id = ?", trans.ID).Error)
+		assert.Equal(t, models.AuthorizedState, stored.Status)
+	})
+	t.Run("ExceedsAuthorization", func(t *testing.T) {
+		test := NewRouteTest(t)
+		trans := authorizeFirstTransaction(t, test, time.Now().Add(time.Hour))
+		url := "/orders/first-order/payments/" + trans.ID + "/capture"
+
+		recorder := test.TestEndpoint(http.MethodPost, url, bytes.NewBufferString(`{"amount": 101}`), testAdminToken("magical-unicorn", ""))
+		validateError(t, http.StatusBadRequest, recorder, "exceeds the authorized amount")
+	})
+	t.Run("Expired", func(t *testing.T) {
+		test := NewRouteTest(t)
+		trans := authorizeFirstTransaction(t, test, time.Now().Add(-time.Hour))
+		url := "/orders/first-order/payments/" + trans.ID + "/capture"
+
+		recorder := test.TestEndpoint(http.MethodPost, url, nil, testAdminToken("magical-unicorn", ""))
+		validateError(t, http.StatusBadRequest, recorder, "has expired")
+	})
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, url, nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
+func TestPaymentVoid(t *testing.T) {
+	test := NewRouteTest(t)
+	trans := authorizeFirstTransaction(t, test, time.Now().Add(time.Hour))
+
+	stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+		switch path {
+		case "/v1/payment_intents/" + stripePaymentIntentID + "/cancel":
+			v.(*stripe.PaymentIntent).Status = stripe.PaymentIntentStatusCanceled
+			return nil
+		default:
+			t.Fatalf("unknown Stripe API call to %s", path)
+			return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+		}
+	}))
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments/"+trans.ID+"/void", nil, testAdminToken("magical-unicorn", ""))
+	voided := models.Transaction{}
+	extractPayload(t, http.StatusOK, recorder, &voided)
+	assert.Equal(t, models.VoidedState, voided.Status)
+
+	order := &models.Order{}
+	require.NoError(t, test.DB.Find(order, "id = ?", trans.OrderID).Error)
+	assert.Equal(t, models.VoidedState, order.PaymentState)
+}
+
+func TestVoidAuthorizationBeingCaptured(t *testing.T) {
+	test := NewRouteTest(t)
+	trans := authorizeFirstTransaction(t, test, time.Now().Add(time.Hour))
+	// a capture claimed the authorization after it was loaded
+	require.NoError(t, test.DB.Model(&models.Transaction{}).Where("id = ?", trans.ID).UpdateColumn("status", models.CapturingState).Error)
+
+	stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+		t.Fatalf("unknown Stripe API call to %s", path)
+		return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+	}))
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+	require.NoError(t, err)
+	voided, err := voidAuthorization(ctx, test.DB, logrus.StandardLogger(), trans, test.Data.firstOrder)
+	require.NoError(t, err)
+	assert.False(t, voided)
+
+	stored, err := models.GetTransaction(test.DB, trans.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.CapturingState, stored.Status)
+}
+
+func TestVoidExpiredAuthorizations(t *testing.T) {
+	test := NewRouteTest(t)
+	expired := authorizeFirstTransaction(t, test, time.Now().Add(-time.Minute))
+
+	active := models.NewTransaction(test.Data.secondOrder)
+	active.ProcessorID = "active-authorization"
+	active.Status = models.AuthorizedState
+	expiresAt := time.Now().Add(time.Hour)
+	active.AuthorizationExpiresAt = &expiresAt
+	require.NoError(t, test.DB.Create(active).Error)
+
+	cancelCalls := 0
+	stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+		switch path {
+		case "/v1/payment_intents/" + stripePaymentIntentID + "/cancel":
+			cancelCalls++
+			v.(*stripe.PaymentIntent).Status = stripe.PaymentIntentStatusCanceled
+			return nil
+		default:
+			t.Fatalf("unknown Stripe API call to %s", path)
+			return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+		}
+	}))
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+	require.NoError(t, err)
+	api := NewAPIWithVersion(ctx, test.GlobalConfig, logrus.StandardLogger(), test.DB, "")
+	api.voidExpiredAuthorizations(ctx, test.DB, logrus.StandardLogger())
+	assert.Equal(t, 1, cancelCalls)
+
+	trans, err := models.GetTransaction(test.DB, expired.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.VoidedState, trans.Status)
+
+	order := &models.Order{}
+	require.NoError(t, test.DB.Find(order, "id = ?", expired.OrderID).Error)
+	assert.Equal(t, models.VoidedState, order.PaymentState)
+
+	trans, err = models.GetTransaction(test.DB, active.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.AuthorizedState, trans.Status)
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// maxBatchSize limits the number of orders updated with a single batch request
+const maxBatchSize = 1000
+
+// OrderBatchParams holds the orders and the state changes of a batch update
+type OrderBatchParams struct {
+	OrderIDs         []string `json:"order_ids"`
+	FulfillmentState string   `json:"fulfillment_state"`
+	PaymentState     string   `json:"payment_state"`
+}
+
+// OrderBatchResult is the outcome of a batch update for a single order
+type OrderBatchResult struct {
+	OrderID string `json:"order_id"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// batchPaymentStates are the payment states a batch update can move orders
+// to, with the states they can be moved from. Paying, refunding or voiding an
+// order issues invoices, takes stock, grants licenses and moves money, so it
+// only happens through its payments.
+var batchPaymentStates = map[string][]string{
+	models.FailedState: {models.PendingState, models.PendingPaymentState},
+}
+
+// OrderBatchUpdate changes the fulfillment or payment state of many orders at
+// once. Orders that can't be changed are reported in the results, all others
+// are updated in a single transaction. It is only available to admins.
+func (a *API) OrderBatchUpdate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	config := gcontext.GetConfig(ctx)
+	claims := gcontext.GetClaims(ctx)
+	instanceID := gcontext.GetInstanceID(ctx)
+
+	params := &OrderBatchParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read batch params: %v", err)
+	}
+	if len(params.OrderIDs) == 0 {
+		return badRequestError("No order ids provided")
+	}
+	if len(params.OrderIDs) > maxBatchSize {
+		return badRequestError("At most %d orders can be updated at once", maxBatchSize)
+	}
+	if params.FulfillmentState == "" && params.PaymentState == "" {
+		return badRequestError("Either a fulfillment_state or a payment_state is required")
+	}
+	if params.FulfillmentState != "" && !contains(models.FulfillmentStates, params.FulfillmentState) {
+		return badRequestError("Bad fulfillment state: %s", params.FulfillmentState)
+	}
+	if params.PaymentState != "" && !contains(models.PaymentStates, params.PaymentState) {
+		return badRequestError("Bad payment state: %s", params.PaymentState)
+	}
+	if _, ok := batchPaymentStates[params.PaymentState]; params.PaymentState != "" && !ok {
+		return badRequestError("Orders can't be moved to the payment state %s in a batch", params.PaymentState)
+	}
+
+	tx := a.DB(r).Begin()
+	orders := []*models.Order{}
+	if rsp := tx.Where("id IN (?) AND instance_id = ?", params.OrderIDs, instanceID).Find(&orders); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error while querying for orders").WithInternalError(rsp.Error)
+	}
+	found := make(map[string]*models.Order, len(orders))
+	for _, order := range orders {
+		found[order.ID] = order
+	}
+
+	results := make([]*OrderBatchResult, 0, len(params.OrderIDs))
+	applied := map[string]*OrderBatchResult{}
+	readyForPickup := []*models.Order{}
+	updated := 0
+	for _, id := range params.OrderIDs {
+		result := &OrderBatchResult{OrderID: id}
+		results = append(results, result)
+
+		// duplicate ids in the batch are only applied once
+		if first, ok := applied[id]; ok {
+			*result = *first
+			continue
+		}
+		order, ok := found[id]
+		if !ok {
+			result.Error = "Order not found"
+			continue
+		}
+		if order.State == models.CancelledState {
+			result.Error = "Order has been cancelled"
+			continue
+		}
+		if params.FulfillmentState != "" && !order.FulfillmentStateAllowed(params.FulfillmentState) {
+			result.Error = "Fulfillment state doesn't apply to this order"
+			continue
+		}
+		if params.PaymentState != "" && params.PaymentState != order.PaymentState && !contains(batchPaymentStates[params.PaymentState], order.PaymentState) {
+			result.Error = "Payment state doesn't apply to this order"
+			continue
+		}
+		applied[id] = result
+
+		fields := map[string]interface{}{}
+		changes := []string{}
+		if params.FulfillmentState != "" && params.FulfillmentState != order.FulfillmentState {
+			if params.FulfillmentState == models.ReadyForPickupState {
+				readyForPickup = append(readyForPickup, order)
+			}
+			order.FulfillmentState = params.FulfillmentState
+			fields["fulfillment_state"] = params.FulfillmentState
+			changes = append(changes, "fulfillment_state")
+		}
+		previousPaymentState := order.PaymentState
+		if params.PaymentState != "" && params.PaymentState != order.PaymentState {
+			order.PaymentState = params.PaymentState
+			fields["payment_state"] = params.PaymentState
+			changes = append(changes, "payment_state")
+		}
+		if len(changes) == 0 {
+			result.Success = true
+			continue
+		}
+
+		// a payment completing meanwhile keeps the order from being updated
+		rsp := tx.Model(&models.Order{}).Where("id = ? AND payment_state = ?", order.ID, previousPaymentState).Updates(fields)
+		if rsp.Error != nil {
+			tx.Rollback()
+			return internalServerError("Error updating order %s", order.ID).WithInternalError(rsp.Error)
+		}
+		if rsp.RowsAffected == 0 {
+			result.Error = "Order has been changed meanwhile"
+			continue
+		}
+		result.Success = true
+		models.LogEvent(tx, r.RemoteAddr, claims.Subject, order.ID, models.EventUpdated, changes)
+		if config.Webhooks.Update != "" {
+			hook, err := models.NewHook("update", config.SiteURL, config.Webhooks.Update, order.UserID, config.Webhooks.Secret, order)
+			if err != nil {
+				log.WithError(err).Error("Failed to process webhook")
+			} else {
+				tx.Save(hook)
+			}
+		}
+		updated++
+	}
+
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error committing batch update").WithInternalError(rsp.Error)
+	}
+	for _, order := range readyForPickup {
+		notifyReadyForPickup(r.Context(), a.DB(r), log, order)
+	}
+
+	log.WithField("updated", updated).Infof("Batch updated %d orders", updated)
+	return sendJSON(w, http.StatusOK, map[string]interface{}{"results": results})
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestOrderBatchUpdate(t *testing.T) {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	t.Run("Shipped", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Webhooks.Update = "https://example.com/update"
+		require.NoError(t, test.DB.Model(test.Data.secondOrder).Update("state", models.CancelledState).Error)
+
+		body := strings.NewReader(`{"order_ids": ["first-order", "second-order", "missing-order"], "fulfillment_state": "shipped"}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/batch", body, token)
+		payload := struct {
+			Results []OrderBatchResult `json:"results"`
+		}{}
+		extractPayload(t, http.StatusOK, recorder, &payload)
+		require.Len(t, payload.Results, 3)
+		assert.Equal(t, OrderBatchResult{OrderID: "first-order", Success: true}, payload.Results[0])
+		assert.False(t, payload.Results[1].Success)
+		assert.Contains(t, payload.Results[1].Error, "cancelled")
+		assert.False(t, payload.Results[2].Success)
+		assert.Contains(t, payload.Results[2].Error, "not found")
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, models.ShippedState, order.FulfillmentState)
+		order = &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.secondOrder.ID).Error)
+		assert.Equal(t, models.PendingState, order.FulfillmentState)
+
+		event := &models.Event{}
+		require.NoError(t, test.DB.Where("order_id = ?", test.Data.firstOrder.ID).Last(event).Error)
+		assert.Equal(t, "fulfillment_state", event.Changes)
+
+		var hooks int
+		require.NoError(t, test.DB.Model(&models.Hook{}).Where("type = ?", "update").Count(&hooks).Error)
+		assert.Equal(t, 1, hooks)
+	})
+	t.Run("PaymentState", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(test.Data.secondOrder).Update("payment_state", models.PendingState).Error)
+
+		body := strings.NewReader(`{"order_ids": ["second-order", "second-order", "first-order"], "payment_state": "failed"}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/batch", body, token)
+		payload := struct {
+			Results []OrderBatchResult `json:"results"`
+		}{}
+		extractPayload(t, http.StatusOK, recorder, &payload)
+		require.Len(t, payload.Results, 3)
+		assert.True(t, payload.Results[0].Success)
+		assert.True(t, payload.Results[1].Success)
+		// paid orders only fail through their payments
+		assert.False(t, payload.Results[2].Success)
+		assert.Contains(t, payload.Results[2].Error, "Payment state")
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.secondOrder.ID).Error)
+		assert.Equal(t, models.FailedState, order.PaymentState)
+		order = &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+	})
+	t.Run("PaidState", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := strings.NewReader(`{"order_ids": ["first-order"], "payment_state": "paid"}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/batch", body, token)
+		validateError(t, http.StatusBadRequest, recorder, "payment state paid")
+	})
+	t.Run("InvalidState", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := strings.NewReader(`{"order_ids": ["first-order"], "fulfillment_state": "lost"}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/batch", body, token)
+		validateError(t, http.StatusBadRequest, recorder, "Bad fulfillment state")
+	})
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := strings.NewReader(`{"order_ids": ["first-order"], "fulfillment_state": "shipped"}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/batch", body, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
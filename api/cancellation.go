@@ -0,0 +1,144 @@
+package api
+
+import (
+	"net/http"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// OrderCancel cancels an order that hasn't shipped yet. Authorized payments
+// are voided and paid ones refunded with their provider, pending ones are
+// cancelled, the items of the order go back into stock, its downloads are
+// revoked and the cancelled webhook is triggered.
+func (a *API) OrderCancel(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	config := gcontext.GetConfig(ctx)
+	orderID := gcontext.GetOrderID(ctx)
+
+	var subject string
+	if claims := gcontext.GetClaims(ctx); claims != nil {
+		subject = claims.Subject
+	}
+
+	tx := a.DB(r).Begin()
+	order := &models.Order{}
+	if rsp := orderQuery(tx).First(order, "id = ?", orderID); rsp.Error != nil {
+		tx.Rollback()
+		if rsp.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error while querying for order").WithInternalError(rsp.Error)
+	}
+	if order.State == models.CancelledState {
+		tx.Rollback()
+		return badRequestError("This order has already been cancelled")
+	}
+	if order.FulfillmentState == models.ShippedState || order.FulfillmentState == models.DeliveredState {
+		tx.Rollback()
+		return badRequestError("Shipped orders can't be cancelled")
+	}
+	if order.FulfillmentState == models.PickedUpState {
+		tx.Rollback()
+		return badRequestError("Picked up orders can't be cancelled")
+	}
+	for _, trans := range order.Transactions {
+		if trans.Type != models.ChargeTransactionType {
+			continue
+		}
+		switch trans.Status {
+		case models.ProcessingState:
+			tx.Rollback()
+			return badRequestError("The payment of this order is still processing")
+		case models.CapturingState, models.FinalizingState:
+			tx.Rollback()
+			return httpError(http.StatusConflict, "The payment of this order is being completed")
+		case models.PendingState, models.PendingApprovalState, models.PendingPaymentState:
+			// payments that complete later find their transaction cancelled
+			rsp := tx.Model(&models.Transaction{}).
+				Where("id = ? AND status = ?", trans.ID, trans.Status).
+				UpdateColumn("status", models.CancelledState)
+			if rsp.Error != nil {
+				tx.Rollback()
+				return internalServerError("Error cancelling the pending payment").WithInternalError(rsp.Error)
+			}
+			if rsp.RowsAffected == 0 {
+				tx.Rollback()
+				return httpError(http.StatusConflict, "The payment of this order is being completed")
+			}
+			trans.Status = models.CancelledState
+		}
+	}
+
+	for _, trans := range order.Transactions {
+		if trans.Type != models.ChargeTransactionType {
+			continue
+		}
+		log := log.WithField("transaction_id", trans.ID)
+		var err error
+		switch {
+		case trans.Status == models.AuthorizedState:
+			var voided bool
+			voided, err = voidAuthorization(ctx, tx, log, trans, order)
+			if err != nil {
+				break
+			}
+			if !voided {
+				tx.Commit()
+				return httpError(http.StatusConflict, "The authorization of this order is being captured or voided")
+			}
+			tx.Model(&models.Order{}).Where("id = ?", order.ID).Update("payment_state", models.VoidedState)
+			models.LogEvent(tx, "", trans.UserID, order.ID, models.EventUpdated, []string{"payment_state"})
+		case trans.Status == models.PaidState && trans.RefundableAmount() > 0:
+			_, err = refundCharge(r, tx, log, trans, order, trans.RefundableAmount(), subject)
+		default:
+			continue
+		}
+		if err != nil {
+			// keep the voids and refunds that went through
+			tx.Commit()
+			return internalServerError("Error on provider while cancelling the payment: %v. Try again later.", err).WithInternalError(err)
+		}
+	}
+
+	order.State = models.CancelledState
+	tx.Model(&models.Order{}).Where("id = ?", order.ID).Update("state", models.CancelledState)
+	tx.Model(&models.Download{}).Where("order_id = ?", order.ID).Update("revoked", true)
+	if err := models.ReleaseStockReservations(tx, order.ID); err != nil {
+		tx.Rollback()
+		return internalServerError("Error releasing stock").WithInternalError(err)
+	}
+	returned, err := models.ReturnStockAllocations(tx, order.ID)
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Error returning the items of the order to stock").WithInternalError(err)
+	}
+	if len(returned) > 0 {
+		alertLowStock(ctx, tx, log, order.InstanceID, returned)
+	}
+	for i := range order.Downloads {
+		order.Downloads[i].Revoked = true
+	}
+	models.LogEvent(tx, r.RemoteAddr, subject, order.ID, models.EventUpdated, []string{"state"})
+
+	if config.Webhooks.Cancelled != "" {
+		hook, err := models.NewHook("cancelled", config.SiteURL, config.Webhooks.Cancelled, order.UserID, config.Webhooks.Secret, order)
+		if err != nil {
+			log.WithError(err).Error("Failed to process webhook")
+		} else {
+			tx.Save(hook)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return internalServerError("Error cancelling order").WithInternalError(err)
+	}
+
+	// reload the payment state changed by voids and refunds
+	order = &models.Order{}
+	if rsp := orderQuery(a.DB(r)).First(order, "id = ?", orderID); rsp.Error != nil {
+		return internalServerError("Error while querying for order").WithInternalError(rsp.Error)
+	}
+	log.Info("Cancelled order")
+	return sendJSON(w, http.StatusOK, order)
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestOrderCancel(t *testing.T) {
+	url := "/orders/first-order/cancel"
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	setup := func(t *testing.T, calls map[string]int) *RouteTest {
+		test := NewRouteTest(t)
+		test.Config.Webhooks.Cancelled = "https://example.com/cancelled"
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+			calls[path]++
+			switch path {
+			case "/v1/refunds":
+				v.(*stripe.Refund).ID = "stripe-refund"
+				return nil
+			case "/v1/payment_intents/" + stripePaymentIntentID + "/cancel":
+				v.(*stripe.PaymentIntent).Status = stripe.PaymentIntentStatusCanceled
+				return nil
+			default:
+				t.Fatalf("unknown Stripe API call to %s", path)
+				return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+			}
+		}))
+		return test
+	}
+
+	t.Run("Paid", func(t *testing.T) {
+		calls := map[string]int{}
+		test := setup(t, calls)
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		recorder := test.TestEndpoint(http.MethodPost, url, nil, token)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, models.CancelledState, order.State)
+		assert.Equal(t, models.RefundedState, order.PaymentState)
+		require.Len(t, order.Downloads, 1)
+		assert.True(t, order.Downloads[0].Revoked)
+		assert.Equal(t, 1, calls["/v1/refunds"])
+
+		refunds := []models.Transaction{}
+		require.NoError(t, test.DB.Where("parent_id = ?", test.Data.firstTransaction.ID).Find(&refunds).Error)
+		require.Len(t, refunds, 1)
+		assert.Equal(t, test.Data.firstTransaction.Amount, refunds[0].Amount)
+		assert.Equal(t, "stripe-refund", refunds[0].ProcessorID)
+
+		hook := &models.Hook{}
+		require.NoError(t, test.DB.Where("type = ?", "cancelled").First(hook).Error)
+		assert.Contains(t, hook.Payload, `"state":"cancelled"`)
+	})
+	t.Run("Authorized", func(t *testing.T) {
+		calls := map[string]int{}
+		test := setup(t, calls)
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+		trans := authorizeFirstTransaction(t, test, time.Now().Add(time.Hour))
+
+		recorder := test.TestEndpoint(http.MethodPost, url, nil, token)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, models.CancelledState, order.State)
+		assert.Equal(t, models.VoidedState, order.PaymentState)
+		assert.Equal(t, 1, calls["/v1/payment_intents/"+stripePaymentIntentID+"/cancel"])
+		assert.Equal(t, 0, calls["/v1/refunds"])
+
+		stored, err := models.GetTransaction(test.DB, trans.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.VoidedState, stored.Status)
+	})
+	t.Run("Pending", func(t *testing.T) {
+		calls := map[string]int{}
+		test := setup(t, calls)
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+		test.Config.Payment.Stripe.WebhookSecret = testStripeWebhookSecret
+		trans := test.Data.firstTransaction
+		trans.ProcessorID = stripePaymentIntentID
+		trans.Status = models.PendingState
+		require.NoError(t, test.DB.Save(trans).Error)
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).Update("payment_state", models.PendingState).Error)
+
+		recorder := test.TestEndpoint(http.MethodPost, url, nil, token)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, models.CancelledState, order.State)
+		assert.Equal(t, 0, calls["/v1/refunds"])
+
+		// a payment completing after the cancellation doesn't pay the order
+		recorder = runStripeWebhook(test, "payment_intent.succeeded", `{"id":"`+stripePaymentIntentID+`","object":"payment_intent"}`)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		stored, err := models.GetTransaction(test.DB, trans.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.CancelledState, stored.Status)
+		require.NoError(t, test.DB.First(order, "id = ?", trans.OrderID).Error)
+		assert.Equal(t, models.PendingState, order.PaymentState)
+	})
+	t.Run("Capturing", func(t *testing.T) {
+		calls := map[string]int{}
+		test := setup(t, calls)
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+		trans := authorizeFirstTransaction(t, test, time.Now().Add(time.Hour))
+		require.NoError(t, test.DB.Model(trans).UpdateColumn("status", models.CapturingState).Error)
+
+		recorder := test.TestEndpoint(http.MethodPost, url, nil, token)
+		validateError(t, http.StatusConflict, recorder)
+		assert.Equal(t, 0, calls["/v1/payment_intents/"+stripePaymentIntentID+"/cancel"])
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", trans.OrderID).Error)
+		assert.NotEqual(t, models.CancelledState, order.State)
+	})
+	t.Run("ReturnsStock", func(t *testing.T) {
+		calls := map[string]int{}
+		test := setup(t, calls)
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+		sku := test.Data.firstLineItem.Sku
+		stock := &models.StockItem{InstanceID: test.Data.firstOrder.InstanceID, Sku: sku, Quantity: 3}
+		require.NoError(t, test.DB.Create(stock).Error)
+		require.NoError(t, test.DB.Create(&models.StockAllocation{InstanceID: stock.InstanceID, OrderID: test.Data.firstOrder.ID, Sku: sku, Quantity: 2}).Error)
+
+		recorder := test.TestEndpoint(http.MethodPost, url, nil, token)
+		extractPayload(t, http.StatusOK, recorder, &models.Order{})
+		require.NoError(t, test.DB.First(stock, "id = ?", stock.ID).Error)
+		assert.EqualValues(t, 5, stock.Quantity)
+		var allocations int
+		require.NoError(t, test.DB.Model(&models.StockAllocation{}).Where("order_id = ?", test.Data.firstOrder.ID).Count(&allocations).Error)
+		assert.Equal(t, 0, allocations)
+	})
+	t.Run("AlreadyCancelled", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).Update("state", models.CancelledState).Error)
+		recorder := test.TestEndpoint(http.MethodPost, url, nil, token)
+		validateError(t, http.StatusBadRequest, recorder, "already been cancelled")
+	})
+	t.Run("Shipped", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).Update("fulfillment_state", models.ShippedState).Error)
+		recorder := test.TestEndpoint(http.MethodPost, url, nil, token)
+		validateError(t, http.StatusBadRequest, recorder, "Shipped orders")
+	})
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, url, nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
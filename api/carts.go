@@ -0,0 +1,245 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+
+	"github.com/netlify/gocommerce/calculator"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+type cartRequestParams struct {
+	Currency   string           `json:"currency"`
+	CouponCode string           `json:"coupon"`
+	Country    string           `json:"country"`
+	Items      []*orderLineItem `json:"items"`
+}
+
+// cartItemsParams replaces the items of a cart. The coupon and the country
+// are kept unless they are given.
+type cartItemsParams struct {
+	CouponCode *string          `json:"coupon"`
+	Country    *string          `json:"country"`
+	Items      []*orderLineItem `json:"items"`
+}
+
+// CartCreate creates a new cart and prices its items.
+func (a *API) CartCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	params := &cartRequestParams{Currency: "USD"}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read cart params: %v", err)
+	}
+
+	userID := ""
+	if claims := gcontext.GetClaims(ctx); claims != nil && !isAPIKeySubject(claims.Subject) {
+		userID = claims.Subject
+	}
+	cart := models.NewCart(gcontext.GetInstanceID(ctx), userID, params.Currency)
+	cart.CouponCode = params.CouponCode
+	cart.Country = params.Country
+	cart.Items = cartItems(params.Items)
+
+	if err := a.priceCart(w, r, cart); err != nil {
+		return err
+	}
+	if rsp := a.DB(r).Create(cart); rsp.Error != nil {
+		return internalServerError("Error saving cart").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusCreated, cart)
+}
+
+// CartView returns a cart with its current prices.
+func (a *API) CartView(w http.ResponseWriter, r *http.Request) error {
+	cart, httpErr := a.loadCart(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	return sendJSON(w, http.StatusOK, cart)
+}
+
+// CartItemsUpdate replaces the items of a cart and prices them again.
+func (a *API) CartItemsUpdate(w http.ResponseWriter, r *http.Request) error {
+	params := &cartItemsParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read cart items: %v", err)
+	}
+
+	cart, httpErr := a.loadCart(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if cart.CheckedOut() {
+		return badRequestError("This cart has already been checked out")
+	}
+
+	if params.CouponCode != nil {
+		cart.CouponCode = *params.CouponCode
+	}
+	if params.Country != nil {
+		cart.Country = *params.Country
+	}
+	cart.Items = cartItems(params.Items)
+
+	if err := a.priceCart(w, r, cart); err != nil {
+		return err
+	}
+	if rsp := a.DB(r).Save(cart); rsp.Error != nil {
+		return internalServerError("Error saving cart").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, cart)
+}
+
+// CartCheckout converts a cart into an order. It takes the same params as
+// the creation of an order, but the line items, currency and coupon are
+// taken from the cart.
+func (a *API) CartCheckout(w http.ResponseWriter, r *http.Request) error {
+	log := getLogEntry(r)
+	params := &orderRequestParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read Order params: %v", err)
+	}
+
+	cart, httpErr := a.loadCart(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if cart.CheckedOut() {
+		return badRequestError("This cart has already been checked out with order %s", cart.OrderID)
+	}
+	if len(cart.Items) == 0 {
+		return badRequestError("Can't check out an empty cart")
+	}
+
+	params.Currency = cart.Currency
+	params.CouponCode = cart.CouponCode
+	params.LineItems = orderLineItems(cart.Items)
+	order, err := a.createOrder(w, r, params, func(tx *gorm.DB, order *models.Order) *HTTPError {
+		rsp := tx.Model(&models.Cart{}).Where("id = ? AND order_id = ''", cart.ID).UpdateColumn("order_id", order.ID)
+		if rsp.Error != nil {
+			return internalServerError("Error checking out cart").WithInternalError(rsp.Error)
+		}
+		if rsp.RowsAffected == 0 {
+			return httpError(http.StatusConflict, "This cart has already been checked out")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	cart.OrderID = order.ID
+	log.WithField("order_id", order.ID).Infof("Checked out cart %s", cart.ID)
+	return sendJSON(w, http.StatusCreated, order)
+}
+
+// priceCart prices the items of the cart the way they'd be priced by a new
+// order, taking the claims of the user and the coupon of the cart into account.
+func (a *API) priceCart(w http.ResponseWriter, r *http.Request, cart *models.Cart) error {
+	order, _, err := a.cartOrder(w, r, cart)
+	if err != nil {
+		return err
+	}
+	cart.ApplyPrices(order)
+	return nil
+}
+
+// cartOrder returns the items of the cart priced as a new order, along with
+// the settings they were priced with.
+func (a *API) cartOrder(w http.ResponseWriter, r *http.Request, cart *models.Cart) (*models.Order, *calculator.Settings, error) {
+	ctx := r.Context()
+	log := getLogEntry(r)
+
+	order := models.NewOrder(cart.InstanceID, "", "", cart.Currency)
+	order.UserID = cart.UserID
+	order.ShippingAddress.Country = cart.Country
+	if httpError := setTaxExemption(a.DB(r), gcontext.GetConfig(ctx), order); httpError != nil {
+		return nil, nil, httpError
+	}
+	group, httpError := customerGroup(a.DB(r), gcontext.GetClaims(ctx))
+	if httpError != nil {
+		return nil, nil, httpError
+	}
+	order.CustomerGroup = group
+	if cart.CouponCode != "" {
+		coupon, err := a.lookupCoupon(ctx, w, cart.CouponCode)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !coupon.Valid() {
+			return nil, nil, badRequestError("This coupon is not valid at this time")
+		}
+		order.CouponCode = coupon.Code
+		order.Coupon = coupon
+	}
+
+	if httpError := a.processLineItems(ctx, order, orderLineItems(cart.Items)); httpError != nil {
+		return nil, nil, httpError
+	}
+	settings, err := a.loadSettings(ctx)
+	if err != nil {
+		return nil, nil, internalServerError(err.Error()).WithInternalError(err)
+	}
+	order.CalculateTotal(settings, gcontext.GetClaimsAsMap(ctx), log)
+	applyTaxBackend(gcontext.GetConfig(ctx), settings, log, order)
+	return order, settings, nil
+}
+
+func (a *API) loadCart(r *http.Request) (*models.Cart, *HTTPError) {
+	return a.loadCartByID(r, chi.URLParam(r, "cart_id"))
+}
+
+func (a *API) loadCartByID(r *http.Request, id string) (*models.Cart, *HTTPError) {
+	ctx := r.Context()
+	cart, err := models.GetCart(a.DB(r), id)
+	if err != nil {
+		return nil, internalServerError("Error while querying for cart").WithInternalError(err)
+	}
+	if cart == nil || cart.InstanceID != gcontext.GetInstanceID(ctx) {
+		return nil, notFoundError("Cart not found")
+	}
+
+	if cart.UserID != "" && !gcontext.IsAdmin(ctx) {
+		claims := gcontext.GetClaims(ctx)
+		if claims == nil || claims.Subject != cart.UserID {
+			return nil, unauthorizedError("You don't have access to this cart")
+		}
+	}
+	return cart, nil
+}
+
+func cartItems(items []*orderLineItem) []*models.CartItem {
+	cartItems := make([]*models.CartItem, len(items))
+	for i, item := range items {
+		cartItems[i] = &models.CartItem{
+			Sku:      item.Sku,
+			Path:     item.Path,
+			Quantity: item.Quantity,
+			MetaData: item.MetaData,
+		}
+		for _, addon := range item.Addons {
+			cartItems[i].Addons = append(cartItems[i].Addons, models.CartAddon{Sku: addon.Sku})
+		}
+	}
+	return cartItems
+}
+
+func orderLineItems(items []*models.CartItem) []*orderLineItem {
+	lineItems := make([]*orderLineItem, len(items))
+	for i, item := range items {
+		lineItems[i] = &orderLineItem{
+			Sku:      item.Sku,
+			Path:     item.Path,
+			Quantity: item.Quantity,
+			MetaData: item.MetaData,
+		}
+		for _, addon := range item.Addons {
+			lineItems[i].Addons = append(lineItems[i].Addons, orderAddon{Sku: addon.Sku})
+		}
+	}
+	return lineItems
+}
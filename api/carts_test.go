@@ -0,0 +1,146 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestCarts(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+
+	createCart := func(t *testing.T, test *RouteTest, body string) *models.Cart {
+		recorder := test.TestEndpoint(http.MethodPost, "/carts", strings.NewReader(body), test.Data.testUserToken)
+		cart := &models.Cart{}
+		extractPayload(t, http.StatusCreated, recorder, cart)
+		return cart
+	}
+
+	t.Run("Create", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		cart := createCart(t, test, `{"country": "Germany", "items": [{"path": "/simple-product", "quantity": 1}]}`)
+		assert.Equal(t, "USD", cart.Currency)
+		assert.Equal(t, test.Data.testUser.ID, cart.UserID)
+		assert.EqualValues(t, 1069, cart.Total)
+		assert.EqualValues(t, 70, cart.Taxes)
+		require.Len(t, cart.Items, 1)
+		assert.Equal(t, "product-1", cart.Items[0].Sku)
+		assert.EqualValues(t, 999, cart.Items[0].Price)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/carts/"+cart.ID, nil, test.Data.testUserToken)
+		stored := &models.Cart{}
+		extractPayload(t, http.StatusOK, recorder, stored)
+		assert.EqualValues(t, 1069, stored.Total)
+		require.Len(t, stored.Items, 1)
+	})
+	t.Run("TaxExempt", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		require.NoError(t, test.DB.Model(test.Data.testUser).Updates(map[string]interface{}{"tax_exempt": true, "tax_exemption_certificate": "EX-123"}).Error)
+		cart := createCart(t, test, `{"country": "Germany", "items": [{"path": "/simple-product", "quantity": 1}]}`)
+		assert.EqualValues(t, 999, cart.Total)
+		assert.EqualValues(t, 0, cart.Taxes)
+	})
+	t.Run("UpdateItems", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		couponServer := startCouponList("SPECIAL-EVENT", 10)
+		defer couponServer.Close()
+		test.Config.Coupons.URL = couponServer.URL
+
+		cart := createCart(t, test, `{"items": [{"path": "/simple-product", "quantity": 1}]}`)
+		assert.EqualValues(t, 999, cart.Total)
+
+		body := strings.NewReader(`{"coupon": "SPECIAL-EVENT", "items": [{"path": "/simple-product", "quantity": 2}]}`)
+		recorder := test.TestEndpoint(http.MethodPut, "/carts/"+cart.ID+"/items", body, test.Data.testUserToken)
+		updated := &models.Cart{}
+		extractPayload(t, http.StatusOK, recorder, updated)
+		assert.EqualValues(t, 2*899, updated.Total)
+		assert.EqualValues(t, 2*100, updated.Discount)
+		require.Len(t, updated.Items, 1)
+		assert.EqualValues(t, 2, updated.Items[0].Quantity)
+	})
+	t.Run("Checkout", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		cart := createCart(t, test, `{"country": "Germany", "items": [{"path": "/simple-product", "quantity": 1}]}`)
+
+		body := `{
+			"email": "info@example.com",
+			"shipping_address": {
+				"name": "Test User",
+				"address1": "Branengebranen",
+				"city": "Berlin", "country": "Germany", "zip": "94107"
+			}
+		}`
+		recorder := test.TestEndpoint(http.MethodPost, "/carts/"+cart.ID+"/checkout", strings.NewReader(body), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, cart.Total, order.Total)
+		assert.Equal(t, cart.Taxes, order.Taxes)
+		require.Len(t, order.LineItems, 1)
+		assert.Equal(t, "product-1", order.LineItems[0].Sku)
+
+		stored, err := models.GetCart(test.DB, cart.ID)
+		require.NoError(t, err)
+		assert.Equal(t, order.ID, stored.OrderID)
+
+		recorder = test.TestEndpoint(http.MethodPost, "/carts/"+cart.ID+"/checkout", strings.NewReader(body), test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "already been checked out")
+	})
+	t.Run("CheckedOutMeanwhile", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		cart := createCart(t, test, `{"country": "Germany", "items": [{"path": "/simple-product", "quantity": 1}]}`)
+
+		// another checkout completes while the order is created
+		site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/gocommerce/settings.json" {
+				require.NoError(t, test.DB.Model(cart).UpdateColumn("order_id", "other-order").Error)
+				fmt.Fprintln(w, `{}`)
+				return
+			}
+			handleTestProducts(w, r)
+		}))
+		defer site.Close()
+		test.Config.SiteURL = site.URL
+
+		orders := 0
+		require.NoError(t, test.DB.Model(&models.Order{}).Count(&orders).Error)
+		body := `{"email": "info@example.com", "shipping_address": {"name": "Test User", "address1": "Branengebranen", "city": "Berlin", "country": "Germany", "zip": "94107"}}`
+		recorder := test.TestEndpoint(http.MethodPost, "/carts/"+cart.ID+"/checkout", strings.NewReader(body), test.Data.testUserToken)
+		validateError(t, http.StatusConflict, recorder, "already been checked out")
+
+		after := 0
+		require.NoError(t, test.DB.Model(&models.Order{}).Count(&after).Error)
+		assert.Equal(t, orders, after)
+		stored, err := models.GetCart(test.DB, cart.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "other-order", stored.OrderID)
+	})
+	t.Run("OtherUser", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		cart := createCart(t, test, `{"items": [{"path": "/simple-product", "quantity": 1}]}`)
+
+		token := testToken("stranger-danger", "stranger@example.com")
+		recorder := test.TestEndpoint(http.MethodGet, "/carts/"+cart.ID, nil, token)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+	t.Run("UnknownProduct", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		body := strings.NewReader(`{"items": [{"path": "/missing-product", "quantity": 1}]}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/carts", body, test.Data.testUserToken)
+		validateError(t, http.StatusInternalServerError, recorder)
+	})
+}
@@ -1,17 +1,35 @@
 package api
 
 import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"context"
 
 	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/calculator"
 	gcontext "github.com/netlify/gocommerce/context"
 	"github.com/netlify/gocommerce/coupons"
 	"github.com/netlify/gocommerce/models"
+	"github.com/sirupsen/logrus"
 )
 
+// lookupCoupon returns the coupon with the code stored in the database, or
+// from the coupons settings file of the site if there is none.
 func (a *API) lookupCoupon(ctx context.Context, w http.ResponseWriter, code string) (*models.Coupon, error) {
+	stored, err := models.FindCoupon(gcontext.GetDB(ctx), gcontext.GetInstanceID(ctx), code)
+	if err != nil {
+		return nil, internalServerError("Error fetching coupon").WithInternalError(err)
+	}
+	if stored != nil {
+		return stored, nil
+	}
+
 	couponCache := gcontext.GetCoupons(ctx)
 	if couponCache == nil {
 		return nil, notFoundError("No coupons available")
@@ -30,6 +48,78 @@ func (a *API) lookupCoupon(ctx context.Context, w http.ResponseWriter, code stri
 	return coupon, nil
 }
 
+// couponUser returns the ID of the user of the order, or the email of guests,
+// which the uses of coupons are counted by.
+func couponUser(order *models.Order) string {
+	if order.UserID != "" {
+		return order.UserID
+	}
+	return strings.ToLower(order.Email)
+}
+
+// checkCouponUses returns an error if any of the coupons can't be used for
+// another order of the user of the order.
+func checkCouponUses(tx *gorm.DB, order *models.Order, coupons []*models.Coupon) *HTTPError {
+	for _, coupon := range coupons {
+		if coupon.ID == 0 {
+			continue
+		}
+		switch err := models.CheckCouponUses(tx, coupon, couponUser(order)); err {
+		case nil:
+		case models.ErrCouponUsedUp:
+			return badRequestError("%v", err).WithReason("max_uses")
+		case models.ErrCouponUserLimitHit:
+			return badRequestError("%v", err).WithReason("max_uses_per_user")
+		default:
+			return internalServerError("Error fetching coupon uses").WithInternalError(err)
+		}
+	}
+	return nil
+}
+
+// redeemCoupons counts a use of the coupons of the order within the
+// transaction that marks it as paid.
+func redeemCoupons(tx *gorm.DB, log logrus.FieldLogger, order *models.Order) {
+	coupons, err := models.OrderCoupons(tx, order)
+	if err != nil {
+		log.WithError(err).Error("Failed to load the coupons of the order")
+		return
+	}
+	for _, coupon := range coupons {
+		switch err := models.RedeemCoupon(tx, coupon, couponUser(order)); err {
+		case nil:
+		case models.ErrCouponUsedUp, models.ErrCouponUserLimitHit:
+			// the limit was hit by a concurrent payment after this one was checked
+			log.WithError(err).Warnf("Order was paid with coupon %s after it was used up", coupon.Code)
+		default:
+			log.WithError(err).Errorf("Failed to count the use of coupon %s", coupon.Code)
+		}
+	}
+}
+
+// lookupCoupons returns the valid coupons with the codes, leaving out
+// duplicate codes.
+func (a *API) lookupCoupons(ctx context.Context, w http.ResponseWriter, codes []string) ([]*models.Coupon, error) {
+	result := []*models.Coupon{}
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if code == "" || seen[code] {
+			continue
+		}
+		seen[code] = true
+
+		coupon, err := a.lookupCoupon(ctx, w, code)
+		if err != nil {
+			return nil, err
+		}
+		if !coupon.Valid() {
+			return nil, badRequestError("This coupon is not valid at this time")
+		}
+		result = append(result, coupon)
+	}
+	return result, nil
+}
+
 // CouponView returns information about a single coupon code.
 func (a *API) CouponView(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
@@ -44,21 +134,400 @@ func (a *API) CouponView(w http.ResponseWriter, r *http.Request) error {
 	return sendJSON(w, http.StatusOK, coupon)
 }
 
-// CouponList returns all the coupons for the site. Requires admin permissions
+// Reasons a coupon doesn't apply to a cart. The usage limit reasons are the
+// same as those orders are rejected with.
+const (
+	couponReasonNotFound      = "not_found"
+	couponReasonNotStarted    = "not_started"
+	couponReasonExpired       = "expired"
+	couponReasonUsedUp        = "max_uses"
+	couponReasonUserLimitHit  = "max_uses_per_user"
+	couponReasonBelowMinimum  = "below_minimum"
+	couponReasonWrongProducts = "wrong_products"
+)
+
+// CouponCheckParams holds the cart a coupon is checked against.
+type CouponCheckParams struct {
+	Email     string           `json:"email"`
+	Currency  string           `json:"currency"`
+	Country   string           `json:"country"`
+	LineItems []*orderLineItem `json:"line_items"`
+}
+
+// couponCheck is the result of checking a coupon against a cart. Reason and
+// Message tell why the coupon doesn't apply if it isn't valid, Discount is the
+// discount it gives otherwise.
+type couponCheck struct {
+	Code     string `json:"code"`
+	Valid    bool   `json:"valid"`
+	Reason   string `json:"reason,omitempty"`
+	Message  string `json:"message,omitempty"`
+	Currency string `json:"currency"`
+	Subtotal uint64 `json:"subtotal"`
+	Discount uint64 `json:"discount"`
+}
+
+func (c *couponCheck) reject(reason, message string) *couponCheck {
+	c.Valid = false
+	c.Reason = reason
+	c.Message = message
+	c.Discount = 0
+	return c
+}
+
+// CouponCheck checks whether a coupon applies to a cart, returning the
+// discount it gives or why it doesn't apply.
+func (a *API) CouponCheck(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	db := a.DB(r)
+	code := chi.URLParam(r, "coupon_code")
+
+	params := &CouponCheckParams{Currency: "USD"}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read coupon check params: %v", err)
+	}
+	if len(params.LineItems) == 0 {
+		return badRequestError("A coupon check needs at least one line item")
+	}
+
+	result := &couponCheck{Code: code, Currency: params.Currency}
+	coupon, err := a.lookupCoupon(ctx, w, code)
+	if err != nil {
+		if httpErr, ok := err.(*HTTPError); ok && httpErr.Code == http.StatusNotFound {
+			return sendJSON(w, http.StatusOK, result.reject(couponReasonNotFound, "This coupon code doesn't exist"))
+		}
+		return err
+	}
+
+	now := time.Now()
+	if coupon.StartDate != nil && now.Before(*coupon.StartDate) {
+		return sendJSON(w, http.StatusOK, result.reject(couponReasonNotStarted, "This coupon can't be used before "+coupon.StartDate.Format("2006-01-02")))
+	}
+	if coupon.EndDate != nil && now.After(*coupon.EndDate) {
+		return sendJSON(w, http.StatusOK, result.reject(couponReasonExpired, "This coupon expired on "+coupon.EndDate.Format("2006-01-02")))
+	}
+
+	if coupon.ID != 0 {
+		user := strings.ToLower(params.Email)
+		if claims := gcontext.GetClaims(ctx); claims != nil && claims.Subject != "" {
+			user = claims.Subject
+		}
+		switch err := models.CheckCouponUses(db, coupon, user); err {
+		case nil:
+		case models.ErrCouponUsedUp:
+			return sendJSON(w, http.StatusOK, result.reject(couponReasonUsedUp, err.Error()))
+		case models.ErrCouponUserLimitHit:
+			return sendJSON(w, http.StatusOK, result.reject(couponReasonUserLimitHit, err.Error()))
+		default:
+			return internalServerError("Error fetching coupon uses").WithInternalError(err)
+		}
+	}
+
+	order := models.NewOrder(gcontext.GetInstanceID(ctx), "", params.Email, params.Currency)
+	order.ShippingAddress.Country = params.Country
+	order.CouponCode = coupon.Code
+	order.Coupon = coupon
+	if httpError := a.processLineItems(ctx, order, params.LineItems); httpError != nil {
+		return httpError
+	}
+	settings, err := a.loadSettings(ctx)
+	if err != nil {
+		return internalServerError(err.Error()).WithInternalError(err)
+	}
+	order.CalculateTotal(settings, gcontext.GetClaimsAsMap(ctx), getLogEntry(r))
+	for _, item := range order.LineItems {
+		result.Subtotal += item.CalculationDetail.UnitPrice * item.Quantity
+		for _, discount := range item.DiscountItems {
+			if discount.Type == calculator.DiscountTypeCoupon && discount.Code == coupon.Code {
+				result.Discount += discount.Amount * item.Quantity
+			}
+		}
+	}
+
+	if !coupon.ValidForPrice(params.Currency, result.Subtotal) {
+		message := "This coupon can't be used with " + params.Currency
+		for _, minimum := range coupon.MinimumAmount {
+			if minimum.Currency == params.Currency {
+				message = fmt.Sprintf("This coupon requires a subtotal of at least %s %s", minimum.Amount, minimum.Currency)
+			}
+		}
+		return sendJSON(w, http.StatusOK, result.reject(couponReasonBelowMinimum, message))
+	}
+	applies := false
+	for _, item := range order.LineItems {
+		if coupon.ValidForType(item.ProductType()) && coupon.ValidForProduct(item.ProductSku()) {
+			applies = true
+			break
+		}
+	}
+	if !applies {
+		return sendJSON(w, http.StatusOK, result.reject(couponReasonWrongProducts, "This coupon doesn't apply to any of the products"))
+	}
+
+	result.Valid = true
+	return sendJSON(w, http.StatusOK, result)
+}
+
+// CouponList returns all the coupons for the site, the ones stored in the
+// database replacing the ones of the settings file with the same code.
+// Requires admin permissions
 func (a *API) CouponList(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	log := getLogEntry(r)
 
-	couponCache := gcontext.GetCoupons(ctx)
-	if couponCache == nil {
-		return sendJSON(w, http.StatusOK, []string{})
+	result := map[string]*models.Coupon{}
+	if couponCache := gcontext.GetCoupons(ctx); couponCache != nil {
+		coupons, err := couponCache.List()
+		if err != nil {
+			log.WithError(err).Errorf("Error loading coupons: %v", err)
+			return internalServerError("Error fetching coupons: %v", err)
+		}
+		for key, coupon := range coupons {
+			result[key] = coupon
+		}
 	}
 
-	coupons, err := couponCache.List()
+	stored := []*models.Coupon{}
+	if rsp := a.DB(r).Where("instance_id = ?", gcontext.GetInstanceID(ctx)).Find(&stored); rsp.Error != nil {
+		return internalServerError("Error fetching coupons").WithInternalError(rsp.Error)
+	}
+	for _, coupon := range stored {
+		result[coupon.Code] = coupon
+	}
+
+	return sendJSON(w, http.StatusOK, result)
+}
+
+// CouponCreate stores a new coupon in the database. Requires admin permissions
+func (a *API) CouponCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	instanceID := gcontext.GetInstanceID(ctx)
+
+	coupon := &models.Coupon{}
+	if err := json.NewDecoder(r.Body).Decode(coupon); err != nil {
+		return badRequestError("Could not read coupon params: %v", err)
+	}
+	if httpErr := validateCoupon(coupon); httpErr != nil {
+		return httpErr
+	}
+
+	db := a.DB(r)
+	existing, err := models.FindCoupon(db, instanceID, coupon.Code)
+	if err != nil {
+		return internalServerError("Error fetching coupon").WithInternalError(err)
+	}
+	if existing != nil {
+		return httpError(http.StatusConflict, "A coupon with the code %s already exists", coupon.Code)
+	}
+
+	coupon.ID = 0
+	coupon.InstanceID = instanceID
+	coupon.Uses = 0
+	if rsp := db.Create(coupon); rsp.Error != nil {
+		return internalServerError("Error saving coupon").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusCreated, coupon)
+}
+
+// Limits of coupon batches.
+const (
+	maxCouponBatchCount     = 10000
+	defaultCouponCodeLength = 8
+	minCouponCodeLength     = 6
+	maxCouponCodeLength     = 32
+
+	// couponLookupChunk limits the codes looked up in a single query.
+	couponLookupChunk = 500
+)
+
+// CouponBatchParams holds the parameters for generating a batch of coupons.
+// The coupons are copies of the template part with unique random codes
+// starting with the prefix.
+type CouponBatchParams struct {
+	models.Coupon
+
+	Count  int    `json:"count"`
+	Prefix string `json:"prefix"`
+	Length int    `json:"length"`
+}
+
+// CouponBatchCreate stores a batch of single use coupons with unique codes in
+// the database and returns their codes as CSV. Requires admin permissions
+func (a *API) CouponBatchCreate(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+
+	params := &CouponBatchParams{Length: defaultCouponCodeLength}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read coupon params: %v", err)
+	}
+	if params.Count <= 0 || params.Count > maxCouponBatchCount {
+		return badRequestError("The count of a coupon batch has to be between 1 and %d", maxCouponBatchCount)
+	}
+	if params.Length < minCouponCodeLength || params.Length > maxCouponCodeLength {
+		return badRequestError("The length of coupon codes has to be between %d and %d", minCouponCodeLength, maxCouponCodeLength)
+	}
+
+	template := params.Coupon
+	template.Code = params.Prefix
+	if template.Code == "" {
+		template.Code = "batch"
+	}
+	if httpErr := validateCoupon(&template); httpErr != nil {
+		return httpErr
+	}
+	template.ID = 0
+	template.InstanceID = instanceID
+	template.Uses = 0
+	template.MaxUses = 1
+	template.MaxUsesPerUser = 0
+
+	tx := a.DB(r).Begin()
+	codes, err := uniqueCouponCodes(tx, instanceID, params.Prefix, params.Length, params.Count)
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Error generating coupon codes").WithInternalError(err)
+	}
+	for _, code := range codes {
+		coupon := template
+		coupon.Code = code
+		if rsp := tx.Create(&coupon); rsp.Error != nil {
+			tx.Rollback()
+			return internalServerError("Error saving coupon").WithInternalError(rsp.Error)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return internalServerError("Error saving coupons").WithInternalError(err)
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="coupons.csv"`)
+	w.WriteHeader(http.StatusCreated)
+	out := csv.NewWriter(w)
+	out.Write([]string{"code"})
+	for _, code := range codes {
+		out.Write([]string{code})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// uniqueCouponCodes generates count random codes with the prefix that aren't
+// used by any coupon of the instance yet.
+func uniqueCouponCodes(tx *gorm.DB, instanceID, prefix string, length, count int) ([]string, error) {
+	codes := []string{}
+	seen := map[string]bool{}
+	for len(codes) < count {
+		batch := []string{}
+		for len(codes)+len(batch) < count {
+			code, err := models.GenerateCode(length)
+			if err != nil {
+				return nil, err
+			}
+			code = prefix + code
+			if !seen[code] {
+				seen[code] = true
+				batch = append(batch, code)
+			}
+		}
+
+		used := map[string]bool{}
+		for start := 0; start < len(batch); start += couponLookupChunk {
+			end := start + couponLookupChunk
+			if end > len(batch) {
+				end = len(batch)
+			}
+			taken := []string{}
+			if rsp := tx.Model(&models.Coupon{}).Where("instance_id = ? AND code IN (?)", instanceID, batch[start:end]).Pluck("code", &taken); rsp.Error != nil {
+				return nil, rsp.Error
+			}
+			for _, code := range taken {
+				used[code] = true
+			}
+		}
+		for _, code := range batch {
+			if !used[code] {
+				codes = append(codes, code)
+			}
+		}
+	}
+	return codes, nil
+}
+
+// CouponUpdate replaces a coupon stored in the database. The usage counter of
+// the coupon is kept. Requires admin permissions
+func (a *API) CouponUpdate(w http.ResponseWriter, r *http.Request) error {
+	db := a.DB(r)
+	existing, httpErr := a.loadStoredCoupon(r)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	coupon := &models.Coupon{}
+	if err := json.NewDecoder(r.Body).Decode(coupon); err != nil {
+		return badRequestError("Could not read coupon params: %v", err)
+	}
+	if coupon.Code == "" {
+		coupon.Code = existing.Code
+	}
+	if httpErr := validateCoupon(coupon); httpErr != nil {
+		return httpErr
+	}
+	if coupon.Code != existing.Code {
+		other, err := models.FindCoupon(db, existing.InstanceID, coupon.Code)
+		if err != nil {
+			return internalServerError("Error fetching coupon").WithInternalError(err)
+		}
+		if other != nil {
+			return httpError(http.StatusConflict, "A coupon with the code %s already exists", coupon.Code)
+		}
+	}
+
+	coupon.ID = existing.ID
+	coupon.InstanceID = existing.InstanceID
+	coupon.Uses = existing.Uses
+	coupon.CreatedAt = existing.CreatedAt
+	if rsp := db.Save(coupon); rsp.Error != nil {
+		return internalServerError("Error saving coupon").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, coupon)
+}
+
+// CouponDelete deletes a coupon stored in the database. Requires admin permissions
+func (a *API) CouponDelete(w http.ResponseWriter, r *http.Request) error {
+	coupon, httpErr := a.loadStoredCoupon(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if rsp := a.DB(r).Delete(coupon); rsp.Error != nil {
+		return internalServerError("Error deleting coupon").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, map[string]string{})
+}
+
+func (a *API) loadStoredCoupon(r *http.Request) (*models.Coupon, *HTTPError) {
+	code := chi.URLParam(r, "coupon_code")
+	coupon, err := models.FindCoupon(a.DB(r), gcontext.GetInstanceID(r.Context()), code)
 	if err != nil {
-		log.WithError(err).Errorf("Error loading coupons: %v", err)
-		return internalServerError("Error fetching coupons: %v", err)
+		return nil, internalServerError("Error fetching coupon").WithInternalError(err)
+	}
+	if coupon == nil {
+		return nil, notFoundError("Coupon not found, only coupons stored in the database can be changed")
 	}
+	return coupon, nil
+}
 
-	return sendJSON(w, http.StatusOK, coupons)
+func validateCoupon(coupon *models.Coupon) *HTTPError {
+	if coupon.Code == "" {
+		return badRequestError("A coupon code is required")
+	}
+	if coupon.Percentage > 100 {
+		return badRequestError("The percentage of a coupon can't be more than 100")
+	}
+	if coupon.Percentage == 0 && len(coupon.FixedAmount) == 0 {
+		return badRequestError("A coupon needs either a percentage or fixed amounts")
+	}
+	if coupon.StartDate != nil && coupon.EndDate != nil && coupon.EndDate.Before(*coupon.StartDate) {
+		return badRequestError("The end date of a coupon can't be before its start date")
+	}
+	return nil
 }
@@ -1,13 +1,22 @@
 package api
 
 import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/netlify/gocommerce/calculator"
 	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
 )
 
 func TestCouponView(t *testing.T) {
@@ -30,6 +39,350 @@ func TestCouponView(t *testing.T) {
 	})
 }
 
+func TestCouponCheck(t *testing.T) {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	site := startTestSite()
+	defer site.Close()
+	check := func(t *testing.T, body string) *couponCheck {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		recorder := test.TestEndpoint(http.MethodPost, "/coupons", strings.NewReader(body), token)
+		extractPayload(t, http.StatusCreated, recorder, &models.Coupon{})
+		coupon, err := models.FindCoupon(test.DB, "", "SUMMER")
+		require.NoError(t, err)
+		if coupon.MaxUses > 0 || coupon.MaxUsesPerUser > 0 {
+			require.NoError(t, test.DB.Model(coupon).UpdateColumn("uses", 1).Error)
+			require.NoError(t, test.DB.Create(&models.CouponUse{CouponID: coupon.ID, UserID: "info@example.com", Uses: 1}).Error)
+		}
+
+		cart := `{"email": "info@example.com", "currency": "USD", "line_items": [{"path": "/simple-product", "quantity": 2}]}`
+		recorder = test.TestEndpoint(http.MethodPost, "/coupons/"+coupon.Code+"/check", strings.NewReader(cart), nil)
+		result := &couponCheck{}
+		extractPayload(t, http.StatusOK, recorder, result)
+		return result
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		result := check(t, `{"code": "SUMMER", "percentage": 10, "minimum_amount": [{"amount": "19.00", "currency": "USD"}]}`)
+		assert.True(t, result.Valid)
+		assert.Empty(t, result.Reason)
+		assert.Equal(t, uint64(1998), result.Subtotal)
+		assert.Equal(t, uint64(200), result.Discount)
+	})
+	for name, c := range map[string]struct{ coupon, reason string }{
+		"NotStarted":    {`{"code": "SUMMER", "percentage": 10, "start_date": "2099-01-01T00:00:00Z"}`, couponReasonNotStarted},
+		"Expired":       {`{"code": "SUMMER", "percentage": 10, "end_date": "2001-01-01T00:00:00Z"}`, couponReasonExpired},
+		"UsedUp":        {`{"code": "SUMMER", "percentage": 10, "max_uses": 1}`, couponReasonUsedUp},
+		"UserLimitHit":  {`{"code": "SUMMER", "percentage": 10, "max_uses_per_user": 1}`, couponReasonUserLimitHit},
+		"BelowMinimum":  {`{"code": "SUMMER", "percentage": 10, "minimum_amount": [{"amount": "20.00", "currency": "USD"}]}`, couponReasonBelowMinimum},
+		"WrongProducts": {`{"code": "SUMMER", "percentage": 10, "products": ["product-2"]}`, couponReasonWrongProducts},
+	} {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			result := check(t, c.coupon)
+			assert.False(t, result.Valid)
+			assert.Equal(t, c.reason, result.Reason)
+			assert.NotEmpty(t, result.Message)
+			assert.Equal(t, uint64(0), result.Discount)
+		})
+	}
+	t.Run("NotFound", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		recorder := test.TestEndpoint(http.MethodPost, "/coupons/UNKNOWN/check", strings.NewReader(`{"line_items": [{"path": "/simple-product", "quantity": 1}]}`), nil)
+		result := &couponCheck{}
+		extractPayload(t, http.StatusOK, recorder, result)
+		assert.False(t, result.Valid)
+		assert.Equal(t, couponReasonNotFound, result.Reason)
+	})
+}
+
+func TestCouponManagement(t *testing.T) {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	create := func(t *testing.T, test *RouteTest, body string) *models.Coupon {
+		recorder := test.TestEndpoint(http.MethodPost, "/coupons", strings.NewReader(body), token)
+		coupon := &models.Coupon{}
+		extractPayload(t, http.StatusCreated, recorder, coupon)
+		return coupon
+	}
+	pay := func(t *testing.T, test *RouteTest, order *models.Order, token *jwt.Token) *httptest.ResponseRecorder {
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+			intent := v.(*stripe.PaymentIntent)
+			intent.ID = stripePaymentIntentID
+			intent.Status = stripe.PaymentIntentStatusSucceeded
+			return nil
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		body, err := json.Marshal(map[string]interface{}{
+			"amount":                   order.Total,
+			"currency":                 "USD",
+			"provider":                 payments.StripeProvider,
+			"stripe_payment_method_id": "payment-method-simple",
+		})
+		require.NoError(t, err)
+		return test.TestEndpoint(http.MethodPost, "/orders/"+order.ID+"/payments", bytes.NewBuffer(body), token)
+	}
+
+	t.Run("Create", func(t *testing.T) {
+		test := NewRouteTest(t)
+		created := create(t, test, `{"code": "SUMMER", "fixed": [{"amount": "5.00", "currency": "USD"}], "products": ["product-1"], "end_date": "2099-01-01T00:00:00Z"}`)
+		assert.NotNil(t, created.CreatedAt)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/coupons/SUMMER", nil, nil)
+		coupon := &models.Coupon{}
+		extractPayload(t, http.StatusOK, recorder, coupon)
+		assert.Equal(t, uint64(500), coupon.FixedDiscount("USD"))
+		assert.Equal(t, []string{"product-1"}, coupon.Products)
+		require.NotNil(t, coupon.EndDate)
+		assert.True(t, coupon.Valid())
+
+		recorder = test.TestEndpoint(http.MethodPost, "/coupons", strings.NewReader(`{"code": "SUMMER", "percentage": 10}`), token)
+		validateError(t, http.StatusConflict, recorder)
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		test := NewRouteTest(t)
+		for _, body := range []string{`{"percentage": 10}`, `{"code": "NOTHING"}`, `{"code": "TOO-MUCH", "percentage": 120}`} {
+			recorder := test.TestEndpoint(http.MethodPost, "/coupons", strings.NewReader(body), token)
+			validateError(t, http.StatusBadRequest, recorder)
+		}
+	})
+	t.Run("UpdateAndDelete", func(t *testing.T) {
+		test := NewRouteTest(t)
+		create(t, test, `{"code": "SUMMER", "percentage": 10}`)
+
+		recorder := test.TestEndpoint(http.MethodPut, "/coupons/SUMMER", strings.NewReader(`{"percentage": 20}`), token)
+		updated := &models.Coupon{}
+		extractPayload(t, http.StatusOK, recorder, updated)
+		assert.Equal(t, "SUMMER", updated.Code)
+		assert.Equal(t, uint64(20), updated.Percentage)
+
+		recorder = test.TestEndpoint(http.MethodDelete, "/coupons/SUMMER", nil, token)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		recorder = test.TestEndpoint(http.MethodGet, "/coupons/SUMMER", nil, nil)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+	t.Run("SettingsFileFallback", func(t *testing.T) {
+		test := NewRouteTest(t)
+		server := startTestCouponURLs()
+		defer server.Close()
+		test.Config.Coupons.URL = server.URL
+		create(t, test, `{"code": "SUMMER", "percentage": 10}`)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/coupons", nil, token)
+		coupons := map[string]*models.Coupon{}
+		extractPayload(t, http.StatusOK, recorder, &coupons)
+		assert.Len(t, coupons, 2)
+		assert.Equal(t, uint64(15), coupons["coupon-code"].Percentage)
+		assert.Equal(t, uint64(10), coupons["SUMMER"].Percentage)
+
+		recorder = test.TestEndpoint(http.MethodPut, "/coupons/coupon-code", strings.NewReader(`{"percentage": 20}`), token)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+	t.Run("CountsUses", func(t *testing.T) {
+		test := NewRouteTest(t)
+		site := startTestSite()
+		defer site.Close()
+		test.Config.SiteURL = site.URL
+		create(t, test, `{"code": "SUMMER", "percentage": 10}`)
+
+		body := strings.NewReader(`{
+			"email": "info@example.com",
+			"shipping_address": {
+				"name": "Test User",
+				"address1": "610 22nd Street",
+				"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+			},
+			"line_items": [{"path": "/simple-product", "quantity": 1}],
+			"coupon": "SUMMER"
+		}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, uint64(100), order.Discount)
+
+		coupon, err := models.FindCoupon(test.DB, "", "SUMMER")
+		require.NoError(t, err)
+		assert.Equal(t, uint64(0), coupon.Uses)
+
+		recorder = pay(t, test, order, test.Data.testUserToken)
+		extractPayload(t, http.StatusOK, recorder, &models.Transaction{})
+		coupon, err = models.FindCoupon(test.DB, "", "SUMMER")
+		require.NoError(t, err)
+		assert.Equal(t, uint64(1), coupon.Uses)
+	})
+	t.Run("UsageLimits", func(t *testing.T) {
+		test := NewRouteTest(t)
+		site := startTestSite()
+		defer site.Close()
+		test.Config.SiteURL = site.URL
+		create(t, test, `{"code": "SUMMER", "percentage": 10, "max_uses": 2, "max_uses_per_user": 1}`)
+
+		order := func(email string, token *jwt.Token) *httptest.ResponseRecorder {
+			body := strings.NewReader(`{
+				"email": "` + email + `",
+				"shipping_address": {
+					"name": "Test User",
+					"address1": "610 22nd Street",
+					"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+				},
+				"line_items": [{"path": "/simple-product", "quantity": 1}],
+				"coupon": "SUMMER"
+			}`)
+			return test.TestEndpoint(http.MethodPost, "/orders", body, token)
+		}
+		created := func(email string, token *jwt.Token) *models.Order {
+			created := &models.Order{}
+			extractPayload(t, http.StatusCreated, order(email, token), created)
+			return created
+		}
+
+		// orders that aren't paid don't use the coupon
+		first := created("info@example.com", test.Data.testUserToken)
+		second := created("info@example.com", test.Data.testUserToken)
+		extractPayload(t, http.StatusOK, pay(t, test, first, test.Data.testUserToken), &models.Transaction{})
+		validateError(t, http.StatusBadRequest, pay(t, test, second, test.Data.testUserToken), "already used this coupon")
+		validateError(t, http.StatusBadRequest, order("info@example.com", test.Data.testUserToken))
+
+		guest := created("guest@example.com", nil)
+		extractPayload(t, http.StatusOK, pay(t, test, guest, nil), &models.Transaction{})
+		validateError(t, http.StatusBadRequest, order("another-guest@example.com", nil))
+
+		coupon, err := models.FindCoupon(test.DB, "", "SUMMER")
+		require.NoError(t, err)
+		assert.Equal(t, uint64(2), coupon.Uses)
+		uses, err := coupon.UsesBy(test.DB, test.Data.testUser.ID)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(1), uses)
+		uses, err = coupon.UsesBy(test.DB, "guest@example.com")
+		require.NoError(t, err)
+		assert.Equal(t, uint64(1), uses)
+	})
+	t.Run("ConcurrentFirstUse", func(t *testing.T) {
+		test := NewRouteTest(t)
+		coupon := create(t, test, `{"code": "SUMMER", "percentage": 10, "max_uses_per_user": 2}`)
+		coupon, err := models.FindCoupon(test.DB, "", coupon.Code)
+		require.NoError(t, err)
+
+		// the counter of a concurrent first use is created before the
+		// savepoint of this one
+		tx := test.DB.Begin()
+		require.NoError(t, tx.Create(&models.CouponUse{CouponID: coupon.ID, UserID: "guest@example.com", Uses: 1}).Error)
+		require.NoError(t, models.RedeemCoupon(tx, coupon, "guest@example.com"))
+		assert.Equal(t, models.ErrCouponUserLimitHit, models.RedeemCoupon(tx, coupon, "guest@example.com"))
+		require.NoError(t, tx.Commit().Error)
+
+		uses, err := coupon.UsesBy(test.DB, "guest@example.com")
+		require.NoError(t, err)
+		assert.Equal(t, uint64(2), uses)
+	})
+	t.Run("MultipleCoupons", func(t *testing.T) {
+		order := func(t *testing.T, test *RouteTest) *models.Order {
+			body := strings.NewReader(`{
+				"email": "info@example.com",
+				"shipping_address": {
+					"name": "Test User",
+					"address1": "610 22nd Street",
+					"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+				},
+				"line_items": [{"path": "/simple-product", "quantity": 1}],
+				"coupons": ["SUMMER", "EXTRA"]
+			}`)
+			recorder := test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+			order := &models.Order{}
+			extractPayload(t, http.StatusCreated, recorder, order)
+			return order
+		}
+		uses := func(t *testing.T, test *RouteTest, code string) uint64 {
+			coupon, err := models.FindCoupon(test.DB, "", code)
+			require.NoError(t, err)
+			return coupon.Uses
+		}
+
+		t.Run("BestOf", func(t *testing.T) {
+			test := NewRouteTest(t)
+			site := startTestSite()
+			defer site.Close()
+			test.Config.SiteURL = site.URL
+			create(t, test, `{"code": "SUMMER", "percentage": 10}`)
+			create(t, test, `{"code": "EXTRA", "percentage": 5}`)
+
+			created := order(t, test)
+			extractPayload(t, http.StatusOK, pay(t, test, created, test.Data.testUserToken), &models.Transaction{})
+			assert.Equal(t, uint64(100), created.Discount)
+			assert.Equal(t, "SUMMER", created.CouponCode)
+			assert.Len(t, created.Coupons, 2)
+			require.Len(t, created.LineItems[0].DiscountItems, 1)
+			assert.Equal(t, "SUMMER", created.LineItems[0].DiscountItems[0].Code)
+			assert.Equal(t, uint64(100), created.LineItems[0].DiscountItems[0].Amount)
+
+			assert.Equal(t, uint64(1), uses(t, test, "SUMMER"))
+			assert.Equal(t, uint64(0), uses(t, test, "EXTRA"))
+		})
+		t.Run("Additive", func(t *testing.T) {
+			test := NewRouteTest(t)
+			site := startTestSiteWithSettings(&calculator.Settings{CouponStacking: calculator.CouponStackingAdditive})
+			defer site.Close()
+			test.Config.SiteURL = site.URL
+			create(t, test, `{"code": "SUMMER", "percentage": 10}`)
+			create(t, test, `{"code": "EXTRA", "percentage": 5}`)
+
+			created := order(t, test)
+			extractPayload(t, http.StatusOK, pay(t, test, created, test.Data.testUserToken), &models.Transaction{})
+			assert.Equal(t, uint64(150), created.Discount)
+			require.Len(t, created.LineItems[0].DiscountItems, 2)
+			assert.Equal(t, "SUMMER", created.LineItems[0].DiscountItems[0].Code)
+			assert.Equal(t, "EXTRA", created.LineItems[0].DiscountItems[1].Code)
+
+			stored := &models.Order{}
+			require.NoError(t, test.DB.First(stored, "id = ?", created.ID).Error)
+			assert.Len(t, stored.Coupons, 2)
+
+			assert.Equal(t, uint64(1), uses(t, test, "SUMMER"))
+			assert.Equal(t, uint64(1), uses(t, test, "EXTRA"))
+		})
+	})
+	t.Run("Batch", func(t *testing.T) {
+		test := NewRouteTest(t)
+		create(t, test, `{"code": "SUMMER", "percentage": 10}`)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/coupons/batch", strings.NewReader(`{"count": 50, "prefix": "MAIL-", "percentage": 15, "end_date": "2099-01-01T00:00:00Z"}`), token)
+		require.Equal(t, http.StatusCreated, recorder.Code, recorder.Body.String())
+		assert.Equal(t, "text/csv", recorder.Header().Get("Content-Type"))
+		rows, err := csv.NewReader(recorder.Body).ReadAll()
+		require.NoError(t, err)
+		require.Len(t, rows, 51)
+		assert.Equal(t, []string{"code"}, rows[0])
+
+		codes := map[string]bool{}
+		for _, row := range rows[1:] {
+			assert.True(t, strings.HasPrefix(row[0], "MAIL-"))
+			assert.Len(t, row[0], len("MAIL-")+defaultCouponCodeLength)
+			codes[row[0]] = true
+		}
+		assert.Len(t, codes, 50)
+
+		coupon, err := models.FindCoupon(test.DB, "", rows[1][0])
+		require.NoError(t, err)
+		require.NotNil(t, coupon)
+		assert.Equal(t, uint64(15), coupon.Percentage)
+		assert.Equal(t, uint64(1), coupon.MaxUses)
+		require.NotNil(t, coupon.EndDate)
+
+		for _, body := range []string{`{"count": 0, "percentage": 15}`, `{"count": 10}`, `{"count": 10, "percentage": 15, "length": 2}`} {
+			recorder := test.TestEndpoint(http.MethodPost, "/coupons/batch", strings.NewReader(body), token)
+			validateError(t, http.StatusBadRequest, recorder)
+		}
+		recorder = test.TestEndpoint(http.MethodPost, "/coupons/batch", strings.NewReader(`{"count": 10, "percentage": 15}`), test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, "/coupons", strings.NewReader(`{"code": "SUMMER", "percentage": 10}`), test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
 func startTestCouponURLs() *httptest.Server {
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
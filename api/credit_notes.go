@@ -0,0 +1,187 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/go-pdf/fpdf"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+// creditNoteBatchSize is how many missing credit notes are issued at most
+// per sweep.
+const creditNoteBatchSize = 100
+
+// CreditNoteList lists the credit notes issued for the refunds of an order.
+func (a *API) CreditNoteList(w http.ResponseWriter, r *http.Request) error {
+	order, httpErr := a.loadOrder(r)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	notes := []*models.CreditNote{}
+	if rsp := a.DB(r).Preload("Items").Where("order_id = ?", order.ID).Order("created_at asc").Find(&notes); rsp.Error != nil {
+		return internalServerError("Error querying credit notes").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, notes)
+}
+
+// CreditNotePDF renders a credit note of an order as a PDF.
+func (a *API) CreditNotePDF(w http.ResponseWriter, r *http.Request) error {
+	order, httpErr := a.loadOrder(r)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	note := &models.CreditNote{}
+	rsp := a.DB(r).Preload("Items").Where("id = ? AND order_id = ?", chi.URLParam(r, "credit_note_id"), order.ID).First(note)
+	if rsp.RecordNotFound() {
+		return notFoundError("Credit note not found")
+	}
+	if rsp.Error != nil {
+		return internalServerError("Error querying credit notes").WithInternalError(rsp.Error)
+	}
+
+	data, err := renderCreditNote(note, order)
+	if err != nil {
+		return internalServerError("Error rendering credit note").WithInternalError(err)
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="credit-note-%s.pdf"`, creditNoteNumber(note.Series, note.Number)))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(data)
+	return err
+}
+
+// renderCreditNote renders the credit note as a single page PDF listing its
+// reversed items and totals.
+func renderCreditNote(note *models.CreditNote, order *models.Order) ([]byte, error) {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.SetCreationDate(note.CreatedAt)
+	pdf.SetTitle("Credit note "+creditNoteNumber(note.Series, note.Number), true)
+	text := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.AddPage()
+
+	pdf.SetFont("Helvetica", "B", 16)
+	pdf.CellFormat(0, 10, text("Credit note "+creditNoteNumber(note.Series, note.Number)), "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 10)
+	pdf.CellFormat(0, 6, "Date: "+note.CreatedAt.Format("2006-01-02"), "", 1, "L", false, 0, "")
+	if note.InvoiceNumber != 0 {
+		pdf.CellFormat(0, 6, text("Invoice: "+creditNoteNumber(note.InvoiceSeries, note.InvoiceNumber)), "", 1, "L", false, 0, "")
+	}
+	pdf.CellFormat(0, 6, text("Order: "+order.ID), "", 1, "L", false, 0, "")
+	if name := order.BillingAddress.Name; name != "" {
+		pdf.CellFormat(0, 6, text("Customer: "+name), "", 1, "L", false, 0, "")
+	}
+	pdf.Ln(6)
+
+	widths := []float64{80, 20, 30, 30, 30}
+	pdf.SetFont("Helvetica", "B", 10)
+	for i, header := range []string{"Item", "Quantity", "Net", "Taxes", "Total"} {
+		align := "R"
+		if i == 0 {
+			align = "L"
+		}
+		pdf.CellFormat(widths[i], 7, header, "B", 0, align, false, 0, "")
+	}
+	pdf.Ln(-1)
+	pdf.SetFont("Helvetica", "", 10)
+	for _, item := range note.Items {
+		pdf.CellFormat(widths[0], 7, text(item.Title), "", 0, "L", false, 0, "")
+		pdf.CellFormat(widths[1], 7, strconv.FormatUint(item.Quantity, 10), "", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[2], 7, formatCurrencyAmount(item.NetTotal, note.Currency), "", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[3], 7, formatCurrencyAmount(item.Taxes, note.Currency), "", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[4], 7, formatCurrencyAmount(item.Total, note.Currency), "", 1, "R", false, 0, "")
+	}
+
+	pdf.Ln(4)
+	pdf.CellFormat(160, 7, "Taxes", "T", 0, "R", false, 0, "")
+	pdf.CellFormat(30, 7, formatCurrencyAmount(note.Taxes, note.Currency), "T", 1, "R", false, 0, "")
+	pdf.SetFont("Helvetica", "B", 10)
+	pdf.CellFormat(160, 7, "Total "+note.Currency, "", 0, "R", false, 0, "")
+	pdf.CellFormat(30, 7, formatCurrencyAmount(note.Total, note.Currency), "", 1, "R", false, 0, "")
+
+	out := &bytes.Buffer{}
+	if err := pdf.Output(out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// creditNoteNumber formats the number of a credit note or invoice, prefixed
+// with its series if it has one.
+func creditNoteNumber(series string, number int64) string {
+	if series == "" {
+		return strconv.FormatInt(number, 10)
+	}
+	return series + "-" + strconv.FormatInt(number, 10)
+}
+
+// formatCurrencyAmount formats a signed amount in the lowest unit of the
+// currency with the decimals of the currency.
+func formatCurrencyAmount(amount int64, currency string) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	exponent := payments.CurrencyExponent(currency)
+	if exponent == 0 {
+		return sign + strconv.FormatInt(amount, 10)
+	}
+	unit := int64(1)
+	for i := 0; i < exponent; i++ {
+		unit *= 10
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/unit, exponent, amount%unit)
+}
+
+// issueCreditNote issues the credit note of a successful refund within the
+// transaction that records it. It's issued within a savepoint, so failing to
+// issue it doesn't fail the transaction recording the refund, and the credit
+// note is issued by issueMissingCreditNotes instead.
+func issueCreditNote(tx *gorm.DB, log logrus.FieldLogger, refund *models.Transaction) {
+	if err := tx.Exec("SAVEPOINT credit_note").Error; err != nil {
+		log.WithError(err).Error("Failed to issue credit note, it will be retried")
+		return
+	}
+	if _, err := models.IssueCreditNote(tx, refund); err != nil {
+		log.WithError(err).Error("Failed to issue credit note, it will be retried")
+		tx.Exec("ROLLBACK TO SAVEPOINT credit_note")
+		return
+	}
+	tx.Exec("RELEASE SAVEPOINT credit_note")
+}
+
+// issueMissingCreditNotes issues the credit notes of successful refunds that
+// failed to get one when they were recorded.
+func issueMissingCreditNotes(db *gorm.DB, log logrus.FieldLogger) {
+	refunds, err := models.RefundsWithoutCreditNote(db, creditNoteBatchSize)
+	if err != nil {
+		log.WithError(err).Error("Error querying for refunds without credit notes")
+		return
+	}
+	for _, refund := range refunds {
+		log := log.WithField("transaction_id", refund.ID)
+		tx := db.Begin()
+		note, err := models.IssueCreditNote(tx, refund)
+		if err != nil {
+			tx.Rollback()
+			log.WithError(err).Error("Failed to issue credit note")
+			continue
+		}
+		if err := tx.Commit().Error; err != nil {
+			log.WithError(err).Error("Failed to issue credit note")
+			continue
+		}
+		log.WithField("credit_note_id", note.ID).Info("Issued missing credit note")
+	}
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestCreditNotes(t *testing.T) {
+	setup := func(t *testing.T) *RouteTest {
+		test := NewRouteTest(t)
+		test.Config.Payment.Providers = map[string]conf.PaymentProviderConfiguration{
+			"mem": {Enabled: true},
+		}
+		test.Data.firstOrder.PaymentProcessor = "mem"
+		test.Data.firstOrder.Taxes = 4
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+		// the calculation details are those of a single unit
+		test.Data.firstLineItem.CalculationDetail = &models.CalculationDetail{UnitPrice: 12, Subtotal: 12, NetTotal: 10, Taxes: 2, Total: 12}
+		require.NoError(t, test.DB.Save(test.Data.firstLineItem).Error)
+		tx := test.DB.Begin()
+		_, err := models.IssueInvoice(tx, test.Data.firstOrder, "")
+		require.NoError(t, err)
+		require.NoError(t, tx.Commit().Error)
+		return test
+	}
+	refund := func(t *testing.T, test *RouteTest, amount uint64) {
+		url := fmt.Sprintf("/orders/%s/payments/%s/refund", test.Data.firstOrder.ID, test.Data.firstTransaction.ID)
+		w := runPaymentRefund(test, url, &PaymentParams{Amount: amount, Currency: "USD"})
+		extractPayload(t, http.StatusOK, w, &models.Transaction{})
+	}
+	list := func(t *testing.T, test *RouteTest) []*models.CreditNote {
+		w := test.TestEndpoint(http.MethodGet, "/orders/first-order/credit_notes", nil, test.Data.testUserToken)
+		notes := []*models.CreditNote{}
+		extractPayload(t, http.StatusOK, w, &notes)
+		return notes
+	}
+
+	t.Run("FullRefund", func(t *testing.T) {
+		test := setup(t)
+		refund(t, test, test.Data.firstOrder.Total)
+
+		notes := list(t, test)
+		require.Len(t, notes, 1)
+		note := notes[0]
+		assert.Equal(t, int64(1), note.Number)
+		assert.Equal(t, int64(1), note.InvoiceNumber)
+		assert.Equal(t, -int64(test.Data.firstOrder.Total), note.Total)
+		assert.Equal(t, int64(-4), note.Taxes)
+
+		var total int64
+		for _, item := range note.Items {
+			total += item.Total
+		}
+		assert.Equal(t, note.Total, total)
+		require.Len(t, note.Items, 1)
+		assert.Equal(t, "123-i-can-fly-456", note.Items[0].Sku)
+		assert.Equal(t, uint64(2), note.Items[0].Quantity)
+		assert.Equal(t, int64(-20), note.Items[0].NetTotal)
+		assert.Equal(t, int64(-4), note.Items[0].Taxes)
+		assert.Equal(t, int64(-24), note.Items[0].Total)
+	})
+	t.Run("PDF", func(t *testing.T) {
+		test := setup(t)
+		refund(t, test, test.Data.firstOrder.Total)
+		notes := list(t, test)
+		require.Len(t, notes, 1)
+
+		w := test.TestEndpoint(http.MethodGet, "/orders/first-order/credit_notes/"+notes[0].ID+"/pdf", nil, test.Data.testUserToken)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, "application/pdf", w.Header().Get("Content-Type"))
+		assert.True(t, strings.HasPrefix(w.Body.String(), "%PDF-"))
+
+		w = test.TestEndpoint(http.MethodGet, "/orders/first-order/credit_notes/unknown/pdf", nil, test.Data.testUserToken)
+		validateError(t, http.StatusNotFound, w)
+	})
+	t.Run("Missing", func(t *testing.T) {
+		test := setup(t)
+		refund(t, test, test.Data.firstOrder.Total)
+		notes := list(t, test)
+		require.Len(t, notes, 1)
+		require.NoError(t, test.DB.Delete(notes[0]).Error)
+
+		issueMissingCreditNotes(test.DB, logrus.StandardLogger())
+		issueMissingCreditNotes(test.DB, logrus.StandardLogger())
+		notes = list(t, test)
+		require.Len(t, notes, 1)
+		assert.Equal(t, int64(2), notes[0].Number)
+	})
+	t.Run("PartialRefunds", func(t *testing.T) {
+		test := setup(t)
+		refund(t, test, test.Data.firstOrder.Total/2)
+		refund(t, test, 6)
+
+		notes := list(t, test)
+		require.Len(t, notes, 2)
+		assert.Equal(t, int64(1), notes[0].Number)
+		assert.Equal(t, int64(2), notes[1].Number)
+		require.Len(t, notes[0].Items, 1)
+		assert.Equal(t, -int64(test.Data.firstOrder.Total/2), notes[0].Items[0].Total)
+		assert.Equal(t, int64(-2), notes[0].Taxes)
+		assert.Equal(t, int64(-6), notes[1].Total)
+		assert.Equal(t, int64(-1), notes[1].Taxes)
+	})
+	t.Run("NoAccess", func(t *testing.T) {
+		test := setup(t)
+		w := test.TestEndpoint(http.MethodGet, "/orders/first-order/credit_notes", nil, testToken("villian", "villian@wayneindustries.com"))
+		validateError(t, http.StatusUnauthorized, w)
+	})
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+// creditLedger is the store credit of a user with the entries of its ledger.
+type creditLedger struct {
+	Balances     map[string]int64            `json:"balances"`
+	Transactions []*models.CreditTransaction `json:"transactions"`
+}
+
+// CreditParams holds the parameters for giving a user store credit.
+type CreditParams struct {
+	Amount      int64  `json:"amount"`
+	Currency    string `json:"currency"`
+	Description string `json:"description"`
+}
+
+// CreditList returns the store credit balances of a user and the ledger of
+// credit transactions.
+func (a *API) CreditList(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	db := a.DB(r)
+	userID := gcontext.GetUserID(ctx)
+	if gcontext.GetUser(ctx) == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+
+	balances, err := models.CreditBalances(db, userID)
+	if err != nil {
+		return internalServerError("problem while querying for the credit of userID: %s", userID).WithInternalError(err)
+	}
+	ledger := &creditLedger{Balances: balances, Transactions: []*models.CreditTransaction{}}
+	if rsp := db.Where("user_id = ?", userID).Order("created_at desc").Find(&ledger.Transactions); rsp.Error != nil {
+		return internalServerError("problem while querying for the credit of userID: %s", userID).WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, ledger)
+}
+
+// CreditCreate gives a user store credit, or takes it away with a negative
+// amount. Requires admin permissions.
+func (a *API) CreditCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	db := a.DB(r)
+	userID := gcontext.GetUserID(ctx)
+	if gcontext.GetUser(ctx) == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+
+	params := &CreditParams{Currency: "USD"}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read params: %v", err)
+	}
+	if params.Amount == 0 {
+		return badRequestError("Store credit requires a non-zero amount")
+	}
+
+	tx := db.Begin()
+	credit := models.NewCreditTransaction(gcontext.GetInstanceID(ctx), userID, params.Currency, params.Amount)
+	credit.Description = params.Description
+	if err := models.BookCredit(tx, credit); err != nil {
+		tx.Rollback()
+		if err == models.ErrInsufficientCredit {
+			balance, _ := models.CreditBalance(db, userID, params.Currency)
+			return badRequestError("The user only has %d %s of store credit", balance, params.Currency)
+		}
+		return internalServerError("Error saving store credit").WithInternalError(err)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return internalServerError("Error saving store credit").WithInternalError(err)
+	}
+	return sendJSON(w, http.StatusCreated, credit)
+}
+
+// payWithCredit pays as much of the amount as the store credit of the user of
+// the order covers, within the transaction of the payment. It returns the
+// paid transaction, or nil if the user has no credit. It returns
+// models.ErrInsufficientCredit if a concurrent payment spent the credit.
+func payWithCredit(ctx context.Context, tx *gorm.DB, log logrus.FieldLogger, order *models.Order, amount uint64, invoiceNumber int64) (*models.Transaction, error) {
+	balance, err := models.CreditBalance(tx, order.UserID, order.Currency)
+	if err != nil {
+		return nil, err
+	}
+	if balance <= 0 || amount == 0 {
+		return nil, nil
+	}
+	if uint64(balance) < amount {
+		amount = uint64(balance)
+	}
+
+	tr := models.NewTransaction(order)
+	tr.Amount = amount
+	tr.Provider = models.StoreCreditProvider
+	tr.InvoiceNumber = invoiceNumber
+
+	credit := models.NewCreditTransaction(order.InstanceID, order.UserID, order.Currency, -int64(amount))
+	credit.OrderID = order.ID
+	credit.TransactionID = tr.ID
+	credit.Description = "Payment of order " + orderLabel(order)
+	if err := models.BookCredit(tx, credit); err != nil {
+		return nil, err
+	}
+	tr.ProcessorID = credit.ID
+
+	if _, err := completePayment(ctx, tx, log, tr, order); err != nil {
+		return nil, err
+	}
+	return tr, nil
+}
+
+// creditRefunder refunds to the store credit of the user of the order instead
+// of the payment provider, within the transaction recording the refund.
+func creditRefunder(tx *gorm.DB, order *models.Order, refund *models.Transaction) payments.Refunder {
+	refund.Provider = models.StoreCreditProvider
+	return func(transactionID string, amount uint64, currency string) (string, error) {
+		if order.UserID == "" {
+			return "", errors.New("Only orders of registered users can be refunded to store credit")
+		}
+		credit := models.NewCreditTransaction(order.InstanceID, order.UserID, currency, int64(amount))
+		credit.OrderID = order.ID
+		credit.TransactionID = refund.ID
+		credit.Description = "Refund of order " + orderLabel(order)
+		if err := models.BookCredit(tx, credit); err != nil {
+			return "", err
+		}
+		return credit.ID, nil
+	}
+}
+
+// orderLabel returns the number customers know the order by, or its ID for
+// orders without a number.
+func orderLabel(order *models.Order) string {
+	if order.Number != "" {
+		return order.Number
+	}
+	return order.ID
+}
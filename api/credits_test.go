@@ -0,0 +1,142 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+func TestStoreCredit(t *testing.T) {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	setup := func(t *testing.T, credit int64) *RouteTest {
+		test := NewRouteTest(t)
+		test.Data.firstTransaction.Status = models.FailedState
+		require.NoError(t, test.DB.Save(test.Data.firstTransaction).Error)
+		require.NoError(t, test.DB.Model(&models.Order{}).Where("id = ?", test.Data.firstOrder.ID).Update("payment_state", models.PendingState).Error)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/users/"+test.Data.testUser.ID+"/credits", bytes.NewBufferString(fmt.Sprintf(`{"amount": %d, "currency": "USD", "description": "Goodwill"}`, credit)), token)
+		extractPayload(t, http.StatusCreated, recorder, &models.CreditTransaction{})
+		return test
+	}
+	pay := func(test *RouteTest, params map[string]interface{}) *httptest.ResponseRecorder {
+		params["currency"] = "USD"
+		body, err := json.Marshal(params)
+		require.NoError(t, err)
+		return test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+	}
+	ledger := func(t *testing.T, test *RouteTest) *creditLedger {
+		recorder := test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID+"/credits", nil, test.Data.testUserToken)
+		ledger := &creditLedger{}
+		extractPayload(t, http.StatusOK, recorder, ledger)
+		return ledger
+	}
+	paymentState := func(t *testing.T, test *RouteTest) string {
+		order := &models.Order{}
+		require.NoError(t, test.DB.Find(order, "id = ?", test.Data.firstOrder.ID).Error)
+		return order.PaymentState
+	}
+
+	t.Run("CoversTotal", func(t *testing.T) {
+		test := setup(t, 30)
+		recorder := pay(test, map[string]interface{}{"amount": 24, "use_credit": true})
+		tr := &models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, tr)
+		assert.Equal(t, models.StoreCreditProvider, tr.Provider)
+		assert.EqualValues(t, 24, tr.Amount)
+		assert.Equal(t, models.PaidState, paymentState(t, test))
+
+		credit := ledger(t, test)
+		assert.EqualValues(t, 6, credit.Balances["USD"])
+		require.Len(t, credit.Transactions, 2)
+	})
+	t.Run("SplitWithProvider", func(t *testing.T) {
+		test := setup(t, 10)
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+			switch path {
+			case "/v1/payment_intents":
+				assert.EqualValues(t, 14, *params.(*stripe.PaymentIntentParams).Amount)
+				intent := v.(*stripe.PaymentIntent)
+				intent.ID = stripePaymentIntentID
+				intent.Status = stripe.PaymentIntentStatusSucceeded
+				return nil
+			default:
+				t.Fatalf("unknown Stripe API call to %s", path)
+				return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+			}
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		recorder := pay(test, map[string]interface{}{"amount": 24, "use_credit": true})
+		validateError(t, http.StatusBadRequest, recorder, "requires specifying a 'provider'")
+		assert.EqualValues(t, 10, ledger(t, test).Balances["USD"])
+
+		recorder = pay(test, map[string]interface{}{"amount": 24, "use_credit": true, "provider": payments.StripeProvider, "stripe_payment_method_id": "payment-method-simple"})
+		card := &models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, card)
+		assert.EqualValues(t, 14, card.Amount)
+		assert.Equal(t, models.PaidState, paymentState(t, test))
+		assert.EqualValues(t, 0, ledger(t, test).Balances["USD"])
+
+		recorder = runPaymentRefund(test, "/payments/"+card.ID+"/refund", &PaymentParams{Amount: 14, Currency: "USD", ToCredit: true})
+		refund := &models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, refund)
+		assert.Equal(t, models.PaidState, refund.Status)
+		assert.Equal(t, models.StoreCreditProvider, refund.Provider)
+		assert.EqualValues(t, 14, ledger(t, test).Balances["USD"])
+
+		creditTr := &models.Transaction{}
+		require.NoError(t, test.DB.First(creditTr, "order_id = ? AND provider = ? AND type = ?", test.Data.firstOrder.ID, models.StoreCreditProvider, models.ChargeTransactionType).Error)
+		recorder = runPaymentRefund(test, "/payments/"+creditTr.ID+"/refund", &PaymentParams{Amount: 10, Currency: "USD"})
+		extractPayload(t, http.StatusOK, recorder, &models.Transaction{})
+		assert.Equal(t, models.RefundedState, paymentState(t, test))
+
+		credit := ledger(t, test)
+		assert.EqualValues(t, 24, credit.Balances["USD"])
+		assert.Len(t, credit.Transactions, 4)
+	})
+	t.Run("Overdraw", func(t *testing.T) {
+		test := setup(t, 10)
+		recorder := test.TestEndpoint(http.MethodPost, "/users/"+test.Data.testUser.ID+"/credits", bytes.NewBufferString(`{"amount": -11, "currency": "USD"}`), token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+	t.Run("Account", func(t *testing.T) {
+		test := NewRouteTest(t)
+		// entries booked before the accounts existed
+		require.NoError(t, test.DB.Create(models.NewCreditTransaction("", test.Data.testUser.ID, "USD", 10)).Error)
+
+		tx := test.DB.Begin()
+		assert.Equal(t, models.ErrInsufficientCredit, models.BookCredit(tx, models.NewCreditTransaction("", test.Data.testUser.ID, "USD", -11)))
+		require.NoError(t, models.BookCredit(tx, models.NewCreditTransaction("", test.Data.testUser.ID, "USD", -10)))
+		assert.Equal(t, models.ErrInsufficientCredit, models.BookCredit(tx, models.NewCreditTransaction("", test.Data.testUser.ID, "USD", -1)))
+		require.NoError(t, tx.Commit().Error)
+
+		account := &models.CreditAccount{}
+		require.NoError(t, test.DB.First(account, "user_id = ? AND currency = ?", test.Data.testUser.ID, "USD").Error)
+		assert.EqualValues(t, 0, account.Balance)
+		assert.EqualValues(t, 0, ledger(t, test).Balances["USD"])
+	})
+	t.Run("SpentConcurrently", func(t *testing.T) {
+		test := setup(t, 30)
+		// another payment spent the credit since the balance was read
+		require.NoError(t, test.DB.Model(&models.CreditAccount{}).Where("user_id = ?", test.Data.testUser.ID).UpdateColumn("balance", 0).Error)
+
+		recorder := pay(test, map[string]interface{}{"amount": 24, "use_credit": true})
+		validateError(t, http.StatusConflict, recorder)
+		assert.Equal(t, models.PendingState, paymentState(t, test))
+	})
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, "/users/"+test.Data.testUser.ID+"/credits", bytes.NewBufferString(`{"amount": 10, "currency": "USD"}`), test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
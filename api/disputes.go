@@ -0,0 +1,128 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+type disputeImpactRow struct {
+	Currency        string `json:"currency"`
+	Status          string `json:"status"`
+	Disputes        uint64 `json:"disputes"`
+	Amount          uint64 `json:"amount"`
+	Fees            uint64 `json:"fees"`
+	FinancialImpact uint64 `json:"financial_impact"`
+}
+
+// DisputeList lists the chargebacks and disputes. It is only available to admins.
+func (a *API) DisputeList(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+	query := a.DB(r).Where("instance_id = ?", instanceID)
+
+	query, err := parseDisputeQueryParams(query, r.URL.Query())
+	if err != nil {
+		return badRequestError("Malformed request: %v", err)
+	}
+
+	disputes := []models.Dispute{}
+	if rsp := query.Order("created_at desc").Find(&disputes); rsp.Error != nil {
+		return internalServerError("Error while querying for disputes").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, disputes)
+}
+
+// DisputeView returns a single dispute. It is only available to admins.
+func (a *API) DisputeView(w http.ResponseWriter, r *http.Request) error {
+	dispute, httpErr := a.getDispute(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	return sendJSON(w, http.StatusOK, dispute)
+}
+
+// DisputeEvidence attaches evidence metadata, e.g. tracking numbers or links to
+// customer communication, to a dispute. Keys set to null are removed.
+func (a *API) DisputeEvidence(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	dispute, httpErr := a.getDispute(r)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	evidence := map[string]interface{}{}
+	if err := json.NewDecoder(r.Body).Decode(&evidence); err != nil {
+		return badRequestError("Could not read evidence: %v", err)
+	}
+
+	if dispute.Evidence == nil {
+		dispute.Evidence = map[string]interface{}{}
+	}
+	for key, value := range evidence {
+		if value == nil {
+			delete(dispute.Evidence, key)
+		} else {
+			dispute.Evidence[key] = value
+		}
+	}
+
+	tx := a.DB(r).Begin()
+	if rsp := tx.Save(dispute); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving dispute evidence").WithInternalError(rsp.Error)
+	}
+	models.LogEvent(tx, r.RemoteAddr, gcontext.GetClaims(ctx).Subject, dispute.OrderID, models.EventUpdated, []string{"dispute_evidence"})
+	if err := tx.Commit().Error; err != nil {
+		return internalServerError("Error saving dispute evidence").WithInternalError(err)
+	}
+	return sendJSON(w, http.StatusOK, dispute)
+}
+
+// DisputeImpact sums up the disputed amounts, fees and the resulting financial
+// impact per currency and dispute state for a period.
+func (a *API) DisputeImpact(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+
+	query := a.DB(r).
+		Model(&models.Dispute{}).
+		Select("currency, status, count(*) as disputes, sum(amount) as amount, sum(fee) as fees, sum(financial_impact) as financial_impact").
+		Where("instance_id = ?", instanceID).
+		Group("currency, status")
+
+	query, err := parseTimeQueryParams(query, query.NewScope(models.Dispute{}).QuotedTableName(), r.URL.Query())
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+
+	rows, err := query.Rows()
+	if err != nil {
+		return internalServerError("Database error").WithInternalError(err)
+	}
+	defer rows.Close()
+	result := []*disputeImpactRow{}
+	for rows.Next() {
+		row := &disputeImpactRow{}
+		err = rows.Scan(&row.Currency, &row.Status, &row.Disputes, &row.Amount, &row.Fees, &row.FinancialImpact)
+		if err != nil {
+			return internalServerError("Database error").WithInternalError(err)
+		}
+		result = append(result, row)
+	}
+
+	return sendJSON(w, http.StatusOK, result)
+}
+
+func (a *API) getDispute(r *http.Request) (*models.Dispute, *HTTPError) {
+	dispute, err := models.GetDispute(a.DB(r), chi.URLParam(r, "dispute_id"))
+	if err != nil {
+		return nil, internalServerError("Error while querying for dispute").WithInternalError(err)
+	}
+	if dispute == nil || dispute.InstanceID != gcontext.GetInstanceID(r.Context()) {
+		return nil, notFoundError("Dispute not found")
+	}
+	return dispute, nil
+}
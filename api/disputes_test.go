@@ -0,0 +1,118 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+func createTestDisputes(t *testing.T, test *RouteTest) (*models.Dispute, *models.Dispute) {
+	open := models.NewDispute(test.Data.firstTransaction, payments.StripeProvider, "dp_open")
+	open.Fee = 15
+	require.NoError(t, test.DB.Create(open).Error)
+
+	won := models.NewDispute(test.Data.secondTransaction, payments.PayPalProvider, "dp_won")
+	won.Fee = 20
+	won.Status = models.DisputeWonState
+	require.NoError(t, test.DB.Create(won).Error)
+	return open, won
+}
+
+func TestDisputeList(t *testing.T) {
+	t.Run("AsAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		open, _ := createTestDisputes(t, test)
+
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodGet, "/disputes", nil, token)
+		disputes := []models.Dispute{}
+		extractPayload(t, http.StatusOK, recorder, &disputes)
+		assert.Len(t, disputes, 2)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/disputes?status=open", nil, token)
+		disputes = []models.Dispute{}
+		extractPayload(t, http.StatusOK, recorder, &disputes)
+		require.Len(t, disputes, 1)
+		assert.Equal(t, open.ID, disputes[0].ID)
+		assert.Equal(t, open.Amount+open.Fee, disputes[0].FinancialImpact)
+	})
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/disputes", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
+func TestDisputeView(t *testing.T) {
+	test := NewRouteTest(t)
+	open, _ := createTestDisputes(t, test)
+	token := testAdminToken("magical-unicorn", "")
+
+	recorder := test.TestEndpoint(http.MethodGet, "/disputes/"+open.ID, nil, token)
+	dispute := &models.Dispute{}
+	extractPayload(t, http.StatusOK, recorder, dispute)
+	assert.Equal(t, open.TransactionID, dispute.TransactionID)
+
+	recorder = test.TestEndpoint(http.MethodGet, "/disputes/dne", nil, token)
+	validateError(t, http.StatusNotFound, recorder)
+
+	recorder = test.TestEndpoint(http.MethodGet, "/payments/"+test.Data.firstTransaction.ID, nil, token)
+	trans := &models.Transaction{}
+	extractPayload(t, http.StatusOK, recorder, trans)
+	require.Len(t, trans.Disputes, 1)
+	assert.Equal(t, open.ID, trans.Disputes[0].ID)
+}
+
+func TestDisputeEvidence(t *testing.T) {
+	test := NewRouteTest(t)
+	open, _ := createTestDisputes(t, test)
+	token := testAdminToken("magical-unicorn", "")
+	url := "/disputes/" + open.ID + "/evidence"
+
+	recorder := test.TestEndpoint(http.MethodPut, url, bytes.NewBufferString(`{"tracking_number": "1Z999", "notes": "delivered"}`), token)
+	dispute := &models.Dispute{}
+	extractPayload(t, http.StatusOK, recorder, dispute)
+	assert.Equal(t, "1Z999", dispute.Evidence["tracking_number"])
+
+	recorder = test.TestEndpoint(http.MethodPut, url, bytes.NewBufferString(`{"notes": null, "receipt_url": "https://example.com/receipt"}`), token)
+	extractPayload(t, http.StatusOK, recorder, dispute)
+
+	stored, err := models.GetDispute(test.DB, open.ID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"tracking_number": "1Z999",
+		"receipt_url":     "https://example.com/receipt",
+	}, stored.Evidence)
+}
+
+func TestDisputeImpact(t *testing.T) {
+	test := NewRouteTest(t)
+	open, won := createTestDisputes(t, test)
+	lost := models.NewDispute(test.Data.firstTransaction, payments.StripeProvider, "dp_lost")
+	lost.Amount = 40
+	lost.Fee = 15
+	lost.Status = models.DisputeLostState
+	require.NoError(t, test.DB.Create(lost).Error)
+
+	recorder := test.TestEndpoint(http.MethodGet, "/disputes/impact", nil, testAdminToken("magical-unicorn", ""))
+	rows := []disputeImpactRow{}
+	extractPayload(t, http.StatusOK, recorder, &rows)
+	require.Len(t, rows, 3)
+
+	byStatus := map[string]disputeImpactRow{}
+	for _, row := range rows {
+		assert.Equal(t, "USD", row.Currency)
+		byStatus[row.Status] = row
+	}
+	assert.Equal(t, open.Amount+open.Fee, byStatus[models.DisputeOpenState].FinancialImpact)
+	assert.Equal(t, won.Fee, byStatus[models.DisputeWonState].FinancialImpact)
+	assert.Equal(t, won.Amount, byStatus[models.DisputeWonState].Amount)
+	assert.EqualValues(t, 55, byStatus[models.DisputeLostState].FinancialImpact)
+	assert.EqualValues(t, 1, byStatus[models.DisputeLostState].Disputes)
+}
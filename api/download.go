@@ -1,16 +1,53 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
 	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/conf"
 	gcontext "github.com/netlify/gocommerce/context"
 	"github.com/netlify/gocommerce/models"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
-const maxIPsPerDay = 50
+const defaultMaxIPsPerDay = 50
+
+// downloadTokenTTL is how long single use download tokens can be redeemed.
+const downloadTokenTTL = 15 * time.Minute
+
+// Reasons reported when a download limit has been hit.
+const (
+	downloadIPLimitReason    = "max_ips_per_day"
+	downloadCountLimitReason = "max_downloads"
+	downloadExpiredReason    = "expired"
+)
+
+// downloadWatermarkPendingReason is reported while the stamped copy of a
+// download is being requested.
+const downloadWatermarkPendingReason = "watermark_pending"
+
+// downloadLimits returns how many IPs the downloads of an order can be
+// accessed from within a day and how often the download can be accessed.
+// Zero means the download can be accessed any number of times.
+func downloadLimits(config *conf.Configuration, download *models.Download) (uint64, uint64) {
+	maxIPs := download.MaxIPsPerDay
+	if maxIPs == 0 {
+		maxIPs = config.Downloads.MaxIPsPerDay
+	}
+	if maxIPs == 0 {
+		maxIPs = defaultMaxIPsPerDay
+	}
+	maxDownloads := download.MaxDownloads
+	if maxDownloads == 0 {
+		maxDownloads = config.Downloads.MaxDownloads
+	}
+	return maxIPs, maxDownloads
+}
 
 // DownloadURL returns a signed URL to download a purchased asset.
 func (a *API) DownloadURL(w http.ResponseWriter, r *http.Request) error {
@@ -20,6 +57,7 @@ func (a *API) DownloadURL(w http.ResponseWriter, r *http.Request) error {
 	logEntrySetField(r, "download_id", downloadID)
 	claims := gcontext.GetClaims(ctx)
 	assets := gcontext.GetAssetStore(ctx)
+	config := gcontext.GetConfig(ctx)
 
 	download := &models.Download{}
 	if result := db.Where("id = ?", downloadID).First(download); result.Error != nil {
@@ -44,6 +82,17 @@ func (a *API) DownloadURL(w http.ResponseWriter, r *http.Request) error {
 	if order.PaymentState != models.PaidState {
 		return unauthorizedError("This download has not been paid yet")
 	}
+	if download.Revoked {
+		return unauthorizedError("This download has been revoked")
+	}
+	if download.Expired(time.Now()) {
+		return unauthorizedError("This download expired at %s", download.ExpiresAt.Format(time.RFC3339)).WithReason(downloadExpiredReason)
+	}
+
+	maxIPs, maxDownloads := downloadLimits(config, download)
+	if maxDownloads > 0 && download.DownloadCount >= maxDownloads {
+		return unauthorizedError("This download has already been accessed %d times", maxDownloads).WithReason(downloadCountLimitReason)
+	}
 
 	rows, err := db.Model(&models.Event{}).
 		Select("count(distinct(ip))").
@@ -59,26 +108,117 @@ func (a *API) DownloadURL(w http.ResponseWriter, r *http.Request) error {
 			return internalServerError("Error signing download").WithInternalError(err)
 		}
 	}
-	if count > maxIPsPerDay {
-		return unauthorizedError("This download has been accessed from too many IPs within the last day")
+	if count > maxIPs {
+		return unauthorizedError("This download has been accessed from more than %d IPs within the last day", maxIPs).WithReason(downloadIPLimitReason)
 	}
 
-	if err := download.SignURL(assets); err != nil {
-		return internalServerError("Error signing download").WithInternalError(err)
+	if download.Watermark {
+		if download.WatermarkedURL == "" {
+			if err := queueWatermarks(db, order); err != nil {
+				return internalServerError("Error watermarking download").WithInternalError(err)
+			}
+			return httpError(http.StatusConflict, "This download is still being watermarked, retry in a minute").WithReason(downloadWatermarkPendingReason)
+		}
+		download.URL = download.WatermarkedURL
 	}
 
 	tx := db.Begin()
+	if config.Downloads.OneTimeTokens || config.Downloads.Proxy {
+		ttl := downloadTokenTTL
+		if config.Downloads.Proxy {
+			ttl = downloadProxyTokenTTL
+		}
+		token, err := models.NewDownloadToken(gcontext.GetInstanceID(ctx), download, ttl)
+		if err != nil {
+			tx.Rollback()
+			return internalServerError("Error creating download token").WithInternalError(err)
+		}
+		if rsp := tx.Create(token); rsp.Error != nil {
+			tx.Rollback()
+			return internalServerError("Error creating download token").WithInternalError(rsp.Error)
+		}
+		download.Token = token.Token
+		download.URL = a.apiURL(r, "/downloads/redeem/"+token.Token)
+	} else if err := download.SignURL(assets); err != nil {
+		tx.Rollback()
+		return internalServerError("Error signing download").WithInternalError(err)
+	}
+
 	tx.Model(download).Updates(map[string]interface{}{"download_count": gorm.Expr("download_count + 1")})
 	var subject string
 	if claims != nil {
 		subject = claims.Subject
 	}
 	models.LogEvent(tx, r.RemoteAddr, subject, order.ID, models.EventUpdated, []string{"download"})
+	if err := models.LogDownload(tx, order, download, r.RemoteAddr, downloadCountry(config, r)); err != nil {
+		tx.Rollback()
+		return internalServerError("Error logging download").WithInternalError(err)
+	}
 	tx.Commit()
 
 	return sendJSON(w, http.StatusOK, download)
 }
 
+// DownloadRedeem consumes a single use download token and redirects to the
+// signed URL of the download. Downloads are streamed instead if the instance
+// proxies them, and their tokens can be used until they expire so downloads
+// can be resumed.
+func (a *API) DownloadRedeem(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	db := a.DB(r)
+	assets := gcontext.GetAssetStore(ctx)
+	config := gcontext.GetConfig(ctx)
+
+	redeem := models.ConsumeDownloadToken
+	if config.Downloads.Proxy {
+		redeem = models.FindDownloadToken
+	}
+	tx := db.Begin()
+	token, ok, err := redeem(tx, gcontext.GetInstanceID(ctx), chi.URLParam(r, "token"))
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Error redeeming download token").WithInternalError(err)
+	}
+	if !ok {
+		tx.Rollback()
+		return unauthorizedError("This download token is invalid, expired or has already been used")
+	}
+	logEntrySetField(r, "download_id", token.DownloadID)
+
+	download := &models.Download{}
+	if result := tx.Where("id = ?", token.DownloadID).First(download); result.Error != nil {
+		tx.Rollback()
+		if result.RecordNotFound() {
+			return notFoundError("Download not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	if download.Revoked {
+		tx.Rollback()
+		return unauthorizedError("This download has been revoked")
+	}
+	if download.Expired(time.Now()) {
+		tx.Rollback()
+		return unauthorizedError("This download expired at %s", download.ExpiresAt.Format(time.RFC3339)).WithReason(downloadExpiredReason)
+	}
+	if download.WatermarkedURL != "" {
+		download.URL = download.WatermarkedURL
+	}
+	if err := download.SignURL(assets); err != nil {
+		tx.Rollback()
+		return internalServerError("Error signing download").WithInternalError(err)
+	}
+	if result := tx.Commit(); result.Error != nil {
+		return internalServerError("Error redeeming download token").WithInternalError(result.Error)
+	}
+
+	if config.Downloads.Proxy {
+		return proxyDownload(w, r, config, download.URL)
+	}
+	http.Redirect(w, r, download.URL, http.StatusFound)
+	return nil
+}
+
 // DownloadList lists all purchased downloads for an order or a user.
 func (a *API) DownloadList(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
@@ -111,7 +251,8 @@ func (a *API) DownloadList(w http.ResponseWriter, r *http.Request) error {
 	orderTable := db.NewScope(models.Order{}).QuotedTableName()
 	downloadsTable := db.NewScope(models.Download{}).QuotedTableName()
 
-	query := db.Joins("join " + orderTable + " ON " + downloadsTable + ".order_id = " + orderTable + ".id and " + orderTable + ".payment_state = 'paid'")
+	query := db.Joins("join "+orderTable+" ON "+downloadsTable+".order_id = "+orderTable+".id and "+orderTable+".payment_state = 'paid'").
+		Where(downloadsTable+".revoked = ?", false)
 	if order != nil {
 		query = query.Where(orderTable+".id = ?", order.ID)
 	} else {
@@ -119,6 +260,14 @@ func (a *API) DownloadList(w http.ResponseWriter, r *http.Request) error {
 		query = query.Where(orderTable+".user_id = ?", claims.Subject)
 	}
 
+	switch group := r.URL.Query().Get("group"); group {
+	case "":
+	case "product":
+		return a.downloadProductList(w, r, db, query)
+	default:
+		return badRequestError("Unknown download grouping %s", group)
+	}
+
 	offset, limit, err := paginate(w, r, query.Model(&models.Download{}))
 	if err != nil {
 		return badRequestError("Bad Pagination Parameters: %v", err)
@@ -128,11 +277,68 @@ func (a *API) DownloadList(w http.ResponseWriter, r *http.Request) error {
 	if result := query.Offset(offset).Limit(limit).Find(&downloads); result.Error != nil {
 		return internalServerError("Error during database query").WithInternalError(err)
 	}
+	if err := downloadLicenses(db, downloads); err != nil {
+		return internalServerError("Error loading licenses").WithInternalError(err)
+	}
 
 	log.WithField("download_count", len(downloads)).Debugf("Successfully retrieved %d downloads", len(downloads))
 	return sendJSON(w, http.StatusOK, downloads)
 }
 
+// downloadProduct is a purchased product with the newest file of each format
+// of its downloads.
+type downloadProduct struct {
+	Sku      string            `json:"sku"`
+	Title    string            `json:"title"`
+	Files    []models.Download `json:"files"`
+	Licenses []string          `json:"licenses,omitempty"`
+}
+
+// downloadProductList lists the downloads grouped by product. Downloads added
+// by a refresh replace the older files of the same format, so only the newest
+// file of each format is listed.
+func (a *API) downloadProductList(w http.ResponseWriter, r *http.Request, db, query *gorm.DB) error {
+	downloadsTable := db.NewScope(models.Download{}).QuotedTableName()
+
+	var downloads []models.Download
+	if result := query.Order(downloadsTable + ".created_at desc").Find(&downloads); result.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	if err := downloadLicenses(db, downloads); err != nil {
+		return internalServerError("Error loading licenses").WithInternalError(err)
+	}
+
+	products := []*downloadProduct{}
+	bySku := map[string]*downloadProduct{}
+	formats := map[string]bool{}
+	licenses := map[string]bool{}
+	for _, download := range downloads {
+		product, ok := bySku[download.Sku]
+		if !ok {
+			product = &downloadProduct{Sku: download.Sku, Title: download.Title, Files: []models.Download{}}
+			bySku[download.Sku] = product
+			products = append(products, product)
+		}
+		for _, key := range download.Licenses {
+			if !licenses[key] {
+				licenses[key] = true
+				product.Licenses = append(product.Licenses, key)
+			}
+		}
+		download.Licenses = nil
+
+		format := download.Sku + "/" + download.Format
+		if formats[format] {
+			continue
+		}
+		formats[format] = true
+		product.Files = append(product.Files, download)
+	}
+
+	getLogEntry(r).WithField("product_count", len(products)).Debugf("Successfully retrieved downloads of %d products", len(products))
+	return sendJSON(w, http.StatusOK, products)
+}
+
 // DownloadRefresh makes sure downloads are up to date
 func (a *API) DownloadRefresh(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
@@ -170,6 +376,179 @@ func (a *API) DownloadRefresh(w http.ResponseWriter, r *http.Request) error {
 	if result := a.db.Save(order); result.Error != nil {
 		return internalServerError("Error during saving order").WithInternalError(result.Error)
 	}
+	paidAt, err := models.OrderPaidAt(a.db, order)
+	if err != nil {
+		return internalServerError("Error during updating downloads").WithInternalError(err)
+	}
+	if err := models.StartDownloadExpiry(a.db, order, paidAt); err != nil {
+		return internalServerError("Error during updating downloads").WithInternalError(err)
+	}
 
 	return sendJSON(w, http.StatusOK, map[string]string{})
 }
+
+// DownloadRefreshAll refreshes the downloads of all paid orders of the product
+// with the sku in the background, e.g. once a new version of its files has been
+// released. It is only available to admins.
+func (a *API) DownloadRefreshAll(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	db := a.DB(r)
+	instanceID := gcontext.GetInstanceID(ctx)
+
+	sku := r.URL.Query().Get("sku")
+	if sku == "" {
+		return badRequestError("The sku of the product to refresh is required")
+	}
+	logEntrySetField(r, "sku", sku)
+
+	var count int
+	if result := skuOrders(db, instanceID, sku).Count(&count); result.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	if err := models.EnqueueJob(db, instanceID, refreshDownloadsJob, sku, &refreshDownloadsPayload{Sku: sku}); err != nil {
+		return internalServerError("Error refreshing downloads").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusAccepted, map[string]int{"orders": count})
+}
+
+// refreshDownloadsJob adds the new downloads of a product to its paid orders.
+const refreshDownloadsJob = "refresh_downloads"
+
+// refreshDownloadsBatchSize is how many orders are refreshed at once.
+const refreshDownloadsBatchSize = 100
+
+type refreshDownloadsPayload struct {
+	Sku string `json:"sku"`
+}
+
+// skuOrders queries the paid orders of the instance with the product.
+func skuOrders(db *gorm.DB, instanceID, sku string) *gorm.DB {
+	items := db.Model(&models.LineItem{}).Select("order_id").Where("sku = ?", sku).SubQuery()
+	return db.Model(&models.Order{}).Where("instance_id = ? AND payment_state = ? AND id IN ?", instanceID, models.PaidState, items)
+}
+
+// runRefreshDownloadsJob refreshes the downloads of the paid orders of the
+// product of the job in batches.
+func runRefreshDownloadsJob(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, job *models.Job) error {
+	payload := &refreshDownloadsPayload{}
+	if err := json.Unmarshal([]byte(job.Payload), payload); err != nil {
+		return errors.Wrap(err, "Error parsing job payload")
+	}
+	config := gcontext.GetConfig(ctx)
+
+	refreshed := 0
+	lastID := ""
+	for {
+		orders := []*models.Order{}
+		query := skuOrders(db, job.InstanceID, payload.Sku).
+			Preload("LineItems").
+			Preload("Downloads").
+			Where("id > ?", lastID).
+			Order("id asc").
+			Limit(refreshDownloadsBatchSize)
+		if result := query.Find(&orders); result.Error != nil {
+			return result.Error
+		}
+		if len(orders) == 0 {
+			break
+		}
+		lastID = orders[len(orders)-1].ID
+
+		updated, err := refreshDownloads(db, config, log, orders, payload.Sku)
+		refreshed += updated
+		if err != nil {
+			return err
+		}
+	}
+	log.Infof("Refreshed the downloads of %d orders", refreshed)
+	return nil
+}
+
+// refreshDownloads adds the new downloads of the product with the sku to the
+// orders and saves the orders that got new downloads. The new downloads
+// expire like the others, counting from the payment of their order. It
+// returns how many orders got new downloads.
+func refreshDownloads(db *gorm.DB, config *conf.Configuration, log logrus.FieldLogger, orders []*models.Order, sku string) (int, error) {
+	updates, err := models.UpdateSkuDownloads(config, log, orders, sku)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, order := range updates {
+		paidAt, err := models.OrderPaidAt(db, order)
+		if err != nil {
+			return 0, err
+		}
+		tx := db.Begin()
+		if result := tx.Save(order); result.Error != nil {
+			tx.Rollback()
+			return 0, result.Error
+		}
+		if err := models.StartDownloadExpiry(tx, order, paidAt); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		if err := tx.Commit().Error; err != nil {
+			return 0, err
+		}
+	}
+	return len(updates), nil
+}
+
+// DownloadExtendParams are the parameters to extend the expiry of a download.
+// ExpiresAt sets the new expiry, Days extends the current one, or now if the
+// download has already expired.
+type DownloadExtendParams struct {
+	ExpiresAt *time.Time `json:"expires_at"`
+	Days      uint64     `json:"days"`
+}
+
+// DownloadExtend extends the expiry of a download, e.g. for support cases. It
+// is only available to admins.
+func (a *API) DownloadExtend(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	db := a.DB(r)
+	downloadID := chi.URLParam(r, "download_id")
+	logEntrySetField(r, "download_id", downloadID)
+	claims := gcontext.GetClaims(ctx)
+
+	params := &DownloadExtendParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read params: %v", err)
+	}
+	if params.ExpiresAt == nil && params.Days == 0 {
+		return badRequestError("Either expires_at or days is required")
+	}
+
+	download := &models.Download{}
+	if result := db.Where("id = ?", downloadID).First(download); result.Error != nil {
+		if result.RecordNotFound() {
+			return notFoundError("Download not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+
+	expiresAt := params.ExpiresAt
+	if expiresAt == nil {
+		from := time.Now()
+		if download.ExpiresAt != nil && download.ExpiresAt.After(from) {
+			from = *download.ExpiresAt
+		}
+		extended := from.AddDate(0, 0, int(params.Days))
+		expiresAt = &extended
+	}
+
+	tx := db.Begin()
+	if result := tx.Model(download).Update("expires_at", expiresAt); result.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error updating download").WithInternalError(result.Error)
+	}
+	models.LogEvent(tx, r.RemoteAddr, claims.Subject, download.OrderID, models.EventUpdated, []string{"download_expiry"})
+	if result := tx.Commit(); result.Error != nil {
+		return internalServerError("Error updating download").WithInternalError(result.Error)
+	}
+
+	download.ExpiresAt = expiresAt
+	return sendJSON(w, http.StatusOK, download)
+}
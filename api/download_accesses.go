@@ -0,0 +1,81 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+// downloadAccess is an access of a download with the IP reduced to its network,
+// so customers can tell whether a link was shared without exposing the exact
+// addresses.
+type downloadAccess struct {
+	AccessedAt time.Time `json:"accessed_at"`
+	IP         string    `json:"ip,omitempty"`
+	Country    string    `json:"country,omitempty"`
+}
+
+// DownloadAccessList lists the accesses of a download of an order.
+func (a *API) DownloadAccessList(w http.ResponseWriter, r *http.Request) error {
+	order, httpErr := a.loadOrder(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	downloadID := chi.URLParam(r, "download_id")
+	logEntrySetField(r, "download_id", downloadID)
+
+	db := a.DB(r)
+	download := &models.Download{}
+	if rsp := db.First(download, "id = ? AND order_id = ?", downloadID, order.ID); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return notFoundError("Download not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+
+	logs := []*models.DownloadLog{}
+	if rsp := db.Where("download_id = ?", download.ID).Order("created_at asc").Find(&logs); rsp.Error != nil {
+		return internalServerError("Error querying download accesses").WithInternalError(rsp.Error)
+	}
+
+	accesses := make([]*downloadAccess, len(logs))
+	for i, log := range logs {
+		accesses[i] = &downloadAccess{
+			AccessedAt: log.CreatedAt,
+			IP:         coarseIP(log.IP),
+			Country:    log.Country,
+		}
+	}
+	return sendJSON(w, http.StatusOK, accesses)
+}
+
+// downloadCountry returns the country of the client as reported by the CDN in
+// front of the API.
+func downloadCountry(config *conf.Configuration, r *http.Request) string {
+	if config.Downloads.CountryHeader == "" {
+		return ""
+	}
+	return strings.ToUpper(r.Header.Get(config.Downloads.CountryHeader))
+}
+
+// coarseIP reduces an IP to its network, the /24 of IPv4 and the /48 of IPv6
+// addresses.
+func coarseIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
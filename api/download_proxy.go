@@ -0,0 +1,137 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/netlify/gocommerce/conf"
+)
+
+// downloadProxyTokenTTL is how long the tokens of proxied downloads can be
+// used. They can be used more than once within it, so interrupted downloads
+// can be resumed.
+const downloadProxyTokenTTL = 15 * time.Minute
+
+// downloadProxyTimeout bounds how long streaming a proxied asset can take.
+const downloadProxyTimeout = 30 * time.Minute
+
+// downloadProxyClient fetches proxied assets. It only connects to public
+// addresses and doesn't follow redirects, so the URLs of downloads can't
+// reach internal services or carry the authorization of the asset store to
+// other hosts.
+var downloadProxyClient = &http.Client{
+	Timeout: downloadProxyTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				return checkDownloadProxyAddress(address)
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// downloadProxyAllowedIP reports whether proxied assets can be fetched from
+// the IP address.
+var downloadProxyAllowedIP = func(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// checkDownloadProxyAddress refuses to connect to the resolved address of an
+// asset store host unless it's public.
+func checkDownloadProxyAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !downloadProxyAllowedIP(ip) {
+		return fmt.Errorf("Refusing to fetch a proxied download from %s", host)
+	}
+	return nil
+}
+
+// downloadProxyHostAllowed reports whether the asset URL is on one of the
+// hosts of the asset store. Hosts match with or without the port.
+func downloadProxyHostAllowed(config *conf.Configuration, u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	for _, host := range config.Downloads.ProxyHosts {
+		if strings.EqualFold(host, u.Host) || strings.EqualFold(host, u.Hostname()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Headers passed on between clients and the asset store when proxying.
+var (
+	downloadProxyRequestHeaders  = []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"}
+	downloadProxyResponseHeaders = []string{"Accept-Ranges", "Content-Disposition", "Content-Length", "Content-Range", "Content-Type", "ETag", "Last-Modified"}
+)
+
+// proxyDownload streams the asset to the client. Range requests are passed on
+// to the asset store, so partial and resumed downloads are answered by it.
+func proxyDownload(w http.ResponseWriter, r *http.Request, config *conf.Configuration, assetURL string) error {
+	u, err := url.Parse(assetURL)
+	if err != nil {
+		return internalServerError("Error fetching download").WithInternalError(err)
+	}
+	if !downloadProxyHostAllowed(config, u) {
+		return internalServerError("Error fetching download").WithInternalMessage("The host of %s isn't one of the proxy hosts of the asset store", assetURL)
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return internalServerError("Error fetching download").WithInternalError(err)
+	}
+	req = req.WithContext(r.Context())
+	for _, header := range downloadProxyRequestHeaders {
+		if value := r.Header.Get(header); value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+	if config.Downloads.ProxyAuthorization != "" {
+		req.Header.Set("Authorization", config.Downloads.ProxyAuthorization)
+	}
+
+	resp, err := downloadProxyClient.Do(req)
+	if err != nil {
+		return internalServerError("Error fetching download").WithInternalError(err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusNotModified, http.StatusRequestedRangeNotSatisfiable:
+	default:
+		return internalServerError("Error fetching download: %s", resp.Status)
+	}
+
+	for _, header := range downloadProxyResponseHeaders {
+		if value := resp.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	if w.Header().Get("Content-Disposition") == "" && path.Base(u.Path) != "/" && path.Base(u.Path) != "." {
+		w.Header().Set("Content-Disposition", `attachment; filename="`+path.Base(u.Path)+`"`)
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		getLogEntry(r).WithError(err).Warn("Proxied download was interrupted")
+	}
+	return nil
+}
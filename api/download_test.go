@@ -1,15 +1,23 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/netlify/gocommerce/models"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDownloadList(t *testing.T) {
@@ -22,6 +30,187 @@ func TestDownloadList(t *testing.T) {
 		extractPayload(t, http.StatusOK, recorder, &downloads)
 		assert.Len(t, downloads, 1)
 	})
+	t.Run("GroupedByProduct", func(t *testing.T) {
+		test := NewRouteTest(t)
+		sku := test.Data.firstOrder.LineItems[0].Sku
+		for i, download := range []*models.Download{
+			{ID: "pdf-v1", Format: "pdf", URL: "/v1.pdf", Size: 100},
+			{ID: "pdf-v2", Format: "pdf", URL: "/v2.pdf", Size: 200},
+			{ID: "epub-v1", Format: "epub", URL: "/v1.epub", Size: 300},
+		} {
+			download.OrderID = test.Data.firstOrder.ID
+			download.Sku = sku
+			download.CreatedAt = time.Now().Add(time.Duration(i+1) * time.Minute)
+			require.NoError(t, test.DB.Create(download).Error)
+		}
+
+		recorder := test.TestEndpoint(http.MethodGet, "/downloads?group=product", nil, test.Data.testUserToken)
+		products := []downloadProduct{}
+		extractPayload(t, http.StatusOK, recorder, &products)
+		require.Len(t, products, 1)
+		assert.Equal(t, sku, products[0].Sku)
+		files := map[string]models.Download{}
+		for _, file := range products[0].Files {
+			files[file.Format] = file
+		}
+		assert.Len(t, files, 3)
+		assert.Equal(t, "pdf-v2", files["pdf"].ID)
+		assert.Equal(t, uint64(200), files["pdf"].Size)
+		assert.Equal(t, "epub-v1", files["epub"].ID)
+	})
+	t.Run("UnknownGrouping", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/downloads?group=format", nil, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+}
+
+func TestDownloadURL(t *testing.T) {
+	url := "/downloads/first-download"
+	reason := func(t *testing.T, recorder *httptest.ResponseRecorder) string {
+		require.Equal(t, http.StatusUnauthorized, recorder.Code, "code mismatch: %v", recorder.Body)
+		rsp := &HTTPError{}
+		require.NoError(t, json.NewDecoder(recorder.Body).Decode(rsp))
+		return rsp.Reason
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, test.Data.testUserToken)
+		download := &models.Download{}
+		extractPayload(t, http.StatusOK, recorder, download)
+		assert.Equal(t, "first-download", download.ID)
+
+		stored := &models.Download{}
+		require.NoError(t, test.DB.First(stored, "id = ?", download.ID).Error)
+		assert.Equal(t, uint64(1), stored.DownloadCount)
+	})
+	t.Run("MaxDownloads", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Downloads.MaxDownloads = 2
+		for i := 0; i < 2; i++ {
+			recorder := test.TestEndpoint(http.MethodGet, url, nil, test.Data.testUserToken)
+			assert.Equal(t, http.StatusOK, recorder.Code)
+		}
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, test.Data.testUserToken)
+		assert.Equal(t, downloadCountLimitReason, reason(t, recorder))
+	})
+	t.Run("ProductMaxDownloads", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Downloads.MaxDownloads = 5
+		require.NoError(t, test.DB.Model(&models.Download{}).Where("id = ?", "first-download").Updates(map[string]interface{}{
+			"max_downloads":  1,
+			"download_count": 1,
+		}).Error)
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, test.Data.testUserToken)
+		assert.Equal(t, downloadCountLimitReason, reason(t, recorder))
+	})
+	t.Run("MaxIPsPerDay", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Downloads.MaxIPsPerDay = 1
+		for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+			models.LogEvent(test.DB, ip, test.Data.testUser.ID, test.Data.firstOrder.ID, models.EventUpdated, []string{"download"})
+		}
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, test.Data.testUserToken)
+		assert.Equal(t, downloadIPLimitReason, reason(t, recorder))
+	})
+	t.Run("Expired", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(&models.Download{}).Where("id = ?", "first-download").Update("expires_at", time.Now().Add(-time.Hour)).Error)
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, test.Data.testUserToken)
+		assert.Equal(t, downloadExpiredReason, reason(t, recorder))
+	})
+	t.Run("OneTimeToken", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Downloads.OneTimeTokens = true
+		assetURL := "https://cdn.example.com/batwing.zip"
+		require.NoError(t, test.DB.Model(&models.Download{}).Where("id = ?", "first-download").Update("url", assetURL).Error)
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, test.Data.testUserToken)
+		download := &models.Download{}
+		extractPayload(t, http.StatusOK, recorder, download)
+		require.NotEmpty(t, download.Token)
+		assert.Equal(t, baseURL+"/downloads/redeem/"+download.Token, download.URL)
+		path := strings.TrimPrefix(download.URL, baseURL)
+
+		recorder = test.TestEndpoint(http.MethodGet, path, nil, nil)
+		assert.Equal(t, http.StatusFound, recorder.Code)
+		assert.Equal(t, assetURL, recorder.Header().Get("Location"))
+
+		recorder = test.TestEndpoint(http.MethodGet, path, nil, nil)
+		validateError(t, http.StatusUnauthorized, recorder, "already been used")
+	})
+	t.Run("ExpiredToken", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token, err := models.NewDownloadToken("", &models.Download{ID: "first-download"}, -time.Minute)
+		require.NoError(t, err)
+		require.NoError(t, test.DB.Create(token).Error)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/downloads/redeem/"+token.Token, nil, nil)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+	t.Run("ExpiryStartsAtPayment", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(&models.Download{}).Where("id = ?", "first-download").Update("expires_after_days", 30).Error)
+		ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+		require.NoError(t, err)
+
+		tx := test.DB.Begin()
+		order := &models.Order{}
+		require.NoError(t, orderQuery(tx).First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		order.PaymentState = models.PendingState
+		tr := models.NewTransaction(order)
+		complete, err := completePayment(ctx, tx, logrus.StandardLogger(), tr, order)
+		require.NoError(t, err)
+		assert.True(t, complete)
+		require.NoError(t, tx.Commit().Error)
+
+		stored := &models.Download{}
+		require.NoError(t, test.DB.First(stored, "id = ?", "first-download").Error)
+		require.NotNil(t, stored.ExpiresAt)
+		assert.WithinDuration(t, time.Now().AddDate(0, 0, 30), *stored.ExpiresAt, time.Minute)
+	})
+}
+
+func TestDownloadExtend(t *testing.T) {
+	url := "/downloads/first-download/extend"
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	extend := func(t *testing.T, test *RouteTest, params *DownloadExtendParams) *models.Download {
+		body, err := json.Marshal(params)
+		require.NoError(t, err)
+		recorder := test.TestEndpoint(http.MethodPost, url, bytes.NewBuffer(body), token)
+		download := &models.Download{}
+		extractPayload(t, http.StatusOK, recorder, download)
+		require.NotNil(t, download.ExpiresAt)
+		return download
+	}
+
+	t.Run("Days", func(t *testing.T) {
+		test := NewRouteTest(t)
+		expiresAt := time.Now().Add(-time.Hour)
+		require.NoError(t, test.DB.Model(&models.Download{}).Where("id = ?", "first-download").Update("expires_at", expiresAt).Error)
+
+		download := extend(t, test, &DownloadExtendParams{Days: 7})
+		assert.WithinDuration(t, time.Now().AddDate(0, 0, 7), *download.ExpiresAt, time.Minute)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/downloads/first-download", nil, test.Data.testUserToken)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	})
+	t.Run("ExpiresAt", func(t *testing.T) {
+		test := NewRouteTest(t)
+		expiresAt := time.Now().AddDate(1, 0, 0).UTC().Truncate(time.Second)
+		download := extend(t, test, &DownloadExtendParams{ExpiresAt: &expiresAt})
+		assert.True(t, expiresAt.Equal(*download.ExpiresAt))
+	})
+	t.Run("MissingParams", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, url, bytes.NewBufferString("{}"), token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+	t.Run("NonAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, url, bytes.NewBufferString(`{"days": 7}`), test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
 }
 
 func currentDownloads(test *RouteTest) []models.Download {
@@ -33,8 +222,9 @@ func currentDownloads(test *RouteTest) []models.Download {
 }
 
 type DownloadMeta struct {
-	Title string `json:"title"`
-	URL   string `json:"url"`
+	Title            string `json:"title"`
+	URL              string `json:"url"`
+	ExpiresAfterDays uint64 `json:"expires_after_days,omitempty"`
 }
 
 func startTestSiteWithDownloads(t *testing.T, downloads []*DownloadMeta) *httptest.Server {
@@ -90,3 +280,298 @@ func TestDownloadRefresh(t *testing.T) {
 	}
 	assert.True(t, exists)
 }
+
+func TestDownloadRefreshAll(t *testing.T) {
+	t.Run("Refreshed", func(t *testing.T) {
+		test := NewRouteTest(t)
+		testSite := startTestSiteWithDownloads(t, []*DownloadMeta{
+			&DownloadMeta{
+				Title: "Version 2",
+				URL:   "/my/special/v2/url",
+			},
+		})
+		defer testSite.Close()
+		test.Config.SiteURL = testSite.URL
+
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodPost, "/downloads/refresh_all?sku=123-i-can-fly-456", nil, token)
+		rsp := map[string]int{}
+		extractPayload(t, http.StatusAccepted, recorder, &rsp)
+		assert.Equal(t, 1, rsp["orders"])
+		test.RunJobs()
+
+		downloads := currentDownloads(test)
+		require.Len(t, downloads, 2)
+		urls := []string{downloads[0].URL, downloads[1].URL}
+		assert.Contains(t, urls, "/my/special/v2/url")
+	})
+	t.Run("ExpiryFromPayment", func(t *testing.T) {
+		test := NewRouteTest(t)
+		testSite := startTestSiteWithDownloads(t, []*DownloadMeta{
+			&DownloadMeta{
+				Title:            "Version 2",
+				URL:              "/my/special/v2/url",
+				ExpiresAfterDays: 30,
+			},
+		})
+		defer testSite.Close()
+		test.Config.SiteURL = testSite.URL
+		paidAt := time.Now().AddDate(0, -2, 0)
+		require.NoError(t, test.DB.Model(&models.Transaction{}).Where("id = ?", test.Data.firstTransaction.ID).Update("created_at", paidAt).Error)
+
+		orders := []*models.Order{}
+		require.NoError(t, test.DB.Preload("LineItems").Preload("Downloads").Find(&orders, "id = ?", test.Data.firstOrder.ID).Error)
+		refreshed, err := refreshDownloads(test.DB, test.Config, logrus.StandardLogger(), orders, "123-i-can-fly-456")
+		require.NoError(t, err)
+		assert.Equal(t, 1, refreshed)
+
+		download := &models.Download{}
+		require.NoError(t, test.DB.First(download, "url = ?", "/my/special/v2/url").Error)
+		require.NotNil(t, download.ExpiresAt)
+		assert.WithinDuration(t, paidAt.AddDate(0, 0, 30), *download.ExpiresAt, time.Second)
+		assert.True(t, download.Expired(time.Now()))
+	})
+	t.Run("Queued", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		for i := 0; i < 2; i++ {
+			recorder := test.TestEndpoint(http.MethodPost, "/downloads/refresh_all?sku=123-i-can-fly-456", nil, token)
+			assert.Equal(t, http.StatusAccepted, recorder.Code)
+		}
+		var jobs int
+		require.NoError(t, test.DB.Model(&models.Job{}).Where("type = ? AND reference = ?", refreshDownloadsJob, "123-i-can-fly-456").Count(&jobs).Error)
+		assert.Equal(t, 1, jobs)
+	})
+	t.Run("MissingSku", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodPost, "/downloads/refresh_all", nil, token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, "/downloads/refresh_all?sku=123-i-can-fly-456", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
+func TestDownloadProxy(t *testing.T) {
+	// the stores of the tests listen on the loopback address
+	allowedIP := downloadProxyAllowedIP
+	downloadProxyAllowedIP = func(ip net.IP) bool { return true }
+	defer func() { downloadProxyAllowedIP = allowedIP }()
+
+	content := "the plans of the batwing"
+	setup := func(t *testing.T) (*RouteTest, *httptest.Server) {
+		store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Basic secret" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			http.ServeContent(w, r, "batwing.txt", time.Now(), strings.NewReader(content))
+		}))
+		test := NewRouteTest(t)
+		test.Config.Downloads.Proxy = true
+		test.Config.Downloads.ProxyAuthorization = "Basic secret"
+		test.Config.Downloads.ProxyHosts = []string{strings.TrimPrefix(store.URL, "http://")}
+		require.NoError(t, test.DB.Model(&models.Download{}).Where("id = ?", "first-download").Update("url", store.URL+"/assets/batwing.txt").Error)
+		return test, store
+	}
+	tokenURL := func(t *testing.T, test *RouteTest) string {
+		recorder := test.TestEndpoint(http.MethodGet, "/downloads/first-download", nil, test.Data.testUserToken)
+		download := &models.Download{}
+		extractPayload(t, http.StatusOK, recorder, download)
+		require.NotEmpty(t, download.Token)
+		return strings.TrimPrefix(download.URL, baseURL)
+	}
+
+	t.Run("Streamed", func(t *testing.T) {
+		test, store := setup(t)
+		defer store.Close()
+		url := tokenURL(t, test)
+
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, nil)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, content, recorder.Body.String())
+		assert.Equal(t, "bytes", recorder.Header().Get("Accept-Ranges"))
+		assert.Equal(t, `attachment; filename="batwing.txt"`, recorder.Header().Get("Content-Disposition"))
+	})
+	t.Run("Resumed", func(t *testing.T) {
+		test, store := setup(t)
+		defer store.Close()
+		url := tokenURL(t, test)
+
+		recorder := test.TestEndpointWithHeaders(http.MethodGet, url, nil, nil, map[string]string{"Range": "bytes=0-7"})
+		assert.Equal(t, http.StatusPartialContent, recorder.Code)
+		assert.Equal(t, "the plan", recorder.Body.String())
+
+		// the token can be used again to resume the download
+		recorder = test.TestEndpointWithHeaders(http.MethodGet, url, nil, nil, map[string]string{"Range": "bytes=8-"})
+		assert.Equal(t, http.StatusPartialContent, recorder.Code)
+		assert.Equal(t, "s of the batwing", recorder.Body.String())
+		assert.Equal(t, fmt.Sprintf("bytes 8-%d/%d", len(content)-1, len(content)), recorder.Header().Get("Content-Range"))
+	})
+	t.Run("StoreError", func(t *testing.T) {
+		test, store := setup(t)
+		defer store.Close()
+		test.Config.Downloads.ProxyAuthorization = ""
+		url := tokenURL(t, test)
+
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, nil)
+		validateError(t, http.StatusInternalServerError, recorder)
+	})
+	t.Run("OtherHost", func(t *testing.T) {
+		test, store := setup(t)
+		defer store.Close()
+		test.Config.Downloads.ProxyHosts = []string{"assets.wayneindustries.com"}
+		url := tokenURL(t, test)
+
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, nil)
+		validateError(t, http.StatusInternalServerError, recorder)
+	})
+	t.Run("Redirect", func(t *testing.T) {
+		authorized := false
+		other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authorized = r.Header.Get("Authorization") != ""
+			fmt.Fprint(w, content)
+		}))
+		defer other.Close()
+		test, store := setup(t)
+		defer store.Close()
+		require.NoError(t, test.DB.Model(&models.Download{}).Where("id = ?", "first-download").Update("url", store.URL+"/assets/moved.txt").Error)
+		store.Config.Handler = http.RedirectHandler(other.URL+"/batwing.txt", http.StatusFound)
+		url := tokenURL(t, test)
+
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, nil)
+		validateError(t, http.StatusInternalServerError, recorder)
+		assert.False(t, authorized)
+	})
+	t.Run("PrivateAddress", func(t *testing.T) {
+		downloadProxyAllowedIP = allowedIP
+		defer func() { downloadProxyAllowedIP = func(ip net.IP) bool { return true } }()
+		test, store := setup(t)
+		defer store.Close()
+		url := tokenURL(t, test)
+
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, nil)
+		validateError(t, http.StatusInternalServerError, recorder)
+		assert.False(t, downloadProxyAllowedIP(net.ParseIP("10.0.0.1")))
+		assert.False(t, downloadProxyAllowedIP(net.ParseIP("169.254.169.254")))
+		assert.False(t, downloadProxyAllowedIP(net.ParseIP("::1")))
+		assert.True(t, downloadProxyAllowedIP(net.ParseIP("93.184.216.34")))
+	})
+}
+
+func TestDownloadAccessList(t *testing.T) {
+	url := "/orders/first-order/downloads/first-download/accesses"
+
+	t.Run("Listed", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Downloads.CountryHeader = "CF-IPCountry"
+		recorder := test.TestEndpointWithHeaders(http.MethodGet, "/downloads/first-download", nil, test.Data.testUserToken, map[string]string{"CF-IPCountry": "de"})
+		require.Equal(t, http.StatusOK, recorder.Code)
+		download := &models.Download{}
+		require.NoError(t, test.DB.First(download, "id = ?", "first-download").Error)
+		require.NoError(t, models.LogDownload(test.DB, test.Data.firstOrder, download, "[2001:db8:1234:5678::1]:443", ""))
+
+		recorder = test.TestEndpoint(http.MethodGet, url, nil, test.Data.testUserToken)
+		accesses := []downloadAccess{}
+		extractPayload(t, http.StatusOK, recorder, &accesses)
+		require.Len(t, accesses, 2)
+		assert.Equal(t, "192.0.2.0/24", accesses[0].IP)
+		assert.Equal(t, "DE", accesses[0].Country)
+		assert.False(t, accesses[0].AccessedAt.IsZero())
+		assert.Equal(t, "2001:db8:1234::/48", accesses[1].IP)
+		assert.Empty(t, accesses[1].Country)
+	})
+	t.Run("OtherOrder", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/second-order/downloads/first-download/accesses", nil, test.Data.testUserToken)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+	t.Run("NoAccess", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, testToken("villian", "villian@wayneindustries.com"))
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
+func TestDownloadWatermark(t *testing.T) {
+	url := "/downloads/first-download"
+	setup := func(t *testing.T) *RouteTest {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(&models.Download{}).Where("id = ?", "first-download").Updates(map[string]interface{}{
+			"url":       "https://cdn.example.com/ebook.pdf",
+			"watermark": true,
+		}).Error)
+		return test
+	}
+
+	t.Run("Stamped", func(t *testing.T) {
+		test := setup(t)
+		requests := []*watermarkRequest{}
+		service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			req := &watermarkRequest{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(req))
+			requests = append(requests, req)
+			fmt.Fprint(w, `{"url": "https://cdn.example.com/stamped/ebook.pdf?signature=of-the-service"}`)
+		}))
+		defer service.Close()
+		test.Config.Downloads.WatermarkURL = service.URL
+
+		for i := 0; i < 2; i++ {
+			recorder := test.TestEndpoint(http.MethodGet, url, nil, test.Data.testUserToken)
+			validateError(t, http.StatusConflict, recorder, "still being watermarked")
+		}
+		var jobs int
+		require.NoError(t, test.DB.Model(&models.Job{}).Where("type = ? AND reference = ?", watermarkJob, test.Data.firstOrder.ID).Count(&jobs).Error)
+		assert.Equal(t, 1, jobs)
+		assert.Empty(t, requests)
+
+		test.RunJobs()
+		for i := 0; i < 2; i++ {
+			recorder := test.TestEndpoint(http.MethodGet, url, nil, test.Data.testUserToken)
+			download := &models.Download{}
+			extractPayload(t, http.StatusOK, recorder, download)
+			assert.Equal(t, "https://cdn.example.com/stamped/ebook.pdf", download.URL)
+		}
+
+		require.Len(t, requests, 1)
+		assert.Equal(t, test.Data.firstOrder.ID, requests[0].OrderID)
+		assert.Equal(t, test.Data.firstOrder.Email, requests[0].Email)
+		assert.Equal(t, "https://cdn.example.com/ebook.pdf", requests[0].URL)
+		assert.Contains(t, requests[0].Text, test.Data.firstOrder.Email)
+	})
+	t.Run("OtherStore", func(t *testing.T) {
+		test := setup(t)
+		service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"url": "https://cdn.example.com/stamped/ebook.pdf"}`)
+		}))
+		defer service.Close()
+		test.Config.Downloads.WatermarkURL = service.URL
+		test.Config.Downloads.Provider = "azure"
+		test.Config.Downloads.Azure.ConnectionString = "AccountName=wayneassets;AccountKey=" + base64.StdEncoding.EncodeToString([]byte("secret"))
+		require.NoError(t, test.DB.Model(&models.Download{}).Where("id = ?", "first-download").Update("url", "https://wayneassets.blob.core.windows.net/ebooks/ebook.pdf").Error)
+
+		validateError(t, http.StatusConflict, test.TestEndpoint(http.MethodGet, url, nil, test.Data.testUserToken))
+		test.RunJobs()
+
+		job := &models.Job{}
+		require.NoError(t, test.DB.First(job, "type = ?", watermarkJob).Error)
+		assert.False(t, job.Done)
+		assert.Equal(t, 1, job.Tries)
+		require.NotNil(t, job.ErrorMessage)
+		assert.Contains(t, *job.ErrorMessage, "Error signing the watermarked copy")
+		validateError(t, http.StatusConflict, test.TestEndpoint(http.MethodGet, url, nil, test.Data.testUserToken))
+	})
+	t.Run("NotConfigured", func(t *testing.T) {
+		test := setup(t)
+		validateError(t, http.StatusConflict, test.TestEndpoint(http.MethodGet, url, nil, test.Data.testUserToken))
+		test.RunJobs()
+
+		job := &models.Job{}
+		require.NoError(t, test.DB.First(job, "type = ?", watermarkJob).Error)
+		require.NotNil(t, job.ErrorMessage)
+		assert.Contains(t, *job.ErrorMessage, "No watermarking service configured")
+	})
+}
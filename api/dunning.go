@@ -0,0 +1,214 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+const paymentRetryInterval = time.Minute
+
+// paymentFailed handles a failed payment of the order. With a retry schedule
+// configured the order and its subscription are past due until the payment
+// has been retried, otherwise they have failed for good. It returns the retry
+// that has been scheduled, whose mail is sent once the transaction has been
+// committed.
+func paymentFailed(ctx context.Context, tx *gorm.DB, log logrus.FieldLogger, order *models.Order, reason string) *models.PaymentRetry {
+	retry, err := models.FindPendingPaymentRetry(tx, order.ID)
+	if err != nil {
+		log.WithError(err).Error("Error querying for payment retries")
+	}
+	if retry != nil {
+		setPaymentState(tx, order, models.PastDueState, models.SubscriptionPastDueState)
+		return nil
+	}
+
+	schedule := gcontext.GetConfig(ctx).PaymentRetrySchedule()
+	if len(schedule) == 0 {
+		setPaymentState(tx, order, models.FailedState, models.SubscriptionFailedState)
+		return nil
+	}
+
+	retry = models.NewPaymentRetry(order, reason, schedule)
+	if rsp := tx.Create(retry); rsp.Error != nil {
+		log.WithError(rsp.Error).Error("Failed to schedule payment retry")
+		setPaymentState(tx, order, models.FailedState, models.SubscriptionFailedState)
+		return nil
+	}
+	setPaymentState(tx, order, models.PastDueState, models.SubscriptionPastDueState)
+	paymentRetryHook(ctx, tx, log, order, retry)
+	return retry
+}
+
+// paymentRetried resolves the pending payment retries of an order that has
+// been paid. A past due subscription of a renewal order is active again.
+func paymentRetried(tx *gorm.DB, order *models.Order) {
+	tx.Model(&models.PaymentRetry{}).
+		Where("order_id = ? AND status = ?", order.ID, models.PaymentRetryPendingState).
+		Updates(map[string]interface{}{"status": models.PaymentRetrySucceededState, "next_attempt_at": nil})
+
+	if order.SubscriptionID == "" {
+		return
+	}
+	sub := &models.Subscription{}
+	if rsp := tx.First(sub, "id = ? AND status = ?", order.SubscriptionID, models.SubscriptionPastDueState); rsp.Error != nil {
+		return
+	}
+	sub.Status = models.SubscriptionActiveState
+	sub.Renewed(order.ID, time.Now())
+	tx.Save(sub)
+}
+
+func setPaymentState(tx *gorm.DB, order *models.Order, orderState, subscriptionState string) {
+	order.PaymentState = orderState
+	tx.Model(&models.Order{}).Where("id = ?", order.ID).Update("payment_state", orderState)
+	if order.SubscriptionID != "" {
+		tx.Model(&models.Subscription{}).
+			Where("id = ? AND status IN (?)", order.SubscriptionID, []string{models.SubscriptionActiveState, models.SubscriptionPastDueState}).
+			Update("status", subscriptionState)
+	}
+}
+
+// paymentRetryHook triggers the dunning webhook about a step of retrying the
+// payment.
+func paymentRetryHook(ctx context.Context, tx *gorm.DB, log logrus.FieldLogger, order *models.Order, retry *models.PaymentRetry) {
+	config := gcontext.GetConfig(ctx)
+	if config.Webhooks.Dunning == "" {
+		return
+	}
+	hook, err := models.NewHook("dunning", config.SiteURL, config.Webhooks.Dunning, order.UserID, config.Webhooks.Secret, retry)
+	if err != nil {
+		log.WithError(err).Error("Failed to process webhook")
+	} else {
+		tx.Save(hook)
+	}
+}
+
+// sendPaymentRetryMail mails the customer about a step of retrying the
+// payment. It's called once the step has been committed.
+func sendPaymentRetryMail(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, order *models.Order, retry *models.PaymentRetry) {
+	if !notificationAllowed(db, log, order.InstanceID, order.UserID, order.Email, models.OrderEmailsNotification) {
+		return
+	}
+	if err := gcontext.GetMailer(ctx).PaymentRetryMail(order, retry); err != nil {
+		log.WithError(err).Error("Error sending payment retry mail")
+	}
+}
+
+// RunPaymentRetrier creates a goroutine that retries the failed payments that
+// are due every minute.
+func (a *API) RunPaymentRetrier(ctx context.Context, db *gorm.DB, log logrus.FieldLogger) {
+	go func() {
+		for {
+			a.retryDuePayments(ctx, db, log)
+			time.Sleep(paymentRetryInterval)
+		}
+	}()
+}
+
+func (a *API) retryDuePayments(ctx context.Context, db *gorm.DB, log logrus.FieldLogger) {
+	due := []*models.PaymentRetry{}
+	rsp := db.Where("status = ? AND next_attempt_at <= ?", models.PaymentRetryPendingState, time.Now()).Find(&due)
+	if rsp.Error != nil {
+		log.WithError(rsp.Error).Error("Error querying for due payment retries")
+		return
+	}
+
+	instances := map[string]context.Context{}
+	for _, retry := range due {
+		log := log.WithField("payment_retry_id", retry.ID).WithField("order_id", retry.OrderID)
+
+		instanceCtx, ok := instances[retry.InstanceID]
+		if !ok {
+			var err error
+			if instanceCtx, err = a.instanceContext(ctx, db, retry.InstanceID); err != nil {
+				log.WithError(err).Error("Error loading instance configuration")
+				continue
+			}
+			instances[retry.InstanceID] = instanceCtx
+		}
+
+		claimed, err := retryPayment(instanceCtx, db, log, retry)
+		if err != nil {
+			log.WithError(err).Error("Failed to retry payment")
+			continue
+		}
+		if !claimed {
+			log.Debug("Payment has been retried already")
+			continue
+		}
+		log.WithField("status", retry.Status).Infof("Retried payment, attempt %d", retry.Attempts)
+	}
+}
+
+// retryPayment makes the next attempt of a payment retry. Renewal orders are
+// charged to the saved payment method of their subscription again, the
+// customers of other orders are reminded to pay. Once no attempts are left the
+// order and its subscription have failed. The attempt is claimed first, and it
+// reports whether it has been claimed rather than made by a concurrent retrier.
+func retryPayment(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, retry *models.PaymentRetry) (bool, error) {
+	order := &models.Order{}
+	if rsp := db.Preload("LineItems").First(order, "id = ?", retry.OrderID); rsp.Error != nil {
+		return false, rsp.Error
+	}
+
+	if order.PaymentState == models.PaidState {
+		retry.Status = models.PaymentRetrySucceededState
+		retry.NextAttemptAt = nil
+		return true, db.Save(retry).Error
+	}
+
+	claimed, err := models.ClaimPaymentRetry(db, retry)
+	if err != nil || !claimed {
+		return false, err
+	}
+
+	var tr *models.Transaction
+	var chargeErr error
+	if order.SubscriptionID != "" {
+		sub := &models.Subscription{}
+		if rsp := db.First(sub, "id = ?", order.SubscriptionID); rsp.Error != nil {
+			return true, rsp.Error
+		}
+		tr, chargeErr = chargeRenewal(ctx, db, log, sub, order)
+	}
+
+	tx := db.Begin()
+	complete := false
+	if tr != nil {
+		var err error
+		if complete, err = settleRenewal(ctx, tx, log, order, tr, chargeErr); err != nil {
+			tx.Rollback()
+			return true, err
+		}
+		if renewalFailed(chargeErr) {
+			retry.LastError = chargeErr.Error()
+		} else {
+			retry.Status = models.PaymentRetrySucceededState
+			retry.NextAttemptAt = nil
+		}
+	}
+
+	if retry.Status == models.PaymentRetryPendingState && !retry.Schedule(gcontext.GetConfig(ctx).PaymentRetrySchedule()) {
+		retry.Status = models.PaymentRetryFailedState
+		setPaymentState(tx, order, models.FailedState, models.SubscriptionFailedState)
+	}
+	tx.Save(retry)
+	paymentRetryHook(ctx, tx, log, order, retry)
+	models.LogEvent(tx, "", order.UserID, order.ID, models.EventUpdated, []string{"payment_state"})
+	if err := tx.Commit().Error; err != nil {
+		return true, err
+	}
+
+	notified := *retry
+	go sendPaymentRetryMail(ctx, db, log, order, &notified)
+	if complete {
+		go sendOrderConfirmation(ctx, db, log, tr)
+	}
+	return true, nil
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestRenewalRetries(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	run := func(t *testing.T, test *RouteTest, job func(*API, context.Context)) {
+		test.Config.SiteURL = server.URL
+		ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+		require.NoError(t, err)
+		job(NewAPIWithVersion(ctx, test.GlobalConfig, logrus.StandardLogger(), test.DB, ""), ctx)
+	}
+	renew := func(t *testing.T, test *RouteTest) {
+		run(t, test, func(api *API, ctx context.Context) { api.renewDueSubscriptions(ctx, test.DB, logrus.StandardLogger()) })
+	}
+	retry := func(t *testing.T, test *RouteTest, retry *models.PaymentRetry) *models.PaymentRetry {
+		// pretend the next attempt is due
+		require.NoError(t, test.DB.Model(retry).Update("next_attempt_at", time.Now().Add(-time.Minute)).Error)
+		run(t, test, func(api *API, ctx context.Context) { api.retryDuePayments(ctx, test.DB, logrus.StandardLogger()) })
+		stored := &models.PaymentRetry{}
+		require.NoError(t, test.DB.First(stored, "id = ?", retry.ID).Error)
+		return stored
+	}
+	mockCharges := func(t *testing.T, succeed func(int) bool) {
+		charges := 0
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+			charges++
+			if !succeed(charges) {
+				return &stripe.Error{Code: stripe.ErrorCodeCardDeclined, Msg: "Your card was declined"}
+			}
+			intent := v.(*stripe.PaymentIntent)
+			intent.ID = stripePaymentIntentID
+			intent.Status = stripe.PaymentIntentStatusSucceeded
+			return nil
+		}))
+	}
+	setup := func(t *testing.T, schedule ...uint64) (*RouteTest, *models.Subscription, *models.PaymentRetry) {
+		test := NewRouteTest(t)
+		test.Config.Payment.Dunning.RetrySchedule = schedule
+		createTestPaymentMethod(t, test)
+		sub := createTestSubscription(t, test, time.Now().Add(-time.Minute))
+
+		renew(t, test)
+		stored, err := models.GetSubscription(test.DB, sub.UserID, sub.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.SubscriptionPastDueState, stored.Status)
+
+		retry, err := models.FindPendingPaymentRetry(test.DB, stored.LastOrderID)
+		require.NoError(t, err)
+		require.NotNil(t, retry)
+		assert.Equal(t, sub.ID, retry.SubscriptionID)
+		return test, stored, retry
+	}
+	paymentState := func(t *testing.T, test *RouteTest, orderID string) string {
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", orderID).Error)
+		return order.PaymentState
+	}
+
+	t.Run("Recovered", func(t *testing.T) {
+		mockCharges(t, func(charge int) bool { return charge > 2 })
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+		test, sub, pending := setup(t, 1, 3, 7)
+		assert.Equal(t, models.PastDueState, paymentState(t, test, sub.LastOrderID))
+
+		pending = retry(t, test, pending)
+		assert.Equal(t, models.PaymentRetryPendingState, pending.Status)
+		assert.EqualValues(t, 1, pending.Attempts)
+		assert.WithinDuration(t, pending.FailedAt.Add(3*24*time.Hour), *pending.NextAttemptAt, time.Second)
+
+		recovered := retry(t, test, pending)
+		assert.Equal(t, models.PaymentRetrySucceededState, recovered.Status)
+		assert.Nil(t, recovered.NextAttemptAt)
+		assert.Equal(t, models.PaidState, paymentState(t, test, sub.LastOrderID))
+
+		active, err := models.GetSubscription(test.DB, sub.UserID, sub.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.SubscriptionActiveState, active.Status)
+		assert.True(t, active.NextRenewalAt.After(time.Now()))
+
+		var charges int
+		require.NoError(t, test.DB.Model(&models.Transaction{}).Where("order_id = ?", sub.LastOrderID).Count(&charges).Error)
+		assert.Equal(t, 3, charges)
+	})
+	t.Run("Exhausted", func(t *testing.T) {
+		mockCharges(t, func(int) bool { return false })
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+		test, sub, pending := setup(t, 1)
+
+		failed := retry(t, test, pending)
+		assert.Equal(t, models.PaymentRetryFailedState, failed.Status)
+		assert.Contains(t, failed.LastError, "declined")
+		assert.Equal(t, models.FailedState, paymentState(t, test, sub.LastOrderID))
+
+		stored, err := models.GetSubscription(test.DB, sub.UserID, sub.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.SubscriptionFailedState, stored.Status)
+	})
+	t.Run("PaidInBetween", func(t *testing.T) {
+		mockCharges(t, func(int) bool { return false })
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+		test, sub, pending := setup(t, 1)
+
+		require.NoError(t, test.DB.Model(&models.Order{}).Where("id = ?", sub.LastOrderID).Update("payment_state", models.PaidState).Error)
+		resolved := retry(t, test, pending)
+		assert.Equal(t, models.PaymentRetrySucceededState, resolved.Status)
+		assert.EqualValues(t, 0, resolved.Attempts)
+	})
+	t.Run("Claimed", func(t *testing.T) {
+		mockCharges(t, func(int) bool { return false })
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+		test, _, pending := setup(t, 1, 3)
+		stale := *pending
+
+		claimed, err := models.ClaimPaymentRetry(test.DB, pending)
+		require.NoError(t, err)
+		assert.True(t, claimed)
+		assert.EqualValues(t, 1, pending.Attempts)
+		claimed, err = models.ClaimPaymentRetry(test.DB, &stale)
+		require.NoError(t, err)
+		assert.False(t, claimed, "expected the attempt to be claimed only once")
+	})
+	t.Run("Canceled", func(t *testing.T) {
+		mockCharges(t, func(int) bool { return false })
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+		test, sub, pending := setup(t, 1)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/users/i-am-batman/subscriptions/"+sub.ID+"/cancel", nil, test.Data.testUserToken)
+		extractPayload(t, http.StatusOK, recorder, &models.Subscription{})
+
+		stored := &models.PaymentRetry{}
+		require.NoError(t, test.DB.First(stored, "id = ?", pending.ID).Error)
+		assert.Equal(t, models.PaymentRetryCanceledState, stored.Status)
+	})
+}
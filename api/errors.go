@@ -33,6 +33,7 @@ type HTTPError struct {
 	InternalError   error  `json:"-"`
 	InternalMessage string `json:"-"`
 	ErrorID         string `json:"error_id,omitempty"`
+	Reason          string `json:"reason,omitempty"`
 }
 
 func (e *HTTPError) Error() string {
@@ -62,6 +63,12 @@ func (e *HTTPError) WithInternalMessage(fmtString string, args ...interface{}) *
 	return e
 }
 
+// WithReason adds a machine readable reason to the error
+func (e *HTTPError) WithReason(reason string) *HTTPError {
+	e.Reason = reason
+	return e
+}
+
 func httpError(code int, fmtString string, args ...interface{}) *HTTPError {
 	return &HTTPError{
 		Code:    code,
@@ -0,0 +1,203 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+
+	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// UserExportCreate exports the personal data of a user as a JSON archive of
+// their addresses, orders, transactions, downloads and events. Accounts with
+// more orders than the sync limit of the configuration, or all of them with
+// async=true in the query parameters, are exported in the background: the
+// response is the pending export, whose download link is set once it's
+// ready.
+func (a *API) UserExportCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	db := a.DB(r)
+	log := getLogEntry(r)
+	config := gcontext.GetConfig(ctx)
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		return notFoundError("Couldn't find a record for " + gcontext.GetUserID(ctx))
+	}
+
+	async := false
+	if value := r.URL.Query().Get("async"); value != "" {
+		var err error
+		if async, err = strconv.ParseBool(value); err != nil {
+			return badRequestError("async must be a boolean")
+		}
+	}
+	var orders int
+	if rsp := db.Model(&models.Order{}).Where("user_id = ?", user.ID).Count(&orders); rsp.Error != nil {
+		return internalServerError("Error while querying for orders").WithInternalError(rsp.Error)
+	}
+
+	if !async && orders <= config.ExportSyncOrderLimit() {
+		data, err := models.CollectUserData(db, user)
+		if err != nil {
+			return internalServerError("Error exporting user data").WithInternalError(err)
+		}
+		log.Info("Exported user data")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="export-%s.json"`, user.ID))
+		return sendJSON(w, http.StatusOK, data)
+	}
+
+	pending := &models.UserExport{}
+	rsp := db.Where("user_id = ? AND state = ? AND created_at > ?", user.ID, models.UserExportPendingState, time.Now().Add(-exportPendingTimeout)).Last(pending)
+	if rsp.Error == nil {
+		return sendJSON(w, http.StatusAccepted, pending)
+	}
+	if !rsp.RecordNotFound() {
+		return internalServerError("Error while querying for exports").WithInternalError(rsp.Error)
+	}
+
+	select {
+	case exportBuilds <- struct{}{}:
+	default:
+		return httpError(http.StatusTooManyRequests, "Too many exports are being built, please try again later")
+	}
+	export := models.NewUserExport(user)
+	if rsp := db.Create(export); rsp.Error != nil {
+		<-exportBuilds
+		return internalServerError("Error creating export").WithInternalError(rsp.Error)
+	}
+	log.WithField("export_id", export.ID).Info("Started exporting user data")
+	go func() {
+		defer func() { <-exportBuilds }()
+		buildUserExport(db, config, log, user, export)
+	}()
+
+	return sendJSON(w, http.StatusAccepted, export)
+}
+
+// exportPendingTimeout is how long a pending export of a user is returned
+// again instead of starting another one. Exports pending for longer were
+// interrupted, e.g. by a restart.
+const exportPendingTimeout = 30 * time.Minute
+
+// maxConcurrentExports is how many background exports are built at once.
+const maxConcurrentExports = 4
+
+// exportBuilds holds a slot for each background export being built.
+var exportBuilds = make(chan struct{}, maxConcurrentExports)
+
+// UserExportView returns a background export of the personal data of a user,
+// with the signed link to download it once it's ready.
+func (a *API) UserExportView(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	export := &models.UserExport{}
+	rsp := a.DB(r).First(export, "instance_id = ? AND user_id = ? AND id = ?", gcontext.GetInstanceID(ctx), gcontext.GetUserID(ctx), chi.URLParam(r, "export_id"))
+	if rsp.RecordNotFound() {
+		return notFoundError("Export not found")
+	}
+	if rsp.Error != nil {
+		return internalServerError("Error while querying for export").WithInternalError(rsp.Error)
+	}
+
+	if export.State == models.UserExportReadyState && export.ExpiresAt != nil {
+		export.DownloadURL = a.exportDownloadURL(r, gcontext.GetConfig(ctx), export)
+	}
+	return sendJSON(w, http.StatusOK, export)
+}
+
+// UserExportDownload sends the archive of a background export to the holder
+// of its signed download link, until the link expires.
+func (a *API) UserExportDownload(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := gcontext.GetConfig(ctx)
+	query := r.URL.Query()
+
+	export := &models.UserExport{}
+	rsp := a.DB(r).First(export, "instance_id = ? AND id = ? AND state = ?", gcontext.GetInstanceID(ctx), chi.URLParam(r, "export_id"), models.UserExportReadyState)
+	if rsp.RecordNotFound() {
+		return notFoundError("Export not found")
+	}
+	if rsp.Error != nil {
+		return internalServerError("Error while querying for export").WithInternalError(rsp.Error)
+	}
+
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return unauthorizedError("This export link is invalid or expired")
+	}
+	signature, err := hex.DecodeString(query.Get("signature"))
+	if err != nil || !hmac.Equal(signature, exportSignature(config, export, expires)) {
+		return unauthorizedError("This export link is invalid or expired")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="export-%s.json"`, export.UserID))
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write([]byte(export.Archive))
+	return err
+}
+
+// buildUserExport collects the personal data of the user of a background
+// export and stores it as its archive, valid for the link TTL of the
+// configuration.
+func buildUserExport(db *gorm.DB, config *conf.Configuration, log logrus.FieldLogger, user *models.User, export *models.UserExport) {
+	log = log.WithField("export_id", export.ID)
+	changes := map[string]interface{}{"state": models.UserExportFailedState}
+
+	data, err := models.CollectUserData(db, user)
+	if err == nil {
+		var archive []byte
+		if archive, err = json.Marshal(data); err == nil {
+			now := time.Now()
+			changes = map[string]interface{}{
+				"state":        models.UserExportReadyState,
+				"archive":      string(archive),
+				"completed_at": now,
+				"expires_at":   now.Add(config.ExportLinkTTL()),
+			}
+		}
+	}
+	if err != nil {
+		log.WithError(err).Error("Failed to export user data")
+	}
+
+	if rsp := db.Model(export).Updates(changes); rsp.Error != nil {
+		log.WithError(rsp.Error).Error("Failed to save user data export")
+		return
+	}
+	log.Info("Exported user data")
+}
+
+// exportDownloadURL returns the absolute link to download the archive of a
+// ready export, signed until the export expires.
+func (a *API) exportDownloadURL(r *http.Request, config *conf.Configuration, export *models.UserExport) string {
+	expires := export.ExpiresAt.Unix()
+	signature := hex.EncodeToString(exportSignature(config, export, expires))
+	return a.apiURL(r, fmt.Sprintf("/exports/%s?expires=%d&signature=%s", export.ID, expires, signature))
+}
+
+// exportSignature signs the download link of an export valid until expires
+// with the JWT secret of the instance.
+func exportSignature(config *conf.Configuration, export *models.UserExport, expires int64) []byte {
+	mac := hmac.New(sha256.New, []byte(config.JWT.Secret))
+	fmt.Fprintf(mac, "%s/%s/%d", export.InstanceID, export.ID, expires)
+	return mac.Sum(nil)
+}
+
+// deleteExpiredExports removes the archives of background exports whose
+// download links expired.
+func deleteExpiredExports(db *gorm.DB, log logrus.FieldLogger) {
+	if err := models.DeleteExpiredUserExports(db, time.Now()); err != nil {
+		log.WithError(err).Error("Error deleting expired user data exports")
+	}
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestUserExport(t *testing.T) {
+	t.Run("Sync", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID+"/export", nil, test.Data.testUserToken)
+		assert.Contains(t, recorder.Header().Get("Content-Disposition"), "export-i-am-batman.json")
+
+		data := &models.UserData{}
+		extractPayload(t, http.StatusOK, recorder, data)
+		assert.Equal(t, test.Data.testUser.ID, data.User.ID)
+		assert.Len(t, data.Orders, 2)
+		assert.Len(t, data.Addresses, 1)
+		assert.Len(t, data.Transactions, 2)
+		for _, order := range data.Orders {
+			assert.NotEmpty(t, order.LineItems)
+		}
+	})
+	t.Run("Async", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Export.SyncOrderLimit = 1
+		recorder := test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID+"/export", nil, test.Data.testUserToken)
+		export := &models.UserExport{}
+		extractPayload(t, http.StatusAccepted, recorder, export)
+		assert.Equal(t, models.UserExportPendingState, export.State)
+
+		for i := 0; i < 100 && export.State == models.UserExportPendingState; i++ {
+			time.Sleep(10 * time.Millisecond)
+			recorder = test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID+"/exports/"+export.ID, nil, test.Data.testUserToken)
+			extractPayload(t, http.StatusOK, recorder, export)
+		}
+		require.Equal(t, models.UserExportReadyState, export.State)
+		require.True(t, strings.HasPrefix(export.DownloadURL, baseURL+"/exports/"+export.ID+"?"))
+		link := strings.TrimPrefix(export.DownloadURL, baseURL)
+
+		// the signed link works without a token
+		recorder = test.TestEndpoint(http.MethodGet, link, nil, nil)
+		data := &models.UserData{}
+		extractPayload(t, http.StatusOK, recorder, data)
+		assert.Len(t, data.Orders, 2)
+
+		tampered := strings.Replace(link, "expires=", "expires=1", 1)
+		recorder = test.TestEndpoint(http.MethodGet, tampered, nil, nil)
+		validateError(t, http.StatusUnauthorized, recorder, "This export link is invalid or expired")
+	})
+	t.Run("Pending", func(t *testing.T) {
+		test := NewRouteTest(t)
+		export := models.NewUserExport(test.Data.testUser)
+		require.NoError(t, test.DB.Create(export).Error)
+
+		// a pending export is returned instead of starting another one
+		recorder := test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID+"/export?async=true", nil, test.Data.testUserToken)
+		pending := &models.UserExport{}
+		extractPayload(t, http.StatusAccepted, recorder, pending)
+		assert.Equal(t, export.ID, pending.ID)
+		var count int
+		require.NoError(t, test.DB.Model(&models.UserExport{}).Count(&count).Error)
+		assert.Equal(t, 1, count)
+	})
+	t.Run("TooMany", func(t *testing.T) {
+		test := NewRouteTest(t)
+		for i := 0; i < maxConcurrentExports; i++ {
+			exportBuilds <- struct{}{}
+		}
+		defer func() {
+			for i := 0; i < maxConcurrentExports; i++ {
+				<-exportBuilds
+			}
+		}()
+		recorder := test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID+"/export?async=true", nil, test.Data.testUserToken)
+		validateError(t, http.StatusTooManyRequests, recorder, "Too many exports")
+	})
+	t.Run("OtherUser", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID+"/export", nil, testToken("magical-unicorn", ""))
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -18,3 +19,25 @@ func sendJSON(w http.ResponseWriter, status int, obj interface{}) error {
 	_, err = w.Write(b)
 	return err
 }
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// apiURL returns the absolute URL of the path on the API, on the configured
+// API endpoint or else on the host the request has been sent to.
+func (a *API) apiURL(r *http.Request, path string) string {
+	if a.config.API.Endpoint != "" {
+		return strings.TrimSuffix(a.config.API.Endpoint, "/") + path
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + path
+}
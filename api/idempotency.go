@@ -0,0 +1,167 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+)
+
+// idempotencyRecorder captures the response of a request so it can be stored
+// with its idempotency key.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotentAttempt tracks whether a request sent with an Idempotency-Key
+// reached the payment provider.
+type idempotentAttempt struct {
+	charged bool
+}
+
+type idempotentAttemptKey struct{}
+
+// markCharged records that the request is about to call the payment provider,
+// so its response is stored even if it fails on our side afterwards, as
+// retrying it could charge the customer again.
+func markCharged(ctx context.Context) {
+	if attempt, ok := ctx.Value(idempotentAttemptKey{}).(*idempotentAttempt); ok {
+		attempt.charged = true
+	}
+}
+
+// idempotencyRequestHash fingerprints a request so a key can't be reused for a different request.
+func idempotencyRequestHash(method, path string, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(method + " " + path + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// withIdempotency stores the response of requests sent with an Idempotency-Key
+// header and replays it when the request is retried with the same key.
+func (a *API) withIdempotency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err := a.serveIdempotent(next, key, w, r); err != nil {
+			handleError(err, w, r)
+		}
+	})
+}
+
+func (a *API) serveIdempotent(next http.Handler, key string, w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	db := a.DB(r)
+
+	if len(key) > maxIdempotencyKeyLength {
+		return badRequestError("%s must not be longer than %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength)
+	}
+
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			return internalServerError("Error reading body").WithInternalError(err)
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	requestHash := idempotencyRequestHash(r.Method, r.URL.Path, body)
+
+	var userID string
+	if claims := gcontext.GetClaims(ctx); claims != nil {
+		userID = claims.Subject
+	}
+	instanceID := gcontext.GetInstanceID(ctx)
+
+	stored, err := models.GetIdempotencyKey(db, instanceID, key)
+	if err != nil {
+		return internalServerError("Error while querying for idempotency key").WithInternalError(err)
+	}
+	if stored != nil && stored.Expired() {
+		db.Delete(stored)
+		stored = nil
+	}
+	if stored != nil {
+		if stored.RequestHash != requestHash || stored.UserID != userID {
+			return httpError(http.StatusUnprocessableEntity, "%s has already been used for a different request", idempotencyKeyHeader)
+		}
+		if !stored.Completed() {
+			return httpError(http.StatusConflict, "A request with this %s is still in progress", idempotencyKeyHeader)
+		}
+
+		log.WithField("idempotency_key", key).Info("Replaying stored response")
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(idempotencyReplayedHeader, "true")
+		w.WriteHeader(stored.StatusCode)
+		_, err := w.Write([]byte(stored.Response))
+		return err
+	}
+
+	record := models.NewIdempotencyKey(instanceID, key, userID, requestHash)
+	if rsp := db.Create(record); rsp.Error != nil {
+		// most likely a concurrent request with the same key
+		return httpError(http.StatusConflict, "A request with this %s is still in progress", idempotencyKeyHeader).WithInternalError(rsp.Error)
+	}
+
+	attempt := &idempotentAttempt{}
+	rec := &idempotencyRecorder{ResponseWriter: w}
+	defer func() {
+		if rvr := recover(); rvr != nil {
+			// don't leave the key in progress until it expires
+			if attempt.charged {
+				record.StatusCode = http.StatusInternalServerError
+				record.Response = `{"code":500,"msg":"Internal Server Error"}`
+				db.Save(record)
+			} else {
+				db.Delete(record)
+			}
+			panic(rvr)
+		}
+	}()
+	next.ServeHTTP(rec, r.WithContext(context.WithValue(ctx, idempotentAttemptKey{}, attempt)))
+
+	if rec.status == 0 || (rec.status >= http.StatusInternalServerError && !attempt.charged) {
+		// allow clients to retry requests that failed on our side before
+		// anything was charged
+		db.Delete(record)
+		return nil
+	}
+	record.StatusCode = rec.status
+	record.Response = rec.body.String()
+	if rsp := db.Save(record); rsp.Error != nil {
+		log.WithError(rsp.Error).Error("Failed to store idempotent response")
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+)
+
+func TestOrderCreateIdempotency(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+
+	headers := map[string]string{idempotencyKeyHeader: "order-key-1"}
+
+	t.Run("Replay", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		token := test.Data.testUserToken
+
+		recorder := test.TestEndpointWithHeaders(http.MethodPost, "/orders", strings.NewReader(defaultPayload), token, headers)
+		first := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, first)
+		assert.Empty(t, recorder.Header().Get(idempotencyReplayedHeader))
+
+		recorder = test.TestEndpointWithHeaders(http.MethodPost, "/orders", strings.NewReader(defaultPayload), token, headers)
+		second := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, second)
+		assert.Equal(t, "true", recorder.Header().Get(idempotencyReplayedHeader))
+		assert.Equal(t, first.ID, second.ID)
+
+		var count int
+		require.NoError(t, test.DB.Model(&models.Order{}).Where("email = ?", "info@example.com").Count(&count).Error)
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("DifferentRequest", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		token := test.Data.testUserToken
+
+		recorder := test.TestEndpointWithHeaders(http.MethodPost, "/orders", strings.NewReader(defaultPayload), token, headers)
+		extractPayload(t, http.StatusCreated, recorder, &models.Order{})
+
+		payload := strings.Replace(defaultPayload, "info@example.com", "other@example.com", 1)
+		recorder = test.TestEndpointWithHeaders(http.MethodPost, "/orders", strings.NewReader(payload), token, headers)
+		validateError(t, http.StatusUnprocessableEntity, recorder, "already been used")
+	})
+
+	t.Run("InProgress", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		hash := idempotencyRequestHash(http.MethodPost, "/orders", []byte(defaultPayload))
+		require.NoError(t, test.DB.Create(models.NewIdempotencyKey("", "order-key-1", test.Data.testUser.ID, hash)).Error)
+
+		recorder := test.TestEndpointWithHeaders(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken, headers)
+		validateError(t, http.StatusConflict, recorder, "still in progress")
+	})
+}
+
+func TestPaymentCreateIdempotency(t *testing.T) {
+	test := NewRouteTest(t)
+	test.Config.Payment.Manual.Enabled = true
+	test.Data.firstOrder.PaymentState = models.PendingState
+	require.NoError(t, test.DB.Save(test.Data.firstOrder).Error, "Failed to update order")
+
+	body, err := json.Marshal(map[string]interface{}{
+		"amount":   test.Data.firstOrder.Total,
+		"currency": test.Data.firstOrder.Currency,
+		"provider": "manual",
+	})
+	require.NoError(t, err)
+	headers := map[string]string{idempotencyKeyHeader: "payment-key-1"}
+
+	recorder := test.TestEndpointWithHeaders(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken, headers)
+	first := models.Transaction{}
+	extractPayload(t, http.StatusOK, recorder, &first)
+
+	recorder = test.TestEndpointWithHeaders(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken, headers)
+	second := models.Transaction{}
+	extractPayload(t, http.StatusOK, recorder, &second)
+	assert.Equal(t, first.ID, second.ID)
+
+	var count int
+	require.NoError(t, test.DB.Model(&models.Transaction{}).Where("order_id = ? AND type = ?", test.Data.firstOrder.ID, models.ChargeTransactionType).Count(&count).Error)
+	assert.Equal(t, 2, count, "expected the fixture transaction and a single new one")
+}
+
+func TestPaymentCreateIdempotencyAfterCharge(t *testing.T) {
+	test := NewRouteTest(t)
+	test.Data.firstOrder.PaymentState = models.PendingState
+	require.NoError(t, test.DB.Save(test.Data.firstOrder).Error, "Failed to update order")
+
+	chargeCalls := 0
+	stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+		if path == "/v1/payment_intents" {
+			chargeCalls++
+			return &stripe.Error{Code: stripe.ErrorCodeURLInvalid, HTTPStatusCode: http.StatusInternalServerError}
+		}
+		t.Fatalf("unknown Stripe API call to %s", path)
+		return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+	}))
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	body, err := json.Marshal(map[string]interface{}{
+		"amount":                   test.Data.firstOrder.Total,
+		"currency":                 test.Data.firstOrder.Currency,
+		"provider":                 payments.StripeProvider,
+		"stripe_payment_method_id": "payment-method-simple",
+	})
+	require.NoError(t, err)
+	headers := map[string]string{idempotencyKeyHeader: "payment-key-2"}
+
+	recorder := test.TestEndpointWithHeaders(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken, headers)
+	validateError(t, http.StatusInternalServerError, recorder)
+
+	// the provider was reached, so the failure is replayed instead of charging again
+	recorder = test.TestEndpointWithHeaders(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken, headers)
+	validateError(t, http.StatusInternalServerError, recorder)
+	assert.Equal(t, "true", recorder.Header().Get(idempotencyReplayedHeader))
+	assert.Equal(t, 1, chargeCalls)
+}
+
+func TestIdempotencyPanic(t *testing.T) {
+	test := NewRouteTest(t)
+	ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+	require.NoError(t, err)
+	ctx = gcontext.WithDB(ctx, test.DB)
+	api := NewAPIWithVersion(ctx, test.GlobalConfig, logrus.StandardLogger(), test.DB, "")
+
+	serve := func(charged bool) {
+		handler := api.withIdempotency(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if charged {
+				markCharged(r.Context())
+			}
+			panic("handler failed")
+		}))
+		req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(`{}`)).WithContext(ctx)
+		req.Header.Set(idempotencyKeyHeader, "panic-key")
+		assert.Panics(t, func() { handler.ServeHTTP(httptest.NewRecorder(), req) })
+	}
+
+	// a request that failed before charging can be retried
+	serve(false)
+	stored, err := models.GetIdempotencyKey(test.DB, "", "panic-key")
+	require.NoError(t, err)
+	assert.Nil(t, stored)
+
+	serve(true)
+	stored, err = models.GetIdempotencyKey(test.DB, "", "panic-key")
+	require.NoError(t, err)
+	require.NotNil(t, stored)
+	assert.Equal(t, http.StatusInternalServerError, stored.StatusCode)
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestInvoiceNumbering(t *testing.T) {
+	pay := func(t *testing.T, test *RouteTest, orderID string, rollback bool) *models.Order {
+		ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+		require.NoError(t, err)
+
+		tx := test.DB.Begin()
+		order := &models.Order{}
+		require.NoError(t, orderQuery(tx).First(order, "id = ?", orderID).Error)
+		order.PaymentState = models.PendingState
+		tr := models.NewTransaction(order)
+		tr.Amount = order.Total
+		complete, err := completePayment(ctx, tx, logrus.StandardLogger(), tr, order)
+		require.NoError(t, err)
+		assert.True(t, complete)
+		if rollback {
+			require.NoError(t, tx.Rollback().Error)
+		} else {
+			require.NoError(t, tx.Commit().Error)
+		}
+		return order
+	}
+	invoiceOf := func(t *testing.T, test *RouteTest, orderID string) *models.Invoice {
+		order := &models.Order{}
+		require.NoError(t, orderQuery(test.DB).First(order, "id = ?", orderID).Error)
+		require.NotNil(t, order.Invoice)
+		return order.Invoice
+	}
+
+	t.Run("Sequential", func(t *testing.T) {
+		test := NewRouteTest(t)
+		pay(t, test, test.Data.firstOrder.ID, false)
+		pay(t, test, test.Data.secondOrder.ID, false)
+
+		assert.Equal(t, int64(1), invoiceOf(t, test, test.Data.firstOrder.ID).Number)
+		assert.Equal(t, int64(2), invoiceOf(t, test, test.Data.secondOrder.ID).Number)
+	})
+	t.Run("KeepsIssuedInvoice", func(t *testing.T) {
+		test := NewRouteTest(t)
+		pay(t, test, test.Data.firstOrder.ID, false)
+		order := pay(t, test, test.Data.firstOrder.ID, false)
+
+		require.NotNil(t, order.Invoice)
+		assert.Equal(t, int64(1), order.Invoice.Number)
+		var invoices int
+		require.NoError(t, test.DB.Model(&models.Invoice{}).Count(&invoices).Error)
+		assert.Equal(t, 1, invoices)
+	})
+	t.Run("NoGapOnRollback", func(t *testing.T) {
+		test := NewRouteTest(t)
+		order := pay(t, test, test.Data.firstOrder.ID, true)
+		require.NotNil(t, order.Invoice)
+		assert.Equal(t, int64(1), order.Invoice.Number)
+
+		pay(t, test, test.Data.secondOrder.ID, false)
+		assert.Equal(t, int64(1), invoiceOf(t, test, test.Data.secondOrder.ID).Number)
+	})
+	t.Run("PerCountry", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Invoices.PerCountry = true
+		address := getTestAddress()
+		require.NoError(t, test.DB.Create(address).Error)
+		require.NoError(t, test.DB.Model(&models.Order{}).Where("id = ?", test.Data.secondOrder.ID).Update("billing_address_id", address.ID).Error)
+
+		pay(t, test, test.Data.firstOrder.ID, false)
+		pay(t, test, test.Data.secondOrder.ID, false)
+
+		first := invoiceOf(t, test, test.Data.firstOrder.ID)
+		second := invoiceOf(t, test, test.Data.secondOrder.ID)
+		assert.Equal(t, "dcland", first.Series)
+		assert.Equal(t, int64(1), first.Number)
+		assert.Equal(t, "marvel-land", second.Series)
+		assert.Equal(t, int64(1), second.Number)
+	})
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+const jobInterval = 5 * time.Second
+
+// jobHandler does the work of a job within the context of its instance.
+type jobHandler func(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, job *models.Job) error
+
+// jobHandlers are the handlers of the types of jobs.
+var jobHandlers = map[string]jobHandler{
+	watermarkJob:        runWatermarkJob,
+	licenseJob:          runLicenseJob,
+	refreshDownloadsJob: runRefreshDownloadsJob,
+	taxOrderJob:         runTaxOrderJob,
+	taxRefundJob:        runTaxRefundJob,
+	lowStockJob:         runLowStockJob,
+	backInStockJob:      runBackInStockJob,
+}
+
+// RunJobs creates a goroutine that runs the queued jobs every 5 seconds.
+func (a *API) RunJobs(ctx context.Context, db *gorm.DB, log logrus.FieldLogger) {
+	workerID := uuid.NewRandom().String()
+	go func() {
+		for {
+			a.runJobs(ctx, db, log, workerID)
+			time.Sleep(jobInterval)
+		}
+	}()
+}
+
+func (a *API) runJobs(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, workerID string) {
+	jobs, err := models.ClaimJobs(db, workerID)
+	if err != nil {
+		log.WithError(err).Error("Error querying for jobs")
+		return
+	}
+
+	for _, job := range jobs {
+		log := log.WithFields(logrus.Fields{"job_id": job.ID, "job_type": job.Type, "instance_id": job.InstanceID})
+		err := a.runJob(ctx, db, log, job)
+		failed, saveErr := job.Complete(db, err)
+		if saveErr != nil {
+			log.WithError(saveErr).Error("Error saving job")
+			continue
+		}
+		switch {
+		case err == nil:
+			log.Info("Completed job")
+		case failed:
+			log.WithError(err).Errorf("Job failed %d times, giving up", job.Tries)
+		default:
+			log.WithError(err).Warnf("Job failed, retrying at %v", job.RunAfter)
+		}
+	}
+}
+
+func (a *API) runJob(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, job *models.Job) error {
+	handler, ok := jobHandlers[job.Type]
+	if !ok {
+		return errors.Errorf("Unknown job type %s", job.Type)
+	}
+	instanceCtx, err := a.instanceContext(ctx, db, job.InstanceID)
+	if err != nil {
+		return errors.Wrap(err, "Error loading instance configuration")
+	}
+	return handler(instanceCtx, db, log, job)
+}
@@ -0,0 +1,181 @@
+package api
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+
+	"github.com/netlify/gocommerce/claims"
+	"github.com/netlify/gocommerce/conf"
+)
+
+const (
+	jwksTimeout   = 10 * time.Second
+	jwksCacheTime = 1 * time.Hour
+)
+
+// jwksRefreshInterval is how often the keys of a JWKS URL are refetched at
+// most when a token is signed by a key that isn't known yet, as happens once
+// the identity provider rotated its keys.
+var jwksRefreshInterval = 1 * time.Minute
+
+// jwksKeySets caches the public keys of the JWKS URLs by their key ID.
+var jwksKeySets = struct {
+	sync.Mutex
+	sets map[string]*jwksKeySet
+}{sets: map[string]*jwksKeySet{}}
+
+type jwksKeySet struct {
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+	// attempted is when the keys were last requested, whether that
+	// succeeded or not.
+	attempted time.Time
+	// fetching is closed once the keys being requested have been fetched.
+	fetching chan struct{}
+}
+
+type jwksResponse struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+// jwtKeyFunc returns the key verifying the signature of a token: the JWT
+// secret for HS256 tokens and the key of the JWKS URL the token names for
+// RS256 tokens.
+func jwtKeyFunc(config *conf.Configuration) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodHMAC:
+			if config.JWT.Secret == "" {
+				return nil, errors.New("HS256 tokens are not accepted without a JWT secret")
+			}
+			return []byte(config.JWT.Secret), nil
+		case *jwt.SigningMethodRSA:
+			if config.JWT.JWKSURL == "" {
+				return nil, errors.New("RS256 tokens are not accepted without a JWKS URL")
+			}
+			kid, _ := token.Header["kid"].(string)
+			return jwksKey(config.JWT.JWKSURL, kid)
+		}
+		return nil, fmt.Errorf("Unexpected signing method %v", token.Header["alg"])
+	}
+}
+
+// jwksKey returns the public key with the ID of the JWKS URL. The keys are
+// fetched again once they expire, or when the ID is unknown and they haven't
+// been requested within the refresh interval. Only one request fetches the
+// keys of a URL at a time, the others wait for its keys. Cached keys keep
+// being used when fetching fails.
+func jwksKey(url, kid string) (*rsa.PublicKey, error) {
+	jwksKeySets.Lock()
+	set := jwksKeySets.sets[url]
+	if set == nil {
+		set = &jwksKeySet{}
+		jwksKeySets.sets[url] = set
+	}
+	for set.fetching != nil {
+		fetching := set.fetching
+		jwksKeySets.Unlock()
+		<-fetching
+		jwksKeySets.Lock()
+	}
+
+	key, ok := set.keys[kid]
+	recent := time.Since(set.attempted) < jwksRefreshInterval
+	if ok && (recent || time.Since(set.fetched) < jwksCacheTime) {
+		jwksKeySets.Unlock()
+		return key, nil
+	}
+	if !ok && recent {
+		jwksKeySets.Unlock()
+		return nil, fmt.Errorf("Unknown JWKS key %q", kid)
+	}
+	fetching := make(chan struct{})
+	set.fetching = fetching
+	set.attempted = time.Now()
+	jwksKeySets.Unlock()
+
+	keys, err := fetchJWKS(url)
+
+	jwksKeySets.Lock()
+	if err == nil {
+		set.keys = keys
+		set.fetched = time.Now()
+	}
+	set.fetching = nil
+	close(fetching)
+	key, ok = set.keys[kid]
+	jwksKeySets.Unlock()
+
+	if ok {
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("Unknown JWKS key %q", kid)
+}
+
+// fetchJWKS requests the RSA signing keys of the JWKS URL.
+func fetchJWKS(url string) (map[string]*rsa.PublicKey, error) {
+	client := &http.Client{Timeout: jwksTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error requesting JWKS")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error requesting JWKS: %s", resp.Status)
+	}
+
+	jwks := &jwksResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(jwks); err != nil {
+		return nil, errors.Wrap(err, "Error reading JWKS")
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error reading JWKS key %q", k.Kid)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error reading JWKS key %q", k.Kid)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+// verifyTokenClaims checks the audience and issuer of the claims against
+// the ones configured for the instance, if any. The configured audience has
+// to be one of the audiences of the token.
+func verifyTokenClaims(config *conf.Configuration, c *claims.JWTClaims) error {
+	if config.JWT.Audience != "" && !c.HasAudience(config.JWT.Audience) {
+		return fmt.Errorf("Unexpected audience %q", c.Audiences)
+	}
+	if config.JWT.Issuer != "" && !c.VerifyIssuer(config.JWT.Issuer, true) {
+		return fmt.Errorf("Unexpected issuer %q", c.Issuer)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/claims"
+)
+
+type testJWKS struct {
+	sync.Mutex
+	keys     map[string]*rsa.PrivateKey
+	requests int
+}
+
+func (s *testJWKS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	s.requests++
+	jwks := map[string][]map[string]string{"keys": {}}
+	for kid, key := range s.keys {
+		jwks["keys"] = append(jwks["keys"], map[string]string{
+			"kty": "RSA",
+			"kid": kid,
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	sendJSON(w, http.StatusOK, jwks)
+}
+
+func (s *testJWKS) rotate(t *testing.T, kid string) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	s.Lock()
+	s.keys = map[string]*rsa.PrivateKey{kid: key}
+	s.Unlock()
+	return key
+}
+
+func testRSAToken(t *testing.T, key *rsa.PrivateKey, kid string, c *claims.JWTClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, c)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+	return signed
+}
+
+func TestJWKS(t *testing.T) {
+	refreshInterval := jwksRefreshInterval
+	defer func() { jwksRefreshInterval = refreshInterval }()
+
+	jwks := &testJWKS{}
+	server := httptest.NewServer(jwks)
+	defer server.Close()
+	key := jwks.rotate(t, "first")
+
+	test := NewRouteTest(t)
+	test.Config.JWT.JWKSURL = server.URL
+	test.Config.JWT.Audience = "gocommerce"
+	test.Config.JWT.Issuer = "https://identity.wayneindustries.com"
+	adminClaims := func(audience, issuer string) *claims.JWTClaims {
+		return &claims.JWTClaims{
+			StandardClaims: jwt.StandardClaims{Subject: "admin-yo", Audience: audience, Issuer: issuer},
+			Email:          "admin@wayneindustries.com",
+			AppMetaData:    map[string]interface{}{"roles": []string{"admin"}},
+		}
+	}
+	// audiencesToken signs the claims with a list of audiences, which the
+	// claims can't be marshaled with.
+	audiencesToken := func(t *testing.T, key *rsa.PrivateKey, kid string, audiences ...string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"sub":          "admin-yo",
+			"aud":          audiences,
+			"iss":          "https://identity.wayneindustries.com",
+			"email":        "admin@wayneindustries.com",
+			"app_metadata": map[string]interface{}{"roles": []string{"admin"}},
+		})
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(key)
+		require.NoError(t, err)
+		return signed
+	}
+	request := func(token string) *httptest.ResponseRecorder {
+		return test.TestEndpointWithHeaders(http.MethodGet, "/coupons", nil, nil, map[string]string{"Authorization": "Bearer " + token})
+	}
+
+	t.Run("RS256", func(t *testing.T) {
+		token := testRSAToken(t, key, "first", adminClaims("gocommerce", "https://identity.wayneindustries.com"))
+		assert.Equal(t, http.StatusOK, request(token).Code)
+		assert.Equal(t, http.StatusOK, request(token).Code)
+		assert.Equal(t, 1, jwks.requests)
+	})
+	t.Run("HS256", func(t *testing.T) {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, adminClaims("gocommerce", "https://identity.wayneindustries.com"))
+		assert.Equal(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/coupons", nil, token).Code)
+	})
+	t.Run("Claims", func(t *testing.T) {
+		token := testRSAToken(t, key, "first", adminClaims("another-app", "https://identity.wayneindustries.com"))
+		validateError(t, http.StatusUnauthorized, request(token), "Invalid token")
+		token = testRSAToken(t, key, "first", adminClaims("gocommerce", "https://identity.example.com"))
+		validateError(t, http.StatusUnauthorized, request(token), "Invalid token")
+		validateError(t, http.StatusUnauthorized, test.TestEndpoint(http.MethodGet, "/coupons", nil, testAdminToken("admin-yo", "admin@wayneindustries.com")), "Invalid token")
+	})
+	t.Run("Audiences", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, request(audiencesToken(t, key, "first", "https://identity.wayneindustries.com/userinfo", "gocommerce")).Code)
+		validateError(t, http.StatusUnauthorized, request(audiencesToken(t, key, "first", "another-app")), "Invalid token")
+		validateError(t, http.StatusUnauthorized, request(audiencesToken(t, key, "first")), "Invalid token")
+	})
+	t.Run("Rotation", func(t *testing.T) {
+		rotated := jwks.rotate(t, "second")
+		token := testRSAToken(t, rotated, "second", adminClaims("gocommerce", "https://identity.wayneindustries.com"))
+		validateError(t, http.StatusUnauthorized, request(token), "Invalid token")
+
+		jwksRefreshInterval = 0
+		assert.Equal(t, http.StatusOK, request(token).Code)
+		forged, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		token = testRSAToken(t, forged, "second", adminClaims("gocommerce", "https://identity.wayneindustries.com"))
+		validateError(t, http.StatusUnauthorized, request(token), "Invalid token")
+	})
+	t.Run("ConcurrentRotation", func(t *testing.T) {
+		jwksRefreshInterval = refreshInterval
+		rotated := jwks.rotate(t, "third")
+		token := testRSAToken(t, rotated, "third", adminClaims("gocommerce", "https://identity.wayneindustries.com"))
+		jwks.Lock()
+		requests := jwks.requests
+		jwks.Unlock()
+		// the keys were last requested before the refresh interval
+		jwksKeySets.Lock()
+		jwksKeySets.sets[server.URL].attempted = time.Now().Add(-jwksRefreshInterval)
+		jwksKeySets.Unlock()
+
+		// only one of the requests with the new key fetches the keys
+		codes := make([]int, 10)
+		var wg sync.WaitGroup
+		for i := range codes {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				codes[i] = request(token).Code
+			}(i)
+		}
+		wg.Wait()
+		for _, code := range codes {
+			assert.Equal(t, http.StatusOK, code)
+		}
+		assert.Equal(t, requests+1, jwks.requests)
+	})
+}
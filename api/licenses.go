@@ -0,0 +1,298 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+const (
+	defaultLicenseGenerator = "random"
+	licenseVendorTimeout    = 30 * time.Second
+
+	// licenseAlphabet leaves out characters that are easily mistaken for
+	// each other when typing in a key.
+	licenseAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
+// licenseGenerator generates the license keys for the units of a line item.
+type licenseGenerator interface {
+	Generate(order *models.Order, item *models.LineItem) ([]string, error)
+}
+
+// licenseGenerators are the generators products and instances can choose from
+// by name.
+var licenseGenerators = map[string]func(config *conf.Configuration, item *models.LineItem) licenseGenerator{
+	"random": func(config *conf.Configuration, item *models.LineItem) licenseGenerator {
+		return &randomLicenseGenerator{}
+	},
+	"vendor": func(config *conf.Configuration, item *models.LineItem) licenseGenerator {
+		url := item.LicenseURL
+		if url == "" {
+			url = config.Licenses.VendorURL
+		}
+		return &vendorLicenseGenerator{url: url, secret: config.Webhooks.Secret}
+	},
+}
+
+// randomLicenseGenerator generates random keys like XXXXX-XXXXX-XXXXX-XXXXX-XXXXX.
+type randomLicenseGenerator struct{}
+
+func (g *randomLicenseGenerator) Generate(order *models.Order, item *models.LineItem) ([]string, error) {
+	keys := make([]string, item.Quantity)
+	for i := range keys {
+		random := make([]byte, 25)
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+		groups := make([]string, 5)
+		for j := range groups {
+			group := make([]byte, 5)
+			for k, b := range random[j*5 : j*5+5] {
+				group[k] = licenseAlphabet[int(b)%len(licenseAlphabet)]
+			}
+			groups[j] = string(group)
+		}
+		keys[i] = strings.Join(groups, "-")
+	}
+	return keys, nil
+}
+
+// licenseRequest is sent to the license API of a vendor to generate the keys
+// of a line item.
+type licenseRequest struct {
+	OrderID     string `json:"order_id"`
+	OrderNumber string `json:"order_number"`
+	Email       string `json:"email"`
+	LineItemID  int64  `json:"line_item_id"`
+	Sku         string `json:"sku"`
+	Quantity    uint64 `json:"quantity"`
+}
+
+type licenseResponse struct {
+	Keys []string `json:"keys"`
+}
+
+// vendorLicenseGenerator requests the keys from the license API of the vendor
+// of the product, signed like webhooks.
+type vendorLicenseGenerator struct {
+	url    string
+	secret string
+}
+
+func (g *vendorLicenseGenerator) Generate(order *models.Order, item *models.LineItem) ([]string, error) {
+	if g.url == "" {
+		return nil, errors.New("No license API configured for the vendor license generator")
+	}
+
+	body, err := json.Marshal(&licenseRequest{
+		OrderID:     order.ID,
+		OrderNumber: order.Number,
+		Email:       order.Email,
+		LineItemID:  item.ID,
+		Sku:         item.Sku,
+		Quantity:    item.Quantity,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", g.url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if g.secret != "" {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"sub": order.UserID,
+			"exp": time.Now().Add(5 * time.Minute).Unix(),
+		})
+		signature, err := token.SignedString([]byte(g.secret))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-Commerce-Signature", signature)
+	}
+
+	client := &http.Client{Timeout: licenseVendorTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error requesting license keys")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error requesting license keys: %s", resp.Status)
+	}
+
+	licenses := &licenseResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(licenses); err != nil {
+		return nil, errors.Wrap(err, "Error reading license keys")
+	}
+	if uint64(len(licenses.Keys)) != item.Quantity {
+		return nil, fmt.Errorf("The license API returned %d keys for %d units", len(licenses.Keys), item.Quantity)
+	}
+	return licenses.Keys, nil
+}
+
+// licenseJob issues the license keys of a paid order that are requested from
+// vendors or failed to be issued with the payment.
+const licenseJob = "licenses"
+
+type licensePayload struct {
+	OrderID string `json:"order_id"`
+}
+
+// issueLicenses issues the license keys of the line items that require a
+// license within the transaction that marks the order as paid. Keys of
+// vendors are requested by a job once the transaction has been committed, so
+// it doesn't wait on their APIs, and so are keys that failed to be issued.
+func issueLicenses(tx *gorm.DB, config *conf.Configuration, log logrus.FieldLogger, order *models.Order) {
+	if len(order.LineItems) == 0 {
+		tx.Model(order).Related(&order.LineItems)
+	}
+
+	queue := false
+	for _, item := range order.LineItems {
+		generator, err := itemLicenseGenerator(config, item)
+		if err != nil {
+			log.WithError(err).Errorf("Failed to generate licenses for %s", item.Sku)
+			continue
+		}
+		if generator == nil {
+			continue
+		}
+		if _, ok := generator.(*vendorLicenseGenerator); ok {
+			queue = true
+			continue
+		}
+
+		keys, err := generator.Generate(order, item)
+		if err != nil {
+			log.WithError(err).Errorf("Failed to generate licenses for %s, they will be retried", item.Sku)
+			queue = true
+			continue
+		}
+		licenses, err := models.IssueLicenses(tx, order, item, keys)
+		if err != nil {
+			log.WithError(err).Errorf("Failed to issue licenses for %s, they will be retried", item.Sku)
+			queue = true
+			continue
+		}
+		order.Licenses = append(order.Licenses, licenses...)
+	}
+
+	if queue {
+		if err := models.EnqueueJob(tx, order.InstanceID, licenseJob, order.ID, &licensePayload{OrderID: order.ID}); err != nil {
+			log.WithError(err).Error("Failed to queue the licenses of the order")
+		}
+	}
+}
+
+// runLicenseJob issues the missing license keys of the order of the job.
+// Line items that already have their licenses are skipped, so failed jobs
+// request only the missing keys when they're retried.
+func runLicenseJob(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, job *models.Job) error {
+	payload := &licensePayload{}
+	if err := json.Unmarshal([]byte(job.Payload), payload); err != nil {
+		return errors.Wrap(err, "Error parsing job payload")
+	}
+	order := &models.Order{}
+	if rsp := db.Preload("LineItems").First(order, "id = ?", payload.OrderID); rsp.Error != nil {
+		return rsp.Error
+	}
+
+	config := gcontext.GetConfig(ctx)
+	var failed error
+	for _, item := range order.LineItems {
+		generator, err := itemLicenseGenerator(config, item)
+		if err != nil || generator == nil {
+			continue
+		}
+		if err := issueMissingLicenses(db, generator, order, item); err != nil {
+			log.WithError(err).Warnf("Failed to issue licenses for %s", item.Sku)
+			failed = err
+		}
+	}
+	return failed
+}
+
+// issueMissingLicenses generates the license keys of the line item unless
+// they have been issued already and stores them within a transaction.
+func issueMissingLicenses(db *gorm.DB, generator licenseGenerator, order *models.Order, item *models.LineItem) error {
+	var issued int
+	if rsp := db.Model(&models.License{}).Where("order_id = ? AND line_item_id = ?", order.ID, item.ID).Count(&issued); rsp.Error != nil {
+		return rsp.Error
+	}
+	if issued > 0 {
+		return nil
+	}
+	keys, err := generator.Generate(order, item)
+	if err != nil {
+		return err
+	}
+	tx := db.Begin()
+	if _, err := models.IssueLicenses(tx, order, item, keys); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// itemLicenseGenerator returns the license generator of the line item, or nil
+// if it doesn't require a license.
+func itemLicenseGenerator(config *conf.Configuration, item *models.LineItem) (licenseGenerator, error) {
+	if !item.RequiresLicense {
+		return nil, nil
+	}
+	name := item.LicenseGenerator
+	if name == "" {
+		name = config.Licenses.Generator
+	}
+	if name == "" {
+		name = defaultLicenseGenerator
+	}
+	newGenerator, ok := licenseGenerators[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown license generator %s", name)
+	}
+	return newGenerator(config, item), nil
+}
+
+// downloadLicenses lists the license keys issued for the products of the
+// downloads with them.
+func downloadLicenses(db *gorm.DB, downloads []models.Download) error {
+	if len(downloads) == 0 {
+		return nil
+	}
+	orderIDs := make([]string, len(downloads))
+	for i, download := range downloads {
+		orderIDs[i] = download.OrderID
+	}
+
+	licenses := []*models.License{}
+	if rsp := db.Where("order_id IN (?)", orderIDs).Order("created_at asc").Find(&licenses); rsp.Error != nil {
+		return rsp.Error
+	}
+	for i := range downloads {
+		for _, license := range licenses {
+			if license.OrderID == downloads[i].OrderID && license.Sku == downloads[i].Sku {
+				downloads[i].Licenses = append(downloads[i].Licenses, license.Key)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestLicenses(t *testing.T) {
+	setup := func(t *testing.T, generator, url string) *RouteTest {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(&models.LineItem{}).Where("order_id = ?", test.Data.firstOrder.ID).Updates(map[string]interface{}{
+			"requires_license":  true,
+			"license_generator": generator,
+			"license_url":       url,
+		}).Error)
+		return test
+	}
+	pay := func(t *testing.T, test *RouteTest) *models.Order {
+		ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+		require.NoError(t, err)
+
+		tx := test.DB.Begin()
+		order := &models.Order{}
+		require.NoError(t, orderQuery(tx).First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		order.PaymentState = models.PendingState
+		tr := models.NewTransaction(order)
+		tr.Amount = order.Total
+		complete, err := completePayment(ctx, tx, logrus.StandardLogger(), tr, order)
+		require.NoError(t, err)
+		assert.True(t, complete)
+		require.NoError(t, tx.Commit().Error)
+		return order
+	}
+
+	t.Run("Random", func(t *testing.T) {
+		test := setup(t, "", "")
+		order := pay(t, test)
+
+		require.Len(t, order.Licenses, 2)
+		assert.Regexp(t, regexp.MustCompile(`^[A-Z2-9]{5}(-[A-Z2-9]{5}){4}$`), order.Licenses[0].Key)
+		assert.NotEqual(t, order.Licenses[0].Key, order.Licenses[1].Key)
+		assert.Equal(t, "123-i-can-fly-456", order.Licenses[0].Sku)
+
+		stored := &models.Order{}
+		require.NoError(t, orderQuery(test.DB).First(stored, "id = ?", order.ID).Error)
+		assert.Len(t, stored.Licenses, 2)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/downloads", nil, test.Data.testUserToken)
+		downloads := []models.Download{}
+		extractPayload(t, http.StatusOK, recorder, &downloads)
+		require.Len(t, downloads, 1)
+		assert.ElementsMatch(t, []string{order.Licenses[0].Key, order.Licenses[1].Key}, downloads[0].Licenses)
+	})
+	t.Run("Vendor", func(t *testing.T) {
+		var requested *licenseRequest
+		fail := true
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if fail {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			requested = &licenseRequest{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(requested))
+			assert.NotEmpty(t, r.Header.Get("X-Commerce-Signature"))
+			json.NewEncoder(w).Encode(&licenseResponse{Keys: []string{"vendor-1", "vendor-2"}})
+		}))
+		defer server.Close()
+
+		test := setup(t, "vendor", server.URL)
+		test.Config.Webhooks.Secret = "secret"
+		order := pay(t, test)
+		assert.Empty(t, order.Licenses)
+
+		test.RunJobs()
+		job := &models.Job{}
+		require.NoError(t, test.DB.First(job, "type = ? AND reference = ?", licenseJob, order.ID).Error)
+		assert.False(t, job.Done)
+		require.NotNil(t, job.ErrorMessage)
+		assert.Contains(t, *job.ErrorMessage, "503")
+
+		fail = false
+		require.NoError(t, test.DB.Model(job).Update("run_after", nil).Error)
+		test.RunJobs()
+		require.NoError(t, test.DB.First(job, job.ID).Error)
+		assert.True(t, job.Done)
+		assert.False(t, job.Failed)
+
+		require.NotNil(t, requested)
+		assert.Equal(t, uint64(2), requested.Quantity)
+		assert.Equal(t, test.Data.firstOrder.Email, requested.Email)
+		stored := &models.Order{}
+		require.NoError(t, orderQuery(test.DB).First(stored, "id = ?", order.ID).Error)
+		require.Len(t, stored.Licenses, 2)
+		assert.ElementsMatch(t, []string{"vendor-1", "vendor-2"}, []string{stored.Licenses[0].Key, stored.Licenses[1].Key})
+	})
+	t.Run("IssuedOnce", func(t *testing.T) {
+		test := setup(t, "", "")
+		pay(t, test)
+		pay(t, test)
+
+		var licenses int
+		require.NoError(t, test.DB.Model(&models.License{}).Count(&licenses).Error)
+		assert.Equal(t, 2, licenses)
+	})
+	t.Run("NotRequired", func(t *testing.T) {
+		test := NewRouteTest(t)
+		order := pay(t, test)
+		assert.Empty(t, order.Licenses)
+	})
+}
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// LineItemChange describes a change to a line item of an order. Line items
+// are matched by SKU, a SKU the order doesn't contain yet is added from the
+// product at Path.
+type LineItemChange struct {
+	Sku      string                 `json:"sku"`
+	Path     string                 `json:"path"`
+	Quantity *uint64                `json:"quantity"`
+	Price    *uint64                `json:"price"`
+	MetaData map[string]interface{} `json:"meta"`
+	Remove   bool                   `json:"remove"`
+}
+
+// LineItemsUpdateParams holds the changes to the line items of an order
+type LineItemsUpdateParams struct {
+	LineItems []*LineItemChange `json:"line_items"`
+}
+
+// OrderLineItemsUpdate lets an admin add, remove and modify the line items of
+// a pending order. The totals are recalculated and the changes are logged
+// with the old and new values.
+func (a *API) OrderLineItemsUpdate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	claims := gcontext.GetClaims(ctx)
+	config := gcontext.GetConfig(ctx)
+	orderID := gcontext.GetOrderID(ctx)
+
+	params := &LineItemsUpdateParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read line item changes: %v", err)
+	}
+	if len(params.LineItems) == 0 {
+		return badRequestError("No line item changes provided")
+	}
+
+	tx := a.DB(r).Begin()
+	order := &models.Order{}
+	if rsp := orderQuery(tx).First(order, "id = ?", orderID); rsp.Error != nil {
+		tx.Rollback()
+		if rsp.RecordNotFound() {
+			return notFoundError("Failed to find order with id '%s'", orderID)
+		}
+		return internalServerError("Error while querying for order").WithInternalError(rsp.Error)
+	}
+	if order.PaymentState != models.PendingState {
+		tx.Rollback()
+		return badRequestError("Only the line items of pending orders can be changed")
+	}
+
+	items := make(map[string]*models.LineItem, len(order.LineItems))
+	for _, item := range order.LineItems {
+		items[item.Sku] = item
+	}
+	knownDownloads := len(order.Downloads)
+	removed := []*models.LineItem{}
+	changes := []string{}
+
+	for _, change := range params.LineItems {
+		if change.Sku == "" {
+			tx.Rollback()
+			return badRequestError("Line item changes require a sku")
+		}
+		if change.Quantity != nil && *change.Quantity == 0 {
+			tx.Rollback()
+			return badRequestError("The quantity of line item %s must be positive, remove it instead", change.Sku)
+		}
+
+		item, exists := items[change.Sku]
+		if change.Remove {
+			if !exists {
+				tx.Rollback()
+				return badRequestError("Order has no line item with sku %s", change.Sku)
+			}
+			removed = append(removed, item)
+			delete(items, change.Sku)
+			changes = append(changes, fmt.Sprintf("line_items.%s removed", change.Sku))
+			continue
+		}
+
+		if !exists {
+			if change.Path == "" {
+				tx.Rollback()
+				return badRequestError("New line item %s requires a path", change.Sku)
+			}
+			item = &models.LineItem{
+				Sku:      change.Sku,
+				Path:     change.Path,
+				Quantity: 1,
+				MetaData: change.MetaData,
+				OrderID:  order.ID,
+			}
+			// the product price is taken without any claims, as those of the
+			// admin don't apply to the customer
+			if err := item.Process(config, gcontext.GetClaimsAsMap(ctx), order); err != nil {
+				tx.Rollback()
+				return badRequestError("Error processing line item %s: %v", change.Sku, err)
+			}
+			if change.Quantity != nil {
+				item.Quantity = *change.Quantity
+			}
+			if change.Price != nil {
+				item.Price = *change.Price
+				item.PriceItems = nil
+				item.Tiers = nil
+			}
+			items[item.Sku] = item
+			order.LineItems = append(order.LineItems, item)
+			changes = append(changes, fmt.Sprintf("line_items.%s added", item.Sku))
+			continue
+		}
+
+		if change.Quantity != nil && *change.Quantity != item.Quantity {
+			changes = append(changes, fmt.Sprintf("line_items.%s.quantity %d->%d", item.Sku, item.Quantity, *change.Quantity))
+			item.Quantity = *change.Quantity
+		}
+		if change.Price != nil && *change.Price != item.Price {
+			changes = append(changes, fmt.Sprintf("line_items.%s.price %d->%d", item.Sku, item.Price, *change.Price))
+			item.Price = *change.Price
+			// the price components don't add up to an adjusted price anymore
+			// and an adjusted price replaces the quantity-break prices
+			item.PriceItems = nil
+			item.Tiers = nil
+		}
+		if change.Path != "" && change.Path != item.Path {
+			changes = append(changes, fmt.Sprintf("line_items.%s.path %s->%s", item.Sku, item.Path, change.Path))
+			item.Path = change.Path
+		}
+		if change.MetaData != nil {
+			changes = append(changes, fmt.Sprintf("line_items.%s.meta", item.Sku))
+			item.MetaData = change.MetaData
+		}
+	}
+
+	if len(items) == 0 {
+		tx.Rollback()
+		return badRequestError("An order needs at least one line item")
+	}
+
+	lineItems := make([]*models.LineItem, 0, len(items))
+	for _, item := range order.LineItems {
+		if _, ok := items[item.Sku]; ok {
+			lineItems = append(lineItems, item)
+		}
+	}
+	order.LineItems = lineItems
+
+	for _, download := range order.Downloads[knownDownloads:] {
+		if err := tx.Create(&download).Error; err != nil {
+			tx.Rollback()
+			return internalServerError("Error creating download item").WithInternalError(err)
+		}
+	}
+	for _, item := range removed {
+		if err := tx.Delete(item).Error; err != nil {
+			tx.Rollback()
+			return internalServerError("Error removing line item").WithInternalError(err)
+		}
+		tx.Where("line_item_id = ?", item.ID).Delete(&models.DiscountItem{})
+		tx.Where("order_id = ? AND sku = ?", order.ID, item.Sku).Delete(&models.Download{})
+	}
+	downloads := []models.Download{}
+	for _, download := range order.Downloads {
+		if _, ok := items[download.Sku]; ok {
+			downloads = append(downloads, download)
+		}
+	}
+	order.Downloads = downloads
+
+	settings, err := a.loadSettings(ctx)
+	if err != nil {
+		tx.Rollback()
+		return internalServerError(err.Error()).WithInternalError(err)
+	}
+
+	// the discounts are calculated from scratch
+	for _, item := range order.LineItems {
+		if item.ID != 0 {
+			tx.Where("line_item_id = ?", item.ID).Delete(&models.DiscountItem{})
+		}
+	}
+	previousTotal := order.Total
+	order.CalculateTotal(settings, gcontext.GetClaimsAsMap(ctx), log)
+	if httpError := checkShippingMethod(settings, order); httpError != nil {
+		tx.Rollback()
+		return httpError
+	}
+	applyTaxBackend(config, settings, log, order)
+	if order.Total != previousTotal {
+		changes = append(changes, fmt.Sprintf("total %d->%d", previousTotal, order.Total))
+	}
+
+	if rsp := tx.Save(order); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving line item changes").WithInternalError(rsp.Error)
+	}
+	if err := models.SaveDiscountItems(tx, order); err != nil {
+		tx.Rollback()
+		return internalServerError("Error saving line item changes").WithInternalError(err)
+	}
+
+	models.LogEvent(tx, r.RemoteAddr, claims.Subject, order.ID, models.EventUpdated, changes)
+	if config.Webhooks.Update != "" {
+		hook, err := models.NewHook("update", config.SiteURL, config.Webhooks.Update, order.UserID, config.Webhooks.Secret, order)
+		if err != nil {
+			log.WithError(err).Error("Failed to process webhook")
+		} else {
+			tx.Save(hook)
+		}
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error committing line item changes").WithInternalError(rsp.Error)
+	}
+
+	log.WithField("changes", changes).Info("Updated line items of order")
+	return sendJSON(w, http.StatusOK, order)
+}
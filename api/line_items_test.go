@@ -0,0 +1,120 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestOrderLineItemsUpdate(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	url := "/orders/second-order/line_items"
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	setup := func(t *testing.T) *RouteTest {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		require.NoError(t, test.DB.Model(test.Data.secondOrder).Update("payment_state", models.PendingState).Error)
+		return test
+	}
+
+	t.Run("Modify", func(t *testing.T) {
+		test := setup(t)
+		body := strings.NewReader(`{"line_items": [
+			{"sku": "456-i-rollover-all-things", "quantity": 3},
+			{"sku": "234-fancy-belts", "price": 40},
+			{"sku": "product-1", "path": "/simple-product"}
+		]}`)
+		recorder := test.TestEndpoint(http.MethodPatch, url, body, token)
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Len(t, order.LineItems, 3)
+		assert.EqualValues(t, 3*5+40+999, order.Total)
+
+		stored := &models.Order{}
+		require.NoError(t, orderQuery(test.DB).First(stored, "id = ?", test.Data.secondOrder.ID).Error)
+		assert.Len(t, stored.LineItems, 3)
+		assert.EqualValues(t, 3*5+40+999, stored.Total)
+
+		event := &models.Event{}
+		require.NoError(t, test.DB.Where("order_id = ?", test.Data.secondOrder.ID).Last(event).Error)
+		assert.Equal(t, string(models.EventUpdated), event.Type)
+		assert.Contains(t, event.Changes, "line_items.456-i-rollover-all-things.quantity 2->3")
+		assert.Contains(t, event.Changes, "line_items.234-fancy-belts.price 45->40")
+		assert.Contains(t, event.Changes, "line_items.product-1 added")
+		assert.Contains(t, event.Changes, "total 55->1054")
+	})
+	t.Run("MemberDiscount", func(t *testing.T) {
+		test := setup(t)
+		discountServer := startTestSiteWithSettings(calculator.Settings{
+			MemberDiscounts: []*calculator.MemberDiscount{
+				{Claims: map[string]string{"email": "admin@wayneindustries.com"}, Percentage: 20},
+			},
+		})
+		defer discountServer.Close()
+		test.Config.SiteURL = discountServer.URL
+
+		body := strings.NewReader(`{"line_items": [{"sku": "456-i-rollover-all-things", "quantity": 3}]}`)
+		recorder := test.TestEndpoint(http.MethodPatch, url, body, token)
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.EqualValues(t, 12, order.Discount)
+		assert.EqualValues(t, 3*5+45-12, order.Total)
+	})
+	t.Run("Remove", func(t *testing.T) {
+		test := setup(t)
+		body := strings.NewReader(`{"line_items": [{"sku": "234-fancy-belts", "remove": true}]}`)
+		recorder := test.TestEndpoint(http.MethodPatch, url, body, token)
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		require.Len(t, order.LineItems, 1)
+		assert.Equal(t, "456-i-rollover-all-things", order.LineItems[0].Sku)
+		assert.EqualValues(t, 10, order.Total)
+
+		items := []models.LineItem{}
+		require.NoError(t, test.DB.Where("order_id = ?", test.Data.secondOrder.ID).Find(&items).Error)
+		assert.Len(t, items, 1)
+	})
+	t.Run("RemoveAll", func(t *testing.T) {
+		test := setup(t)
+		body := strings.NewReader(`{"line_items": [
+			{"sku": "234-fancy-belts", "remove": true},
+			{"sku": "456-i-rollover-all-things", "remove": true}
+		]}`)
+		recorder := test.TestEndpoint(http.MethodPatch, url, body, token)
+		validateError(t, http.StatusBadRequest, recorder, "at least one line item")
+	})
+	t.Run("NotPending", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := strings.NewReader(`{"line_items": [{"sku": "234-fancy-belts", "quantity": 2}]}`)
+		recorder := test.TestEndpoint(http.MethodPatch, url, body, token)
+		validateError(t, http.StatusBadRequest, recorder, "pending orders")
+	})
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := setup(t)
+		body := strings.NewReader(`{"line_items": [{"sku": "234-fancy-belts", "quantity": 2}]}`)
+		recorder := test.TestEndpoint(http.MethodPatch, url, body, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+	t.Run("RemovedShippingMethod", func(t *testing.T) {
+		test := setup(t)
+		require.NoError(t, test.DB.Model(test.Data.secondOrder).Updates(map[string]interface{}{"shipping_method": "discontinued", "shipping": 490}).Error)
+		body := strings.NewReader(`{"line_items": [{"sku": "456-i-rollover-all-things", "quantity": 3}]}`)
+		recorder := test.TestEndpoint(http.MethodPatch, url, body, token)
+		validateError(t, http.StatusBadRequest, recorder, "discontinued")
+
+		stored := &models.Order{}
+		require.NoError(t, test.DB.First(stored, "id = ?", test.Data.secondOrder.ID).Error)
+		assert.EqualValues(t, 490, stored.Shipping)
+	})
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// OrderNoteParams holds the parameters for adding a note to an order
+type OrderNoteParams struct {
+	Text       string `json:"text"`
+	Visibility string `json:"visibility"`
+}
+
+// OrderNoteList lists the notes of an order. Customers only see the notes
+// meant for them, admins see internal notes as well.
+func (a *API) OrderNoteList(w http.ResponseWriter, r *http.Request) error {
+	order, httpErr := a.loadOrder(r)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	notes := []models.OrderNote{}
+	query := noteQuery(r, a.DB(r)).Where("order_id = ?", order.ID)
+	if rsp := query.Order("created_at asc").Find(&notes); rsp.Error != nil {
+		return internalServerError("Error while querying for notes").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, notes)
+}
+
+// OrderNoteCreate adds a note to an order. It is only available to admins.
+func (a *API) OrderNoteCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	claims := gcontext.GetClaims(ctx)
+
+	params := &OrderNoteParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read note params: %v", err)
+	}
+	if params.Text == "" {
+		return badRequestError("A note requires a text")
+	}
+	if params.Visibility != "" && !contains(models.NoteVisibilities, params.Visibility) {
+		return badRequestError("Invalid visibility %s, must be one of %v", params.Visibility, models.NoteVisibilities)
+	}
+
+	order, httpErr := a.loadOrder(r)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	note := models.NewOrderNote(order.ID, claims.Subject, claims.Email, params.Text, params.Visibility)
+	if rsp := a.DB(r).Create(note); rsp.Error != nil {
+		return internalServerError("Error saving note").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusCreated, note)
+}
+
+// OrderNoteDelete removes a note from an order. It is only available to admins.
+func (a *API) OrderNoteDelete(w http.ResponseWriter, r *http.Request) error {
+	orderID := gcontext.GetOrderID(r.Context())
+	rsp := a.DB(r).Where("id = ? AND order_id = ?", chi.URLParam(r, "note_id"), orderID).Delete(&models.OrderNote{})
+	if rsp.Error != nil {
+		return internalServerError("Error deleting note").WithInternalError(rsp.Error)
+	}
+	if rsp.RowsAffected == 0 {
+		return notFoundError("Note not found")
+	}
+	return sendJSON(w, http.StatusOK, map[string]string{})
+}
+
+// noteQuery limits the notes to those the user of the request may see.
+func noteQuery(r *http.Request, db *gorm.DB) *gorm.DB {
+	if hasPermission(r.Context(), readOrdersPermission) {
+		return db
+	}
+	return db.Where("visibility = ?", models.NoteCustomerVisibility)
+}
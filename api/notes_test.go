@@ -0,0 +1,82 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestOrderNotes(t *testing.T) {
+	url := "/orders/first-order/notes"
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	addNote := func(t *testing.T, test *RouteTest, text, visibility string) *models.OrderNote {
+		body := strings.NewReader(fmt.Sprintf(`{"text": %q, "visibility": %q}`, text, visibility))
+		recorder := test.TestEndpoint(http.MethodPost, url, body, token)
+		note := &models.OrderNote{}
+		extractPayload(t, http.StatusCreated, recorder, note)
+		return note
+	}
+
+	t.Run("Create", func(t *testing.T) {
+		test := NewRouteTest(t)
+		note := addNote(t, test, "called about the delivery", "")
+		assert.Equal(t, models.NoteInternalVisibility, note.Visibility)
+		assert.Equal(t, "admin-yo", note.UserID)
+		assert.Equal(t, "admin@wayneindustries.com", note.Author)
+		assert.Equal(t, test.Data.firstOrder.ID, note.OrderID)
+	})
+	t.Run("Visibility", func(t *testing.T) {
+		test := NewRouteTest(t)
+		addNote(t, test, "customer is a bit odd", models.NoteInternalVisibility)
+		addNote(t, test, "your batwing is on its way", models.NoteCustomerVisibility)
+
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, token)
+		notes := []models.OrderNote{}
+		extractPayload(t, http.StatusOK, recorder, &notes)
+		assert.Len(t, notes, 2)
+
+		recorder = test.TestEndpoint(http.MethodGet, url, nil, test.Data.testUserToken)
+		notes = []models.OrderNote{}
+		extractPayload(t, http.StatusOK, recorder, &notes)
+		require.Len(t, notes, 1)
+		assert.Equal(t, "your batwing is on its way", notes[0].Text)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/orders/first-order", nil, token)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Len(t, order.Notes, 2)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/orders/first-order", nil, test.Data.testUserToken)
+		order = &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Len(t, order.Notes, 1)
+	})
+	t.Run("InvalidVisibility", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := strings.NewReader(`{"text": "hello", "visibility": "everyone"}`)
+		recorder := test.TestEndpoint(http.MethodPost, url, body, token)
+		validateError(t, http.StatusBadRequest, recorder, "Invalid visibility")
+	})
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := strings.NewReader(`{"text": "hello"}`)
+		recorder := test.TestEndpoint(http.MethodPost, url, body, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+	t.Run("Delete", func(t *testing.T) {
+		test := NewRouteTest(t)
+		note := addNote(t, test, "typo", "")
+		recorder := test.TestEndpoint(http.MethodDelete, fmt.Sprintf("%s/%d", url, note.ID), nil, token)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		recorder = test.TestEndpoint(http.MethodDelete, fmt.Sprintf("%s/%d", url, note.ID), nil, token)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+}
@@ -0,0 +1,189 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+
+	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// NotificationPreferencesParams are the parameters for updating the kinds of
+// emails a user receives. Kinds left out keep their current preference.
+type NotificationPreferencesParams struct {
+	OrderEmails     *bool `json:"order_emails"`
+	Marketing       *bool `json:"marketing"`
+	ShipmentUpdates *bool `json:"shipment_updates"`
+}
+
+// NotificationPreferencesView shows the kinds of emails the user receives.
+func (a *API) NotificationPreferencesView(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	userID := gcontext.GetUserID(ctx)
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+
+	prefs, err := models.LoadNotificationPreferences(a.DB(r), user)
+	if err != nil {
+		return internalServerError("Error loading notification preferences").WithInternalError(err)
+	}
+	return sendJSON(w, http.StatusOK, prefs)
+}
+
+// NotificationPreferencesUpdate opts the user into or out of kinds of emails.
+func (a *API) NotificationPreferencesUpdate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	userID := gcontext.GetUserID(ctx)
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+
+	params := &NotificationPreferencesParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Failed to parse json body: %v", err)
+	}
+
+	tx := a.DB(r).Begin()
+	prefs, err := models.LoadNotificationPreferences(tx, user)
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Error loading notification preferences").WithInternalError(err)
+	}
+	updates := map[string]*bool{
+		models.OrderEmailsNotification:     params.OrderEmails,
+		models.MarketingNotification:       params.Marketing,
+		models.ShipmentUpdatesNotification: params.ShipmentUpdates,
+	}
+	for kind, allowed := range updates {
+		if allowed != nil {
+			prefs.Set(kind, *allowed)
+		}
+	}
+	if rsp := tx.Save(prefs); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving notification preferences").WithInternalError(rsp.Error)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return internalServerError("Error saving notification preferences").WithInternalError(err)
+	}
+	return sendJSON(w, http.StatusOK, prefs)
+}
+
+// Unsubscribe opts the owner of an unsubscribe token out of a kind of
+// emails, marketing emails by default. It doesn't require signing in, so
+// it can be linked from the emails, and takes a POST, so mail clients can
+// unsubscribe with a single click and link scanners don't.
+func (a *API) Unsubscribe(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	kind, httpErr := unsubscribeKind(r)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	tx := a.DB(r).Begin()
+	prefs, ok, err := models.FindUnsubscribeToken(tx, gcontext.GetInstanceID(ctx), chi.URLParam(r, "token"))
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Error loading notification preferences").WithInternalError(err)
+	}
+	if !ok {
+		tx.Rollback()
+		return notFoundError("This unsubscribe token is invalid")
+	}
+	prefs.Set(kind, false)
+	if rsp := tx.Save(prefs); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving notification preferences").WithInternalError(rsp.Error)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return internalServerError("Error saving notification preferences").WithInternalError(err)
+	}
+	return sendJSON(w, http.StatusOK, prefs)
+}
+
+const unsubscribeConfirmPage = `<!DOCTYPE html>
+<html>
+<head><title>Unsubscribe</title></head>
+<body>
+<form method="post">
+<p>Stop receiving these emails?</p>
+<button type="submit">Unsubscribe</button>
+</form>
+</body>
+</html>
+`
+
+// UnsubscribeConfirm is the page the unsubscribe links of emails open. It
+// asks to confirm with a POST to Unsubscribe instead of opting out on the
+// GET.
+func (a *API) UnsubscribeConfirm(w http.ResponseWriter, r *http.Request) error {
+	if _, httpErr := unsubscribeKind(r); httpErr != nil {
+		return httpErr
+	}
+	_, ok, err := models.FindUnsubscribeToken(a.DB(r), gcontext.GetInstanceID(r.Context()), chi.URLParam(r, "token"))
+	if err != nil {
+		return internalServerError("Error loading notification preferences").WithInternalError(err)
+	}
+	if !ok {
+		return notFoundError("This unsubscribe token is invalid")
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write([]byte(unsubscribeConfirmPage))
+	return err
+}
+
+// unsubscribeKind returns the kind of emails to unsubscribe from in the query
+// parameters, marketing emails by default.
+func unsubscribeKind(r *http.Request) (string, *HTTPError) {
+	kind := r.URL.Query().Get("kind")
+	if kind == "" {
+		kind = models.MarketingNotification
+	}
+	if !models.ValidNotificationKind(kind) {
+		return "", badRequestError("Unknown notification kind %v", kind)
+	}
+	return kind, nil
+}
+
+// unsubscribeBase returns the URL of the unsubscribe endpoint that tokens are
+// appended to. Mails sent in the background, without a request to take the
+// host from, link to the site URL if the API endpoint isn't configured.
+func (a *API) unsubscribeBase(r *http.Request, config *conf.Configuration) string {
+	if r == nil && a.config.API.Endpoint == "" {
+		return strings.TrimSuffix(config.SiteURL, "/") + "/unsubscribe/"
+	}
+	return a.apiURL(r, "/unsubscribe/")
+}
+
+// unsubscribeLink returns the link to unsubscribe the recipient of a
+// marketing email, the user or else the guest with the email, from marketing
+// emails. Their token is created with the first email sent to them.
+func unsubscribeLink(db *gorm.DB, instanceID, userID, email, base string) (string, error) {
+	prefs, err := models.LoadRecipientPreferences(db, instanceID, userID, email)
+	if err != nil {
+		return "", err
+	}
+	return base + prefs.UnsubscribeToken, nil
+}
+
+// notificationAllowed reports whether the user, or else the guest with the
+// email, agreed to receive emails of the kind. Emails aren't sent if the
+// preferences can't be checked.
+func notificationAllowed(db *gorm.DB, log logrus.FieldLogger, instanceID, userID, email, kind string) bool {
+	allowed, err := models.NotificationAllowed(db, instanceID, userID, email, kind)
+	if err != nil {
+		log.WithError(err).WithField("user_id", userID).Error("Error checking notification preferences")
+		return false
+	}
+	return allowed
+}
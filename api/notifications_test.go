@@ -0,0 +1,136 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestNotificationPreferences(t *testing.T) {
+	newTest := func(t *testing.T) (*RouteTest, string) {
+		test := NewRouteTest(t)
+		return test, "/users/" + test.Data.testUser.ID + "/notifications"
+	}
+
+	t.Run("Defaults", func(t *testing.T) {
+		test, url := newTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, test.Data.testUserToken)
+		prefs := &models.NotificationPreferences{}
+		extractPayload(t, http.StatusOK, recorder, prefs)
+		assert.True(t, prefs.OrderEmails)
+		assert.True(t, prefs.Marketing)
+		assert.True(t, prefs.ShipmentUpdates)
+		assert.Len(t, prefs.UnsubscribeToken, 64)
+
+		recorder = test.TestEndpoint(http.MethodGet, url, nil, test.Data.testUserToken)
+		again := &models.NotificationPreferences{}
+		extractPayload(t, http.StatusOK, recorder, again)
+		assert.Equal(t, prefs.UnsubscribeToken, again.UnsubscribeToken)
+	})
+	t.Run("Update", func(t *testing.T) {
+		test, url := newTest(t)
+		recorder := test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"marketing": false}`), test.Data.testUserToken)
+		prefs := &models.NotificationPreferences{}
+		extractPayload(t, http.StatusOK, recorder, prefs)
+		assert.True(t, prefs.OrderEmails)
+		assert.False(t, prefs.Marketing)
+		assert.True(t, prefs.ShipmentUpdates)
+
+		recorder = test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"shipment_updates": false}`), test.Data.testUserToken)
+		prefs = &models.NotificationPreferences{}
+		extractPayload(t, http.StatusOK, recorder, prefs)
+		assert.False(t, prefs.Marketing)
+		assert.False(t, prefs.ShipmentUpdates)
+	})
+	t.Run("OtherUser", func(t *testing.T) {
+		test, url := newTest(t)
+		token := testToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, token)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+	t.Run("Unsubscribe", func(t *testing.T) {
+		test, url := newTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, test.Data.testUserToken)
+		prefs := &models.NotificationPreferences{}
+		extractPayload(t, http.StatusOK, recorder, prefs)
+
+		// opening the link only asks to confirm
+		recorder = test.TestEndpoint(http.MethodGet, "/unsubscribe/"+prefs.UnsubscribeToken, nil, nil)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), `<form method="post">`)
+		allowed, err := models.NotificationAllowed(test.DB, "", test.Data.testUser.ID, "", models.MarketingNotification)
+		require.NoError(t, err)
+		assert.True(t, allowed)
+
+		recorder = test.TestEndpoint(http.MethodPost, "/unsubscribe/"+prefs.UnsubscribeToken, strings.NewReader("List-Unsubscribe=One-Click"), nil)
+		unsubscribed := &models.NotificationPreferences{}
+		extractPayload(t, http.StatusOK, recorder, unsubscribed)
+		assert.False(t, unsubscribed.Marketing)
+		assert.True(t, unsubscribed.ShipmentUpdates)
+
+		recorder = test.TestEndpoint(http.MethodPost, "/unsubscribe/"+prefs.UnsubscribeToken+"?kind=shipment_updates", nil, nil)
+		unsubscribed = &models.NotificationPreferences{}
+		extractPayload(t, http.StatusOK, recorder, unsubscribed)
+		assert.False(t, unsubscribed.ShipmentUpdates)
+		assert.True(t, unsubscribed.OrderEmails)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/unsubscribe/"+prefs.UnsubscribeToken+"?kind=newsletters", nil, nil)
+		validateError(t, http.StatusBadRequest, recorder, "Unknown notification kind newsletters")
+
+		recorder = test.TestEndpoint(http.MethodGet, "/unsubscribe/not-a-token", nil, nil)
+		validateError(t, http.StatusNotFound, recorder, "This unsubscribe token is invalid")
+	})
+	t.Run("AbandonedOrderMail", func(t *testing.T) {
+		test, url := newTest(t)
+		recorder := test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"marketing": false}`), test.Data.testUserToken)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.NoError(t, test.DB.Model(&models.Order{}).Where("id = ?", test.Data.secondOrder.ID).Updates(map[string]interface{}{
+			"payment_state": models.PendingState,
+			"created_at":    time.Now().Add(-2 * time.Hour),
+		}).Error)
+
+		ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+		require.NoError(t, err)
+		api := NewAPIWithVersion(ctx, test.GlobalConfig, logrus.StandardLogger(), test.DB, "")
+		api.markAbandonedOrders(ctx, test.DB, logrus.StandardLogger())
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.secondOrder.ID).Error)
+		assert.NotNil(t, order.AbandonedAt)
+		var emails int
+		require.NoError(t, test.DB.Model(&models.Event{}).Where("order_id = ? AND type = ?", order.ID, models.EventEmailed).Count(&emails).Error)
+		assert.Equal(t, 0, emails)
+	})
+	t.Run("Guest", func(t *testing.T) {
+		test, _ := newTest(t)
+		order := models.NewOrder("", "guest-session", "Guest@example.com", "USD")
+		require.NoError(t, test.DB.Create(order).Error)
+		ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+		require.NoError(t, err)
+		mail := func() int {
+			sendAbandonedOrderMail(ctx, test.DB, testLogger, order, baseURL+"/unsubscribe/")
+			var emails int
+			require.NoError(t, test.DB.Model(&models.Event{}).Where("order_id = ? AND type = ?", order.ID, models.EventEmailed).Count(&emails).Error)
+			return emails
+		}
+
+		// the token of a guest is created with their first marketing email
+		assert.Equal(t, 1, mail())
+		prefs, err := models.LoadRecipientPreferences(test.DB, "", "", "guest@example.com")
+		require.NoError(t, err)
+		assert.Equal(t, "Guest@example.com", prefs.Email)
+		assert.Len(t, prefs.UnsubscribeToken, 64)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/unsubscribe/"+prefs.UnsubscribeToken, nil, nil)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, 1, mail())
+	})
+}
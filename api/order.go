@@ -6,10 +6,10 @@ import (
 	"fmt"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/jinzhu/gorm"
-	"github.com/mattes/vat"
 	"github.com/netlify/gocommerce/calculator"
 	"github.com/netlify/gocommerce/claims"
 	gcontext "github.com/netlify/gocommerce/context"
@@ -46,6 +46,10 @@ type orderRequestParams struct {
 	BillingAddressID string          `json:"billing_address_id"`
 	BillingAddress   *models.Address `json:"billing_address"`
 
+	// UseDefaultAddresses fills the addresses the order doesn't have with
+	// the default billing and shipping addresses of the user.
+	UseDefaultAddresses bool `json:"use_default_addresses"`
+
 	VATNumber string `json:"vatnumber"`
 
 	MetaData map[string]interface{} `json:"meta"`
@@ -56,7 +60,22 @@ type orderRequestParams struct {
 
 	FulfillmentState string `json:"fulfillment_state"`
 
-	CouponCode string `json:"coupon"`
+	CouponCode  string   `json:"coupon"`
+	CouponCodes []string `json:"coupons"`
+
+	ReferralCode string `json:"referral_code"`
+
+	Tags []string `json:"tags"`
+
+	// ShippingMethod is the ID of the shipping method of the settings to
+	// ship with. Shipping is the amount the client expects to be charged for
+	// it, the order is rejected if it doesn't match.
+	ShippingMethod string  `json:"shipping_method"`
+	Shipping       *uint64 `json:"shipping"`
+
+	// PickupLocation is the ID of the pickup location of the settings the
+	// order is collected at instead of being shipped to the shipping address.
+	PickupLocation string `json:"pickup_location"`
 }
 
 type receiptParams struct {
@@ -82,11 +101,14 @@ func (a *API) withOrderID(w http.ResponseWriter, r *http.Request) (context.Conte
 	return ctx, nil
 }
 
-// ClaimOrders will look for any orders with no user id belonging to an email and claim them
+// ClaimOrders will look for any orders with no user id belonging to the verified
+// email of the user and claim them. The downloads of claimed orders are listed
+// for the user from then on.
 func (a *API) ClaimOrders(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	db := a.DB(r)
 	log := getLogEntry(r)
+	config := gcontext.GetConfig(ctx)
 	instanceID := gcontext.GetInstanceID(ctx)
 
 	claims := gcontext.GetClaims(ctx)
@@ -98,18 +120,24 @@ func (a *API) ClaimOrders(w http.ResponseWriter, r *http.Request) error {
 		return badRequestError("Must provide a ID in the token to claim orders")
 	}
 
+	verified := config.JWT.AssumeEmailVerified
+	if claims.EmailVerified != nil {
+		verified = *claims.EmailVerified
+	}
+	if !verified {
+		return unauthorizedError("Must verify the email %s to claim orders", claims.Email)
+	}
+
 	log = log.WithFields(logrus.Fields{
 		"user_id":    claims.Subject,
 		"user_email": claims.Email,
 	})
 
-	// now find all the order associated with that email
-	query := orderQuery(db)
-	query = query.Where(&models.Order{
-		InstanceID: instanceID,
-		UserID:     "",
-		Email:      claims.Email,
-	})
+	// now find all the anonymous orders associated with that email
+	orderTable := db.NewScope(models.Order{}).QuotedTableName()
+	query := orderQuery(db).
+		Where(orderTable+".instance_id = ? AND LOWER("+orderTable+".email) = LOWER(?)", instanceID, claims.Email).
+		Where(orderTable + ".user_id = '' OR " + orderTable + ".user_id IS NULL")
 
 	orders := []models.Order{}
 	if res := query.Find(&orders); res.Error != nil {
@@ -138,13 +166,14 @@ func (a *API) ClaimOrders(w http.ResponseWriter, r *http.Request) error {
 			tx.Rollback()
 			return internalServerError("Failed to update an order with user ID %s", user.ID).WithInternalError(res.Error).WithInternalMessage("Failed to update order ID %s", o.ID)
 		}
+		models.LogEvent(tx, r.RemoteAddr, user.ID, o.ID, models.EventUpdated, []string{"user_id"})
 	}
 
 	if rsp := tx.Commit(); rsp.Error != nil {
 		return internalServerError("Failed to update all the orders").WithInternalError(rsp.Error)
 	}
 
-	log.Info("Finished updating")
+	log.WithField("order_count", len(orders)).Info("Finished updating")
 	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
@@ -221,6 +250,8 @@ func (a *API) ResendOrderReceipt(w http.ResponseWriter, r *http.Request) error {
 			transaction.Order = order
 			if mailErr := mailer.OrderConfirmationMail(transaction); mailErr != nil {
 				log.WithError(mailErr).Errorf("Error sending order confirmation mail")
+			} else {
+				models.LogEvent(a.DB(r), r.RemoteAddr, gcontext.GetUserID(ctx), order.ID, models.EventEmailed, []string{"order_confirmation"})
 			}
 		}
 	}
@@ -258,6 +289,13 @@ func (a *API) OrderList(w http.ResponseWriter, r *http.Request) error {
 	userID := gcontext.GetUserID(ctx)
 	if userID == "" {
 		userID = claims.Subject
+		// API keys don't have orders of their own, but list all orders
+		if isAPIKeySubject(userID) {
+			if !hasPermission(ctx, readOrdersPermission) {
+				return unauthorizedError("Permission %v required", readOrdersPermission)
+			}
+			userID = "all"
+		}
 	}
 	if userID != "all" {
 		orderTable := query.NewScope(models.Order{}).QuotedTableName()
@@ -288,7 +326,10 @@ func (a *API) OrderView(w http.ResponseWriter, r *http.Request) error {
 	log := getLogEntry(r)
 
 	order := &models.Order{}
-	if result := orderQuery(a.DB(r)).First(order, "id = ?", id); result.Error != nil {
+	query := orderQuery(a.DB(r)).Preload("Notes", func(db *gorm.DB) *gorm.DB {
+		return noteQuery(r, db).Order("created_at asc")
+	})
+	if result := query.First(order, "id = ?", id); result.Error != nil {
 		if result.RecordNotFound() {
 			return notFoundError("Order not found")
 		}
@@ -305,10 +346,6 @@ func (a *API) OrderView(w http.ResponseWriter, r *http.Request) error {
 
 // OrderCreate endpoint
 func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
-	ctx := r.Context()
-	config := gcontext.GetConfig(ctx)
-	instanceID := gcontext.GetInstanceID(ctx)
-
 	params := &orderRequestParams{Currency: "USD"}
 	jsonDecoder := json.NewDecoder(r.Body)
 	err := jsonDecoder.Decode(params)
@@ -316,20 +353,42 @@ func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
 		return badRequestError("Could not read Order params: %v", err)
 	}
 
+	order, err := a.createOrder(w, r, params, nil)
+	if err != nil {
+		return err
+	}
+	return sendJSON(w, http.StatusCreated, order)
+}
+
+// orderCreated is called within the database transaction creating an order,
+// so changes to other records commit or roll back together with the order.
+type orderCreated func(tx *gorm.DB, order *models.Order) *HTTPError
+
+// createOrder creates and prices a new order from the params. The callback,
+// if any, is called once the order has been saved.
+func (a *API) createOrder(w http.ResponseWriter, r *http.Request, params *orderRequestParams, created orderCreated) (*models.Order, error) {
+	ctx := r.Context()
+	config := gcontext.GetConfig(ctx)
+	instanceID := gcontext.GetInstanceID(ctx)
+
 	claims := gcontext.GetClaims(ctx)
+	if claims != nil && isAPIKeySubject(claims.Subject) {
+		// API keys aren't users, so they create guest orders
+		claims = nil
+	}
 	order := models.NewOrder(instanceID, params.SessionID, params.Email, params.Currency)
+	order.Test = config.Payment.Sandbox
 
-	if params.CouponCode != "" {
-		coupon, err := a.lookupCoupon(ctx, w, params.CouponCode)
-		if err != nil {
-			return err
-		}
-		if !coupon.Valid() {
-			return badRequestError("This coupon is not valid at this time")
-		}
-
-		order.CouponCode = coupon.Code
-		order.Coupon = coupon
+	coupons, err := a.lookupCoupons(ctx, w, append([]string{params.CouponCode}, params.CouponCodes...))
+	if err != nil {
+		return nil, err
+	}
+	if len(coupons) > 0 {
+		order.CouponCode = coupons[0].Code
+		order.Coupon = coupons[0]
+	}
+	if len(coupons) > 1 {
+		order.Coupons = coupons
 	}
 
 	log := logEntrySetFields(r, logrus.Fields{
@@ -340,6 +399,15 @@ func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
 		"email":    params.Email,
 		"currency": params.Currency,
 	}).Debug("Created order, starting to process request")
+
+	settings, err := a.loadSettings(ctx)
+	if err != nil {
+		return nil, internalServerError(err.Error()).WithInternalError(err)
+	}
+	if httpError := validateOrderMeta(settings, params.MetaData); httpError != nil {
+		return nil, httpError
+	}
+
 	tx := a.DB(r).Begin()
 
 	order.IP = r.RemoteAddr
@@ -348,27 +416,67 @@ func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
 	if httpError != nil {
 		log.WithError(httpError).Info("Failed to set the order email from the token")
 		tx.Rollback()
-		return httpError
+		return nil, httpError
 	}
 
 	log.WithField("order_user_id", order.UserID).Debug("Successfully set the order's ID")
 
-	shipping, httpError := a.processAddress(tx, order, "Shipping Address", params.ShippingAddress, params.ShippingAddressID)
-	if httpError != nil {
+	if httpError := setTaxExemption(tx, config, order); httpError != nil {
 		tx.Rollback()
-		return httpError
+		return nil, httpError
 	}
-	if shipping == nil {
+	if order.CustomerGroup, httpError = customerGroup(tx, claims); httpError != nil {
 		tx.Rollback()
-		return badRequestError("Shipping Address Required")
+		return nil, httpError
+	}
+
+	if params.UseDefaultAddresses {
+		if httpError := useDefaultAddresses(tx, order, params); httpError != nil {
+			tx.Rollback()
+			return nil, httpError
+		}
+	}
+
+	var shipping *models.Address
+	if params.PickupLocation != "" {
+		if params.ShippingMethod != "" {
+			tx.Rollback()
+			return nil, badRequestError("Orders collected at a pickup location can't have a shipping method")
+		}
+		shipping, httpError = pickupAddress(tx, settings, order, params.PickupLocation)
+		if httpError != nil {
+			tx.Rollback()
+			return nil, httpError
+		}
+		order.PickupLocation = params.PickupLocation
+		order.ShippingAddress = *shipping
+		order.ShippingAddressID = shipping.ID
+	} else {
+		shipping, httpError = a.processAddress(tx, order, "Shipping Address", params.ShippingAddress, params.ShippingAddressID)
+		if httpError != nil {
+			tx.Rollback()
+			return nil, httpError
+		}
+		if shipping == nil {
+			tx.Rollback()
+			return nil, badRequestError("Shipping Address Required")
+		}
+		if httpError := applyAddressValidation(tx, config, log, shipping); httpError != nil {
+			tx.Rollback()
+			return nil, httpError
+		}
+		order.ShippingAddress = *shipping
+		order.ShippingAddressID = shipping.ID
+		if httpError := validateShippingZone(settings, order); httpError != nil {
+			tx.Rollback()
+			return nil, httpError
+		}
 	}
-	order.ShippingAddress = *shipping
-	order.ShippingAddressID = shipping.ID
 
 	billing, httpError := a.processAddress(tx, order, "Billing Address", params.BillingAddress, params.BillingAddressID)
 	if httpError != nil {
 		tx.Rollback()
-		return httpError
+		return nil, httpError
 	}
 	if billing != nil {
 		order.BillingAddress = *billing
@@ -380,31 +488,57 @@ func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
 
 	if httpError := persistUserName(tx, order, claims); httpError != nil {
 		tx.Rollback()
-		return httpError
+		return nil, httpError
 	}
 
 	if params.VATNumber != "" {
-		valid, err := vat.IsValidVAT(params.VATNumber)
-		if err != nil {
+		if httpError := validateVATNumber(order, params.VATNumber); httpError != nil {
 			tx.Rollback()
-			return internalServerError("Error verifying VAT number").WithInternalError(err)
+			return nil, httpError
 		}
-		if !valid {
-			tx.Rollback()
-			return badRequestError("Vat number %v is not valid", order.VATNumber)
-		}
-		order.VATNumber = params.VATNumber
 	}
 
-	if httpError := a.createLineItems(ctx, tx, order, params.LineItems, log); httpError != nil {
+	order.ShippingMethod = params.ShippingMethod
+	if httpError := a.createLineItems(ctx, tx, order, params.LineItems, settings, log); httpError != nil {
 		log.WithError(httpError).Error("Failed to create order line items")
 		tx.Rollback()
-		return httpError
+		return nil, httpError
+	}
+	if httpError := applyShipping(ctx, tx, settings, order, params.Shipping); httpError != nil {
+		tx.Rollback()
+		return nil, httpError
+	}
+	if httpError := reserveStock(tx, config, order); httpError != nil {
+		tx.Rollback()
+		return nil, httpError
 	}
 
 	log.WithField("subtotal", order.SubTotal).Debug("Successfully processed all the line items")
 
+	number, err := models.NextOrderNumber(tx, instanceID, config.Orders.NumberPrefix, time.Now())
+	if err != nil {
+		tx.Rollback()
+		return nil, internalServerError("Error generating order number").WithInternalError(err)
+	}
+	order.Number = number
+
+	if httpError := checkCouponUses(tx, order, order.AppliedCoupons()); httpError != nil {
+		tx.Rollback()
+		return nil, httpError
+	}
+
+	if params.ReferralCode != "" {
+		if httpError := referOrder(tx, order, params.ReferralCode); httpError != nil {
+			tx.Rollback()
+			return nil, httpError
+		}
+	}
+
 	tx.Create(order)
+	if err := models.SaveDiscountItems(tx, order); err != nil {
+		tx.Rollback()
+		return nil, internalServerError("Error saving order").WithInternalError(err)
+	}
 	models.LogEvent(tx, r.RemoteAddr, order.UserID, order.ID, models.EventCreated, nil)
 	if config.Webhooks.Order != "" {
 		hook, err := models.NewHook("order", config.SiteURL, config.Webhooks.Order, order.UserID, config.Webhooks.Secret, order)
@@ -413,10 +547,18 @@ func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
 		}
 		tx.Save(hook)
 	}
-	tx.Commit()
+	if created != nil {
+		if httpError := created(tx, order); httpError != nil {
+			tx.Rollback()
+			return nil, httpError
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, internalServerError("Error saving order").WithInternalError(err)
+	}
 
 	log.Infof("Successfully created order %s", order.ID)
-	return sendJSON(w, http.StatusCreated, order)
+	return order, nil
 }
 
 // OrderUpdate will allow an ADMIN only to update the details of a record
@@ -485,7 +627,9 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 		}
 
 		log.Debugf("Updating vat number from '%v' to '%v'", existingOrder.VATNumber, orderParams.VATNumber)
-		existingOrder.VATNumber = orderParams.VATNumber
+		if httpError := validateVATNumber(existingOrder, orderParams.VATNumber); httpError != nil {
+			return httpError
+		}
 		changes = append(changes, "vatnumber")
 	}
 
@@ -514,6 +658,10 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 
 	if orderParams.ShippingAddress != nil || orderParams.ShippingAddressID != "" {
 		log.Debugf("Updating order's shipping address")
+		if existingOrder.PickupLocation != "" {
+			tx.Rollback()
+			return badRequestError("Orders collected at a pickup location have no shipping address to update")
+		}
 
 		addr, httpErr := a.processAddress(tx, existingOrder, "Shipping Address", orderParams.ShippingAddress, orderParams.ShippingAddressID)
 		if httpErr != nil {
@@ -521,6 +669,10 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 			tx.Rollback()
 			return httpErr
 		}
+		if httpErr := applyAddressValidation(tx, config, log, addr); httpErr != nil {
+			tx.Rollback()
+			return httpErr
+		}
 
 		old := existingOrder.ShippingAddressID
 		existingOrder.ShippingAddress = *addr
@@ -531,6 +683,7 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 		changes = append(changes, "shipping_address")
 	}
 
+	readyForPickup := false
 	if orderParams.FulfillmentState != "" {
 		ok := false
 		for _, state := range models.FulfillmentStates {
@@ -543,10 +696,23 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 			tx.Rollback()
 			return badRequestError("Bad fulfillment state: " + orderParams.FulfillmentState)
 		}
+		if !existingOrder.FulfillmentStateAllowed(orderParams.FulfillmentState) {
+			tx.Rollback()
+			return badRequestError("The fulfillment state %v doesn't apply to this order", orderParams.FulfillmentState)
+		}
+		readyForPickup = orderParams.FulfillmentState == models.ReadyForPickupState && existingOrder.FulfillmentState != models.ReadyForPickupState
 		existingOrder.FulfillmentState = orderParams.FulfillmentState
 		changes = append(changes, "fulfillment_state")
 	}
 
+	if orderParams.Tags != nil {
+		if err := models.SetOrderTags(tx, existingOrder, orderParams.Tags); err != nil {
+			tx.Rollback()
+			return internalServerError("Error saving order tags").WithInternalError(err)
+		}
+		changes = append(changes, "tags")
+	}
+
 	//
 	// handle the line items
 	//
@@ -568,11 +734,42 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 		changes = append(changes, "line_items")
 	}
 
+	// a validated VAT number can make the order reverse charged
+	recalculate := orderParams.VATNumber != ""
+	if recalculate {
+		settings, err := a.loadSettings(ctx)
+		if err != nil {
+			tx.Rollback()
+			return internalServerError(err.Error()).WithInternalError(err)
+		}
+
+		// the discounts are calculated from scratch
+		for _, item := range existingOrder.LineItems {
+			tx.Where("line_item_id = ?", item.ID).Delete(&models.DiscountItem{})
+		}
+		previousTotal := existingOrder.Total
+		existingOrder.CalculateTotal(settings, gcontext.GetClaimsAsMap(ctx), log)
+		if httpError := checkShippingMethod(settings, existingOrder); httpError != nil {
+			tx.Rollback()
+			return httpError
+		}
+		applyTaxBackend(config, settings, log, existingOrder)
+		if existingOrder.Total != previousTotal {
+			changes = append(changes, fmt.Sprintf("total %d->%d", previousTotal, existingOrder.Total))
+		}
+	}
+
 	log.Info("Saving order updates")
 	if rsp := tx.Save(existingOrder); rsp.Error != nil {
 		tx.Rollback()
 		return internalServerError("Error saving order updates").WithInternalError(rsp.Error)
 	}
+	if recalculate {
+		if err := models.SaveDiscountItems(tx, existingOrder); err != nil {
+			tx.Rollback()
+			return internalServerError("Error saving order updates").WithInternalError(err)
+		}
+	}
 
 	models.LogEvent(tx, r.RemoteAddr, claims.Subject, existingOrder.ID, models.EventUpdated, changes)
 	if config.Webhooks.Update != "" {
@@ -587,6 +784,9 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 		tx.Rollback()
 		return internalServerError("Error committing order updates").WithInternalError(rsp.Error)
 	}
+	if readyForPickup {
+		notifyReadyForPickup(ctx, a.DB(r), log, existingOrder)
+	}
 
 	return sendJSON(w, http.StatusOK, existingOrder)
 }
@@ -631,7 +831,48 @@ func setOrderEmail(tx *gorm.DB, order *models.Order, claims *claims.JWTClaims, l
 	return nil
 }
 
-func (a *API) createLineItems(ctx context.Context, tx *gorm.DB, order *models.Order, items []*orderLineItem, log logrus.FieldLogger) *HTTPError {
+func (a *API) createLineItems(ctx context.Context, tx *gorm.DB, order *models.Order, items []*orderLineItem, settings *calculator.Settings, log logrus.FieldLogger) *HTTPError {
+	if httpError := a.processLineItems(ctx, order, items); httpError != nil {
+		return httpError
+	}
+
+	for _, item := range order.LineItems {
+		order.SubTotal = order.SubTotal + (item.Price+item.AddonPrice)*item.Quantity
+		if err := tx.Save(item).Error; err != nil {
+			return internalServerError("Error creating line item").WithInternalError(err)
+		}
+	}
+
+	for _, download := range order.Downloads {
+		if err := tx.Create(&download).Error; err != nil {
+			return internalServerError("Error creating download item").WithInternalError(err)
+		}
+	}
+
+	order.CalculateTotal(settings, gcontext.GetClaimsAsMap(ctx), log)
+	applyTaxBackend(gcontext.GetConfig(ctx), settings, log, order)
+	return nil
+}
+
+// validateOrderMeta checks the meta of a new order against the schema of the
+// site settings, if there is one.
+func validateOrderMeta(settings *calculator.Settings, meta map[string]interface{}) *HTTPError {
+	if len(settings.OrderMetaSchema) == 0 {
+		return nil
+	}
+	schema := &models.MetaSchema{}
+	if err := json.Unmarshal(settings.OrderMetaSchema, schema); err != nil {
+		return internalServerError("Error parsing the order meta schema of the site settings").WithInternalError(err)
+	}
+	if err := schema.Validate(meta); err != nil {
+		return badRequestError("Invalid order meta: %v", err)
+	}
+	return nil
+}
+
+// processLineItems adds the items to the order and looks up their product
+// details concurrently.
+func (a *API) processLineItems(ctx context.Context, order *models.Order, items []*orderLineItem) *HTTPError {
 	sem := make(chan int, MaxConcurrentLookups)
 	var wg sync.WaitGroup
 	sharedErr := verificationError{}
@@ -673,26 +914,6 @@ func (a *API) createLineItems(ctx context.Context, tx *gorm.DB, order *models.Or
 	if sharedErr.err != nil {
 		return internalServerError("Error processing line item").WithInternalError(sharedErr.err)
 	}
-
-	for _, item := range order.LineItems {
-		order.SubTotal = order.SubTotal + (item.Price+item.AddonPrice)*item.Quantity
-		if err := tx.Save(item).Error; err != nil {
-			return internalServerError("Error creating line item").WithInternalError(err)
-		}
-	}
-
-	for _, download := range order.Downloads {
-		if err := tx.Create(&download).Error; err != nil {
-			return internalServerError("Error creating download item").WithInternalError(err)
-		}
-	}
-
-	settings, err := a.loadSettings(ctx)
-	if err != nil {
-		return internalServerError(err.Error()).WithInternalError(err)
-	}
-
-	order.CalculateTotal(settings, gcontext.GetClaimsAsMap(ctx), log)
 	return nil
 }
 
@@ -733,6 +954,11 @@ func (a *API) processAddress(tx *gorm.DB, order *models.Order, name string, addr
 	}
 
 	address.UserID = order.UserID
+	address.DefaultBilling = false
+	address.DefaultShipping = false
+	address.Verdict = ""
+	address.Latitude = 0
+	address.Longitude = 0
 	// it is a new address we're making
 	if err := address.Validate(); err != nil {
 		return nil, badRequestError("Failed to validate %v: %v", name, err.Error())
@@ -744,6 +970,27 @@ func (a *API) processAddress(tx *gorm.DB, order *models.Order, name string, addr
 	return address, nil
 }
 
+// useDefaultAddresses fills the shipping and billing addresses the order
+// params don't have with the default addresses of the user of the order.
+// Orders collected at a pickup location aren't shipped to the default
+// shipping address.
+func useDefaultAddresses(tx *gorm.DB, order *models.Order, params *orderRequestParams) *HTTPError {
+	if order.UserID == "" {
+		return badRequestError("Default addresses can only be used by signed in users")
+	}
+	billing, shipping, err := models.DefaultAddresses(tx, order.UserID)
+	if err != nil {
+		return internalServerError("Error loading default addresses").WithInternalError(err)
+	}
+	if shipping != nil && params.PickupLocation == "" && params.ShippingAddress == nil && params.ShippingAddressID == "" {
+		params.ShippingAddressID = shipping.ID
+	}
+	if billing != nil && params.BillingAddress == nil && params.BillingAddressID == "" {
+		params.BillingAddressID = billing.ID
+	}
+	return nil
+}
+
 func (a *API) processLineItem(ctx context.Context, order *models.Order, item *models.LineItem) error {
 	config := gcontext.GetConfig(ctx)
 	jwtClaims := gcontext.GetClaimsAsMap(ctx)
@@ -751,11 +998,33 @@ func (a *API) processLineItem(ctx context.Context, order *models.Order, item *mo
 	return item.Process(config, jwtClaims, order)
 }
 
+// loadOrder loads the order of the request with its line items and
+// transactions if the user has access to it.
+func (a *API) loadOrder(r *http.Request) (*models.Order, *HTTPError) {
+	ctx := r.Context()
+	order := &models.Order{}
+	if rsp := orderQuery(a.DB(r)).First(order, "id = ?", gcontext.GetOrderID(ctx)); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, notFoundError("Order not found")
+		}
+		return nil, internalServerError("Error while querying for order").WithInternalError(rsp.Error)
+	}
+	if !hasOrderAccess(ctx, order) {
+		return nil, unauthorizedError("You don't have access to this order")
+	}
+	return order, nil
+}
+
 func orderQuery(db *gorm.DB) *gorm.DB {
 	return db.
 		Preload("LineItems").
 		Preload("Downloads").
 		Preload("ShippingAddress").
 		Preload("BillingAddress").
-		Preload("Transactions")
+		Preload("Transactions").
+		Preload("Shipments").
+		Preload("Shipments.Items").
+		Preload("Tags").
+		Preload("Invoice").
+		Preload("Licenses")
 }
@@ -95,6 +95,41 @@ func TestOrderCreate(t *testing.T) {
 		assert.Equal(t, stored.UserID, order.UserID)
 	})
 
+	t.Run("Sandbox", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.Payment.Sandbox = true
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.True(t, order.Test)
+		assert.True(t, models.NewTransaction(order).Test)
+	})
+
+	t.Run("Number", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		year := time.Now().Year()
+		for i, prefix := range []string{"", "WE"} {
+			test.Config.Orders.NumberPrefix = prefix
+			recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+
+			order := &models.Order{}
+			extractPayload(t, http.StatusCreated, recorder, order)
+			if prefix == "" {
+				prefix = models.DefaultOrderNumberPrefix
+			}
+			assert.Equal(t, fmt.Sprintf("%s-%d-%06d", prefix, year, i+1), order.Number)
+		}
+
+		recorder := test.TestEndpoint(http.MethodGet, fmt.Sprintf("/orders?number=WE-%d-000002", year), nil, test.Data.testUserToken)
+		orders := []models.Order{}
+		extractPayload(t, http.StatusOK, recorder, &orders)
+		require.Len(t, orders, 1)
+		assert.Equal(t, fmt.Sprintf("WE-%d-000002", year), orders[0].Number)
+	})
+
 	t.Run("NameBackwardsCompatible", func(t *testing.T) {
 		test := NewRouteTest(t)
 		test.Config.SiteURL = server.URL
@@ -250,6 +285,100 @@ func TestOrderCreate(t *testing.T) {
 		assert.Equal(t, uint64(0), discountItem.Fixed)
 	})
 
+	t.Run("WithCartRule", func(t *testing.T) {
+		test := NewRouteTest(t)
+		server := startTestSiteWithSettings(&calculator.Settings{
+			CartRules: []*calculator.CartRule{
+				&calculator.CartRule{
+					Name:          "10% off orders over $5",
+					MinimumAmount: []*calculator.CartRuleAmount{&calculator.CartRuleAmount{Amount: "5.00", Currency: "USD"}},
+					Percentage:    10,
+				},
+				&calculator.CartRule{
+					Name:          "10% off orders over $50",
+					MinimumAmount: []*calculator.CartRuleAmount{&calculator.CartRuleAmount{Amount: "50.00", Currency: "USD"}},
+					Percentage:    10,
+				},
+			},
+		})
+		defer server.Close()
+		test.Config.SiteURL = server.URL
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, uint64(899), order.Total)
+		assert.Equal(t, uint64(100), order.Discount)
+		assert.Equal(t, []string{"10% off orders over $5"}, order.CartRules)
+
+		discountItem := order.LineItems[0].CalculationDetail.DiscountItems[0]
+		assert.Equal(t, calculator.DiscountTypeRule, discountItem.Type)
+		assert.Equal(t, "10% off orders over $5", discountItem.Code)
+
+		stored := &models.Order{}
+		require.NoError(t, test.DB.First(stored, "id = ?", order.ID).Error)
+		assert.Equal(t, []string{"10% off orders over $5"}, stored.CartRules)
+	})
+
+	t.Run("WithPriceTiers", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+
+		body := strings.Replace(defaultPayload, `"path": "/simple-product", "quantity": 1`, `"path": "/tiered-product", "quantity": 10`, 1)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(body), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, uint64(9000), order.Total)
+		require.Len(t, order.LineItems, 1)
+		assert.Equal(t, uint64(1000), order.LineItems[0].Price)
+		assert.Equal(t, uint64(900), order.LineItems[0].CalculationDetail.UnitPrice)
+
+		stored := &models.LineItem{}
+		require.NoError(t, test.DB.First(stored, "order_id = ?", order.ID).Error)
+		assert.Equal(t, uint64(900), stored.CalculationDetail.UnitPrice)
+		assert.Equal(t, []calculator.PriceTier{{MinQuantity: 10, Price: 900}, {MinQuantity: 50, Price: 750}}, stored.Tiers)
+	})
+
+	t.Run("MetaSchema", func(t *testing.T) {
+		test := NewRouteTest(t)
+		server := startTestSiteWithSettings(&calculator.Settings{
+			OrderMetaSchema: json.RawMessage(`{
+				"type": "object",
+				"required": ["erp_id"],
+				"additionalProperties": false,
+				"properties": {
+					"erp_id": {"type": "string", "pattern": "^C-[0-9]+$"},
+					"priority": {"type": "integer", "enum": [1, 2, 3]}
+				}
+			}`),
+		})
+		defer server.Close()
+		test.Config.SiteURL = server.URL
+
+		createWithMeta := func(meta string) *httptest.ResponseRecorder {
+			body := strings.NewReader(`{
+				"email": "info@example.com",
+				"shipping_address": {
+					"name": "Test User", "address1": "610 22nd Street",
+					"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+				},
+				"line_items": [{"path": "/simple-product", "quantity": 1}],
+				"meta": ` + meta + `
+			}`)
+			return test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+		}
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, createWithMeta(`{"erp_id": "C-123", "priority": 2}`), order)
+		assert.Equal(t, "C-123", order.MetaData["erp_id"])
+
+		validateError(t, http.StatusBadRequest, createWithMeta(`{"priority": 2}`), "meta.erp_id is required")
+		validateError(t, http.StatusBadRequest, createWithMeta(`{"erp_id": "123"}`), "meta.erp_id must match")
+		validateError(t, http.StatusBadRequest, createWithMeta(`{"erp_id": "C-1", "priority": 1.5}`), "meta.priority must be of type integer")
+		validateError(t, http.StatusBadRequest, createWithMeta(`{"erp_id": "C-1", "erpid": "C-1"}`), "unknown keys: erpid")
+		validateError(t, http.StatusBadRequest, createWithMeta(`null`), "meta.erp_id is required")
+	})
+
 	t.Run("MultipleItemsWithDownloads", func(t *testing.T) {
 		test := NewRouteTest(t)
 
@@ -483,6 +612,38 @@ func TestOrdersList(t *testing.T) {
 			extractPayload(t, http.StatusOK, recorder, &orders)
 			assert.Len(t, orders, 1)
 		})
+		t.Run("Search", func(t *testing.T) {
+			test := NewRouteTest(t)
+			token := test.Data.testUserToken
+			for search, count := range map[string]int{
+				"second":      1,
+				"order":       0,
+				"WAYNEIND":    2,
+				"wayne":       2,
+				"456-i-roll":  1,
+				"utility":     1,
+				"nothing-yet": 0,
+				"%25":         0,
+				"_":           0,
+			} {
+				recorder := test.TestEndpoint(http.MethodGet, "/orders?query="+search, nil, token)
+				orders := []models.Order{}
+				extractPayload(t, http.StatusOK, recorder, &orders)
+				assert.Len(t, orders, count, "Unexpected results for %s", search)
+			}
+		})
+		t.Run("SearchRanking", func(t *testing.T) {
+			test := NewRouteTest(t)
+			token := test.Data.testUserToken
+			require.NoError(t, test.DB.Model(test.Data.secondOrder).Update("email", "first@wayneindustries.com").Error)
+			recorder := test.TestEndpoint(http.MethodGet, "/orders?query=first", nil, token)
+
+			orders := []models.Order{}
+			extractPayload(t, http.StatusOK, recorder, &orders)
+			require.Len(t, orders, 2)
+			assert.Equal(t, test.Data.firstOrder.ID, orders[0].ID)
+			assert.Equal(t, test.Data.secondOrder.ID, orders[1].ID)
+		})
 		t.Run("RangeWithParams", func(t *testing.T) {
 			test := NewRouteTest(t)
 			token := test.Data.testUserToken
@@ -981,6 +1142,45 @@ func TestOrderUpdate(t *testing.T) {
 	})
 }
 
+func TestOrderTags(t *testing.T) {
+	test := NewRouteTest(t)
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	tags := func(order *models.Order) []string {
+		values := []string{}
+		for _, tag := range order.Tags {
+			values = append(values, tag.Tag)
+		}
+		return values
+	}
+	listTagged := func(t *testing.T, query string) []models.Order {
+		recorder := test.TestEndpoint(http.MethodGet, "/orders?"+query, nil, test.Data.testUserToken)
+		orders := []models.Order{}
+		extractPayload(t, http.StatusOK, recorder, &orders)
+		return orders
+	}
+
+	recorder := runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{Tags: []string{" Fraud ", "review", "fraud"}}, token)
+	order := &models.Order{}
+	extractPayload(t, http.StatusOK, recorder, order)
+	assert.Equal(t, []string{"fraud", "review"}, tags(order))
+
+	recorder = test.TestEndpoint(http.MethodGet, "/orders/first-order", nil, token)
+	order = &models.Order{}
+	extractPayload(t, http.StatusOK, recorder, order)
+	assert.Equal(t, []string{"fraud", "review"}, tags(order))
+
+	orders := listTagged(t, "tag=FRAUD")
+	require.Len(t, orders, 1)
+	assert.Equal(t, test.Data.firstOrder.ID, orders[0].ID)
+	assert.Len(t, listTagged(t, "tag=fraud&tag=priority"), 0)
+
+	recorder = runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{Tags: []string{}}, token)
+	order = &models.Order{}
+	extractPayload(t, http.StatusOK, recorder, order)
+	assert.Empty(t, order.Tags)
+	assert.Len(t, listTagged(t, "tag=fraud"), 0)
+}
+
 // -------------------------------------------------------------------------------------------------------------------
 // CLAIMS
 // -------------------------------------------------------------------------------------------------------------------
@@ -990,10 +1190,11 @@ func TestClaim(t *testing.T) {
 		test := NewRouteTest(t)
 		test.Data.firstOrder.Email = "villian@wayneindustries.com"
 		test.Data.firstOrder.UserID = ""
+		test.Data.firstOrder.User = nil
 		rsp := test.DB.Save(test.Data.firstOrder)
 		require.NoError(t, rsp.Error, "Failed to update email")
 
-		token := testToken("villian", "villian@wayneindustries.com")
+		token := verifiedToken("villian", "villian@wayneindustries.com")
 		recorder := test.TestEndpoint(http.MethodPost, "/claim", nil, token)
 		require.Equal(t, http.StatusNoContent, recorder.Code)
 
@@ -1029,15 +1230,91 @@ func TestClaim(t *testing.T) {
 		test := NewRouteTest(t)
 		test.Data.firstOrder.Email = "villian@wayneindustries.com"
 		test.Data.firstOrder.UserID = ""
+		test.Data.firstOrder.User = nil
 		rsp := test.DB.Save(test.Data.firstOrder)
 		require.NoError(t, rsp.Error, "Failed to update email")
 
-		token := testToken("villian", "villian@wayneindustries.com")
+		token := verifiedToken("villian", "villian@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodPost, "/claim", nil, token)
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+
+		recorder = test.TestEndpoint(http.MethodPost, "/claim", nil, token)
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+	})
+
+	t.Run("Downloads", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.Email = "Villian@WayneIndustries.com"
+		test.Data.firstOrder.UserID = ""
+		test.Data.firstOrder.User = nil
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+		// orders of other users with the same email aren't claimed
+		require.NoError(t, test.DB.Model(test.Data.secondOrder).Update("email", "villian@wayneindustries.com").Error)
+
+		token := verifiedToken("villian", "villian@wayneindustries.com")
 		recorder := test.TestEndpoint(http.MethodPost, "/claim", nil, token)
 		require.Equal(t, http.StatusNoContent, recorder.Code)
 
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.secondOrder.ID).Error)
+		assert.Equal(t, test.Data.testUser.ID, order.UserID)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/downloads", nil, token)
+		downloads := []models.Download{}
+		extractPayload(t, http.StatusOK, recorder, &downloads)
+		require.Len(t, downloads, 1)
+		assert.Equal(t, test.Data.firstOrder.ID, downloads[0].OrderID)
+	})
+
+	t.Run("MissingVerification", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.Email = "villian@wayneindustries.com"
+		test.Data.firstOrder.UserID = ""
+		test.Data.firstOrder.User = nil
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		token := testToken("villian", "villian@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodPost, "/claim", nil, token)
+		validateError(t, http.StatusUnauthorized, recorder, "verify")
+
+		// unless the identity provider only issues tokens for confirmed emails
+		test.Config.JWT.AssumeEmailVerified = true
 		recorder = test.TestEndpoint(http.MethodPost, "/claim", nil, token)
 		require.Equal(t, http.StatusNoContent, recorder.Code)
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, "villian", order.UserID)
+	})
+
+	t.Run("Unverified", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.Email = "villian@wayneindustries.com"
+		test.Data.firstOrder.UserID = ""
+		test.Data.firstOrder.User = nil
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		verified := false
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, &claims.JWTClaims{
+			StandardClaims: jwt.StandardClaims{Subject: "villian"},
+			Email:          "villian@wayneindustries.com",
+			EmailVerified:  &verified,
+		})
+		recorder := test.TestEndpoint(http.MethodPost, "/claim", nil, token)
+		validateError(t, http.StatusUnauthorized, recorder, "verify")
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, "", order.UserID)
+	})
+}
+
+// verifiedToken returns a token with a verified email, which can claim orders.
+func verifiedToken(id, email string) *jwt.Token {
+	verified := true
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, &claims.JWTClaims{
+		StandardClaims: jwt.StandardClaims{Subject: id},
+		Email:          email,
+		EmailVerified:  &verified,
 	})
 }
 
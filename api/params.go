@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/conf"
 	"github.com/netlify/gocommerce/models"
 	"github.com/pkg/errors"
 )
@@ -53,6 +54,40 @@ func parsePaymentQueryParams(query *gorm.DB, params url.Values) (*gorm.DB, error
 	return parseTimeQueryParams(query, transactionTable, params)
 }
 
+func parseDisputeQueryParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
+	disputeTable := query.NewScope(models.Dispute{}).QuotedTableName()
+	query = addFilters(query, disputeTable, params, []string{
+		"transaction_id",
+		"order_id",
+		"provider",
+		"currency",
+		"status",
+		"reason",
+	})
+
+	query, err := parseLimitQueryParam(query, params)
+	if err != nil {
+		return nil, err
+	}
+	return parseTimeQueryParams(query, disputeTable, params)
+}
+
+func parseReturnQueryParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
+	returnTable := query.NewScope(models.Return{}).QuotedTableName()
+	query = addFilters(query, returnTable, params, []string{
+		"order_id",
+		"user_id",
+		"currency",
+		"status",
+	})
+
+	query, err := parseLimitQueryParam(query, params)
+	if err != nil {
+		return nil, err
+	}
+	return parseTimeQueryParams(query, returnTable, params)
+}
+
 func parseUserBulkDeleteParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
 	if _, ok := params["id"]; !ok {
 		return nil, errors.New("User ID field is required")
@@ -138,6 +173,11 @@ func parseOrderParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
 	query = addNegativeAddressFilter(query, params, "countries", "country")
 	query = addAddressFilter(query, params, "name", "name")
 
+	search := params.Get("query")
+	if search != "" {
+		query = addOrderSearch(query, orderTable, search)
+	}
+
 	if values, exists := params["sort"]; exists {
 		for _, value := range values {
 			parts := strings.Split(value, " ")
@@ -159,9 +199,19 @@ func parseOrderParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
 			query = query.Order(field + " " + string(dir))
 		}
 	} else {
+		if search != "" {
+			query = query.Order(orderSearchRank(query, orderTable, search))
+		}
 		query = query.Order("created_at desc")
 	}
 
+	if tags, exists := params["tag"]; exists {
+		tagTable := query.NewScope(models.OrderTag{}).QuotedTableName()
+		for _, tag := range models.NormalizeTags(tags) {
+			query = query.Where(orderTable+".id IN (SELECT order_id FROM "+tagTable+" WHERE tag = ?)", tag)
+		}
+	}
+
 	if items := params.Get("items"); items != "" {
 		lineItemTable := query.NewScope(models.LineItem{}).QuotedTableName()
 		statement := "JOIN " + lineItemTable + " as line_item on line_item.order_id = " +
@@ -176,7 +226,13 @@ func parseOrderParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
 		query = query.Joins(statement, "%"+itemType+"%")
 	}
 
-	query, err := addFilterChoices(query, orderTable, params, "payment_state", models.PaymentStates)
+	archived, err := getArchivedQueryParam(params)
+	if err != nil {
+		return nil, err
+	}
+	query = query.Where(archivedCondition(orderTable, archived))
+
+	query, err = addFilterChoices(query, orderTable, params, "payment_state", models.PaymentStates)
 	if err != nil {
 		return nil, err
 	}
@@ -185,8 +241,17 @@ func parseOrderParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
 		return nil, err
 	}
 
+	if value := params.Get("oversold"); value != "" {
+		oversold, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("bad value for 'oversold' parameter: %s", err)
+		}
+		query = query.Where(orderTable+".oversold = ?", oversold)
+	}
+
 	query = addFilters(query, orderTable, params, []string{
 		"invoice_number",
+		"number",
 	})
 
 	query = addLikeFilters(query, orderTable, params, []string{
@@ -197,6 +262,61 @@ func parseOrderParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
 	return parseTimeQueryParams(query, orderTable, params)
 }
 
+// likeEscape escapes the wildcards of LIKE patterns. It isn't a backslash,
+// which MySQL treats as an escape within string literals as well.
+const likeEscape = "!"
+
+var likeEscaper = strings.NewReplacer(likeEscape, likeEscape+likeEscape, "%", likeEscape+"%", "_", likeEscape+"_")
+
+// escapeLike escapes the wildcards of the search, so it is matched literally
+// by a LIKE pattern with the likeEscape escape character.
+func escapeLike(search string) string {
+	return likeEscaper.Replace(search)
+}
+
+// orderSearchConditions returns the conditions an order can match a search
+// with, ordered by their weight in the ranking of the results.
+func orderSearchConditions(query *gorm.DB, orderTable, search string) ([]string, []interface{}) {
+	like := "LIKE"
+	if query.Dialect().GetName() == "postgres" {
+		like = "ILIKE"
+	}
+	lineItemTable := query.NewScope(models.LineItem{}).QuotedTableName()
+	addressTable := query.NewScope(models.Address{}).QuotedTableName()
+	like += " ? ESCAPE '" + likeEscape + "'"
+	prefix := escapeLike(search) + "%"
+	pattern := "%" + prefix
+
+	conditions := []string{
+		"(" + orderTable + ".id " + like + " OR " + orderTable + ".number " + like + ")",
+		orderTable + ".email " + like,
+		"EXISTS (SELECT 1 FROM " + addressTable + " as search_address WHERE search_address.id = " +
+			orderTable + ".billing_address_id AND search_address.name " + like + ")",
+		"EXISTS (SELECT 1 FROM " + lineItemTable + " as search_item WHERE search_item.order_id = " +
+			orderTable + ".id AND (search_item.title " + like + " OR search_item.sku " + like + "))",
+	}
+	args := []interface{}{prefix, prefix, pattern, pattern, pattern, pattern}
+	return conditions, args
+}
+
+// addOrderSearch matches orders by the prefix of their ID or number, their
+// email, the name of the billing address and the title or SKU of their line items.
+func addOrderSearch(query *gorm.DB, orderTable, search string) *gorm.DB {
+	conditions, args := orderSearchConditions(query, orderTable, search)
+	return query.Where("("+strings.Join(conditions, " OR ")+")", args...)
+}
+
+// orderSearchRank orders search results by the weight of the conditions they
+// match, e.g. an ID prefix ranks above a matching line item.
+func orderSearchRank(query *gorm.DB, orderTable, search string) interface{} {
+	conditions, args := orderSearchConditions(query, orderTable, search)
+	cases := make([]string, len(conditions))
+	for i, condition := range conditions {
+		cases[i] = fmt.Sprintf("CASE WHEN %s THEN %d ELSE 0 END", condition, 1<<uint(len(conditions)-i-1))
+	}
+	return gorm.Expr("("+strings.Join(cases, " + ")+") desc", args...)
+}
+
 func parseLimitQueryParam(query *gorm.DB, params url.Values) (*gorm.DB, error) {
 	if values, exists := params["limit"]; exists {
 		v, err := strconv.Atoi(values[0])
@@ -209,6 +329,41 @@ func parseLimitQueryParam(query *gorm.DB, params url.Values) (*gorm.DB, error) {
 	return query, nil
 }
 
+// getTestQueryParam returns whether test data is requested instead of live data.
+func getTestQueryParam(params url.Values) (bool, error) {
+	value := params.Get("test")
+	if value == "" {
+		return false, nil
+	}
+	test, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("bad value for 'test' parameter: %s", err)
+	}
+	return test, nil
+}
+
+// getArchivedQueryParam returns whether archived orders are requested instead
+// of the ones that haven't been archived.
+func getArchivedQueryParam(params url.Values) (bool, error) {
+	value := params.Get("archived")
+	if value == "" {
+		return false, nil
+	}
+	archived, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("bad value for 'archived' parameter: %s", err)
+	}
+	return archived, nil
+}
+
+// archivedCondition limits the orders of the table to archived or unarchived ones.
+func archivedCondition(orderTable string, archived bool) string {
+	if archived {
+		return orderTable + ".archived_at IS NOT NULL"
+	}
+	return orderTable + ".archived_at IS NULL"
+}
+
 func getTimeQueryParams(params url.Values) (from *time.Time, to *time.Time, err error) {
 	if value := params.Get("from"); value != "" {
 		ts, err := strconv.ParseInt(value, 10, 64)
@@ -230,6 +385,55 @@ func getTimeQueryParams(params url.Values) (from *time.Time, to *time.Time, err
 	return
 }
 
+// getTimezoneQueryParam returns the location of the 'timezone' parameter, an
+// IANA time zone like Europe/Berlin, or of the reports configuration if it's
+// not set.
+func getTimezoneQueryParam(params url.Values, config *conf.Configuration) (*time.Location, error) {
+	value := params.Get("timezone")
+	if value == "" {
+		return reportsLocation(config)
+	}
+	loc, err := time.LoadLocation(value)
+	if err != nil {
+		return nil, fmt.Errorf("bad value for 'timezone' parameter: %s", value)
+	}
+	return loc, nil
+}
+
+// reportsLocation returns the location of the timezone of the reports
+// configuration, UTC if it's not set.
+func reportsLocation(config *conf.Configuration) (*time.Location, error) {
+	if config.Reports.Timezone == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(config.Reports.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("bad reports timezone: %s", config.Reports.Timezone)
+	}
+	return loc, nil
+}
+
+// startOfDay returns the start of the day of the time in the location.
+func startOfDay(t time.Time, loc *time.Location) time.Time {
+	year, month, day := t.In(loc).Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, loc)
+}
+
+// getQuarterQueryParam returns the start and end of the quarter of the
+// 'quarter' parameter, given as 2006-Q1, in the location.
+func getQuarterQueryParam(params url.Values, loc *time.Location) (from time.Time, to time.Time, err error) {
+	value := params.Get("quarter")
+	if value == "" {
+		return from, to, errors.New("the 'quarter' parameter is required")
+	}
+	var year, quarter int
+	if _, err := fmt.Sscanf(value, "%d-Q%d", &year, &quarter); err != nil || quarter < 1 || quarter > 4 {
+		return from, to, fmt.Errorf("bad value for 'quarter' parameter: %s", value)
+	}
+	from = time.Date(year, time.Month(3*(quarter-1)+1), 1, 0, 0, 0, 0, loc)
+	return from, from.AddDate(0, 3, 0), nil
+}
+
 func parseTimeQueryParams(query *gorm.DB, tableName string, params url.Values) (*gorm.DB, error) {
 	from, to, err := getTimeQueryParams(params)
 	if err != nil {
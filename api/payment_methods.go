@@ -0,0 +1,166 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/pborman/uuid"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+// PaymentMethodParams holds the parameters for saving a payment method. Any
+// provider specific fields, e.g. the stripe_payment_method_id, are read by the
+// payment provider.
+type PaymentMethodParams struct {
+	ProviderType string `json:"provider"`
+}
+
+// PaymentMethodList will return the saved payment methods for a given user
+func (a *API) PaymentMethodList(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	userID := gcontext.GetUserID(ctx)
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+
+	methods := []models.PaymentMethod{}
+	results := a.DB(r).Where("user_id = ?", userID).Order("created_at desc").Find(&methods)
+	if results.Error != nil {
+		return internalServerError("problem while querying for userID: %s", userID).WithInternalError(results.Error)
+	}
+
+	return sendJSON(w, http.StatusOK, &methods)
+}
+
+// PaymentMethodView will return a particular saved payment method for a given user
+func (a *API) PaymentMethodView(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	methodID := chi.URLParam(r, "method_id")
+	userID := gcontext.GetUserID(ctx)
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+
+	method, err := models.GetPaymentMethod(a.DB(r), userID, methodID)
+	if err != nil {
+		return internalServerError("problem while querying for payment method: %s", methodID).WithInternalError(err)
+	}
+	if method == nil {
+		return notFoundError("Payment method not found")
+	}
+
+	return sendJSON(w, http.StatusOK, method)
+}
+
+// PaymentMethodCreate stores a payment method of the user with the payment
+// provider so it can be used for future payments.
+func (a *API) PaymentMethodCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	db := a.DB(r)
+	userID := gcontext.GetUserID(ctx)
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+
+	params := PaymentMethodParams{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		return badRequestError("Could not read params: %v", err)
+	}
+	if params.ProviderType == "" {
+		return badRequestError("Saving a payment method requires specifying a 'provider'")
+	}
+
+	provider := gcontext.GetPaymentProviders(ctx)[strings.ToLower(params.ProviderType)]
+	if provider == nil {
+		return badRequestError("Payment provider '%s' not configured", params.ProviderType)
+	}
+	vaultingProvider, ok := provider.(payments.VaultingProvider)
+	if !ok {
+		return badRequestError("Payment provider '%s' does not support saving payment methods", provider.Name())
+	}
+	vault, err := vaultingProvider.NewVaulter(ctx, r, log.WithField("component", "payment_provider"))
+	if err != nil {
+		return badRequestError("Error creating payment provider: %v", err)
+	}
+
+	customerID, err := models.FindProviderCustomerID(db, userID, provider.Name())
+	if err != nil {
+		return internalServerError("problem while querying for payment methods of userID: %s", userID).WithInternalError(err)
+	}
+
+	vaulted, err := vault(customerID, user.Email)
+	if err != nil {
+		return internalServerError("There was an error saving your payment method: %v", err).WithInternalError(err)
+	}
+
+	method := &models.PaymentMethod{
+		ID:                 uuid.NewRandom().String(),
+		UserID:             userID,
+		Provider:           provider.Name(),
+		ProviderCustomerID: vaulted.CustomerID,
+		ProviderToken:      vaulted.Token,
+		Type:               vaulted.Type,
+		Brand:              vaulted.Brand,
+		Last4:              vaulted.Last4,
+		ExpMonth:           vaulted.ExpMonth,
+		ExpYear:            vaulted.ExpYear,
+	}
+	if rsp := db.Create(method); rsp.Error != nil {
+		return internalServerError("failed to save payment method").WithInternalError(rsp.Error)
+	}
+
+	log.WithField("payment_method_id", method.ID).Info("saved payment method")
+	return sendJSON(w, http.StatusCreated, method)
+}
+
+// PaymentMethodDelete will detach the saved payment method of that user from
+// the payment provider and soft delete it
+// return errors or 200 and no body
+func (a *API) PaymentMethodDelete(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	methodID := chi.URLParam(r, "method_id")
+	log := getLogEntry(r).WithField("payment_method_id", methodID)
+
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		log.Warn("requested non-existent user - not an error b/c it is a delete")
+		return nil
+	}
+
+	method, err := models.GetPaymentMethod(a.DB(r), user.ID, methodID)
+	if err != nil {
+		return internalServerError("problem while querying for payment method: %s", methodID).WithInternalError(err)
+	}
+	if method == nil {
+		log.Warn("Attempted to delete a payment method that doesn't exist")
+		return nil
+	}
+
+	vaultingProvider, ok := gcontext.GetPaymentProviders(ctx)[method.Provider].(payments.VaultingProvider)
+	if !ok {
+		return badRequestError("Payment provider '%s' is not configured for saved payment methods", method.Provider)
+	}
+	detach, err := vaultingProvider.NewDetacher(ctx, log.WithField("component", "payment_provider"))
+	if err != nil {
+		return internalServerError("Error creating payment provider").WithInternalError(err)
+	}
+	if err := detach(method); err != nil {
+		return internalServerError("There was an error removing the payment method from the payment provider").WithInternalError(err)
+	}
+
+	if rsp := a.DB(r).Delete(method); rsp.Error != nil {
+		return internalServerError("error while deleting payment method").WithInternalError(rsp.Error)
+	}
+
+	log.Info("deleted payment method")
+	return nil
+}
@@ -0,0 +1,226 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+func createTestPaymentMethod(t *testing.T, test *RouteTest) *models.PaymentMethod {
+	method := &models.PaymentMethod{
+		ID:                 "saved-card",
+		UserID:             test.Data.testUser.ID,
+		Provider:           payments.StripeProvider,
+		ProviderCustomerID: "cus_batman",
+		ProviderToken:      "pm_batman",
+		Type:               "card",
+		Brand:              "visa",
+		Last4:              "4242",
+	}
+	require.NoError(t, test.DB.Create(method).Error)
+	return method
+}
+
+func TestPaymentMethodCreate(t *testing.T) {
+	t.Run("Stripe", func(t *testing.T) {
+		test := NewRouteTest(t)
+		customerCalls := 0
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+			switch path {
+			case "/v1/customers":
+				customerCalls++
+				assert.Equal(t, test.Data.testUser.Email, *params.(*stripe.CustomerParams).Email)
+				v.(*stripe.Customer).ID = "cus_batman"
+				return nil
+			case "/v1/payment_methods/pm_card/attach":
+				assert.Equal(t, "cus_batman", *params.(*stripe.PaymentMethodAttachParams).Customer)
+				pm := v.(*stripe.PaymentMethod)
+				pm.ID = "pm_card"
+				pm.Type = stripe.PaymentMethodTypeCard
+				pm.Card = &stripe.PaymentMethodCard{
+					Brand:    stripe.PaymentMethodCardBrandVisa,
+					Last4:    "4242",
+					ExpMonth: 12,
+					ExpYear:  2030,
+				}
+				return nil
+			default:
+				t.Fatalf("unknown Stripe API call to %s", path)
+				return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+			}
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		body, err := json.Marshal(map[string]string{
+			"provider":                 payments.StripeProvider,
+			"stripe_payment_method_id": "pm_card",
+		})
+		require.NoError(t, err)
+		url := "/users/" + test.Data.testUser.ID + "/payment_methods"
+
+		for i := 0; i < 2; i++ {
+			recorder := test.TestEndpoint(http.MethodPost, url, bytes.NewBuffer(body), test.Data.testUserToken)
+			method := &models.PaymentMethod{}
+			extractPayload(t, http.StatusCreated, recorder, method)
+			assert.Equal(t, test.Data.testUser.ID, method.UserID)
+			assert.Equal(t, payments.StripeProvider, method.Provider)
+			assert.Equal(t, "visa", method.Brand)
+			assert.Equal(t, "4242", method.Last4)
+			assert.EqualValues(t, 12, method.ExpMonth)
+
+			stored, err := models.GetPaymentMethod(test.DB, test.Data.testUser.ID, method.ID)
+			require.NoError(t, err)
+			require.NotNil(t, stored)
+			assert.Equal(t, "cus_batman", stored.ProviderCustomerID)
+			assert.Equal(t, "pm_card", stored.ProviderToken)
+		}
+		assert.Equal(t, 1, customerCalls, "expected the Stripe customer to be reused")
+	})
+	t.Run("UnsupportedProvider", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Payment.Manual.Enabled = true
+		body := bytes.NewBufferString(`{"provider": "manual"}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/users/"+test.Data.testUser.ID+"/payment_methods", body, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "does not support saving payment methods")
+	})
+	t.Run("AsStranger", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := bytes.NewBufferString(`{"provider": "stripe", "stripe_payment_method_id": "pm_card"}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/users/"+test.Data.testUser.ID+"/payment_methods", body, testToken("stranger-danger", ""))
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
+func TestPaymentMethodList(t *testing.T) {
+	test := NewRouteTest(t)
+	saved := createTestPaymentMethod(t, test)
+
+	recorder := test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID+"/payment_methods", nil, test.Data.testUserToken)
+	methods := []models.PaymentMethod{}
+	extractPayload(t, http.StatusOK, recorder, &methods)
+	require.Len(t, methods, 1)
+	assert.Equal(t, saved.ID, methods[0].ID)
+	assert.Equal(t, saved.Last4, methods[0].Last4)
+	assert.Empty(t, methods[0].ProviderToken, "provider tokens must not be exposed")
+}
+
+func TestPaymentMethodView(t *testing.T) {
+	t.Run("AsUser", func(t *testing.T) {
+		test := NewRouteTest(t)
+		saved := createTestPaymentMethod(t, test)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID+"/payment_methods/"+saved.ID, nil, test.Data.testUserToken)
+		method := &models.PaymentMethod{}
+		extractPayload(t, http.StatusOK, recorder, method)
+		assert.Equal(t, saved.ID, method.ID)
+	})
+	t.Run("Missing", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID+"/payment_methods/dne", nil, test.Data.testUserToken)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+}
+
+func TestPaymentMethodDelete(t *testing.T) {
+	test := NewRouteTest(t)
+	saved := createTestPaymentMethod(t, test)
+	detachCalls := 0
+	stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+		switch path {
+		case "/v1/payment_methods/pm_batman/detach":
+			detachCalls++
+			v.(*stripe.PaymentMethod).ID = "pm_batman"
+			return nil
+		default:
+			t.Fatalf("unknown Stripe API call to %s", path)
+			return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+		}
+	}))
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	recorder := test.TestEndpoint(http.MethodDelete, "/users/"+test.Data.testUser.ID+"/payment_methods/"+saved.ID, nil, test.Data.testUserToken)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	assert.Equal(t, 1, detachCalls)
+
+	method, err := models.GetPaymentMethod(test.DB, test.Data.testUser.ID, saved.ID)
+	require.NoError(t, err)
+	assert.Nil(t, method)
+}
+
+func TestPaymentCreateWithSavedMethod(t *testing.T) {
+	t.Run("Stripe", func(t *testing.T) {
+		test := NewRouteTest(t)
+		saved := createTestPaymentMethod(t, test)
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+			switch path {
+			case "/v1/payment_intents":
+				intentParams := params.(*stripe.PaymentIntentParams)
+				assert.Equal(t, saved.ProviderToken, *intentParams.PaymentMethod)
+				assert.Equal(t, saved.ProviderCustomerID, *intentParams.Customer)
+				intent := v.(*stripe.PaymentIntent)
+				intent.ID = stripePaymentIntentID
+				intent.Status = stripe.PaymentIntentStatusSucceeded
+				return nil
+			default:
+				t.Fatalf("unknown Stripe API call to %s", path)
+				return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+			}
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error, "Failed to update order")
+
+		body, err := json.Marshal(&PaymentParams{
+			Amount:          test.Data.firstOrder.Total,
+			Currency:        test.Data.firstOrder.Currency,
+			PaymentMethodID: saved.ID,
+		})
+		require.NoError(t, err)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+		trans := models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, &trans)
+		assert.Equal(t, models.PaidState, trans.Status)
+		assert.Equal(t, stripePaymentIntentID, trans.ProcessorID)
+	})
+	t.Run("OtherUser", func(t *testing.T) {
+		test := NewRouteTest(t)
+		saved := createTestPaymentMethod(t, test)
+		require.NoError(t, test.DB.Model(saved).Update("user_id", "stranger-danger").Error)
+
+		body, err := json.Marshal(&PaymentParams{
+			Amount:          test.Data.firstOrder.Total,
+			Currency:        test.Data.firstOrder.Currency,
+			PaymentMethodID: saved.ID,
+		})
+		require.NoError(t, err)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+	t.Run("ProviderMismatch", func(t *testing.T) {
+		test := NewRouteTest(t)
+		saved := createTestPaymentMethod(t, test)
+
+		body, err := json.Marshal(&PaymentParams{
+			Amount:          test.Data.firstOrder.Total,
+			Currency:        test.Data.firstOrder.Currency,
+			ProviderType:    payments.PayPalProvider,
+			PaymentMethodID: saved.ID,
+		})
+		require.NoError(t, err)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+}
@@ -6,13 +6,13 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"strings"
 
 	"github.com/go-chi/chi"
 
 	"github.com/jinzhu/gorm"
-	"github.com/pborman/uuid"
 	"github.com/sirupsen/logrus"
 
 	"mime"
@@ -22,8 +22,14 @@ import (
 	gcontext "github.com/netlify/gocommerce/context"
 	"github.com/netlify/gocommerce/models"
 	"github.com/netlify/gocommerce/payments"
-	"github.com/netlify/gocommerce/payments/paypal"
-	"github.com/netlify/gocommerce/payments/stripe"
+
+	// register the builtin payment providers
+	_ "github.com/netlify/gocommerce/payments/adyen"
+	_ "github.com/netlify/gocommerce/payments/coinbase"
+	_ "github.com/netlify/gocommerce/payments/klarna"
+	_ "github.com/netlify/gocommerce/payments/manual"
+	_ "github.com/netlify/gocommerce/payments/paypal"
+	_ "github.com/netlify/gocommerce/payments/stripe"
 )
 
 // PaymentParams holds the parameters for creating a payment
@@ -32,6 +38,32 @@ type PaymentParams struct {
 	Currency     string `json:"currency"`
 	ProviderType string `json:"provider"`
 	Description  string `json:"description"`
+
+	// PaymentMethodID references a saved payment method of the user to charge
+	// instead of payment details sent with the request.
+	PaymentMethodID string `json:"payment_method_id"`
+
+	// AuthorizeOnly only authorizes the amount at checkout. The payment has to
+	// be captured later on, e.g. when the order ships.
+	AuthorizeOnly bool `json:"authorize_only"`
+
+	// Partial pays only part of the order total, e.g. with a gift card, so the
+	// rest can be paid with another provider. The order stays partially paid
+	// until its payments cover the total.
+	Partial bool `json:"partial"`
+
+	// UseCredit pays as much of the amount as possible with the store credit
+	// of the user before charging the rest with the provider, which can be
+	// left out if the credit covers the whole amount.
+	UseCredit bool `json:"use_credit"`
+
+	// ToCredit refunds to the store credit of the user instead of the
+	// payment provider.
+	ToCredit bool `json:"to_credit"`
+
+	// ProviderMetadata holds provider specific data, e.g. the payment method
+	// and return URL for redirect based payment methods.
+	ProviderMetadata map[string]interface{} `json:"provider_metadata"`
 }
 
 // PaymentListForUser is the endpoint for listing transactions for a user.
@@ -70,8 +102,7 @@ func (a *API) PaymentListForOrder(w http.ResponseWriter, r *http.Request) error
 	}
 
 	// additional check for anonymous orders: only allow admins
-	isAdmin := gcontext.IsAdmin(ctx)
-	if order.UserID == "" && !isAdmin {
+	if order.UserID == "" && !hasPermission(ctx, readPaymentsPermission) {
 		// anon order ~ only accessible by an admin
 		return unauthorizedError("Anonymous orders must be accessed by admins")
 	}
@@ -80,9 +111,19 @@ func (a *API) PaymentListForOrder(w http.ResponseWriter, r *http.Request) error
 	return sendJSON(w, http.StatusOK, order.Transactions)
 }
 
-func paymentComplete(r *http.Request, tx *gorm.DB, tr *models.Transaction, order *models.Order) {
-	ctx := r.Context()
-	log := getLogEntry(r)
+// paymentComplete marks the transaction as paid. Orders paid with multiple
+// transactions are marked as paid once their paid transactions cover the order
+// total and stay partially paid until then. It reports whether the order has
+// been paid completely, or an error if the payment couldn't be recorded, in
+// which case the transaction must be rolled back. Orders whose items the stock doesn't cover anymore are
+// still paid, as the provider has been paid already, and marked as oversold.
+func paymentComplete(r *http.Request, tx *gorm.DB, tr *models.Transaction, order *models.Order) (bool, error) {
+	return completePayment(r.Context(), tx, getLogEntry(r), tr, order)
+}
+
+// completePayment is paymentComplete for payments that aren't made within a
+// request, e.g. subscription renewals.
+func completePayment(ctx context.Context, tx *gorm.DB, log logrus.FieldLogger, tr *models.Transaction, order *models.Order) (bool, error) {
 	config := gcontext.GetConfig(ctx)
 
 	tr.Status = models.PaidState
@@ -91,8 +132,48 @@ func paymentComplete(r *http.Request, tx *gorm.DB, tr *models.Transaction, order
 	} else {
 		tx.Save(tr)
 	}
+
 	order.PaymentState = models.PaidState
+	if tr.SettledAmount() < order.Total {
+		settled, err := models.OrderSettledAmount(tx, order.ID)
+		if err != nil {
+			return false, internalServerError("Failed to sum up the paid transactions of the order").WithInternalError(err)
+		}
+		if settled < order.Total {
+			order.PaymentState = models.PartiallyPaidState
+		}
+	}
 	tx.Save(order)
+	if order.PaymentState != models.PaidState {
+		return false, nil
+	}
+	skus, oversold, err := models.CommitStockReservations(tx, order)
+	if err != nil {
+		return false, internalServerError("Failed to take the items of the order out of stock").WithInternalError(err)
+	}
+	if len(oversold) > 0 {
+		for _, short := range oversold {
+			log.WithField("order_id", order.ID).Warnf("Oversold paid order: %v", short)
+		}
+		order.Oversold = true
+		tx.Model(order).UpdateColumn("oversold", true)
+		models.LogEvent(tx, "", "", order.ID, models.EventUpdated, []string{"oversold"})
+	}
+	if len(skus) > 0 {
+		alertLowStock(ctx, tx, log, order.InstanceID, skus)
+	}
+	paymentRetried(tx, order)
+	redeemCoupons(tx, log, order)
+	issueInvoice(tx, config, log, order)
+	issueLicenses(tx, config, log, order)
+	rewardReferral(tx, config, log, order)
+	reportTaxes(tx, log, order)
+	if err := models.StartDownloadExpiry(tx, order, time.Now()); err != nil {
+		log.WithError(err).Error("Failed to set the expiry of downloads")
+	}
+	if err := queueWatermarks(tx, order); err != nil {
+		log.WithError(err).Error("Failed to queue the watermarking of downloads")
+	}
 
 	if config.Webhooks.Payment != "" {
 		hook, err := models.NewHook("payment", config.SiteURL, config.Webhooks.Payment, order.UserID, config.Webhooks.Secret, order)
@@ -101,13 +182,206 @@ func paymentComplete(r *http.Request, tx *gorm.DB, tr *models.Transaction, order
 		}
 		tx.Save(hook)
 	}
+	return true, nil
+}
+
+// claimPayment marks the transaction as paid unless it has been already or
+// its order has been cancelled. The conditional update locks the transaction
+// until tx ends, so of concurrent requests completing the same payment, e.g. a
+// webhook and the client confirming it, only the one that claimed it
+// completes it. It reports false if the payment can't be claimed.
+func claimPayment(tx *gorm.DB, trans *models.Transaction) (bool, error) {
+	rsp := tx.Model(&models.Transaction{}).
+		Where("id = ? AND status NOT IN (?)", trans.ID, []string{models.PaidState, models.CancelledState}).
+		UpdateColumn("status", models.PaidState)
+	if rsp.Error != nil {
+		return false, rsp.Error
+	}
+	return rsp.RowsAffected > 0, nil
+}
+
+// issueInvoice issues the invoice of a paid order within the transaction that
+// marks it as paid.
+func issueInvoice(tx *gorm.DB, config *conf.Configuration, log logrus.FieldLogger, order *models.Order) {
+	series := ""
+	if config.Invoices.PerCountry {
+		if order.BillingAddress.ID == "" && order.BillingAddressID != "" {
+			tx.First(&order.BillingAddress, "id = ?", order.BillingAddressID)
+		}
+		series = order.BillingAddress.Country
+	}
+	if _, err := models.IssueInvoice(tx, order, series); err != nil {
+		log.WithError(err).Error("Failed to issue invoice")
+	}
+}
+
+// paymentProcessing marks the transaction and order as processing. The payment
+// is completed once the provider reports it settled.
+func paymentProcessing(tx *gorm.DB, tr *models.Transaction, order *models.Order) {
+	tr.Status = models.ProcessingState
+	if tx.NewRecord(tr) {
+		tx.Create(tr)
+	} else {
+		tx.Save(tr)
+	}
+	order.PaymentState = models.ProcessingState
+	tx.Save(order)
+}
+
+// authorizationComplete marks the transaction and order as authorized. The
+// payment is completed once the authorized amount is captured.
+func authorizationComplete(r *http.Request, tx *gorm.DB, tr *models.Transaction, order *models.Order) {
+	tr.Status = models.AuthorizedState
+	if tx.NewRecord(tr) {
+		tx.Create(tr)
+	} else {
+		tx.Save(tr)
+	}
+	order.PaymentState = models.AuthorizedState
+	tx.Save(order)
+	models.LogEvent(tx, r.RemoteAddr, order.UserID, order.ID, models.EventUpdated, []string{"payment_state"})
+}
+
+// reserveRefund books the amount of a refund on its charge transaction before
+// it's issued. The conditional update locks the charge until the transaction
+// ends, so concurrent refunds can't exceed the refundable amount. It reports
+// false if the amount isn't left to refund anymore.
+func reserveRefund(tx *gorm.DB, trans *models.Transaction, amount uint64) (bool, error) {
+	rsp := tx.Model(&models.Transaction{}).
+		Where("id = ? AND refunded_amount + ? <= amount", trans.ID, amount).
+		UpdateColumn("refunded_amount", gorm.Expr("refunded_amount + ?", amount))
+	if rsp.Error != nil {
+		return false, rsp.Error
+	}
+	if rsp.RowsAffected == 0 {
+		return false, nil
+	}
+	return true, tx.Model(&models.Transaction{}).Where("id = ?", trans.ID).Select("refunded_amount").Row().Scan(&trans.RefundedAmount)
 }
 
-func sendOrderConfirmation(ctx context.Context, log logrus.FieldLogger, tr *models.Transaction) {
+// releaseRefund gives back the amount reserved for a refund that failed.
+func releaseRefund(tx *gorm.DB, trans *models.Transaction, amount uint64) error {
+	trans.RefundedAmount -= amount
+	return tx.Model(&models.Transaction{}).Where("id = ?", trans.ID).
+		UpdateColumn("refunded_amount", gorm.Expr("refunded_amount - ?", amount)).Error
+}
+
+// refundComplete marks the order of a successful refund, reserved on its
+// charge transaction, as refunded once nothing is left to refund on any of its
+// charges. It reports whether the payment state of the order changed.
+func refundComplete(tx *gorm.DB, trans *models.Transaction, refund *models.Transaction) bool {
+	if trans.RefundableAmount() > 0 {
+		return false
+	}
+
+	charges := []*models.Transaction{}
+	tx.Where("order_id = ? AND type = ? AND status = ? AND id <> ?", trans.OrderID, models.ChargeTransactionType, models.PaidState, trans.ID).Find(&charges)
+	for _, charge := range charges {
+		if charge.RefundableAmount() > 0 {
+			return false
+		}
+	}
+	tx.Model(&models.Order{}).Where("id = ?", trans.OrderID).Update("payment_state", models.RefundedState)
+	revokeDownloads(tx, "", trans.OrderID, models.RefundedState)
+	return true
+}
+
+// revokeDownloads revokes the downloads of an order that has been refunded or
+// disputed, so they can't be accessed anymore. The reason is logged with the
+// event.
+func revokeDownloads(tx *gorm.DB, ip, orderID, reason string) {
+	rsp := tx.Model(&models.Download{}).Where("order_id = ? AND revoked = ?", orderID, false).Update("revoked", true)
+	if rsp.RowsAffected > 0 {
+		models.LogEvent(tx, ip, "", orderID, models.EventRevoked, []string{reason})
+	}
+}
+
+// restoreDownloads gives access to the downloads of an order again once a
+// dispute has been decided in favour of the shop.
+func restoreDownloads(tx *gorm.DB, ip string, order *models.Order) {
+	if order.State == models.CancelledState {
+		return
+	}
+	rsp := tx.Model(&models.Download{}).Where("order_id = ? AND revoked = ?", order.ID, true).Update("revoked", false)
+	if rsp.RowsAffected > 0 {
+		models.LogEvent(tx, ip, "", order.ID, models.EventUpdated, []string{"downloads"})
+	}
+}
+
+// refundCharge refunds the amount of a paid charge transaction with its
+// provider and records the refund.
+func refundCharge(r *http.Request, tx *gorm.DB, log logrus.FieldLogger, trans *models.Transaction, order *models.Order, amount uint64, subject string) (*models.Transaction, error) {
+	ctx := r.Context()
+	config := gcontext.GetConfig(ctx)
+
+	m := models.NewRefund(trans, amount)
+	var refund payments.Refunder
+	if trans.Provider == models.StoreCreditProvider {
+		refund = creditRefunder(tx, order, m)
+	} else {
+		provider, httpErr := transactionProvider(ctx, trans, order)
+		if httpErr != nil {
+			return nil, httpErr
+		}
+		var err error
+		refund, err = provider.NewRefunder(ctx, r, log.WithField("component", "payment_provider"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	reserved, err := reserveRefund(tx, trans, m.Amount)
+	if err != nil {
+		return nil, err
+	}
+	if !reserved {
+		return nil, fmt.Errorf("The refund exceeds the remaining refundable balance of %d", trans.RefundableAmount())
+	}
+	refundID, err := refund(trans.ProcessorID, m.Amount, m.Currency)
+	if err != nil {
+		releaseRefund(tx, trans, m.Amount)
+		return nil, err
+	}
+	m.ProcessorID = refundID
+	m.Status = models.PaidState
+	tx.Create(m)
+
+	models.LogEvent(tx, r.RemoteAddr, subject, order.ID, models.EventRefunded, []string{m.ID, m.Status})
+	if refundComplete(tx, trans, m) {
+		models.LogEvent(tx, r.RemoteAddr, subject, order.ID, models.EventUpdated, []string{"payment_state"})
+	}
+	issueCreditNote(tx, log, m)
+	reverseReferralReward(tx, log, m.OrderID)
+	reportTaxRefund(tx, log, m)
+	if config.Webhooks.Refund != "" {
+		hook, err := models.NewHook("refund", config.SiteURL, config.Webhooks.Refund, m.UserID, config.Webhooks.Secret, m)
+		if err != nil {
+			log.WithError(err).Error("Failed to process webhook")
+		} else {
+			tx.Save(hook)
+		}
+	}
+	return m, nil
+}
+
+func sendOrderConfirmation(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, tr *models.Transaction) {
 	mailer := gcontext.GetMailer(ctx)
 
-	err1 := mailer.OrderConfirmationMail(tr)
+	email := ""
+	if tr.Order != nil {
+		email = tr.Order.Email
+	}
+	var err1 error
+	if notificationAllowed(db, log, tr.InstanceID, tr.UserID, email, models.OrderEmailsNotification) {
+		err1 = mailer.OrderConfirmationMail(tr)
+		if err1 == nil {
+			models.LogEvent(db, "", "", tr.OrderID, models.EventEmailed, []string{"order_confirmation"})
+		}
+	}
 	err2 := mailer.OrderReceivedMail(tr)
+	if err2 == nil {
+		models.LogEvent(db, "", "", tr.OrderID, models.EventEmailed, []string{"order_received"})
+	}
 
 	if err1 != nil || err2 != nil {
 		log.Errorf("Error sending order confirmation mails: %v %v", err1, err2)
@@ -124,17 +398,63 @@ func (a *API) PaymentCreate(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return badRequestError("Could not read params: %v", err)
 	}
-	if params.ProviderType == "" {
-		return badRequestError("Creating a payment requires specifying a 'provider'")
+
+	var savedMethod *models.PaymentMethod
+	if params.PaymentMethodID != "" {
+		claims := gcontext.GetClaims(ctx)
+		if claims == nil {
+			return unauthorizedError("You must be logged in to pay with a saved payment method")
+		}
+		savedMethod, err = models.GetPaymentMethod(a.DB(r), claims.Subject, params.PaymentMethodID)
+		if err != nil {
+			return internalServerError("Error during database query").WithInternalError(err)
+		}
+		if savedMethod == nil {
+			return notFoundError("Payment method not found")
+		}
+		if params.ProviderType == "" {
+			params.ProviderType = savedMethod.Provider
+		} else if !strings.EqualFold(params.ProviderType, savedMethod.Provider) {
+			return badRequestError("Payment method was saved with provider '%s'", savedMethod.Provider)
+		}
 	}
 
-	provider := gcontext.GetPaymentProviders(ctx)[strings.ToLower(params.ProviderType)]
-	if provider == nil {
-		return badRequestError("Payment provider '%s' not configured", params.ProviderType)
+	if params.ProviderType == "" && !params.UseCredit {
+		return badRequestError("Creating a payment requires specifying a 'provider'")
 	}
-	charge, err := provider.NewCharger(ctx, r, log.WithField("component", "payment_provider"))
-	if err != nil {
-		return badRequestError("Error creating payment provider: %v", err)
+
+	var provider payments.Provider
+	var charge payments.Charger
+	var capturingProvider payments.CapturingProvider
+	if params.ProviderType != "" {
+		provider = gcontext.GetPaymentProviders(ctx)[strings.ToLower(params.ProviderType)]
+		if provider == nil {
+			return badRequestError("Payment provider '%s' not configured", params.ProviderType)
+		}
+		if params.AuthorizeOnly {
+			if params.Partial || params.UseCredit {
+				return badRequestError("Partial payments can't be authorized only")
+			}
+			var ok bool
+			if capturingProvider, ok = provider.(payments.CapturingProvider); !ok {
+				return badRequestError("Payment provider '%s' does not support authorizing payments", provider.Name())
+			}
+			if savedMethod != nil {
+				return badRequestError("Payments with a saved payment method can't be authorized only")
+			}
+			charge, err = capturingProvider.NewAuthorizer(ctx, r, log.WithField("component", "payment_provider"))
+		} else if savedMethod != nil {
+			vaultingProvider, ok := provider.(payments.VaultingProvider)
+			if !ok {
+				return badRequestError("Payment provider '%s' does not support saved payment methods", provider.Name())
+			}
+			charge, err = vaultingProvider.NewSavedMethodCharger(ctx, savedMethod, log.WithField("component", "payment_provider"))
+		} else {
+			charge, err = provider.NewCharger(ctx, r, log.WithField("component", "payment_provider"))
+		}
+		if err != nil {
+			return badRequestError("Error creating payment provider: %v", err)
+		}
 	}
 
 	orderID := gcontext.GetOrderID(ctx)
@@ -157,18 +477,47 @@ func (a *API) PaymentCreate(w http.ResponseWriter, r *http.Request) error {
 		tx.Rollback()
 		return badRequestError("This order has already been paid")
 	}
+	if order.PaymentState == models.PendingApprovalState {
+		tx.Rollback()
+		return badRequestError("The payment of this order is awaiting approval")
+	}
+	if order.PaymentState == models.ProcessingState {
+		tx.Rollback()
+		return badRequestError("The payment of this order is still processing")
+	}
+	if order.PaymentState == models.ExpiredState {
+		tx.Rollback()
+		return badRequestError("This order has expired")
+	}
+	if order.State == models.CancelledState {
+		tx.Rollback()
+		return badRequestError("This order has been cancelled")
+	}
 
 	if order.Currency != params.Currency {
 		tx.Rollback()
 		return badRequestError("Currencies doesn't match - %v vs %v", order.Currency, params.Currency)
 	}
 
+	config := gcontext.GetConfig(ctx)
+	if httpErr := reserveStock(tx, config, order); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	for _, country := range []string{order.BillingAddress.Country, order.ShippingAddress.Country} {
+		if provider != nil && !config.PaymentProviderAllowed(provider.Name(), country) {
+			tx.Rollback()
+			return badRequestError("Payment provider '%s' is not available for orders from %s", provider.Name(), country)
+		}
+	}
+
 	token := gcontext.GetToken(ctx)
 	if order.UserID == "" {
 		if token != nil {
-			claims := token.Claims.(*claims.JWTClaims)
-			order.UserID = claims.Subject
-			tx.Save(order)
+			if claims := token.Claims.(*claims.JWTClaims); !isAPIKeySubject(claims.Subject) {
+				order.UserID = claims.Subject
+				tx.Save(order)
+			}
 		}
 	} else {
 		if token == nil {
@@ -182,7 +531,33 @@ func (a *API) PaymentCreate(w http.ResponseWriter, r *http.Request) error {
 		}
 	}
 
-	err = a.verifyAmount(ctx, order, params.Amount)
+	if order.PaymentState != models.PartiallyPaidState {
+		coupons, err := models.OrderCoupons(tx, order)
+		if err != nil {
+			tx.Rollback()
+			return internalServerError("Error during database query").WithInternalError(err)
+		}
+		if httpErr := checkCouponUses(tx, order, coupons); httpErr != nil {
+			tx.Rollback()
+			return httpErr
+		}
+	}
+
+	outstanding := order.Total
+	if order.PaymentState == models.PartiallyPaidState {
+		settled, err := models.OrderSettledAmount(tx, order.ID)
+		if err != nil {
+			tx.Rollback()
+			return internalServerError("Error during database query").WithInternalError(err)
+		}
+		if settled < outstanding {
+			outstanding -= settled
+		} else {
+			outstanding = 0
+		}
+	}
+
+	err = a.verifyAmount(ctx, outstanding, params.Amount, params.Partial)
 	if err != nil {
 		tx.Rollback()
 		return internalServerError("We failed to authorize the amount for this order: %v", err)
@@ -199,7 +574,50 @@ func (a *API) PaymentCreate(w http.ResponseWriter, r *http.Request) error {
 		order.InvoiceNumber = invoiceNumber
 	}
 
+	if params.UseCredit {
+		if order.UserID == "" {
+			tx.Rollback()
+			return unauthorizedError("You must be logged in to pay with store credit")
+		}
+		creditTr, err := payWithCredit(ctx, tx, log, order, params.Amount, invoiceNumber)
+		if err != nil {
+			tx.Rollback()
+			if err == models.ErrInsufficientCredit {
+				return httpError(http.StatusConflict, "The store credit was spent by another payment, please try again")
+			}
+			if httpErr, ok := err.(*HTTPError); ok {
+				return httpErr
+			}
+			return internalServerError("Paying with store credit failed").WithInternalError(err)
+		}
+		if creditTr != nil {
+			params.Amount -= creditTr.Amount
+		}
+		if params.Amount == 0 {
+			models.LogEvent(tx, r.RemoteAddr, order.UserID, order.ID, models.EventUpdated, []string{"payment_state"})
+			if err := tx.Commit().Error; err != nil {
+				return internalServerError("Saving payment failed").WithInternalError(err)
+			}
+			if order.PaymentState == models.PaidState {
+				go sendOrderConfirmation(ctx, a.DB(r), log, creditTr)
+			}
+			return sendJSON(w, http.StatusOK, creditTr)
+		}
+		if provider == nil {
+			tx.Rollback()
+			return badRequestError("The store credit doesn't cover the amount, paying the rest requires specifying a 'provider'")
+		}
+	}
+
 	tr := models.NewTransaction(order)
+	tr.Amount = params.Amount
+	tr.Provider = provider.Name()
+	if capturingProvider != nil {
+		expiresAt := time.Now().Add(capturingProvider.AuthorizationPeriod())
+		tr.AuthorizedAmount = params.Amount
+		tr.AuthorizationExpiresAt = &expiresAt
+	}
+	markCharged(ctx)
 	processorID, err := charge(params.Amount, params.Currency, order, invoiceNumber)
 	tr.ProcessorID = processorID
 	tr.InvoiceNumber = invoiceNumber
@@ -214,6 +632,36 @@ func (a *API) PaymentCreate(w http.ResponseWriter, r *http.Request) error {
 			tx.Commit()
 			return sendJSON(w, 200, tr)
 		}
+		if deferredErr, ok := err.(*payments.PaymentDeferredError); ok {
+			tr.Status = models.PendingPaymentState
+			tr.ProviderMetadata = deferredErr.Metadata()
+			order.PaymentState = models.PendingPaymentState
+			tx.Create(tr)
+			tx.Save(order)
+			models.LogEvent(tx, r.RemoteAddr, order.UserID, order.ID, models.EventUpdated, []string{"payment_state"})
+			if err := tx.Commit().Error; err != nil {
+				return internalServerError("Saving payment failed").WithInternalError(err)
+			}
+			go sendOrderConfirmation(ctx, a.DB(r), log, tr)
+			return sendJSON(w, http.StatusOK, tr)
+		}
+		if processingErr, ok := err.(*payments.PaymentProcessingError); ok {
+			tr.ProviderMetadata = processingErr.Metadata()
+			paymentProcessing(tx, tr, order)
+			models.LogEvent(tx, r.RemoteAddr, order.UserID, order.ID, models.EventUpdated, []string{"payment_state"})
+			if err := tx.Commit().Error; err != nil {
+				return internalServerError("Saving payment failed").WithInternalError(err)
+			}
+			return sendJSON(w, http.StatusOK, tr)
+		}
+		if confirmFail, ok := err.(*payments.PaymentConfirmFailError); ok {
+			tr.FailureCode = strconv.FormatInt(http.StatusBadRequest, 10)
+			tr.FailureDescription = confirmFail.Error()
+			tr.Status = models.FailedState
+			tx.Create(tr)
+			tx.Commit()
+			return badRequestError("There was an error charging your card: %s", confirmFail.Error())
+		}
 
 		tr.FailureCode = strconv.FormatInt(http.StatusInternalServerError, 10)
 		tr.FailureDescription = err.Error()
@@ -223,17 +671,34 @@ func (a *API) PaymentCreate(w http.ResponseWriter, r *http.Request) error {
 		return internalServerError("There was an error charging your card: %v", err).WithInternalError(err)
 	}
 
-	paymentComplete(r, tx, tr, order)
+	if tr.IsAuthorization() {
+		authorizationComplete(r, tx, tr, order)
+		if err := tx.Commit().Error; err != nil {
+			return internalServerError("Saving payment failed").WithInternalError(err)
+		}
+		go sendOrderConfirmation(ctx, a.DB(r), log, tr)
+		return sendJSON(w, http.StatusOK, tr)
+	}
+
+	complete, err := paymentComplete(r, tx, tr, order)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
 	if err := tx.Commit().Error; err != nil {
 		return internalServerError("Saving payment failed").WithInternalError(err)
 	}
 
-	go sendOrderConfirmation(ctx, log, tr)
+	if complete {
+		go sendOrderConfirmation(ctx, a.DB(r), log, tr)
+	}
 
 	return sendJSON(w, http.StatusOK, tr)
 }
 
-// PaymentConfirm allows client to confirm if a pending transaction has been completed. Updates transaction and order
+// PaymentConfirm allows client to confirm if a pending transaction has been completed. Updates transaction and order.
+// If the provider requests yet another action the transaction stays pending and the
+// metadata needed by the client is returned with it.
 func (a *API) PaymentConfirm(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	log := getLogEntry(r)
@@ -245,6 +710,10 @@ func (a *API) PaymentConfirm(w http.ResponseWriter, r *http.Request) error {
 		return httpErr
 	}
 
+	if orderID := gcontext.GetOrderID(ctx); orderID != "" && trans.OrderID != orderID {
+		return notFoundError("Transaction not found")
+	}
+
 	if trans.UserID != "" {
 		token := gcontext.GetToken(ctx)
 		if token == nil {
@@ -256,9 +725,12 @@ func (a *API) PaymentConfirm(w http.ResponseWriter, r *http.Request) error {
 		}
 	}
 
-	if trans.Status == models.PaidState {
+	if trans.Status == models.PaidState || trans.Status == models.AuthorizedState || trans.Status == models.ProcessingState {
 		return sendJSON(w, http.StatusOK, trans)
 	}
+	if trans.Status == models.CancelledState {
+		return badRequestError("The order of this payment has been cancelled")
+	}
 
 	order := &models.Order{}
 	if rsp := db.Find(order, "id = ?", trans.OrderID); rsp.Error != nil {
@@ -267,13 +739,9 @@ func (a *API) PaymentConfirm(w http.ResponseWriter, r *http.Request) error {
 		}
 		return internalServerError("Error while querying for order").WithInternalError(rsp.Error)
 	}
-	if order.PaymentProcessor == "" {
-		return badRequestError("Order does not specify a payment provider")
-	}
-
-	provider := gcontext.GetPaymentProviders(ctx)[order.PaymentProcessor]
-	if provider == nil {
-		return badRequestError("Payment provider '%s' not configured", order.PaymentProcessor)
+	provider, httpErr := transactionProvider(ctx, trans, order)
+	if httpErr != nil {
+		return httpErr
 	}
 	confirm, err := provider.NewConfirmer(ctx, r, log.WithField("component", "payment_provider"))
 	if err != nil {
@@ -281,6 +749,20 @@ func (a *API) PaymentConfirm(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	if err := confirm(trans.ProcessorID); err != nil {
+		if pendingErr, ok := err.(*payments.PaymentPendingError); ok {
+			trans.ProviderMetadata = pendingErr.Metadata()
+			return sendJSON(w, http.StatusOK, trans)
+		}
+		if processingErr, ok := err.(*payments.PaymentProcessingError); ok {
+			tx := db.Begin()
+			trans.ProviderMetadata = processingErr.Metadata()
+			paymentProcessing(tx, trans, order)
+			models.LogEvent(tx, r.RemoteAddr, order.UserID, order.ID, models.EventUpdated, []string{"payment_state"})
+			if err := tx.Commit().Error; err != nil {
+				return internalServerError("Saving payment failed").WithInternalError(err)
+			}
+			return sendJSON(w, http.StatusOK, trans)
+		}
 		if confirmFail, ok := err.(*payments.PaymentConfirmFailError); ok {
 			return badRequestError("Error confirming payment: %s", confirmFail.Error())
 		}
@@ -288,6 +770,29 @@ func (a *API) PaymentConfirm(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	tx := db.Begin()
+	var claimed bool
+	if trans.IsAuthorization() {
+		// the order may have been cancelled while the provider confirmed it
+		rsp := tx.Model(&models.Transaction{}).
+			Where("id = ? AND status = ?", trans.ID, trans.Status).
+			UpdateColumn("status", models.AuthorizedState)
+		err, claimed = rsp.Error, rsp.RowsAffected > 0
+	} else {
+		claimed, err = claimPayment(tx, trans)
+	}
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Error claiming the payment").WithInternalError(err)
+	}
+	if !claimed {
+		// a webhook completed the payment or the order was cancelled meanwhile
+		tx.Rollback()
+		trans, httpErr := getTransaction(db, trans.ID)
+		if httpErr != nil {
+			return httpErr
+		}
+		return sendJSON(w, http.StatusOK, trans)
+	}
 
 	if trans.InvoiceNumber == 0 {
 		invoiceNumber, err := models.NextInvoiceNumber(tx, order.InstanceID)
@@ -298,16 +803,317 @@ func (a *API) PaymentConfirm(w http.ResponseWriter, r *http.Request) error {
 		trans.InvoiceNumber = invoiceNumber
 	}
 
-	paymentComplete(r, tx, trans, order)
+	complete := true
+	if trans.IsAuthorization() {
+		authorizationComplete(r, tx, trans, order)
+	} else {
+		var err error
+		if complete, err = paymentComplete(r, tx, trans, order); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
 	if err := tx.Commit().Error; err != nil {
 		return internalServerError("Saving payment failed").WithInternalError(err)
 	}
 
-	go sendOrderConfirmation(ctx, log, trans)
+	if complete {
+		go sendOrderConfirmation(ctx, a.DB(r), log, trans)
+	}
 
 	return sendJSON(w, http.StatusOK, trans)
 }
 
+// PaymentCallback finalizes a pending transaction once the customer returns from a
+// redirect based payment flow. The provider specific result of the redirect is
+// passed in the request body and the transaction and order are updated accordingly.
+func (a *API) PaymentCallback(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	db := a.DB(r)
+
+	payID := chi.URLParam(r, "payment_id")
+	trans, httpErr := getTransaction(db, payID)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	if trans.OrderID != gcontext.GetOrderID(ctx) {
+		return notFoundError("Transaction not found")
+	}
+
+	if trans.UserID != "" {
+		token := gcontext.GetToken(ctx)
+		if token == nil {
+			return unauthorizedError("You must be logged in to finalize this payment")
+		}
+		claims := token.Claims.(*claims.JWTClaims)
+		if trans.UserID != claims.Subject {
+			return unauthorizedError("You must be logged in to finalize this payment")
+		}
+	}
+
+	if trans.Status == models.PaidState {
+		return sendJSON(w, http.StatusOK, trans)
+	}
+	if trans.Status == models.FinalizingState {
+		return httpError(http.StatusConflict, "The payment is already being finalized")
+	}
+	if trans.Status != models.PendingState {
+		return badRequestError("Only pending payments can be finalized")
+	}
+
+	order := &models.Order{}
+	if rsp := db.Find(order, "id = ?", trans.OrderID); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error while querying for order").WithInternalError(rsp.Error)
+	}
+	provider, httpErr := transactionProvider(ctx, trans, order)
+	if httpErr != nil {
+		return httpErr
+	}
+	finalizingProvider, ok := provider.(payments.FinalizingProvider)
+	if !ok {
+		return badRequestError("Payment provider '%s' does not support payment callbacks", provider.Name())
+	}
+	finalize, err := finalizingProvider.NewFinalizer(ctx, r, log.WithField("component", "payment_provider"))
+	if err != nil {
+		return badRequestError("Error creating payment provider: %v", err)
+	}
+
+	// claim the payment so a double redirect or a concurrent webhook doesn't
+	// complete it twice
+	rsp := db.Model(&models.Transaction{}).
+		Where("id = ? AND status = ?", trans.ID, models.PendingState).
+		UpdateColumn("status", models.FinalizingState)
+	if rsp.Error != nil {
+		return internalServerError("Error claiming the payment").WithInternalError(rsp.Error)
+	}
+	if rsp.RowsAffected == 0 {
+		return httpError(http.StatusConflict, "The payment is already being finalized")
+	}
+	release := func() error {
+		return db.Model(&models.Transaction{}).
+			Where("id = ? AND status = ?", trans.ID, models.FinalizingState).
+			UpdateColumn("status", models.PendingState).Error
+	}
+
+	processorID, err := finalize(trans.ProcessorID, trans.ProviderMetadata)
+	if processorID != "" {
+		trans.ProcessorID = processorID
+	}
+
+	tx := db.Begin()
+	if err != nil {
+		if pendingErr, ok := err.(*payments.PaymentPendingError); ok {
+			trans.ProviderMetadata = pendingErr.Metadata()
+			if rsp := tx.Save(trans); rsp.Error != nil {
+				tx.Rollback()
+				release()
+				return internalServerError("Saving payment failed").WithInternalError(rsp.Error)
+			}
+			if err := tx.Commit().Error; err != nil {
+				release()
+				return internalServerError("Saving payment failed").WithInternalError(err)
+			}
+			return sendJSON(w, http.StatusOK, trans)
+		}
+		if reviewErr, ok := err.(*payments.PaymentReviewError); ok {
+			trans.Status = models.PendingApprovalState
+			trans.ProviderMetadata = reviewErr.Metadata()
+			if trans.InvoiceNumber == 0 {
+				trans.InvoiceNumber = order.InvoiceNumber
+			}
+			order.PaymentState = models.PendingApprovalState
+			if err := saveAll(tx, trans, order); err != nil {
+				tx.Rollback()
+				release()
+				return internalServerError("Saving payment failed").WithInternalError(err)
+			}
+			models.LogEvent(tx, r.RemoteAddr, order.UserID, order.ID, models.EventUpdated, []string{"payment_state"})
+			if err := tx.Commit().Error; err != nil {
+				release()
+				return internalServerError("Saving payment failed").WithInternalError(err)
+			}
+			return sendJSON(w, http.StatusOK, trans)
+		}
+		if confirmFail, ok := err.(*payments.PaymentConfirmFailError); ok {
+			trans.FailureCode = strconv.FormatInt(http.StatusBadRequest, 10)
+			trans.FailureDescription = confirmFail.Error()
+			trans.Status = models.FailedState
+			if rsp := tx.Save(trans); rsp.Error != nil {
+				tx.Rollback()
+				release()
+				return internalServerError("Saving payment failed").WithInternalError(rsp.Error)
+			}
+			if err := tx.Commit().Error; err != nil {
+				release()
+				return internalServerError("Saving payment failed").WithInternalError(err)
+			}
+			return badRequestError("Error finalizing payment: %s", confirmFail.Error())
+		}
+		tx.Rollback()
+		release()
+		return internalServerError("Error on provider while trying to finalize: %v. Try again later.", err)
+	}
+
+	claimed, err := claimPayment(tx, trans)
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Error claiming the payment").WithInternalError(err)
+	}
+	if !claimed {
+		// a webhook completed the payment meanwhile
+		tx.Rollback()
+		trans, httpErr := getTransaction(db, trans.ID)
+		if httpErr != nil {
+			return httpErr
+		}
+		return sendJSON(w, http.StatusOK, trans)
+	}
+
+	if trans.InvoiceNumber == 0 {
+		invoiceNumber, err := models.NextInvoiceNumber(tx, order.InstanceID)
+		if err != nil {
+			tx.Rollback()
+			release()
+			return internalServerError("We failed to generate a valid invoice ID, please try again later: %v", err)
+		}
+		trans.InvoiceNumber = invoiceNumber
+	}
+
+	complete, err := paymentComplete(r, tx, trans, order)
+	if err != nil {
+		tx.Rollback()
+		release()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		release()
+		return internalServerError("Saving payment failed").WithInternalError(err)
+	}
+
+	if complete {
+		go sendOrderConfirmation(ctx, a.DB(r), log, trans)
+	}
+
+	return sendJSON(w, http.StatusOK, trans)
+}
+
+// saveAll saves the records within tx, stopping at the first error.
+func saveAll(tx *gorm.DB, records ...interface{}) error {
+	for _, record := range records {
+		if rsp := tx.Save(record); rsp.Error != nil {
+			return rsp.Error
+		}
+	}
+	return nil
+}
+
+// ManualPaymentConfirmParams holds the parameters for confirming a manual payment
+type ManualPaymentConfirmParams struct {
+	Reference string `json:"reference"`
+}
+
+// ManualPaymentConfirm marks the manual payment of an order that is awaiting payment
+// as paid, e.g. once the bank transfer arrived. It is only available to admins.
+func (a *API) ManualPaymentConfirm(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	orderID := gcontext.GetOrderID(ctx)
+
+	params := &ManualPaymentConfirmParams{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+			return badRequestError("Could not read params: %v", err)
+		}
+	}
+
+	tx := a.DB(r).Begin()
+	order, httpErr := queryForOrder(tx, orderID, log)
+	if httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if order.PaymentState != models.PendingPaymentState {
+		tx.Rollback()
+		return badRequestError("Only orders awaiting a manual payment can be confirmed")
+	}
+
+	var trans *models.Transaction
+	for _, t := range order.Transactions {
+		if t.Type == models.ChargeTransactionType && t.Status == models.PendingPaymentState {
+			trans = t
+			break
+		}
+	}
+	if trans == nil {
+		tx.Rollback()
+		return notFoundError("No pending payment found for this order")
+	}
+
+	// claim the payment so concurrent confirmations don't complete it twice
+	rsp := tx.Model(&models.Transaction{}).
+		Where("id = ? AND status = ?", trans.ID, models.PendingPaymentState).
+		UpdateColumn("status", models.PaidState)
+	if rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error claiming the payment").WithInternalError(rsp.Error)
+	}
+	if rsp.RowsAffected == 0 {
+		tx.Rollback()
+		return httpError(http.StatusConflict, "The payment of this order has been confirmed already")
+	}
+
+	if params.Reference != "" {
+		if trans.ProviderMetadata == nil {
+			trans.ProviderMetadata = map[string]interface{}{}
+		}
+		trans.ProviderMetadata["reference"] = params.Reference
+	}
+
+	if trans.InvoiceNumber == 0 {
+		invoiceNumber, err := models.NextInvoiceNumber(tx, order.InstanceID)
+		if err != nil {
+			tx.Rollback()
+			return internalServerError("We failed to generate a valid invoice ID, please try again later: %v", err)
+		}
+		trans.InvoiceNumber = invoiceNumber
+	}
+
+	if _, err := paymentComplete(r, tx, trans, order); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	var subject string
+	if claims := gcontext.GetClaims(ctx); claims != nil {
+		subject = claims.Subject
+	}
+	models.LogEvent(tx, r.RemoteAddr, subject, order.ID, models.EventUpdated, []string{"payment_state"})
+	if err := tx.Commit().Error; err != nil {
+		return internalServerError("Saving payment failed").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusOK, trans)
+}
+
+// ApplePayDomainAssociation serves the Apple Pay domain verification file
+// required to accept Apple Pay through Stripe.
+func (a *API) ApplePayDomainAssociation(w http.ResponseWriter, r *http.Request) error {
+	config := gcontext.GetConfig(r.Context())
+	if !config.Payment.Stripe.Enabled || config.Payment.Stripe.ApplePayDomainAssociation == "" {
+		return notFoundError("Apple Pay is not configured")
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write([]byte(config.Payment.Stripe.ApplePayDomainAssociation))
+	return err
+}
+
 // PaymentList will list all the payments that meet the criteria. It is only available to admins.
 func (a *API) PaymentList(w http.ResponseWriter, r *http.Request) error {
 	log := getLogEntry(r)
@@ -329,7 +1135,7 @@ func (a *API) PaymentList(w http.ResponseWriter, r *http.Request) error {
 // PaymentView returns information about a single payment. It is only available to admins.
 func (a *API) PaymentView(w http.ResponseWriter, r *http.Request) error {
 	payID := chi.URLParam(r, "payment_id")
-	trans, httpErr := getTransaction(a.DB(r), payID)
+	trans, httpErr := getTransaction(a.DB(r).Preload("Refunds").Preload("Disputes"), payID)
 	if httpErr != nil {
 		return httpErr
 	}
@@ -337,7 +1143,8 @@ func (a *API) PaymentView(w http.ResponseWriter, r *http.Request) error {
 }
 
 // PaymentRefund refunds a transaction for a specific amount. This allows partial
-// refunds if desired. It is only available to admins.
+// refunds if desired, as long as the amount does not exceed the remaining
+// refundable balance of the transaction. It is only available to admins.
 func (a *API) PaymentRefund(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	db := a.DB(r)
@@ -354,6 +1161,10 @@ func (a *API) PaymentRefund(w http.ResponseWriter, r *http.Request) error {
 		return httpErr
 	}
 
+	if orderID := gcontext.GetOrderID(ctx); orderID != "" && trans.OrderID != orderID {
+		return notFoundError("Transaction not found")
+	}
+
 	if trans.Currency != params.Currency {
 		return badRequestError("Currencies do not match - %v vs %v", trans.Currency, params.Currency)
 	}
@@ -362,6 +1173,10 @@ func (a *API) PaymentRefund(w http.ResponseWriter, r *http.Request) error {
 		return badRequestError("The balance of the refund must be between 0 and the total amount")
 	}
 
+	if trans.Type == models.RefundTransactionType {
+		return badRequestError("Can't refund a refund transaction")
+	}
+
 	if trans.FailureCode != "" {
 		return badRequestError("Can't refund a failed transaction")
 	}
@@ -370,39 +1185,50 @@ func (a *API) PaymentRefund(w http.ResponseWriter, r *http.Request) error {
 		return badRequestError("Can't refund a transaction that hasn't been paid")
 	}
 
+	if params.Amount > trans.RefundableAmount() {
+		return badRequestError("The refund exceeds the remaining refundable balance of %d", trans.RefundableAmount())
+	}
+
 	log := getLogEntry(r)
 	order, httpErr := queryForOrder(db, trans.OrderID, log)
 	if httpErr != nil {
 		return httpErr
 	}
-	if order.PaymentProcessor == "" {
-		return badRequestError("Order does not specify a payment provider")
+	toCredit := params.ToCredit || trans.Provider == models.StoreCreditProvider
+	if toCredit && order.UserID == "" {
+		return badRequestError("Only orders of registered users can be refunded to store credit")
 	}
-
-	provider := gcontext.GetPaymentProviders(ctx)[order.PaymentProcessor]
-	if provider == nil {
-		return badRequestError("Payment provider '%s' not configured", order.PaymentProcessor)
-	}
-	refund, err := provider.NewRefunder(ctx, r, log.WithField("component", "payment_provider"))
-	if err != nil {
-		return badRequestError("Error creating payment provider: %v", err)
+	var refund payments.Refunder
+	provID := models.StoreCreditProvider
+	if !toCredit {
+		provider, httpErr := transactionProvider(ctx, trans, order)
+		if httpErr != nil {
+			return httpErr
+		}
+		refund, err = provider.NewRefunder(ctx, r, log.WithField("component", "payment_provider"))
+		if err != nil {
+			return badRequestError("Error creating payment provider: %v", err)
+		}
+		provID = provider.Name()
 	}
 
 	// ok make the refund
-	m := &models.Transaction{
-		InstanceID: order.InstanceID,
-		ID:         uuid.NewRandom().String(),
-		Amount:     params.Amount,
-		Currency:   params.Currency,
-		UserID:     trans.UserID,
-		OrderID:    trans.OrderID,
-		Type:       models.RefundTransactionType,
-		Status:     models.PendingState,
-	}
+	m := models.NewRefund(trans, params.Amount)
 
 	tx := db.Begin()
+	reserved, err := reserveRefund(tx, trans, params.Amount)
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Error reserving the refund").WithInternalError(err)
+	}
+	if !reserved {
+		tx.Rollback()
+		return badRequestError("The refund exceeds the remaining refundable balance of %d", trans.RefundableAmount())
+	}
+	if toCredit {
+		refund = creditRefunder(tx, order, m)
+	}
 	tx.Create(m)
-	provID := provider.Name()
 	log.Debugf("Starting refund to %s", provID)
 	refundID, err := refund(trans.ProcessorID, params.Amount, params.Currency)
 	if err != nil {
@@ -410,6 +1236,7 @@ func (a *API) PaymentRefund(w http.ResponseWriter, r *http.Request) error {
 		m.FailureCode = strconv.FormatInt(http.StatusInternalServerError, 10)
 		m.FailureDescription = err.Error()
 		m.Status = models.FailedState
+		releaseRefund(tx, trans, params.Amount)
 	} else {
 		m.ProcessorID = refundID
 		m.Status = models.PaidState
@@ -417,6 +1244,21 @@ func (a *API) PaymentRefund(w http.ResponseWriter, r *http.Request) error {
 
 	log.Infof("Finished transaction with %s: %s", provID, m.ProcessorID)
 	tx.Save(m)
+
+	var subject string
+	if claims := gcontext.GetClaims(ctx); claims != nil {
+		subject = claims.Subject
+	}
+	models.LogEvent(tx, r.RemoteAddr, subject, order.ID, models.EventRefunded, []string{m.ID, m.Status})
+	if m.Status == models.PaidState {
+		if refundComplete(tx, trans, m) {
+			models.LogEvent(tx, r.RemoteAddr, subject, order.ID, models.EventUpdated, []string{"payment_state"})
+		}
+		issueCreditNote(tx, log, m)
+		reverseReferralReward(tx, log, m.OrderID)
+		reportTaxRefund(tx, log, m)
+	}
+
 	if config.Webhooks.Refund != "" {
 		hook, err := models.NewHook("refund", config.SiteURL, config.Webhooks.Refund, m.UserID, config.Webhooks.Secret, m)
 		if err != nil {
@@ -482,6 +1324,48 @@ func (a *API) PreauthorizePayment(w http.ResponseWriter, r *http.Request) error
 // ------------------------------------------------------------------------------------------------
 // Helpers
 // ------------------------------------------------------------------------------------------------
+// transactionProvider returns the payment provider that processed the
+// transaction. Transactions that don't record their provider were processed by
+// the payment processor of the order.
+func transactionProvider(ctx context.Context, trans *models.Transaction, order *models.Order) (payments.Provider, *HTTPError) {
+	name := trans.Provider
+	if name == "" {
+		name = order.PaymentProcessor
+	}
+	if name == "" {
+		return nil, badRequestError("Order does not specify a payment provider")
+	}
+
+	provider := gcontext.GetPaymentProviders(ctx)[name]
+	if provider == nil {
+		return nil, badRequestError("Payment provider '%s' not configured", name)
+	}
+	return provider, nil
+}
+
+// lookupFee sets the fee the payment provider charged for the transaction if
+// the provider reports its fees.
+func lookupFee(ctx context.Context, log logrus.FieldLogger, trans *models.Transaction, order *models.Order) error {
+	provider, httpErr := transactionProvider(ctx, trans, order)
+	if httpErr != nil {
+		return httpErr
+	}
+	reporter, ok := provider.(payments.FeeReportingProvider)
+	if !ok {
+		return nil
+	}
+	lookup, err := reporter.NewFeeLookup(ctx, log.WithField("component", "payment_provider"))
+	if err != nil {
+		return err
+	}
+	fee, err := lookup(trans.ProcessorID)
+	if err != nil {
+		return err
+	}
+	trans.Fee = fee
+	return nil
+}
+
 func getTransaction(db *gorm.DB, payID string) (*models.Transaction, *HTTPError) {
 	trans, err := models.GetTransaction(db, payID)
 	if err != nil {
@@ -493,9 +1377,15 @@ func getTransaction(db *gorm.DB, payID string) (*models.Transaction, *HTTPError)
 	return trans, nil
 }
 
-func (a *API) verifyAmount(ctx context.Context, order *models.Order, amount uint64) error {
-	if order.Total != amount {
-		return fmt.Errorf("Amount calculated for order didn't match amount to charge. %v vs %v", order.Total, amount)
+func (a *API) verifyAmount(ctx context.Context, outstanding uint64, amount uint64, partial bool) error {
+	if partial {
+		if amount == 0 || amount >= outstanding {
+			return fmt.Errorf("Partial payments must be less than the outstanding amount of %v, got %v", outstanding, amount)
+		}
+		return nil
+	}
+	if outstanding != amount {
+		return fmt.Errorf("Amount calculated for order didn't match amount to charge. %v vs %v", outstanding, amount)
 	}
 
 	return nil
@@ -530,24 +1420,65 @@ func queryForTransactions(db *gorm.DB, log logrus.FieldLogger, clause, id string
 }
 
 // createPaymentProviders creates instance(s) of Provider based on the configuration
-// provided.
+// provided. The builtin providers are configured through their dedicated settings,
+// any other registered provider through the generic provider settings.
 func createPaymentProviders(c *conf.Configuration) (map[string]payments.Provider, error) {
 	provs := map[string]payments.Provider{}
+	enabled := map[string]map[string]interface{}{}
 	if c.Payment.Stripe.Enabled {
-		p, err := stripe.NewPaymentProvider(stripe.Config{
-			SecretKey: c.Payment.Stripe.SecretKey,
-		})
-		if err != nil {
-			return nil, err
+		enabled[payments.StripeProvider] = map[string]interface{}{
+			"secret_key": c.Payment.Stripe.SecretKey,
 		}
-		provs[p.Name()] = p
 	}
 	if c.Payment.PayPal.Enabled {
-		p, err := paypal.NewPaymentProvider(paypal.Config{
-			Env:      c.Payment.PayPal.Env,
-			ClientID: c.Payment.PayPal.ClientID,
-			Secret:   c.Payment.PayPal.Secret,
-		})
+		enabled[payments.PayPalProvider] = map[string]interface{}{
+			"env":        c.Payment.PayPal.Env,
+			"client_id":  c.Payment.PayPal.ClientID,
+			"secret":     c.Payment.PayPal.Secret,
+			"webhook_id": c.Payment.PayPal.WebhookID,
+		}
+	}
+	if c.Payment.Adyen.Enabled {
+		enabled[payments.AdyenProvider] = map[string]interface{}{
+			"api_key":          c.Payment.Adyen.APIKey,
+			"merchant_account": c.Payment.Adyen.MerchantAccount,
+			"env":              c.Payment.Adyen.Env,
+			"live_url_prefix":  c.Payment.Adyen.LiveURLPrefix,
+		}
+	}
+	if c.Payment.Manual.Enabled {
+		enabled[payments.ManualProvider] = map[string]interface{}{
+			"instructions": c.Payment.Manual.Instructions,
+		}
+	}
+	if c.Payment.Coinbase.Enabled {
+		enabled[payments.CoinbaseProvider] = map[string]interface{}{
+			"api_key":        c.Payment.Coinbase.APIKey,
+			"webhook_secret": c.Payment.Coinbase.WebhookSecret,
+			"env":            c.Payment.Coinbase.Env,
+		}
+	}
+	if c.Payment.Klarna.Enabled {
+		enabled[payments.KlarnaProvider] = map[string]interface{}{
+			"username":         c.Payment.Klarna.Username,
+			"password":         c.Payment.Klarna.Password,
+			"env":              c.Payment.Klarna.Env,
+			"region":           c.Payment.Klarna.Region,
+			"notification_url": c.Payment.Klarna.NotificationURL,
+		}
+	}
+	for name, pc := range c.Payment.Providers {
+		if !pc.Enabled {
+			continue
+		}
+		if _, exists := enabled[name]; exists {
+			return nil, fmt.Errorf("Payment provider '%s' is configured twice", name)
+		}
+		enabled[name] = pc.Config
+	}
+
+	for name, config := range enabled {
+		p, err := payments.NewProvider(name, config)
 		if err != nil {
 			return nil, err
 		}
@@ -22,6 +22,7 @@ import (
 	"strings"
 
 	paypalsdk "github.com/netlify/PayPal-Go-SDK"
+	"github.com/netlify/gocommerce/calculator"
 	"github.com/netlify/gocommerce/conf"
 	gcontext "github.com/netlify/gocommerce/context"
 	"github.com/netlify/gocommerce/models"
@@ -273,6 +274,61 @@ func TestPaymentsRefund(t *testing.T) {
 		}
 	})
 
+	t.Run("Reserved", func(t *testing.T) {
+		test := NewRouteTest(t)
+		stale := *test.Data.firstTransaction
+		// a concurrent refund booked most of the charge already
+		require.NoError(t, test.DB.Model(test.Data.firstTransaction).UpdateColumn("refunded_amount", 80).Error)
+
+		reserved, err := reserveRefund(test.DB, &stale, 40)
+		require.NoError(t, err)
+		assert.False(t, reserved)
+
+		reserved, err = reserveRefund(test.DB, &stale, 20)
+		require.NoError(t, err)
+		assert.True(t, reserved)
+		assert.EqualValues(t, 100, stale.RefundedAmount)
+		assert.Zero(t, stale.RefundableAmount())
+	})
+
+	t.Run("Partial", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Payment.Providers = map[string]conf.PaymentProviderConfiguration{
+			"mem": {Enabled: true},
+		}
+		test.Data.firstOrder.PaymentProcessor = "mem"
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		url := fmt.Sprintf("/orders/%s/payments/%s/refund", test.Data.firstOrder.ID, test.Data.firstTransaction.ID)
+		for i := 0; i < 2; i++ {
+			w := runPaymentRefund(test, url, &PaymentParams{Amount: 40, Currency: "USD"})
+			rsp := models.Transaction{}
+			extractPayload(t, http.StatusOK, w, &rsp)
+			assert.Equal(t, test.Data.firstTransaction.ID, rsp.ParentID)
+			assert.Equal(t, models.PaidState, rsp.Status)
+		}
+
+		w := runPaymentRefund(test, url, &PaymentParams{Amount: 40, Currency: "USD"})
+		validateError(t, http.StatusBadRequest, w, "remaining refundable balance of 20")
+
+		token := testAdminToken("magical-unicorn", "")
+		w = test.TestEndpoint(http.MethodGet, "/payments/"+test.Data.firstTransaction.ID, nil, token)
+		trans := models.Transaction{}
+		extractPayload(t, http.StatusOK, w, &trans)
+		assert.EqualValues(t, 80, trans.RefundedAmount)
+		assert.Len(t, trans.Refunds, 2)
+
+		var count int
+		require.NoError(t, test.DB.Model(&models.Event{}).Where("order_id = ? AND type = ?", test.Data.firstOrder.ID, models.EventRefunded).Count(&count).Error)
+		assert.Equal(t, 2, count)
+	})
+	t.Run("WrongOrder", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := fmt.Sprintf("/orders/%s/payments/%s/refund", test.Data.secondOrder.ID, test.Data.firstTransaction.ID)
+		w := runPaymentRefund(test, url, &PaymentParams{Amount: 1, Currency: "USD"})
+		validateError(t, http.StatusNotFound, w, "Transaction not found")
+	})
+
 	t.Run("PayPal", func(t *testing.T) {
 		test := NewRouteTest(t)
 		var loginCount, refundCount int
@@ -320,6 +376,43 @@ func TestPaymentsRefund(t *testing.T) {
 	})
 }
 
+func init() {
+	payments.Register("mem", func(config map[string]interface{}) (payments.Provider, error) {
+		return &memProvider{name: "mem"}, nil
+	})
+}
+
+func TestPaymentProviderRegistry(t *testing.T) {
+	t.Run("Enabled", func(t *testing.T) {
+		_, config := testConfig()
+		config.Payment.Providers = map[string]conf.PaymentProviderConfiguration{
+			"mem": {Enabled: true},
+		}
+		provs, err := createPaymentProviders(config)
+		require.NoError(t, err)
+		assert.Len(t, provs, 2)
+		assert.NotNil(t, provs[payments.StripeProvider])
+		assert.NotNil(t, provs["mem"])
+	})
+	t.Run("Disabled", func(t *testing.T) {
+		_, config := testConfig()
+		config.Payment.Providers = map[string]conf.PaymentProviderConfiguration{
+			"mem": {Enabled: false},
+		}
+		provs, err := createPaymentProviders(config)
+		require.NoError(t, err)
+		assert.Len(t, provs, 1)
+	})
+	t.Run("Unknown", func(t *testing.T) {
+		_, config := testConfig()
+		config.Payment.Providers = map[string]conf.PaymentProviderConfiguration{
+			"missing": {Enabled: true},
+		}
+		_, err := createPaymentProviders(config)
+		assert.Error(t, err)
+	})
+}
+
 func runPaymentRefund(test *RouteTest, url string, params interface{}) *httptest.ResponseRecorder {
 	body, err := json.Marshal(params)
 	require.NoError(test.T, err)
@@ -516,6 +609,187 @@ func TestPaymentCreate(t *testing.T) {
 				})
 			}
 		})
+		t.Run("Wallet", func(t *testing.T) {
+			walletToken := "tok_apple_pay"
+			walletPaymentMethod := "payment-method-wallet"
+
+			tests := map[string]struct {
+				WalletType     string
+				ExpectedStatus int
+			}{
+				"ApplePay": {"apple_pay", http.StatusOK},
+				"Mismatch": {"google_pay", http.StatusBadRequest},
+				"Unknown":  {"samsung_pay", http.StatusBadRequest},
+			}
+
+			for name, testParams := range tests {
+				t.Run(name, func(t *testing.T) {
+					test := NewRouteTest(t)
+					stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+						switch path {
+						case "/v1/payment_methods":
+							pmParams := params.(*stripe.PaymentMethodParams)
+							assert.Equal(t, walletToken, *pmParams.Card.Token)
+							pm := v.(*stripe.PaymentMethod)
+							pm.ID = walletPaymentMethod
+							pm.Card = &stripe.PaymentMethodCard{
+								Wallet: &stripe.PaymentMethodCardWallet{Type: stripe.PaymentMethodCardWalletTypeApplePay},
+							}
+							return nil
+						case "/v1/payment_intents":
+							intentParams := params.(*stripe.PaymentIntentParams)
+							assert.Equal(t, walletPaymentMethod, *intentParams.PaymentMethod)
+							intent := v.(*stripe.PaymentIntent)
+							intent.ID = stripePaymentIntentID
+							intent.Status = stripe.PaymentIntentStatusSucceeded
+							return nil
+						default:
+							t.Fatalf("unknown Stripe API call to %s", path)
+							return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+						}
+					}))
+					defer stripe.SetBackend(stripe.APIBackend, nil)
+
+					test.Data.firstOrder.PaymentState = models.PendingState
+					require.NoError(t, test.DB.Save(test.Data.firstOrder).Error, "Failed to update order")
+
+					params := &stripePaymentParams{
+						Amount:            test.Data.firstOrder.Total,
+						Currency:          test.Data.firstOrder.Currency,
+						StripeWalletToken: walletToken,
+						StripeWalletType:  testParams.WalletType,
+						Provider:          payments.StripeProvider,
+					}
+					body, err := json.Marshal(params)
+					require.NoError(t, err)
+
+					recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+					if testParams.ExpectedStatus != http.StatusOK {
+						assert.Equal(t, testParams.ExpectedStatus, recorder.Code)
+						return
+					}
+
+					trans := models.Transaction{}
+					extractPayload(t, http.StatusOK, recorder, &trans)
+					assert.Equal(t, models.PaidState, trans.Status)
+					assert.Equal(t, stripePaymentIntentID, trans.ProcessorID)
+				})
+			}
+		})
+		t.Run("SEPADebit", func(t *testing.T) {
+			test := NewRouteTest(t)
+			stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+				switch path {
+				case "/v1/payment_intents":
+					intentParams := params.(*stripe.PaymentIntentParams)
+					require.Len(t, intentParams.PaymentMethodTypes, 1)
+					assert.Equal(t, "sepa_debit", *intentParams.PaymentMethodTypes[0])
+					require.NotNil(t, intentParams.Extra)
+					assert.Equal(t, "online", intentParams.Extra.Get("mandate_data[customer_acceptance][type]"))
+					intent := v.(*stripe.PaymentIntent)
+					intent.ID = stripePaymentIntentID
+					intent.Status = stripe.PaymentIntentStatusProcessing
+					intent.PaymentMethodTypes = []string{"sepa_debit"}
+					return nil
+				default:
+					t.Fatalf("unknown Stripe API call to %s", path)
+					return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+				}
+			}))
+			defer stripe.SetBackend(stripe.APIBackend, nil)
+
+			test.Data.firstOrder.PaymentState = models.PendingState
+			require.NoError(t, test.DB.Save(test.Data.firstOrder).Error, "Failed to update order")
+
+			params := &stripePaymentParams{
+				Amount:                  test.Data.firstOrder.Total,
+				Currency:                test.Data.firstOrder.Currency,
+				StripePaymentMethodID:   "payment-method-sepa",
+				StripePaymentMethodType: "sepa_debit",
+				Provider:                payments.StripeProvider,
+			}
+			body, err := json.Marshal(params)
+			require.NoError(t, err)
+
+			recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+			trans := models.Transaction{}
+			extractPayload(t, http.StatusOK, recorder, &trans)
+			assert.Equal(t, models.ProcessingState, trans.Status)
+			assert.Equal(t, stripePaymentIntentID, trans.ProcessorID)
+
+			order := &models.Order{}
+			require.NoError(t, test.DB.Find(order, "id = ?", trans.OrderID).Error)
+			assert.Equal(t, models.ProcessingState, order.PaymentState)
+
+			recorder = test.TestEndpoint(http.MethodGet, "/orders/first-order/downloads", nil, test.Data.testUserToken)
+			validateError(t, http.StatusUnauthorized, recorder, "not been completed")
+
+			recorder = test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+			validateError(t, http.StatusBadRequest, recorder, "still processing")
+		})
+	})
+}
+
+func TestAvailablePaymentMethods(t *testing.T) {
+	setup := func(t *testing.T) *RouteTest {
+		test := NewRouteTest(t)
+		test.Config.Payment.Manual.Enabled = true
+		test.Config.Payment.Countries = map[string][]string{
+			"DE": {"stripe", "manual"},
+			"US": {"stripe"},
+		}
+		return test
+	}
+
+	t.Run("ByCountry", func(t *testing.T) {
+		test := setup(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/payment_methods?country=us", nil, nil)
+		pms := &calculator.PaymentMethods{}
+		extractPayload(t, http.StatusOK, recorder, pms)
+		assert.True(t, pms.Stripe.Enabled)
+		assert.False(t, pms.Manual.Enabled)
+	})
+	t.Run("UnrestrictedCountry", func(t *testing.T) {
+		test := setup(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/payment_methods?country=FR", nil, nil)
+		pms := &calculator.PaymentMethods{}
+		extractPayload(t, http.StatusOK, recorder, pms)
+		assert.True(t, pms.Stripe.Enabled)
+		assert.True(t, pms.Manual.Enabled)
+	})
+	t.Run("DisallowedPayment", func(t *testing.T) {
+		test := setup(t)
+		test.Config.Payment.Countries["dcland"] = []string{"stripe"}
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error, "Failed to update order")
+
+		body, err := json.Marshal(map[string]interface{}{
+			"amount":   test.Data.firstOrder.Total,
+			"currency": test.Data.firstOrder.Currency,
+			"provider": payments.ManualProvider,
+		})
+		require.NoError(t, err)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "not available for orders from dcland")
+	})
+}
+
+func TestApplePayDomainAssociation(t *testing.T) {
+	url := "/.well-known/apple-developer-merchantid-domain-association"
+	t.Run("Configured", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Payment.Stripe.Enabled = true
+		test.Config.Payment.Stripe.SecretKey = "secret"
+		test.Config.Payment.Stripe.ApplePayDomainAssociation = "7B227073704964223A2233"
+
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, nil)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "7B227073704964223A2233", recorder.Body.String())
+	})
+	t.Run("NotConfigured", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, nil)
+		validateError(t, http.StatusNotFound, recorder, "Apple Pay is not configured")
 	})
 }
 
@@ -574,6 +848,335 @@ func TestPaymentConfirm(t *testing.T) {
 		})
 	}
 
+	t.Run("ActionRequired", func(t *testing.T) {
+		test := NewRouteTest(t)
+		stripeClientSecret := "payment-intent-secret"
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+			if path == fmt.Sprintf("/v1/payment_intents/%s/confirm", stripePaymentIntentID) {
+				intent := v.(*stripe.PaymentIntent)
+				intent.ID = stripePaymentIntentID
+				intent.Status = stripe.PaymentIntentStatusRequiresAction
+				intent.ClientSecret = stripeClientSecret
+				return nil
+			}
+
+			t.Fatalf("unknown Stripe API call to %s", path)
+			return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error, "Failed to update order")
+		test.Data.firstTransaction.Status = models.PendingState
+		test.Data.firstTransaction.ProcessorID = stripePaymentIntentID
+		require.NoError(t, test.DB.Save(test.Data.firstTransaction).Error, "Failed to update transaction")
+
+		url := fmt.Sprintf("/orders/%s/payments/%s/confirm", test.Data.firstOrder.ID, test.Data.firstTransaction.ID)
+		recorder := test.TestEndpoint(http.MethodPost, url, nil, test.Data.testUserToken)
+
+		trans := models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, &trans)
+		assert.Equal(t, models.PendingState, trans.Status)
+		assert.Equal(t, stripeClientSecret, trans.ProviderMetadata["payment_intent_secret"])
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.Find(order, "id = ?", trans.OrderID).Error)
+		assert.Equal(t, models.PendingState, order.PaymentState)
+	})
+
+	t.Run("WebhookCompletedMeanwhile", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Payment.Stripe.WebhookSecret = testStripeWebhookSecret
+		test.Config.Webhooks.Payment = "https://example.com/payment"
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+			if path == fmt.Sprintf("/v1/payment_intents/%s/confirm", stripePaymentIntentID) {
+				// the webhook completes the payment while the client confirms it
+				recorder := runStripeWebhook(test, "payment_intent.succeeded", `{"id":"`+stripePaymentIntentID+`","object":"payment_intent"}`)
+				require.Equal(t, http.StatusOK, recorder.Code)
+				intent := v.(*stripe.PaymentIntent)
+				intent.ID = stripePaymentIntentID
+				intent.Status = stripe.PaymentIntentStatusSucceeded
+				return nil
+			}
+
+			t.Fatalf("unknown Stripe API call to %s", path)
+			return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error, "Failed to update order")
+		test.Data.firstTransaction.Status = models.PendingState
+		test.Data.firstTransaction.ProcessorID = stripePaymentIntentID
+		require.NoError(t, test.DB.Save(test.Data.firstTransaction).Error, "Failed to update transaction")
+
+		recorder := test.TestEndpoint(http.MethodPost, fmt.Sprintf("/payments/%s/confirm", test.Data.firstTransaction.ID), nil, test.Data.testUserToken)
+		trans := models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, &trans)
+		assert.Equal(t, models.PaidState, trans.Status)
+
+		// the payment is completed once
+		var hooks int
+		require.NoError(t, test.DB.Model(&models.Hook{}).Where("type = ?", "payment").Count(&hooks).Error)
+		assert.Equal(t, 1, hooks)
+	})
+
+	t.Run("WrongOrder", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := fmt.Sprintf("/orders/%s/payments/%s/confirm", test.Data.secondOrder.ID, test.Data.firstTransaction.ID)
+		recorder := test.TestEndpoint(http.MethodPost, url, nil, test.Data.testUserToken)
+		validateError(t, http.StatusNotFound, recorder, "Transaction not found")
+	})
+}
+
+func TestPaymentAdyenCallback(t *testing.T) {
+	test := NewRouteTest(t)
+	test.Data.secondOrder.PaymentState = models.PendingState
+	require.NoError(t, test.DB.Save(test.Data.secondOrder).Error, "Failed to update order")
+
+	pspReference := "8535296650153317"
+	paymentData := "Ab02b4c0!BQABAgCW5sxB4e"
+	var paymentCalls, detailsCalls int
+	var redirect func() *httptest.ResponseRecorder
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "apikey", r.Header.Get("X-API-Key"))
+		payload := map[string]interface{}{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+
+		w.Header().Add("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v52/payments":
+			paymentCalls++
+			assert.Equal(t, "merchant", payload["merchantAccount"])
+			assert.Equal(t, test.Data.secondOrder.ID, payload["reference"])
+			assert.Equal(t, "https://example.com/return", payload["returnUrl"])
+			fmt.Fprint(w, `{"resultCode":"RedirectShopper","paymentData":"`+paymentData+`","action":{"type":"redirect","method":"GET","url":"https://test.adyen.com/hpp/redirect"}}`)
+		case "/v52/payments/details":
+			detailsCalls++
+			assert.Equal(t, paymentData, payload["paymentData"])
+			// a double redirect while the first one is finalized
+			validateError(t, http.StatusConflict, redirect(), "already being finalized")
+			fmt.Fprint(w, `{"resultCode":"Authorised","pspReference":"`+pspReference+`"}`)
+		default:
+			w.WriteHeader(500)
+			t.Fatalf("unknown Adyen API call to %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+	test.Config.Payment.Adyen.Enabled = true
+	test.Config.Payment.Adyen.APIKey = "apikey"
+	test.Config.Payment.Adyen.MerchantAccount = "merchant"
+	test.Config.Payment.Adyen.Env = server.URL
+
+	params := &PaymentParams{
+		Amount:       test.Data.secondOrder.Total,
+		Currency:     test.Data.secondOrder.Currency,
+		ProviderType: payments.AdyenProvider,
+		ProviderMetadata: map[string]interface{}{
+			"payment_method": map[string]interface{}{"type": "ideal", "issuer": "1121"},
+			"return_url":     "https://example.com/return",
+		},
+	}
+	body, err := json.Marshal(params)
+	require.NoError(t, err)
+
+	recorder := test.TestEndpoint(http.MethodPost, "/orders/second-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+	trans := models.Transaction{}
+	extractPayload(t, http.StatusOK, recorder, &trans)
+	assert.Equal(t, models.PendingState, trans.Status)
+	assert.Equal(t, "RedirectShopper", trans.ProviderMetadata["result_code"])
+	assert.NotNil(t, trans.ProviderMetadata["action"])
+
+	callback := map[string]interface{}{
+		"provider_metadata": map[string]interface{}{
+			"details": map[string]interface{}{"payload": "Ab02b4c0!redirect-result"},
+		},
+	}
+	body, err = json.Marshal(callback)
+	require.NoError(t, err)
+
+	url := fmt.Sprintf("/orders/second-order/payments/%s/callback", trans.ID)
+	redirect = func() *httptest.ResponseRecorder {
+		return test.TestEndpoint(http.MethodPost, url, bytes.NewBuffer(body), test.Data.testUserToken)
+	}
+	trans = models.Transaction{}
+	extractPayload(t, http.StatusOK, redirect(), &trans)
+	assert.Equal(t, models.PaidState, trans.Status)
+	assert.Equal(t, pspReference, trans.ProcessorID)
+	assert.Equal(t, 1, paymentCalls)
+	assert.Equal(t, 1, detailsCalls)
+
+	// returning again once the payment is complete doesn't finalize it again
+	assert.Equal(t, http.StatusOK, redirect().Code)
+	assert.Equal(t, 1, detailsCalls)
+
+	order := &models.Order{}
+	require.NoError(t, test.DB.Find(order, "id = ?", trans.OrderID).Error)
+	assert.Equal(t, models.PaidState, order.PaymentState)
+}
+
+// setupKlarna configures the Klarna provider against a fake Klarna API whose
+// orders are placed and reviewed with the fraud status fraudStatus points to.
+func setupKlarna(t *testing.T, test *RouteTest, fraudStatus *string) func() {
+	test.Data.secondOrder.PaymentState = models.PendingState
+	require.NoError(t, test.DB.Save(test.Data.secondOrder).Error, "Failed to update order")
+	require.NoError(t, test.DB.Model(&models.Address{}).Where("id = ?", test.Data.testAddress.ID).Update("country", "US").Error)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ := r.BasicAuth()
+		assert.Equal(t, "merchant", username)
+		assert.Equal(t, "secret", password)
+
+		w.Header().Add("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/payments/v1/sessions":
+			payload := map[string]interface{}{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+			assert.Equal(t, "US", payload["purchase_country"])
+			assert.Equal(t, "USD", payload["purchase_currency"])
+			assert.EqualValues(t, test.Data.secondOrder.Total, payload["order_amount"])
+			assert.Equal(t, test.Data.secondOrder.ID, payload["merchant_reference1"])
+			fmt.Fprint(w, `{"session_id":"klarna-session","client_token":"client-token","payment_method_categories":[{"identifier":"pay_later"}]}`)
+		case "/payments/v1/authorizations/auth-token/order":
+			payload := map[string]interface{}{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+			assert.EqualValues(t, test.Data.secondOrder.Total, payload["order_amount"])
+			assert.Len(t, payload["order_lines"], 2)
+			assert.Equal(t, true, payload["auto_capture"])
+			fmt.Fprintf(w, `{"order_id":"klarna-order","redirect_url":"https://example.com/confirmation","fraud_status":"%s"}`, *fraudStatus)
+		case "/ordermanagement/v1/orders/klarna-order":
+			fmt.Fprintf(w, `{"order_id":"klarna-order","status":"AUTHORIZED","fraud_status":"%s"}`, *fraudStatus)
+		default:
+			w.WriteHeader(500)
+			t.Fatalf("unknown Klarna API call to %s", r.URL.Path)
+		}
+	}))
+	test.Config.Payment.Klarna.Enabled = true
+	test.Config.Payment.Klarna.Username = "merchant"
+	test.Config.Payment.Klarna.Password = "secret"
+	test.Config.Payment.Klarna.Env = server.URL
+	return server.Close
+}
+
+// authorizeKlarnaPayment starts a Klarna payment session for the second order
+// and passes the authorization of the session to the payment callback.
+func authorizeKlarnaPayment(t *testing.T, test *RouteTest) *httptest.ResponseRecorder {
+	params := &PaymentParams{
+		Amount:       test.Data.secondOrder.Total,
+		Currency:     test.Data.secondOrder.Currency,
+		ProviderType: payments.KlarnaProvider,
+	}
+	body, err := json.Marshal(params)
+	require.NoError(t, err)
+
+	recorder := test.TestEndpoint(http.MethodPost, "/orders/second-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+	trans := models.Transaction{}
+	extractPayload(t, http.StatusOK, recorder, &trans)
+	assert.Equal(t, models.PendingState, trans.Status)
+	assert.Equal(t, "klarna-session", trans.ProcessorID)
+	assert.Equal(t, "client-token", trans.ProviderMetadata["client_token"])
+
+	body, err = json.Marshal(map[string]interface{}{
+		"provider_metadata": map[string]interface{}{"authorization_token": "auth-token"},
+	})
+	require.NoError(t, err)
+	url := fmt.Sprintf("/orders/second-order/payments/%s/callback", trans.ID)
+	return test.TestEndpoint(http.MethodPost, url, bytes.NewBuffer(body), test.Data.testUserToken)
+}
+
+func TestPaymentKlarnaCallback(t *testing.T) {
+	t.Run("Accepted", func(t *testing.T) {
+		test := NewRouteTest(t)
+		fraudStatus := "ACCEPTED"
+		defer setupKlarna(t, test, &fraudStatus)()
+
+		trans := models.Transaction{}
+		extractPayload(t, http.StatusOK, authorizeKlarnaPayment(t, test), &trans)
+		assert.Equal(t, models.PaidState, trans.Status)
+		assert.Equal(t, "klarna-order", trans.ProcessorID)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.Find(order, "id = ?", trans.OrderID).Error)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+	})
+	t.Run("PendingApproval", func(t *testing.T) {
+		test := NewRouteTest(t)
+		fraudStatus := "PENDING"
+		defer setupKlarna(t, test, &fraudStatus)()
+
+		trans := models.Transaction{}
+		extractPayload(t, http.StatusOK, authorizeKlarnaPayment(t, test), &trans)
+		assert.Equal(t, models.PendingApprovalState, trans.Status)
+		assert.Equal(t, "klarna-order", trans.ProcessorID)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.Find(order, "id = ?", trans.OrderID).Error)
+		assert.Equal(t, models.PendingApprovalState, order.PaymentState)
+
+		body, err := json.Marshal(&PaymentParams{
+			Amount:       test.Data.secondOrder.Total,
+			Currency:     test.Data.secondOrder.Currency,
+			ProviderType: payments.KlarnaProvider,
+		})
+		require.NoError(t, err)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/second-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "awaiting approval")
+	})
+	t.Run("Rejected", func(t *testing.T) {
+		test := NewRouteTest(t)
+		fraudStatus := "REJECTED"
+		defer setupKlarna(t, test, &fraudStatus)()
+
+		validateError(t, http.StatusBadRequest, authorizeKlarnaPayment(t, test), "rejected")
+
+		trans := &models.Transaction{}
+		require.NoError(t, test.DB.First(trans, "order_id = ? AND provider = ?", test.Data.secondOrder.ID, payments.KlarnaProvider).Error)
+		assert.Equal(t, models.FailedState, trans.Status)
+	})
+}
+
+func TestManualPayment(t *testing.T) {
+	test := NewRouteTest(t)
+	test.Config.Payment.Manual.Enabled = true
+	test.Config.Payment.Manual.Instructions = "IBAN DE89 3704 0044 0532 0130 00"
+	test.Data.firstOrder.PaymentState = models.PendingState
+	require.NoError(t, test.DB.Save(test.Data.firstOrder).Error, "Failed to update order")
+
+	confirmURL := "/orders/" + test.Data.firstOrder.ID + "/payments/confirm"
+	recorder := test.TestEndpoint(http.MethodPut, confirmURL, nil, testAdminToken("magical-unicorn", ""))
+	validateError(t, http.StatusBadRequest, recorder, "awaiting a manual payment")
+
+	body, err := json.Marshal(map[string]interface{}{
+		"amount":         test.Data.firstOrder.Total,
+		"currency":       test.Data.firstOrder.Currency,
+		"provider":       payments.ManualProvider,
+		"payment_method": "bank_transfer",
+	})
+	require.NoError(t, err)
+	recorder = test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+	trans := models.Transaction{}
+	extractPayload(t, http.StatusOK, recorder, &trans)
+	assert.Equal(t, models.PendingPaymentState, trans.Status)
+	assert.Equal(t, test.Config.Payment.Manual.Instructions, trans.ProviderMetadata["instructions"])
+
+	order := &models.Order{}
+	require.NoError(t, test.DB.Find(order, "id = ?", test.Data.firstOrder.ID).Error)
+	assert.Equal(t, models.PendingPaymentState, order.PaymentState)
+
+	recorder = test.TestEndpoint(http.MethodPut, confirmURL, nil, test.Data.testUserToken)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	body, err = json.Marshal(&ManualPaymentConfirmParams{Reference: "wire-1234"})
+	require.NoError(t, err)
+	recorder = test.TestEndpoint(http.MethodPut, confirmURL, bytes.NewBuffer(body), testAdminToken("magical-unicorn", ""))
+	confirmed := models.Transaction{}
+	extractPayload(t, http.StatusOK, recorder, &confirmed)
+	assert.Equal(t, trans.ID, confirmed.ID)
+	assert.Equal(t, models.PaidState, confirmed.Status)
+	assert.Equal(t, "wire-1234", confirmed.ProviderMetadata["reference"])
+
+	require.NoError(t, test.DB.Find(order, "id = ?", test.Data.firstOrder.ID).Error)
+	assert.Equal(t, models.PaidState, order.PaymentState)
 }
 
 func TestPaymentPreauthorize(t *testing.T) {
@@ -722,11 +1325,14 @@ func validateAllTransactions(t *testing.T, testData *TestData, trans []models.Tr
 }
 
 type stripePaymentParams struct {
-	Amount                uint64 `json:"amount"`
-	Currency              string `json:"currency"`
-	StripeToken           string `json:"stripe_token"`
-	StripePaymentMethodID string `json:"stripe_payment_method_id"`
-	Provider              string `json:"provider"`
+	Amount                  uint64 `json:"amount"`
+	Currency                string `json:"currency"`
+	StripeToken             string `json:"stripe_token"`
+	StripePaymentMethodID   string `json:"stripe_payment_method_id"`
+	StripeWalletToken       string `json:"stripe_wallet_token,omitempty"`
+	StripeWalletType        string `json:"stripe_wallet_type,omitempty"`
+	StripePaymentMethodType string `json:"stripe_payment_method_type,omitempty"`
+	Provider                string `json:"provider"`
 }
 
 type paypalPaymentParams struct {
@@ -831,7 +1437,93 @@ func (t trackingStripeBackend) CallMultipart(method, path, key, boundary string,
 }
 
 func (t trackingStripeBackend) CallRaw(method, path, key string, body *form.Values, params *stripe.Params, v interface{}) error {
-	return nil
+	return t.trackingFunc(method, path, key, params, v)
 }
 
 func (t trackingStripeBackend) SetMaxNetworkRetries(maxNetworkRetries int) {}
+
+// giftCardProvider is a payment provider charging an imaginary gift card balance.
+type giftCardProvider struct {
+	memProvider
+}
+
+func (gp *giftCardProvider) NewCharger(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Charger, error) {
+	return func(amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
+		return "gift-card-charge", nil
+	}, nil
+}
+
+func init() {
+	payments.Register("giftcard", func(config map[string]interface{}) (payments.Provider, error) {
+		return &giftCardProvider{memProvider{name: "giftcard"}}, nil
+	})
+}
+
+func TestPaymentCreateSplitTender(t *testing.T) {
+	test := NewRouteTest(t)
+	test.Config.Payment.Providers = map[string]conf.PaymentProviderConfiguration{
+		"giftcard": {Enabled: true},
+	}
+	stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+		switch path {
+		case "/v1/payment_intents":
+			assert.EqualValues(t, 14, *params.(*stripe.PaymentIntentParams).Amount)
+			intent := v.(*stripe.PaymentIntent)
+			intent.ID = stripePaymentIntentID
+			intent.Status = stripe.PaymentIntentStatusSucceeded
+			return nil
+		case "/v1/refunds":
+			v.(*stripe.Refund).ID = "stripe-refund"
+			return nil
+		default:
+			t.Fatalf("unknown Stripe API call to %s", path)
+			return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+		}
+	}))
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	test.Data.firstTransaction.Status = models.FailedState
+	require.NoError(t, test.DB.Save(test.Data.firstTransaction).Error)
+	require.NoError(t, test.DB.Model(&models.Order{}).Where("id = ?", test.Data.firstOrder.ID).Update("payment_state", models.PendingState).Error)
+
+	pay := func(params map[string]interface{}) *httptest.ResponseRecorder {
+		params["currency"] = test.Data.firstOrder.Currency
+		body, err := json.Marshal(params)
+		require.NoError(t, err)
+		return test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+	}
+	paymentState := func() string {
+		order := &models.Order{}
+		require.NoError(t, test.DB.Find(order, "id = ?", test.Data.firstOrder.ID).Error)
+		return order.PaymentState
+	}
+
+	recorder := pay(map[string]interface{}{"amount": 24, "provider": "giftcard", "partial": true})
+	validateError(t, http.StatusInternalServerError, recorder, "less than the outstanding amount")
+
+	recorder = pay(map[string]interface{}{"amount": 10, "provider": "giftcard", "partial": true})
+	giftCard := models.Transaction{}
+	extractPayload(t, http.StatusOK, recorder, &giftCard)
+	assert.Equal(t, models.PaidState, giftCard.Status)
+	assert.Equal(t, "giftcard", giftCard.Provider)
+	assert.EqualValues(t, 10, giftCard.Amount)
+	assert.Equal(t, models.PartiallyPaidState, paymentState())
+
+	recorder = pay(map[string]interface{}{"amount": 24, "provider": payments.StripeProvider, "stripe_payment_method_id": "payment-method-simple"})
+	validateError(t, http.StatusInternalServerError, recorder, "didn't match amount to charge. 14 vs 24")
+
+	recorder = pay(map[string]interface{}{"amount": 14, "provider": payments.StripeProvider, "stripe_payment_method_id": "payment-method-simple"})
+	card := models.Transaction{}
+	extractPayload(t, http.StatusOK, recorder, &card)
+	assert.Equal(t, payments.StripeProvider, card.Provider)
+	assert.EqualValues(t, 14, card.Amount)
+	assert.Equal(t, models.PaidState, paymentState())
+
+	recorder = runPaymentRefund(test, "/payments/"+card.ID+"/refund", &PaymentParams{Amount: 14, Currency: "USD"})
+	extractPayload(t, http.StatusOK, recorder, &models.Transaction{})
+	assert.Equal(t, models.PaidState, paymentState())
+
+	recorder = runPaymentRefund(test, "/payments/"+giftCard.ID+"/refund", &PaymentParams{Amount: 10, Currency: "USD"})
+	extractPayload(t, http.StatusOK, recorder, &models.Transaction{})
+	assert.Equal(t, models.RefundedState, paymentState())
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"context"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+	"github.com/sirupsen/logrus"
+
+	"github.com/netlify/gocommerce/calculator"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// pickupAddress returns the address of the pickup location of the settings
+// with the ID, stored as the shipping address of a new order collected there.
+func pickupAddress(tx *gorm.DB, settings *calculator.Settings, order *models.Order, id string) (*models.Address, *HTTPError) {
+	location := calculator.FindPickupLocation(settings, id)
+	if location == nil {
+		return nil, badRequestError("Unknown pickup location %v", id)
+	}
+	address := &models.Address{
+		AddressRequest: models.AddressRequest{
+			Name:     location.Name,
+			Address1: location.Address1,
+			Address2: location.Address2,
+			City:     location.City,
+			Country:  location.Country,
+			State:    location.State,
+			Zip:      location.Zip,
+		},
+		ID:     uuid.NewRandom().String(),
+		UserID: order.UserID,
+	}
+	if rsp := tx.Create(address); rsp.Error != nil {
+		return nil, internalServerError("Error saving pickup address").WithInternalError(rsp.Error)
+	}
+	return address, nil
+}
+
+// notifyReadyForPickup emails the customer of an order that has been made
+// ready for pickup.
+func notifyReadyForPickup(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, order *models.Order) {
+	if !notificationAllowed(db, log, order.InstanceID, order.UserID, order.Email, models.ShipmentUpdatesNotification) {
+		return
+	}
+	if order.ShippingAddress.ID == "" && order.ShippingAddressID != "" {
+		db.First(&order.ShippingAddress, "id = ?", order.ShippingAddressID)
+	}
+	if err := gcontext.GetMailer(ctx).ReadyForPickupMail(order); err != nil {
+		log.WithError(err).WithField("order_id", order.ID).Error("Error sending ready for pickup mail")
+		return
+	}
+	models.LogEvent(db, "", "", order.ID, models.EventEmailed, []string{"ready_for_pickup"})
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestPickupLocations(t *testing.T) {
+	server := startTestSiteWithSettings(&calculator.Settings{
+		PickupLocations: []*calculator.PickupLocation{{
+			ID: "soho", Name: "SoHo Store", Address1: "120 Prince St",
+			City: "New York", State: "NY", Country: "USA", Zip: "10012",
+		}},
+	})
+	defer server.Close()
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	createOrder := func(test *RouteTest, location string) *httptest.ResponseRecorder {
+		body := `{
+			"email": "info@example.com",
+			"pickup_location": "` + location + `",
+			"line_items": [{"path": "/simple-product", "quantity": 1}]
+		}`
+		return test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(body), test.Data.testUserToken)
+	}
+	setState := func(test *RouteTest, order *models.Order, state string) *httptest.ResponseRecorder {
+		body := strings.NewReader(`{"fulfillment_state": "` + state + `"}`)
+		return test.TestEndpoint(http.MethodPut, "/orders/"+order.ID, body, token)
+	}
+
+	t.Run("Collected", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, createOrder(test, "soho"), order)
+		assert.Equal(t, "soho", order.PickupLocation)
+		assert.Equal(t, "SoHo Store", order.ShippingAddress.Name)
+		assert.Equal(t, "120 Prince St", order.ShippingAddress.Address1)
+		assert.EqualValues(t, 0, order.Shipping)
+
+		validateError(t, http.StatusBadRequest, setState(test, order, models.ShippedState), "doesn't apply")
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/"+order.ID+"/shipments", strings.NewReader(`{}`), token)
+		validateError(t, http.StatusBadRequest, recorder, "pickup location")
+
+		extractPayload(t, http.StatusOK, setState(test, order, models.ReadyForPickupState), order)
+		assert.Equal(t, models.ReadyForPickupState, order.FulfillmentState)
+		email := &models.Event{}
+		require.NoError(t, test.DB.Where("order_id = ? AND type = ?", order.ID, models.EventEmailed).First(email).Error)
+		assert.Equal(t, "ready_for_pickup", email.Changes)
+
+		extractPayload(t, http.StatusOK, setState(test, order, models.PickedUpState), order)
+		assert.Equal(t, models.PickedUpState, order.FulfillmentState)
+	})
+	t.Run("UnknownLocation", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		validateError(t, http.StatusBadRequest, createOrder(test, "brooklyn"), "Unknown pickup location")
+	})
+	t.Run("ShippedOrder", func(t *testing.T) {
+		test := NewRouteTest(t)
+		validateError(t, http.StatusBadRequest, setState(test, test.Data.firstOrder, models.ReadyForPickupState), "doesn't apply")
+	})
+}
@@ -0,0 +1,207 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
+)
+
+const (
+	memoryRateLimitStore = "memory"
+	redisRateLimitStore  = "redis"
+
+	rateLimitedReason = "rate_limited"
+)
+
+// The groups of routes the rate limits of an instance apply to.
+const (
+	ordersRateLimit    = "orders"
+	couponsRateLimit   = "coupons"
+	downloadsRateLimit = "downloads"
+)
+
+// rateLimitStore counts the requests towards the rate limits.
+type rateLimitStore interface {
+	// Increment counts a request with the key and returns the number of
+	// requests counted in the current window, which starts with the first
+	// request and lasts for the window, and when it ends.
+	Increment(key string, window time.Duration) (uint64, time.Time, error)
+}
+
+// memoryRateLimits counts the requests of the API when the rate limits aren't
+// shared with other servers.
+var memoryRateLimits = newMemoryRateLimiter()
+
+// memoryRateLimiter counts the requests of the windows in memory. Windows
+// that ended are pruned at most once a minute.
+type memoryRateLimiter struct {
+	sync.Mutex
+	windows map[string]*rateLimitWindow
+	pruned  time.Time
+}
+
+type rateLimitWindow struct {
+	count uint64
+	reset time.Time
+}
+
+func newMemoryRateLimiter() *memoryRateLimiter {
+	return &memoryRateLimiter{windows: map[string]*rateLimitWindow{}}
+}
+
+func (s *memoryRateLimiter) Increment(key string, window time.Duration) (uint64, time.Time, error) {
+	now := time.Now()
+	s.Lock()
+	defer s.Unlock()
+
+	if now.Sub(s.pruned) > time.Minute {
+		for k, w := range s.windows {
+			if !now.Before(w.reset) {
+				delete(s.windows, k)
+			}
+		}
+		s.pruned = now
+	}
+
+	w, ok := s.windows[key]
+	if !ok || !now.Before(w.reset) {
+		w = &rateLimitWindow{reset: now.Add(window)}
+		s.windows[key] = w
+	}
+	w.count++
+	return w.count, w.reset, nil
+}
+
+// newRateLimitStore returns the store of the rate limits. It falls back to
+// counting the requests in memory if the store can't be set up.
+func newRateLimitStore(config *conf.GlobalConfiguration, log logrus.FieldLogger) rateLimitStore {
+	switch config.RateLimit.Store {
+	case "", memoryRateLimitStore:
+		return memoryRateLimits
+	case redisRateLimitStore:
+		store, err := newRedisRateLimiter(config.RateLimit.RedisURL)
+		if err == nil {
+			return store
+		}
+		log.WithError(err).Error("Error setting up the redis rate limit store, falling back to memory")
+	default:
+		log.Errorf("Unknown rate limit store %s, falling back to memory", config.RateLimit.Store)
+	}
+	return memoryRateLimits
+}
+
+// rateLimitConfig returns the rate limits of the group of routes.
+func rateLimitConfig(config *conf.Configuration, group string) conf.RateLimitConfiguration {
+	switch group {
+	case ordersRateLimit:
+		return config.RateLimits.Orders
+	case couponsRateLimit:
+		return config.RateLimits.Coupons
+	case downloadsRateLimit:
+		return config.RateLimits.Downloads
+	}
+	return conf.RateLimitConfiguration{}
+}
+
+// rateLimitClient returns who the request counts towards and their limit:
+// the API key or the user of the claims, or the IP address of unauthenticated
+// requests.
+func rateLimitClient(r *http.Request, config *conf.GlobalConfiguration, limits conf.RateLimitConfiguration) (string, uint64) {
+	if claims := gcontext.GetClaims(r.Context()); claims != nil && claims.Subject != "" {
+		if strings.HasPrefix(claims.Subject, apiKeySubjectPrefix) {
+			return claims.Subject, limits.APIKey
+		}
+		return "user:" + claims.Subject, limits.User
+	}
+	return "ip:" + clientIP(r, config), limits.IP
+}
+
+// clientIP returns the IP address of the client of the request. With a
+// client IP header, it's the last address of the header that isn't one of the
+// trusted proxies, since each proxy appends the address it got the request
+// from and only the addresses the trusted proxies added can be relied on.
+// Without one, or if the header has no such address, it's the address of the
+// peer.
+func clientIP(r *http.Request, config *conf.GlobalConfiguration) string {
+	if name := config.RateLimit.ClientIPHeader; name != "" {
+		values := strings.Split(strings.Join(r.Header[http.CanonicalHeaderKey(name)], ","), ",")
+		for i := len(values) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(values[i]))
+			if ip != nil && !trustedProxy(ip, config.RateLimit.TrustedProxies) {
+				return ip.String()
+			}
+		}
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return ip
+}
+
+// trustedProxy reports whether the IP address is one of the proxies, which
+// are addresses or CIDR ranges.
+func trustedProxy(ip net.IP, proxies []string) bool {
+	for _, proxy := range proxies {
+		if strings.Contains(proxy, "/") {
+			if _, network, err := net.ParseCIDR(proxy); err == nil && network.Contains(ip) {
+				return true
+			}
+		} else if ip.Equal(net.ParseIP(proxy)) {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimited limits the requests to the group of routes to the rate limits
+// of the instance. Responses report the limit and the requests remaining in
+// the current window, and requests over the limit are rejected with a 429
+// and the seconds until the window ends in the Retry-After header. Requests
+// are let through if the store fails.
+func (a *API) rateLimited(group string) middlewareHandler {
+	return func(w http.ResponseWriter, r *http.Request) (context.Context, error) {
+		ctx := r.Context()
+		limits := rateLimitConfig(gcontext.GetConfig(ctx), group)
+		client, limit := rateLimitClient(r, a.config, limits)
+		if limit == 0 {
+			return ctx, nil
+		}
+
+		key := fmt.Sprintf("%s:%s:%s", gcontext.GetInstanceID(ctx), group, client)
+		count, reset, err := a.rateLimits.Increment(key, limits.WindowDuration())
+		if err != nil {
+			getLogEntry(r).WithError(err).Error("Error counting the request towards the rate limit")
+			return ctx, nil
+		}
+
+		remaining := uint64(0)
+		if count < limit {
+			remaining = limit - count
+		}
+		w.Header().Set("X-RateLimit-Limit", strconv.FormatUint(limit, 10))
+		w.Header().Set("X-RateLimit-Remaining", strconv.FormatUint(remaining, 10))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+		if count <= limit {
+			return ctx, nil
+		}
+
+		retryAfter := int64((time.Until(reset) + time.Second - 1) / time.Second)
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+		logEntrySetField(r, "rate_limit_client", client)
+		return nil, httpError(http.StatusTooManyRequests, "Rate limit exceeded, retry in %d seconds", retryAfter).WithReason(rateLimitedReason)
+	}
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+const (
+	redisTimeout      = 1 * time.Second
+	redisMaxIdleConns = 10
+	redisIdleTimeout  = 5 * time.Minute
+	redisKeyPrefix    = "gocommerce:ratelimit:"
+)
+
+// redisIncrementScript counts a request and starts the window with the
+// first one, atomically so concurrent servers share the window.
+const redisIncrementScript = `local count = redis.call("INCR", KEYS[1])
+if count == 1 then redis.call("PEXPIRE", KEYS[1], ARGV[1]) end
+return {count, redis.call("PTTL", KEYS[1])}`
+
+// redisRateLimiter counts the requests of the windows in redis, so the rate
+// limits are shared by all the servers using it.
+type redisRateLimiter struct {
+	pool *redis.Pool
+}
+
+// newRedisRateLimiter returns a rate limit store for the redis URL, like
+// redis://:password@localhost:6379/0, or rediss:// for TLS.
+func newRedisRateLimiter(rawURL string) (*redisRateLimiter, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse the redis URL")
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("Unsupported redis URL scheme %q", u.Scheme)
+	}
+
+	return &redisRateLimiter{pool: &redis.Pool{
+		MaxIdle:     redisMaxIdleConns,
+		IdleTimeout: redisIdleTimeout,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(rawURL,
+				redis.DialConnectTimeout(redisTimeout),
+				redis.DialReadTimeout(redisTimeout),
+				redis.DialWriteTimeout(redisTimeout),
+			)
+		},
+	}}, nil
+}
+
+// Increment counts the request in redis.
+func (s *redisRateLimiter) Increment(key string, window time.Duration) (uint64, time.Time, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	windowMs := int64(window / time.Millisecond)
+	values, err := redis.Int64s(conn.Do("EVAL", redisIncrementScript, 1, redisKeyPrefix+key, windowMs))
+	if err != nil {
+		return 0, time.Time{}, errors.Wrap(err, "Failed to count the request in redis")
+	}
+	if len(values) != 2 || values[0] < 1 {
+		return 0, time.Time{}, fmt.Errorf("Unexpected redis reply %v", values)
+	}
+	ttl := values[1]
+	if ttl < 0 {
+		ttl = windowMs
+	}
+	return uint64(values[0]), time.Now().Add(time.Duration(ttl) * time.Millisecond), nil
+}
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/conf"
+)
+
+// testRedis answers the commands of the redis rate limit store, counting
+// the requests of each key.
+type testRedis struct {
+	sync.Mutex
+	listener net.Listener
+	commands []string
+	counts   map[string]int
+}
+
+func startTestRedis(t *testing.T) *testRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &testRedis{listener: listener, counts: map[string]int{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+		for i := range args {
+			line, _ = reader.ReadString('\n')
+			size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			data := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, data); err != nil {
+				return
+			}
+			args[i] = string(data[:size])
+		}
+
+		s.Lock()
+		s.commands = append(s.commands, args[0])
+		switch args[0] {
+		case "AUTH", "SELECT":
+			fmt.Fprint(conn, "+OK\r\n")
+		case "EVAL":
+			s.counts[args[3]]++
+			fmt.Fprintf(conn, "*2\r\n:%d\r\n:%s\r\n", s.counts[args[3]], args[4])
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+		s.Unlock()
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	t.Run("IP", func(t *testing.T) {
+		memoryRateLimits = newMemoryRateLimiter()
+		test := NewRouteTest(t)
+		test.Config.RateLimits.Coupons = conf.RateLimitConfiguration{IP: 2, Window: 30}
+
+		recorder := test.TestEndpoint(http.MethodGet, "/coupons/coupon-code", nil, nil)
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+		assert.Equal(t, "2", recorder.Header().Get("X-RateLimit-Limit"))
+		assert.Equal(t, "1", recorder.Header().Get("X-RateLimit-Remaining"))
+		assert.Equal(t, http.StatusNotFound, test.TestEndpoint(http.MethodGet, "/coupons/coupon-code", nil, nil).Code)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/coupons/coupon-code", nil, nil)
+		validateError(t, http.StatusTooManyRequests, recorder, "Rate limit exceeded, retry in 30 seconds")
+		assert.Equal(t, "30", recorder.Header().Get("Retry-After"))
+		assert.Equal(t, "0", recorder.Header().Get("X-RateLimit-Remaining"))
+
+		recorder = test.TestEndpoint(http.MethodGet, "/coupons/coupon-code", nil, test.Data.testUserToken)
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+		assert.Empty(t, recorder.Header().Get("X-RateLimit-Limit"))
+		assert.Empty(t, test.TestEndpoint(http.MethodGet, "/orders/"+test.Data.firstOrder.ID, nil, nil).Header().Get("Retry-After"))
+	})
+	t.Run("User", func(t *testing.T) {
+		memoryRateLimits = newMemoryRateLimiter()
+		test := NewRouteTest(t)
+		test.Config.RateLimits.Orders = conf.RateLimitConfiguration{User: 1}
+
+		body := `{"email": "info@example.com", "line_items": [{"path": "/simple-product", "quantity": 1}]}`
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(body), test.Data.testUserToken)
+		assert.NotEqual(t, http.StatusTooManyRequests, recorder.Code)
+		recorder = test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(body), test.Data.testUserToken)
+		validateError(t, http.StatusTooManyRequests, recorder, "Rate limit exceeded, retry in 60 seconds")
+
+		token := testToken("another-user", "another@wayneindustries.com")
+		recorder = test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(body), token)
+		assert.NotEqual(t, http.StatusTooManyRequests, recorder.Code)
+	})
+	t.Run("ClientIPHeader", func(t *testing.T) {
+		memoryRateLimits = newMemoryRateLimiter()
+		test := NewRouteTest(t)
+		test.GlobalConfig.RateLimit.ClientIPHeader = "X-Forwarded-For"
+		test.GlobalConfig.RateLimit.TrustedProxies = []string{"10.0.0.0/8", "198.51.100.1"}
+		test.Config.RateLimits.Coupons = conf.RateLimitConfiguration{IP: 1, Window: 30}
+
+		request := func(forwardedFor string) *httptest.ResponseRecorder {
+			headers := map[string]string{"X-Forwarded-For": forwardedFor}
+			return test.TestEndpointWithHeaders(http.MethodGet, "/coupons/coupon-code", nil, nil, headers)
+		}
+		assert.Equal(t, http.StatusNotFound, request("203.0.113.7, 10.0.0.2").Code)
+		assert.Equal(t, http.StatusTooManyRequests, request("203.0.113.7, 198.51.100.1, 10.0.0.3").Code)
+		assert.Equal(t, http.StatusTooManyRequests, request("203.0.113.9, 203.0.113.7, 10.0.0.2").Code)
+		assert.Equal(t, http.StatusNotFound, request("203.0.113.8, 10.0.0.2").Code)
+		assert.Equal(t, http.StatusNotFound, request("10.0.0.2").Code)
+		assert.Equal(t, http.StatusTooManyRequests, test.TestEndpoint(http.MethodGet, "/coupons/coupon-code", nil, nil).Code)
+	})
+	t.Run("Redis", func(t *testing.T) {
+		redis := startTestRedis(t)
+		defer redis.listener.Close()
+		test := NewRouteTest(t)
+		test.GlobalConfig.RateLimit.Store = "redis"
+		test.GlobalConfig.RateLimit.RedisURL = "redis://:secret@" + redis.listener.Addr().String() + "/2"
+		test.Config.RateLimits.Downloads = conf.RateLimitConfiguration{IP: 1, Window: 10}
+
+		assert.NotEqual(t, http.StatusTooManyRequests, test.TestEndpoint(http.MethodGet, "/downloads/unknown", nil, nil).Code)
+		recorder := test.TestEndpoint(http.MethodGet, "/downloads/unknown", nil, nil)
+		validateError(t, http.StatusTooManyRequests, recorder, "Rate limit exceeded, retry in 10 seconds")
+		assert.Equal(t, "10", recorder.Header().Get("Retry-After"))
+
+		redis.Lock()
+		defer redis.Unlock()
+		assert.Equal(t, map[string]int{"gocommerce:ratelimit::downloads:ip:192.0.2.1": 2}, redis.counts)
+		assert.Equal(t, []string{"AUTH", "SELECT", "EVAL", "AUTH", "SELECT", "EVAL"}, redis.commands)
+	})
+}
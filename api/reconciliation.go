@@ -0,0 +1,197 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+const (
+	defaultReconciliationPeriod = 30 * 24 * time.Hour
+	reconciliationBatchSize     = 500
+)
+
+// kinds of discrepancies flagged by the payment reconciliation report
+const (
+	mismatchMissingTransaction = "missing_transaction"
+	mismatchMissingCharge      = "missing_charge"
+	mismatchStatus             = "status"
+	mismatchAmount             = "amount"
+)
+
+type reconciliationRow struct {
+	Provider    string `json:"provider"`
+	ProcessorID string `json:"processor_id"`
+	Currency    string `json:"currency"`
+
+	GatewayAmount   uint64     `json:"gateway_amount"`
+	GatewayRefunded uint64     `json:"gateway_refunded"`
+	GatewayFee      uint64     `json:"gateway_fee"`
+	GatewayStatus   string     `json:"gateway_status,omitempty"`
+	GatewayTime     *time.Time `json:"gateway_created_at,omitempty"`
+
+	TransactionID string `json:"transaction_id,omitempty"`
+	OrderID       string `json:"order_id,omitempty"`
+	Amount        uint64 `json:"amount"`
+	Status        string `json:"status,omitempty"`
+
+	Mismatches []string `json:"mismatches,omitempty"`
+}
+
+type reconciliationReport struct {
+	From        time.Time            `json:"from"`
+	To          time.Time            `json:"to"`
+	Rows        []*reconciliationRow `json:"rows"`
+	Mismatches  int                  `json:"mismatches"`
+	Unsupported []string             `json:"unsupported_providers,omitempty"`
+}
+
+// PaymentReconciliationReport lists the charges recorded by the payment
+// providers within a period next to the transactions stored for them and flags
+// the charges whose state or amount don't match.
+func (a *API) PaymentReconciliationReport(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	// the providers only know the charges made with the keys of the current mode
+	db := a.DB(r).Where("instance_id = ? AND test = ?", gcontext.GetInstanceID(ctx), gcontext.GetConfig(ctx).Payment.Sandbox)
+
+	from, to, err := getTimeQueryParams(r.URL.Query())
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	report := &reconciliationReport{To: time.Now(), Rows: []*reconciliationRow{}}
+	if to != nil {
+		report.To = *to
+	}
+	report.From = report.To.Add(-defaultReconciliationPeriod)
+	if from != nil {
+		report.From = *from
+	}
+
+	providers := gcontext.GetPaymentProviders(ctx)
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		reconciler, ok := providers[name].(payments.ReconcilingProvider)
+		if !ok {
+			report.Unsupported = append(report.Unsupported, name)
+			continue
+		}
+		list, err := reconciler.NewChargeLister(ctx, log.WithField("component", "payment_provider"))
+		if err != nil {
+			return internalServerError("Error creating payment provider").WithInternalError(err)
+		}
+		charges, err := list(report.From, report.To)
+		if err != nil {
+			return internalServerError("Error listing charges of payment provider '%s'", name).WithInternalError(err)
+		}
+
+		rows, err := reconcileCharges(db, name, charges, report.From, report.To)
+		if err != nil {
+			return internalServerError("Error while querying for transactions").WithInternalError(err)
+		}
+		report.Rows = append(report.Rows, rows...)
+	}
+
+	for _, row := range report.Rows {
+		if len(row.Mismatches) > 0 {
+			report.Mismatches++
+		}
+	}
+	return sendJSON(w, http.StatusOK, report)
+}
+
+// reconcileCharges matches the charges of a provider with the local charge
+// transactions by their processor ID. Paid transactions within the period the
+// provider doesn't know about are flagged as well.
+func reconcileCharges(db *gorm.DB, provider string, charges []*payments.GatewayCharge, from, to time.Time) ([]*reconciliationRow, error) {
+	transactions := map[string]*models.Transaction{}
+	for start := 0; start < len(charges); start += reconciliationBatchSize {
+		end := start + reconciliationBatchSize
+		if end > len(charges) {
+			end = len(charges)
+		}
+		ids := make([]string, 0, end-start)
+		for _, charge := range charges[start:end] {
+			ids = append(ids, charge.ID)
+		}
+
+		found := []*models.Transaction{}
+		if rsp := db.Where("type = ? AND processor_id IN (?)", models.ChargeTransactionType, ids).Find(&found); rsp.Error != nil {
+			return nil, rsp.Error
+		}
+		for _, tr := range found {
+			transactions[tr.ProcessorID] = tr
+		}
+	}
+
+	rows := []*reconciliationRow{}
+	for _, charge := range charges {
+		created := charge.CreatedAt
+		row := &reconciliationRow{
+			Provider:        provider,
+			ProcessorID:     charge.ID,
+			Currency:        charge.Currency,
+			GatewayAmount:   charge.Amount,
+			GatewayRefunded: charge.Refunded,
+			GatewayFee:      charge.Fee,
+			GatewayStatus:   charge.Status,
+			GatewayTime:     &created,
+		}
+		tr, ok := transactions[charge.ID]
+		if !ok {
+			if charge.Status == models.PaidState {
+				row.Mismatches = append(row.Mismatches, mismatchMissingTransaction)
+			}
+			rows = append(rows, row)
+			continue
+		}
+		row.TransactionID = tr.ID
+		row.OrderID = tr.OrderID
+		row.Amount = tr.Amount
+		row.Status = tr.Status
+		if tr.Status != charge.Status {
+			row.Mismatches = append(row.Mismatches, mismatchStatus)
+		}
+		if tr.Amount != charge.Amount {
+			row.Mismatches = append(row.Mismatches, mismatchAmount)
+		}
+		rows = append(rows, row)
+	}
+
+	paid := []*models.Transaction{}
+	rsp := db.
+		Where("type = ? AND provider = ? AND status = ?", models.ChargeTransactionType, provider, models.PaidState).
+		Where("created_at >= ? AND created_at <= ?", from, to).
+		Order("created_at asc").
+		Find(&paid)
+	if rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	for _, tr := range paid {
+		if _, ok := transactions[tr.ProcessorID]; ok {
+			continue
+		}
+		rows = append(rows, &reconciliationRow{
+			Provider:      provider,
+			ProcessorID:   tr.ProcessorID,
+			Currency:      tr.Currency,
+			TransactionID: tr.ID,
+			OrderID:       tr.OrderID,
+			Amount:        tr.Amount,
+			Status:        tr.Status,
+			Mismatches:    []string{mismatchMissingCharge},
+		})
+	}
+	return rows, nil
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// AbandonedOrderList lists the pending orders that have been abandoned by their
+// customers. It takes the same filters as the order list and is only
+// available to admins.
+func (a *API) AbandonedOrderList(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	instanceID := gcontext.GetInstanceID(ctx)
+
+	query, err := parseOrderParams(orderQuery(a.DB(r)), r.URL.Query())
+	if err != nil {
+		return badRequestError("Bad parameters in query: %v", err)
+	}
+	orderTable := query.NewScope(models.Order{}).QuotedTableName()
+	query = query.Where(orderTable+".instance_id = ? AND "+orderTable+".payment_state = ? AND "+orderTable+".abandoned_at IS NOT NULL", instanceID, models.PendingState)
+
+	offset, limit, err := paginate(w, r, query.Model(&models.Order{}))
+	if err != nil {
+		return badRequestError("Bad Pagination Parameters: %v", err)
+	}
+
+	orders := []models.Order{}
+	if rsp := query.Offset(offset).Limit(limit).Find(&orders); rsp.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+
+	log.WithField("order_count", len(orders)).Debugf("Successfully retrieved %d abandoned orders", len(orders))
+	return sendJSON(w, http.StatusOK, orders)
+}
+
+// RunAbandonedOrderNotifier creates a goroutine that marks abandoned orders and
+// notifies about them at the interval of the sweeper configuration.
+func (a *API) RunAbandonedOrderNotifier(ctx context.Context, db *gorm.DB, log logrus.FieldLogger) {
+	interval := a.config.Sweeper.Interval
+	if interval <= 0 {
+		interval = defaultSweepInterval
+	}
+	go func() {
+		for {
+			a.markAbandonedOrders(ctx, db, log)
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func (a *API) markAbandonedOrders(ctx context.Context, db *gorm.DB, log logrus.FieldLogger) {
+	instanceIDs := []string{}
+	rsp := db.Model(&models.Order{}).
+		Where("payment_state = ? AND abandoned_at IS NULL AND archived_at IS NULL AND email <> ''", models.PendingState).
+		Pluck("DISTINCT instance_id", &instanceIDs)
+	if rsp.Error != nil {
+		log.WithError(rsp.Error).Error("Error querying for pending orders")
+		return
+	}
+
+	for _, instanceID := range instanceIDs {
+		log := log.WithField("instance_id", instanceID)
+
+		instanceCtx, err := a.instanceContext(ctx, db, instanceID)
+		if err != nil {
+			log.WithError(err).Error("Error loading instance configuration")
+			continue
+		}
+		config := gcontext.GetConfig(instanceCtx)
+		now := time.Now()
+
+		abandoned := []*models.Order{}
+		rsp := orderQuery(db).
+			Where("instance_id = ? AND payment_state = ? AND abandoned_at IS NULL AND archived_at IS NULL AND email <> '' AND created_at < ? AND created_at > ?",
+				instanceID, models.PendingState, now.Add(-config.AbandonedOrderDelay()), now.Add(-config.AbandonedOrderMaxAge())).
+			Find(&abandoned)
+		if rsp.Error != nil {
+			log.WithError(rsp.Error).Error("Error querying for abandoned orders")
+			continue
+		}
+
+		for _, order := range abandoned {
+			log := log.WithField("order_id", order.ID)
+			if err := abandonOrder(instanceCtx, db, log, order, a.unsubscribeBase(nil, config)); err != nil {
+				log.WithError(err).Error("Failed to mark abandoned order")
+				continue
+			}
+			log.Info("Marked abandoned order")
+		}
+	}
+}
+
+// abandonOrder marks the order as abandoned and, if the instance opted in to
+// recovery, triggers the abandoned webhook and reminds the customer once the
+// order has been marked, with a link to the unsubscribe endpoint at
+// unsubscribeBase.
+func abandonOrder(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, order *models.Order, unsubscribeBase string) error {
+	config := gcontext.GetConfig(ctx)
+	now := time.Now()
+
+	tx := db.Begin()
+	rsp := tx.Model(&models.Order{}).Where("id = ? AND abandoned_at IS NULL", order.ID).Update("abandoned_at", now)
+	if rsp.Error != nil {
+		tx.Rollback()
+		return rsp.Error
+	}
+	if rsp.RowsAffected == 0 {
+		// another process got to the order first
+		tx.Rollback()
+		return nil
+	}
+	order.AbandonedAt = &now
+	models.LogEvent(tx, "", order.UserID, order.ID, models.EventUpdated, []string{"abandoned_at"})
+
+	notify := config.Orders.EnableRecovery
+	if notify && config.Webhooks.Abandoned != "" {
+		hook, err := models.NewHook("abandoned", config.SiteURL, config.Webhooks.Abandoned, order.UserID, config.Webhooks.Secret, order)
+		if err != nil {
+			log.WithError(err).Error("Failed to process webhook")
+		} else {
+			tx.Save(hook)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	if notify {
+		go sendAbandonedOrderMail(ctx, db, log, order, unsubscribeBase)
+	}
+	return nil
+}
+
+// sendAbandonedOrderMail reminds the customer of an abandoned order unless
+// they opted out of marketing emails.
+func sendAbandonedOrderMail(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, order *models.Order, unsubscribeBase string) {
+	if !notificationAllowed(db, log, order.InstanceID, order.UserID, order.Email, models.MarketingNotification) {
+		return
+	}
+	link, err := unsubscribeLink(db, order.InstanceID, order.UserID, order.Email, unsubscribeBase)
+	if err != nil {
+		log.WithError(err).Error("Error creating unsubscribe link")
+		return
+	}
+	if err := gcontext.GetMailer(ctx).AbandonedOrderMail(order, link); err != nil {
+		log.WithError(err).Error("Error sending abandoned order mail")
+		return
+	}
+	models.LogEvent(db, "", "", order.ID, models.EventEmailed, []string{"abandoned_order"})
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestAbandonedOrders(t *testing.T) {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	setup := func(t *testing.T, age time.Duration) *RouteTest {
+		test := NewRouteTest(t)
+		test.Config.Webhooks.Abandoned = "https://example.com/abandoned"
+		test.Config.Orders.EnableRecovery = true
+		require.NoError(t, test.DB.Model(&models.Order{}).Where("id = ?", test.Data.secondOrder.ID).Updates(map[string]interface{}{
+			"payment_state": models.PendingState,
+			"created_at":    time.Now().Add(-age),
+		}).Error)
+		return test
+	}
+	run := func(t *testing.T, test *RouteTest) {
+		ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+		require.NoError(t, err)
+		api := NewAPIWithVersion(ctx, test.GlobalConfig, logrus.StandardLogger(), test.DB, "")
+		api.markAbandonedOrders(ctx, test.DB, logrus.StandardLogger())
+	}
+	countEmails := func(t *testing.T, test *RouteTest) int {
+		var emails int
+		require.NoError(t, test.DB.Model(&models.Event{}).Where("order_id = ? AND type = ?", test.Data.secondOrder.ID, models.EventEmailed).Count(&emails).Error)
+		return emails
+	}
+	countHooks := func(t *testing.T, test *RouteTest) int {
+		var hooks int
+		require.NoError(t, test.DB.Model(&models.Hook{}).Where("type = ?", "abandoned").Count(&hooks).Error)
+		return hooks
+	}
+
+	t.Run("Abandoned", func(t *testing.T) {
+		test := setup(t, 2*time.Hour)
+		run(t, test)
+		run(t, test)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.secondOrder.ID).Error)
+		assert.NotNil(t, order.AbandonedAt)
+		order = &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Nil(t, order.AbandonedAt)
+		assert.Equal(t, 1, countHooks(t, test))
+
+		// the reminder is mailed in the background
+		for i := 0; i < 100 && countEmails(t, test) == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		email := &models.Event{}
+		require.NoError(t, test.DB.Where("order_id = ? AND type = ?", test.Data.secondOrder.ID, models.EventEmailed).First(email).Error)
+		assert.Equal(t, "abandoned_order", email.Changes)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/abandoned", nil, token)
+		orders := []models.Order{}
+		extractPayload(t, http.StatusOK, recorder, &orders)
+		require.Len(t, orders, 1)
+		assert.Equal(t, test.Data.secondOrder.ID, orders[0].ID)
+	})
+	t.Run("NotYet", func(t *testing.T) {
+		test := setup(t, 10*time.Minute)
+		run(t, test)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.secondOrder.ID).Error)
+		assert.Nil(t, order.AbandonedAt)
+		assert.Equal(t, 0, countHooks(t, test))
+	})
+	t.Run("TooOld", func(t *testing.T) {
+		test := setup(t, 8*24*time.Hour)
+		run(t, test)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.secondOrder.ID).Error)
+		assert.Nil(t, order.AbandonedAt)
+		assert.Equal(t, 0, countHooks(t, test))
+	})
+	t.Run("RecoveryDisabled", func(t *testing.T) {
+		test := setup(t, 2*time.Hour)
+		test.Config.Orders.EnableRecovery = false
+		run(t, test)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.secondOrder.ID).Error)
+		assert.NotNil(t, order.AbandonedAt)
+		assert.Equal(t, 0, countHooks(t, test))
+		assert.Equal(t, 0, countEmails(t, test))
+	})
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/abandoned", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
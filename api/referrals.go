@@ -0,0 +1,282 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+
+	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// Referral rewards referrers can be given.
+const (
+	referralRewardCredit = "credit"
+	referralRewardCoupon = "coupon"
+)
+
+// referralCouponPrefix is the prefix of the coupon codes given as a reward.
+const referralCouponPrefix = "REF-"
+
+// referralProgram is the referral code of a user with the orders referred
+// with it.
+type referralProgram struct {
+	Code      string             `json:"code"`
+	Referrals []*models.Referral `json:"referrals"`
+}
+
+type referralsRow struct {
+	Code       string `json:"code"`
+	ReferrerID string `json:"referrer_id"`
+	Currency   string `json:"currency"`
+	Orders     uint64 `json:"orders"`
+	PaidOrders uint64 `json:"paid_orders"`
+	Revenue    uint64 `json:"revenue"`
+	Rewarded   uint64 `json:"rewarded"`
+}
+
+// ReferralView returns the referral code of a user, generating it on the first
+// request, and the orders referred with it.
+func (a *API) ReferralView(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	userID := gcontext.GetUserID(ctx)
+	if gcontext.GetUser(ctx) == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+
+	tx := a.DB(r).Begin()
+	code, err := models.ReferralCodeForUser(tx, gcontext.GetInstanceID(ctx), userID)
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Error generating referral code").WithInternalError(err)
+	}
+	program := &referralProgram{Code: code.Code, Referrals: []*models.Referral{}}
+	if rsp := tx.Where("referrer_id = ?", userID).Order("created_at desc").Find(&program.Referrals); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("problem while querying for the referrals of userID: %s", userID).WithInternalError(rsp.Error)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return internalServerError("Error generating referral code").WithInternalError(err)
+	}
+	return sendJSON(w, http.StatusOK, program)
+}
+
+// ReferralsReport lists the orders referred by each referral code within a
+// period, how many of them were paid with the revenue and how many of them
+// were rewarded.
+func (a *API) ReferralsReport(w http.ResponseWriter, r *http.Request) error {
+	db := a.DB(r)
+	instanceID := gcontext.GetInstanceID(r.Context())
+	ordersTable := db.NewScope(models.Order{}).QuotedTableName()
+	referralsTable := db.NewScope(models.Referral{}).QuotedTableName()
+	paid := "CASE WHEN " + ordersTable + ".payment_state = 'paid' THEN "
+	query := db.
+		Model(&models.Referral{}).
+		Select(referralsTable+".code, "+referralsTable+".referrer_id, "+ordersTable+".currency, count(*) as orders, "+
+			"sum("+paid+"1 ELSE 0 END) as paid_orders, sum("+paid+ordersTable+".total ELSE 0 END) as revenue, "+
+			"count("+referralsTable+".rewarded_at) - count("+referralsTable+".reversed_at) as rewarded").
+		Joins("JOIN "+ordersTable+" ON "+ordersTable+".id = "+referralsTable+".order_id").
+		Where(referralsTable+".instance_id = ?", instanceID).
+		Group(referralsTable + ".code, " + referralsTable + ".referrer_id, " + ordersTable + ".currency").
+		Order("revenue desc")
+
+	test, err := getTestQueryParam(r.URL.Query())
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	query = query.Where(ordersTable+".test = ?", test)
+	query, err = parseTimeQueryParams(query, referralsTable, r.URL.Query())
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+
+	rows, err := query.Rows()
+	if err != nil {
+		return internalServerError("Database error").WithInternalError(err)
+	}
+	defer rows.Close()
+	result := []*referralsRow{}
+	for rows.Next() {
+		row := &referralsRow{}
+		err = rows.Scan(&row.Code, &row.ReferrerID, &row.Currency, &row.Orders, &row.PaidOrders, &row.Revenue, &row.Rewarded)
+		if err != nil {
+			return internalServerError("Database error").WithInternalError(err)
+		}
+		result = append(result, row)
+	}
+
+	return sendJSON(w, http.StatusOK, result)
+}
+
+// referOrder attributes the order to the owner of the referral code within the
+// transaction creating the order.
+func referOrder(tx *gorm.DB, order *models.Order, code string) *HTTPError {
+	referralCode, err := models.FindReferralCode(tx, order.InstanceID, code)
+	if err != nil {
+		return internalServerError("Error looking up referral code").WithInternalError(err)
+	}
+	if referralCode == nil {
+		return badRequestError("Referral code not found")
+	}
+	self, err := selfReferral(tx, referralCode.UserID, order)
+	if err != nil {
+		return internalServerError("Error looking up referrer").WithInternalError(err)
+	}
+	if self {
+		return badRequestError("You can't use your own referral code")
+	}
+
+	order.ReferralCode = referralCode.Code
+	if rsp := tx.Create(models.NewReferral(referralCode, order)); rsp.Error != nil {
+		return internalServerError("Error saving referral").WithInternalError(rsp.Error)
+	}
+	return nil
+}
+
+// rewardReferral rewards the referrer of a paid order within the transaction
+// that marks it as paid.
+func rewardReferral(tx *gorm.DB, config *conf.Configuration, log logrus.FieldLogger, order *models.Order) {
+	if order.ReferralCode == "" || config.Referrals.Reward == "" {
+		return
+	}
+	referral := &models.Referral{}
+	if rsp := tx.Where("order_id = ?", order.ID).First(referral); rsp.Error != nil {
+		if !rsp.RecordNotFound() {
+			log.WithError(rsp.Error).Error("Failed to look up the referral of the order")
+		}
+		return
+	}
+	if referral.RewardedAt != nil {
+		return
+	}
+	// the order can be paid by the referrer after it was created as a guest
+	if self, err := selfReferral(tx, referral.ReferrerID, order); err != nil || self {
+		if err != nil {
+			log.WithError(err).Error("Failed to look up the referrer of the order")
+		} else {
+			log.Warnf("Not rewarding referral of the referrer's own order by %s", referral.ReferrerID)
+		}
+		return
+	}
+
+	switch config.Referrals.Reward {
+	case referralRewardCredit:
+		credit := models.NewCreditTransaction(order.InstanceID, referral.ReferrerID, order.Currency, int64(config.Referrals.CreditAmount))
+		credit.OrderID = order.ID
+		credit.Description = "Referral of order " + orderLabel(order)
+		if err := models.BookCredit(tx, credit); err != nil {
+			log.WithError(err).Error("Failed to reward referral with store credit")
+			return
+		}
+		referral.RewardReference = credit.ID
+	case referralRewardCoupon:
+		code, err := models.GenerateCode(8)
+		if err != nil {
+			log.WithError(err).Error("Failed to generate referral coupon code")
+			return
+		}
+		coupon := &models.Coupon{
+			InstanceID: order.InstanceID,
+			Code:       referralCouponPrefix + code,
+			Percentage: config.Referrals.CouponPercentage,
+			MaxUses:    1,
+		}
+		if days := config.Referrals.CouponValidDays; days > 0 {
+			end := time.Now().AddDate(0, 0, days)
+			coupon.EndDate = &end
+		}
+		if rsp := tx.Create(coupon); rsp.Error != nil {
+			log.WithError(rsp.Error).Error("Failed to reward referral with a coupon")
+			return
+		}
+		referral.RewardReference = coupon.Code
+	default:
+		log.Errorf("Unknown referral reward %s", config.Referrals.Reward)
+		return
+	}
+
+	now := time.Now()
+	referral.Reward = config.Referrals.Reward
+	referral.RewardedAt = &now
+	if rsp := tx.Save(referral); rsp.Error != nil {
+		log.WithError(rsp.Error).Error("Failed to save referral reward")
+	}
+}
+
+// selfReferral returns whether the order is one of the referrer's own, by the
+// user or the email of the referrer.
+func selfReferral(tx *gorm.DB, referrerID string, order *models.Order) (bool, error) {
+	if order.UserID != "" && order.UserID == referrerID {
+		return true, nil
+	}
+	referrer, err := models.GetUser(tx, referrerID)
+	if err != nil || referrer == nil {
+		return false, err
+	}
+	return strings.EqualFold(referrer.Email, order.Email), nil
+}
+
+// reverseReferralReward takes back the reward of the referral of an order once
+// the order has been refunded completely, within the transaction recording
+// the refund. Credit the referrer has spent already and coupons that have been
+// used can't be taken back.
+func reverseReferralReward(tx *gorm.DB, log logrus.FieldLogger, orderID string) {
+	order := &models.Order{}
+	if rsp := tx.Select("id, number, payment_state").First(order, "id = ?", orderID); rsp.Error != nil {
+		log.WithError(rsp.Error).Error("Failed to look up the refunded order")
+		return
+	}
+	if order.PaymentState != models.RefundedState {
+		return
+	}
+	referral := &models.Referral{}
+	if rsp := tx.Where("order_id = ? AND rewarded_at IS NOT NULL AND reversed_at IS NULL", orderID).First(referral); rsp.Error != nil {
+		if !rsp.RecordNotFound() {
+			log.WithError(rsp.Error).Error("Failed to look up the referral of the order")
+		}
+		return
+	}
+
+	switch referral.Reward {
+	case referralRewardCredit:
+		reward := &models.CreditTransaction{}
+		if rsp := tx.First(reward, "id = ?", referral.RewardReference); rsp.Error != nil {
+			log.WithError(rsp.Error).Error("Failed to look up the store credit of the referral")
+			return
+		}
+		credit := models.NewCreditTransaction(reward.InstanceID, reward.UserID, reward.Currency, -reward.Amount)
+		credit.OrderID = reward.OrderID
+		credit.Description = "Refund of referred order " + orderLabel(order)
+		if err := models.BookCredit(tx, credit); err != nil {
+			if err == models.ErrInsufficientCredit {
+				log.Warnf("Referrer %s has spent the store credit of the referral already", referral.ReferrerID)
+			} else {
+				log.WithError(err).Error("Failed to reverse the store credit of the referral")
+			}
+			return
+		}
+	case referralRewardCoupon:
+		rsp := tx.Model(&models.Coupon{}).
+			Where("instance_id = ? AND code = ? AND uses = 0", referral.InstanceID, referral.RewardReference).
+			UpdateColumn("end_date", time.Now())
+		if rsp.Error != nil {
+			log.WithError(rsp.Error).Error("Failed to expire the coupon of the referral")
+			return
+		}
+		if rsp.RowsAffected == 0 {
+			log.Warnf("Referrer %s has used the coupon of the referral already", referral.ReferrerID)
+			return
+		}
+	default:
+		return
+	}
+
+	now := time.Now()
+	if rsp := tx.Model(referral).UpdateColumn("reversed_at", now); rsp.Error != nil {
+		log.WithError(rsp.Error).Error("Failed to save the reversal of the referral reward")
+	}
+}
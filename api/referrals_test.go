@@ -0,0 +1,175 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+func TestReferrals(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+
+	setup := func(t *testing.T) (*RouteTest, string) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		recorder := test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID+"/referrals", nil, test.Data.testUserToken)
+		program := &referralProgram{}
+		extractPayload(t, http.StatusOK, recorder, program)
+		require.NotEmpty(t, program.Code)
+		return test, program.Code
+	}
+	referredOrder := func(t *testing.T, test *RouteTest, code string) *models.Order {
+		body := strings.Replace(defaultPayload, `"email": "info@example.com",`, `"email": "friend@example.com", "referral_code": "`+code+`",`, 1)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(body), nil)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, code, order.ReferralCode)
+		return order
+	}
+	pay := func(t *testing.T, test *RouteTest, order *models.Order, token *jwt.Token) {
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+			intent := v.(*stripe.PaymentIntent)
+			intent.ID = stripePaymentIntentID
+			intent.Status = stripe.PaymentIntentStatusSucceeded
+			return nil
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		body, err := json.Marshal(map[string]interface{}{
+			"amount":                   order.Total,
+			"currency":                 "USD",
+			"provider":                 payments.StripeProvider,
+			"stripe_payment_method_id": "payment-method-simple",
+		})
+		require.NoError(t, err)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/"+order.ID+"/payments", bytes.NewBuffer(body), token)
+		extractPayload(t, http.StatusOK, recorder, &models.Transaction{})
+	}
+	referral := func(t *testing.T, test *RouteTest, order *models.Order) *models.Referral {
+		referral := &models.Referral{}
+		require.NoError(t, test.DB.First(referral, "order_id = ?", order.ID).Error)
+		return referral
+	}
+
+	t.Run("CreditReward", func(t *testing.T) {
+		test, code := setup(t)
+		test.Config.Referrals.Reward = referralRewardCredit
+		test.Config.Referrals.CreditAmount = 500
+
+		order := referredOrder(t, test, code)
+		assert.Nil(t, referral(t, test, order).RewardedAt)
+		pay(t, test, order, nil)
+
+		rewarded := referral(t, test, order)
+		require.NotNil(t, rewarded.RewardedAt)
+		assert.Equal(t, test.Data.testUser.ID, rewarded.ReferrerID)
+		assert.Equal(t, referralRewardCredit, rewarded.Reward)
+		balance, err := models.CreditBalance(test.DB, test.Data.testUser.ID, "USD")
+		require.NoError(t, err)
+		assert.EqualValues(t, 500, balance)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID+"/referrals", nil, test.Data.testUserToken)
+		program := &referralProgram{}
+		extractPayload(t, http.StatusOK, recorder, program)
+		assert.Equal(t, code, program.Code)
+		require.Len(t, program.Referrals, 1)
+		assert.Equal(t, "friend@example.com", program.Referrals[0].Email)
+
+		referredOrder(t, test, code)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder = test.TestEndpoint(http.MethodGet, "/reports/referrals", nil, token)
+		rows := []*referralsRow{}
+		extractPayload(t, http.StatusOK, recorder, &rows)
+		require.Len(t, rows, 1)
+		assert.Equal(t, code, rows[0].Code)
+		assert.EqualValues(t, 2, rows[0].Orders)
+		assert.EqualValues(t, 1, rows[0].PaidOrders)
+		assert.EqualValues(t, 999, rows[0].Revenue)
+		assert.EqualValues(t, 1, rows[0].Rewarded)
+	})
+	t.Run("CouponReward", func(t *testing.T) {
+		test, code := setup(t)
+		test.Config.Referrals.Reward = referralRewardCoupon
+		test.Config.Referrals.CouponPercentage = 15
+		test.Config.Referrals.CouponValidDays = 30
+
+		order := referredOrder(t, test, code)
+		pay(t, test, order, nil)
+
+		rewarded := referral(t, test, order)
+		require.NotNil(t, rewarded.RewardedAt)
+		coupon, err := models.FindCoupon(test.DB, "", rewarded.RewardReference)
+		require.NoError(t, err)
+		require.NotNil(t, coupon)
+		assert.True(t, strings.HasPrefix(coupon.Code, referralCouponPrefix))
+		assert.EqualValues(t, 15, coupon.Percentage)
+		assert.EqualValues(t, 1, coupon.MaxUses)
+		assert.NotNil(t, coupon.EndDate)
+	})
+	t.Run("RefundReversesReward", func(t *testing.T) {
+		test, code := setup(t)
+		test.Config.Referrals.Reward = referralRewardCredit
+		test.Config.Referrals.CreditAmount = 500
+
+		order := referredOrder(t, test, code)
+		pay(t, test, order, nil)
+		require.NotNil(t, referral(t, test, order).RewardedAt)
+
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+			v.(*stripe.Refund).ID = "refund-id"
+			return nil
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+		charge := &models.Transaction{}
+		require.NoError(t, test.DB.First(charge, "order_id = ? AND type = ?", order.ID, models.ChargeTransactionType).Error)
+
+		recorder := runPaymentRefund(test, "/payments/"+charge.ID+"/refund", &PaymentParams{Amount: 500, Currency: "USD"})
+		extractPayload(t, http.StatusOK, recorder, &models.Transaction{})
+		assert.Nil(t, referral(t, test, order).ReversedAt, "partial refunds keep the reward")
+
+		recorder = runPaymentRefund(test, "/payments/"+charge.ID+"/refund", &PaymentParams{Amount: order.Total - 500, Currency: "USD"})
+		extractPayload(t, http.StatusOK, recorder, &models.Transaction{})
+		assert.NotNil(t, referral(t, test, order).ReversedAt)
+		balance, err := models.CreditBalance(test.DB, test.Data.testUser.ID, "USD")
+		require.NoError(t, err)
+		assert.EqualValues(t, 0, balance)
+	})
+	t.Run("PaidByReferrer", func(t *testing.T) {
+		test, code := setup(t)
+		test.Config.Referrals.Reward = referralRewardCredit
+		test.Config.Referrals.CreditAmount = 500
+
+		order := referredOrder(t, test, code)
+		pay(t, test, order, test.Data.testUserToken)
+
+		assert.Nil(t, referral(t, test, order).RewardedAt)
+		balance, err := models.CreditBalance(test.DB, test.Data.testUser.ID, "USD")
+		require.NoError(t, err)
+		assert.EqualValues(t, 0, balance)
+	})
+	t.Run("InvalidCode", func(t *testing.T) {
+		test, code := setup(t)
+		body := strings.Replace(defaultPayload, `"email": "info@example.com",`, `"email": "info@example.com", "referral_code": "UNKNOWN",`, 1)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(body), nil)
+		validateError(t, http.StatusBadRequest, recorder, "Referral code not found")
+
+		body = strings.Replace(defaultPayload, `"email": "info@example.com",`, `"referral_code": "`+code+`",`, 1)
+		recorder = test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(body), test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "own referral code")
+
+		body = strings.Replace(defaultPayload, `"email": "info@example.com",`, `"email": "Bruce@WayneIndustries.com", "referral_code": "`+code+`",`, 1)
+		recorder = test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(body), nil)
+		validateError(t, http.StatusBadRequest, recorder, "own referral code")
+	})
+}
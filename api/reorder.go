@@ -0,0 +1,87 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+// ReorderItem is a line item of the original order that couldn't be ordered again
+type ReorderItem struct {
+	Sku      string `json:"sku"`
+	Path     string `json:"path"`
+	Title    string `json:"title"`
+	Quantity uint64 `json:"quantity"`
+	Error    string `json:"error"`
+}
+
+// ReorderResponse holds the new order and the items left out of it
+type ReorderResponse struct {
+	Order            *models.Order  `json:"order"`
+	UnavailableItems []*ReorderItem `json:"unavailable_items"`
+}
+
+// OrderReorder creates a new pending order with the line items of an existing
+// order. The items are priced from the current product metadata of the site,
+// items that can't be purchased anymore are left out and reported.
+func (a *API) OrderReorder(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+
+	original, httpErr := a.loadOrder(r)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	params := &orderRequestParams{
+		Email:     original.Email,
+		Currency:  original.Currency,
+		VATNumber: original.VATNumber,
+		ShippingAddress: &models.Address{
+			AddressRequest: original.ShippingAddress.AddressRequest,
+		},
+		BillingAddress: &models.Address{
+			AddressRequest: original.BillingAddress.AddressRequest,
+		},
+	}
+
+	unavailable := []*ReorderItem{}
+	for _, item := range original.LineItems {
+		orderItem := &orderLineItem{
+			Sku:      item.Sku,
+			Path:     item.Path,
+			Quantity: item.Quantity,
+			MetaData: item.MetaData,
+		}
+
+		// check the item on its own, so a single item that's gone doesn't
+		// fail the whole order
+		check := models.NewOrder(original.InstanceID, "", "", original.Currency)
+		if httpErr := a.processLineItems(ctx, check, []*orderLineItem{orderItem}); httpErr != nil {
+			log.WithError(httpErr).Debugf("Line item %s of order %s is not available anymore", item.Sku, original.ID)
+			unavailable = append(unavailable, &ReorderItem{
+				Sku:      item.Sku,
+				Path:     item.Path,
+				Title:    item.Title,
+				Quantity: item.Quantity,
+				Error:    httpErr.Cause().Error(),
+			})
+			continue
+		}
+		params.LineItems = append(params.LineItems, orderItem)
+	}
+	if len(params.LineItems) == 0 {
+		return badRequestError("None of the items of order %s can be purchased anymore", original.ID)
+	}
+
+	order, err := a.createOrder(w, r, params, nil)
+	if err != nil {
+		return err
+	}
+
+	log.WithField("unavailable_count", len(unavailable)).Infof("Reordered order %s as %s", original.ID, order.ID)
+	return sendJSON(w, http.StatusCreated, &ReorderResponse{
+		Order:            order,
+		UnavailableItems: unavailable,
+	})
+}
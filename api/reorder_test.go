@@ -0,0 +1,61 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestOrderReorder(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+
+	t.Run("PartiallyAvailable", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		require.NoError(t, test.DB.Create(&models.LineItem{
+			OrderID:  test.Data.firstOrder.ID,
+			Title:    "simple product",
+			Sku:      "product-1",
+			Path:     "/simple-product",
+			Price:    500,
+			Quantity: 3,
+		}).Error)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/reorder", nil, test.Data.testUserToken)
+		rsp := &ReorderResponse{}
+		extractPayload(t, http.StatusCreated, recorder, rsp)
+
+		require.NotNil(t, rsp.Order)
+		assert.NotEqual(t, test.Data.firstOrder.ID, rsp.Order.ID)
+		assert.Equal(t, models.PendingState, rsp.Order.PaymentState)
+		assert.Equal(t, test.Data.firstOrder.Email, rsp.Order.Email)
+		assert.Equal(t, test.Data.firstOrder.ShippingAddress.Address1, rsp.Order.ShippingAddress.Address1)
+		require.Len(t, rsp.Order.LineItems, 1)
+		item := rsp.Order.LineItems[0]
+		assert.Equal(t, "product-1", item.Sku)
+		assert.Equal(t, uint64(3), item.Quantity)
+		assert.Equal(t, uint64(999), item.Price)
+		assert.Equal(t, uint64(3*999), rsp.Order.Total)
+
+		require.Len(t, rsp.UnavailableItems, 1)
+		assert.Equal(t, "123-i-can-fly-456", rsp.UnavailableItems[0].Sku)
+		assert.NotEmpty(t, rsp.UnavailableItems[0].Error)
+	})
+	t.Run("NothingAvailable", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/reorder", nil, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "can be purchased")
+	})
+	t.Run("NoAccess", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/reorder", nil, testToken("villian", "villian@wayneindustries.com"))
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
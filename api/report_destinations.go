@@ -0,0 +1,119 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/netlify/gocommerce/conf"
+)
+
+const reportDeliveryTimeout = time.Minute
+
+// postReport posts the CSV file of a report to a webhook, signed like the
+// other webhooks when there's a secret.
+func postReport(client *http.Client, hookURL, secret, filename string, report []byte) error {
+	req, err := http.NewRequest(http.MethodPost, hookURL, bytes.NewReader(report))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/csv")
+	req.Header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	if secret != "" {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"exp": time.Now().Add(5 * time.Minute).Unix(),
+		})
+		signature, err := token.SignedString([]byte(secret))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-Commerce-Signature", signature)
+	}
+	return sendReportRequest(client, req)
+}
+
+// uploadReportToS3 puts the CSV file of a report into the bucket, signing
+// the request with AWS Signature Version 4.
+func uploadReportToS3(client *http.Client, dest *conf.S3DestinationConfiguration, filename string, report []byte, now time.Time) error {
+	region := dest.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	key := strings.TrimPrefix(strings.TrimSuffix(dest.Prefix, "/")+"/"+filename, "/")
+	objectURL := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", dest.Bucket, region, key)
+	if dest.Endpoint != "" {
+		objectURL = strings.TrimSuffix(dest.Endpoint, "/") + "/" + dest.Bucket + "/" + key
+	}
+	parsed, err := url.Parse(objectURL)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, parsed.String(), bytes.NewReader(report))
+	if err != nil {
+		return err
+	}
+	payloadHash := sha256Hex(report)
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := now.UTC().Format("20060102")
+	req.Header.Set("Content-Type", "text/csv")
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	signedHeaders := "content-type;host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		http.MethodPut,
+		parsed.EscapedPath(),
+		"",
+		"content-type:text/csv",
+		"host:" + parsed.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	signingKey := []byte("AWS4" + dest.SecretAccessKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", dest.AccessKeyID, scope, signedHeaders, signature))
+	return sendReportRequest(client, req)
+}
+
+func sendReportRequest(client *http.Client, req *http.Request) error {
+	rsp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(rsp.Body)
+		return fmt.Errorf("Unexpected response %s: %s", rsp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
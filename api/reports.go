@@ -1,18 +1,39 @@
 package api
 
 import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
 	"net/http"
+	"sort"
+	"strconv"
+	"time"
 
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/netlify/gocommerce/calculator"
 	gcontext "github.com/netlify/gocommerce/context"
 	"github.com/netlify/gocommerce/models"
 )
 
+// defaultDashboardProducts is how many of the best selling products the
+// dashboard report lists by default.
+const defaultDashboardProducts = 5
+
 type salesRow struct {
 	Total    uint64 `json:"total"`
 	SubTotal uint64 `json:"subtotal"`
 	Taxes    uint64 `json:"taxes"`
 	Currency string `json:"currency"`
 	Orders   uint64 `json:"orders"`
+
+	// Fees are the processing fees of the payments known to be charged by the
+	// payment providers, NetRevenue the total without them.
+	Fees       uint64 `json:"fees"`
+	NetRevenue uint64 `json:"net_revenue"`
 }
 
 type productsRow struct {
@@ -20,80 +41,901 @@ type productsRow struct {
 	Path     string `json:"path"`
 	Total    uint64 `json:"total"`
 	Currency string `json:"currency"`
+	Quantity uint64 `json:"quantity"`
+
+	// Total is the gross revenue of the product, Discount and Refunded the
+	// parts of it given as discounts and refunded, NetRevenue what's left.
+	Discount   uint64 `json:"discount"`
+	Refunded   uint64 `json:"refunded"`
+	NetRevenue uint64 `json:"net_revenue"`
+}
+
+type dashboardRow struct {
+	Currency          string `json:"currency"`
+	Revenue           uint64 `json:"revenue"`
+	Orders            uint64 `json:"orders"`
+	AverageOrderValue uint64 `json:"average_order_value"`
+	Refunds           uint64 `json:"refunds"`
+}
+
+type dashboardReport struct {
+	Today       []*dashboardRow `json:"today"`
+	Last7Days   []*dashboardRow `json:"last_7_days"`
+	Last30Days  []*dashboardRow `json:"last_30_days"`
+	TopProducts []*productsRow  `json:"top_products"`
+}
+
+type cohortRow struct {
+	Cohort          string  `json:"cohort"`
+	Currency        string  `json:"currency"`
+	Customers       uint64  `json:"customers"`
+	RepeatCustomers uint64  `json:"repeat_customers"`
+	RepeatRate      float64 `json:"repeat_rate"`
+	Revenue         uint64  `json:"revenue"`
+
+	Months []*cohortMonthRow `json:"months"`
+}
+
+// cohortMonthRow sums up the orders of a cohort in the month after its first
+// one. RepeatRate is the share of the customers of the cohort that purchased
+// again by the end of the month.
+type cohortMonthRow struct {
+	Month      int     `json:"month"`
+	Customers  uint64  `json:"customers"`
+	Orders     uint64  `json:"orders"`
+	Revenue    uint64  `json:"revenue"`
+	RepeatRate float64 `json:"repeat_rate"`
+}
+
+type downloadsRow struct {
+	Sku       string `json:"sku"`
+	Day       string `json:"day"`
+	Downloads uint64 `json:"downloads"`
+	UniqueIPs uint64 `json:"unique_ips"`
+	Bandwidth uint64 `json:"bandwidth"`
+}
+
+type lowStockRow struct {
+	Sku       string `json:"sku"`
+	Location  string `json:"location,omitempty"`
+	Quantity  uint64 `json:"quantity"`
+	Reserved  uint64 `json:"reserved"`
+	Threshold uint64 `json:"threshold"`
+}
+
+type vatRow struct {
+	CountryCode   string  `json:"country_code"`
+	Currency      string  `json:"currency"`
+	Rate          float64 `json:"vat_rate"`
+	TaxableAmount int64   `json:"taxable_amount"`
+	VAT           int64   `json:"vat"`
+	Orders        uint64  `json:"orders"`
+
+	orders map[string]bool
 }
 
-// SalesReport lists the sales numbers for a period
+// SalesReport lists the sales numbers for a period. The whole days that have
+// been rolled up are summed up from their rollups, the rest of the period
+// from the orders.
 func (a *API) SalesReport(w http.ResponseWriter, r *http.Request) error {
+	db := a.DB(r)
+	log := getLogEntry(r)
 	instanceID := gcontext.GetInstanceID(r.Context())
+	test, err := getTestQueryParam(r.URL.Query())
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	archived, err := getArchivedQueryParam(r.URL.Query())
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	from, to, err := getTimeQueryParams(r.URL.Query())
+	if err != nil {
+		return badRequestError(err.Error())
+	}
 
-	query := a.DB(r).
+	state, err := models.FindSalesRollupState(db, instanceID)
+	if err != nil {
+		log.WithError(err).Warn("Error loading sales rollups, querying orders instead")
+		state = nil
+	}
+	result, err := querySales(db, log, state, instanceID, test, archived, from, to)
+	if err != nil {
+		return internalServerError("Database error").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusOK, result)
+}
+
+// querySales sums up the sales of a period by currency, from the rollups of
+// the whole days that have been rolled up and the orders of the rest.
+func querySales(db *gorm.DB, log logrus.FieldLogger, state *models.SalesRollupState, instanceID string, test, archived bool, from, to *time.Time) ([]*salesRow, error) {
+	rolledUp, periods := salesReportPeriods(state, from, to)
+
+	sales := map[string]*salesRow{}
+	if rolledUp != nil {
+		if err := addRolledUpSales(db, sales, instanceID, test, archived, rolledUp); err != nil {
+			log.WithError(err).Warn("Error querying sales rollups, querying orders instead")
+			sales = map[string]*salesRow{}
+			periods = []*salesPeriod{{from: from, to: to}}
+		}
+	}
+	for _, period := range periods {
+		if err := addOrderSales(db, sales, instanceID, test, archived, period); err != nil {
+			return nil, err
+		}
+	}
+
+	result := []*salesRow{}
+	for _, row := range sales {
+		if row.Fees < row.Total {
+			row.NetRevenue = row.Total - row.Fees
+		}
+		result = append(result, row)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Currency < result[j].Currency })
+	return result, nil
+}
+
+// addOrderSales adds the paid orders within the period, and the fees of
+// their charges, to the sales by currency.
+func addOrderSales(db *gorm.DB, sales map[string]*salesRow, instanceID string, test, archived bool, period *salesPeriod) error {
+	ordersTable := db.NewScope(models.Order{}).QuotedTableName()
+	query := db.
 		Model(&models.Order{}).
 		Select("sum(total) as total, sum(sub_total) as subtotal, sum(taxes) as taxes, currency, count(*) as orders").
-		Where("payment_state = 'paid' AND instance_id = ?", instanceID).
+		Where("payment_state = 'paid' AND instance_id = ? AND test = ?", instanceID, test).
+		Where(archivedCondition(ordersTable, archived)).
 		Group("currency")
+	rows, err := period.where(query, ordersTable).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		row := &salesRow{}
+		if err := rows.Scan(&row.Total, &row.SubTotal, &row.Taxes, &row.Currency, &row.Orders); err != nil {
+			return err
+		}
+		salesRowFor(sales, row.Currency).add(row)
+	}
+
+	transactionsTable := db.NewScope(models.Transaction{}).QuotedTableName()
+	query = db.
+		Model(&models.Transaction{}).
+		Select(ordersTable+".currency, sum("+transactionsTable+".fee) as fees").
+		Joins("JOIN "+ordersTable+" ON "+ordersTable+".id = "+transactionsTable+".order_id").
+		Where(ordersTable+".payment_state = 'paid' AND "+ordersTable+".instance_id = ? AND "+ordersTable+".test = ?", instanceID, test).
+		Where(archivedCondition(ordersTable, archived)).
+		Where(transactionsTable+".type = ?", models.ChargeTransactionType).
+		Group(ordersTable + ".currency")
+	fees, err := period.where(query, ordersTable).Rows()
+	if err != nil {
+		return err
+	}
+	defer fees.Close()
+	for fees.Next() {
+		row := &salesRow{}
+		if err := fees.Scan(&row.Currency, &row.Fees); err != nil {
+			return err
+		}
+		salesRowFor(sales, row.Currency).add(row)
+	}
+	return nil
+}
+
+func salesRowFor(sales map[string]*salesRow, currency string) *salesRow {
+	row, ok := sales[currency]
+	if !ok {
+		row = &salesRow{Currency: currency}
+		sales[currency] = row
+	}
+	return row
+}
+
+func (row *salesRow) add(other *salesRow) {
+	row.Total += other.Total
+	row.SubTotal += other.SubTotal
+	row.Taxes += other.Taxes
+	row.Orders += other.Orders
+	row.Fees += other.Fees
+}
+
+// ProductsReport lists the units sold and the revenue of each product within
+// a period: the gross revenue before discounts, the discounts, the amounts
+// refunded for the product and the net revenue that's left.
+func (a *API) ProductsReport(w http.ResponseWriter, r *http.Request) error {
+	db := a.DB(r)
+	params := r.URL.Query()
+	instanceID := gcontext.GetInstanceID(r.Context())
+	test, err := getTestQueryParam(params)
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	archived, err := getArchivedQueryParam(params)
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	from, to, err := getTimeQueryParams(params)
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	result, err := productSales(db, instanceID, test, archived, from, to)
+	if err != nil {
+		return internalServerError("Database error").WithInternalError(err)
+	}
+
+	if params.Get("format") != "csv" {
+		return sendJSON(w, http.StatusOK, result)
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="products.csv"`)
+	w.WriteHeader(http.StatusOK)
+	out := csv.NewWriter(w)
+	out.Write([]string{"sku", "path", "currency", "quantity", "gross_revenue", "discount", "refunded", "net_revenue"})
+	for _, row := range result {
+		out.Write([]string{row.Sku, row.Path, row.Currency, strconv.FormatUint(row.Quantity, 10), formatAmount(row.Total), formatAmount(row.Discount), formatAmount(row.Refunded), formatAmount(row.NetRevenue)})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// productSales returns the units sold and the revenue of each product within
+// the period, the best selling first.
+func productSales(db *gorm.DB, instanceID string, test, archived bool, from, to *time.Time) ([]*productsRow, error) {
+	ordersTable := db.NewScope(models.Order{}).QuotedTableName()
+	itemsTable := db.NewScope(models.LineItem{}).QuotedTableName()
+	notesTable := db.NewScope(models.CreditNoteItem{}).QuotedTableName()
+	returnsTable := db.NewScope(models.Return{}).QuotedTableName()
+	returnItemsTable := db.NewScope(models.ReturnItem{}).QuotedTableName()
+
+	// the line items of the paid and refunded orders within the period
+	filter := func(query *gorm.DB) *gorm.DB {
+		query = query.
+			Joins("JOIN "+ordersTable+" ON "+ordersTable+".id = "+itemsTable+".order_id").
+			Where(ordersTable+".payment_state IN (?)", []string{models.PaidState, models.RefundedState}).
+			Where(ordersTable+".instance_id = ? AND "+ordersTable+".test = ?", instanceID, test).
+			Where(archivedCondition(ordersTable, archived)).
+			Group(itemsTable + ".sku, " + itemsTable + ".path, " + ordersTable + ".currency")
+		if from != nil {
+			query = query.Where(ordersTable+".created_at >= ?", from)
+		}
+		if to != nil {
+			query = query.Where(ordersTable+".created_at <= ?", to)
+		}
+		return query
+	}
+
+	products := map[string]*productsRow{}
+	result := []*productsRow{}
+	scan := func(query *gorm.DB, amounts func(row *productsRow) []interface{}) error {
+		rows, err := query.Rows()
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			scanned := &productsRow{}
+			dest := append([]interface{}{&scanned.Sku, &scanned.Path, &scanned.Currency}, amounts(scanned)...)
+			if err := rows.Scan(dest...); err != nil {
+				return err
+			}
+			key := scanned.Sku + "\x00" + scanned.Path + "\x00" + scanned.Currency
+			row, ok := products[key]
+			if !ok {
+				row = &productsRow{Sku: scanned.Sku, Path: scanned.Path, Currency: scanned.Currency}
+				products[key] = row
+				result = append(result, row)
+			}
+			row.Quantity += scanned.Quantity
+			row.Total += scanned.Total
+			row.Discount += scanned.Discount
+			row.Refunded += scanned.Refunded
+		}
+		return nil
+	}
+	columns := itemsTable + ".sku, " + itemsTable + ".path, " + ordersTable + ".currency, "
+	// the amounts are those of a single unit excluding taxes, or the price of
+	// items that were never priced in detail
+	subtotal := "COALESCE(" + itemsTable + ".calculation_subtotal, " + itemsTable + ".price + " + itemsTable + ".addon_price)"
+	netTotal := "COALESCE(" + itemsTable + ".calculation_net_total, " + itemsTable + ".price + " + itemsTable + ".addon_price)"
+
+	sold := filter(db.Model(&models.LineItem{}).
+		Select(columns +
+			"sum(" + itemsTable + ".quantity), " +
+			"sum(" + itemsTable + ".quantity * " + subtotal + "), " +
+			"sum(" + itemsTable + ".quantity * (" + subtotal + " - " + netTotal + "))"))
+	if err := scan(sold, func(row *productsRow) []interface{} {
+		return []interface{}{&row.Quantity, &row.Total, &row.Discount}
+	}); err != nil {
+		return nil, err
+	}
+
+	// refunds of whole orders reverse their line items on the credit note
+	reversed := filter(db.Model(&models.CreditNoteItem{}).
+		Select(columns + "sum(" + notesTable + ".quantity * " + netTotal + ")").
+		Joins("JOIN " + itemsTable + " ON " + itemsTable + ".id = " + notesTable + ".line_item_id"))
+	if err := scan(reversed, func(row *productsRow) []interface{} {
+		return []interface{}{&row.Refunded}
+	}); err != nil {
+		return nil, err
+	}
+
+	// approved returns refund the items sent back, unless the credit note of
+	// the refund already reversed them
+	returned := filter(db.Model(&models.ReturnItem{}).
+		Select(columns+"sum("+returnItemsTable+".quantity * "+netTotal+")").
+		Joins("JOIN "+returnsTable+" ON "+returnsTable+".id = "+returnItemsTable+".return_id").
+		Joins("JOIN "+itemsTable+" ON "+itemsTable+".id = "+returnItemsTable+".line_item_id").
+		Where(returnsTable+".status = ?", models.ReturnApprovedState).
+		Where(returnItemsTable + ".line_item_id NOT IN (SELECT line_item_id FROM " + notesTable + " WHERE line_item_id > 0)"))
+	if err := scan(returned, func(row *productsRow) []interface{} {
+		return []interface{}{&row.Refunded}
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, row := range result {
+		if deductions := row.Discount + row.Refunded; deductions < row.Total {
+			row.NetRevenue = row.Total - deductions
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Total != result[j].Total {
+			return result[i].Total > result[j].Total
+		}
+		return result[i].Sku < result[j].Sku
+	})
+	return result, nil
+}
+
+// DashboardReport sums up the revenue, orders, average order value and
+// refunds of today and the last 7 and 30 days, including today in the
+// timezone of the report, with the best selling products of the last 30
+// days, so admin dashboards don't have to query each report on their own.
+func (a *API) DashboardReport(w http.ResponseWriter, r *http.Request) error {
+	db := a.DB(r)
+	log := getLogEntry(r)
+	params := r.URL.Query()
+	instanceID := gcontext.GetInstanceID(r.Context())
+	test, err := getTestQueryParam(params)
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	archived, err := getArchivedQueryParam(params)
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	loc, err := getTimezoneQueryParam(params, gcontext.GetConfig(r.Context()))
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	top := defaultDashboardProducts
+	if value := params.Get("top"); value != "" {
+		top, err = strconv.Atoi(value)
+		if err != nil || top < 0 {
+			return badRequestError("bad value for 'top' parameter: %v", value)
+		}
+	}
+
+	state, err := models.FindSalesRollupState(db, instanceID)
+	if err != nil {
+		log.WithError(err).Warn("Error loading sales rollups, querying orders instead")
+		state = nil
+	}
+	today := startOfDay(time.Now(), loc)
+	report := &dashboardReport{}
+	for _, window := range []struct {
+		rows *[]*dashboardRow
+		days int
+	}{{&report.Today, 1}, {&report.Last7Days, 7}, {&report.Last30Days, 30}} {
+		from := today.AddDate(0, 0, 1-window.days).UTC()
+		rows, err := dashboardSales(db, log, state, instanceID, test, archived, from)
+		if err != nil {
+			return internalServerError("Database error").WithInternalError(err)
+		}
+		*window.rows = rows
+	}
+
+	from := today.AddDate(0, 0, -29).UTC()
+	products, err := productSales(db, instanceID, test, archived, &from, nil)
+	if err != nil {
+		return internalServerError("Database error").WithInternalError(err)
+	}
+	if len(products) > top {
+		products = products[:top]
+	}
+	report.TopProducts = products
+
+	return sendJSON(w, http.StatusOK, report)
+}
+
+// dashboardSales returns the sales and refunds by currency since from.
+func dashboardSales(db *gorm.DB, log logrus.FieldLogger, state *models.SalesRollupState, instanceID string, test, archived bool, from time.Time) ([]*dashboardRow, error) {
+	sales, err := querySales(db, log, state, instanceID, test, archived, &from, nil)
+	if err != nil {
+		return nil, err
+	}
+	rows := map[string]*dashboardRow{}
+	result := []*dashboardRow{}
+	rowFor := func(currency string) *dashboardRow {
+		row, ok := rows[currency]
+		if !ok {
+			row = &dashboardRow{Currency: currency}
+			rows[currency] = row
+			result = append(result, row)
+		}
+		return row
+	}
+	for _, sale := range sales {
+		row := rowFor(sale.Currency)
+		row.Revenue = sale.Total
+		row.Orders = sale.Orders
+		if sale.Orders > 0 {
+			row.AverageOrderValue = sale.Total / sale.Orders
+		}
+	}
+
+	ordersTable := db.NewScope(models.Order{}).QuotedTableName()
+	transactionsTable := db.NewScope(models.Transaction{}).QuotedTableName()
+	refunds, err := db.
+		Model(&models.Transaction{}).
+		Select(transactionsTable+".currency, sum("+transactionsTable+".amount)").
+		Joins("JOIN "+ordersTable+" ON "+ordersTable+".id = "+transactionsTable+".order_id").
+		Where(transactionsTable+".instance_id = ? AND "+transactionsTable+".type = ? AND "+transactionsTable+".status = ?", instanceID, models.RefundTransactionType, models.PaidState).
+		Where(transactionsTable+".created_at >= ? AND "+ordersTable+".test = ?", from, test).
+		Where(archivedCondition(ordersTable, archived)).
+		Group(transactionsTable + ".currency").
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer refunds.Close()
+	for refunds.Next() {
+		var currency string
+		var amount uint64
+		if err := refunds.Scan(&currency, &amount); err != nil {
+			return nil, err
+		}
+		rowFor(currency).Refunds += amount
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Currency < result[j].Currency })
+	return result, nil
+}
 
-	query, err := parseTimeQueryParams(query, query.NewScope(models.Order{}).QuotedTableName(), r.URL.Query())
+// CohortsReport groups the customers by the month of their first purchase in
+// a currency and lists the repeat purchase rate and the revenue of each
+// cohort per month since, from the rolled up customer months. The from and
+// to params pick the cohorts. The months are rolled up in the timezone of the
+// reports configuration, so other timezones can't be picked.
+func (a *API) CohortsReport(w http.ResponseWriter, r *http.Request) error {
+	db := a.DB(r)
+	params := r.URL.Query()
+	instanceID := gcontext.GetInstanceID(r.Context())
+	config := gcontext.GetConfig(r.Context())
+	from, to, err := getTimeQueryParams(params)
 	if err != nil {
 		return badRequestError(err.Error())
 	}
+	loc, err := reportsLocation(config)
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	if tz, err := getTimezoneQueryParam(params, config); err != nil {
+		return badRequestError(err.Error())
+	} else if tz.String() != loc.String() {
+		return badRequestError("The cohorts report is only available in the reports timezone %v", loc)
+	}
 
+	query := db.Model(&models.CustomerMonth{}).
+		Select("cohort, currency, month, count(*), sum(orders), sum(revenue), sum(CASE WHEN repeated THEN 1 ELSE 0 END)").
+		Where("instance_id = ?", instanceID).
+		Group("cohort, currency, month").
+		Order("cohort, currency, month")
+	if from != nil {
+		query = query.Where("cohort >= ?", models.CohortMonth(*from, loc))
+	}
+	if to != nil {
+		query = query.Where("cohort <= ?", to.UTC())
+	}
+	if currency := params.Get("currency"); currency != "" {
+		query = query.Where("currency = ?", currency)
+	}
 	rows, err := query.Rows()
 	if err != nil {
 		return internalServerError("Database error").WithInternalError(err)
 	}
 	defer rows.Close()
-	result := []*salesRow{}
+
+	result := []*cohortRow{}
+	var cohort *cohortRow
 	for rows.Next() {
-		row := &salesRow{}
-		err = rows.Scan(&row.Total, &row.SubTotal, &row.Taxes, &row.Currency, &row.Orders)
-		if err != nil {
+		var start, month time.Time
+		var currency string
+		var repeated uint64
+		row := &cohortMonthRow{}
+		if err := rows.Scan(&start, &currency, &month, &row.Customers, &row.Orders, &row.Revenue, &repeated); err != nil {
 			return internalServerError("Database error").WithInternalError(err)
 		}
-		result = append(result, row)
+		start, month = start.In(loc), month.In(loc)
+		if cohort == nil || cohort.Cohort != start.Format("2006-01") || cohort.Currency != currency {
+			// every customer of a cohort purchased in its first month
+			cohort = &cohortRow{Cohort: start.Format("2006-01"), Currency: currency, Customers: row.Customers}
+			result = append(result, cohort)
+		}
+		row.Month = (month.Year()-start.Year())*12 + int(month.Month()) - int(start.Month())
+		cohort.RepeatCustomers += repeated
+		cohort.Revenue += row.Revenue
+		if cohort.Customers > 0 {
+			row.RepeatRate = float64(cohort.RepeatCustomers) / float64(cohort.Customers)
+		}
+		cohort.RepeatRate = row.RepeatRate
+		cohort.Months = append(cohort.Months, row)
+	}
+	if err := rows.Err(); err != nil {
+		return internalServerError("Database error").WithInternalError(err)
 	}
 
-	return sendJSON(w, http.StatusOK, result)
+	if params.Get("format") != "csv" {
+		return sendJSON(w, http.StatusOK, result)
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="cohorts.csv"`)
+	w.WriteHeader(http.StatusOK)
+	out := csv.NewWriter(w)
+	out.Write([]string{"cohort", "currency", "month", "customers", "orders", "revenue", "repeat_rate"})
+	for _, cohort := range result {
+		for _, row := range cohort.Months {
+			out.Write([]string{cohort.Cohort, cohort.Currency, strconv.Itoa(row.Month), strconv.FormatUint(row.Customers, 10), strconv.FormatUint(row.Orders, 10), formatAmount(row.Revenue), strconv.FormatFloat(row.RepeatRate, 'f', 4, 64)})
+		}
+	}
+	out.Flush()
+	return out.Error()
 }
 
-// ProductsReport list the products sold within a period
-func (a *API) ProductsReport(w http.ResponseWriter, r *http.Request) error {
+// DownloadsReport lists how often the downloads of each product were accessed
+// per day within a period, from how many IPs and the bandwidth they used.
+// The accesses are logged with their UTC day, so they're grouped by the days
+// of other timezones as they're read.
+func (a *API) DownloadsReport(w http.ResponseWriter, r *http.Request) error {
 	db := a.DB(r)
 	instanceID := gcontext.GetInstanceID(r.Context())
 	ordersTable := db.NewScope(models.Order{}).QuotedTableName()
-	itemsTable := db.NewScope(models.LineItem{}).QuotedTableName()
+	logsTable := db.NewScope(models.DownloadLog{}).QuotedTableName()
+	loc, err := getTimezoneQueryParam(r.URL.Query(), gcontext.GetConfig(r.Context()))
+	if err != nil {
+		return badRequestError(err.Error())
+	}
 	query := db.
-		Model(&models.LineItem{}).
-		Select("sku, path, sum(quantity * price) as total, currency").
-		Joins("JOIN " + ordersTable + " ON " + ordersTable + ".id = " + itemsTable + ".order_id " + "AND " + ordersTable + ".payment_state = 'paid'").
-		Group("sku, path, currency").
-		Order("total desc")
+		Model(&models.DownloadLog{}).
+		Joins("JOIN "+ordersTable+" ON "+ordersTable+".id = "+logsTable+".order_id").
+		Where(logsTable+".instance_id = ?", instanceID)
 
-	query = query.Where(ordersTable+".instance_id = ?", instanceID)
-	from, to, err := getTimeQueryParams(r.URL.Query())
+	test, err := getTestQueryParam(r.URL.Query())
 	if err != nil {
 		return badRequestError(err.Error())
 	}
-	if from != nil {
-		query = query.Where(ordersTable+".created_at >= ?", from)
-	}
-	if to != nil {
-		query.Where(ordersTable+".created_at <= ?", to)
+	query = query.Where(ordersTable+".test = ?", test)
+	query = addFilters(query, logsTable, r.URL.Query(), []string{"sku"})
+	query, err = parseTimeQueryParams(query, logsTable, r.URL.Query())
+	if err != nil {
+		return badRequestError(err.Error())
 	}
 
-	rows, err := query.Rows()
+	var result []*downloadsRow
+	if loc == time.UTC {
+		result, err = utcDownloadsRows(query, logsTable)
+	} else {
+		result, err = localDownloadsRows(query, logsTable, loc)
+	}
 	if err != nil {
 		return internalServerError("Database error").WithInternalError(err)
 	}
+
+	return sendJSON(w, http.StatusOK, result)
+}
+
+// utcDownloadsRows groups the accesses by their logged UTC day.
+func utcDownloadsRows(query *gorm.DB, logsTable string) ([]*downloadsRow, error) {
+	rows, err := query.
+		Select(logsTable + ".sku, " + logsTable + ".day, count(*) as downloads, count(distinct(" + logsTable + ".ip)) as unique_ips, sum(" + logsTable + ".bytes) as bandwidth").
+		Group(logsTable + ".sku, " + logsTable + ".day").
+		Order(logsTable + ".day asc, downloads desc").
+		Rows()
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
-	result := []*productsRow{}
+	result := []*downloadsRow{}
+	for rows.Next() {
+		row := &downloadsRow{}
+		if err := rows.Scan(&row.Sku, &row.Day, &row.Downloads, &row.UniqueIPs, &row.Bandwidth); err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+	return result, nil
+}
+
+// localDownloadsRows groups the accesses by the day of their time in the
+// location.
+func localDownloadsRows(query *gorm.DB, logsTable string, loc *time.Location) ([]*downloadsRow, error) {
+	rows, err := query.
+		Select(logsTable + ".sku, " + logsTable + ".created_at, " + logsTable + ".ip, " + logsTable + ".bytes").
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	downloads := map[string]*downloadsRow{}
+	ips := map[string]map[string]bool{}
+	result := []*downloadsRow{}
 	for rows.Next() {
-		row := &productsRow{}
-		err = rows.Scan(&row.Sku, &row.Path, &row.Total, &row.Currency)
+		var sku, ip string
+		var createdAt time.Time
+		var bytes uint64
+		if err := rows.Scan(&sku, &createdAt, &ip, &bytes); err != nil {
+			return nil, err
+		}
+		day := createdAt.In(loc).Format("2006-01-02")
+		key := sku + "\x00" + day
+		row, ok := downloads[key]
+		if !ok {
+			row = &downloadsRow{Sku: sku, Day: day}
+			downloads[key] = row
+			ips[key] = map[string]bool{}
+			result = append(result, row)
+		}
+		row.Downloads++
+		row.Bandwidth += bytes
+		if !ips[key][ip] {
+			ips[key][ip] = true
+			row.UniqueIPs++
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Day != result[j].Day {
+			return result[i].Day < result[j].Day
+		}
+		return result[i].Downloads > result[j].Downloads
+	})
+	return result, nil
+}
+
+// VATReport aggregates the VAT charged on digital goods sold to consumers in
+// other EU member states per member state and VAT rate within a quarter, as
+// filed in OSS returns. Sales count in the quarter they were paid in, refunds
+// in the quarter they were paid out in, taking their share of the VAT of the
+// order's digital goods. Digital goods are the line items with downloads or
+// licenses, or those of the product types in the query parameters. Reverse
+// charged orders are left out, as their VAT is accounted for by the buyer, and
+// so are sales to the member state of the seller, which are domestic.
+func (a *API) VATReport(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	db := a.DB(r)
+	instanceID := gcontext.GetInstanceID(ctx)
+	params := r.URL.Query()
+	loc, err := getTimezoneQueryParam(params, gcontext.GetConfig(ctx))
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	from, to, err := getQuarterQueryParam(params, loc)
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	test, err := getTestQueryParam(params)
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	settings, err := a.loadSettings(ctx)
+	if err != nil {
+		return internalServerError(err.Error()).WithInternalError(err)
+	}
+	seller, _ := calculator.EUVATCountryCode(settings.VATCountry)
+
+	ordersTable := db.NewScope(models.Order{}).QuotedTableName()
+	itemsTable := db.NewScope(models.LineItem{}).QuotedTableName()
+	addressesTable := db.NewScope(models.Address{}).QuotedTableName()
+	downloadsTable := db.NewScope(models.Download{}).QuotedTableName()
+	transactionsTable := db.NewScope(models.Transaction{}).QuotedTableName()
+	digitalItems := func() *gorm.DB {
+		query := db.
+			Model(&models.LineItem{}).
+			Select(addressesTable+".country, "+ordersTable+".currency, "+ordersTable+".id, "+itemsTable+".quantity, "+
+				itemsTable+".calculation_net_total, "+itemsTable+".calculation_taxes, "+itemsTable+".calculation_raw_tax_rates").
+			Joins("JOIN "+ordersTable+" ON "+ordersTable+".id = "+itemsTable+".order_id").
+			Joins("JOIN "+addressesTable+" ON "+addressesTable+".id = "+ordersTable+".billing_address_id").
+			Where(ordersTable+".instance_id = ? AND "+ordersTable+".test = ? AND "+ordersTable+".reverse_charge = ?", instanceID, test, false)
+		if types, ok := params["product_type"]; ok {
+			return query.Where(itemsTable+".type IN (?)", types)
+		}
+		return query.Where(itemsTable+".requires_license = ? OR EXISTS (SELECT 1 FROM "+downloadsTable+" WHERE "+
+			downloadsTable+".order_id = "+itemsTable+".order_id AND "+downloadsTable+".sku = "+itemsTable+".sku)", true)
+	}
+
+	grouped := map[string]*vatRow{}
+	add := func(code, currency, orderID string, rate float64, taxable, vat int64) {
+		key := fmt.Sprintf("%s/%s/%v", code, currency, rate)
+		row, exists := grouped[key]
+		if !exists {
+			row = &vatRow{CountryCode: code, Currency: currency, Rate: rate, orders: map[string]bool{}}
+			grouped[key] = row
+		}
+		row.TaxableAmount += taxable
+		row.VAT += vat
+		if taxable > 0 {
+			row.orders[orderID] = true
+			row.Orders = uint64(len(row.orders))
+		}
+	}
+	// addItems adds the VAT of the line items, multiplied by the share of
+	// their order: 1 for sales and the negative refunded share for refunds.
+	addItems := func(query *gorm.DB, share func(orderID string) float64) error {
+		rows, err := query.Rows()
 		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var country, currency, orderID string
+			var quantity, netTotal, taxes uint64
+			var rawRates *string
+			if err := rows.Scan(&country, &currency, &orderID, &quantity, &netTotal, &taxes, &rawRates); err != nil {
+				return err
+			}
+			code, ok := calculator.EUVATCountryCode(country)
+			if !ok || code == seller || netTotal == 0 || taxes == 0 {
+				continue
+			}
+			factor := share(orderID)
+			scale := func(amount uint64) int64 {
+				return int64(math.Round(float64(amount*quantity) * factor))
+			}
+
+			// Use the rates the line item was taxed at, falling back to the
+			// effective rate for items priced before they were stored.
+			if rawRates != nil && *rawRates != "" {
+				var rates []calculator.TaxRate
+				if err := json.Unmarshal([]byte(*rawRates), &rates); err != nil {
+					return errors.Wrap(err, "Error decoding tax rates")
+				}
+				if len(rates) > 0 {
+					for _, rate := range rates {
+						add(code, currency, orderID, rate.Rate, scale(rate.TaxableAmount), scale(rate.Amount))
+					}
+					continue
+				}
+			}
+			rate := math.Round(float64(taxes) * 100 / float64(netTotal))
+			add(code, currency, orderID, rate, scale(netTotal), scale(taxes))
+		}
+		return rows.Err()
+	}
+
+	paidAt := "COALESCE((SELECT min(" + transactionsTable + ".created_at) FROM " + transactionsTable + " WHERE " +
+		transactionsTable + ".order_id = " + ordersTable + ".id AND " + transactionsTable + ".type = ? AND " +
+		transactionsTable + ".status = ?), " + ordersTable + ".created_at)"
+	sales := digitalItems().
+		Where(ordersTable+".payment_state IN (?)", []string{models.PaidState, models.RefundedState}).
+		Where(paidAt+" >= ? AND "+paidAt+" < ?", models.ChargeTransactionType, models.PaidState, from.UTC(), models.ChargeTransactionType, models.PaidState, to.UTC())
+	if err := addItems(sales, func(string) float64 { return 1 }); err != nil {
+		return internalServerError("Database error").WithInternalError(err)
+	}
+
+	refundRows, err := db.
+		Model(&models.Transaction{}).
+		Select(ordersTable+".id, "+ordersTable+".total, sum("+transactionsTable+".amount)").
+		Joins("JOIN "+ordersTable+" ON "+ordersTable+".id = "+transactionsTable+".order_id").
+		Where(transactionsTable+".type = ? AND "+transactionsTable+".status = ?", models.RefundTransactionType, models.PaidState).
+		Where(transactionsTable+".created_at >= ? AND "+transactionsTable+".created_at < ?", from.UTC(), to.UTC()).
+		Where(ordersTable+".instance_id = ? AND "+ordersTable+".test = ?", instanceID, test).
+		Group(ordersTable + ".id, " + ordersTable + ".total").
+		Rows()
+	if err != nil {
+		return internalServerError("Database error").WithInternalError(err)
+	}
+	refunded := map[string]float64{}
+	refundedOrders := []string{}
+	for refundRows.Next() {
+		var orderID string
+		var total, amount uint64
+		if err := refundRows.Scan(&orderID, &total, &amount); err != nil {
+			refundRows.Close()
+			return internalServerError("Database error").WithInternalError(err)
+		}
+		if total == 0 {
+			continue
+		}
+		refunded[orderID] = -math.Min(float64(amount)/float64(total), 1)
+		refundedOrders = append(refundedOrders, orderID)
+	}
+	refundRows.Close()
+	if len(refundedOrders) > 0 {
+		refunds := digitalItems().Where(ordersTable+".id IN (?)", refundedOrders)
+		if err := addItems(refunds, func(orderID string) float64 { return refunded[orderID] }); err != nil {
 			return internalServerError("Database error").WithInternalError(err)
 		}
+	}
+
+	result := make([]*vatRow, 0, len(grouped))
+	for _, row := range grouped {
 		result = append(result, row)
 	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].CountryCode != result[j].CountryCode {
+			return result[i].CountryCode < result[j].CountryCode
+		}
+		if result[i].Currency != result[j].Currency {
+			return result[i].Currency < result[j].Currency
+		}
+		return result[i].Rate > result[j].Rate
+	})
+
+	if params.Get("format") != "csv" {
+		return sendJSON(w, http.StatusOK, result)
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="vat-%s.csv"`, params.Get("quarter")))
+	w.WriteHeader(http.StatusOK)
+	out := csv.NewWriter(w)
+	out.Write([]string{"member_state", "vat_rate", "currency", "taxable_amount", "vat_amount"})
+	for _, row := range result {
+		out.Write([]string{row.CountryCode, strconv.FormatFloat(row.Rate, 'f', -1, 64), row.Currency, formatSignedAmount(row.TaxableAmount), formatSignedAmount(row.VAT)})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// LowStockReport lists the tracked products whose quantity in stock at a
+// location is below their low stock threshold there, or the default threshold
+// of the configuration.
+func (a *API) LowStockReport(w http.ResponseWriter, r *http.Request) error {
+	db := a.DB(r)
+	ctx := r.Context()
+	instanceID := gcontext.GetInstanceID(ctx)
+	defaultThreshold := gcontext.GetConfig(ctx).Stock.LowStockThreshold
+
+	stock := []*models.StockItem{}
+	if rsp := db.Where("instance_id = ?", instanceID).Order("sku, location").Find(&stock); rsp.Error != nil {
+		return internalServerError("Database error").WithInternalError(rsp.Error)
+	}
+	result := []*lowStockRow{}
+	skus := []string{}
+	for _, item := range stock {
+		if !item.LowStock(defaultThreshold) {
+			continue
+		}
+		result = append(result, &lowStockRow{Sku: item.Sku, Location: item.Location, Quantity: item.Quantity, Threshold: item.Threshold(defaultThreshold)})
+		skus = append(skus, item.Sku)
+	}
+	if len(skus) > 0 {
+		reserved, err := models.ReservedStock(db, instanceID, skus, "", time.Now())
+		if err != nil {
+			return internalServerError("Database error").WithInternalError(err)
+		}
+		for _, row := range result {
+			row.Reserved = reserved[row.Sku]
+		}
+	}
 
 	return sendJSON(w, http.StatusOK, result)
 }
+
+// formatAmount formats an amount in the lowest unit of a currency with two
+// decimals.
+func formatAmount(amount uint64) string {
+	return fmt.Sprintf("%d.%02d", amount/100, amount%100)
+}
+
+// formatSignedAmount formats an amount like formatAmount, with a minus sign
+// if it's negative.
+func formatSignedAmount(amount int64) string {
+	if amount < 0 {
+		return "-" + formatAmount(uint64(-amount))
+	}
+	return formatAmount(uint64(amount))
+}
@@ -1,10 +1,20 @@
 package api
 
 import (
+	"context"
+	"encoding/csv"
+	"fmt"
 	"net/http"
 	"testing"
+	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/models"
 )
 
 func TestSalesReport(t *testing.T) {
@@ -23,6 +33,56 @@ func TestSalesReport(t *testing.T) {
 		assert.Equal(t, "USD", row.Currency)
 		assert.Equal(t, uint64(2), row.Orders)
 	})
+	t.Run("TestOrders", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		require.NoError(t, test.DB.Model(test.Data.secondOrder).Update("test", true).Error)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/sales", nil, token)
+		report := []salesRow{}
+		extractPayload(t, http.StatusOK, recorder, &report)
+		require.Len(t, report, 1)
+		assert.Equal(t, uint64(24), report[0].Total)
+		assert.Equal(t, uint64(1), report[0].Orders)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/reports/sales?test=true", nil, token)
+		extractPayload(t, http.StatusOK, recorder, &report)
+		require.Len(t, report, 1)
+		assert.Equal(t, uint64(55), report[0].Total)
+		assert.Equal(t, uint64(1), report[0].Orders)
+	})
+	t.Run("ArchivedOrders", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/second-order/archive", nil, token)
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+		recorder = test.TestEndpoint(http.MethodGet, "/reports/sales", nil, token)
+		report := []salesRow{}
+		extractPayload(t, http.StatusOK, recorder, &report)
+		require.Len(t, report, 1)
+		assert.Equal(t, uint64(24), report[0].Total)
+		assert.Equal(t, uint64(1), report[0].Orders)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/reports/sales?archived=true", nil, token)
+		extractPayload(t, http.StatusOK, recorder, &report)
+		require.Len(t, report, 1)
+		assert.Equal(t, uint64(55), report[0].Total)
+	})
+}
+
+func TestSalesReportFees(t *testing.T) {
+	test := NewRouteTest(t)
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	require.NoError(t, test.DB.Model(test.Data.firstTransaction).Update("fee", 33).Error)
+	require.NoError(t, test.DB.Model(test.Data.secondTransaction).Update("fee", 2).Error)
+
+	recorder := test.TestEndpoint(http.MethodGet, "/reports/sales", nil, token)
+	report := []salesRow{}
+	extractPayload(t, http.StatusOK, recorder, &report)
+	require.Len(t, report, 1)
+	assert.EqualValues(t, 35, report[0].Fees)
+	assert.EqualValues(t, 44, report[0].NetRevenue)
 }
 
 func TestProductsReport(t *testing.T) {
@@ -43,3 +103,411 @@ func TestProductsReport(t *testing.T) {
 	assert.Equal(t, "456-i-rollover-all-things", prod3.Sku)
 	assert.Equal(t, uint64(10), prod3.Total)
 }
+
+func TestProductsReportRefunds(t *testing.T) {
+	test := NewRouteTest(t)
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	require.NoError(t, test.DB.Model(&models.LineItem{}).Where("id = ?", 11).UpdateColumns(map[string]interface{}{
+		"calculation_subtotal": 12, "calculation_discount": 3, "calculation_net_total": 9, "calculation_total": 9,
+	}).Error)
+	require.NoError(t, test.DB.Model(&models.LineItem{}).Where("id = ?", 21).UpdateColumns(map[string]interface{}{
+		"calculation_subtotal": 5, "calculation_net_total": 5, "calculation_taxes": 1, "calculation_total": 6,
+	}).Error)
+	require.NoError(t, test.DB.Model(&models.LineItem{}).Where("id = ?", 22).UpdateColumns(map[string]interface{}{
+		"calculation_subtotal": 40, "calculation_net_total": 40, "calculation_taxes": 5, "calculation_total": 45,
+	}).Error)
+	require.NoError(t, test.DB.Model(test.Data.secondOrder).UpdateColumn("payment_state", models.RefundedState).Error)
+	require.NoError(t, test.DB.Create(&models.CreditNote{
+		ID:       "second-credit-note",
+		OrderID:  test.Data.secondOrder.ID,
+		RefundID: "second-refund",
+		Currency: "USD",
+		Total:    -45,
+		Items:    []*models.CreditNoteItem{{LineItemID: 22, Sku: "234-fancy-belts", Quantity: 1, NetTotal: -40, Taxes: -5, Total: -45}},
+	}).Error)
+	require.NoError(t, test.DB.Create(&models.Return{
+		ID:      "second-return",
+		OrderID: test.Data.secondOrder.ID,
+		Status:  models.ReturnApprovedState,
+		Items: []*models.ReturnItem{
+			{LineItemID: 21, Sku: "456-i-rollover-all-things", Quantity: 2, Amount: 12},
+			{LineItemID: 22, Sku: "234-fancy-belts", Quantity: 1, Amount: 45},
+		},
+	}).Error)
+
+	recorder := test.TestEndpoint(http.MethodGet, "/reports/products", nil, token)
+	report := []productsRow{}
+	extractPayload(t, http.StatusOK, recorder, &report)
+	require.Len(t, report, 3)
+	assert.Equal(t, "234-fancy-belts", report[0].Sku)
+	assert.EqualValues(t, 40, report[0].Total)
+	assert.EqualValues(t, 40, report[0].Refunded)
+	assert.EqualValues(t, 0, report[0].NetRevenue)
+	assert.Equal(t, "123-i-can-fly-456", report[1].Sku)
+	assert.EqualValues(t, 2, report[1].Quantity)
+	assert.EqualValues(t, 6, report[1].Discount)
+	assert.EqualValues(t, 18, report[1].NetRevenue)
+	assert.Equal(t, "456-i-rollover-all-things", report[2].Sku)
+	assert.EqualValues(t, 10, report[2].Total)
+	assert.EqualValues(t, 10, report[2].Refunded)
+	assert.EqualValues(t, 0, report[2].NetRevenue)
+
+	recorder = test.TestEndpoint(http.MethodGet, "/reports/products?format=csv", nil, token)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "text/csv", recorder.Header().Get("Content-Type"))
+	records, err := csv.NewReader(recorder.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+	assert.Equal(t, []string{"sku", "path", "currency", "quantity", "gross_revenue", "discount", "refunded", "net_revenue"}, records[0])
+	assert.Equal(t, []string{"123-i-can-fly-456", report[1].Path, "USD", "2", "0.24", "0.06", "0.00", "0.18"}, records[2])
+}
+
+func TestDashboardReport(t *testing.T) {
+	test := NewRouteTest(t)
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	require.NoError(t, test.DB.Model(test.Data.secondOrder).UpdateColumn("created_at", time.Now().AddDate(0, 0, -10)).Error)
+	refund := models.NewRefund(test.Data.firstTransaction, 4)
+	refund.Status = models.PaidState
+	require.NoError(t, test.DB.Create(refund).Error)
+
+	recorder := test.TestEndpoint(http.MethodGet, "/reports/dashboard?top=2", nil, token)
+	report := &dashboardReport{}
+	extractPayload(t, http.StatusOK, recorder, report)
+	expected := &dashboardRow{Currency: "USD", Revenue: 24, Orders: 1, AverageOrderValue: 24, Refunds: 4}
+	assert.Equal(t, []*dashboardRow{expected}, report.Today)
+	assert.Equal(t, []*dashboardRow{expected}, report.Last7Days)
+	assert.Equal(t, []*dashboardRow{{Currency: "USD", Revenue: 79, Orders: 2, AverageOrderValue: 39, Refunds: 4}}, report.Last30Days)
+	require.Len(t, report.TopProducts, 2)
+	assert.Equal(t, "234-fancy-belts", report.TopProducts[0].Sku)
+	assert.Equal(t, "123-i-can-fly-456", report.TopProducts[1].Sku)
+
+	recorder = test.TestEndpoint(http.MethodGet, "/reports/dashboard?top=many", nil, token)
+	validateError(t, http.StatusBadRequest, recorder)
+}
+
+func TestCohortsReport(t *testing.T) {
+	test := NewRouteTest(t)
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	require.NoError(t, test.DB.Model(test.Data.firstOrder).UpdateColumn("created_at", time.Date(2026, 8, 10, 12, 0, 0, 0, time.UTC)).Error)
+	require.NoError(t, test.DB.Model(test.Data.secondOrder).UpdateColumn("created_at", time.Date(2026, 9, 5, 12, 0, 0, 0, time.UTC)).Error)
+	ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+	require.NoError(t, err)
+	api := NewAPIWithVersion(ctx, test.GlobalConfig, logrus.StandardLogger(), test.DB, "")
+	api.rollupCohorts(ctx, test.DB, logrus.StandardLogger(), time.Now())
+
+	recorder := test.TestEndpoint(http.MethodGet, "/reports/cohorts", nil, token)
+	report := []*cohortRow{}
+	extractPayload(t, http.StatusOK, recorder, &report)
+	assert.Equal(t, []*cohortRow{{
+		Cohort:          "2026-08",
+		Currency:        "USD",
+		Customers:       1,
+		RepeatCustomers: 1,
+		RepeatRate:      1,
+		Revenue:         79,
+		Months: []*cohortMonthRow{
+			{Month: 0, Customers: 1, Orders: 1, Revenue: 24},
+			{Month: 1, Customers: 1, Orders: 1, Revenue: 55, RepeatRate: 1},
+		},
+	}}, report)
+
+	require.NoError(t, test.DB.Model(test.Data.secondOrder).Update("test", true).Error)
+	api.rollupCohorts(ctx, test.DB, logrus.StandardLogger(), time.Now())
+	recorder = test.TestEndpoint(http.MethodGet, "/reports/cohorts?format=csv", nil, token)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	records, err := csv.NewReader(recorder.Body).ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"cohort", "currency", "month", "customers", "orders", "revenue", "repeat_rate"},
+		{"2026-08", "USD", "0", "1", "1", "0.24", "0.0000"},
+	}, records)
+}
+
+func TestDownloadsReport(t *testing.T) {
+	test := NewRouteTest(t)
+	require.NoError(t, test.DB.Model(&models.Download{}).Where("id = ?", "first-download").Update("size", 1000).Error)
+	for i := 0; i < 2; i++ {
+		recorder := test.TestEndpoint(http.MethodGet, "/downloads/first-download", nil, test.Data.testUserToken)
+		require.Equal(t, http.StatusOK, recorder.Code)
+	}
+	download := &models.Download{}
+	require.NoError(t, test.DB.First(download, "id = ?", "first-download").Error)
+	require.NoError(t, models.LogDownload(test.DB, test.Data.firstOrder, download, "10.0.0.1", ""))
+
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	recorder := test.TestEndpoint(http.MethodGet, "/reports/downloads", nil, token)
+	report := []downloadsRow{}
+	extractPayload(t, http.StatusOK, recorder, &report)
+	require.Len(t, report, 1)
+	assert.Equal(t, "123-i-can-fly-456", report[0].Sku)
+	assert.Equal(t, time.Now().UTC().Format("2006-01-02"), report[0].Day)
+	assert.Equal(t, uint64(3), report[0].Downloads)
+	assert.Equal(t, uint64(2), report[0].UniqueIPs)
+	assert.Equal(t, uint64(3000), report[0].Bandwidth)
+
+	recorder = test.TestEndpoint(http.MethodGet, "/reports/downloads?sku=other", nil, token)
+	extractPayload(t, http.StatusOK, recorder, &report)
+	assert.Empty(t, report)
+}
+
+func TestReportsTimezone(t *testing.T) {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	t.Run("Dashboard", func(t *testing.T) {
+		test := NewRouteTest(t)
+		loc, err := time.LoadLocation("Pacific/Kiritimati")
+		require.NoError(t, err)
+		today := startOfDay(time.Now(), loc)
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).UpdateColumn("created_at", today.Add(time.Minute).UTC()).Error)
+		require.NoError(t, test.DB.Model(test.Data.secondOrder).UpdateColumn("created_at", today.Add(-time.Minute).UTC()).Error)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/dashboard?timezone=Pacific/Kiritimati", nil, token)
+		report := &dashboardReport{}
+		extractPayload(t, http.StatusOK, recorder, report)
+		require.Len(t, report.Today, 1)
+		assert.Equal(t, uint64(24), report.Today[0].Revenue)
+		require.Len(t, report.Last7Days, 1)
+		assert.Equal(t, uint64(79), report.Last7Days[0].Revenue)
+	})
+	t.Run("Downloads", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Reports.Timezone = "Europe/Berlin"
+		for i, createdAt := range []time.Time{
+			time.Date(2026, 10, 13, 21, 30, 0, 0, time.UTC),
+			time.Date(2026, 10, 13, 22, 30, 0, 0, time.UTC),
+		} {
+			require.NoError(t, test.DB.Create(&models.DownloadLog{
+				OrderID:   test.Data.firstOrder.ID,
+				Sku:       "123-i-can-fly-456",
+				IP:        fmt.Sprintf("10.0.0.%d", i),
+				Bytes:     100,
+				Day:       createdAt.Format("2006-01-02"),
+				CreatedAt: createdAt,
+			}).Error)
+		}
+
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/downloads", nil, token)
+		report := []downloadsRow{}
+		extractPayload(t, http.StatusOK, recorder, &report)
+		assert.Equal(t, []downloadsRow{
+			{Sku: "123-i-can-fly-456", Day: "2026-10-13", Downloads: 1, UniqueIPs: 1, Bandwidth: 100},
+			{Sku: "123-i-can-fly-456", Day: "2026-10-14", Downloads: 1, UniqueIPs: 1, Bandwidth: 100},
+		}, report)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/reports/downloads?timezone=UTC", nil, token)
+		extractPayload(t, http.StatusOK, recorder, &report)
+		assert.Equal(t, []downloadsRow{{Sku: "123-i-can-fly-456", Day: "2026-10-13", Downloads: 2, UniqueIPs: 2, Bandwidth: 200}}, report)
+	})
+	t.Run("Cohorts", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Reports.Timezone = "America/New_York"
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/cohorts?timezone=UTC", nil, token)
+		validateError(t, http.StatusBadRequest, recorder, "The cohorts report is only available in the reports timezone America/New_York")
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/vat?quarter=2026-Q3&timezone=Mars/Olympus", nil, token)
+		validateError(t, http.StatusBadRequest, recorder, "bad value for 'timezone' parameter: Mars/Olympus")
+	})
+}
+
+func TestPaymentReconciliationReport(t *testing.T) {
+	test := NewRouteTest(t)
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	require.NoError(t, test.DB.Model(test.Data.firstTransaction).Update("provider", "stripe").Error)
+
+	pending := models.NewTransaction(test.Data.firstOrder)
+	pending.Provider = "stripe"
+	pending.ProcessorID = "pi_pending"
+	pending.Status = models.PendingState
+	require.NoError(t, test.DB.Create(pending).Error)
+
+	unknown := models.NewTransaction(test.Data.secondOrder)
+	unknown.Provider = "stripe"
+	unknown.ProcessorID = "pi_unknown"
+	unknown.Status = models.PaidState
+	require.NoError(t, test.DB.Create(unknown).Error)
+
+	now := time.Now().Unix()
+	stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+		switch path {
+		case "/v1/charges":
+			list := v.(*stripe.ChargeList)
+			list.Data = []*stripe.Charge{
+				{ID: "ch_1", PaymentIntent: test.Data.firstTransaction.ProcessorID, Amount: 100, Currency: "usd", Status: "succeeded", Captured: true, Created: now, BalanceTransaction: &stripe.BalanceTransaction{Fee: 33}},
+				{ID: "ch_2", PaymentIntent: "pi_pending", Amount: int64(pending.Amount), Currency: "usd", Status: "succeeded", Captured: true, Created: now},
+				{ID: "ch_3", Amount: 500, Currency: "usd", Status: "succeeded", Captured: true, Created: now},
+			}
+			return nil
+		default:
+			t.Fatalf("unknown Stripe API call to %s", path)
+			return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+		}
+	}))
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	recorder := test.TestEndpoint(http.MethodGet, "/reports/payments/reconciliation", nil, token)
+	report := &reconciliationReport{}
+	extractPayload(t, http.StatusOK, recorder, report)
+	require.Len(t, report.Rows, 4)
+	assert.Equal(t, 3, report.Mismatches)
+
+	matched := report.Rows[0]
+	assert.Equal(t, test.Data.firstTransaction.ID, matched.TransactionID)
+	assert.Equal(t, "USD", matched.Currency)
+	assert.EqualValues(t, 33, matched.GatewayFee)
+	assert.Empty(t, matched.Mismatches)
+
+	assert.Equal(t, pending.ID, report.Rows[1].TransactionID)
+	assert.Equal(t, models.PaidState, report.Rows[1].GatewayStatus)
+	assert.Equal(t, models.PendingState, report.Rows[1].Status)
+	assert.Equal(t, []string{mismatchStatus}, report.Rows[1].Mismatches)
+
+	assert.Equal(t, "ch_3", report.Rows[2].ProcessorID)
+	assert.Equal(t, []string{mismatchMissingTransaction}, report.Rows[2].Mismatches)
+
+	assert.Equal(t, unknown.ID, report.Rows[3].TransactionID)
+	assert.Equal(t, []string{mismatchMissingCharge}, report.Rows[3].Mismatches)
+}
+
+func TestVATReport(t *testing.T) {
+	now := time.Now().UTC()
+	quarter := fmt.Sprintf("%d-Q%d", now.Year(), (int(now.Month())-1)/3+1)
+	site := startTestSiteWithSettings(&calculator.Settings{VATCountry: "DE"})
+	defer site.Close()
+	setup := func(t *testing.T) *RouteTest {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		require.NoError(t, test.DB.Model(&models.Address{}).Where("id = ?", "first-address").Update("country", "Austria").Error)
+		require.NoError(t, test.DB.Model(&models.LineItem{}).Where("id = ?", 11).Updates(map[string]interface{}{
+			"calculation_net_total": 1000, "calculation_taxes": 200,
+		}).Error)
+		require.NoError(t, test.DB.Model(&models.LineItem{}).Where("id = ?", 21).Updates(map[string]interface{}{
+			"calculation_net_total": 500, "calculation_taxes": 100,
+		}).Error)
+		return test
+	}
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	t.Run("DigitalGoods", func(t *testing.T) {
+		test := setup(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/vat?quarter="+quarter, nil, token)
+		report := []vatRow{}
+		extractPayload(t, http.StatusOK, recorder, &report)
+		require.Len(t, report, 1)
+		assert.Equal(t, "AT", report[0].CountryCode)
+		assert.Equal(t, "USD", report[0].Currency)
+		assert.Equal(t, float64(20), report[0].Rate)
+		assert.Equal(t, int64(2000), report[0].TaxableAmount)
+		assert.Equal(t, int64(400), report[0].VAT)
+		assert.Equal(t, uint64(1), report[0].Orders)
+	})
+	t.Run("ProductTypes", func(t *testing.T) {
+		test := setup(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/vat?quarter="+quarter+"&product_type=plane&product_type=tank", nil, token)
+		report := []vatRow{}
+		extractPayload(t, http.StatusOK, recorder, &report)
+		require.Len(t, report, 1)
+		assert.Equal(t, int64(3000), report[0].TaxableAmount)
+		assert.Equal(t, int64(600), report[0].VAT)
+		assert.Equal(t, uint64(2), report[0].Orders)
+	})
+	t.Run("CSV", func(t *testing.T) {
+		test := setup(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/vat?format=csv&quarter="+quarter, nil, token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "text/csv", recorder.Header().Get("Content-Type"))
+		assert.Equal(t, "member_state,vat_rate,currency,taxable_amount,vat_amount\nAT,20,USD,20.00,4.00\n", recorder.Body.String())
+	})
+	t.Run("HistoricalRates", func(t *testing.T) {
+		test := setup(t)
+		require.NoError(t, test.DB.Model(&models.LineItem{}).Where("id = ?", 11).Update(
+			"calculation_raw_tax_rates", `[{"rate":13,"jurisdiction":"Austria","taxable_amount":400,"amount":52},{"rate":20,"jurisdiction":"Austria","taxable_amount":600,"amount":120}]`,
+		).Error)
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/vat?quarter="+quarter, nil, token)
+		report := []vatRow{}
+		extractPayload(t, http.StatusOK, recorder, &report)
+		require.Len(t, report, 2)
+		assert.Equal(t, float64(20), report[0].Rate)
+		assert.Equal(t, int64(1200), report[0].TaxableAmount)
+		assert.Equal(t, int64(240), report[0].VAT)
+		assert.Equal(t, float64(13), report[1].Rate)
+		assert.Equal(t, int64(800), report[1].TaxableAmount)
+		assert.Equal(t, int64(104), report[1].VAT)
+	})
+	t.Run("ExcludesReverseCharge", func(t *testing.T) {
+		test := setup(t)
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).Update("reverse_charge", true).Error)
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/vat?quarter="+quarter, nil, token)
+		report := []vatRow{}
+		extractPayload(t, http.StatusOK, recorder, &report)
+		assert.Empty(t, report)
+	})
+	t.Run("OtherQuarter", func(t *testing.T) {
+		test := setup(t)
+		recorder := test.TestEndpoint(http.MethodGet, fmt.Sprintf("/reports/vat?quarter=%d-Q1", now.Year()-1), nil, token)
+		report := []vatRow{}
+		extractPayload(t, http.StatusOK, recorder, &report)
+		assert.Empty(t, report)
+	})
+	t.Run("Domestic", func(t *testing.T) {
+		test := setup(t)
+		require.NoError(t, test.DB.Model(&models.Address{}).Where("id = ?", "first-address").Update("country", "Germany").Error)
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/vat?quarter="+quarter, nil, token)
+		report := []vatRow{}
+		extractPayload(t, http.StatusOK, recorder, &report)
+		assert.Empty(t, report)
+	})
+	t.Run("PaidDate", func(t *testing.T) {
+		test := setup(t)
+		lastYear := now.AddDate(-1, 0, 0)
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).UpdateColumn("created_at", lastYear).Error)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/vat?quarter="+quarter, nil, token)
+		report := []vatRow{}
+		extractPayload(t, http.StatusOK, recorder, &report)
+		require.Len(t, report, 1)
+		assert.Equal(t, int64(2000), report[0].TaxableAmount)
+
+		lastQuarter := fmt.Sprintf("%d-Q%d", lastYear.Year(), (int(lastYear.Month())-1)/3+1)
+		recorder = test.TestEndpoint(http.MethodGet, "/reports/vat?quarter="+lastQuarter, nil, token)
+		extractPayload(t, http.StatusOK, recorder, &report)
+		assert.Empty(t, report)
+	})
+	t.Run("PartialRefund", func(t *testing.T) {
+		test := setup(t)
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).UpdateColumn("total", 2400).Error)
+		refund := models.NewRefund(test.Data.firstTransaction, 1200)
+		refund.OrderID = test.Data.firstOrder.ID
+		refund.Status = models.PaidState
+		require.NoError(t, test.DB.Create(refund).Error)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/vat?format=csv&quarter="+quarter, nil, token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "member_state,vat_rate,currency,taxable_amount,vat_amount\nAT,20,USD,10.00,2.00\n", recorder.Body.String())
+	})
+	t.Run("RefundInLaterQuarter", func(t *testing.T) {
+		test := setup(t)
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).UpdateColumns(map[string]interface{}{
+			"created_at": now.AddDate(-1, 0, 0), "payment_state": models.RefundedState, "total": 2400,
+		}).Error)
+		require.NoError(t, test.DB.Model(test.Data.firstTransaction).UpdateColumn("created_at", now.AddDate(-1, 0, 0)).Error)
+		refund := models.NewRefund(test.Data.firstTransaction, 2400)
+		refund.OrderID = test.Data.firstOrder.ID
+		refund.Status = models.PaidState
+		require.NoError(t, test.DB.Create(refund).Error)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/vat?quarter="+quarter, nil, token)
+		report := []vatRow{}
+		extractPayload(t, http.StatusOK, recorder, &report)
+		require.Len(t, report, 1)
+		assert.Equal(t, int64(-2000), report[0].TaxableAmount)
+		assert.Equal(t, int64(-400), report[0].VAT)
+		assert.Equal(t, uint64(0), report[0].Orders)
+	})
+	t.Run("MissingQuarter", func(t *testing.T) {
+		test := setup(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/vat", nil, token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// RunRetentionJob creates a goroutine that anonymizes orders older than the
+// retention period of their instance and removes expired user data exports at
+// the interval of the sweeper configuration.
+func (a *API) RunRetentionJob(ctx context.Context, db *gorm.DB, log logrus.FieldLogger) {
+	interval := a.config.Sweeper.Interval
+	if interval <= 0 {
+		interval = defaultSweepInterval
+	}
+	go func() {
+		for {
+			a.anonymizeExpiredOrders(ctx, db, log)
+			deleteExpiredExports(db, log)
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func (a *API) anonymizeExpiredOrders(ctx context.Context, db *gorm.DB, log logrus.FieldLogger) {
+	instanceIDs := []string{}
+	rsp := db.Model(&models.Order{}).Where("anonymized_at IS NULL").Pluck("DISTINCT instance_id", &instanceIDs)
+	if rsp.Error != nil {
+		log.WithError(rsp.Error).Error("Error querying for orders")
+		return
+	}
+
+	now := time.Now()
+	for _, instanceID := range instanceIDs {
+		log := log.WithField("instance_id", instanceID)
+
+		instanceCtx, err := a.instanceContext(ctx, db, instanceID)
+		if err != nil {
+			log.WithError(err).Error("Error loading instance configuration")
+			continue
+		}
+		cutoff, ok := gcontext.GetConfig(instanceCtx).RetentionCutoff(now)
+		if !ok {
+			continue
+		}
+
+		expired := []*models.Order{}
+		rsp := db.Where("instance_id = ? AND anonymized_at IS NULL AND created_at < ?", instanceID, cutoff).Find(&expired)
+		if rsp.Error != nil {
+			log.WithError(rsp.Error).Error("Error querying for expired orders")
+			continue
+		}
+
+		for _, order := range expired {
+			log := log.WithField("order_id", order.ID)
+			tx := db.Begin()
+			if err := models.AnonymizeOrder(tx, order, cutoff); err != nil {
+				tx.Rollback()
+				log.WithError(err).Error("Failed to anonymize order")
+				continue
+			}
+			if err := tx.Commit().Error; err != nil {
+				log.WithError(err).Error("Failed to anonymize order")
+				continue
+			}
+			log.Info("Anonymized order")
+		}
+	}
+}
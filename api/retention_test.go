@@ -0,0 +1,106 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestRetention(t *testing.T) {
+	setup := func(t *testing.T, months uint64) *RouteTest {
+		test := NewRouteTest(t)
+		test.Config.Retention.Months = months
+		require.NoError(t, test.DB.Model(&models.Order{}).Where("id = ?", test.Data.firstOrder.ID).Update("created_at", time.Now().AddDate(-1, 0, 0)).Error)
+		models.LogEvent(test.DB, "127.0.0.1", test.Data.testUser.ID, test.Data.firstOrder.ID, models.EventCreated, nil)
+		return test
+	}
+	run := func(t *testing.T, test *RouteTest) {
+		ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+		require.NoError(t, err)
+		api := NewAPIWithVersion(ctx, test.GlobalConfig, logrus.StandardLogger(), test.DB, "")
+		api.anonymizeExpiredOrders(ctx, test.DB, logrus.StandardLogger())
+	}
+	countEvents := func(t *testing.T, test *RouteTest) int {
+		var events int
+		require.NoError(t, test.DB.Model(&models.Event{}).Where("order_id = ?", test.Data.firstOrder.ID).Count(&events).Error)
+		return events
+	}
+
+	t.Run("Anonymized", func(t *testing.T) {
+		test := setup(t, 6)
+		orderID := test.Data.firstOrder.ID
+		require.NoError(t, test.DB.Create(&models.Hook{OrderID: orderID, Type: "update", URL: "http://hooks.example.com", Payload: `{"email": "info@example.com"}`}).Error)
+		require.NoError(t, test.DB.Create(&models.OrderNote{OrderID: orderID, Text: "Call the customer"}).Error)
+		require.NoError(t, test.DB.Create(&models.Return{ID: "first-return", OrderID: orderID, Reason: "Bought it for my neighbour", Status: models.ReturnRejectedState}).Error)
+		require.NoError(t, test.DB.Create(&models.Cart{ID: "first-cart", OrderID: orderID}).Error)
+		run(t, test)
+
+		order := &models.Order{}
+		require.NoError(t, orderQuery(test.DB).First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.NotNil(t, order.AnonymizedAt)
+		assert.Empty(t, order.Email)
+		assert.Empty(t, order.IP)
+		assert.Equal(t, test.Data.firstOrder.Total, order.Total)
+		assert.Equal(t, test.Data.firstOrder.Taxes, order.Taxes)
+		assert.Equal(t, 0, countEvents(t, test))
+
+		hook := &models.Hook{}
+		require.NoError(t, test.DB.First(hook, "order_id = ?", orderID).Error)
+		assert.Empty(t, hook.Payload)
+		assert.True(t, hook.Done)
+		ret := &models.Return{}
+		require.NoError(t, test.DB.First(ret, "id = ?", "first-return").Error)
+		assert.Empty(t, ret.Reason)
+		var notes, carts int
+		require.NoError(t, test.DB.Unscoped().Model(&models.OrderNote{}).Where("order_id = ?", orderID).Count(&notes).Error)
+		require.NoError(t, test.DB.Model(&models.Cart{}).Where("order_id = ?", orderID).Count(&carts).Error)
+		assert.Equal(t, 0, notes)
+		assert.Equal(t, 0, carts)
+
+		// the address is still used by the second order
+		assert.Equal(t, test.Data.testAddress.Name, order.BillingAddress.Name)
+
+		recent := &models.Order{}
+		require.NoError(t, test.DB.First(recent, "id = ?", test.Data.secondOrder.ID).Error)
+		assert.Nil(t, recent.AnonymizedAt)
+		assert.Equal(t, test.Data.secondOrder.Email, recent.Email)
+	})
+	t.Run("UnusedAddress", func(t *testing.T) {
+		test := setup(t, 6)
+		address := getTestAddress()
+		require.NoError(t, test.DB.Create(address).Error)
+		require.NoError(t, test.DB.Model(&models.Order{}).Where("id = ?", test.Data.firstOrder.ID).Update("billing_address_id", address.ID).Error)
+		run(t, test)
+
+		stored := &models.Address{}
+		require.NoError(t, test.DB.First(stored, "id = ?", address.ID).Error)
+		assert.Empty(t, stored.Name)
+		assert.Empty(t, stored.Address1)
+		assert.Empty(t, stored.Zip)
+		assert.Equal(t, address.Country, stored.Country)
+	})
+	t.Run("WithinRetention", func(t *testing.T) {
+		test := setup(t, 24)
+		run(t, test)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Nil(t, order.AnonymizedAt)
+		assert.Equal(t, test.Data.firstOrder.Email, order.Email)
+		assert.Equal(t, 1, countEvents(t, test))
+	})
+	t.Run("Disabled", func(t *testing.T) {
+		test := setup(t, 0)
+		run(t, test)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Nil(t, order.AnonymizedAt)
+	})
+}
@@ -0,0 +1,286 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// ReturnItemParams holds the quantity of a line item to return
+type ReturnItemParams struct {
+	LineItemID int64  `json:"line_item_id"`
+	Quantity   uint64 `json:"quantity"`
+}
+
+// ReturnParams holds the parameters for requesting a return
+type ReturnParams struct {
+	Reason string              `json:"reason"`
+	Items  []*ReturnItemParams `json:"items"`
+}
+
+// ReturnResolutionParams holds the parameters for approving or rejecting a
+// return. Restock lists the IDs of the returned items that go back into stock.
+type ReturnResolutionParams struct {
+	Resolution string  `json:"resolution"`
+	Restock    []int64 `json:"restock"`
+}
+
+// ReturnList lists the returns. It is only available to admins.
+func (a *API) ReturnList(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+	query := a.DB(r).Preload("Items").Where("instance_id = ?", instanceID)
+
+	query, err := parseReturnQueryParams(query, r.URL.Query())
+	if err != nil {
+		return badRequestError("Malformed request: %v", err)
+	}
+
+	returns := []models.Return{}
+	if rsp := query.Order("created_at desc").Find(&returns); rsp.Error != nil {
+		return internalServerError("Error while querying for returns").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, returns)
+}
+
+// ReturnListForOrder lists the returns of an order.
+func (a *API) ReturnListForOrder(w http.ResponseWriter, r *http.Request) error {
+	order, httpErr := a.loadOrder(r)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	returns := []models.Return{}
+	if rsp := a.DB(r).Preload("Items").Where("order_id = ?", order.ID).Order("created_at desc").Find(&returns); rsp.Error != nil {
+		return internalServerError("Error while querying for returns").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, returns)
+}
+
+// ReturnCreate requests the return of line items of a paid order.
+func (a *API) ReturnCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	db := a.DB(r)
+
+	params := &ReturnParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read return params: %v", err)
+	}
+	if len(params.Items) == 0 {
+		return badRequestError("A return requires at least one item")
+	}
+
+	order, httpErr := a.loadOrder(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if order.PaymentState != models.PaidState {
+		return badRequestError("Only items of paid orders can be returned")
+	}
+
+	returned, err := models.ReturnedQuantities(db, order.ID)
+	if err != nil {
+		return internalServerError("Error while querying for returns").WithInternalError(err)
+	}
+
+	ret := models.NewReturn(order, params.Reason)
+	requested := map[int64]uint64{}
+	for _, itemParams := range params.Items {
+		var item *models.LineItem
+		for _, lineItem := range order.LineItems {
+			if lineItem.ID == itemParams.LineItemID {
+				item = lineItem
+				break
+			}
+		}
+		if item == nil {
+			return badRequestError("Order has no line item with id %d", itemParams.LineItemID)
+		}
+		if itemParams.Quantity == 0 {
+			return badRequestError("The quantity of line item %d must be positive", item.ID)
+		}
+		requested[item.ID] += itemParams.Quantity
+		if returned[item.ID]+requested[item.ID] > item.Quantity {
+			return badRequestError("Only %d of line item %d can be returned", item.Quantity-returned[item.ID], item.ID)
+		}
+		ret.AddItem(item, itemParams.Quantity)
+	}
+
+	tx := db.Begin()
+	if rsp := tx.Create(ret); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving return").WithInternalError(rsp.Error)
+	}
+	models.LogEvent(tx, r.RemoteAddr, gcontext.GetClaims(ctx).Subject, order.ID, models.EventUpdated, []string{"returns"})
+	if err := tx.Commit().Error; err != nil {
+		return internalServerError("Error saving return").WithInternalError(err)
+	}
+
+	log.WithField("return_id", ret.ID).Info("Return requested")
+	return sendJSON(w, http.StatusCreated, ret)
+}
+
+// ReturnView returns a single return of an order.
+func (a *API) ReturnView(w http.ResponseWriter, r *http.Request) error {
+	order, httpErr := a.loadOrder(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	ret, httpErr := a.getReturn(r, order)
+	if httpErr != nil {
+		return httpErr
+	}
+	return sendJSON(w, http.StatusOK, ret)
+}
+
+// ReturnApprove approves a requested return and refunds the returned items
+// with the payment providers of the order. It is only available to admins.
+func (a *API) ReturnApprove(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	subject := gcontext.GetClaims(ctx).Subject
+
+	params, ret, order, httpErr := a.loadReturnResolution(r)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	restock := map[int64]bool{}
+	for _, id := range params.Restock {
+		restock[id] = true
+	}
+	for _, item := range ret.Items {
+		if restock[item.ID] {
+			item.Restock = true
+			delete(restock, item.ID)
+		}
+	}
+	for id := range restock {
+		return badRequestError("Return has no item with id %d", id)
+	}
+
+	tx := a.DB(r).Begin()
+	if httpErr := claimReturn(tx, ret, models.ReturnProcessingState); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	for _, trans := range order.Transactions {
+		if ret.RefundedAmount >= ret.Amount {
+			break
+		}
+		if trans.Type != models.ChargeTransactionType || trans.Status != models.PaidState || trans.RefundableAmount() == 0 {
+			continue
+		}
+		amount := ret.Amount - ret.RefundedAmount
+		if amount > trans.RefundableAmount() {
+			amount = trans.RefundableAmount()
+		}
+		if _, err := refundCharge(r, tx, log.WithField("transaction_id", trans.ID), trans, order, amount, subject); err != nil {
+			// keep the refunds that went through so approving again only refunds
+			// the rest, saving the return as requested again
+			tx.Save(ret)
+			tx.Commit()
+			return internalServerError("Error on provider while refunding the return: %v. Try again later.", err).WithInternalError(err)
+		}
+		ret.RefundedAmount += amount
+	}
+	if ret.RefundedAmount < ret.Amount {
+		tx.Rollback()
+		return badRequestError("The order doesn't have enough refundable payments for the return of %d", ret.Amount)
+	}
+
+	ret.Resolve(models.ReturnApprovedState, params.Resolution)
+	for _, item := range ret.Items {
+		tx.Save(item)
+	}
+	tx.Save(ret)
+	models.LogEvent(tx, r.RemoteAddr, subject, order.ID, models.EventUpdated, []string{"returns"})
+	if err := tx.Commit().Error; err != nil {
+		return internalServerError("Error saving return").WithInternalError(err)
+	}
+
+	log.WithField("return_id", ret.ID).Info("Return approved")
+	return sendJSON(w, http.StatusOK, ret)
+}
+
+// ReturnReject rejects a requested return. It is only available to admins.
+func (a *API) ReturnReject(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	params, ret, order, httpErr := a.loadReturnResolution(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if ret.RefundedAmount > 0 {
+		return badRequestError("Parts of this return have already been refunded")
+	}
+
+	tx := a.DB(r).Begin()
+	if httpErr := claimReturn(tx, ret, models.ReturnRejectedState); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	ret.Resolve(models.ReturnRejectedState, params.Resolution)
+	tx.Save(ret)
+	models.LogEvent(tx, r.RemoteAddr, gcontext.GetClaims(ctx).Subject, order.ID, models.EventUpdated, []string{"returns"})
+	if err := tx.Commit().Error; err != nil {
+		return internalServerError("Error saving return").WithInternalError(err)
+	}
+	return sendJSON(w, http.StatusOK, ret)
+}
+
+// claimReturn moves a requested return to the status unless it has been
+// resolved concurrently. The return itself keeps its requested status, so
+// saving it without resolving it releases the claim.
+func claimReturn(tx *gorm.DB, ret *models.Return, status string) *HTTPError {
+	rsp := tx.Model(&models.Return{}).
+		Where("id = ? AND status = ?", ret.ID, models.ReturnRequestedState).
+		UpdateColumn("status", status)
+	if rsp.Error != nil {
+		return internalServerError("Error claiming return").WithInternalError(rsp.Error)
+	}
+	if rsp.RowsAffected != 1 {
+		return httpError(http.StatusConflict, "This return is already being resolved")
+	}
+	return nil
+}
+
+// loadReturnResolution reads the resolution params and loads the requested
+// return of the request together with its order.
+func (a *API) loadReturnResolution(r *http.Request) (*ReturnResolutionParams, *models.Return, *models.Order, *HTTPError) {
+	params := &ReturnResolutionParams{}
+	if r.Body != nil && r.Body != http.NoBody {
+		if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+			return nil, nil, nil, badRequestError("Could not read params: %v", err)
+		}
+	}
+
+	order, httpErr := a.loadOrder(r)
+	if httpErr != nil {
+		return nil, nil, nil, httpErr
+	}
+	ret, httpErr := a.getReturn(r, order)
+	if httpErr != nil {
+		return nil, nil, nil, httpErr
+	}
+	if ret.Status != models.ReturnRequestedState {
+		return nil, nil, nil, badRequestError("This return has already been %s", ret.Status)
+	}
+	return params, ret, order, nil
+}
+
+func (a *API) getReturn(r *http.Request, order *models.Order) (*models.Return, *HTTPError) {
+	ret, err := models.GetReturn(a.DB(r), chi.URLParam(r, "return_id"))
+	if err != nil {
+		return nil, internalServerError("Error while querying for return").WithInternalError(err)
+	}
+	if ret == nil || ret.OrderID != order.ID {
+		return nil, notFoundError("Return not found")
+	}
+	return ret, nil
+}
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestReturns(t *testing.T) {
+	url := "/orders/first-order/returns"
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	requestReturn := func(t *testing.T, test *RouteTest, quantity string) *models.Return {
+		body := strings.NewReader(`{"reason": "too fast", "items": [{"line_item_id": 11, "quantity": ` + quantity + `}]}`)
+		recorder := test.TestEndpoint(http.MethodPost, url, body, test.Data.testUserToken)
+		ret := &models.Return{}
+		extractPayload(t, http.StatusCreated, recorder, ret)
+		return ret
+	}
+
+	t.Run("Create", func(t *testing.T) {
+		test := NewRouteTest(t)
+		ret := requestReturn(t, test, "1")
+		assert.Equal(t, models.ReturnRequestedState, ret.Status)
+		assert.Equal(t, test.Data.firstOrder.ID, ret.OrderID)
+		assert.EqualValues(t, 12, ret.Amount)
+		require.Len(t, ret.Items, 1)
+		assert.EqualValues(t, 11, ret.Items[0].LineItemID)
+
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, test.Data.testUserToken)
+		returns := []models.Return{}
+		extractPayload(t, http.StatusOK, recorder, &returns)
+		require.Len(t, returns, 1)
+		assert.Equal(t, ret.ID, returns[0].ID)
+	})
+	t.Run("TooMany", func(t *testing.T) {
+		test := NewRouteTest(t)
+		requestReturn(t, test, "1")
+		body := strings.NewReader(`{"items": [{"line_item_id": 11, "quantity": 2}]}`)
+		recorder := test.TestEndpoint(http.MethodPost, url, body, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "Only 1 of line item 11")
+	})
+	t.Run("UnknownItem", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := strings.NewReader(`{"items": [{"line_item_id": 99, "quantity": 1}]}`)
+		recorder := test.TestEndpoint(http.MethodPost, url, body, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "no line item")
+	})
+	t.Run("Approve", func(t *testing.T) {
+		test := NewRouteTest(t)
+		ret := requestReturn(t, test, "2")
+		refunds := 0
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+			switch path {
+			case "/v1/refunds":
+				refunds++
+				v.(*stripe.Refund).ID = "stripe-refund"
+				return nil
+			default:
+				t.Fatalf("unknown Stripe API call to %s", path)
+				return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+			}
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		body := strings.NewReader(`{"resolution": "ok", "restock": [` + strconv.FormatInt(ret.Items[0].ID, 10) + `]}`)
+		recorder := test.TestEndpoint(http.MethodPost, url+"/"+ret.ID+"/approve", body, token)
+		approved := &models.Return{}
+		extractPayload(t, http.StatusOK, recorder, approved)
+		assert.Equal(t, models.ReturnApprovedState, approved.Status)
+		assert.EqualValues(t, 24, approved.RefundedAmount)
+		assert.NotNil(t, approved.ResolvedAt)
+		require.Len(t, approved.Items, 1)
+		assert.True(t, approved.Items[0].Restock)
+		assert.Equal(t, 1, refunds)
+
+		trans := []models.Transaction{}
+		require.NoError(t, test.DB.Where("parent_id = ?", test.Data.firstTransaction.ID).Find(&trans).Error)
+		require.Len(t, trans, 1)
+		assert.EqualValues(t, 24, trans[0].Amount)
+		assert.Equal(t, models.RefundTransactionType, trans[0].Type)
+
+		recorder = test.TestEndpoint(http.MethodPost, url+"/"+ret.ID+"/approve", nil, token)
+		validateError(t, http.StatusBadRequest, recorder, "already been approved")
+	})
+	t.Run("Claimed", func(t *testing.T) {
+		test := NewRouteTest(t)
+		ret := requestReturn(t, test, "1")
+		stale := *ret
+
+		require.Nil(t, claimReturn(test.DB, ret, models.ReturnProcessingState))
+		httpErr := claimReturn(test.DB, &stale, models.ReturnRejectedState)
+		require.NotNil(t, httpErr)
+		assert.Equal(t, http.StatusConflict, httpErr.Code)
+
+		stored, err := models.GetReturn(test.DB, ret.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.ReturnProcessingState, stored.Status)
+	})
+	t.Run("RefundFailed", func(t *testing.T) {
+		test := NewRouteTest(t)
+		ret := requestReturn(t, test, "1")
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+			return &stripe.Error{Code: stripe.ErrorCodeCardDeclined, Msg: "Refunds are unavailable"}
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		recorder := test.TestEndpoint(http.MethodPost, url+"/"+ret.ID+"/approve", nil, token)
+		validateError(t, http.StatusInternalServerError, recorder)
+
+		stored, err := models.GetReturn(test.DB, ret.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.ReturnRequestedState, stored.Status)
+	})
+	t.Run("Reject", func(t *testing.T) {
+		test := NewRouteTest(t)
+		ret := requestReturn(t, test, "2")
+		body := strings.NewReader(`{"resolution": "worn out"}`)
+		recorder := test.TestEndpoint(http.MethodPost, url+"/"+ret.ID+"/reject", body, token)
+		rejected := &models.Return{}
+		extractPayload(t, http.StatusOK, recorder, rejected)
+		assert.Equal(t, models.ReturnRejectedState, rejected.Status)
+		assert.Equal(t, "worn out", rejected.Resolution)
+
+		// rejected items can be requested again
+		requestReturn(t, test, "2")
+	})
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		ret := requestReturn(t, test, "1")
+		recorder := test.TestEndpoint(http.MethodPost, url+"/"+ret.ID+"/approve", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+	t.Run("AdminList", func(t *testing.T) {
+		test := NewRouteTest(t)
+		requestReturn(t, test, "1")
+		recorder := test.TestEndpoint(http.MethodGet, "/returns?status=requested", nil, token)
+		returns := []models.Return{}
+		extractPayload(t, http.StatusOK, recorder, &returns)
+		assert.Len(t, returns, 1)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/returns?status=approved", nil, token)
+		returns = []models.Return{}
+		extractPayload(t, http.StatusOK, recorder, &returns)
+		assert.Len(t, returns, 0)
+	})
+}
@@ -0,0 +1,146 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/netlify/gocommerce/claims"
+	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
+)
+
+// The roles the claims of a token can grant.
+const (
+	superadminRole  = "superadmin"
+	supportRole     = "support"
+	fulfillmentRole = "fulfillment"
+	financeRole     = "finance"
+)
+
+// permission is required by the routes available to other roles than
+// superadmin, which has every permission.
+type permission string
+
+const (
+	readOrdersPermission     permission = "orders:read"
+	writeOrdersPermission    permission = "orders:write"
+	writeShipmentsPermission permission = "shipments:write"
+	writeStockPermission     permission = "stock:write"
+	readPaymentsPermission   permission = "payments:read"
+	writePaymentsPermission  permission = "payments:write"
+	readReportsPermission    permission = "reports:read"
+	readUsersPermission      permission = "users:read"
+	writeUsersPermission     permission = "users:write"
+)
+
+// permissions lists every permission, the ones API keys can be scoped to.
+var permissions = []permission{
+	readOrdersPermission,
+	writeOrdersPermission,
+	writeShipmentsPermission,
+	writeStockPermission,
+	readPaymentsPermission,
+	writePaymentsPermission,
+	readReportsPermission,
+	readUsersPermission,
+	writeUsersPermission,
+}
+
+var rolePermissions = map[string][]permission{
+	supportRole: {
+		readOrdersPermission,
+		writeOrdersPermission,
+		readPaymentsPermission,
+		readUsersPermission,
+		writeUsersPermission,
+	},
+	fulfillmentRole: {
+		readOrdersPermission,
+		writeShipmentsPermission,
+		writeStockPermission,
+	},
+	financeRole: {
+		readOrdersPermission,
+		readPaymentsPermission,
+		writePaymentsPermission,
+		readReportsPermission,
+	},
+}
+
+// claimRoles returns the roles granted by the roles in the app metadata of
+// the claims. Only the AdminGroupName and the roles mapped in the JWT
+// configuration grant roles, so the roles of an identity provider don't
+// grant any until they're mapped.
+func claimRoles(config *conf.Configuration, c *claims.JWTClaims) []string {
+	granted := map[string]bool{}
+	data, _ := c.AppMetaData["roles"].([]interface{})
+	for _, d := range data {
+		name, _ := d.(string)
+		if name == "" {
+			continue
+		}
+		if name == config.JWT.AdminGroupName {
+			granted[superadminRole] = true
+		}
+		for _, role := range []string{superadminRole, supportRole, fulfillmentRole, financeRole} {
+			for _, n := range config.JWT.Roles[role] {
+				if n == name {
+					granted[role] = true
+				}
+			}
+		}
+	}
+
+	roles := []string{}
+	for _, role := range []string{superadminRole, supportRole, fulfillmentRole, financeRole} {
+		if granted[role] {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// validPermission reports whether the permission exists.
+func validPermission(name string) bool {
+	for _, p := range permissions {
+		if string(p) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPermission reports whether the roles of the request, or the API key it
+// was made with, grant the permission.
+func hasPermission(ctx context.Context, p permission) bool {
+	if gcontext.IsAdmin(ctx) {
+		return true
+	}
+	for _, granted := range gcontext.GetPermissions(ctx) {
+		if granted == string(p) {
+			return true
+		}
+	}
+	for _, role := range gcontext.GetRoles(ctx) {
+		for _, granted := range rolePermissions[role] {
+			if granted == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// permissionRequired limits a route to the roles granting the permission.
+func permissionRequired(p permission) middlewareHandler {
+	return func(w http.ResponseWriter, r *http.Request) (context.Context, error) {
+		ctx := r.Context()
+		claims := gcontext.GetClaims(ctx)
+		if claims == nil || !hasPermission(ctx, p) {
+			return nil, unauthorizedError("Permission %v required", p)
+		}
+
+		logEntrySetField(r, "admin_id", claims.Subject)
+		return ctx, nil
+	}
+}
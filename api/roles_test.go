@@ -0,0 +1,101 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gocommerce/claims"
+)
+
+func testRoleToken(id, email string, roles ...interface{}) *jwt.Token {
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, &claims.JWTClaims{
+		StandardClaims: jwt.StandardClaims{Subject: id},
+		Email:          email,
+		AppMetaData:    map[string]interface{}{"roles": roles},
+	})
+}
+
+// testRoles maps each role to a claim role of the same name.
+var testRoles = map[string][]string{
+	superadminRole:  {superadminRole},
+	supportRole:     {supportRole},
+	fulfillmentRole: {fulfillmentRole},
+	financeRole:     {financeRole},
+}
+
+func TestRoles(t *testing.T) {
+	refund := func(test *RouteTest, token *jwt.Token) int {
+		body := strings.NewReader(`{"amount": 100000, "currency": "USD"}`)
+		return test.TestEndpoint(http.MethodPost, "/payments/"+test.Data.firstTransaction.ID+"/refund", body, token).Code
+	}
+
+	t.Run("Fulfillment", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.JWT.Roles = testRoles
+		token := testRoleToken("packer", "packer@wayneindustries.com", "fulfillment")
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/"+test.Data.firstOrder.ID+"/shipments", strings.NewReader(`{"carrier": "UPS", "tracking_number": "1Z999"}`), token)
+		assert.Equal(t, http.StatusCreated, recorder.Code, recorder.Body.String())
+
+		recorder = test.TestEndpoint(http.MethodGet, "/orders/"+test.Data.firstOrder.ID, nil, token)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		validateError(t, http.StatusUnauthorized, test.TestEndpoint(http.MethodPost, "/payments/"+test.Data.firstTransaction.ID+"/refund", strings.NewReader(`{"amount": 1}`), token), "Permission payments:write required")
+		validateError(t, http.StatusUnauthorized, test.TestEndpoint(http.MethodGet, "/reports/sales", nil, token), "Permission reports:read required")
+	})
+	t.Run("Finance", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.JWT.Roles = testRoles
+		token := testRoleToken("accountant", "accountant@wayneindustries.com", "finance")
+		assert.Equal(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/reports/sales", nil, token).Code)
+		assert.Equal(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/payments", nil, token).Code)
+		assert.NotEqual(t, http.StatusUnauthorized, refund(test, token))
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/"+test.Data.firstOrder.ID+"/shipments", strings.NewReader(`{"carrier": "UPS"}`), token)
+		validateError(t, http.StatusUnauthorized, recorder, "Permission shipments:write required")
+		recorder = test.TestEndpoint(http.MethodGet, "/users", nil, token)
+		validateError(t, http.StatusUnauthorized, recorder, "Permission users:read required")
+	})
+	t.Run("Support", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.JWT.Roles = testRoles
+		token := testRoleToken("helper", "helper@wayneindustries.com", "support")
+		assert.Equal(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/users", nil, token).Code)
+		assert.Equal(t, http.StatusOK, test.TestEndpoint(http.MethodGet, test.Data.urlWithUserID, nil, token).Code)
+		assert.Equal(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/orders/"+test.Data.secondOrder.ID+"/timeline", nil, token).Code)
+
+		validateError(t, http.StatusUnauthorized, test.TestEndpoint(http.MethodGet, "/stock", nil, token), "Permission stock:write required")
+		validateError(t, http.StatusUnauthorized, test.TestEndpoint(http.MethodGet, "/coupons", nil, token), "Admin permissions required")
+		assert.Equal(t, http.StatusUnauthorized, refund(test, token))
+	})
+	t.Run("MappedRoles", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.JWT.Roles = map[string][]string{"finance": {"accounting"}, "superadmin": {"owner"}}
+
+		token := testRoleToken("accountant", "accountant@wayneindustries.com", "accounting")
+		assert.Equal(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/reports/sales", nil, token).Code)
+		token = testRoleToken("accountant", "accountant@wayneindustries.com", "finance")
+		assert.Equal(t, http.StatusUnauthorized, test.TestEndpoint(http.MethodGet, "/reports/sales", nil, token).Code)
+
+		token = testRoleToken("owner", "owner@wayneindustries.com", "owner")
+		assert.Equal(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/coupons", nil, token).Code)
+		token = testAdminToken("admin-yo", "admin@wayneindustries.com")
+		assert.Equal(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/coupons", nil, token).Code)
+	})
+	t.Run("Unmapped", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testRoleToken("accountant", "accountant@wayneindustries.com", "finance")
+		validateError(t, http.StatusUnauthorized, test.TestEndpoint(http.MethodGet, "/reports/sales", nil, token), "Permission reports:read required")
+		token = testRoleToken("owner", "owner@wayneindustries.com", "superadmin")
+		validateError(t, http.StatusUnauthorized, test.TestEndpoint(http.MethodGet, "/coupons", nil, token), "Admin permissions required")
+		assert.Equal(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/coupons", nil, testAdminToken("admin-yo", "admin@wayneindustries.com")).Code)
+	})
+	t.Run("Customers", func(t *testing.T) {
+		test := NewRouteTest(t)
+		validateError(t, http.StatusUnauthorized, test.TestEndpoint(http.MethodGet, "/reports/sales", nil, test.Data.testUserToken), "Permission reports:read required")
+		validateError(t, http.StatusUnauthorized, test.TestEndpoint(http.MethodGet, "/reports/sales", nil, nil), "Permission reports:read required")
+	})
+}
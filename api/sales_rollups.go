@@ -0,0 +1,164 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+const defaultRollupInterval = time.Hour
+
+// salesPeriod is a period of the sales report. From and to are inclusive,
+// before is exclusive, and the period is open ended without them.
+type salesPeriod struct {
+	from   *time.Time
+	to     *time.Time
+	before *time.Time
+}
+
+func (p *salesPeriod) where(query *gorm.DB, tableName string) *gorm.DB {
+	if p.from != nil {
+		query = query.Where(tableName+".created_at >= ?", p.from)
+	}
+	if p.to != nil {
+		query = query.Where(tableName+".created_at <= ?", p.to)
+	}
+	if p.before != nil {
+		query = query.Where(tableName+".created_at < ?", p.before)
+	}
+	return query
+}
+
+// salesReportPeriods splits the period of the sales report into the whole
+// days that have been rolled up and the periods around them that are
+// queried from the orders.
+func salesReportPeriods(state *models.SalesRollupState, from, to *time.Time) (*salesPeriod, []*salesPeriod) {
+	whole := []*salesPeriod{{from: from, to: to}}
+	if state == nil {
+		return nil, whole
+	}
+
+	var start *time.Time
+	if from != nil {
+		day := models.RollupDay(*from)
+		if day.Before(*from) {
+			day = day.Add(24 * time.Hour)
+		}
+		start = &day
+	}
+	end := state.RolledUpTo
+	if to != nil {
+		if day := models.RollupDay(*to); day.Before(end) {
+			end = day
+		}
+	}
+	if start != nil && !start.Before(end) {
+		return nil, whole
+	}
+
+	periods := []*salesPeriod{}
+	if start != nil {
+		periods = append(periods, &salesPeriod{from: from, before: start})
+	}
+	periods = append(periods, &salesPeriod{from: &end, to: to})
+	return &salesPeriod{from: start, before: &end}, periods
+}
+
+// addRolledUpSales adds the rollups of the days within the period to the
+// sales by currency.
+func addRolledUpSales(db *gorm.DB, sales map[string]*salesRow, instanceID string, test, archived bool, period *salesPeriod) error {
+	query := db.
+		Model(&models.SalesRollup{}).
+		Select("currency, sum(orders), sum(total), sum(sub_total), sum(taxes), sum(fees)").
+		Where("instance_id = ? AND test = ? AND archived = ?", instanceID, test, archived).
+		Group("currency")
+	if period.from != nil {
+		query = query.Where("day >= ?", period.from)
+	}
+	if period.before != nil {
+		query = query.Where("day < ?", period.before)
+	}
+
+	rows, err := query.Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		row := &salesRow{}
+		if err := rows.Scan(&row.Currency, &row.Orders, &row.Total, &row.SubTotal, &row.Taxes, &row.Fees); err != nil {
+			return err
+		}
+		salesRowFor(sales, row.Currency).add(row)
+	}
+	return nil
+}
+
+// RunSalesRollups creates a goroutine that rolls up the daily sales of all
+// instances for the sales report, and their customers for the cohorts
+// report, at the interval of the rollups configuration.
+func (a *API) RunSalesRollups(ctx context.Context, db *gorm.DB, log logrus.FieldLogger) {
+	interval := a.config.Rollups.Interval
+	if interval <= 0 {
+		interval = defaultRollupInterval
+	}
+	go func() {
+		for {
+			a.rollupSales(db, log, time.Now())
+			a.rollupCohorts(ctx, db, log, time.Now())
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func (a *API) rollupSales(db *gorm.DB, log logrus.FieldLogger, now time.Time) {
+	instanceIDs := []string{}
+	rsp := db.Model(&models.Order{}).Pluck("DISTINCT instance_id", &instanceIDs)
+	if rsp.Error != nil {
+		log.WithError(rsp.Error).Error("Error querying for orders")
+		return
+	}
+
+	for _, instanceID := range instanceIDs {
+		log := log.WithField("instance_id", instanceID)
+		state, err := models.RollupSales(db, instanceID, now, a.config.Rollups.Refresh)
+		if err != nil {
+			log.WithError(err).Error("Failed to roll up sales")
+			continue
+		}
+		log.WithField("rolled_up_to", state.RolledUpTo).Debug("Rolled up sales")
+	}
+}
+
+// rollupCohorts rolls up the customers of all instances in the months of the
+// timezone of their reports.
+func (a *API) rollupCohorts(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, now time.Time) {
+	instanceIDs := []string{}
+	rsp := db.Model(&models.Order{}).Pluck("DISTINCT instance_id", &instanceIDs)
+	if rsp.Error != nil {
+		log.WithError(rsp.Error).Error("Error querying for orders")
+		return
+	}
+
+	for _, instanceID := range instanceIDs {
+		log := log.WithField("instance_id", instanceID)
+		instanceCtx, err := a.instanceContext(ctx, db, instanceID)
+		if err != nil {
+			log.WithError(err).Error("Error loading instance configuration")
+			continue
+		}
+		loc, err := reportsLocation(gcontext.GetConfig(instanceCtx))
+		if err != nil {
+			log.WithError(err).Error("Failed to roll up customer cohorts")
+			continue
+		}
+		if _, err := models.RollupCohorts(db, instanceID, loc, now); err != nil {
+			log.WithError(err).Error("Failed to roll up customer cohorts")
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestSalesRollups(t *testing.T) {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	day := models.RollupDay(time.Now()).Add(-3 * 24 * time.Hour)
+
+	setup := func(t *testing.T) (*RouteTest, *API) {
+		test := NewRouteTest(t)
+		test.GlobalConfig.Rollups.Refresh = 7 * 24 * time.Hour
+		for i, order := range []*models.Order{test.Data.firstOrder, test.Data.secondOrder} {
+			createdAt := day.Add(time.Duration(10+i) * time.Hour)
+			require.NoError(t, test.DB.Model(order).UpdateColumn("created_at", createdAt).Error)
+		}
+		ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+		require.NoError(t, err)
+		return test, NewAPIWithVersion(ctx, test.GlobalConfig, logrus.StandardLogger(), test.DB, "")
+	}
+	report := func(t *testing.T, test *RouteTest, query string) []salesRow {
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/sales"+query, nil, token)
+		rows := []salesRow{}
+		extractPayload(t, http.StatusOK, recorder, &rows)
+		return rows
+	}
+
+	t.Run("RolledUp", func(t *testing.T) {
+		test, api := setup(t)
+		api.rollupSales(test.DB, logrus.StandardLogger(), time.Now())
+
+		rollups := []*models.SalesRollup{}
+		require.NoError(t, test.DB.Find(&rollups).Error)
+		require.Len(t, rollups, 1)
+		assert.Equal(t, "USD", rollups[0].Currency)
+		assert.EqualValues(t, 2, rollups[0].Orders)
+		assert.EqualValues(t, 79, rollups[0].Total)
+		state, err := models.FindSalesRollupState(test.DB, "")
+		require.NoError(t, err)
+		assert.Equal(t, models.RollupDay(time.Now()), state.RolledUpTo.UTC())
+
+		// changes that don't update the orders are left out until refreshed
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).UpdateColumn("total", 100).Error)
+		rows := report(t, test, "")
+		require.Len(t, rows, 1)
+		assert.EqualValues(t, 79, rows[0].Total)
+		assert.EqualValues(t, 2, rows[0].Orders)
+
+		api.rollupSales(test.DB, logrus.StandardLogger(), time.Now().Add(24*time.Hour))
+		rows = report(t, test, "")
+		require.Len(t, rows, 1)
+		assert.EqualValues(t, 155, rows[0].Total)
+	})
+	t.Run("UpdatedOrders", func(t *testing.T) {
+		test, api := setup(t)
+		api.rollupSales(test.DB, logrus.StandardLogger(), time.Now())
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/second-order/archive", nil, token)
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		api.rollupSales(test.DB, logrus.StandardLogger(), time.Now())
+
+		rows := report(t, test, "")
+		require.Len(t, rows, 1)
+		assert.EqualValues(t, 24, rows[0].Total)
+		rows = report(t, test, "?archived=true")
+		require.Len(t, rows, 1)
+		assert.EqualValues(t, 55, rows[0].Total)
+	})
+	t.Run("PartialDays", func(t *testing.T) {
+		test, api := setup(t)
+		api.rollupSales(test.DB, logrus.StandardLogger(), time.Now())
+		require.NoError(t, test.DB.Model(&models.SalesRollup{}).UpdateColumn("total", 1000).Error)
+
+		// the day is queried from the orders when the period starts within it
+		from := day.Add(10*time.Hour + 30*time.Minute)
+		rows := report(t, test, fmt.Sprintf("?from=%d", from.Unix()))
+		require.Len(t, rows, 1)
+		assert.EqualValues(t, 1, rows[0].Orders)
+		assert.EqualValues(t, 55, rows[0].Total)
+
+		rows = report(t, test, fmt.Sprintf("?from=%d", day.Unix()))
+		require.Len(t, rows, 1)
+		assert.EqualValues(t, 1000, rows[0].Total)
+
+		to := day.Add(10*time.Hour + 30*time.Minute)
+		rows = report(t, test, fmt.Sprintf("?from=%d&to=%d", day.Unix(), to.Unix()))
+		require.Len(t, rows, 1)
+		assert.EqualValues(t, 1, rows[0].Orders)
+		assert.EqualValues(t, 24, rows[0].Total)
+	})
+	t.Run("NewOrders", func(t *testing.T) {
+		test, api := setup(t)
+		api.rollupSales(test.DB, logrus.StandardLogger(), time.Now())
+		require.NoError(t, test.DB.Model(test.Data.secondOrder).UpdateColumn("created_at", time.Now()).Error)
+		require.NoError(t, test.DB.Model(&models.SalesRollup{}).UpdateColumn("total", 1000).Error)
+
+		rows := report(t, test, "")
+		require.Len(t, rows, 1)
+		assert.EqualValues(t, 1055, rows[0].Total)
+		assert.EqualValues(t, 3, rows[0].Orders)
+	})
+}
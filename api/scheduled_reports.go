@@ -0,0 +1,279 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// The reports that can be exported on a schedule.
+const (
+	scheduledSalesReport = "sales"
+	scheduledTaxesReport = "taxes"
+)
+
+// maxReportAttempts is how often the report of a period is exported before
+// the admin is alerted and it's given up on.
+const maxReportAttempts = 3
+
+// ReportRunList lists the runs of the scheduled reports, the newest first,
+// optionally for the schedule with the name in the schedule param.
+func (a *API) ReportRunList(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+	query := a.DB(r).Where("instance_id = ?", instanceID)
+	if schedule := r.URL.Query().Get("schedule"); schedule != "" {
+		query = query.Where("schedule = ?", schedule)
+	}
+
+	offset, limit, err := paginate(w, r, query.Model(&models.ReportRun{}))
+	if err != nil {
+		return badRequestError("Bad Pagination Parameters: %v", err)
+	}
+	runs := []*models.ReportRun{}
+	if rsp := query.Order("created_at desc").Offset(offset).Limit(limit).Find(&runs); rsp.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, runs)
+}
+
+// RunReportScheduler creates a goroutine that exports the scheduled
+// reports of all instances once their period is over, at the interval of
+// the sweeper configuration.
+func (a *API) RunReportScheduler(ctx context.Context, db *gorm.DB, log logrus.FieldLogger) {
+	interval := a.config.Sweeper.Interval
+	if interval <= 0 {
+		interval = defaultSweepInterval
+	}
+	go func() {
+		for {
+			a.runScheduledReports(ctx, db, log, time.Now())
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func (a *API) runScheduledReports(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, now time.Time) {
+	instanceIDs := []string{}
+	rsp := db.Model(&models.Order{}).Pluck("DISTINCT instance_id", &instanceIDs)
+	if rsp.Error != nil {
+		log.WithError(rsp.Error).Error("Error querying for orders")
+		return
+	}
+
+	for _, instanceID := range instanceIDs {
+		log := log.WithField("instance_id", instanceID)
+
+		instanceCtx, err := a.instanceContext(ctx, db, instanceID)
+		if err != nil {
+			log.WithError(err).Error("Error loading instance configuration")
+			continue
+		}
+		for _, schedule := range gcontext.GetConfig(instanceCtx).Reports.Schedules {
+			log := log.WithField("schedule", schedule.Name)
+			if err := runScheduledReport(instanceCtx, db, log, instanceID, schedule, now); err != nil {
+				log.WithError(err).Error("Error running scheduled report")
+			}
+		}
+	}
+}
+
+// runScheduledReport exports the report of the schedule for the last period
+// that's over, unless it's already been delivered or given up on. The run of
+// the period is claimed first, so only one scheduler exports it. Failed runs
+// are tried again until the last attempt, which alerts the admin.
+func runScheduledReport(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, instanceID string, schedule conf.ReportSchedule, now time.Time) error {
+	loc, err := reportsLocation(gcontext.GetConfig(ctx))
+	if err != nil {
+		return err
+	}
+	start, end, err := reportPeriod(schedule.Interval, now, loc)
+	if err != nil {
+		return err
+	}
+	run, err := models.ClaimReportRun(db, instanceID, schedule.Name, schedule.Report, start.UTC(), end.UTC(), maxReportAttempts)
+	if err != nil || run == nil {
+		return err
+	}
+
+	filename := fmt.Sprintf("%s-%s.csv", schedule.Name, start.Format("2006-01-02"))
+	report, rows, err := buildScheduledReport(db, instanceID, schedule.Report, start, end)
+	if err == nil {
+		run.Rows = rows
+		err = deliverReport(ctx, db, schedule, run, filename, report)
+	}
+	if err != nil {
+		log.WithError(err).WithField("attempt", run.Attempts).Warn("Failed to deliver scheduled report")
+	}
+	if saveErr := run.Complete(db, err); saveErr != nil {
+		return saveErr
+	}
+	if run.Status == models.ReportRunFailed && run.Attempts >= maxReportAttempts {
+		alertReportFailed(ctx, db, log, run)
+	}
+	return nil
+}
+
+// reportPeriod returns the last day or week, starting on Monday, that's over
+// at now, in the location.
+func reportPeriod(interval string, now time.Time, loc *time.Location) (time.Time, time.Time, error) {
+	today := startOfDay(now, loc)
+	switch interval {
+	case "day":
+		return today.AddDate(0, 0, -1), today, nil
+	case "week":
+		daysSinceMonday := (int(today.Weekday()) + 6) % 7
+		end := today.AddDate(0, 0, -daysSinceMonday)
+		return end.AddDate(0, 0, -7), end, nil
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("Unknown report interval '%v'", interval)
+}
+
+// buildScheduledReport exports the report for the period as a CSV file with
+// the amounts in decimals, and returns it with the number of its rows. The
+// sales are listed per day in the location of the period. Test orders are
+// left out, archived orders are included.
+func buildScheduledReport(db *gorm.DB, instanceID, report string, start, end time.Time) ([]byte, int, error) {
+	ordersTable := db.NewScope(models.Order{}).QuotedTableName()
+	paid := db.Model(&models.Order{}).
+		Where(ordersTable+".payment_state = ? AND "+ordersTable+".instance_id = ? AND "+ordersTable+".test = ?", models.PaidState, instanceID, false).
+		Where(ordersTable+".created_at >= ? AND "+ordersTable+".created_at < ?", start.UTC(), end.UTC())
+
+	records := [][]string{}
+	switch report {
+	case scheduledSalesReport:
+		records = append(records, []string{"day", "currency", "orders", "subtotal", "taxes", "total"})
+		for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+			rows, err := paid.
+				Select("currency, count(*), sum(sub_total), sum(taxes), sum(total)").
+				Where(ordersTable+".created_at >= ? AND "+ordersTable+".created_at < ?", day.UTC(), day.AddDate(0, 0, 1).UTC()).
+				Group("currency").
+				Order("currency").
+				Rows()
+			if err != nil {
+				return nil, 0, err
+			}
+			for rows.Next() {
+				var currency string
+				var orders, subtotal, taxes, total uint64
+				if err := rows.Scan(&currency, &orders, &subtotal, &taxes, &total); err != nil {
+					rows.Close()
+					return nil, 0, err
+				}
+				records = append(records, []string{day.Format("2006-01-02"), currency, strconv.FormatUint(orders, 10), formatAmount(subtotal), formatAmount(taxes), formatAmount(total)})
+			}
+			rows.Close()
+		}
+	case scheduledTaxesReport:
+		addressesTable := db.NewScope(models.Address{}).QuotedTableName()
+		records = append(records, []string{"country", "currency", "orders", "taxable_amount", "taxes"})
+		rows, err := paid.
+			Select(addressesTable + ".country, " + ordersTable + ".currency, count(*), sum(" + ordersTable + ".total - " + ordersTable + ".taxes), sum(" + ordersTable + ".taxes)").
+			Joins("LEFT JOIN " + addressesTable + " ON " + addressesTable + ".id = " + ordersTable + ".billing_address_id").
+			Group(addressesTable + ".country, " + ordersTable + ".currency").
+			Order(addressesTable + ".country, " + ordersTable + ".currency").
+			Rows()
+		if err != nil {
+			return nil, 0, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var country *string
+			var currency string
+			var orders, taxable, taxes uint64
+			if err := rows.Scan(&country, &currency, &orders, &taxable, &taxes); err != nil {
+				return nil, 0, err
+			}
+			code := ""
+			if country != nil {
+				code = *country
+			}
+			records = append(records, []string{code, currency, strconv.FormatUint(orders, 10), formatAmount(taxable), formatAmount(taxes)})
+		}
+	default:
+		return nil, 0, fmt.Errorf("Unknown scheduled report '%v'", report)
+	}
+
+	buf := &bytes.Buffer{}
+	out := csv.NewWriter(buf)
+	if err := out.WriteAll(records); err != nil {
+		return nil, 0, err
+	}
+	return buf.Bytes(), len(records) - 1, nil
+}
+
+// deliverReport sends the report to each destination of the schedule it
+// wasn't delivered to by an earlier attempt of the run. Each delivery is
+// recorded right away, so a destination that fails doesn't make the others
+// receive the report twice when the run is retried.
+func deliverReport(ctx context.Context, db *gorm.DB, schedule conf.ReportSchedule, run *models.ReportRun, filename string, report []byte) error {
+	if schedule.Email == "" && schedule.Webhook == "" && schedule.S3 == nil {
+		return errors.New("The schedule has no destination")
+	}
+	config := gcontext.GetConfig(ctx)
+	client := &http.Client{Timeout: reportDeliveryTimeout}
+	failures := []string{}
+	deliver := func(column string, at **time.Time, message string, send func() error) error {
+		if err := send(); err != nil {
+			failures = append(failures, errors.Wrap(err, message).Error())
+			return nil
+		}
+		now := time.Now()
+		*at = &now
+		return db.Model(run).UpdateColumn(column, now).Error
+	}
+	if schedule.Email != "" && run.EmailedAt == nil {
+		if err := deliver("emailed_at", &run.EmailedAt, "Error emailing report", func() error {
+			return gcontext.GetMailer(ctx).ScheduledReportMail(schedule.Email, run, filename, report)
+		}); err != nil {
+			return err
+		}
+	}
+	if schedule.Webhook != "" && run.PostedAt == nil {
+		if err := deliver("posted_at", &run.PostedAt, "Error posting report to webhook", func() error {
+			return postReport(client, schedule.Webhook, config.Webhooks.Secret, filename, report)
+		}); err != nil {
+			return err
+		}
+	}
+	if schedule.S3 != nil && run.UploadedAt == nil {
+		if err := deliver("uploaded_at", &run.UploadedAt, "Error uploading report to S3", func() error {
+			return uploadReportToS3(client, schedule.S3, filename, report, time.Now())
+		}); err != nil {
+			return err
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// alertReportFailed emails the admin and triggers the report_failed
+// webhook about a report that was given up on.
+func alertReportFailed(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, run *models.ReportRun) {
+	config := gcontext.GetConfig(ctx)
+	if config.Webhooks.ReportFailed != "" {
+		hook, err := models.NewHook("report_failed", config.SiteURL, config.Webhooks.ReportFailed, "", config.Webhooks.Secret, run)
+		if err != nil {
+			log.WithError(err).Error("Failed to process webhook")
+		} else {
+			db.Save(hook)
+		}
+	}
+	if err := gcontext.GetMailer(ctx).ReportFailedMail(run); err != nil {
+		log.WithError(err).Error("Error sending report failed mail")
+	}
+}
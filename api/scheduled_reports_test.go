@@ -0,0 +1,213 @@
+package api
+
+import (
+	"context"
+	"encoding/csv"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestScheduledReports(t *testing.T) {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	now := time.Date(2026, 10, 14, 8, 0, 0, 0, time.UTC)
+
+	type delivery struct {
+		method  string
+		path    string
+		headers http.Header
+		records [][]string
+	}
+	startDestination := func(t *testing.T, status int) (*httptest.Server, *[]*delivery) {
+		deliveries := []*delivery{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			records, err := csv.NewReader(strings.NewReader(string(body))).ReadAll()
+			require.NoError(t, err)
+			deliveries = append(deliveries, &delivery{r.Method, r.URL.Path, r.Header, records})
+			w.WriteHeader(status)
+		}))
+		return server, &deliveries
+	}
+	run := func(t *testing.T, test *RouteTest, schedules ...conf.ReportSchedule) {
+		test.Config.Reports.Schedules = schedules
+		ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+		require.NoError(t, err)
+		api := NewAPIWithVersion(ctx, test.GlobalConfig, logrus.StandardLogger(), test.DB, "")
+		api.runScheduledReports(ctx, test.DB, logrus.StandardLogger(), now)
+	}
+	setup := func(t *testing.T, createdAt time.Time) *RouteTest {
+		test := NewRouteTest(t)
+		for _, order := range []*models.Order{test.Data.firstOrder, test.Data.secondOrder} {
+			require.NoError(t, test.DB.Model(order).UpdateColumn("created_at", createdAt).Error)
+		}
+		return test
+	}
+
+	t.Run("DailySales", func(t *testing.T) {
+		test := setup(t, time.Date(2026, 10, 13, 15, 0, 0, 0, time.UTC))
+		server, deliveries := startDestination(t, http.StatusOK)
+		defer server.Close()
+		test.Config.Webhooks.Secret = "secret"
+		schedule := conf.ReportSchedule{
+			Name:     "daily-sales",
+			Report:   "sales",
+			Interval: "day",
+			Webhook:  server.URL + "/reports",
+			S3: &conf.S3DestinationConfiguration{
+				Bucket:          "exports",
+				Region:          "eu-west-1",
+				Prefix:          "gocommerce/",
+				Endpoint:        server.URL,
+				AccessKeyID:     "AKID",
+				SecretAccessKey: "secret",
+			},
+		}
+		run(t, test, schedule)
+		run(t, test, schedule)
+
+		require.Len(t, *deliveries, 2)
+		hook := (*deliveries)[0]
+		assert.Equal(t, http.MethodPost, hook.method)
+		assert.NotEmpty(t, hook.headers.Get("X-Commerce-Signature"))
+		assert.Equal(t, [][]string{
+			{"day", "currency", "orders", "subtotal", "taxes", "total"},
+			{"2026-10-13", "USD", "2", "0.79", "0.00", "0.79"},
+		}, hook.records)
+
+		upload := (*deliveries)[1]
+		assert.Equal(t, http.MethodPut, upload.method)
+		assert.Equal(t, "/exports/gocommerce/daily-sales-2026-10-13.csv", upload.path)
+		assert.True(t, strings.HasPrefix(upload.headers.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/"+time.Now().UTC().Format("20060102")+"/eu-west-1/s3/aws4_request"))
+		assert.Equal(t, hook.records, upload.records)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/runs?schedule=daily-sales", nil, token)
+		runs := []*models.ReportRun{}
+		extractPayload(t, http.StatusOK, recorder, &runs)
+		require.Len(t, runs, 1)
+		assert.Equal(t, models.ReportRunSucceeded, runs[0].Status)
+		assert.Equal(t, 1, runs[0].Rows)
+		assert.Equal(t, time.Date(2026, 10, 13, 0, 0, 0, 0, time.UTC), runs[0].PeriodStart.UTC())
+	})
+	t.Run("WeeklyTaxes", func(t *testing.T) {
+		test := setup(t, time.Date(2026, 10, 8, 15, 0, 0, 0, time.UTC))
+		server, deliveries := startDestination(t, http.StatusOK)
+		defer server.Close()
+		run(t, test, conf.ReportSchedule{Name: "weekly-taxes", Report: "taxes", Interval: "week", Webhook: server.URL})
+
+		require.Len(t, *deliveries, 1)
+		assert.Equal(t, [][]string{
+			{"country", "currency", "orders", "taxable_amount", "taxes"},
+			{"dcland", "USD", "2", "0.79", "0.00"},
+		}, (*deliveries)[0].records)
+
+		run := &models.ReportRun{}
+		require.NoError(t, test.DB.First(run, "schedule = ?", "weekly-taxes").Error)
+		assert.Equal(t, time.Date(2026, 10, 5, 0, 0, 0, 0, time.UTC), run.PeriodStart.UTC())
+		assert.Equal(t, time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC), run.PeriodEnd.UTC())
+	})
+	t.Run("Failures", func(t *testing.T) {
+		test := setup(t, time.Date(2026, 10, 13, 15, 0, 0, 0, time.UTC))
+		server, deliveries := startDestination(t, http.StatusInternalServerError)
+		defer server.Close()
+		test.Config.Webhooks.ReportFailed = "https://example.com/report_failed"
+		schedule := conf.ReportSchedule{Name: "daily-sales", Report: "sales", Interval: "day", Webhook: server.URL}
+		for i := 0; i < maxReportAttempts+1; i++ {
+			run(t, test, schedule)
+		}
+		assert.Len(t, *deliveries, maxReportAttempts)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/runs", nil, token)
+		runs := []*models.ReportRun{}
+		extractPayload(t, http.StatusOK, recorder, &runs)
+		require.Len(t, runs, 1)
+		assert.Equal(t, models.ReportRunFailed, runs[0].Status)
+		assert.Equal(t, maxReportAttempts, runs[0].Attempts)
+		assert.Contains(t, runs[0].Error, "500 Internal Server Error")
+
+		var hooks int
+		require.NoError(t, test.DB.Model(&models.Hook{}).Where("type = ?", "report_failed").Count(&hooks).Error)
+		assert.Equal(t, 1, hooks)
+	})
+	t.Run("PartialFailure", func(t *testing.T) {
+		test := setup(t, time.Date(2026, 10, 13, 15, 0, 0, 0, time.UTC))
+		hookServer, hooks := startDestination(t, http.StatusInternalServerError)
+		defer hookServer.Close()
+		s3Server, uploads := startDestination(t, http.StatusOK)
+		defer s3Server.Close()
+		schedule := conf.ReportSchedule{
+			Name:     "daily-sales",
+			Report:   "sales",
+			Interval: "day",
+			Email:    "accounting@example.com",
+			S3:       &conf.S3DestinationConfiguration{Bucket: "exports", Region: "eu-west-1", Endpoint: s3Server.URL, AccessKeyID: "AKID", SecretAccessKey: "secret"},
+			Webhook:  hookServer.URL,
+		}
+		run(t, test, schedule)
+		run(t, test, schedule)
+
+		// the email isn't sent and the report isn't uploaded again
+		assert.Len(t, *hooks, 2)
+		assert.Len(t, *uploads, 1)
+		run := &models.ReportRun{}
+		require.NoError(t, test.DB.First(run, "schedule = ?", "daily-sales").Error)
+		assert.Equal(t, models.ReportRunFailed, run.Status)
+		assert.Equal(t, 2, run.Attempts)
+		assert.NotNil(t, run.EmailedAt)
+		assert.Nil(t, run.PostedAt)
+		assert.NotNil(t, run.UploadedAt)
+	})
+	t.Run("Claimed", func(t *testing.T) {
+		test := setup(t, time.Date(2026, 10, 13, 15, 0, 0, 0, time.UTC))
+		server, deliveries := startDestination(t, http.StatusOK)
+		defer server.Close()
+		start := time.Date(2026, 10, 13, 0, 0, 0, 0, time.UTC)
+		claimed, err := models.ClaimReportRun(test.DB, test.Data.firstOrder.InstanceID, "daily-sales", "sales", start, start.AddDate(0, 0, 1), maxReportAttempts)
+		require.NoError(t, err)
+		require.NotNil(t, claimed)
+
+		// another scheduler is exporting the report
+		run(t, test, conf.ReportSchedule{Name: "daily-sales", Report: "sales", Interval: "day", Webhook: server.URL})
+		assert.Empty(t, *deliveries)
+		var runs int
+		require.NoError(t, test.DB.Model(&models.ReportRun{}).Where("schedule = ?", "daily-sales").Count(&runs).Error)
+		assert.Equal(t, 1, runs)
+	})
+	t.Run("Timezone", func(t *testing.T) {
+		test := setup(t, time.Date(2026, 10, 12, 23, 0, 0, 0, time.UTC))
+		server, deliveries := startDestination(t, http.StatusOK)
+		defer server.Close()
+		test.Config.Reports.Timezone = "Europe/Berlin"
+		run(t, test, conf.ReportSchedule{Name: "daily-sales", Report: "sales", Interval: "day", Webhook: server.URL})
+
+		require.Len(t, *deliveries, 1)
+		assert.Equal(t, [][]string{
+			{"day", "currency", "orders", "subtotal", "taxes", "total"},
+			{"2026-10-13", "USD", "2", "0.79", "0.00", "0.79"},
+		}, (*deliveries)[0].records)
+
+		run := &models.ReportRun{}
+		require.NoError(t, test.DB.First(run, "schedule = ?", "daily-sales").Error)
+		assert.Equal(t, time.Date(2026, 10, 12, 22, 0, 0, 0, time.UTC), run.PeriodStart.UTC())
+	})
+	t.Run("NoDestination", func(t *testing.T) {
+		test := setup(t, time.Date(2026, 10, 13, 15, 0, 0, 0, time.UTC))
+		run(t, test, conf.ReportSchedule{Name: "nowhere", Report: "sales", Interval: "day"})
+
+		run := &models.ReportRun{}
+		require.NoError(t, test.DB.First(run, "schedule = ?", "nowhere").Error)
+		assert.Equal(t, models.ReportRunFailed, run.Status)
+		assert.Equal(t, "The schedule has no destination", run.Error)
+	})
+}
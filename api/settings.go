@@ -5,7 +5,9 @@ import (
 	"net/http"
 
 	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/conf"
 	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/payments"
 )
 
 func (a *API) ViewSettings(w http.ResponseWriter, r *http.Request) error {
@@ -16,19 +18,46 @@ func (a *API) ViewSettings(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return fmt.Errorf("Error loading site settings: %v", err)
 	}
+	settings.PaymentMethods = paymentMethods(config, "")
 
+	sendJSON(w, 200, settings)
+	return nil
+}
+
+// AvailablePaymentMethods lists the payment methods that can be used for
+// orders from the country passed as the country query parameter.
+func (a *API) AvailablePaymentMethods(w http.ResponseWriter, r *http.Request) error {
+	config := gcontext.GetConfig(r.Context())
+	return sendJSON(w, http.StatusOK, paymentMethods(config, r.URL.Query().Get("country")))
+}
+
+// paymentMethods returns the enabled payment methods available for the
+// country. All enabled payment methods are returned if country is empty.
+func paymentMethods(config *conf.Configuration, country string) *calculator.PaymentMethods {
 	pms := &calculator.PaymentMethods{}
-	if config.Payment.Stripe.Enabled {
+	if config.Payment.Stripe.Enabled && config.PaymentProviderAllowed(payments.StripeProvider, country) {
 		pms.Stripe.Enabled = true
 		pms.Stripe.PublicKey = config.Payment.Stripe.PublicKey
 	}
-	if config.Payment.PayPal.Enabled {
+	if config.Payment.PayPal.Enabled && config.PaymentProviderAllowed(payments.PayPalProvider, country) {
 		pms.PayPal.Enabled = true
 		pms.PayPal.ClientID = config.Payment.PayPal.ClientID
 		pms.PayPal.Environment = config.Payment.PayPal.Env
 	}
-	settings.PaymentMethods = pms
-
-	sendJSON(w, 200, settings)
-	return nil
+	if config.Payment.Adyen.Enabled && config.PaymentProviderAllowed(payments.AdyenProvider, country) {
+		pms.Adyen.Enabled = true
+		pms.Adyen.ClientKey = config.Payment.Adyen.ClientKey
+		pms.Adyen.Environment = config.Payment.Adyen.Env
+	}
+	if config.Payment.Manual.Enabled && config.PaymentProviderAllowed(payments.ManualProvider, country) {
+		pms.Manual.Enabled = true
+		pms.Manual.Instructions = config.Payment.Manual.Instructions
+	}
+	if config.Payment.Coinbase.Enabled && config.PaymentProviderAllowed(payments.CoinbaseProvider, country) {
+		pms.Coinbase.Enabled = true
+	}
+	if config.Payment.Klarna.Enabled && config.PaymentProviderAllowed(payments.KlarnaProvider, country) {
+		pms.Klarna.Enabled = true
+	}
+	return pms
 }
@@ -0,0 +1,448 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/shipping"
+)
+
+// labelClaimTimeout is how long a shipment stays claimed by a request buying
+// its label, after which another request can buy it if the first one died.
+const labelClaimTimeout = 5 * time.Minute
+
+// ShipmentItemParams holds the quantity of a line item to ship
+type ShipmentItemParams struct {
+	LineItemID int64  `json:"line_item_id"`
+	Quantity   uint64 `json:"quantity"`
+}
+
+// ShipmentParams holds the parameters for creating a shipment. Without items
+// all line items that haven't been shipped yet are added to the shipment.
+// Without a location it's sent from the default stock location.
+type ShipmentParams struct {
+	Carrier        string                `json:"carrier"`
+	TrackingNumber string                `json:"tracking_number"`
+	TrackingURL    string                `json:"tracking_url"`
+	Location       string                `json:"location"`
+	Items          []*ShipmentItemParams `json:"items"`
+}
+
+// LabelParams holds the parameters for buying a shipping label. Without a
+// carrier and service the cheapest rate is bought.
+type LabelParams struct {
+	Carrier string `json:"carrier"`
+	Service string `json:"service"`
+}
+
+// ShipmentList lists the shipments of an order.
+func (a *API) ShipmentList(w http.ResponseWriter, r *http.Request) error {
+	order, httpErr := a.loadOrder(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	return sendJSON(w, http.StatusOK, order.Shipments)
+}
+
+// ShipmentCreate ships line items of an order and updates its fulfillment
+// state. It is only available to admins.
+func (a *API) ShipmentCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	config := gcontext.GetConfig(ctx)
+	claims := gcontext.GetClaims(ctx)
+
+	params := &ShipmentParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read shipment params: %v", err)
+	}
+
+	order, httpErr := a.loadOrder(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if order.State == models.CancelledState {
+		return badRequestError("Cancelled orders can't be shipped")
+	}
+	if order.PickupLocation != "" {
+		return badRequestError("Orders collected at a pickup location aren't shipped")
+	}
+	if httpErr := a.checkStockLocation(r, params.Location); httpErr != nil {
+		return httpErr
+	}
+
+	db := a.DB(r)
+	shipped, err := models.ShippedQuantities(db, order.ID)
+	if err != nil {
+		return internalServerError("Error while querying for shipments").WithInternalError(err)
+	}
+
+	shipment := models.NewShipment(order, params.Carrier, params.TrackingNumber, params.TrackingURL)
+	shipment.Location = params.Location
+	trackShipment(config, log, shipment)
+	if len(params.Items) == 0 {
+		for _, item := range order.LineItems {
+			if shipped[item.ID] < item.Quantity {
+				shipment.AddItem(item, item.Quantity-shipped[item.ID])
+				shipped[item.ID] = item.Quantity
+			}
+		}
+		if len(shipment.Items) == 0 {
+			return badRequestError("All line items of this order have already been shipped")
+		}
+	}
+	for _, itemParams := range params.Items {
+		var item *models.LineItem
+		for _, lineItem := range order.LineItems {
+			if lineItem.ID == itemParams.LineItemID {
+				item = lineItem
+				break
+			}
+		}
+		if item == nil {
+			return badRequestError("Order has no line item with id %d", itemParams.LineItemID)
+		}
+		if itemParams.Quantity == 0 {
+			return badRequestError("The quantity of line item %d must be positive", item.ID)
+		}
+		if shipped[item.ID]+itemParams.Quantity > item.Quantity {
+			return badRequestError("Only %d of line item %d are left to ship", item.Quantity-shipped[item.ID], item.ID)
+		}
+		shipped[item.ID] += itemParams.Quantity
+		shipment.AddItem(item, itemParams.Quantity)
+	}
+
+	tx := db.Begin()
+	if rsp := tx.Create(shipment); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving shipment").WithInternalError(rsp.Error)
+	}
+	moved, err := models.ShipFromLocation(tx, shipment)
+	if err != nil {
+		tx.Rollback()
+		if outOfStock, ok := err.(*models.OutOfStockError); ok {
+			return badRequestError("%v at this location", outOfStock).WithReason(outOfStockReason)
+		}
+		return internalServerError("Error allocating stock").WithInternalError(err)
+	}
+	if len(moved) > 0 {
+		alertLowStock(ctx, tx, log, order.InstanceID, moved)
+	}
+
+	changes := []string{fmt.Sprintf("shipments.%s", shipment.ID)}
+	if state := order.FulfillmentStateFor(shipped); state != order.FulfillmentState {
+		changes = append(changes, "fulfillment_state")
+		order.FulfillmentState = state
+		tx.Model(&models.Order{}).Where("id = ?", order.ID).Update("fulfillment_state", state)
+	}
+	order.Shipments = append(order.Shipments, shipment)
+
+	models.LogEvent(tx, r.RemoteAddr, claims.Subject, order.ID, models.EventUpdated, changes)
+	if config.Webhooks.Update != "" {
+		hook, err := models.NewHook("update", config.SiteURL, config.Webhooks.Update, order.UserID, config.Webhooks.Secret, order)
+		if err != nil {
+			log.WithError(err).Error("Failed to process webhook")
+		} else {
+			tx.Save(hook)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return internalServerError("Error saving shipment").WithInternalError(err)
+	}
+
+	log.WithField("shipment_id", shipment.ID).Info("Created shipment")
+	return sendJSON(w, http.StatusCreated, shipment)
+}
+
+// ShipmentUpdate attaches the carrier and tracking number to a shipment of an
+// order. It is only available to admins.
+func (a *API) ShipmentUpdate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	config := gcontext.GetConfig(ctx)
+	claims := gcontext.GetClaims(ctx)
+
+	params := &ShipmentParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read shipment params: %v", err)
+	}
+	if len(params.Items) > 0 {
+		return badRequestError("The items of a shipment can't be changed")
+	}
+
+	order, httpErr := a.loadOrder(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	shipment := orderShipment(order, chi.URLParam(r, "shipment_id"))
+	if shipment == nil {
+		return notFoundError("Shipment not found")
+	}
+
+	if params.Carrier != shipment.Carrier || params.TrackingNumber != shipment.TrackingNumber {
+		shipment.Carrier = params.Carrier
+		shipment.TrackingNumber = params.TrackingNumber
+		shipment.TrackerID = ""
+		shipment.Status = ""
+		shipment.StatusDetail = ""
+		shipment.DeliveredAt = nil
+		trackShipment(config, log, shipment)
+	}
+	shipment.TrackingURL = params.TrackingURL
+
+	tx := a.DB(r).Begin()
+	if rsp := tx.Save(shipment); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving shipment").WithInternalError(rsp.Error)
+	}
+	models.LogEvent(tx, r.RemoteAddr, claims.Subject, order.ID, models.EventUpdated, []string{fmt.Sprintf("shipments.%s", shipment.ID)})
+	if err := tx.Commit().Error; err != nil {
+		return internalServerError("Error saving shipment").WithInternalError(err)
+	}
+	return sendJSON(w, http.StatusOK, shipment)
+}
+
+// ShipmentLabel buys a shipping label for a shipment of an order with the
+// shipping backend, and sets its carrier and tracking number to those of the
+// label. The shipment is claimed before the label is bought, so concurrent
+// requests don't buy it twice, and a label that can't be saved is voided. It
+// is only available to admins.
+func (a *API) ShipmentLabel(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	db := a.DB(r)
+	log := getLogEntry(r)
+	config := gcontext.GetConfig(ctx)
+	claims := gcontext.GetClaims(ctx)
+
+	if config.Shipping.Provider == "" {
+		return badRequestError("No shipping backend is configured to buy labels")
+	}
+	params := &LabelParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read label params: %v", err)
+	}
+
+	order, httpErr := a.loadOrder(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	shipment := orderShipment(order, chi.URLParam(r, "shipment_id"))
+	if shipment == nil {
+		return notFoundError("Shipment not found")
+	}
+	if shipment.LabelURL != "" {
+		return badRequestError("A label has already been bought for this shipment")
+	}
+
+	provider, err := newLabelProvider(config, config.Shipping.Provider)
+	if err != nil {
+		return internalServerError("Failed to set up the shipping backend").WithInternalError(err)
+	}
+	parcel := labelShipment(config, order, shipment)
+	if shipment.Location != "" {
+		location := &models.StockLocation{}
+		if rsp := db.First(location, "instance_id = ? AND id = ?", order.InstanceID, shipment.Location); rsp.Error != nil {
+			return internalServerError("Error loading stock location").WithInternalError(rsp.Error)
+		}
+		parcel.From = shipping.Address{
+			Name:    location.Name,
+			Country: location.Country,
+			Zip:     location.Zip,
+			State:   location.State,
+			City:    location.City,
+			Street:  location.Street,
+		}
+	}
+
+	now := time.Now()
+	rsp := db.Model(&models.Shipment{}).
+		Where("id = ? AND label_url = ? AND (label_claimed_at IS NULL OR label_claimed_at < ?)", shipment.ID, "", now.Add(-labelClaimTimeout)).
+		UpdateColumn("label_claimed_at", now)
+	if rsp.Error != nil {
+		return internalServerError("Error claiming shipment").WithInternalError(rsp.Error)
+	}
+	if rsp.RowsAffected == 0 {
+		return httpError(http.StatusConflict, "A label is already being bought for this shipment")
+	}
+	shipment.LabelClaimedAt = &now
+
+	label, err := provider.BuyLabel(parcel, params.Carrier, params.Service)
+	if err != nil {
+		releaseLabelClaim(db, log, shipment)
+		return internalServerError("Error buying label").WithInternalError(err)
+	}
+	log.WithField("shipment_id", shipment.ID).Infof("Bought label %s with %s", label.ID, config.Shipping.Provider)
+
+	shipment.Carrier = label.Carrier
+	shipment.TrackingNumber = label.TrackingNumber
+	shipment.LabelURL = label.URL
+	shipment.LabelCost = label.Amount
+	shipment.LabelCurrency = label.Currency
+	if label.TrackerID != "" {
+		shipment.TrackerID = label.TrackerID
+		shipment.Status = shipping.StatusPreTransit
+	}
+
+	tx := db.Begin()
+	err = tx.Save(shipment).Error
+	if err == nil {
+		models.LogEvent(tx, r.RemoteAddr, claims.Subject, order.ID, models.EventUpdated, []string{fmt.Sprintf("shipments.%s", shipment.ID)})
+		if config.Webhooks.Update != "" {
+			hook, hookErr := models.NewHook("update", config.SiteURL, config.Webhooks.Update, order.UserID, config.Webhooks.Secret, order)
+			if hookErr != nil {
+				log.WithError(hookErr).Error("Failed to process webhook")
+			} else {
+				tx.Save(hook)
+			}
+		}
+		err = tx.Commit().Error
+	}
+	if err != nil {
+		tx.Rollback()
+		if voidErr := provider.VoidLabel(label); voidErr != nil {
+			log.WithError(voidErr).Errorf("Failed to void label %s of shipment %s", label.ID, shipment.ID)
+		} else {
+			log.WithField("shipment_id", shipment.ID).Infof("Voided label %s", label.ID)
+		}
+		releaseLabelClaim(db, log, shipment)
+		return internalServerError("Error saving shipment").WithInternalError(err)
+	}
+	return sendJSON(w, http.StatusOK, shipment)
+}
+
+// releaseLabelClaim releases the claim of a shipment no label was bought for,
+// so it can be bought again.
+func releaseLabelClaim(db *gorm.DB, log logrus.FieldLogger, shipment *models.Shipment) {
+	rsp := db.Model(&models.Shipment{}).Where("id = ? AND label_url = ?", shipment.ID, "").UpdateColumn("label_claimed_at", nil)
+	if rsp.Error != nil {
+		log.WithError(rsp.Error).Errorf("Failed to release the label claim of shipment %s", shipment.ID)
+	}
+}
+
+// orderShipment returns the shipment of the order with the ID, or nil.
+func orderShipment(order *models.Order, id string) *models.Shipment {
+	for _, shipment := range order.Shipments {
+		if shipment.ID == id {
+			return shipment
+		}
+	}
+	return nil
+}
+
+// trackShipment starts tracking a shipment with its tracking number with the
+// tracking backend. Shipments are saved without a status if the backend
+// fails.
+func trackShipment(config *conf.Configuration, log logrus.FieldLogger, shipment *models.Shipment) {
+	if config.Shipping.TrackingProvider == "" || shipment.TrackingNumber == "" {
+		return
+	}
+	tracker, err := newTracker(config, config.Shipping.TrackingProvider)
+	if err != nil {
+		log.WithError(err).Error("Failed to set up the tracking backend")
+		return
+	}
+	status, err := tracker.Track(shipment.Carrier, shipment.TrackingNumber)
+	if err != nil {
+		log.WithError(err).Errorf("Failed to track shipment with %s", config.Shipping.TrackingProvider)
+		return
+	}
+	shipment.TrackerID = status.ID
+	shipment.Status = status.Status
+	shipment.StatusDetail = status.Detail
+	if status.Status == shipping.StatusDelivered {
+		now := time.Now()
+		shipment.DeliveredAt = &now
+	}
+}
+
+// updateTrackingStatus applies the status of a tracked shipment reported by
+// the tracking backend. Once all shipments of a shipped order have been
+// delivered the order is marked as delivered, and the customer is notified
+// of every delivered shipment.
+func updateTrackingStatus(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, status *shipping.TrackingStatus) error {
+	config := gcontext.GetConfig(ctx)
+	if status.ID == "" {
+		return errors.New("Tracking update without a tracker_id")
+	}
+	tx := db.Begin()
+	query := tx.Where("instance_id = ?", gcontext.GetInstanceID(ctx))
+	if status.TrackingNumber != "" {
+		query = query.Where("tracker_id = ? OR (tracking_number = ? AND carrier = ?)", status.ID, status.TrackingNumber, status.Carrier)
+	} else {
+		query = query.Where("tracker_id = ?", status.ID)
+	}
+	shipment := &models.Shipment{}
+	rsp := query.First(shipment)
+	if rsp.RecordNotFound() {
+		tx.Rollback()
+		log.WithField("tracker_id", status.ID).Info("No shipment found for tracking update")
+		return nil
+	}
+	if rsp.Error != nil {
+		tx.Rollback()
+		return rsp.Error
+	}
+	if shipment.Status == status.Status && shipment.StatusDetail == status.Detail {
+		tx.Rollback()
+		return nil
+	}
+
+	delivered := status.Status == shipping.StatusDelivered && !shipment.Delivered()
+	shipment.TrackerID = status.ID
+	shipment.Status = status.Status
+	shipment.StatusDetail = status.Detail
+	if delivered {
+		now := time.Now()
+		shipment.DeliveredAt = &now
+	}
+	if rsp := tx.Save(shipment); rsp.Error != nil {
+		tx.Rollback()
+		return rsp.Error
+	}
+
+	order := &models.Order{}
+	if rsp := tx.Preload("LineItems").Preload("Shipments").Preload("Shipments.Items").First(order, "id = ?", shipment.OrderID); rsp.Error != nil {
+		tx.Rollback()
+		return rsp.Error
+	}
+	changes := []string{fmt.Sprintf("shipments.%s", shipment.ID)}
+	if state := order.DeliveredStateFor(order.Shipments); state != order.FulfillmentState {
+		changes = append(changes, "fulfillment_state")
+		order.FulfillmentState = state
+		tx.Model(&models.Order{}).Where("id = ?", order.ID).Update("fulfillment_state", state)
+	}
+
+	models.LogEvent(tx, "", "", order.ID, models.EventUpdated, changes)
+	if config.Webhooks.Update != "" {
+		hook, err := models.NewHook("update", config.SiteURL, config.Webhooks.Update, order.UserID, config.Webhooks.Secret, order)
+		if err != nil {
+			log.WithError(err).Error("Failed to process webhook")
+		} else {
+			tx.Save(hook)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	log.WithField("shipment_id", shipment.ID).WithField("status", status.Status).Info("Updated shipment tracking status")
+
+	if delivered && notificationAllowed(db, log, order.InstanceID, order.UserID, order.Email, models.ShipmentUpdatesNotification) {
+		if err := gcontext.GetMailer(ctx).ShipmentDeliveredMail(order, shipment); err != nil {
+			log.WithError(err).Error("Error sending shipment delivered mail")
+		} else {
+			models.LogEvent(db, "", "", order.ID, models.EventEmailed, []string{"shipment_delivered"})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/shipping"
+)
+
+func TestShipments(t *testing.T) {
+	url := "/orders/first-order/shipments"
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	t.Run("Partial", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := strings.NewReader(`{"carrier": "UPS", "tracking_number": "1Z999", "items": [{"line_item_id": 11, "quantity": 1}]}`)
+		recorder := test.TestEndpoint(http.MethodPost, url, body, token)
+		shipment := &models.Shipment{}
+		extractPayload(t, http.StatusCreated, recorder, shipment)
+		assert.Equal(t, "UPS", shipment.Carrier)
+		assert.Equal(t, "1Z999", shipment.TrackingNumber)
+		require.Len(t, shipment.Items, 1)
+		assert.EqualValues(t, 1, shipment.Items[0].Quantity)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, models.ShippingState, order.FulfillmentState)
+
+		// the rest of the order is shipped without listing the items
+		body = strings.NewReader(`{"carrier": "DHL", "tracking_number": "JD014"}`)
+		recorder = test.TestEndpoint(http.MethodPost, url, body, token)
+		shipment = &models.Shipment{}
+		extractPayload(t, http.StatusCreated, recorder, shipment)
+		require.Len(t, shipment.Items, 1)
+		assert.EqualValues(t, 1, shipment.Items[0].Quantity)
+
+		order = &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, models.ShippedState, order.FulfillmentState)
+
+		recorder = test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{}`), token)
+		validateError(t, http.StatusBadRequest, recorder, "already been shipped")
+	})
+	t.Run("TooMany", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := strings.NewReader(`{"items": [{"line_item_id": 11, "quantity": 3}]}`)
+		recorder := test.TestEndpoint(http.MethodPost, url, body, token)
+		validateError(t, http.StatusBadRequest, recorder, "Only 2 of line item 11")
+	})
+	t.Run("CustomerList", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := strings.NewReader(`{"carrier": "UPS", "tracking_number": "1Z999"}`)
+		recorder := test.TestEndpoint(http.MethodPost, url, body, token)
+		require.Equal(t, http.StatusCreated, recorder.Code)
+
+		recorder = test.TestEndpoint(http.MethodGet, url, nil, test.Data.testUserToken)
+		shipments := []models.Shipment{}
+		extractPayload(t, http.StatusOK, recorder, &shipments)
+		require.Len(t, shipments, 1)
+		assert.Equal(t, "1Z999", shipments[0].TrackingNumber)
+		assert.Len(t, shipments[0].Items, 1)
+	})
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{}`), test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
+const testEasyPostWebhookSecret = "easypost-secret"
+
+func runEasyPostWebhook(test *RouteTest, description, result string) *httptest.ResponseRecorder {
+	payload := `{"object": "Event", "description": "` + description + `", "result": ` + result + `}`
+	mac := hmac.New(sha256.New, []byte(testEasyPostWebhookSecret))
+	mac.Write([]byte(payload))
+	headers := map[string]string{"X-Hmac-Signature": "hmac-sha256-hex=" + hex.EncodeToString(mac.Sum(nil))}
+	return test.TestEndpointWithHeaders(http.MethodPost, "/webhooks/easypost", strings.NewReader(payload), nil, headers)
+}
+
+func TestShipmentTracking(t *testing.T) {
+	url := "/orders/first-order/shipments"
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/trackers", r.URL.Path)
+		body := map[string]map[string]string{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{
+			"id":            "trk_" + body["tracker"]["tracking_code"],
+			"tracking_code": body["tracker"]["tracking_code"],
+			"carrier":       body["tracker"]["carrier"],
+			"status":        shipping.StatusPreTransit,
+		})
+	}))
+	defer server.Close()
+
+	newTest := func(t *testing.T) *RouteTest {
+		test := NewRouteTest(t)
+		test.Config.Shipping.TrackingProvider = easyPostProvider
+		test.Config.Shipping.EasyPost.APIKey = "easypost-key"
+		test.Config.Shipping.EasyPost.WebhookSecret = testEasyPostWebhookSecret
+		test.Config.Shipping.EasyPost.URL = server.URL
+		return test
+	}
+
+	t.Run("Delivered", func(t *testing.T) {
+		test := newTest(t)
+		body := strings.NewReader(`{"carrier": "UPS", "tracking_number": "1Z999"}`)
+		recorder := test.TestEndpoint(http.MethodPost, url, body, token)
+		shipment := &models.Shipment{}
+		extractPayload(t, http.StatusCreated, recorder, shipment)
+		assert.Equal(t, shipping.StatusPreTransit, shipment.Status)
+
+		recorder = runEasyPostWebhook(test, "tracker.updated", `{"id": "trk_1Z999", "tracking_code": "1Z999", "carrier": "UPS", "status": "in_transit"}`)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, models.ShippedState, order.FulfillmentState)
+
+		recorder = runEasyPostWebhook(test, "tracker.updated", `{"id": "trk_1Z999", "tracking_code": "1Z999", "carrier": "UPS", "status": "delivered", "status_detail": "arrived_at_destination"}`)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		shipment = &models.Shipment{}
+		require.NoError(t, test.DB.First(shipment, "tracker_id = ?", "trk_1Z999").Error)
+		assert.Equal(t, shipping.StatusDelivered, shipment.Status)
+		assert.Equal(t, "arrived_at_destination", shipment.StatusDetail)
+		assert.NotNil(t, shipment.DeliveredAt)
+
+		order = &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, models.DeliveredState, order.FulfillmentState)
+	})
+	t.Run("PartiallyDelivered", func(t *testing.T) {
+		test := newTest(t)
+		body := strings.NewReader(`{"carrier": "UPS", "tracking_number": "1Z999", "items": [{"line_item_id": 11, "quantity": 1}]}`)
+		recorder := test.TestEndpoint(http.MethodPost, url, body, token)
+		require.Equal(t, http.StatusCreated, recorder.Code)
+		body = strings.NewReader(`{"carrier": "DHL", "tracking_number": "JD014"}`)
+		recorder = test.TestEndpoint(http.MethodPost, url, body, token)
+		require.Equal(t, http.StatusCreated, recorder.Code)
+
+		recorder = runEasyPostWebhook(test, "tracker.updated", `{"id": "trk_1Z999", "tracking_code": "1Z999", "carrier": "UPS", "status": "delivered"}`)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, models.ShippedState, order.FulfillmentState)
+	})
+	t.Run("Update", func(t *testing.T) {
+		test := newTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{}`), token)
+		shipment := &models.Shipment{}
+		extractPayload(t, http.StatusCreated, recorder, shipment)
+		assert.Empty(t, shipment.Status)
+
+		body := strings.NewReader(`{"carrier": "UPS", "tracking_number": "1Z999", "tracking_url": "https://ups.com/1Z999"}`)
+		recorder = test.TestEndpoint(http.MethodPut, url+"/"+shipment.ID, body, token)
+		shipment = &models.Shipment{}
+		extractPayload(t, http.StatusOK, recorder, shipment)
+		assert.Equal(t, "1Z999", shipment.TrackingNumber)
+		assert.Equal(t, "https://ups.com/1Z999", shipment.TrackingURL)
+		assert.Equal(t, shipping.StatusPreTransit, shipment.Status)
+
+		recorder = test.TestEndpoint(http.MethodPut, url+"/"+shipment.ID, strings.NewReader(`{}`), test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+		recorder = test.TestEndpoint(http.MethodPut, url+"/unknown", strings.NewReader(`{}`), token)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+	t.Run("InvalidSignature", func(t *testing.T) {
+		test := newTest(t)
+		test.Config.Shipping.EasyPost.WebhookSecret = "other-secret"
+		recorder := runEasyPostWebhook(test, "tracker.updated", `{"id": "trk_1Z999", "status": "delivered"}`)
+		validateError(t, http.StatusBadRequest, recorder, "Invalid EasyPost webhook")
+	})
+	t.Run("MissingTrackerID", func(t *testing.T) {
+		test := newTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{}`), token)
+		shipment := &models.Shipment{}
+		extractPayload(t, http.StatusCreated, recorder, shipment)
+
+		recorder = runEasyPostWebhook(test, "tracker.updated", `{"status": "delivered"}`)
+		validateError(t, http.StatusBadRequest, recorder, "tracker_id")
+		require.NoError(t, test.DB.First(shipment, "id = ?", shipment.ID).Error)
+		assert.Empty(t, shipment.Status)
+		assert.Nil(t, shipment.DeliveredAt)
+	})
+	t.Run("NotConfigured", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := runEasyPostWebhook(test, "tracker.updated", `{"id": "trk_1Z999", "status": "delivered"}`)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+}
+
+func TestShipmentLabel(t *testing.T) {
+	url := "/orders/first-order/shipments"
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	bought, voided := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/shipments":
+			body := map[string]map[string]map[string]interface{}{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, "PDF", body["shipment"]["options"]["label_format"])
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id": "shp_1", "rates": [
+				{"id": "rate_1", "carrier": "USPS", "service": "Priority", "rate": "7.90", "currency": "USD"},
+				{"id": "rate_2", "carrier": "UPS", "service": "Ground", "rate": "9.20", "currency": "USD"}
+			]}`))
+		case "/shipments/shp_1/refund":
+			voided++
+			w.Write([]byte(`{"id": "shp_1", "refund_status": "submitted"}`))
+		case "/shipments/shp_1/buy":
+			bought++
+			body := map[string]map[string]string{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			w.Write([]byte(`{"id": "shp_1", "tracking_code": "TRK-` + body["rate"]["id"] + `",
+				"postage_label": {"label_url": "https://easypost.test/label.png", "label_pdf_url": "https://easypost.test/label.pdf"},
+				"tracker": {"id": "trk_1"}}`))
+		default:
+			t.Fatalf("unknown EasyPost API call to %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	newTest := func(t *testing.T) (*RouteTest, *models.Shipment) {
+		test := NewRouteTest(t)
+		test.Config.Shipping.Provider = easyPostProvider
+		test.Config.Shipping.EasyPost.APIKey = "easypost-key"
+		test.Config.Shipping.EasyPost.URL = server.URL
+		recorder := test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{}`), token)
+		shipment := &models.Shipment{}
+		extractPayload(t, http.StatusCreated, recorder, shipment)
+		return test, shipment
+	}
+
+	t.Run("Cheapest", func(t *testing.T) {
+		test, shipment := newTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, url+"/"+shipment.ID+"/label", strings.NewReader(`{}`), token)
+		extractPayload(t, http.StatusOK, recorder, shipment)
+		assert.Equal(t, "USPS", shipment.Carrier)
+		assert.Equal(t, "TRK-rate_1", shipment.TrackingNumber)
+		assert.Equal(t, "https://easypost.test/label.pdf", shipment.LabelURL)
+		assert.EqualValues(t, 790, shipment.LabelCost)
+		assert.Equal(t, "USD", shipment.LabelCurrency)
+
+		stored := &models.Shipment{}
+		require.NoError(t, test.DB.First(stored, "id = ?", shipment.ID).Error)
+		assert.Equal(t, "trk_1", stored.TrackerID)
+
+		recorder = test.TestEndpoint(http.MethodPost, url+"/"+shipment.ID+"/label", strings.NewReader(`{}`), token)
+		validateError(t, http.StatusBadRequest, recorder, "already been bought")
+	})
+	t.Run("Service", func(t *testing.T) {
+		test, shipment := newTest(t)
+		body := strings.NewReader(`{"carrier": "UPS", "service": "Ground"}`)
+		recorder := test.TestEndpoint(http.MethodPost, url+"/"+shipment.ID+"/label", body, token)
+		extractPayload(t, http.StatusOK, recorder, shipment)
+		assert.Equal(t, "UPS", shipment.Carrier)
+		assert.Equal(t, "TRK-rate_2", shipment.TrackingNumber)
+		assert.EqualValues(t, 920, shipment.LabelCost)
+	})
+	t.Run("Claimed", func(t *testing.T) {
+		test, shipment := newTest(t)
+		require.NoError(t, test.DB.Model(shipment).UpdateColumn("label_claimed_at", time.Now()).Error)
+		before := bought
+		recorder := test.TestEndpoint(http.MethodPost, url+"/"+shipment.ID+"/label", strings.NewReader(`{}`), token)
+		validateError(t, http.StatusConflict, recorder, "already being bought")
+		assert.Equal(t, before, bought)
+
+		require.NoError(t, test.DB.Model(shipment).UpdateColumn("label_claimed_at", time.Now().Add(-labelClaimTimeout-time.Minute)).Error)
+		recorder = test.TestEndpoint(http.MethodPost, url+"/"+shipment.ID+"/label", strings.NewReader(`{}`), token)
+		extractPayload(t, http.StatusOK, recorder, shipment)
+		assert.Equal(t, before+1, bought)
+	})
+	t.Run("BuyFailed", func(t *testing.T) {
+		test, shipment := newTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, url+"/"+shipment.ID+"/label", strings.NewReader(`{"carrier": "FedEx"}`), token)
+		validateError(t, http.StatusInternalServerError, recorder)
+
+		stored := &models.Shipment{}
+		require.NoError(t, test.DB.First(stored, "id = ?", shipment.ID).Error)
+		assert.Nil(t, stored.LabelClaimedAt)
+		recorder = test.TestEndpoint(http.MethodPost, url+"/"+shipment.ID+"/label", strings.NewReader(`{}`), token)
+		extractPayload(t, http.StatusOK, recorder, shipment)
+	})
+	t.Run("SaveFailed", func(t *testing.T) {
+		test, shipment := newTest(t)
+		test.DB.Callback().Update().Before("gorm:update").Register("test:fail_label", func(scope *gorm.Scope) {
+			if saved, ok := scope.Value.(*models.Shipment); ok && saved.LabelURL != "" {
+				scope.Err(errors.New("database is gone"))
+			}
+		})
+		defer test.DB.Callback().Update().Remove("test:fail_label")
+
+		before := voided
+		recorder := test.TestEndpoint(http.MethodPost, url+"/"+shipment.ID+"/label", strings.NewReader(`{}`), token)
+		validateError(t, http.StatusInternalServerError, recorder)
+		assert.Equal(t, before+1, voided)
+
+		stored := &models.Shipment{}
+		require.NoError(t, test.DB.First(stored, "id = ?", shipment.ID).Error)
+		assert.Empty(t, stored.LabelURL)
+		assert.Nil(t, stored.LabelClaimedAt)
+	})
+	t.Run("NotConfigured", func(t *testing.T) {
+		test, shipment := newTest(t)
+		test.Config.Shipping.Provider = ""
+		recorder := test.TestEndpoint(http.MethodPost, url+"/"+shipment.ID+"/label", strings.NewReader(`{}`), token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+}
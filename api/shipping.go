@@ -0,0 +1,313 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/shipping"
+	"github.com/netlify/gocommerce/shipping/easypost"
+)
+
+// easyPostProvider is the shipping backend quoting live rates with EasyPost.
+const easyPostProvider = "easypost"
+
+// outsideShippingZonesReason is the reason orders shipping to an address
+// outside the shipping zones of the settings are rejected with.
+const outsideShippingZonesReason = "outside_shipping_zones"
+
+// defaultShippingRateTTL is how long live rates can be picked at checkout if
+// the configuration doesn't set it.
+const defaultShippingRateTTL = 10 * time.Minute
+
+// shippingRate is a shipping method of the settings or a live rate of a
+// carrier, as listed for a cart.
+type shippingRate struct {
+	calculator.ShippingQuote
+
+	Provider     string `json:"provider,omitempty"`
+	Carrier      string `json:"carrier,omitempty"`
+	Service      string `json:"service,omitempty"`
+	DeliveryDays int    `json:"delivery_days,omitempty"`
+}
+
+// newRateProvider returns the client of the shipping backend.
+func newRateProvider(config *conf.Configuration, provider string) (shipping.RateProvider, error) {
+	switch provider {
+	case easyPostProvider:
+		return easypost.NewClient(easypost.Config{
+			APIKey: config.Shipping.EasyPost.APIKey,
+			URL:    config.Shipping.EasyPost.URL,
+		})
+	}
+	return nil, fmt.Errorf("Unknown shipping provider %s", provider)
+}
+
+// newLabelProvider returns the client of the shipping backend buying labels.
+func newLabelProvider(config *conf.Configuration, provider string) (shipping.LabelProvider, error) {
+	switch provider {
+	case easyPostProvider:
+		return easypost.NewClient(easypost.Config{
+			APIKey: config.Shipping.EasyPost.APIKey,
+			URL:    config.Shipping.EasyPost.URL,
+		})
+	}
+	return nil, fmt.Errorf("Unknown shipping provider %s", provider)
+}
+
+// newTracker returns the client of the tracking backend.
+func newTracker(config *conf.Configuration, provider string) (shipping.Tracker, error) {
+	switch provider {
+	case easyPostProvider:
+		return easypost.NewClient(easypost.Config{
+			APIKey:        config.Shipping.EasyPost.APIKey,
+			WebhookSecret: config.Shipping.EasyPost.WebhookSecret,
+			URL:           config.Shipping.EasyPost.URL,
+		})
+	}
+	return nil, fmt.Errorf("Unknown tracking provider %s", provider)
+}
+
+// ShippingRateList returns the prices of the shipping methods of the settings
+// available for the cart in the query parameters, shipping to its country or
+// the country and state in the query parameters. With a shipping backend, the
+// live rates of the carriers for the zip, state and city in the query
+// parameters are listed as well.
+func (a *API) ShippingRateList(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	query := r.URL.Query()
+	cartID := query.Get("cart")
+	if cartID == "" {
+		return badRequestError("A cart is required")
+	}
+	cart, httpErr := a.loadCartByID(r, cartID)
+	if httpErr != nil {
+		return httpErr
+	}
+	if country := query.Get("country"); country != "" {
+		cart.Country = country
+	}
+
+	order, settings, err := a.cartOrder(w, r, cart)
+	if err != nil {
+		return err
+	}
+	order.ShippingAddress.Zip = query.Get("zip")
+	order.ShippingAddress.State = query.Get("state")
+	order.ShippingAddress.City = query.Get("city")
+	order.ShippingAddress.Address1 = query.Get("address1")
+	params := order.ShippingParameters()
+
+	rates := []shippingRate{}
+	for _, quote := range calculator.ShippingQuotes(settings, params) {
+		rates = append(rates, shippingRate{ShippingQuote: quote})
+	}
+
+	config := gcontext.GetConfig(ctx)
+	if config.Shipping.Provider != "" && order.ShippingAddress.Zip != "" &&
+		calculator.ShippingMethodAllowed(settings, params, config.Shipping.Provider) {
+		rates = append(rates, liveRates(ctx, a.DB(r), config, getLogEntry(r), order)...)
+	}
+	return sendJSON(w, http.StatusOK, rates)
+}
+
+// liveRates returns the rates the carriers of the shipping backend quote for
+// the items of the order in its currency, and stores them for checkout. No
+// rates are returned if the backend fails.
+func liveRates(ctx context.Context, db *gorm.DB, config *conf.Configuration, log logrus.FieldLogger, order *models.Order) []shippingRate {
+	provider, err := newRateProvider(config, config.Shipping.Provider)
+	if err != nil {
+		log.WithError(err).Error("Failed to set up the shipping backend")
+		return nil
+	}
+	quotes, err := provider.Rates(shippingShipment(config, order))
+	if err != nil {
+		log.WithError(err).Errorf("Failed to get live rates from %s", config.Shipping.Provider)
+		return nil
+	}
+
+	ttl := defaultShippingRateTTL
+	if config.Shipping.RateTTL > 0 {
+		ttl = time.Duration(config.Shipping.RateTTL) * time.Second
+	}
+	expiresAt := time.Now().Add(ttl)
+	instanceID := gcontext.GetInstanceID(ctx)
+	weight := order.ShippingParameters().Weight
+
+	if err := models.DeleteExpiredShippingRates(db); err != nil {
+		log.WithError(err).Warn("Failed to delete expired shipping rates")
+	}
+	rates := []shippingRate{}
+	for _, quote := range quotes {
+		if quote.Currency != order.Currency {
+			continue
+		}
+		rate := shippingRate{
+			ShippingQuote: calculator.ShippingQuote{
+				ID:       quote.ID,
+				Name:     quote.Carrier + " " + quote.Service,
+				Amount:   quote.Amount,
+				Currency: quote.Currency,
+			},
+			Provider:     config.Shipping.Provider,
+			Carrier:      quote.Carrier,
+			Service:      quote.Service,
+			DeliveryDays: quote.DeliveryDays,
+		}
+		stored := &models.ShippingRate{
+			InstanceID:   instanceID,
+			RateID:       quote.ID,
+			Provider:     rate.Provider,
+			Carrier:      rate.Carrier,
+			Service:      rate.Service,
+			Name:         rate.Name,
+			Amount:       rate.Amount,
+			Currency:     rate.Currency,
+			DeliveryDays: rate.DeliveryDays,
+			Country:      order.ShippingAddress.Country,
+			Zip:          order.ShippingAddress.Zip,
+			Weight:       weight,
+			ExpiresAt:    expiresAt,
+		}
+		if rsp := db.Create(stored); rsp.Error != nil {
+			log.WithError(rsp.Error).Errorf("Failed to store the shipping rate %s", quote.ID)
+			continue
+		}
+		rates = append(rates, rate)
+	}
+	return rates
+}
+
+// applyShipping checks that the shipping method of a new, priced order is
+// available for it, and that the shipping amount expected by the client is
+// the one charged. Live rates of the shipping backend are charged at the
+// amount quoted, if they were quoted for the destination and items of the
+// order.
+func applyShipping(ctx context.Context, tx *gorm.DB, settings *calculator.Settings, order *models.Order, amount *uint64) *HTTPError {
+	if order.ShippingMethod == "" {
+		if amount != nil && *amount > 0 {
+			return badRequestError("A shipping method is required to charge for shipping")
+		}
+		return nil
+	}
+
+	if _, ok := calculator.QuoteShipping(settings, order.ShippingParameters(), order.ShippingMethod); !ok {
+		rate, err := models.GetShippingRate(tx, gcontext.GetInstanceID(ctx), order.ShippingMethod)
+		if err != nil {
+			return internalServerError("Error loading the shipping rate").WithInternalError(err)
+		}
+		if rate == nil || !calculator.ShippingMethodAllowed(settings, order.ShippingParameters(), rate.Provider) {
+			return badRequestError("The shipping method %v isn't available for this order", order.ShippingMethod)
+		}
+		if rate.Country != order.ShippingAddress.Country || rate.Zip != order.ShippingAddress.Zip ||
+			rate.Weight != order.ShippingParameters().Weight || rate.Currency != order.Currency {
+			return badRequestError("The shipping rate %v was quoted for another destination or items", order.ShippingMethod)
+		}
+		order.ShippingProvider = rate.Provider
+		order.Shipping = rate.Amount
+		order.Total += order.Shipping
+	}
+
+	if amount != nil && *amount != order.Shipping {
+		return badRequestError("The shipping amount %v doesn't match the %v of the shipping method", *amount, order.Shipping)
+	}
+	return nil
+}
+
+// checkShippingMethod checks that the shipping method of an order priced
+// again is still available for it. Methods that have been removed from the
+// settings, or don't apply to the order anymore, aren't free shipping.
+func checkShippingMethod(settings *calculator.Settings, order *models.Order) *HTTPError {
+	if order.ShippingMethod == "" || order.ShippingProvider != "" {
+		return nil
+	}
+	if _, ok := calculator.QuoteShipping(settings, order.ShippingParameters(), order.ShippingMethod); !ok {
+		return badRequestError("The shipping method %v isn't available for this order anymore", order.ShippingMethod)
+	}
+	return nil
+}
+
+// validateShippingZone checks that the shipping address of a new order lies
+// within one of the shipping zones of the settings, if they define any.
+func validateShippingZone(settings *calculator.Settings, order *models.Order) *HTTPError {
+	if calculator.ShipsTo(settings, order.ShippingParameters()) {
+		return nil
+	}
+	destination := order.ShippingAddress.Country
+	if order.ShippingAddress.State != "" {
+		destination = order.ShippingAddress.State + ", " + destination
+	}
+	return badRequestError("Orders can't be shipped to %v", destination).WithReason(outsideShippingZonesReason)
+}
+
+// shippingShipment returns the parcel of the items of an order as sent to the
+// shipping backend. The items are stacked on top of each other.
+func shippingShipment(config *conf.Configuration, order *models.Order) *shipping.Shipment {
+	quantities := map[int64]uint64{}
+	for _, item := range order.LineItems {
+		quantities[item.ID] = item.Quantity
+	}
+	return parcelShipment(config, order, quantities)
+}
+
+// labelShipment returns the parcel of the items of a shipment of an order as
+// sent to the shipping backend.
+func labelShipment(config *conf.Configuration, order *models.Order, shipment *models.Shipment) *shipping.Shipment {
+	quantities := map[int64]uint64{}
+	for _, item := range shipment.Items {
+		quantities[item.LineItemID] += item.Quantity
+	}
+	return parcelShipment(config, order, quantities)
+}
+
+// parcelShipment returns the parcel of the quantities of the line items of an
+// order, keyed by line item ID, shipping to the order's shipping address.
+func parcelShipment(config *conf.Configuration, order *models.Order, quantities map[int64]uint64) *shipping.Shipment {
+	from := config.Shipping.From
+	to := order.ShippingAddress
+	shipment := &shipping.Shipment{
+		From: shipping.Address{
+			Name:    from.Name,
+			Country: from.Country,
+			Zip:     from.Zip,
+			State:   from.State,
+			City:    from.City,
+			Street:  from.Street,
+		},
+		To: shipping.Address{
+			Name:    to.Name,
+			Country: taxCountryCode(to.Country),
+			Zip:     to.Zip,
+			State:   to.State,
+			City:    to.City,
+			Street:  to.Address1,
+		},
+	}
+	if shipment.From.Country == "" {
+		shipment.From.Country = "US"
+	}
+
+	for _, item := range order.LineItems {
+		quantity := quantities[item.ID]
+		if quantity == 0 {
+			continue
+		}
+		if item.Length > shipment.Parcel.Length {
+			shipment.Parcel.Length = item.Length
+		}
+		if item.Width > shipment.Parcel.Width {
+			shipment.Parcel.Width = item.Width
+		}
+		shipment.Parcel.Height += item.Height * quantity
+		shipment.Parcel.Weight += item.Weight * quantity
+	}
+	return shipment
+}
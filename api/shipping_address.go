@@ -0,0 +1,94 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+
+	"github.com/netlify/gocommerce/address"
+	"github.com/netlify/gocommerce/address/google"
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+// googleAddressProvider is the backend validating addresses with the Google
+// Address Validation API.
+const googleAddressProvider = "google"
+
+// undeliverableAddressReason is the reason orders shipping to addresses the
+// address validation backend finds undeliverable are rejected with.
+const undeliverableAddressReason = "undeliverable_address"
+
+// newAddressValidator returns the client of the address validation backend.
+func newAddressValidator(config *conf.Configuration, provider string) (address.Validator, error) {
+	switch provider {
+	case googleAddressProvider:
+		return google.NewClient(google.Config{
+			APIKey: config.AddressValidation.Google.APIKey,
+			URL:    config.AddressValidation.Google.URL,
+		})
+	}
+	return nil, fmt.Errorf("Unknown address validation provider %s", provider)
+}
+
+// applyAddressValidation validates the shipping address of an order with the
+// address validation backend and stores the verdict. The address is kept as
+// entered, only a missing state or zip is filled in from the normalized form
+// of a deliverable address. Addresses that have been validated before are kept, and new ones
+// are stored unvalidated if the backend fails.
+func applyAddressValidation(tx *gorm.DB, config *conf.Configuration, log logrus.FieldLogger, addr *models.Address) *HTTPError {
+	if config.AddressValidation.Provider == "" || addr.Verdict != "" {
+		return nil
+	}
+	validator, err := newAddressValidator(config, config.AddressValidation.Provider)
+	if err != nil {
+		log.WithError(err).Error("Failed to set up the address validation backend")
+		return nil
+	}
+	result, err := validator.Validate(address.Address{
+		Country:  addressCountryCode(addr.Country),
+		Zip:      addr.Zip,
+		State:    addr.State,
+		City:     addr.City,
+		Address1: addr.Address1,
+		Address2: addr.Address2,
+	})
+	if err != nil {
+		log.WithError(err).Errorf("Failed to validate address with %s", config.AddressValidation.Provider)
+		return nil
+	}
+
+	if result.Verdict == address.VerdictUndeliverable && config.AddressValidation.RejectUndeliverable {
+		return badRequestError("The shipping address couldn't be confirmed as deliverable").WithReason(undeliverableAddressReason)
+	}
+	addr.Verdict = result.Verdict
+	addr.Latitude = result.Latitude
+	addr.Longitude = result.Longitude
+	if result.Verdict != address.VerdictUndeliverable {
+		if addr.Zip == "" {
+			addr.Zip = result.Address.Zip
+		}
+		if addr.State == "" {
+			addr.State = result.Address.State
+		}
+	}
+	if rsp := tx.Save(addr); rsp.Error != nil {
+		return internalServerError("Error saving address").WithInternalError(rsp.Error)
+	}
+	return nil
+}
+
+// addressCountryCode returns the ISO 3166 country code of a country in an
+// address as sent to the address validation backend. Other names than those
+// of the US and the EU member states are passed on as is.
+func addressCountryCode(country string) string {
+	if code, ok := calculator.EUVATCountryCode(country); ok {
+		if code == "EL" {
+			return "GR"
+		}
+		return code
+	}
+	return taxCountryCode(country)
+}
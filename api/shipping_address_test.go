@@ -0,0 +1,107 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/address"
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestAddressValidation(t *testing.T) {
+	site := startTestSite()
+	defer site.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "google-key", r.URL.Query().Get("key"))
+		require.Equal(t, "/v1:validateAddress", r.URL.Path)
+		body := struct {
+			Address struct {
+				RegionCode   string   `json:"regionCode"`
+				AddressLines []string `json:"addressLines"`
+			} `json:"address"`
+		}{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, "US", body.Address.RegionCode)
+		if body.Address.AddressLines[0] == "Nowhere 1" {
+			w.Write([]byte(`{"result": {"verdict": {"addressComplete": false, "hasUnconfirmedComponents": true}}}`))
+			return
+		}
+		w.Write([]byte(`{"result": {
+			"verdict": {"addressComplete": true, "hasInferredComponents": true},
+			"address": {"postalAddress": {
+				"regionCode": "US", "postalCode": "94107-2003", "administrativeArea": "CA",
+				"locality": "San Francisco", "addressLines": ["610 22nd St"]
+			}},
+			"geocode": {"location": {"latitude": 37.7589, "longitude": -122.3882}}
+		}}`))
+	}))
+	defer server.Close()
+
+	newTest := func(t *testing.T) *RouteTest {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		test.Config.AddressValidation.Provider = googleAddressProvider
+		test.Config.AddressValidation.Google.APIKey = "google-key"
+		test.Config.AddressValidation.Google.URL = server.URL + "/v1"
+		return test
+	}
+	undeliverable := strings.Replace(defaultPayload, "610 22nd Street", "Nowhere 1", 1)
+
+	t.Run("Normalized", func(t *testing.T) {
+		test := newTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, address.VerdictCorrected, order.ShippingAddress.Verdict)
+		assert.Equal(t, "610 22nd Street", order.ShippingAddress.Address1)
+		assert.Equal(t, "94107", order.ShippingAddress.Zip)
+		assert.Equal(t, "USA", order.ShippingAddress.Country)
+		assert.Equal(t, 37.7589, order.ShippingAddress.Latitude)
+
+		stored := &models.Address{}
+		require.NoError(t, test.DB.First(stored, "id = ?", order.ShippingAddressID).Error)
+		assert.Equal(t, address.VerdictCorrected, stored.Verdict)
+		assert.Equal(t, "610 22nd Street", stored.Address1)
+	})
+	t.Run("MissingState", func(t *testing.T) {
+		test := newTest(t)
+		payload := strings.Replace(defaultPayload, `"state": "CA", `, "", 1)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(payload), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, "CA", order.ShippingAddress.State)
+		assert.Equal(t, "94107", order.ShippingAddress.Zip)
+		assert.Equal(t, "610 22nd Street", order.ShippingAddress.Address1)
+		assert.Equal(t, "San Francisco", order.ShippingAddress.City)
+	})
+	t.Run("Flagged", func(t *testing.T) {
+		test := newTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(undeliverable), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, address.VerdictUndeliverable, order.ShippingAddress.Verdict)
+		assert.Equal(t, "Nowhere 1", order.ShippingAddress.Address1)
+	})
+	t.Run("Rejected", func(t *testing.T) {
+		test := newTest(t)
+		test.Config.AddressValidation.RejectUndeliverable = true
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(undeliverable), test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "deliverable")
+	})
+	t.Run("BackendDown", func(t *testing.T) {
+		test := newTest(t)
+		test.Config.AddressValidation.Google.URL = "http://127.0.0.1:1/v1"
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Empty(t, order.ShippingAddress.Verdict)
+		assert.Equal(t, "610 22nd Street", order.ShippingAddress.Address1)
+	})
+}
@@ -0,0 +1,271 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestShippingRates(t *testing.T) {
+	server := startTestSiteWithSettings(&calculator.Settings{
+		ShippingMethods: []*calculator.ShippingMethod{{
+			ID: "standard", Name: "Standard", Type: calculator.ShippingFlat,
+			Rates: []*calculator.ShippingRate{{Currency: "USD", Amount: "4.90", FreeOver: "50.00"}},
+		}, {
+			ID: "parcel", Name: "Parcel", Type: calculator.ShippingWeight,
+			Rates: []*calculator.ShippingRate{{Currency: "USD", Tiers: []*calculator.ShippingTier{
+				{MinWeight: 0, Amount: "5.00"},
+				{MinWeight: 2000, Amount: "9.00"},
+			}}},
+		}, {
+			ID: "express", Name: "Express", Type: calculator.ShippingFlat, Countries: []string{"USA"},
+			Rates: []*calculator.ShippingRate{{Currency: "USD", Amount: "15.00"}},
+		}},
+	})
+	defer server.Close()
+
+	createCart := func(t *testing.T, test *RouteTest, quantity string) *models.Cart {
+		body := `{"country": "Germany", "items": [{"path": "/heavy-product", "quantity": ` + quantity + `}]}`
+		recorder := test.TestEndpoint(http.MethodPost, "/carts", strings.NewReader(body), test.Data.testUserToken)
+		cart := &models.Cart{}
+		extractPayload(t, http.StatusCreated, recorder, cart)
+		return cart
+	}
+	checkout := func(test *RouteTest, cart *models.Cart, shipping string) *httptest.ResponseRecorder {
+		body := `{
+			"email": "info@example.com",
+			` + shipping + `
+			"shipping_address": {
+				"name": "Test User",
+				"address1": "Branengebranen",
+				"city": "Berlin", "country": "Germany", "zip": "94107"
+			}
+		}`
+		return test.TestEndpoint(http.MethodPost, "/carts/"+cart.ID+"/checkout", strings.NewReader(body), test.Data.testUserToken)
+	}
+
+	t.Run("List", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		cart := createCart(t, test, "2")
+
+		recorder := test.TestEndpoint(http.MethodGet, "/shipping_rates?cart="+cart.ID, nil, test.Data.testUserToken)
+		quotes := []calculator.ShippingQuote{}
+		extractPayload(t, http.StatusOK, recorder, &quotes)
+		require.Len(t, quotes, 2)
+		assert.Equal(t, "standard", quotes[0].ID)
+		assert.EqualValues(t, 490, quotes[0].Amount)
+		assert.Equal(t, "parcel", quotes[1].ID)
+		assert.EqualValues(t, 900, quotes[1].Amount)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/shipping_rates?country=USA&cart="+cart.ID, nil, test.Data.testUserToken)
+		extractPayload(t, http.StatusOK, recorder, &quotes)
+		require.Len(t, quotes, 3)
+		assert.Equal(t, "express", quotes[2].ID)
+	})
+	t.Run("FreeOver", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		cart := createCart(t, test, "3")
+
+		recorder := test.TestEndpoint(http.MethodGet, "/shipping_rates?cart="+cart.ID, nil, test.Data.testUserToken)
+		quotes := []calculator.ShippingQuote{}
+		extractPayload(t, http.StatusOK, recorder, &quotes)
+		require.Len(t, quotes, 2)
+		assert.EqualValues(t, 0, quotes[0].Amount)
+	})
+	t.Run("MissingCart", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/shipping_rates", nil, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+	t.Run("Checkout", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		cart := createCart(t, test, "2")
+
+		recorder := checkout(test, cart, `"shipping_method": "parcel", "shipping": 900,`)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, "parcel", order.ShippingMethod)
+		assert.EqualValues(t, 900, order.Shipping)
+		assert.Equal(t, cart.Total+900, order.Total)
+
+		stored := &models.Order{}
+		require.NoError(t, test.DB.First(stored, "id = ?", order.ID).Error)
+		assert.EqualValues(t, 900, stored.Shipping)
+		assert.Equal(t, order.Total, stored.Total)
+	})
+	t.Run("ShippingMismatch", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		cart := createCart(t, test, "2")
+
+		recorder := checkout(test, cart, `"shipping_method": "parcel", "shipping": 500,`)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+	t.Run("UnavailableMethod", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		cart := createCart(t, test, "2")
+
+		recorder := checkout(test, cart, `"shipping_method": "express",`)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+}
+
+func TestEasyPostRates(t *testing.T) {
+	site := startTestSite()
+	defer site.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, _, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "easypost-key", key)
+		require.Equal(t, "/shipments", r.URL.Path)
+		body := map[string]map[string]map[string]interface{}{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, "10115", body["shipment"]["to_address"]["zip"])
+		assert.Equal(t, "US", body["shipment"]["from_address"]["country"])
+		assert.Equal(t, 105.9, body["shipment"]["parcel"]["weight"])
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id": "shp_1", "rates": [
+			{"id": "rate_1", "carrier": "USPS", "service": "Priority", "rate": "23.50", "currency": "USD", "delivery_days": 6},
+			{"id": "rate_2", "carrier": "DHL", "service": "Express", "rate": "41.00", "currency": "EUR"}
+		]}`))
+	}))
+	defer server.Close()
+
+	test := NewRouteTest(t)
+	test.Config.SiteURL = site.URL
+	test.Config.Shipping.Provider = easyPostProvider
+	test.Config.Shipping.EasyPost.APIKey = "easypost-key"
+	test.Config.Shipping.EasyPost.URL = server.URL
+
+	body := `{"country": "Germany", "items": [{"path": "/heavy-product", "quantity": 2}]}`
+	recorder := test.TestEndpoint(http.MethodPost, "/carts", strings.NewReader(body), test.Data.testUserToken)
+	cart := &models.Cart{}
+	extractPayload(t, http.StatusCreated, recorder, cart)
+
+	recorder = test.TestEndpoint(http.MethodGet, "/shipping_rates?zip=10115&cart="+cart.ID, nil, test.Data.testUserToken)
+	rates := []shippingRate{}
+	extractPayload(t, http.StatusOK, recorder, &rates)
+	require.Len(t, rates, 1)
+	assert.Equal(t, "rate_1", rates[0].ID)
+	assert.Equal(t, easyPostProvider, rates[0].Provider)
+	assert.Equal(t, "USPS", rates[0].Carrier)
+	assert.EqualValues(t, 2350, rates[0].Amount)
+	assert.Equal(t, 6, rates[0].DeliveryDays)
+
+	checkout := func(zip string) *httptest.ResponseRecorder {
+		body := `{
+			"email": "info@example.com",
+			"shipping_method": "rate_1",
+			"shipping": 2350,
+			"shipping_address": {
+				"name": "Test User",
+				"address1": "Branengebranen",
+				"city": "Berlin", "country": "Germany", "zip": "` + zip + `"
+			}
+		}`
+		return test.TestEndpoint(http.MethodPost, "/carts/"+cart.ID+"/checkout", strings.NewReader(body), test.Data.testUserToken)
+	}
+
+	t.Run("OtherDestination", func(t *testing.T) {
+		validateError(t, http.StatusBadRequest, checkout("80331"))
+	})
+	t.Run("Expired", func(t *testing.T) {
+		stored := &models.ShippingRate{}
+		require.NoError(t, test.DB.First(stored, "rate_id = ?", "rate_1").Error)
+		assert.Equal(t, "10115", stored.Zip)
+		expiresAt := stored.ExpiresAt
+		assert.True(t, expiresAt.After(time.Now()))
+
+		require.NoError(t, test.DB.Model(stored).UpdateColumn("expires_at", time.Now().Add(-time.Minute)).Error)
+		validateError(t, http.StatusBadRequest, checkout("10115"), "rate_1")
+		require.NoError(t, test.DB.Model(stored).UpdateColumn("expires_at", expiresAt).Error)
+	})
+	t.Run("Checkout", func(t *testing.T) {
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, checkout("10115"), order)
+		assert.Equal(t, "rate_1", order.ShippingMethod)
+		assert.Equal(t, easyPostProvider, order.ShippingProvider)
+		assert.EqualValues(t, 2350, order.Shipping)
+		assert.Equal(t, cart.Total+2350, order.Total)
+	})
+}
+
+func TestShippingZones(t *testing.T) {
+	server := startTestSiteWithSettings(&calculator.Settings{
+		ShippingMethods: []*calculator.ShippingMethod{{
+			ID: "standard", Name: "Standard", Type: calculator.ShippingFlat,
+			Rates: []*calculator.ShippingRate{{Currency: "USD", Amount: "4.90"}},
+		}, {
+			ID: "express", Name: "Express", Type: calculator.ShippingFlat,
+			Rates: []*calculator.ShippingRate{{Currency: "USD", Amount: "15.00"}},
+		}},
+		ShippingZones: []*calculator.ShippingZone{{
+			Name: "EU", Countries: []string{"Germany", "France"}, Methods: []string{"standard"},
+		}, {
+			Name: "West Coast", Countries: []string{"USA"}, Regions: []string{"CA", "OR"},
+		}},
+	})
+	defer server.Close()
+
+	test := NewRouteTest(t)
+	test.Config.SiteURL = server.URL
+	body := `{"country": "Germany", "items": [{"path": "/simple-product", "quantity": 1}]}`
+	recorder := test.TestEndpoint(http.MethodPost, "/carts", strings.NewReader(body), test.Data.testUserToken)
+	cart := &models.Cart{}
+	extractPayload(t, http.StatusCreated, recorder, cart)
+
+	listRates := func(t *testing.T, query string) []calculator.ShippingQuote {
+		recorder := test.TestEndpoint(http.MethodGet, "/shipping_rates?cart="+cart.ID+query, nil, test.Data.testUserToken)
+		quotes := []calculator.ShippingQuote{}
+		extractPayload(t, http.StatusOK, recorder, &quotes)
+		return quotes
+	}
+	checkout := func(country, state string) *httptest.ResponseRecorder {
+		body := `{
+			"email": "info@example.com",
+			"shipping_address": {
+				"name": "Test User",
+				"address1": "Branengebranen",
+				"city": "Somewhere", "country": "` + country + `", "state": "` + state + `", "zip": "94107"
+			}
+		}`
+		return test.TestEndpoint(http.MethodPost, "/carts/"+cart.ID+"/checkout", strings.NewReader(body), test.Data.testUserToken)
+	}
+
+	t.Run("AllowedMethods", func(t *testing.T) {
+		quotes := listRates(t, "")
+		require.Len(t, quotes, 1)
+		assert.Equal(t, "standard", quotes[0].ID)
+
+		assert.Len(t, listRates(t, "&country=USA&state=CA"), 2)
+		assert.Empty(t, listRates(t, "&country=USA&state=NY"))
+	})
+	t.Run("OutsideZones", func(t *testing.T) {
+		recorder := checkout("USA", "NY")
+		validateError(t, http.StatusBadRequest, recorder, "Orders can't be shipped to NY, USA")
+
+		recorder = checkout("Japan", "")
+		require.Equal(t, http.StatusBadRequest, recorder.Code)
+		rsp := &HTTPError{}
+		require.NoError(t, json.NewDecoder(recorder.Body).Decode(rsp))
+		assert.Equal(t, outsideShippingZonesReason, rsp.Reason)
+	})
+	t.Run("InsideZone", func(t *testing.T) {
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, checkout("USA", "OR"), order)
+	})
+}
@@ -0,0 +1,334 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// outOfStockReason is the reason orders are rejected with when the stock of
+// a product doesn't cover them.
+const outOfStockReason = "out_of_stock"
+
+// StockParams holds the quantity of a product in stock at a location and the
+// quantity below which it's low on stock there. Without a location the stock
+// of the default location is updated.
+type StockParams struct {
+	Location          string  `json:"location"`
+	Quantity          *uint64 `json:"quantity"`
+	LowStockThreshold *uint64 `json:"low_stock_threshold"`
+}
+
+// StockLocationParams holds the name and address of a stock location.
+type StockLocationParams struct {
+	Name    string `json:"name"`
+	Country string `json:"country"`
+	Zip     string `json:"zip"`
+	State   string `json:"state"`
+	City    string `json:"city"`
+	Street  string `json:"street"`
+}
+
+// StockList lists the tracked products with their quantity in stock at each
+// location and the quantity reserved for unpaid orders, or only those at the
+// location in the query parameters.
+func (a *API) StockList(w http.ResponseWriter, r *http.Request) error {
+	db := a.DB(r)
+	instanceID := gcontext.GetInstanceID(r.Context())
+
+	query := db.Where("instance_id = ?", instanceID)
+	if location, ok := r.URL.Query()["location"]; ok {
+		query = query.Where("location = ?", location[0])
+	}
+	stock := []*models.StockItem{}
+	if rsp := query.Order("sku, location").Find(&stock); rsp.Error != nil {
+		return internalServerError("Error while querying for stock").WithInternalError(rsp.Error)
+	}
+	skus := make([]string, 0, len(stock))
+	for _, item := range stock {
+		skus = append(skus, item.Sku)
+	}
+	if len(skus) > 0 {
+		reserved, err := models.ReservedStock(db, instanceID, skus, "", time.Now())
+		if err != nil {
+			return internalServerError("Error while querying for stock reservations").WithInternalError(err)
+		}
+		for _, item := range stock {
+			item.Reserved = reserved[item.Sku]
+		}
+	}
+	return sendJSON(w, http.StatusOK, stock)
+}
+
+// StockUpdate sets the quantity of a product in stock or its low stock
+// threshold, starting to track it if it wasn't tracked yet. Products dropping
+// below their threshold are alerted about, and users waiting for products that
+// were out of stock at all locations are notified.
+func (a *API) StockUpdate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	params := &StockParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read stock params: %v", err)
+	}
+	if params.Quantity == nil && params.LowStockThreshold == nil {
+		return badRequestError("A quantity or low_stock_threshold is required")
+	}
+	if httpErr := a.checkStockLocation(r, params.Location); httpErr != nil {
+		return httpErr
+	}
+	changes := map[string]interface{}{}
+	if params.Quantity != nil {
+		changes["quantity"] = *params.Quantity
+	}
+	if params.LowStockThreshold != nil {
+		changes["low_stock_threshold"] = *params.LowStockThreshold
+	}
+
+	instanceID := gcontext.GetInstanceID(ctx)
+	sku := chi.URLParam(r, "sku")
+	item := &models.StockItem{}
+	tx := a.DB(r).Begin()
+	var inStock int
+	if rsp := tx.Model(&models.StockItem{}).Where("instance_id = ? AND sku = ? AND quantity > 0", instanceID, sku).Count(&inStock); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error while querying for stock").WithInternalError(rsp.Error)
+	}
+	rsp := tx.
+		Where(map[string]interface{}{"instance_id": instanceID, "sku": sku, "location": params.Location}).
+		Assign(changes).
+		FirstOrCreate(item)
+	if rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving stock").WithInternalError(rsp.Error)
+	}
+	alertLowStock(ctx, tx, getLogEntry(r), instanceID, []string{item.Sku})
+	if inStock == 0 && params.Quantity != nil && *params.Quantity > 0 {
+		notifyBackInStock(tx, getLogEntry(r), instanceID, item.Sku, a.unsubscribeBase(r, gcontext.GetConfig(ctx)))
+	}
+	if rsp := tx.First(item, item.ID); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error loading stock").WithInternalError(rsp.Error)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return internalServerError("Error saving stock").WithInternalError(err)
+	}
+	return sendJSON(w, http.StatusOK, item)
+}
+
+// StockDelete stops tracking the stock of a product at the location in the
+// query parameters, or the default location.
+func (a *API) StockDelete(w http.ResponseWriter, r *http.Request) error {
+	rsp := a.DB(r).
+		Where("instance_id = ? AND sku = ? AND location = ?", gcontext.GetInstanceID(r.Context()), chi.URLParam(r, "sku"), r.URL.Query().Get("location")).
+		Delete(&models.StockItem{})
+	if rsp.Error != nil {
+		return internalServerError("Error deleting stock").WithInternalError(rsp.Error)
+	}
+	if rsp.RowsAffected == 0 {
+		return notFoundError("The stock of this product isn't tracked")
+	}
+	return sendJSON(w, http.StatusOK, map[string]string{})
+}
+
+// StockLocationList lists the stock locations.
+func (a *API) StockLocationList(w http.ResponseWriter, r *http.Request) error {
+	locations := []*models.StockLocation{}
+	if rsp := a.DB(r).Where("instance_id = ?", gcontext.GetInstanceID(r.Context())).Order("id").Find(&locations); rsp.Error != nil {
+		return internalServerError("Error while querying for stock locations").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, locations)
+}
+
+// StockLocationUpdate creates or updates the stock location with the ID.
+func (a *API) StockLocationUpdate(w http.ResponseWriter, r *http.Request) error {
+	params := &StockLocationParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read stock location params: %v", err)
+	}
+	if params.Name == "" || params.Country == "" {
+		return badRequestError("A stock location requires a name and country")
+	}
+
+	location := &models.StockLocation{}
+	rsp := a.DB(r).
+		Where(models.StockLocation{InstanceID: gcontext.GetInstanceID(r.Context()), ID: chi.URLParam(r, "location_id")}).
+		Assign(map[string]interface{}{
+			"name":    params.Name,
+			"country": params.Country,
+			"zip":     params.Zip,
+			"state":   params.State,
+			"city":    params.City,
+			"street":  params.Street,
+		}).
+		FirstOrCreate(location)
+	if rsp.Error != nil {
+		return internalServerError("Error saving stock location").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, location)
+}
+
+// StockLocationDelete removes a stock location that has no stock left.
+func (a *API) StockLocationDelete(w http.ResponseWriter, r *http.Request) error {
+	db := a.DB(r)
+	instanceID := gcontext.GetInstanceID(r.Context())
+	id := chi.URLParam(r, "location_id")
+
+	var stocked int
+	if rsp := db.Model(&models.StockItem{}).Where("instance_id = ? AND location = ? AND quantity > 0", instanceID, id).Count(&stocked); rsp.Error != nil {
+		return internalServerError("Error while querying for stock").WithInternalError(rsp.Error)
+	}
+	if stocked > 0 {
+		return badRequestError("Products are still in stock at this location")
+	}
+
+	tx := db.Begin()
+	rsp := tx.Where("instance_id = ? AND id = ?", instanceID, id).Delete(&models.StockLocation{})
+	if rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error deleting stock location").WithInternalError(rsp.Error)
+	}
+	if rsp.RowsAffected == 0 {
+		tx.Rollback()
+		return notFoundError("Stock location not found")
+	}
+	if rsp := tx.Where("instance_id = ? AND location = ?", instanceID, id).Delete(&models.StockItem{}); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error deleting stock").WithInternalError(rsp.Error)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return internalServerError("Error deleting stock location").WithInternalError(err)
+	}
+	return sendJSON(w, http.StatusOK, map[string]string{})
+}
+
+// checkStockLocation checks that the stock location with the ID exists. The
+// default location has no ID and always exists.
+func (a *API) checkStockLocation(r *http.Request, id string) *HTTPError {
+	if id == "" {
+		return nil
+	}
+	var count int
+	rsp := a.DB(r).Model(&models.StockLocation{}).Where("instance_id = ? AND id = ?", gcontext.GetInstanceID(r.Context()), id).Count(&count)
+	if rsp.Error != nil {
+		return internalServerError("Error while querying for stock locations").WithInternalError(rsp.Error)
+	}
+	if count == 0 {
+		return badRequestError("Unknown stock location %v", id)
+	}
+	return nil
+}
+
+// reserveStock holds the stock of the tracked products of an unpaid order for
+// the reservation window, renewing the reservations it already holds.
+func reserveStock(tx *gorm.DB, config *conf.Configuration, order *models.Order) *HTTPError {
+	if err := models.ReserveStock(tx, order, config.StockReservationTTL()); err != nil {
+		return stockError("Error reserving stock", err)
+	}
+	return nil
+}
+
+// checkStock renews the stock reservations of an order that is about to be
+// charged, so the provider isn't paid for items that aren't in stock anymore.
+func checkStock(db *gorm.DB, config *conf.Configuration, order *models.Order) *HTTPError {
+	if order.LineItems == nil {
+		if rsp := db.Where("order_id = ?", order.ID).Find(&order.LineItems); rsp.Error != nil {
+			return internalServerError("Error during database query").WithInternalError(rsp.Error)
+		}
+	}
+	tx := db.Begin()
+	if httpErr := reserveStock(tx, config, order); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if err := tx.Commit().Error; err != nil {
+		return internalServerError("Error reserving stock").WithInternalError(err)
+	}
+	return nil
+}
+
+// stockError returns a bad request for an OutOfStockError and an internal
+// server error with the message otherwise.
+func stockError(message string, err error) *HTTPError {
+	if outOfStock, ok := err.(*models.OutOfStockError); ok {
+		return badRequestError("%v", outOfStock).WithReason(outOfStockReason)
+	}
+	return internalServerError(message).WithInternalError(err)
+}
+
+// releaseExpiredStock removes the stock reservations of orders that haven't
+// been paid within the reservation window.
+func releaseExpiredStock(db *gorm.DB, log logrus.FieldLogger) {
+	if err := models.DeleteExpiredStockReservations(db, time.Now()); err != nil {
+		log.WithError(err).Error("Error releasing expired stock reservations")
+	}
+}
+
+// alertLowStock triggers the low_stock webhook for the SKUs that dropped below
+// their low stock threshold and, if enabled, queues an email to the store admin
+// about them, sent once the transaction is committed.
+func alertLowStock(ctx context.Context, tx *gorm.DB, log logrus.FieldLogger, instanceID string, skus []string) {
+	config := gcontext.GetConfig(ctx)
+	items, err := models.MarkLowStock(tx, instanceID, skus, config.Stock.LowStockThreshold, time.Now())
+	if err != nil {
+		log.WithError(err).Error("Error checking for low stock")
+		return
+	}
+	if len(items) == 0 {
+		return
+	}
+
+	if config.Webhooks.LowStock != "" {
+		hook, err := models.NewHook("low_stock", config.SiteURL, config.Webhooks.LowStock, "", config.Webhooks.Secret, items)
+		if err != nil {
+			log.WithError(err).Error("Failed to process webhook")
+		} else {
+			tx.Save(hook)
+		}
+	}
+	if config.Stock.LowStockEmail {
+		payload := &lowStockPayload{}
+		skus := make([]string, 0, len(items))
+		for _, item := range items {
+			payload.Items = append(payload.Items, item.ID)
+			skus = append(skus, item.Sku)
+		}
+		if err := models.EnqueueJob(tx, instanceID, lowStockJob, strings.Join(skus, ","), payload); err != nil {
+			log.WithError(err).Error("Error queueing low stock mail")
+		}
+	}
+}
+
+// lowStockJob emails the store admin about products low on stock once the
+// transaction marking them has been committed.
+const lowStockJob = "low_stock_mail"
+
+type lowStockPayload struct {
+	Items []int64 `json:"items"`
+}
+
+// runLowStockJob sends the low stock mail for the stock items of the job.
+func runLowStockJob(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, job *models.Job) error {
+	payload := &lowStockPayload{}
+	if err := json.Unmarshal([]byte(job.Payload), payload); err != nil {
+		return errors.Wrap(err, "Error parsing job payload")
+	}
+	items := []*models.StockItem{}
+	if rsp := db.Where("instance_id = ? AND id IN (?)", job.InstanceID, payload.Items).Order("sku").Find(&items); rsp.Error != nil {
+		return rsp.Error
+	}
+	if len(items) == 0 {
+		return nil
+	}
+	return gcontext.GetMailer(ctx).LowStockMail(items)
+}
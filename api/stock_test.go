@@ -0,0 +1,308 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestStockReservations(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	newTest := func(t *testing.T, quantity string) *RouteTest {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.Payment.Providers = map[string]conf.PaymentProviderConfiguration{
+			"giftcard": {Enabled: true},
+		}
+		recorder := test.TestEndpoint(http.MethodPut, "/stock/product-1", strings.NewReader(`{"quantity": `+quantity+`}`), token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		return test
+	}
+	createOrder := func(test *RouteTest) *httptest.ResponseRecorder {
+		return test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+	}
+	newOrder := func(test *RouteTest) *models.Order {
+		order := &models.Order{}
+		extractPayload(test.T, http.StatusCreated, createOrder(test), order)
+		return order
+	}
+	pay := func(test *RouteTest, order *models.Order) *httptest.ResponseRecorder {
+		body := strings.NewReader(`{"amount": 999, "currency": "USD", "provider": "giftcard"}`)
+		return test.TestEndpoint(http.MethodPost, "/orders/"+order.ID+"/payments", body, test.Data.testUserToken)
+	}
+	listStock := func(test *RouteTest) []models.StockItem {
+		recorder := test.TestEndpoint(http.MethodGet, "/stock", nil, token)
+		stock := []models.StockItem{}
+		extractPayload(t, http.StatusOK, recorder, &stock)
+		return stock
+	}
+
+	t.Run("Reserved", func(t *testing.T) {
+		test := newTest(t, "1")
+		newOrder(test)
+		validateError(t, http.StatusBadRequest, createOrder(test), "Only 0 of product-1 are in stock")
+
+		stock := listStock(test)
+		require.Len(t, stock, 1)
+		assert.EqualValues(t, 1, stock[0].Quantity)
+		assert.EqualValues(t, 1, stock[0].Reserved)
+	})
+	t.Run("Expired", func(t *testing.T) {
+		test := newTest(t, "1")
+		first := newOrder(test)
+		require.NoError(t, test.DB.Model(&models.StockReservation{}).Where("order_id = ?", first.ID).Update("expires_at", time.Now().Add(-time.Minute)).Error)
+		newOrder(test)
+
+		// the first order lost its reservation to the second one
+		validateError(t, http.StatusBadRequest, pay(test, first), "Only 0 of product-1 are in stock")
+
+		releaseExpiredStock(test.DB, testLogger)
+		var count int
+		require.NoError(t, test.DB.Model(&models.StockReservation{}).Count(&count).Error)
+		assert.Equal(t, 1, count)
+	})
+	t.Run("Paid", func(t *testing.T) {
+		test := newTest(t, "3")
+		order := newOrder(test)
+		require.Equal(t, http.StatusOK, pay(test, order).Code)
+
+		stock := listStock(test)
+		require.Len(t, stock, 1)
+		assert.EqualValues(t, 2, stock[0].Quantity)
+		assert.EqualValues(t, 0, stock[0].Reserved)
+	})
+	completeOrder := func(test *RouteTest, order *models.Order) error {
+		ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+		require.NoError(test.T, err)
+		tx := test.DB.Begin()
+		defer tx.Rollback()
+		require.NoError(test.T, orderQuery(tx).First(order, "id = ?", order.ID).Error)
+		tr := models.NewTransaction(order)
+		tr.Amount = order.Total
+		if _, err := completePayment(ctx, tx, testLogger, tr, order); err != nil {
+			return err
+		}
+		return tx.Commit().Error
+	}
+	t.Run("Unreserved", func(t *testing.T) {
+		// paid orders are taken out of stock by their line items, even if
+		// their reservation is gone
+		test := newTest(t, "3")
+		order := newOrder(test)
+		require.NoError(t, test.DB.Where("order_id = ?", order.ID).Delete(&models.StockReservation{}).Error)
+		require.NoError(t, completeOrder(test, order))
+
+		stock := listStock(test)
+		require.Len(t, stock, 1)
+		assert.EqualValues(t, 2, stock[0].Quantity)
+	})
+	t.Run("Oversold", func(t *testing.T) {
+		test := newTest(t, "1")
+		order := newOrder(test)
+		recorder := test.TestEndpoint(http.MethodPut, "/stock/product-1", strings.NewReader(`{"quantity": 0}`), token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		// the payment has been made already, so the order is paid anyway
+		require.NoError(t, completeOrder(test, order))
+		saved := &models.Order{}
+		require.NoError(t, test.DB.First(saved, "id = ?", order.ID).Error)
+		assert.Equal(t, models.PaidState, saved.PaymentState)
+		assert.True(t, saved.Oversold)
+
+		orders := []models.Order{}
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/orders?oversold=true", nil, test.Data.testUserToken), &orders)
+		require.Len(t, orders, 1)
+		assert.Equal(t, order.ID, orders[0].ID)
+	})
+	t.Run("Cancelled", func(t *testing.T) {
+		test := newTest(t, "1")
+		order := newOrder(test)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/"+order.ID+"/cancel", nil, token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		newOrder(test)
+	})
+	t.Run("Untracked", func(t *testing.T) {
+		test := newTest(t, "0")
+		recorder := test.TestEndpoint(http.MethodDelete, "/stock/product-1", nil, token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		newOrder(test)
+		assert.Empty(t, listStock(test))
+	})
+}
+
+func TestLowStock(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	test := NewRouteTest(t)
+	test.Config.SiteURL = server.URL
+	test.Config.Payment.Providers = map[string]conf.PaymentProviderConfiguration{
+		"giftcard": {Enabled: true},
+	}
+	test.Config.Webhooks.LowStock = "/low-stock"
+	test.Config.Stock.LowStockEmail = true
+	setStock := func(body string) {
+		recorder := test.TestEndpoint(http.MethodPut, "/stock/product-1", strings.NewReader(body), token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+	}
+	countHooks := func() int {
+		var hooks int
+		require.NoError(t, test.DB.Model(&models.Hook{}).Where("type = ?", "low_stock").Count(&hooks).Error)
+		return hooks
+	}
+	lowStock := func() []lowStockRow {
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/inventory/low_stock", nil, token)
+		rows := []lowStockRow{}
+		extractPayload(t, http.StatusOK, recorder, &rows)
+		return rows
+	}
+
+	setStock(`{"quantity": 2, "low_stock_threshold": 2}`)
+	assert.Equal(t, 0, countHooks())
+	assert.Empty(t, lowStock())
+
+	order := &models.Order{}
+	recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+	extractPayload(t, http.StatusCreated, recorder, order)
+	body := strings.NewReader(`{"amount": 999, "currency": "USD", "provider": "giftcard"}`)
+	recorder = test.TestEndpoint(http.MethodPost, "/orders/"+order.ID+"/payments", body, test.Data.testUserToken)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	waitForConfirmationMails(t, test, order.ID)
+
+	assert.Equal(t, 1, countHooks())
+	job := &models.Job{}
+	require.NoError(t, test.DB.Where("type = ?", lowStockJob).First(job).Error)
+	assert.Equal(t, "product-1", job.Reference)
+	assert.False(t, job.Done)
+	test.RunJobs()
+	require.NoError(t, test.DB.First(job, job.ID).Error)
+	assert.True(t, job.Done)
+	assert.False(t, job.Failed)
+
+	rows := lowStock()
+	require.Len(t, rows, 1)
+	assert.Equal(t, "product-1", rows[0].Sku)
+	assert.EqualValues(t, 1, rows[0].Quantity)
+	assert.EqualValues(t, 2, rows[0].Threshold)
+
+	// products are alerted about once until they're restocked
+	setStock(`{"quantity": 0}`)
+	assert.Equal(t, 1, countHooks())
+	setStock(`{"quantity": 5}`)
+	assert.Empty(t, lowStock())
+	setStock(`{"low_stock_threshold": 10}`)
+	assert.Equal(t, 2, countHooks())
+}
+
+func TestStockLocations(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	test := NewRouteTest(t)
+	test.Config.SiteURL = server.URL
+	test.Config.Payment.Providers = map[string]conf.PaymentProviderConfiguration{
+		"giftcard": {Enabled: true},
+	}
+	for _, id := range []string{"east", "west"} {
+		recorder := test.TestEndpoint(http.MethodPut, "/stock/locations/"+id, strings.NewReader(`{"name": "Warehouse `+id+`", "country": "US"}`), token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+	}
+	setStock := func(location, quantity string) {
+		recorder := test.TestEndpoint(http.MethodPut, "/stock/product-1", strings.NewReader(`{"location": "`+location+`", "quantity": `+quantity+`}`), token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+	}
+	stockAt := func(location string) uint64 {
+		recorder := test.TestEndpoint(http.MethodGet, "/stock?location="+location, nil, token)
+		stock := []models.StockItem{}
+		extractPayload(t, http.StatusOK, recorder, &stock)
+		require.Len(t, stock, 1)
+		return stock[0].Quantity
+	}
+	paidOrder := func(quantity uint64) *models.Order {
+		body := strings.Replace(defaultPayload, `"quantity": 1`, fmt.Sprintf(`"quantity": %d`, quantity), 1)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(body), test.Data.testUserToken), order)
+		payment := fmt.Sprintf(`{"amount": %d, "currency": "USD", "provider": "giftcard"}`, order.Total)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/"+order.ID+"/payments", strings.NewReader(payment), test.Data.testUserToken)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		waitForConfirmationMails(t, test, order.ID)
+		return order
+	}
+	ship := func(order *models.Order, location string, quantity uint64) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"carrier": "UPS", "location": "%s", "items": [{"line_item_id": %d, "quantity": %d}]}`, location, order.LineItems[0].ID, quantity)
+		return test.TestEndpoint(http.MethodPost, "/orders/"+order.ID+"/shipments", strings.NewReader(body), token)
+	}
+
+	recorder := test.TestEndpoint(http.MethodPut, "/stock/product-1", strings.NewReader(`{"location": "north", "quantity": 1}`), token)
+	validateError(t, http.StatusBadRequest, recorder, "Unknown stock location north")
+
+	setStock("east", "2")
+	setStock("west", "2")
+
+	t.Run("Split", func(t *testing.T) {
+		// no warehouse stocks all items, so they're taken from both
+		order := paidOrder(3)
+		assert.EqualValues(t, 0, stockAt("east"))
+		assert.EqualValues(t, 1, stockAt("west"))
+
+		require.Equal(t, http.StatusCreated, ship(order, "east", 2).Code)
+		require.Equal(t, http.StatusCreated, ship(order, "west", 1).Code)
+		assert.EqualValues(t, 0, stockAt("east"))
+		assert.EqualValues(t, 1, stockAt("west"))
+	})
+	t.Run("Moved", func(t *testing.T) {
+		order := paidOrder(1)
+		assert.EqualValues(t, 0, stockAt("west"))
+
+		recorder := ship(order, "east", 1)
+		validateError(t, http.StatusBadRequest, recorder, "Only 0 of product-1 are in stock at this location")
+
+		// shipping from another warehouse returns the items to the one they were taken from
+		setStock("east", "5")
+		require.Equal(t, http.StatusCreated, ship(order, "east", 1).Code)
+		assert.EqualValues(t, 4, stockAt("east"))
+		assert.EqualValues(t, 1, stockAt("west"))
+	})
+	t.Run("Delete", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodDelete, "/stock/locations/east", nil, token)
+		validateError(t, http.StatusBadRequest, recorder, "Products are still in stock at this location")
+
+		setStock("east", "0")
+		recorder = test.TestEndpoint(http.MethodDelete, "/stock/locations/east", nil, token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		locations := []models.StockLocation{}
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/stock/locations", nil, token), &locations)
+		require.Len(t, locations, 1)
+		assert.Equal(t, "west", locations[0].ID)
+	})
+}
+
+// waitForConfirmationMails waits for the confirmation mails of a paid order,
+// which are logged in the background and would lock the database for the
+// next request.
+func waitForConfirmationMails(t *testing.T, test *RouteTest, orderID string) {
+	for i := 0; i < 100; i++ {
+		var sent int
+		require.NoError(t, test.DB.Model(&models.Event{}).Where("order_id = ? AND changes = ?", orderID, "order_received").Count(&sent).Error)
+		if sent > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
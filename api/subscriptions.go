@@ -0,0 +1,445 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+const subscriptionRenewalInterval = time.Minute
+
+// SubscriptionParams holds the parameters for subscribing to renewals of an order
+type SubscriptionParams struct {
+	OrderID         string `json:"order_id"`
+	PaymentMethodID string `json:"payment_method_id"`
+	Plan            string `json:"plan"`
+	Interval        string `json:"interval"`
+	IntervalCount   uint64 `json:"interval_count"`
+}
+
+// SubscriptionList will return the subscriptions of a given user
+func (a *API) SubscriptionList(w http.ResponseWriter, r *http.Request) error {
+	userID := gcontext.GetUserID(r.Context())
+
+	subs := []models.Subscription{}
+	results := a.DB(r).Where("user_id = ?", userID).Order("created_at desc").Find(&subs)
+	if results.Error != nil {
+		return internalServerError("problem while querying for userID: %s", userID).WithInternalError(results.Error)
+	}
+
+	return sendJSON(w, http.StatusOK, &subs)
+}
+
+// SubscriptionView will return a particular subscription of a given user
+func (a *API) SubscriptionView(w http.ResponseWriter, r *http.Request) error {
+	sub, httpErr := a.getSubscription(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	return sendJSON(w, http.StatusOK, sub)
+}
+
+// SubscriptionCreate subscribes the user to renewals of a paid order. Every
+// billing interval a renewal order with the same line items is created and
+// charged to the saved payment method.
+func (a *API) SubscriptionCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	db := a.DB(r)
+	userID := gcontext.GetUserID(ctx)
+	if gcontext.GetUser(ctx) == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+
+	params := SubscriptionParams{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		return badRequestError("Could not read params: %v", err)
+	}
+	if params.Plan == "" {
+		return badRequestError("Creating a subscription requires specifying a 'plan'")
+	}
+	if !models.ValidInterval(params.Interval) {
+		return badRequestError("Interval must be one of %v", models.SubscriptionIntervals)
+	}
+
+	order := &models.Order{}
+	if rsp := db.Preload("LineItems").Where("id = ? AND user_id = ?", params.OrderID, userID).First(order); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	if order.PaymentState != models.PaidState {
+		return badRequestError("Only paid orders can be renewed by a subscription")
+	}
+
+	method, err := models.GetPaymentMethod(db, userID, params.PaymentMethodID)
+	if err != nil {
+		return internalServerError("Error during database query").WithInternalError(err)
+	}
+	if method == nil {
+		return notFoundError("Payment method not found")
+	}
+	provider := gcontext.GetPaymentProviders(ctx)[method.Provider]
+	if _, ok := provider.(payments.VaultingProvider); !ok {
+		return badRequestError("Payment provider '%s' can't charge saved payment methods", method.Provider)
+	}
+
+	sub := models.NewSubscription(order, method.ID, params.Plan, params.Interval, params.IntervalCount)
+	sub.MeteredSkus = meteredSkus(order)
+	tx := db.Begin()
+	if rsp := tx.Create(sub); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("failed to save subscription").WithInternalError(rsp.Error)
+	}
+	models.LogEvent(tx, r.RemoteAddr, gcontext.GetClaims(ctx).Subject, order.ID, models.EventUpdated, []string{"subscription"})
+	if err := tx.Commit().Error; err != nil {
+		return internalServerError("failed to save subscription").WithInternalError(err)
+	}
+
+	log.WithField("subscription_id", sub.ID).Info("created subscription")
+	return sendJSON(w, http.StatusCreated, sub)
+}
+
+// SubscriptionCancel cancels a subscription. No further renewals are charged.
+func (a *API) SubscriptionCancel(w http.ResponseWriter, r *http.Request) error {
+	return a.changeSubscriptionStatus(w, r, models.SubscriptionCanceledState,
+		models.SubscriptionActiveState, models.SubscriptionPausedState, models.SubscriptionPastDueState)
+}
+
+// SubscriptionPause puts the renewals of an active subscription on hold.
+func (a *API) SubscriptionPause(w http.ResponseWriter, r *http.Request) error {
+	return a.changeSubscriptionStatus(w, r, models.SubscriptionPausedState, models.SubscriptionActiveState)
+}
+
+// SubscriptionResume resumes the renewals of a paused subscription. Renewals
+// that fell due while it was paused are skipped.
+func (a *API) SubscriptionResume(w http.ResponseWriter, r *http.Request) error {
+	return a.changeSubscriptionStatus(w, r, models.SubscriptionActiveState, models.SubscriptionPausedState)
+}
+
+func (a *API) changeSubscriptionStatus(w http.ResponseWriter, r *http.Request, status string, from ...string) error {
+	ctx := r.Context()
+	sub, httpErr := a.getSubscription(r)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	allowed := false
+	for _, s := range from {
+		allowed = allowed || sub.Status == s
+	}
+	if !allowed {
+		return badRequestError("A subscription that is %s can't be %s", sub.Status, status)
+	}
+
+	now := time.Now()
+	switch status {
+	case models.SubscriptionPausedState:
+		sub.PausedAt = &now
+	case models.SubscriptionCanceledState:
+		sub.CanceledAt = &now
+	case models.SubscriptionActiveState:
+		sub.PausedAt = nil
+		for !sub.NextRenewalAt.After(now) {
+			sub.NextRenewalAt = sub.RenewalAfter(sub.NextRenewalAt)
+		}
+	}
+	sub.Status = status
+
+	tx := a.DB(r).Begin()
+	if rsp := tx.Save(sub); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("failed to save subscription").WithInternalError(rsp.Error)
+	}
+	if status == models.SubscriptionCanceledState {
+		tx.Model(&models.PaymentRetry{}).
+			Where("subscription_id = ? AND status = ?", sub.ID, models.PaymentRetryPendingState).
+			Updates(map[string]interface{}{"status": models.PaymentRetryCanceledState, "next_attempt_at": nil})
+	}
+	models.LogEvent(tx, r.RemoteAddr, gcontext.GetClaims(ctx).Subject, sub.OrderID, models.EventUpdated, []string{"subscription"})
+	if err := tx.Commit().Error; err != nil {
+		return internalServerError("failed to save subscription").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusOK, sub)
+}
+
+func (a *API) getSubscription(r *http.Request) (*models.Subscription, *HTTPError) {
+	subID := chi.URLParam(r, "subscription_id")
+	sub, err := models.GetSubscription(a.DB(r), gcontext.GetUserID(r.Context()), subID)
+	if err != nil {
+		return nil, internalServerError("problem while querying for subscription: %s", subID).WithInternalError(err)
+	}
+	if sub == nil {
+		return nil, notFoundError("Subscription not found")
+	}
+	return sub, nil
+}
+
+// meteredSkus returns the SKUs of the line items of the order whose products
+// are metered.
+func meteredSkus(order *models.Order) []string {
+	skus := []string{}
+	seen := map[string]bool{}
+	for _, item := range order.LineItems {
+		if item.Metered && !seen[item.Sku] {
+			skus = append(skus, item.Sku)
+			seen[item.Sku] = true
+		}
+	}
+	if len(skus) == 0 {
+		return nil
+	}
+	return skus
+}
+
+// RunSubscriptionRenewer creates a goroutine that renews the subscriptions
+// that are due every minute.
+func (a *API) RunSubscriptionRenewer(ctx context.Context, db *gorm.DB, log logrus.FieldLogger) {
+	go func() {
+		for {
+			a.renewDueSubscriptions(ctx, db, log)
+			time.Sleep(subscriptionRenewalInterval)
+		}
+	}()
+}
+
+func (a *API) renewDueSubscriptions(ctx context.Context, db *gorm.DB, log logrus.FieldLogger) {
+	due := []*models.Subscription{}
+	rsp := db.Where("status = ? AND next_renewal_at <= ?", models.SubscriptionActiveState, time.Now()).Find(&due)
+	if rsp.Error != nil {
+		log.WithError(rsp.Error).Error("Error querying for due subscriptions")
+		return
+	}
+
+	instances := map[string]context.Context{}
+	for _, sub := range due {
+		log := log.WithField("subscription_id", sub.ID)
+
+		instanceCtx, ok := instances[sub.InstanceID]
+		if !ok {
+			var err error
+			if instanceCtx, err = a.instanceContext(ctx, db, sub.InstanceID); err != nil {
+				log.WithError(err).Error("Error loading instance configuration")
+				continue
+			}
+			instances[sub.InstanceID] = instanceCtx
+		}
+
+		dueAt := sub.NextRenewalAt
+		claimed, err := models.ClaimRenewal(db, sub, time.Now())
+		if err != nil {
+			log.WithError(err).Error("Error claiming the renewal of the subscription")
+			continue
+		}
+		if !claimed {
+			log.Debug("Subscription has been renewed already")
+			continue
+		}
+
+		if err := a.renewSubscription(instanceCtx, db, log, sub, dueAt); err != nil {
+			log.WithError(err).Error("Failed to renew subscription")
+			continue
+		}
+		log.WithField("order_id", sub.LastOrderID).Info("Renewed subscription")
+	}
+}
+
+// renewSubscription creates the renewal order of a claimed subscription and
+// charges its saved payment method. If the renewal order can't be created the
+// renewal is due again at dueAt. If the charge fails the renewal is retried or
+// the subscription has failed, depending on the retry schedule.
+func (a *API) renewSubscription(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, sub *models.Subscription, dueAt time.Time) error {
+	renewal, err := a.createRenewalOrder(ctx, db, log, sub)
+	if err != nil {
+		db.Model(&models.Subscription{}).Where("id = ?", sub.ID).UpdateColumn("next_renewal_at", dueAt)
+		return err
+	}
+
+	tr, chargeErr := chargeRenewal(ctx, db, log, sub, renewal)
+
+	tx := db.Begin()
+	complete, err := settleRenewal(ctx, tx, log, renewal, tr, chargeErr)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if renewalFailed(chargeErr) {
+		sub.LastOrderID = renewal.ID
+		tx.Model(&models.Subscription{}).Where("id = ?", sub.ID).UpdateColumn("last_order_id", renewal.ID)
+		retry := paymentFailed(ctx, tx, log, renewal, chargeErr.Error())
+		if err := tx.Commit().Error; err != nil {
+			return err
+		}
+		if retry != nil {
+			go sendPaymentRetryMail(ctx, db, log, renewal, retry)
+		}
+		return fmt.Errorf("Charging the renewal failed: %v", chargeErr)
+	}
+
+	sub.Renewed(renewal.ID, time.Now())
+	tx.Model(&models.Subscription{}).Where("id = ?", sub.ID).UpdateColumns(map[string]interface{}{
+		"last_order_id":   sub.LastOrderID,
+		"next_renewal_at": sub.NextRenewalAt,
+	})
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	if complete {
+		go sendOrderConfirmation(ctx, db, log, tr)
+	}
+	return nil
+}
+
+// createRenewalOrder saves the renewal order for the next billing interval of
+// the subscription. Metered line items are billed by the usage reported since
+// the last renewal, and the totals are calculated with the current settings.
+func (a *API) createRenewalOrder(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, sub *models.Subscription) (*models.Order, error) {
+	config := gcontext.GetConfig(ctx)
+	order := &models.Order{}
+	loader := db.
+		Preload("LineItems").
+		Preload("ShippingAddress").
+		Preload("BillingAddress")
+	if rsp := loader.First(order, "id = ?", sub.OrderID); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	settings, err := a.loadSettings(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	renewal := models.NewRenewalOrder(sub, order)
+	tx := db.Begin()
+	renewal.Number, err = models.NextOrderNumber(tx, renewal.InstanceID, config.Orders.NumberPrefix, time.Now())
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if len(sub.MeteredSkus) > 0 {
+		usage, err := models.BillUsage(tx, sub.ID, renewal.ID)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		sub.BillUsage(renewal, usage)
+	}
+	renewal.CalculateTotal(settings, gcontext.GetClaimsAsMap(ctx), log)
+	if httpError := checkShippingMethod(settings, renewal); httpError != nil {
+		tx.Rollback()
+		return nil, httpError
+	}
+	applyTaxBackend(config, settings, log, renewal)
+	if rsp := tx.Create(renewal); rsp.Error != nil {
+		tx.Rollback()
+		return nil, rsp.Error
+	}
+	models.LogEvent(tx, "", sub.UserID, renewal.ID, models.EventCreated, nil)
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return renewal, nil
+}
+
+// chargeRenewal charges the saved payment method of the subscription for a
+// renewal order. It's called outside of a database transaction, the returned
+// transaction is saved by settleRenewal along with the error of the charge.
+// Renewals without any amount due because of a lack of metered usage aren't
+// charged, while a zero total for the line items of a priced plan fails.
+func chargeRenewal(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, sub *models.Subscription, renewal *models.Order) (*models.Transaction, error) {
+	tr := models.NewTransaction(renewal)
+	if renewal.Total == 0 {
+		if sub.Amount > 0 && hasUnmeteredItem(sub, renewal) {
+			return tr, fmt.Errorf("Renewal of the priced plan '%s' has a zero total", sub.Plan)
+		}
+		return tr, nil
+	}
+
+	charge, provider, err := subscriptionCharger(ctx, db, log, sub)
+	tr.Provider = provider
+	if err == nil {
+		tr.ProcessorID, err = charge(renewal.Total, renewal.Currency, renewal, renewal.InvoiceNumber)
+	}
+	return tr, err
+}
+
+// hasUnmeteredItem reports whether the renewal has line items that are billed
+// by their quantity rather than by usage.
+func hasUnmeteredItem(sub *models.Subscription, renewal *models.Order) bool {
+	for _, item := range renewal.LineItems {
+		if !sub.Metered(item.Sku) {
+			return true
+		}
+	}
+	return false
+}
+
+// renewalFailed reports whether the charge of a renewal failed, rather than
+// being paid or processing.
+func renewalFailed(chargeErr error) bool {
+	_, processing := chargeErr.(*payments.PaymentProcessingError)
+	return chargeErr != nil && !processing
+}
+
+// settleRenewal saves the transaction of a renewal charge as paid, processing
+// or failed and reports whether the order has been paid completely. Only paid
+// renewals are given an invoice number, so failed charges leave no gaps in the
+// invoice numbers.
+func settleRenewal(ctx context.Context, tx *gorm.DB, log logrus.FieldLogger, renewal *models.Order, tr *models.Transaction, chargeErr error) (bool, error) {
+	if processingErr, ok := chargeErr.(*payments.PaymentProcessingError); ok {
+		tr.ProviderMetadata = processingErr.Metadata()
+		renewal.PaymentProcessor = tr.Provider
+		paymentProcessing(tx, tr, renewal)
+		return false, nil
+	}
+	if chargeErr != nil {
+		tr.FailureCode = strconv.FormatInt(http.StatusPaymentRequired, 10)
+		tr.FailureDescription = chargeErr.Error()
+		tr.Status = models.FailedState
+		return false, tx.Create(tr).Error
+	}
+
+	if renewal.InvoiceNumber == 0 {
+		invoiceNumber, err := models.NextInvoiceNumber(tx, renewal.InstanceID)
+		if err != nil {
+			return false, err
+		}
+		renewal.InvoiceNumber = invoiceNumber
+	}
+	tr.InvoiceNumber = renewal.InvoiceNumber
+	if tr.Provider != "" {
+		renewal.PaymentProcessor = tr.Provider
+	}
+	return completePayment(ctx, tx, log, tr, renewal)
+}
+
+// subscriptionCharger returns the charger for the saved payment method of the
+// subscription and the name of its payment provider.
+func subscriptionCharger(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, sub *models.Subscription) (payments.Charger, string, error) {
+	method, err := models.GetPaymentMethod(db, sub.UserID, sub.PaymentMethodID)
+	if err != nil {
+		return nil, "", err
+	}
+	if method == nil {
+		return nil, "", fmt.Errorf("Payment method %s has been deleted", sub.PaymentMethodID)
+	}
+	provider, ok := gcontext.GetPaymentProviders(ctx)[method.Provider].(payments.VaultingProvider)
+	if !ok {
+		return nil, method.Provider, fmt.Errorf("Payment provider '%s' can't charge saved payment methods", method.Provider)
+	}
+	charge, err := provider.NewSavedMethodCharger(ctx, method, log.WithField("component", "payment_provider"))
+	return charge, method.Provider, err
+}
@@ -0,0 +1,273 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func createTestSubscription(t *testing.T, test *RouteTest, nextRenewal time.Time) *models.Subscription {
+	sub := models.NewSubscription(test.Data.firstOrder, "saved-card", "monthly-box", models.MonthInterval, 1)
+	sub.NextRenewalAt = nextRenewal
+	require.NoError(t, test.DB.Create(sub).Error)
+	return sub
+}
+
+func TestSubscriptionCreate(t *testing.T) {
+	url := "/users/i-am-batman/subscriptions"
+
+	t.Run("Success", func(t *testing.T) {
+		test := NewRouteTest(t)
+		method := createTestPaymentMethod(t, test)
+
+		body, err := json.Marshal(&SubscriptionParams{
+			OrderID:         test.Data.firstOrder.ID,
+			PaymentMethodID: method.ID,
+			Plan:            "quarterly-box",
+			Interval:        models.MonthInterval,
+			IntervalCount:   3,
+		})
+		require.NoError(t, err)
+
+		recorder := test.TestEndpoint(http.MethodPost, url, bytes.NewBuffer(body), test.Data.testUserToken)
+		sub := &models.Subscription{}
+		extractPayload(t, http.StatusCreated, recorder, sub)
+		assert.Equal(t, models.SubscriptionActiveState, sub.Status)
+		assert.Equal(t, test.Data.firstOrder.Total, sub.Amount)
+		assert.WithinDuration(t, time.Now().AddDate(0, 3, 0), sub.NextRenewalAt, time.Minute)
+
+		recorder = test.TestEndpoint(http.MethodGet, url, nil, test.Data.testUserToken)
+		subs := []models.Subscription{}
+		extractPayload(t, http.StatusOK, recorder, &subs)
+		require.Len(t, subs, 1)
+		assert.Equal(t, sub.ID, subs[0].ID)
+	})
+	t.Run("InvalidInterval", func(t *testing.T) {
+		test := NewRouteTest(t)
+		method := createTestPaymentMethod(t, test)
+
+		body, err := json.Marshal(&SubscriptionParams{OrderID: test.Data.firstOrder.ID, PaymentMethodID: method.ID, Plan: "box", Interval: "fortnight"})
+		require.NoError(t, err)
+		recorder := test.TestEndpoint(http.MethodPost, url, bytes.NewBuffer(body), test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "Interval must be one of")
+	})
+	t.Run("MeteredProducts", func(t *testing.T) {
+		test := NewRouteTest(t)
+		method := createTestPaymentMethod(t, test)
+		require.NoError(t, test.DB.Model(test.Data.firstLineItem).UpdateColumn("metered", true).Error)
+
+		body := `{"order_id": "` + test.Data.firstOrder.ID + `", "payment_method_id": "` + method.ID + `", "plan": "box", "interval": "month", "metered_skus": ["234-fancy-belts"]}`
+		recorder := test.TestEndpoint(http.MethodPost, url, strings.NewReader(body), test.Data.testUserToken)
+		sub := &models.Subscription{}
+		extractPayload(t, http.StatusCreated, recorder, sub)
+		assert.Equal(t, []string{test.Data.firstLineItem.Sku}, sub.MeteredSkus)
+	})
+	t.Run("UnpaidOrder", func(t *testing.T) {
+		test := NewRouteTest(t)
+		method := createTestPaymentMethod(t, test)
+		require.NoError(t, test.DB.Model(&models.Order{}).Where("id = ?", test.Data.firstOrder.ID).Update("payment_state", models.PendingState).Error)
+
+		body, err := json.Marshal(&SubscriptionParams{OrderID: test.Data.firstOrder.ID, PaymentMethodID: method.ID, Plan: "box", Interval: models.WeekInterval})
+		require.NoError(t, err)
+		recorder := test.TestEndpoint(http.MethodPost, url, bytes.NewBuffer(body), test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "Only paid orders")
+	})
+	t.Run("OtherUser", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, "/users/stranger-danger/subscriptions", bytes.NewBufferString(`{}`), test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
+func TestSubscriptionStatus(t *testing.T) {
+	test := NewRouteTest(t)
+	createTestPaymentMethod(t, test)
+	sub := createTestSubscription(t, test, time.Now().Add(time.Hour))
+	url := "/users/i-am-batman/subscriptions/" + sub.ID
+
+	recorder := test.TestEndpoint(http.MethodPost, url+"/pause", nil, test.Data.testUserToken)
+	paused := &models.Subscription{}
+	extractPayload(t, http.StatusOK, recorder, paused)
+	assert.Equal(t, models.SubscriptionPausedState, paused.Status)
+	assert.NotNil(t, paused.PausedAt)
+
+	recorder = test.TestEndpoint(http.MethodPost, url+"/pause", nil, test.Data.testUserToken)
+	validateError(t, http.StatusBadRequest, recorder, "can't be paused")
+
+	// renewals that fell due while paused are skipped
+	require.NoError(t, test.DB.Model(sub).Update("next_renewal_at", time.Now().AddDate(0, -2, 0)).Error)
+	recorder = test.TestEndpoint(http.MethodPost, url+"/resume", nil, test.Data.testUserToken)
+	resumed := &models.Subscription{}
+	extractPayload(t, http.StatusOK, recorder, resumed)
+	assert.Equal(t, models.SubscriptionActiveState, resumed.Status)
+	assert.Nil(t, resumed.PausedAt)
+	assert.True(t, resumed.NextRenewalAt.After(time.Now()))
+
+	recorder = test.TestEndpoint(http.MethodPost, url+"/cancel", nil, test.Data.testUserToken)
+	canceled := &models.Subscription{}
+	extractPayload(t, http.StatusOK, recorder, canceled)
+	assert.Equal(t, models.SubscriptionCanceledState, canceled.Status)
+	assert.NotNil(t, canceled.CanceledAt)
+
+	recorder = test.TestEndpoint(http.MethodPost, url+"/resume", nil, test.Data.testUserToken)
+	validateError(t, http.StatusBadRequest, recorder)
+
+	recorder = test.TestEndpoint(http.MethodGet, "/users/i-am-batman/subscriptions/dne", nil, test.Data.testUserToken)
+	validateError(t, http.StatusNotFound, recorder)
+}
+
+func TestRenewDueSubscriptions(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	renew := func(t *testing.T, test *RouteTest) {
+		test.Config.SiteURL = server.URL
+		ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+		require.NoError(t, err)
+		api := NewAPIWithVersion(ctx, test.GlobalConfig, logrus.StandardLogger(), test.DB, "")
+		api.renewDueSubscriptions(ctx, test.DB, logrus.StandardLogger())
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		test := NewRouteTest(t)
+		createTestPaymentMethod(t, test)
+		due := time.Now().Add(-time.Minute)
+		sub := createTestSubscription(t, test, due)
+		notDue := createTestSubscription(t, test, time.Now().Add(time.Hour))
+
+		charges := 0
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+			switch path {
+			case "/v1/payment_intents":
+				charges++
+				assert.EqualValues(t, test.Data.firstOrder.Total, *params.(*stripe.PaymentIntentParams).Amount)
+				intent := v.(*stripe.PaymentIntent)
+				intent.ID = stripePaymentIntentID
+				intent.Status = stripe.PaymentIntentStatusSucceeded
+				return nil
+			default:
+				t.Fatalf("unknown Stripe API call to %s", path)
+				return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+			}
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		renew(t, test)
+		assert.Equal(t, 1, charges)
+
+		renewed, err := models.GetSubscription(test.DB, sub.UserID, sub.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.SubscriptionActiveState, renewed.Status)
+		assert.WithinDuration(t, due.AddDate(0, 1, 0), renewed.NextRenewalAt, time.Second)
+		require.NotEmpty(t, renewed.LastOrderID)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.Preload("LineItems").Preload("Transactions").First(order, "id = ?", renewed.LastOrderID).Error)
+		assert.Equal(t, sub.ID, order.SubscriptionID)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+		assert.Equal(t, test.Data.firstOrder.Total, order.Total)
+		assert.Len(t, order.LineItems, len(test.Data.firstOrder.LineItems))
+		require.Len(t, order.Transactions, 1)
+		assert.Equal(t, stripePaymentIntentID, order.Transactions[0].ProcessorID)
+		assert.NotZero(t, order.InvoiceNumber)
+
+		untouched, err := models.GetSubscription(test.DB, notDue.UserID, notDue.ID)
+		require.NoError(t, err)
+		assert.Empty(t, untouched.LastOrderID)
+	})
+	t.Run("Declined", func(t *testing.T) {
+		test := NewRouteTest(t)
+		createTestPaymentMethod(t, test)
+		sub := createTestSubscription(t, test, time.Now().Add(-time.Minute))
+
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+			return &stripe.Error{Code: stripe.ErrorCodeCardDeclined, Msg: "Your card was declined"}
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		renew(t, test)
+
+		// without a retry schedule the renewal isn't retried
+		failed, err := models.GetSubscription(test.DB, sub.UserID, sub.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.SubscriptionFailedState, failed.Status)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.Preload("Transactions").First(order, "id = ?", failed.LastOrderID).Error)
+		assert.Equal(t, models.FailedState, order.PaymentState)
+		require.Len(t, order.Transactions, 1)
+		assert.Equal(t, models.FailedState, order.Transactions[0].Status)
+		assert.Zero(t, order.InvoiceNumber)
+	})
+	t.Run("ZeroTotal", func(t *testing.T) {
+		test := NewRouteTest(t)
+		createTestPaymentMethod(t, test)
+		sub := createTestSubscription(t, test, time.Now().Add(-time.Minute))
+		require.NoError(t, test.DB.Model(test.Data.firstLineItem).UpdateColumn("price", 0).Error)
+
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+			t.Fatalf("unexpected Stripe API call to %s", path)
+			return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		renew(t, test)
+
+		failed, err := models.GetSubscription(test.DB, sub.UserID, sub.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.SubscriptionFailedState, failed.Status)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.Preload("Transactions").First(order, "id = ?", failed.LastOrderID).Error)
+		assert.Equal(t, models.FailedState, order.PaymentState)
+		require.Len(t, order.Transactions, 1)
+		assert.Contains(t, order.Transactions[0].FailureDescription, "zero total")
+	})
+	t.Run("Claimed", func(t *testing.T) {
+		test := NewRouteTest(t)
+		sub := createTestSubscription(t, test, time.Now().Add(-time.Minute))
+		stale := *sub
+
+		claimed, err := models.ClaimRenewal(test.DB, sub, time.Now())
+		require.NoError(t, err)
+		assert.True(t, claimed)
+		claimed, err = models.ClaimRenewal(test.DB, &stale, time.Now())
+		require.NoError(t, err)
+		assert.False(t, claimed, "expected the renewal to be claimed only once")
+	})
+	t.Run("LimitedCoupon", func(t *testing.T) {
+		test := NewRouteTest(t)
+		createTestPaymentMethod(t, test)
+		test.Data.firstOrder.Coupon = &models.Coupon{Code: "once", Percentage: 50, MaxUses: 1}
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+		sub := createTestSubscription(t, test, time.Now().Add(-time.Minute))
+
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+			intent := v.(*stripe.PaymentIntent)
+			intent.ID = stripePaymentIntentID
+			intent.Status = stripe.PaymentIntentStatusSucceeded
+			return nil
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		renew(t, test)
+
+		renewed, err := models.GetSubscription(test.DB, sub.UserID, sub.ID)
+		require.NoError(t, err)
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", renewed.LastOrderID).Error)
+		assert.Nil(t, order.Coupon)
+		assert.Zero(t, order.Discount)
+		assert.Equal(t, test.Data.firstOrder.SubTotal, order.Total)
+	})
+}
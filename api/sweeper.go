@@ -0,0 +1,133 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+const defaultSweepInterval = 10 * time.Minute
+
+// staleOrderStates are the payment states of orders that expire once they
+// are older than the pending order TTL of their instance.
+var staleOrderStates = []string{models.PendingState, models.AuthorizedState}
+
+// RunPendingOrderSweeper creates a goroutine that expires stale pending orders
+// at the interval of the sweeper configuration. It also releases expired stock
+// reservations and retries issuing missing credit notes.
+func (a *API) RunPendingOrderSweeper(ctx context.Context, db *gorm.DB, log logrus.FieldLogger) {
+	interval := a.config.Sweeper.Interval
+	if interval <= 0 {
+		interval = defaultSweepInterval
+	}
+	go func() {
+		for {
+			a.expireStaleOrders(ctx, db, log)
+			releaseExpiredStock(db, log)
+			issueMissingCreditNotes(db, log)
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func (a *API) expireStaleOrders(ctx context.Context, db *gorm.DB, log logrus.FieldLogger) {
+	instanceIDs := []string{}
+	rsp := db.Model(&models.Order{}).Where("payment_state IN (?)", staleOrderStates).Pluck("DISTINCT instance_id", &instanceIDs)
+	if rsp.Error != nil {
+		log.WithError(rsp.Error).Error("Error querying for pending orders")
+		return
+	}
+
+	for _, instanceID := range instanceIDs {
+		log := log.WithField("instance_id", instanceID)
+
+		instanceCtx, err := a.instanceContext(ctx, db, instanceID)
+		if err != nil {
+			log.WithError(err).Error("Error loading instance configuration")
+			continue
+		}
+		ttl := gcontext.GetConfig(instanceCtx).PendingOrderTTL()
+		if ttl == 0 {
+			continue
+		}
+
+		stale := []*models.Order{}
+		rsp := db.Where("instance_id = ? AND payment_state IN (?) AND created_at < ?", instanceID, staleOrderStates, time.Now().Add(-ttl)).Find(&stale)
+		if rsp.Error != nil {
+			log.WithError(rsp.Error).Error("Error querying for stale orders")
+			continue
+		}
+
+		for _, order := range stale {
+			log := log.WithField("order_id", order.ID)
+			expired, err := expireOrder(instanceCtx, db, log, order)
+			if err != nil {
+				log.WithError(err).Error("Failed to expire stale order")
+				continue
+			}
+			if !expired {
+				log.Debug("Skipped order that stopped being stale")
+				continue
+			}
+			log.Info("Expired stale order")
+		}
+	}
+}
+
+// expireOrder voids the authorizations of an order that hasn't been paid in
+// time and marks the order and its pending transactions as expired. The
+// authorizations are claimed before they are voided, and the order is only
+// expired if it's still pending or authorized, which is reported by the
+// returned bool.
+func expireOrder(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, order *models.Order) (bool, error) {
+	transactions := []*models.Transaction{}
+	rsp := db.Where("order_id = ? AND type = ? AND status IN (?)", order.ID, models.ChargeTransactionType, staleOrderStates).Find(&transactions)
+	if rsp.Error != nil {
+		return false, rsp.Error
+	}
+
+	for _, trans := range transactions {
+		if trans.Status != models.AuthorizedState {
+			continue
+		}
+		voided, err := voidAuthorization(ctx, db, log, trans, order)
+		if err != nil {
+			return false, err
+		}
+		if !voided {
+			return false, nil
+		}
+	}
+
+	tx := db.Begin()
+	rsp = tx.Model(&models.Order{}).
+		Where("id = ? AND payment_state IN (?)", order.ID, staleOrderStates).
+		UpdateColumn("payment_state", models.ExpiredState)
+	if rsp.Error != nil {
+		tx.Rollback()
+		return false, rsp.Error
+	}
+	if rsp.RowsAffected == 0 {
+		tx.Rollback()
+		return false, nil
+	}
+	order.PaymentState = models.ExpiredState
+	for _, trans := range transactions {
+		if trans.Status == models.PendingState {
+			tx.Model(&models.Transaction{}).
+				Where("id = ? AND status = ?", trans.ID, models.PendingState).
+				UpdateColumn("status", models.ExpiredState)
+		}
+	}
+	if err := models.ReleaseStockReservations(tx, order.ID); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	models.LogEvent(tx, "", order.UserID, order.ID, models.EventUpdated, []string{"payment_state"})
+	return true, tx.Commit().Error
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestExpireStaleOrders(t *testing.T) {
+	setup := func(t *testing.T, ttl uint64) (*RouteTest, *int) {
+		test := NewRouteTest(t)
+		test.Config.Orders.PendingTTL = ttl
+		createdAt := time.Now().Add(-2 * time.Hour)
+
+		authorizeFirstTransaction(t, test, time.Now().Add(time.Hour))
+		require.NoError(t, test.DB.Model(&models.Order{}).Where("id = ?", test.Data.firstOrder.ID).Update("created_at", createdAt).Error)
+
+		require.NoError(t, test.DB.Model(test.Data.secondTransaction).Update("status", models.PendingState).Error)
+		require.NoError(t, test.DB.Model(&models.Order{}).Where("id = ?", test.Data.secondOrder.ID).Updates(map[string]interface{}{
+			"payment_state": models.PendingState,
+			"created_at":    createdAt,
+		}).Error)
+
+		cancelCalls := 0
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+			switch path {
+			case "/v1/payment_intents/" + stripePaymentIntentID + "/cancel":
+				cancelCalls++
+				v.(*stripe.PaymentIntent).Status = stripe.PaymentIntentStatusCanceled
+				return nil
+			default:
+				t.Fatalf("unknown Stripe API call to %s", path)
+				return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+			}
+		}))
+
+		ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+		require.NoError(t, err)
+		api := NewAPIWithVersion(ctx, test.GlobalConfig, logrus.StandardLogger(), test.DB, "")
+		api.expireStaleOrders(ctx, test.DB, logrus.StandardLogger())
+		return test, &cancelCalls
+	}
+
+	t.Run("Expired", func(t *testing.T) {
+		test, cancelCalls := setup(t, 1)
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+		assert.Equal(t, 1, *cancelCalls)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.Find(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, models.ExpiredState, order.PaymentState)
+		trans, err := models.GetTransaction(test.DB, test.Data.firstTransaction.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.VoidedState, trans.Status)
+
+		order = &models.Order{}
+		require.NoError(t, test.DB.Find(order, "id = ?", test.Data.secondOrder.ID).Error)
+		assert.Equal(t, models.ExpiredState, order.PaymentState)
+		trans, err = models.GetTransaction(test.DB, test.Data.secondTransaction.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.ExpiredState, trans.Status)
+
+		events := []models.Event{}
+		require.NoError(t, test.DB.Where("order_id IN (?)", []string{test.Data.firstOrder.ID, test.Data.secondOrder.ID}).Find(&events).Error)
+		assert.Len(t, events, 2)
+	})
+	t.Run("PaidMeanwhile", func(t *testing.T) {
+		test := NewRouteTest(t)
+		ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+		require.NoError(t, err)
+		stale := *test.Data.firstOrder
+		stale.PaymentState = models.PendingState
+
+		expired, err := expireOrder(ctx, test.DB, logrus.StandardLogger(), &stale)
+		require.NoError(t, err)
+		assert.False(t, expired)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.Find(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+		trans, err := models.GetTransaction(test.DB, test.Data.firstTransaction.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.PaidState, trans.Status)
+	})
+	t.Run("WithinTTL", func(t *testing.T) {
+		test, cancelCalls := setup(t, 3)
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+		assert.Equal(t, 0, *cancelCalls)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.Find(order, "id = ?", test.Data.secondOrder.ID).Error)
+		assert.Equal(t, models.PendingState, order.PaymentState)
+	})
+	t.Run("Disabled", func(t *testing.T) {
+		test, cancelCalls := setup(t, 0)
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+		assert.Equal(t, 0, *cancelCalls)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.Find(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, models.AuthorizedState, order.PaymentState)
+	})
+}
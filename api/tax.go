@@ -0,0 +1,352 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/tax"
+	"github.com/netlify/gocommerce/tax/avatax"
+	"github.com/netlify/gocommerce/tax/taxjar"
+)
+
+const (
+	// taxJarProvider is the tax backend calculating US sales tax with TaxJar.
+	taxJarProvider = "taxjar"
+	// avaTaxProvider is the tax backend calculating taxes with Avalara AvaTax.
+	avaTaxProvider = "avatax"
+)
+
+// defaultTaxCountries are the names of the US in addresses, the countries
+// the tax backend is used for if the configuration doesn't list any.
+var defaultTaxCountries = []string{"US", "USA", "United States"}
+
+// taxBackendCovers returns whether the taxes of orders shipping to the
+// country are calculated by the tax backend.
+func taxBackendCovers(config *conf.Configuration, country string) bool {
+	if config.Tax.Provider == "" {
+		return false
+	}
+	countries := config.Tax.Countries
+	if len(countries) == 0 {
+		countries = defaultTaxCountries
+	}
+	for _, c := range countries {
+		if c == country {
+			return true
+		}
+	}
+	return false
+}
+
+// newTaxCalculator returns the client of the tax backend.
+func newTaxCalculator(config *conf.Configuration, provider string) (tax.Calculator, error) {
+	switch provider {
+	case taxJarProvider:
+		return taxjar.NewClient(taxjar.Config{
+			APIKey: config.Tax.TaxJar.APIKey,
+			URL:    config.Tax.TaxJar.URL,
+		})
+	case avaTaxProvider:
+		return avatax.NewClient(avatax.Config{
+			AccountID:   config.Tax.AvaTax.AccountID,
+			LicenseKey:  config.Tax.AvaTax.LicenseKey,
+			CompanyCode: config.Tax.AvaTax.CompanyCode,
+			Sandbox:     config.Tax.AvaTax.Sandbox,
+			URL:         config.Tax.AvaTax.URL,
+		})
+	}
+	return nil, fmt.Errorf("Unknown tax provider %s", provider)
+}
+
+// applyTaxBackend replaces the taxes of an order priced with the tax rates of
+// the site settings by those of the tax backend, if the order is covered by
+// it. The taxes of the settings are kept if the backend fails, reverse
+// charged and tax exempt orders aren't taxed.
+func applyTaxBackend(config *conf.Configuration, settings *calculator.Settings, log logrus.FieldLogger, order *models.Order) {
+	if (settings != nil && settings.PricesIncludeTaxes) || order.ReverseCharge || order.TaxExempt {
+		return
+	}
+	if !taxBackendCovers(config, order.ShippingAddress.Country) {
+		return
+	}
+
+	backend, err := newTaxCalculator(config, config.Tax.Provider)
+	if err != nil {
+		log.WithError(err).Error("Failed to set up the tax backend, falling back to the settings taxes")
+		return
+	}
+	taxes, err := backend.TaxForOrder(taxOrder(config, order, false))
+	if err != nil {
+		log.WithError(err).Error("Failed to calculate taxes with the tax backend, falling back to the settings taxes")
+		return
+	}
+	order.ApplyTaxes(config.Tax.Provider, taxes)
+}
+
+// setTaxExemption exempts a new order or the order pricing a cart from taxes
+// if its instance or user is tax exempt. Users that haven't ordered yet have
+// no record and aren't exempt.
+func setTaxExemption(tx *gorm.DB, config *conf.Configuration, order *models.Order) *HTTPError {
+	if config.TaxExemption.Exempt {
+		order.TaxExempt = true
+		order.TaxExemptionCertificate = config.TaxExemption.Certificate
+		return nil
+	}
+	if order.UserID == "" {
+		return nil
+	}
+
+	user := &models.User{}
+	rsp := tx.First(user, "id = ?", order.UserID)
+	if rsp.RecordNotFound() {
+		return nil
+	}
+	if rsp.Error != nil {
+		return internalServerError("Error loading user").WithInternalError(rsp.Error)
+	}
+	order.TaxExempt = user.TaxExempt
+	order.TaxExemptionCertificate = user.TaxExemptionCertificate
+	return nil
+}
+
+// Jobs recording paid orders and refunds taxed by the tax backend for filing,
+// once the transaction marking them as paid or recording the refund has been
+// committed.
+const (
+	taxOrderJob  = "tax_order"
+	taxRefundJob = "tax_refund"
+)
+
+type taxOrderPayload struct {
+	OrderID string `json:"order_id"`
+}
+
+type taxRefundPayload struct {
+	RefundID string `json:"refund_id"`
+}
+
+// reportTaxes queues the recording of a paid order taxed by the tax backend,
+// within the transaction that marks it as paid.
+func reportTaxes(tx *gorm.DB, log logrus.FieldLogger, order *models.Order) {
+	if order.TaxProvider == "" {
+		return
+	}
+	if err := models.EnqueueJob(tx, order.InstanceID, taxOrderJob, order.ID, &taxOrderPayload{OrderID: order.ID}); err != nil {
+		log.WithError(err).Error("Failed to queue the recording of the order taxes")
+	}
+}
+
+// reportTaxRefund queues the recording of a refund of an order taxed by the
+// tax backend, within the transaction recording the refund.
+func reportTaxRefund(tx *gorm.DB, log logrus.FieldLogger, refund *models.Transaction) {
+	order := &models.Order{}
+	if rsp := tx.Select("id, tax_provider, total").First(order, "id = ?", refund.OrderID); rsp.Error != nil {
+		log.WithError(rsp.Error).Error("Failed to load the order of the refund")
+		return
+	}
+	if order.TaxProvider == "" || order.Total == 0 {
+		return
+	}
+	if err := models.EnqueueJob(tx, refund.InstanceID, taxRefundJob, refund.ID, &taxRefundPayload{RefundID: refund.ID}); err != nil {
+		log.WithError(err).Error("Failed to queue the recording of the refund taxes")
+	}
+}
+
+// runTaxOrderJob records the paid order of the job with the tax backend.
+func runTaxOrderJob(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, job *models.Job) error {
+	payload := &taxOrderPayload{}
+	if err := json.Unmarshal([]byte(job.Payload), payload); err != nil {
+		return errors.Wrap(err, "Error parsing job payload")
+	}
+	order := &models.Order{}
+	if rsp := db.First(order, "id = ?", payload.OrderID); rsp.Error != nil {
+		return rsp.Error
+	}
+	config := gcontext.GetConfig(ctx)
+	backend, err := newTaxCalculator(config, order.TaxProvider)
+	if err != nil {
+		return errors.Wrap(err, "Error setting up the tax backend")
+	}
+	loadTaxedOrder(db, order)
+
+	record := taxOrder(config, order, true)
+	paidAt, err := models.OrderPaidAt(db, order)
+	if err != nil {
+		return err
+	}
+	record.Date = paidAt
+	return errors.Wrapf(backend.RecordOrder(record), "Error recording order with %s", order.TaxProvider)
+}
+
+// runTaxRefundJob records the refund of the job with the tax backend. The
+// refunded sales tax and shipping are the share of the refund in the order
+// total.
+func runTaxRefundJob(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, job *models.Job) error {
+	payload := &taxRefundPayload{}
+	if err := json.Unmarshal([]byte(job.Payload), payload); err != nil {
+		return errors.Wrap(err, "Error parsing job payload")
+	}
+	refund := &models.Transaction{}
+	if rsp := db.First(refund, "id = ?", payload.RefundID); rsp.Error != nil {
+		return rsp.Error
+	}
+	order := &models.Order{}
+	if rsp := db.First(order, "id = ?", refund.OrderID); rsp.Error != nil {
+		return rsp.Error
+	}
+	config := gcontext.GetConfig(ctx)
+	backend, err := newTaxCalculator(config, order.TaxProvider)
+	if err != nil {
+		return errors.Wrap(err, "Error setting up the tax backend")
+	}
+	loadTaxedOrder(db, order)
+
+	amount := refund.Amount
+	if amount > order.Total {
+		amount = order.Total
+	}
+	share := func(total uint64) uint64 {
+		return uint64(math.Round(float64(total) * float64(amount) / float64(order.Total)))
+	}
+	err = backend.RecordRefund(&tax.Refund{
+		ID:       refund.ID,
+		Order:    taxOrder(config, order, false),
+		Date:     refund.CreatedAt,
+		Amount:   amount,
+		SalesTax: share(order.Taxes),
+		Shipping: share(order.Shipping),
+	})
+	return errors.Wrapf(err, "Error recording refund with %s", order.TaxProvider)
+}
+
+// TaxRateView returns the combined tax rate of the address in the query
+// parameters, as resolved by the tax backend.
+func (a *API) TaxRateView(w http.ResponseWriter, r *http.Request) error {
+	config := gcontext.GetConfig(r.Context())
+	query := r.URL.Query()
+	country := query.Get("country")
+	if country == "" {
+		return badRequestError("A country is required")
+	}
+	if !taxBackendCovers(config, country) {
+		return notFoundError("No tax backend covers %v", country)
+	}
+
+	backend, err := newTaxCalculator(config, config.Tax.Provider)
+	if err != nil {
+		return internalServerError("Failed to set up the tax backend").WithInternalError(err)
+	}
+	address := tax.Address{
+		Country: taxCountryCode(country),
+		Zip:     query.Get("zip"),
+		State:   query.Get("state"),
+		City:    query.Get("city"),
+		Street:  query.Get("address1"),
+	}
+	rate, err := backend.RateForAddress(address)
+	if err != nil {
+		return internalServerError("Failed to look up the tax rate").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusOK, map[string]interface{}{
+		"provider": config.Tax.Provider,
+		"address":  address,
+		"rate":     rate,
+	})
+}
+
+func loadTaxedOrder(tx *gorm.DB, order *models.Order) {
+	if len(order.LineItems) == 0 {
+		tx.Model(order).Related(&order.LineItems)
+	}
+	if order.ShippingAddress.ID == "" && order.ShippingAddressID != "" {
+		tx.First(&order.ShippingAddress, "id = ?", order.ShippingAddressID)
+	}
+}
+
+// taxCountryCode returns the country code of a country covered by the tax
+// backend. Other names than those of the US are passed on as is.
+func taxCountryCode(country string) string {
+	for _, c := range defaultTaxCountries {
+		if c == country {
+			return "US"
+		}
+	}
+	return country
+}
+
+// taxLineItemID returns the ID of the line item as sent to the tax backend.
+// Line items of an order that hasn't been saved yet, e.g. in a coupon check,
+// have no ID and are sent with their SKU instead.
+func taxLineItemID(item *models.LineItem) string {
+	if item.ID == 0 {
+		return item.Sku
+	}
+	return strconv.FormatInt(item.ID, 10)
+}
+
+// taxOrder returns a priced order as sent to the tax backend, with the sales
+// tax of the line items if it's to be recorded.
+func taxOrder(config *conf.Configuration, order *models.Order, withTaxes bool) *tax.Order {
+	shipping := order.ShippingAddress
+	o := &tax.Order{
+		ID:       order.ID,
+		Customer: order.Email,
+		Currency: order.Currency,
+		Date:     time.Now(),
+		From: tax.Address{
+			Country: config.Tax.From.Country,
+			Zip:     config.Tax.From.Zip,
+			State:   config.Tax.From.State,
+			City:    config.Tax.From.City,
+			Street:  config.Tax.From.Street,
+		},
+		To: tax.Address{
+			Country: taxCountryCode(shipping.Country),
+			Zip:     shipping.Zip,
+			State:   shipping.State,
+			City:    shipping.City,
+			Street:  shipping.Address1,
+		},
+		Items:    make([]tax.LineItem, 0, len(order.LineItems)),
+		Shipping: order.Shipping,
+	}
+	if o.From.Country == "" {
+		o.From.Country = "US"
+	}
+
+	for _, item := range order.LineItems {
+		line := tax.LineItem{
+			ID:          taxLineItemID(item),
+			Sku:         item.Sku,
+			Description: item.Title,
+			TaxCode:     item.TaxCode,
+			Quantity:    item.Quantity,
+			UnitPrice:   item.PriceInLowestUnit(),
+		}
+		if detail := item.CalculationDetail; detail != nil {
+			if detail.UnitPrice > 0 {
+				line.UnitPrice = detail.UnitPrice
+			}
+			line.Discount = detail.Discount * item.Quantity
+			if withTaxes {
+				line.SalesTax = detail.Taxes * item.Quantity
+			}
+		}
+		o.Items = append(o.Items, line)
+	}
+	return o
+}
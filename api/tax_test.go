@@ -0,0 +1,354 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+func TestTaxJar(t *testing.T) {
+	site := startTestSite()
+	defer site.Close()
+
+	setup := func(t *testing.T, fail bool) (*RouteTest, *httptest.Server, map[string][]map[string]interface{}) {
+		requests := map[string][]map[string]interface{}{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "Bearer taxjar-key", r.Header.Get("Authorization"))
+			body := map[string]interface{}{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			requests[r.URL.Path] = append(requests[r.URL.Path], body)
+			if fail {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			switch r.URL.Path {
+			case "/taxes":
+				id := body["line_items"].([]interface{})[0].(map[string]interface{})["id"]
+				w.Write([]byte(`{"tax": {"amount_to_collect": 0.89, "breakdown": {"line_items": [{"id": "` + id.(string) + `", "tax_collectable": 0.89}]}}}`))
+			case "/transactions/orders":
+				if len(requests[r.URL.Path]) == 1 && body["transaction_id"] == "retried" {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				fallthrough
+			default:
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte(`{}`))
+			}
+		}))
+
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		test.Config.Tax.Provider = taxJarProvider
+		test.Config.Tax.From.Country = "US"
+		test.Config.Tax.From.Zip = "92093"
+		test.Config.Tax.From.State = "CA"
+		test.Config.Tax.TaxJar.APIKey = "taxjar-key"
+		test.Config.Tax.TaxJar.URL = server.URL
+		return test, server, requests
+	}
+
+	t.Run("PaidAndRefunded", func(t *testing.T) {
+		test, server, requests := setup(t, false)
+		defer server.Close()
+		order := createTaxedOrder(t, test)
+		assert.Equal(t, taxJarProvider, order.TaxProvider)
+		assert.Equal(t, uint64(89), order.Taxes)
+		assert.Equal(t, uint64(1088), order.Total)
+		require.Len(t, requests["/taxes"], 1)
+		assert.Equal(t, "94107", requests["/taxes"][0]["to_zip"])
+		assert.Equal(t, "92093", requests["/taxes"][0]["from_zip"])
+
+		tr := payTaxedOrder(t, test, order)
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+		assert.Empty(t, requests["/transactions/orders"], "orders are recorded once the payment has been committed")
+		test.RunJobs()
+		require.Len(t, requests["/transactions/orders"], 1)
+		reported := requests["/transactions/orders"][0]
+		assert.Equal(t, order.ID, reported["transaction_id"])
+		assert.EqualValues(t, 9.99, reported["amount"])
+		assert.EqualValues(t, 0, reported["shipping"])
+		assert.EqualValues(t, 0.89, reported["sales_tax"])
+		items := reported["line_items"].([]interface{})
+		require.Len(t, items, 1)
+		assert.Equal(t, strconv.FormatInt(order.LineItems[0].ID, 10), items[0].(map[string]interface{})["id"])
+		assert.Equal(t, "product-1", items[0].(map[string]interface{})["product_identifier"])
+
+		recorder := runPaymentRefund(test, "/payments/"+tr.ID+"/refund", &PaymentParams{Amount: 544, Currency: "USD"})
+		extractPayload(t, http.StatusOK, recorder, &models.Transaction{})
+		test.RunJobs()
+		require.Len(t, requests["/transactions/refunds"], 1)
+		refund := requests["/transactions/refunds"][0]
+		assert.Equal(t, order.ID, refund["transaction_reference_id"])
+		assert.EqualValues(t, -4.99, refund["amount"])
+		assert.EqualValues(t, -0.45, refund["sales_tax"])
+	})
+	t.Run("Shipping", func(t *testing.T) {
+		test, server, requests := setup(t, false)
+		defer server.Close()
+		order := createTaxedOrder(t, test)
+		require.NoError(t, test.DB.Model(order).Updates(map[string]interface{}{"shipping": 500, "total": order.Total + 500}).Error)
+		tr := payTaxedOrder(t, test, order)
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+		test.RunJobs()
+		require.Len(t, requests["/transactions/orders"], 1)
+		assert.EqualValues(t, 5, requests["/transactions/orders"][0]["shipping"])
+		assert.EqualValues(t, 14.99, requests["/transactions/orders"][0]["amount"])
+
+		recorder := runPaymentRefund(test, "/payments/"+tr.ID+"/refund", &PaymentParams{Amount: order.Total, Currency: "USD"})
+		extractPayload(t, http.StatusOK, recorder, &models.Transaction{})
+		test.RunJobs()
+		require.Len(t, requests["/transactions/refunds"], 1)
+		assert.EqualValues(t, -5, requests["/transactions/refunds"][0]["shipping"])
+		assert.EqualValues(t, -14.99, requests["/transactions/refunds"][0]["amount"])
+	})
+	t.Run("RetriedRecording", func(t *testing.T) {
+		test, server, requests := setup(t, false)
+		defer server.Close()
+		order := createTaxedOrder(t, test)
+		require.NoError(t, test.DB.Exec("UPDATE "+test.DB.NewScope(models.Order{}).QuotedTableName()+" SET id = ? WHERE id = ?", "retried", order.ID).Error)
+		require.NoError(t, test.DB.Model(&models.LineItem{}).Where("order_id = ?", order.ID).UpdateColumn("order_id", "retried").Error)
+		order.ID = "retried"
+		payTaxedOrder(t, test, order)
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		test.RunJobs()
+		require.Len(t, requests["/transactions/orders"], 1)
+		job := &models.Job{}
+		require.NoError(t, test.DB.First(job, "type = ? AND reference = ?", taxOrderJob, order.ID).Error)
+		assert.False(t, job.Done)
+		require.NoError(t, test.DB.Model(job).Update("run_after", nil).Error)
+
+		test.RunJobs()
+		require.Len(t, requests["/transactions/orders"], 2)
+		require.NoError(t, test.DB.First(job, "id = ?", job.ID).Error)
+		assert.True(t, job.Done)
+		assert.False(t, job.Failed)
+	})
+	t.Run("FallbackOnFailure", func(t *testing.T) {
+		test, server, requests := setup(t, true)
+		defer server.Close()
+		order := createTaxedOrder(t, test)
+		assert.Len(t, requests["/taxes"], 1)
+		assert.Empty(t, order.TaxProvider)
+		assert.Equal(t, uint64(999), order.Total)
+	})
+	t.Run("OtherCountry", func(t *testing.T) {
+		test, server, requests := setup(t, false)
+		defer server.Close()
+		test.Config.Tax.Countries = []string{"Canada"}
+		order := createTaxedOrder(t, test)
+		assert.Empty(t, requests["/taxes"])
+		assert.Empty(t, order.TaxProvider)
+	})
+}
+
+func TestAvaTax(t *testing.T) {
+	site := startTestSite()
+	defer site.Close()
+
+	documents := map[string][]map[string]interface{}{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		account, license, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "account-id", account)
+		assert.Equal(t, "license-key", license)
+		switch r.URL.Path {
+		case "/transactions/create":
+			body := map[string]interface{}{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			documentType := body["type"].(string)
+			documents[documentType] = append(documents[documentType], body)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"totalTax": 0.75, "lines": [{"lineNumber": "1", "tax": 0.75}]}`))
+		case "/taxrates/byaddress":
+			assert.Equal(t, "94107", r.URL.Query().Get("postalCode"))
+			assert.Equal(t, "US", r.URL.Query().Get("country"))
+			w.Write([]byte(`{"totalRate": 0.08625}`))
+		default:
+			t.Fatalf("unknown AvaTax API call to %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	test := NewRouteTest(t)
+	test.Config.SiteURL = site.URL
+	test.Config.Tax.Provider = avaTaxProvider
+	test.Config.Tax.From.Zip = "92093"
+	test.Config.Tax.From.State = "CA"
+	test.Config.Tax.AvaTax.AccountID = "account-id"
+	test.Config.Tax.AvaTax.LicenseKey = "license-key"
+	test.Config.Tax.AvaTax.CompanyCode = "gocommerce"
+	test.Config.Tax.AvaTax.URL = server.URL
+
+	t.Run("PaidAndRefunded", func(t *testing.T) {
+		order := createTaxedOrder(t, test)
+		assert.Equal(t, avaTaxProvider, order.TaxProvider)
+		assert.Equal(t, uint64(75), order.Taxes)
+		assert.Equal(t, uint64(1074), order.Total)
+		require.Len(t, documents["SalesOrder"], 1)
+		assert.Equal(t, false, documents["SalesOrder"][0]["commit"])
+		assert.Equal(t, "info@example.com", documents["SalesOrder"][0]["customerCode"])
+
+		tr := payTaxedOrder(t, test, order)
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+		test.RunJobs()
+		require.Len(t, documents["SalesInvoice"], 1)
+		invoice := documents["SalesInvoice"][0]
+		assert.Equal(t, order.ID, invoice["code"])
+		assert.Equal(t, true, invoice["commit"])
+		assert.EqualValues(t, 0.75, invoice["taxOverride"].(map[string]interface{})["taxAmount"])
+
+		recorder := runPaymentRefund(test, "/payments/"+tr.ID+"/refund", &PaymentParams{Amount: 537, Currency: "USD"})
+		extractPayload(t, http.StatusOK, recorder, &models.Transaction{})
+		test.RunJobs()
+		require.Len(t, documents["ReturnInvoice"], 1)
+		refund := documents["ReturnInvoice"][0]
+		assert.Equal(t, order.ID, refund["referenceCode"])
+		assert.Equal(t, true, refund["commit"])
+		assert.EqualValues(t, -0.38, refund["taxOverride"].(map[string]interface{})["taxAmount"])
+		assert.EqualValues(t, -4.99, refund["lines"].([]interface{})[0].(map[string]interface{})["amount"])
+	})
+	t.Run("RateForAddress", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodGet, "/taxes/rate?country=USA&zip=94107&state=CA", nil, test.Data.testUserToken)
+		rate := struct {
+			Provider string  `json:"provider"`
+			Rate     float64 `json:"rate"`
+		}{}
+		extractPayload(t, http.StatusOK, recorder, &rate)
+		assert.Equal(t, avaTaxProvider, rate.Provider)
+		assert.InDelta(t, 8.625, rate.Rate, 0.0001)
+	})
+	t.Run("RateForUncoveredCountry", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodGet, "/taxes/rate?country=Germany", nil, test.Data.testUserToken)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+	t.Run("RateRequiresAuthentication", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodGet, "/taxes/rate?country=USA&zip=94107&state=CA", nil, nil)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
+func createTaxedOrder(t *testing.T, test *RouteTest) *models.Order {
+	recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+	order := &models.Order{}
+	extractPayload(t, http.StatusCreated, recorder, order)
+	return order
+}
+
+// payTaxedOrder pays an order in full with a mocked Stripe charge, which can
+// be refunded until the Stripe backend is reset.
+func payTaxedOrder(t *testing.T, test *RouteTest, order *models.Order) *models.Transaction {
+	stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+		switch path {
+		case "/v1/payment_intents":
+			intent := v.(*stripe.PaymentIntent)
+			intent.ID = stripePaymentIntentID
+			intent.Status = stripe.PaymentIntentStatusSucceeded
+			return nil
+		case "/v1/refunds":
+			v.(*stripe.Refund).ID = "refund-id"
+			return nil
+		default:
+			t.Fatalf("unknown Stripe API call to %s", path)
+			return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+		}
+	}))
+
+	body, err := json.Marshal(map[string]interface{}{
+		"amount":                   order.Total,
+		"currency":                 "USD",
+		"provider":                 payments.StripeProvider,
+		"stripe_payment_method_id": "payment-method-simple",
+	})
+	require.NoError(t, err)
+	recorder := test.TestEndpoint(http.MethodPost, "/orders/"+order.ID+"/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+	tr := &models.Transaction{}
+	extractPayload(t, http.StatusOK, recorder, tr)
+	return tr
+}
+
+func TestTaxExemption(t *testing.T) {
+	site := startTestSiteWithSettings(&calculator.Settings{
+		Taxes: []*calculator.Tax{{
+			Percentage:   7,
+			ProductTypes: []string{"Book"},
+			Countries:    []string{"USA"},
+		}},
+	})
+	defer site.Close()
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	t.Run("User", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		url := "/users/" + test.Data.testUser.ID + "/tax_exemption"
+
+		recorder := test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{}`), token)
+		validateError(t, http.StatusBadRequest, recorder, "certificate")
+
+		recorder = test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"certificate": "EX-123"}`), token)
+		user := &models.User{}
+		extractPayload(t, http.StatusOK, recorder, user)
+		assert.True(t, user.TaxExempt)
+		assert.Equal(t, "EX-123", user.TaxExemptionCertificate)
+
+		order := createTaxedOrder(t, test)
+		assert.True(t, order.TaxExempt)
+		assert.Equal(t, "EX-123", order.TaxExemptionCertificate)
+		assert.Equal(t, uint64(0), order.Taxes)
+		assert.Equal(t, uint64(999), order.Total)
+
+		ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+		require.NoError(t, err)
+		tx := test.DB.Begin()
+		require.NoError(t, orderQuery(tx).First(order, "id = ?", order.ID).Error)
+		tr := models.NewTransaction(order)
+		tr.Amount = order.Total
+		complete, err := completePayment(ctx, tx, logrus.StandardLogger(), tr, order)
+		require.NoError(t, err)
+		assert.True(t, complete)
+		require.NoError(t, tx.Commit().Error)
+		require.NotNil(t, order.Invoice)
+		assert.Equal(t, "Exempt from taxes, exemption certificate EX-123.", order.Invoice.Note)
+
+		recorder = test.TestEndpoint(http.MethodDelete, url, nil, token)
+		extractPayload(t, http.StatusOK, recorder, user)
+		assert.False(t, user.TaxExempt)
+		order = createTaxedOrder(t, test)
+		assert.False(t, order.TaxExempt)
+		assert.Equal(t, uint64(70), order.Taxes)
+	})
+	t.Run("Instance", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		test.Config.TaxExemption.Exempt = true
+		test.Config.TaxExemption.Certificate = "RESALE-1"
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), nil)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.True(t, order.TaxExempt)
+		assert.Equal(t, "RESALE-1", order.TaxExemptionCertificate)
+		assert.Equal(t, uint64(0), order.Taxes)
+	})
+	t.Run("RequiresAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPut, "/users/"+test.Data.testUser.ID+"/tax_exemption", strings.NewReader(`{"certificate": "EX-123"}`), test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+// The types of entries in the timeline of an order
+const (
+	timelineEvent       = "event"
+	timelineNote        = "note"
+	timelineTransaction = "transaction"
+	timelineEmail       = "email"
+	timelineDownload    = "download"
+)
+
+// TimelineEntry is an event, note or transaction in the timeline of an order.
+// Sent emails and download accesses are events with their own entry type.
+type TimelineEntry struct {
+	Type        string              `json:"type"`
+	CreatedAt   time.Time           `json:"created_at"`
+	Event       *models.Event       `json:"event,omitempty"`
+	Note        *models.OrderNote   `json:"note,omitempty"`
+	Transaction *models.Transaction `json:"transaction,omitempty"`
+}
+
+// OrderTimeline returns the events, notes and transactions of an order in
+// chronological order. It is only available to admins.
+func (a *API) OrderTimeline(w http.ResponseWriter, r *http.Request) error {
+	order, httpErr := a.loadOrder(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	db := a.DB(r)
+
+	events := []*models.Event{}
+	if rsp := db.Where("order_id = ?", order.ID).Find(&events); rsp.Error != nil {
+		return internalServerError("Error while querying for events").WithInternalError(rsp.Error)
+	}
+	notes := []*models.OrderNote{}
+	if rsp := db.Where("order_id = ?", order.ID).Find(&notes); rsp.Error != nil {
+		return internalServerError("Error while querying for notes").WithInternalError(rsp.Error)
+	}
+
+	timeline := make([]*TimelineEntry, 0, len(events)+len(notes)+len(order.Transactions))
+	for _, event := range events {
+		timeline = append(timeline, &TimelineEntry{Type: timelineEventType(event), CreatedAt: event.CreatedAt, Event: event})
+	}
+	for _, note := range notes {
+		timeline = append(timeline, &TimelineEntry{Type: timelineNote, CreatedAt: note.CreatedAt, Note: note})
+	}
+	for _, trans := range order.Transactions {
+		timeline = append(timeline, &TimelineEntry{Type: timelineTransaction, CreatedAt: trans.CreatedAt, Transaction: trans})
+	}
+	sort.SliceStable(timeline, func(i, j int) bool {
+		return timeline[i].CreatedAt.Before(timeline[j].CreatedAt)
+	})
+	return sendJSON(w, http.StatusOK, timeline)
+}
+
+func timelineEventType(event *models.Event) string {
+	switch {
+	case event.Type == string(models.EventEmailed):
+		return timelineEmail
+	case event.Changes == "download":
+		return timelineDownload
+	default:
+		return timelineEvent
+	}
+}
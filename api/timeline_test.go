@@ -0,0 +1,58 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestOrderTimeline(t *testing.T) {
+	test := NewRouteTest(t)
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	recorder := test.TestEndpoint(http.MethodGet, "/downloads/first-download", nil, test.Data.testUserToken)
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	recorder = test.TestEndpoint(http.MethodPost, "/orders/first-order/receipt", strings.NewReader(`{}`), test.Data.testUserToken)
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	recorder = test.TestEndpoint(http.MethodPost, "/orders/first-order/notes", strings.NewReader(`{"text": "called the customer"}`), token)
+	require.Equal(t, http.StatusCreated, recorder.Code, recorder.Body.String())
+
+	recorder = test.TestEndpoint(http.MethodGet, "/orders/first-order/timeline", nil, token)
+	timeline := []TimelineEntry{}
+	extractPayload(t, http.StatusOK, recorder, &timeline)
+
+	types := map[string]int{}
+	for i, entry := range timeline {
+		types[entry.Type]++
+		if i > 0 {
+			assert.False(t, entry.CreatedAt.Before(timeline[i-1].CreatedAt))
+		}
+		switch entry.Type {
+		case "transaction":
+			require.NotNil(t, entry.Transaction)
+			assert.Equal(t, test.Data.firstTransaction.ID, entry.Transaction.ID)
+		case "email":
+			require.NotNil(t, entry.Event)
+			assert.Equal(t, string(models.EventEmailed), entry.Event.Type)
+			assert.Equal(t, "order_confirmation", entry.Event.Changes)
+		case "note":
+			require.NotNil(t, entry.Note)
+			assert.Equal(t, "called the customer", entry.Note.Text)
+		}
+	}
+	assert.Equal(t, map[string]int{"transaction": 1, "download": 1, "email": 1, "note": 1}, types)
+
+	t.Run("NotAdmin", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/first-order/timeline", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+	t.Run("UnknownOrder", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/no-order/timeline", nil, token)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+}
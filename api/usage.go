@@ -0,0 +1,86 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// UsageRecordParams holds the parameters for reporting usage of a metered line item
+type UsageRecordParams struct {
+	Sku      string `json:"sku"`
+	Quantity uint64 `json:"quantity"`
+}
+
+// UsageRecordList will return the usage reported for a subscription
+func (a *API) UsageRecordList(w http.ResponseWriter, r *http.Request) error {
+	sub, httpErr := a.getInstanceSubscription(r)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	query := a.DB(r).Where("subscription_id = ?", sub.ID)
+	if r.URL.Query().Get("unbilled") == "true" {
+		query = query.Where("order_id = '' OR order_id IS NULL")
+	}
+	records := []models.UsageRecord{}
+	if rsp := query.Order("created_at desc").Find(&records); rsp.Error != nil {
+		return internalServerError("Error while querying for usage records").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, &records)
+}
+
+// UsageRecordCreate reports usage of a metered line item of a subscription.
+// The usage is billed with the next renewal order.
+func (a *API) UsageRecordCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	sub, httpErr := a.getInstanceSubscription(r)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	params := UsageRecordParams{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		return badRequestError("Could not read params: %v", err)
+	}
+	if params.Quantity == 0 {
+		return badRequestError("Reporting usage requires a 'quantity' greater than 0")
+	}
+	if !sub.Metered(params.Sku) {
+		return badRequestError("Line items with SKU '%s' aren't metered by the subscription", params.Sku)
+	}
+	if sub.Status == models.SubscriptionCanceledState || sub.Status == models.SubscriptionFailedState {
+		return badRequestError("Can't report usage for a subscription that is %s", sub.Status)
+	}
+
+	record := models.NewUsageRecord(sub, params.Sku, params.Quantity)
+	tx := a.DB(r).Begin()
+	if rsp := tx.Create(record); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("failed to save usage record").WithInternalError(rsp.Error)
+	}
+	models.LogEvent(tx, r.RemoteAddr, gcontext.GetClaims(ctx).Subject, sub.OrderID, models.EventUpdated, []string{"usage"})
+	if err := tx.Commit().Error; err != nil {
+		return internalServerError("failed to save usage record").WithInternalError(err)
+	}
+
+	log.WithField("subscription_id", sub.ID).WithField("usage_record_id", record.ID).Info("reported usage")
+	return sendJSON(w, http.StatusCreated, record)
+}
+
+func (a *API) getInstanceSubscription(r *http.Request) (*models.Subscription, *HTTPError) {
+	subID := chi.URLParam(r, "subscription_id")
+	sub, err := models.GetSubscriptionByID(a.DB(r), subID)
+	if err != nil {
+		return nil, internalServerError("problem while querying for subscription: %s", subID).WithInternalError(err)
+	}
+	if sub == nil || sub.InstanceID != gcontext.GetInstanceID(r.Context()) {
+		return nil, notFoundError("Subscription not found")
+	}
+	return sub, nil
+}
@@ -0,0 +1,146 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func createTestMeteredSubscription(t *testing.T, test *RouteTest, nextRenewal time.Time) *models.Subscription {
+	sub := models.NewSubscription(test.Data.firstOrder, "saved-card", "api-credits", models.MonthInterval, 1)
+	sub.MeteredSkus = []string{test.Data.firstLineItem.Sku}
+	sub.NextRenewalAt = nextRenewal
+	require.NoError(t, test.DB.Create(sub).Error)
+	return sub
+}
+
+func TestUsageRecordCreate(t *testing.T) {
+	test := NewRouteTest(t)
+	createTestPaymentMethod(t, test)
+	sub := createTestMeteredSubscription(t, test, time.Now().Add(time.Hour))
+	url := "/subscriptions/" + sub.ID + "/usage"
+	token := testAdminToken("magical-unicorn", "")
+
+	t.Run("Success", func(t *testing.T) {
+		body := strings.NewReader(`{"sku": "` + test.Data.firstLineItem.Sku + `", "quantity": 3}`)
+		recorder := test.TestEndpoint(http.MethodPost, url, body, token)
+		record := &models.UsageRecord{}
+		extractPayload(t, http.StatusCreated, recorder, record)
+		assert.Equal(t, sub.ID, record.SubscriptionID)
+		assert.EqualValues(t, 3, record.Quantity)
+		assert.Empty(t, record.OrderID)
+
+		recorder = test.TestEndpoint(http.MethodGet, url+"?unbilled=true", nil, token)
+		records := []models.UsageRecord{}
+		extractPayload(t, http.StatusOK, recorder, &records)
+		require.Len(t, records, 1)
+		assert.Equal(t, record.ID, records[0].ID)
+	})
+	t.Run("NotMetered", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{"sku": "234-fancy-belts", "quantity": 1}`), token)
+		validateError(t, http.StatusBadRequest, recorder, "aren't metered")
+	})
+	t.Run("NoQuantity", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{"sku": "`+test.Data.firstLineItem.Sku+`"}`), token)
+		validateError(t, http.StatusBadRequest, recorder, "quantity")
+	})
+	t.Run("NotAdmin", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{"sku": "`+test.Data.firstLineItem.Sku+`", "quantity": 1}`), test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+	t.Run("UnknownSubscription", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodGet, "/subscriptions/dne/usage", nil, token)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+}
+
+func TestRenewMeteredSubscription(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	renew := func(t *testing.T, test *RouteTest) {
+		test.Config.SiteURL = server.URL
+		ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+		require.NoError(t, err)
+		api := NewAPIWithVersion(ctx, test.GlobalConfig, logrus.StandardLogger(), test.DB, "")
+		api.renewDueSubscriptions(ctx, test.DB, logrus.StandardLogger())
+	}
+
+	t.Run("Usage", func(t *testing.T) {
+		test := NewRouteTest(t)
+		createTestPaymentMethod(t, test)
+		sub := createTestMeteredSubscription(t, test, time.Now().Add(-time.Minute))
+		sku := test.Data.firstLineItem.Sku
+		require.NoError(t, test.DB.Create(models.NewUsageRecord(sub, sku, 3)).Error)
+		require.NoError(t, test.DB.Create(models.NewUsageRecord(sub, sku, 2)).Error)
+
+		charged := int64(0)
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+			switch path {
+			case "/v1/payment_intents":
+				charged = *params.(*stripe.PaymentIntentParams).Amount
+				intent := v.(*stripe.PaymentIntent)
+				intent.ID = stripePaymentIntentID
+				intent.Status = stripe.PaymentIntentStatusSucceeded
+				return nil
+			default:
+				t.Fatalf("unknown Stripe API call to %s", path)
+				return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+			}
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		renew(t, test)
+
+		renewed, err := models.GetSubscription(test.DB, sub.UserID, sub.ID)
+		require.NoError(t, err)
+		require.NotEmpty(t, renewed.LastOrderID)
+		assert.Equal(t, []string{sku}, renewed.MeteredSkus)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.Preload("LineItems").First(order, "id = ?", renewed.LastOrderID).Error)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+		assert.EqualValues(t, 5*test.Data.firstLineItem.Price, order.Total)
+		assert.EqualValues(t, order.Total, charged)
+		require.Len(t, order.LineItems, 1)
+		assert.EqualValues(t, 5, order.LineItems[0].Quantity)
+
+		unbilled := 0
+		require.NoError(t, test.DB.Model(&models.UsageRecord{}).Where("subscription_id = ? AND order_id = ''", sub.ID).Count(&unbilled).Error)
+		assert.Zero(t, unbilled)
+		billed := 0
+		require.NoError(t, test.DB.Model(&models.UsageRecord{}).Where("order_id = ?", order.ID).Count(&billed).Error)
+		assert.Equal(t, 2, billed)
+	})
+	t.Run("NoUsage", func(t *testing.T) {
+		test := NewRouteTest(t)
+		createTestPaymentMethod(t, test)
+		sub := createTestMeteredSubscription(t, test, time.Now().Add(-time.Minute))
+
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+			t.Fatalf("unexpected Stripe API call to %s", path)
+			return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		renew(t, test)
+
+		renewed, err := models.GetSubscription(test.DB, sub.UserID, sub.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.SubscriptionActiveState, renewed.Status)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.Preload("LineItems").First(order, "id = ?", renewed.LastOrderID).Error)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+		assert.Zero(t, order.Total)
+		assert.Empty(t, order.LineItems)
+	})
+}
@@ -122,7 +122,8 @@ func (a *API) UserList(w http.ResponseWriter, r *http.Request) error {
 }
 
 // UserView will return the user specified.
-// If you're an admin you can request a user that is not your self
+// If you're an admin you can request a user that is not your self, which
+// includes the profile of their purchase history.
 func (a *API) UserView(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	userID := gcontext.GetUserID(ctx)
@@ -131,9 +132,20 @@ func (a *API) UserView(w http.ResponseWriter, r *http.Request) error {
 		return notFoundError("Couldn't find a record for " + userID)
 	}
 
-	orders := []models.Order{}
-	a.DB(r).Where("user_id = ?", user.ID).Find(&orders).Count(&user.OrderCount)
+	if !hasPermission(ctx, readUsersPermission) {
+		a.DB(r).Model(&models.Order{}).Where("user_id = ?", user.ID).Count(&user.OrderCount)
+		return sendJSON(w, http.StatusOK, user)
+	}
 
+	profile, err := models.LoadUserProfile(a.DB(r), user.ID)
+	if err != nil {
+		return internalServerError("Error computing the user profile").WithInternalError(err)
+	}
+	user.Profile = profile
+	user.OrderCount = profile.OrderCount
+	if profile.LastOrderAt != nil {
+		user.LastOrderAt = &models.HackyNullTime{Time: *profile.LastOrderAt, Valid: true}
+	}
 	return sendJSON(w, http.StatusOK, user)
 }
 
@@ -177,20 +189,82 @@ func (a *API) AddressView(w http.ResponseWriter, r *http.Request) error {
 	return sendJSON(w, http.StatusOK, &addr)
 }
 
+// DefaultAddressParams are the parameters for marking an address as the
+// default billing or shipping address of the user.
+type DefaultAddressParams struct {
+	Billing  *bool `json:"billing"`
+	Shipping *bool `json:"shipping"`
+}
+
+// AddressDefaultUpdate marks an address of the user as their default billing
+// or shipping address, or unmarks it.
+func (a *API) AddressDefaultUpdate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	addrID := chi.URLParam(r, "addr_id")
+	userID := gcontext.GetUserID(ctx)
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+
+	params := &DefaultAddressParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Failed to parse json body: %v", err)
+	}
+	if params.Billing == nil && params.Shipping == nil {
+		return badRequestError("Must mark the address as the default billing or shipping address")
+	}
+
+	tx := a.DB(r).Begin()
+	addr := &models.Address{}
+	rsp := tx.First(addr, "id = ? AND user_id = ?", addrID, userID)
+	if rsp.RecordNotFound() {
+		tx.Rollback()
+		return notFoundError("Address not found")
+	}
+	if rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("problem while querying for userID: %s", userID).WithInternalError(rsp.Error)
+	}
+	if err := addr.SetDefault(tx, params.Billing, params.Shipping); err != nil {
+		tx.Rollback()
+		return internalServerError("failed to save address").WithInternalError(err)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return internalServerError("failed to save address").WithInternalError(err)
+	}
+	return sendJSON(w, http.StatusOK, addr)
+}
+
+// userAnonymizeMode is the delete mode that erases the personal data of the
+// user instead of deleting their records.
+const userAnonymizeMode = "anonymize"
+
 // UserDelete will soft delete the user. It requires admin access
-// return errors or 200 and no body
+// return errors or 200 and no body. With mode=anonymize the user and their
+// orders are kept for the financial records, but their personal data is erased
+// and the erasure is logged as an event of the user and each of their orders.
 func (a *API) UserDelete(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	userID := gcontext.GetUserID(ctx)
 	log := getLogEntry(r)
 	log.Debugf("Starting to delete user %s", userID)
 
+	mode := r.URL.Query().Get("mode")
+	if mode != "" && mode != userAnonymizeMode {
+		return badRequestError("Unknown delete mode %v", mode)
+	}
+
 	user := gcontext.GetUser(ctx)
 	if user == nil {
 		log.Info("attempted to delete non-existent user")
 		return nil
 	}
 
+	if mode == userAnonymizeMode {
+		return a.anonymizeUser(r, user)
+	}
+
 	rsp := a.DB(r).Delete(user)
 	if rsp.Error != nil {
 		return internalServerError("error while deleting user").WithInternalError(rsp.Error)
@@ -200,6 +274,27 @@ func (a *API) UserDelete(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// anonymizeUser erases the personal data of the user and logs the erasure.
+func (a *API) anonymizeUser(r *http.Request, user *models.User) error {
+	claims := gcontext.GetClaims(r.Context())
+	tx := a.DB(r).Begin()
+	orders, err := models.AnonymizeUser(tx, user)
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("error while anonymizing user").WithInternalError(err)
+	}
+	models.LogEvent(tx, r.RemoteAddr, claims.Subject, "", models.EventAnonymized, []string{"users." + user.ID})
+	for _, order := range orders {
+		models.LogEvent(tx, r.RemoteAddr, claims.Subject, order.ID, models.EventAnonymized, []string{"users." + user.ID})
+	}
+	if err := tx.Commit().Error; err != nil {
+		return internalServerError("error while anonymizing user").WithInternalError(err)
+	}
+
+	getLogEntry(r).Infof("Anonymized user")
+	return nil
+}
+
 func (a *API) UserBulkDelete(w http.ResponseWriter, r *http.Request) error {
 	log := getLogEntry(r)
 	db := a.DB(r)
@@ -291,3 +386,119 @@ func (a *API) CreateNewAddress(w http.ResponseWriter, r *http.Request) error {
 
 	return sendJSON(w, http.StatusOK, &struct{ ID string }{ID: addr.ID})
 }
+
+// TaxExemptionParams are the parameters for exempting a user from taxes.
+type TaxExemptionParams struct {
+	Certificate string `json:"certificate"`
+}
+
+// UserTaxExemptionUpdate exempts the user from taxes with the reference of
+// an exemption certificate. It requires admin access
+func (a *API) UserTaxExemptionUpdate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	userID := gcontext.GetUserID(ctx)
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+
+	params := &TaxExemptionParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Failed to parse json body: %v", err)
+	}
+	if params.Certificate == "" {
+		return badRequestError("Tax exemptions require a certificate reference")
+	}
+
+	user.TaxExempt = true
+	user.TaxExemptionCertificate = params.Certificate
+	if rsp := a.DB(r).Save(user); rsp.Error != nil {
+		return internalServerError("failed to save user").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, user)
+}
+
+// UserTaxExemptionDelete revokes the tax exemption of the user. It requires
+// admin access
+func (a *API) UserTaxExemptionDelete(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	userID := gcontext.GetUserID(ctx)
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+
+	user.TaxExempt = false
+	user.TaxExemptionCertificate = ""
+	if rsp := a.DB(r).Save(user); rsp.Error != nil {
+		return internalServerError("failed to save user").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, user)
+}
+
+// CustomerGroupParams are the parameters for adding a user to a customer group.
+type CustomerGroupParams struct {
+	Group string `json:"group"`
+}
+
+// UserCustomerGroupUpdate adds the user to a customer group of the instance
+// settings, whose prices their new orders get. It requires admin access
+func (a *API) UserCustomerGroupUpdate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	userID := gcontext.GetUserID(ctx)
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+
+	params := &CustomerGroupParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Failed to parse json body: %v", err)
+	}
+	if params.Group == "" {
+		return badRequestError("Customer groups require a name")
+	}
+
+	user.CustomerGroup = params.Group
+	if rsp := a.DB(r).Save(user); rsp.Error != nil {
+		return internalServerError("failed to save user").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, user)
+}
+
+// UserCustomerGroupDelete removes the user from their customer group. It
+// requires admin access
+func (a *API) UserCustomerGroupDelete(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	userID := gcontext.GetUserID(ctx)
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+
+	user.CustomerGroup = ""
+	if rsp := a.DB(r).Save(user); rsp.Error != nil {
+		return internalServerError("failed to save user").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, user)
+}
+
+// customerGroup returns the customer group of the user of the claims: the
+// group an admin added them to, or else the customer_group of their
+// app_metadata.
+func customerGroup(db *gorm.DB, claims *claims.JWTClaims) (string, *HTTPError) {
+	if claims == nil || claims.Subject == "" {
+		return "", nil
+	}
+
+	user := &models.User{}
+	rsp := db.First(user, "id = ?", claims.Subject)
+	if rsp.Error != nil && !rsp.RecordNotFound() {
+		return "", internalServerError("Error loading user").WithInternalError(rsp.Error)
+	}
+	if user.CustomerGroup != "" {
+		return user.CustomerGroup, nil
+	}
+	group, _ := claims.AppMetaData["customer_group"].(string)
+	return group, nil
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// UserMergeParams are the parameters for merging a duplicate account into a
+// user: the ID of the duplicate user, the email of guest orders, or both.
+type UserMergeParams struct {
+	UserID string `json:"user_id"`
+	Email  string `json:"email"`
+	DryRun bool   `json:"dry_run"`
+}
+
+// UserMerge moves the orders, addresses, transactions, store credit,
+// subscriptions, payment methods and referrals of a duplicate account onto
+// the user and deletes the duplicate. With dry_run it only lists what would
+// move. It requires admin access
+func (a *API) UserMerge(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	userID := gcontext.GetUserID(ctx)
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+
+	params := &UserMergeParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Failed to parse json body: %v", err)
+	}
+	if params.UserID == "" && params.Email == "" {
+		return badRequestError("Merging requires the user_id or email of the duplicate account")
+	}
+	if params.UserID == user.ID {
+		return badRequestError("Can't merge a user into itself")
+	}
+
+	tx := a.DB(r).Begin()
+	if params.UserID != "" {
+		source := &models.User{}
+		rsp := tx.First(source, "id = ? AND instance_id = ?", params.UserID, user.InstanceID)
+		if rsp.RecordNotFound() {
+			tx.Rollback()
+			return notFoundError("Couldn't find a record for " + params.UserID)
+		}
+		if rsp.Error != nil {
+			tx.Rollback()
+			return internalServerError("Error loading user").WithInternalError(rsp.Error)
+		}
+	}
+
+	merge, err := models.MergeUser(tx, user, params.UserID, params.Email, params.DryRun)
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Error merging users").WithInternalError(err)
+	}
+	if params.DryRun {
+		tx.Rollback()
+		return sendJSON(w, http.StatusOK, merge)
+	}
+
+	claims := gcontext.GetClaims(ctx)
+	for _, orderID := range merge.Orders {
+		models.LogEvent(tx, r.RemoteAddr, claims.Subject, orderID, models.EventUpdated, []string{"user_id"})
+	}
+	if err := tx.Commit().Error; err != nil {
+		return internalServerError("Error merging users").WithInternalError(err)
+	}
+
+	log.WithFields(logrus.Fields{
+		"source_id":   params.UserID,
+		"email":       params.Email,
+		"order_count": len(merge.Orders),
+	}).Info("Merged duplicate account into user")
+	return sendJSON(w, http.StatusOK, merge)
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestUserMerge(t *testing.T) {
+	test := NewRouteTest(t)
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	url := "/users/" + test.Data.testUser.ID + "/merge"
+
+	duplicate := &models.User{ID: "bruce-wayne", Email: "bruce@wayneindustries.com"}
+	require.NoError(t, test.DB.Create(duplicate).Error)
+	addr := getTestAddress()
+	addr.UserID = duplicate.ID
+	require.NoError(t, test.DB.Create(addr).Error)
+	order := models.NewOrder("", "session3", duplicate.Email, "USD")
+	order.UserID = duplicate.ID
+	order.BillingAddressID = addr.ID
+	order.ShippingAddressID = addr.ID
+	require.NoError(t, test.DB.Create(order).Error)
+	credit := models.NewCreditTransaction("", duplicate.ID, "USD", 500)
+	require.NoError(t, test.DB.Create(credit).Error)
+	guest := models.NewOrder("", "session4", "Bruce@WayneIndustries.com", "USD")
+	require.NoError(t, test.DB.Create(guest).Error)
+	sub := &models.Subscription{ID: "batcave-monthly", UserID: duplicate.ID, OrderID: order.ID, PaymentMethodID: "batcard"}
+	require.NoError(t, test.DB.Create(sub).Error)
+	method := &models.PaymentMethod{ID: "batcard", UserID: duplicate.ID, Provider: "stripe", Type: "card"}
+	require.NoError(t, test.DB.Create(method).Error)
+	code := &models.ReferralCode{UserID: duplicate.ID, Code: "BATSIGNL"}
+	require.NoError(t, test.DB.Create(code).Error)
+	referral := &models.Referral{ID: "robin", Code: code.Code, ReferrerID: duplicate.ID, OrderID: "robins-order"}
+	require.NoError(t, test.DB.Create(referral).Error)
+
+	ordersOf := func(userID string) int {
+		var count int
+		require.NoError(t, test.DB.Model(&models.Order{}).Where("user_id = ?", userID).Count(&count).Error)
+		return count
+	}
+
+	recorder := test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{}`), token)
+	validateError(t, http.StatusBadRequest, recorder, "Merging requires the user_id or email of the duplicate account")
+	recorder = test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{"user_id": "bruce-wayne"}`), test.Data.testUserToken)
+	validateError(t, http.StatusUnauthorized, recorder)
+
+	body := `{"user_id": "bruce-wayne", "email": "bruce@wayneindustries.com", "dry_run": true}`
+	recorder = test.TestEndpoint(http.MethodPost, url, strings.NewReader(body), token)
+	merge := &models.UserMerge{}
+	extractPayload(t, http.StatusOK, recorder, merge)
+	assert.True(t, merge.DryRun)
+	assert.ElementsMatch(t, []string{order.ID, guest.ID}, merge.Orders)
+	assert.Equal(t, []string{addr.ID}, merge.Addresses)
+	assert.Equal(t, []string{credit.ID}, merge.Credits)
+	assert.Equal(t, []string{sub.ID}, merge.Subscriptions)
+	assert.Equal(t, []string{method.ID}, merge.PaymentMethods)
+	assert.Equal(t, []string{referral.ID}, merge.Referrals)
+	assert.Equal(t, code.Code, merge.ReferralCode)
+	assert.Equal(t, 1, ordersOf(duplicate.ID))
+	assert.Equal(t, 2, ordersOf(test.Data.testUser.ID))
+
+	body = `{"user_id": "bruce-wayne", "email": "bruce@wayneindustries.com"}`
+	recorder = test.TestEndpoint(http.MethodPost, url, strings.NewReader(body), token)
+	merge = &models.UserMerge{}
+	extractPayload(t, http.StatusOK, recorder, merge)
+	assert.False(t, merge.DryRun)
+	assert.Equal(t, 0, ordersOf(duplicate.ID))
+	assert.Equal(t, 4, ordersOf(test.Data.testUser.ID))
+
+	balance, err := models.CreditBalance(test.DB, test.Data.testUser.ID, "USD")
+	require.NoError(t, err)
+	assert.EqualValues(t, 500, balance)
+	require.NoError(t, test.DB.First(addr, "id = ?", addr.ID).Error)
+	assert.Equal(t, test.Data.testUser.ID, addr.UserID)
+	require.NoError(t, test.DB.First(sub, "id = ?", sub.ID).Error)
+	assert.Equal(t, test.Data.testUser.ID, sub.UserID)
+	require.NoError(t, test.DB.First(method, "id = ?", method.ID).Error)
+	assert.Equal(t, test.Data.testUser.ID, method.UserID)
+	require.NoError(t, test.DB.First(referral, "id = ?", referral.ID).Error)
+	assert.Equal(t, test.Data.testUser.ID, referral.ReferrerID)
+	require.NoError(t, test.DB.First(code, "code = ?", code.Code).Error)
+	assert.Equal(t, test.Data.testUser.ID, code.UserID)
+
+	// the duplicate account is deactivated
+	assert.True(t, test.DB.First(&models.User{}, "id = ?", duplicate.ID).RecordNotFound())
+	recorder = test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{"user_id": "bruce-wayne"}`), token)
+	validateError(t, http.StatusNotFound, recorder)
+}
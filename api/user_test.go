@@ -5,11 +5,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"testing"
 
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/claims"
 	"github.com/netlify/gocommerce/models"
 )
 
@@ -120,6 +124,7 @@ func TestUsersView(t *testing.T) {
 		user := new(models.User)
 		extractPayload(t, http.StatusOK, recorder, user)
 		validateUser(t, test.Data.testUser, user)
+		assert.Nil(t, user.Profile)
 	})
 	t.Run("AsStranger", func(t *testing.T) {
 		test := NewRouteTest(t)
@@ -132,11 +137,31 @@ func TestUsersView(t *testing.T) {
 		test := NewRouteTest(t)
 		url := "/users/" + test.Data.testUser.ID
 		token := testAdminToken("magical-unicorn", "")
+		refund := models.NewRefund(test.Data.firstTransaction, 100)
+		refund.Status = models.PaidState
+		require.NoError(t, test.DB.Create(refund).Error)
 		recorder := test.TestEndpoint(http.MethodGet, url, nil, token)
 
 		user := new(models.User)
 		extractPayload(t, http.StatusOK, recorder, user)
 		validateUser(t, test.Data.testUser, user)
+
+		profile := user.Profile
+		require.NotNil(t, profile)
+		assert.EqualValues(t, 2, profile.OrderCount)
+		assert.EqualValues(t, 2, profile.PaidOrders)
+		assert.NotNil(t, profile.FirstOrderAt)
+		assert.NotNil(t, profile.LastOrderAt)
+		assert.Equal(t, 0.5, profile.RefundRate)
+		require.Len(t, profile.LifetimeValue, 1)
+		total := test.Data.firstOrder.Total + test.Data.secondOrder.Total
+		assert.Equal(t, total, profile.LifetimeValue[0].Total)
+		assert.EqualValues(t, 100, profile.LifetimeValue[0].Refunded)
+		assert.EqualValues(t, total-100, profile.LifetimeValue[0].Net)
+		require.Len(t, profile.TopSkus, 3)
+		assert.Equal(t, "123-i-can-fly-456", profile.TopSkus[0].Sku)
+		assert.EqualValues(t, 2, profile.TopSkus[0].Quantity)
+		assert.Equal(t, "234-fancy-belts", profile.TopSkus[2].Sku)
 	})
 	t.Run("Deleted", func(t *testing.T) {
 		test := NewRouteTest(t)
@@ -286,6 +311,53 @@ func TestUserDelete(t *testing.T) {
 		assert.False(t, test.DB.Unscoped().First(&dyingLineItem).RecordNotFound())
 		assert.NotNil(t, dyingLineItem.DeletedAt, "line item wasn't deleted")
 	})
+	t.Run("Anonymize", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("magical-unicorn", "")
+		order := test.Data.firstOrder
+		require.NoError(t, test.DB.Model(order).UpdateColumns(map[string]interface{}{"total": 1100, "taxes": 100, "invoice_number": 7, "vat_number": "NL123456789B01", "tax_exemption_certificate": "EX-1"}).Error)
+		require.NoError(t, test.DB.Model(test.Data.testUser).UpdateColumn("tax_exemption_certificate", "EX-1").Error)
+		require.NoError(t, test.DB.Create(models.NewUserExport(test.Data.testUser)).Error)
+
+		recorder := test.TestEndpoint(http.MethodDelete, "/users/"+test.Data.testUser.ID+"?mode=anonymize", nil, token)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		user := &models.User{}
+		require.NoError(t, test.DB.Unscoped().First(user, "id = ?", test.Data.testUser.ID).Error)
+		assert.Empty(t, user.Email)
+		assert.Empty(t, user.Name)
+		assert.NotNil(t, user.AnonymizedAt)
+		assert.Nil(t, user.DeletedAt)
+		assert.Empty(t, user.TaxExemptionCertificate)
+		var exports int
+		require.NoError(t, test.DB.Model(&models.UserExport{}).Count(&exports).Error)
+		assert.Equal(t, 0, exports)
+
+		addr := &models.Address{}
+		require.NoError(t, test.DB.Unscoped().First(addr, "id = ?", test.Data.testAddress.ID).Error)
+		assert.Empty(t, addr.FirstName)
+		assert.Empty(t, addr.Address1)
+		assert.Equal(t, test.Data.testAddress.Country, addr.Country)
+
+		found := &models.Order{}
+		require.NoError(t, test.DB.Unscoped().First(found, "id = ?", order.ID).Error)
+		assert.Empty(t, found.Email)
+		assert.Empty(t, found.VATNumber)
+		assert.Empty(t, found.TaxExemptionCertificate)
+		assert.EqualValues(t, 1100, found.Total)
+		assert.EqualValues(t, 100, found.Taxes)
+		assert.EqualValues(t, 7, found.InvoiceNumber)
+
+		var events int
+		require.NoError(t, test.DB.Model(&models.Event{}).Where("order_id = ? AND type = ?", order.ID, models.EventAnonymized).Count(&events).Error)
+		assert.Equal(t, 1, events)
+	})
+	t.Run("UnknownMode", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodDelete, "/users/"+test.Data.testUser.ID+"?mode=shred", nil, token)
+		validateError(t, http.StatusBadRequest, recorder, "Unknown delete mode shred")
+	})
 }
 
 func TestUserBulkDelete(t *testing.T) {
@@ -427,3 +499,108 @@ func TestUserAddressCreate(t *testing.T) {
 		validateError(t, http.StatusBadRequest, recorder)
 	})
 }
+
+func TestUserDefaultAddresses(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	test := NewRouteTest(t)
+	test.Config.SiteURL = server.URL
+	token := test.Data.testUserToken
+
+	office := getTestAddress()
+	office.ID = "wayne-tower"
+	office.UserID = test.Data.testUser.ID
+	require.NoError(t, test.DB.Create(office).Error)
+	markDefault := func(id, body string) *models.Address {
+		url := "/users/" + test.Data.testUser.ID + "/addresses/" + id + "/default"
+		recorder := test.TestEndpoint(http.MethodPut, url, strings.NewReader(body), token)
+		addr := &models.Address{}
+		extractPayload(t, http.StatusOK, recorder, addr)
+		return addr
+	}
+
+	home := markDefault(test.Data.testAddress.ID, `{"billing": true, "shipping": true}`)
+	assert.True(t, home.DefaultBilling)
+	assert.True(t, home.DefaultShipping)
+	addr := markDefault(office.ID, `{"shipping": true}`)
+	assert.False(t, addr.DefaultBilling)
+	assert.True(t, addr.DefaultShipping)
+	require.NoError(t, test.DB.First(home, "id = ?", home.ID).Error)
+	assert.True(t, home.DefaultBilling)
+	assert.False(t, home.DefaultShipping, "the shipping default should move to the office")
+
+	body := `{"use_default_addresses": true, "line_items": [{"path": "/simple-product", "quantity": 1}]}`
+	recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(body), token)
+	order := &models.Order{}
+	extractPayload(t, http.StatusCreated, recorder, order)
+	assert.Equal(t, office.ID, order.ShippingAddressID)
+	assert.Equal(t, home.ID, order.BillingAddressID)
+
+	guest := `{"email": "info@example.com", "use_default_addresses": true, "line_items": [{"path": "/simple-product", "quantity": 1}]}`
+	recorder = test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(guest), nil)
+	validateError(t, http.StatusBadRequest, recorder, "Default addresses can only be used by signed in users")
+
+	url := "/users/" + test.Data.testUser.ID + "/addresses/" + office.ID + "/default"
+	recorder = test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"shipping": true}`), testToken("magical-unicorn", ""))
+	validateError(t, http.StatusUnauthorized, recorder)
+}
+
+func TestUserCustomerGroup(t *testing.T) {
+	site := startTestSiteWithSettings(&calculator.Settings{
+		CustomerGroups: []*calculator.CustomerGroup{
+			{Name: "wholesale", Prices: []*calculator.GroupPrice{{Sku: "product-1", Amount: "7.00", Currency: "USD"}}},
+			{Name: "staff", Percentage: 20},
+		},
+	})
+	defer site.Close()
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	createOrder := func(test *RouteTest, token *jwt.Token) *models.Order {
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), token)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		return order
+	}
+
+	t.Run("Admin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		url := "/users/" + test.Data.testUser.ID + "/customer_group"
+
+		recorder := test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{}`), token)
+		validateError(t, http.StatusBadRequest, recorder, "Customer groups require a name")
+
+		recorder = test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"group": "wholesale"}`), token)
+		user := &models.User{}
+		extractPayload(t, http.StatusOK, recorder, user)
+		assert.Equal(t, "wholesale", user.CustomerGroup)
+
+		order := createOrder(test, test.Data.testUserToken)
+		assert.Equal(t, "wholesale", order.CustomerGroup)
+		assert.Equal(t, uint64(700), order.Total)
+
+		recorder = test.TestEndpoint(http.MethodDelete, url, nil, token)
+		user = &models.User{}
+		extractPayload(t, http.StatusOK, recorder, user)
+		assert.Empty(t, user.CustomerGroup)
+		assert.Equal(t, uint64(999), createOrder(test, test.Data.testUserToken).Total)
+	})
+	t.Run("Claim", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		staff := jwt.NewWithClaims(jwt.SigningMethodHS256, &claims.JWTClaims{
+			StandardClaims: jwt.StandardClaims{Subject: test.Data.testUser.ID},
+			Email:          test.Data.testUser.Email,
+			AppMetaData:    map[string]interface{}{"customer_group": "staff"},
+		})
+
+		order := createOrder(test, staff)
+		assert.Equal(t, "staff", order.CustomerGroup)
+		assert.Equal(t, uint64(200), order.Discount)
+		assert.Equal(t, uint64(799), order.Total)
+	})
+	t.Run("RequiresAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPut, "/users/"+test.Data.testUser.ID+"/customer_group", strings.NewReader(`{"group": "staff"}`), test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
@@ -53,7 +53,11 @@ func db(t *testing.T) (*gorm.DB, *conf.GlobalConfiguration, *conf.Configuration,
 
 	globalConfig, config := testConfig()
 	globalConfig.DB.Driver = "sqlite3"
-	globalConfig.DB.URL = f.Name()
+	// payment mails are logged from goroutines, which wait for the lock of
+	// the transactions of the test instead of failing them. Transactions take
+	// the write lock when they begin, as sqlite fails a transaction that
+	// writes after reading while another connection writes right away.
+	globalConfig.DB.URL = f.Name() + "?_busy_timeout=5000&_txlock=immediate"
 
 	db, err := models.Connect(globalConfig, logrus.StandardLogger())
 	if err != nil {
@@ -377,8 +381,15 @@ func NewRouteTest(t *testing.T) *RouteTest {
 }
 
 func (r *RouteTest) TestEndpoint(method string, url string, body io.Reader, token *jwt.Token) *httptest.ResponseRecorder {
+	return r.TestEndpointWithHeaders(method, url, body, token, nil)
+}
+
+func (r *RouteTest) TestEndpointWithHeaders(method string, url string, body io.Reader, token *jwt.Token, headers map[string]string) *httptest.ResponseRecorder {
 	recorder := httptest.NewRecorder()
 	req := httptest.NewRequest(method, baseURL+url, body)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
 
 	if token != nil {
 		require.NoError(r.T, signHTTPRequest(req, token, r.Config.JWT.Secret))
@@ -391,6 +402,13 @@ func (r *RouteTest) TestEndpoint(method string, url string, body io.Reader, toke
 	return recorder
 }
 
+// RunJobs runs the queued jobs that are due once.
+func (r *RouteTest) RunJobs() {
+	ctx, err := WithInstanceConfig(context.Background(), r.GlobalConfig.SMTP, r.Config, "")
+	require.NoError(r.T, err)
+	NewAPIWithVersion(ctx, r.GlobalConfig, logrus.StandardLogger(), r.DB, "").runJobs(ctx, r.DB, logrus.StandardLogger(), "test")
+}
+
 func signHTTPRequest(req *http.Request, token *jwt.Token, jwtSecret string) error {
 	tokenStr, err := token.SignedString([]byte(jwtSecret))
 	if err != nil {
@@ -438,6 +456,19 @@ func handleTestProducts(w http.ResponseWriter, r *http.Request) {
 			{"sku": "product-1", "title": "Product 1", "type": "Book", "prices": [
 				{"amount": "9.99", "currency": "USD"}
 			]}`))
+	case "/heavy-product":
+		fmt.Fprintln(w, productMetaFrame(`
+			{"sku": "product-heavy", "title": "Heavy Product", "type": "Book", "weight": 1500, "prices": [
+				{"amount": "20.00", "currency": "USD"}
+			]}`))
+	case "/tiered-product":
+		fmt.Fprintln(w, productMetaFrame(`
+			{"sku": "product-tiered", "title": "Tiered Product", "type": "Book", "prices": [
+				{"amount": "10.00", "currency": "USD", "tiers": [
+					{"min_quantity": 10, "amount": "9.00"},
+					{"min_quantity": 50, "amount": "7.50"}
+				]}
+			]}`))
 	case "/bundle-product":
 		fmt.Fprintln(w, productMetaFrame(`
 			{"sku": "product-1", "title": "Product 1", "type": "Book", "prices": [
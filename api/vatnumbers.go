@@ -2,16 +2,23 @@ package api
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/mattes/vat"
+
+	"github.com/netlify/gocommerce/models"
 )
 
+// checkVAT validates VAT numbers with the VIES service of the EU. It's
+// replaced in tests.
+var checkVAT = vat.CheckVAT
+
 // VatNumberLookup looks up information on a VAT number
 func (a *API) VatNumberLookup(w http.ResponseWriter, r *http.Request) error {
 	number := chi.URLParam(r, "vat_number")
 
-	response, err := vat.CheckVAT(number)
+	response, err := checkVAT(number)
 	if err != nil {
 		return internalServerError("Failed to lookup VAT Number").WithInternalError(err)
 	}
@@ -23,3 +30,25 @@ func (a *API) VatNumberLookup(w http.ResponseWriter, r *http.Request) error {
 		"address": response.Address,
 	})
 }
+
+// validateVATNumber validates the VAT number of an order with VIES and stores
+// the result on the order, so it can be reverse charged when it's priced.
+func validateVATNumber(order *models.Order, number string) *HTTPError {
+	response, err := checkVAT(number)
+	if err == vat.ErrVATnumberNotValid {
+		return badRequestError("Vat number %v is not valid", number)
+	} else if err != nil {
+		return internalServerError("Error verifying VAT number").WithInternalError(err)
+	}
+	if !response.Valid {
+		return badRequestError("Vat number %v is not valid", number)
+	}
+
+	validatedAt := time.Now()
+	order.VATNumber = number
+	order.VATCountry = response.CountryCode
+	order.VATCompany = response.Name
+	order.VATAddress = response.Address
+	order.VATValidatedAt = &validatedAt
+	return nil
+}
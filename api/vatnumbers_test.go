@@ -0,0 +1,111 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mattes/vat"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestReverseCharge(t *testing.T) {
+	checkVAT = func(number string) (*vat.VATresponse, error) {
+		return &vat.VATresponse{
+			CountryCode: number[:2],
+			VATnumber:   number[2:],
+			Valid:       !strings.HasSuffix(number, "000"),
+			Name:        "Example B.V.",
+			Address:     "Damrak 1, Amsterdam",
+		}, nil
+	}
+	defer func() { checkVAT = vat.CheckVAT }()
+
+	site := startTestSiteWithSettings(&calculator.Settings{
+		VATCountry: "DE",
+		Taxes: []*calculator.Tax{{
+			Percentage:   7,
+			ProductTypes: []string{"Book"},
+			Countries:    []string{"Netherlands", "Germany"},
+		}},
+	})
+	defer site.Close()
+
+	createOrder := func(t *testing.T, test *RouteTest, country, vatNumber string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{
+			"email": "info@example.com",
+			"vatnumber": "%s",
+			"shipping_address": {
+				"name": "Test User", "address1": "Damrak 1", "city": "Amsterdam", "country": "%s", "zip": "1012"
+			},
+			"line_items": [{"path": "/simple-product", "quantity": 1, "meta": {}}]
+		}`, vatNumber, country)
+		return test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(body), test.Data.testUserToken)
+	}
+
+	t.Run("CrossBorder", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, createOrder(t, test, "Netherlands", "NL123456789B01"), order)
+		assert.True(t, order.ReverseCharge)
+		assert.Equal(t, "NL", order.VATCountry)
+		assert.Equal(t, "Example B.V.", order.VATCompany)
+		assert.NotNil(t, order.VATValidatedAt)
+		assert.Equal(t, uint64(0), order.Taxes)
+		assert.Equal(t, uint64(999), order.Total)
+
+		ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+		require.NoError(t, err)
+		tx := test.DB.Begin()
+		require.NoError(t, orderQuery(tx).First(order, "id = ?", order.ID).Error)
+		tr := models.NewTransaction(order)
+		tr.Amount = order.Total
+		complete, err := completePayment(ctx, tx, logrus.StandardLogger(), tr, order)
+		require.NoError(t, err)
+		assert.True(t, complete)
+		require.NoError(t, tx.Commit().Error)
+		require.NotNil(t, order.Invoice)
+		assert.Equal(t, models.ReverseChargeNote, order.Invoice.Note)
+	})
+	t.Run("SameCountry", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, createOrder(t, test, "Germany", "DE123456789"), order)
+		assert.False(t, order.ReverseCharge)
+		assert.Equal(t, uint64(70), order.Taxes)
+	})
+	t.Run("UpdatedNumber", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, createOrder(t, test, "Netherlands", ""), order)
+		assert.False(t, order.ReverseCharge)
+		assert.Equal(t, uint64(70), order.Taxes)
+
+		recorder := runOrderUpdate(test, order, &orderRequestParams{VATNumber: "NL123456789B01"}, testAdminToken("admin-yo", "admin@wayneindustries.com"))
+		updated := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, updated)
+		assert.True(t, updated.ReverseCharge)
+		assert.Equal(t, uint64(0), updated.Taxes)
+		assert.Equal(t, uint64(999), updated.Total)
+
+		saved := &models.Order{}
+		require.NoError(t, test.DB.First(saved, "id = ?", order.ID).Error)
+		assert.Equal(t, uint64(999), saved.Total)
+	})
+	t.Run("InvalidNumber", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = site.URL
+		validateError(t, http.StatusBadRequest, createOrder(t, test, "Netherlands", "NL123456000"), "not valid")
+	})
+}
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/netlify/gocommerce/assetstores"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+const watermarkTimeout = time.Minute
+
+// watermarkJob requests the stamped copies of the downloads of a paid order.
+const watermarkJob = "watermark"
+
+type watermarkPayload struct {
+	OrderID string `json:"order_id"`
+}
+
+// watermarkRequest is sent to the watermarking service of the instance to
+// stamp a copy of a download for its purchaser.
+type watermarkRequest struct {
+	DownloadID  string `json:"download_id"`
+	OrderID     string `json:"order_id"`
+	OrderNumber string `json:"order_number"`
+	Email       string `json:"email"`
+	Text        string `json:"text"`
+	URL         string `json:"url"`
+}
+
+type watermarkResponse struct {
+	URL string `json:"url"`
+}
+
+// queueWatermarks queues the job requesting the stamped copies of the
+// downloads of the order, if it has any that haven't been stamped yet.
+func queueWatermarks(tx *gorm.DB, order *models.Order) error {
+	var pending int
+	rsp := tx.Model(&models.Download{}).
+		Where("order_id = ? AND watermark = ? AND watermarked_url = ? AND revoked = ?", order.ID, true, "", false).
+		Count(&pending)
+	if rsp.Error != nil {
+		return rsp.Error
+	}
+	if pending == 0 {
+		return nil
+	}
+	return models.EnqueueJob(tx, order.InstanceID, watermarkJob, order.ID, &watermarkPayload{OrderID: order.ID})
+}
+
+// runWatermarkJob requests the stamped copies of the downloads of the order
+// of the job that haven't been stamped yet.
+func runWatermarkJob(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, job *models.Job) error {
+	payload := &watermarkPayload{}
+	if err := json.Unmarshal([]byte(job.Payload), payload); err != nil {
+		return errors.Wrap(err, "Error parsing job payload")
+	}
+	order := &models.Order{}
+	if rsp := db.First(order, "id = ?", payload.OrderID); rsp.Error != nil {
+		return rsp.Error
+	}
+	downloads := []*models.Download{}
+	rsp := db.Where("order_id = ? AND watermark = ? AND watermarked_url = ? AND revoked = ?", order.ID, true, "", false).Find(&downloads)
+	if rsp.Error != nil {
+		return rsp.Error
+	}
+
+	assets := gcontext.GetAssetStore(ctx)
+	var failed error
+	for _, download := range downloads {
+		if err := watermarkDownload(ctx, db, assets, order, download); err != nil {
+			log.WithError(err).WithField("download_id", download.ID).Warn("Failed to watermark download")
+			failed = err
+		}
+	}
+	return failed
+}
+
+// watermarkDownload requests the copy of the asset of the download stamped
+// with the email and number of the order from the watermarking service and
+// keeps it for the downloads. The copy must be in the asset store, it's
+// signed like the asset itself when it's downloaded.
+func watermarkDownload(ctx context.Context, db *gorm.DB, assets assetstores.Store, order *models.Order, download *models.Download) error {
+	config := gcontext.GetConfig(ctx)
+	if config.Downloads.WatermarkURL == "" {
+		return errors.New("No watermarking service configured for downloads that must be watermarked")
+	}
+
+	source := *download
+	if err := source.SignURL(assets); err != nil {
+		return errors.Wrap(err, "Error signing the asset to watermark")
+	}
+	body, err := json.Marshal(&watermarkRequest{
+		DownloadID:  download.ID,
+		OrderID:     order.ID,
+		OrderNumber: order.Number,
+		Email:       order.Email,
+		Text:        fmt.Sprintf("Licensed to %s, order %s", order.Email, orderReference(order)),
+		URL:         source.URL,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", config.Downloads.WatermarkURL, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if config.Webhooks.Secret != "" {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"sub": order.UserID,
+			"exp": time.Now().Add(5 * time.Minute).Unix(),
+		})
+		signature, err := token.SignedString([]byte(config.Webhooks.Secret))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-Commerce-Signature", signature)
+	}
+
+	client := &http.Client{Timeout: watermarkTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "Error requesting watermarked copy")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Error requesting watermarked copy: %s", resp.Status)
+	}
+
+	watermarked := &watermarkResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(watermarked); err != nil {
+		return errors.Wrap(err, "Error reading watermarked copy")
+	}
+	if watermarked.URL == "" {
+		return errors.New("The watermarking service didn't return a URL")
+	}
+
+	// the copy is signed for every download, so a signature of the service
+	// is dropped and the asset store must be able to sign the copy
+	copyURL, err := url.Parse(watermarked.URL)
+	if err != nil {
+		return errors.Wrap(err, "Error parsing the URL of the watermarked copy")
+	}
+	copyURL.RawQuery = ""
+	stamped := models.Download{URL: copyURL.String()}
+	if err := stamped.SignURL(assets); err != nil {
+		return errors.Wrap(err, "Error signing the watermarked copy")
+	}
+
+	if rsp := db.Model(download).Update("watermarked_url", copyURL.String()); rsp.Error != nil {
+		return rsp.Error
+	}
+	download.WatermarkedURL = copyURL.String()
+	return nil
+}
+
+// orderReference returns the human readable number of the order, or its ID
+// for orders placed before orders were numbered.
+func orderReference(order *models.Order) string {
+	if order.Number != "" {
+		return order.Number
+	}
+	return order.ID
+}
@@ -0,0 +1,880 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+	"github.com/sirupsen/logrus"
+	stripe "github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/webhook"
+)
+
+const (
+	maxWebhookBodySize = 65536
+
+	stripeSignatureHeader = "Stripe-Signature"
+)
+
+// paypalWebhookEvent holds the fields of PayPal webhook notifications the webhook
+// receiver uses to match an event to a transaction.
+type paypalWebhookEvent struct {
+	ID        string `json:"id"`
+	EventType string `json:"event_type"`
+	Resource  struct {
+		ID            string `json:"id"`
+		State         string `json:"state"`
+		SaleID        string `json:"sale_id"`
+		ParentPayment string `json:"parent_payment"`
+		Amount        *struct {
+			Total    string `json:"total"`
+			Currency string `json:"currency"`
+		} `json:"amount"`
+		TransactionFee *struct {
+			Value    string `json:"value"`
+			Currency string `json:"currency"`
+		} `json:"transaction_fee"`
+		DisputeID     string `json:"dispute_id"`
+		Reason        string `json:"reason"`
+		Status        string `json:"status"`
+		DisputeAmount *struct {
+			Value        string `json:"value"`
+			CurrencyCode string `json:"currency_code"`
+		} `json:"dispute_amount"`
+		SellerResponseDueDate *time.Time `json:"seller_response_due_date"`
+		DisputedTransactions  []struct {
+			SellerTransactionID string `json:"seller_transaction_id"`
+		} `json:"disputed_transactions"`
+		DisputeOutcome *struct {
+			OutcomeCode string `json:"outcome_code"`
+		} `json:"dispute_outcome"`
+	} `json:"resource"`
+}
+
+// stripeEventObject holds the fields of the Stripe objects the webhook receiver
+// uses to match an event to a transaction.
+type stripeEventObject struct {
+	ID             string             `json:"id"`
+	Charge         string             `json:"charge"`
+	PaymentIntent  string             `json:"payment_intent"`
+	AmountRefunded int64              `json:"amount_refunded"`
+	Status         string             `json:"status"`
+	Refunds        *stripe.RefundList `json:"refunds"`
+	LastError      *stripe.Error      `json:"last_payment_error"`
+
+	// dispute fields
+	Amount          int64  `json:"amount"`
+	Currency        string `json:"currency"`
+	Reason          string `json:"reason"`
+	EvidenceDetails *struct {
+		DueBy int64 `json:"due_by"`
+	} `json:"evidence_details"`
+	BalanceTransactions []struct {
+		Fee int64 `json:"fee"`
+	} `json:"balance_transactions"`
+}
+
+// StripeWebhook receives asynchronous payment events from Stripe. The signature
+// of each event is verified before it is applied to the matching transaction and order.
+func (a *API) StripeWebhook(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	config := gcontext.GetConfig(ctx)
+
+	if !config.Payment.Stripe.Enabled || config.Payment.Stripe.WebhookSecret == "" {
+		return notFoundError("Stripe webhooks are not configured")
+	}
+
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodySize))
+	if err != nil {
+		return badRequestError("Error reading webhook body: %v", err)
+	}
+
+	event, err := webhook.ConstructEvent(payload, r.Header.Get(stripeSignatureHeader), config.Payment.Stripe.WebhookSecret)
+	if err != nil {
+		return badRequestError("Invalid Stripe webhook: %v", err)
+	}
+	log = log.WithField("stripe_event", event.ID).WithField("stripe_event_type", event.Type)
+
+	obj := stripeEventObject{}
+	if event.Data != nil {
+		if err := json.Unmarshal(event.Data.Raw, &obj); err != nil {
+			return badRequestError("Error reading Stripe event object: %v", err)
+		}
+	}
+
+	var processorIDs []string
+	switch event.Type {
+	case "payment_intent.processing", "payment_intent.succeeded", "payment_intent.payment_failed", "payment_intent.canceled":
+		processorIDs = []string{obj.ID}
+	case "charge.succeeded", "charge.refunded":
+		processorIDs = []string{obj.ID, obj.PaymentIntent}
+	case "charge.dispute.created", "charge.dispute.updated", "charge.dispute.closed":
+		processorIDs = []string{obj.Charge, obj.PaymentIntent}
+	default:
+		log.Debug("Ignoring Stripe event")
+		return sendJSON(w, http.StatusOK, map[string]string{})
+	}
+
+	tx := a.DB(r).Begin()
+	trans, order, err := findWebhookTransaction(tx, gcontext.GetInstanceID(ctx), processorIDs)
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Error while querying for transactions").WithInternalError(err)
+	}
+	if trans == nil {
+		tx.Rollback()
+		log.Info("No transaction found for Stripe event")
+		return sendJSON(w, http.StatusOK, map[string]string{})
+	}
+	log = log.WithField("transaction_id", trans.ID).WithField("order_id", order.ID)
+	if event.Livemode == trans.Test {
+		tx.Rollback()
+		log.Info("Ignoring Stripe event of a different mode than the transaction")
+		return sendJSON(w, http.StatusOK, map[string]string{})
+	}
+
+	previousState := order.PaymentState
+	confirmed := false
+	var retry *models.PaymentRetry
+	switch event.Type {
+	case "payment_intent.processing":
+		// e.g. a SEPA Direct Debit confirmed by the client settles later on
+		if trans.Status == models.PendingState {
+			paymentProcessing(tx, trans, order)
+		}
+	case "payment_intent.succeeded":
+		claimed, err := claimPayment(tx, trans)
+		if err != nil {
+			tx.Rollback()
+			return internalServerError("Error claiming the payment").WithInternalError(err)
+		}
+		if claimed {
+			if trans.InvoiceNumber == 0 {
+				invoiceNumber, err := models.NextInvoiceNumber(tx, order.InstanceID)
+				if err != nil {
+					tx.Rollback()
+					return internalServerError("We failed to generate a valid invoice ID, please try again later: %v", err)
+				}
+				trans.InvoiceNumber = invoiceNumber
+			}
+			if confirmed, err = paymentComplete(r, tx, trans, order); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	case "payment_intent.payment_failed", "payment_intent.canceled":
+		if trans.Status != models.PaidState && trans.Status != models.FailedState {
+			trans.Status = models.FailedState
+			trans.FailureCode = strconv.FormatInt(http.StatusPaymentRequired, 10)
+			trans.FailureDescription = "Payment failed at Stripe"
+			if obj.LastError != nil && obj.LastError.Msg != "" {
+				trans.FailureDescription = obj.LastError.Msg
+			}
+			tx.Save(trans)
+			retry = paymentFailed(ctx, tx, log, order, trans.FailureDescription)
+		}
+	case "charge.succeeded":
+		if err := lookupFee(ctx, log, trans, order); err != nil {
+			log.WithError(err).Warn("Failed to look up the Stripe fee")
+		} else {
+			tx.Model(trans).Update("fee", trans.Fee)
+		}
+	case "charge.refunded":
+		if uint64(obj.AmountRefunded) > trans.RefundedAmount {
+			var refundID string
+			if obj.Refunds != nil && len(obj.Refunds.Data) > 0 {
+				refundID = obj.Refunds.Data[0].ID
+			}
+			if err := recordRefund(r, tx, log, trans, uint64(obj.AmountRefunded)-trans.RefundedAmount, refundID); err != nil {
+				tx.Rollback()
+				return internalServerError("Error recording Stripe refund").WithInternalError(err)
+			}
+		}
+		// refundComplete updates the order state in the database only
+		tx.First(order, "id = ?", order.ID)
+	case "charge.dispute.created", "charge.dispute.updated", "charge.dispute.closed":
+		dispute, err := recordDispute(tx, log, trans, payments.StripeProvider, obj.ID, func(d *models.Dispute) {
+			if obj.Amount > 0 {
+				d.Amount = uint64(obj.Amount)
+				d.Currency = strings.ToUpper(obj.Currency)
+			}
+			if obj.Reason != "" {
+				d.Reason = obj.Reason
+			}
+			d.ProviderStatus = obj.Status
+			d.Status = stripeDisputeStatus(obj.Status)
+			if obj.EvidenceDetails != nil && obj.EvidenceDetails.DueBy > 0 {
+				dueBy := time.Unix(obj.EvidenceDetails.DueBy, 0)
+				d.EvidenceDueBy = &dueBy
+			}
+			var fee uint64
+			for _, bt := range obj.BalanceTransactions {
+				fee += uint64(bt.Fee)
+			}
+			if fee > 0 {
+				d.Fee = fee
+			}
+		})
+		if err != nil {
+			tx.Rollback()
+			return internalServerError("Error recording Stripe dispute").WithInternalError(err)
+		}
+
+		applyDispute(tx, r.RemoteAddr, order, dispute)
+	}
+
+	if order.PaymentState != previousState {
+		log.Infof("Changed payment state from %s to %s", previousState, order.PaymentState)
+		models.LogEvent(tx, r.RemoteAddr, "", order.ID, models.EventUpdated, []string{"payment_state"})
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return internalServerError("Error saving webhook changes").WithInternalError(err)
+	}
+	if confirmed {
+		go sendOrderConfirmation(ctx, a.DB(r), log, trans)
+	}
+	if retry != nil {
+		go sendPaymentRetryMail(ctx, a.DB(r), log, order, retry)
+	}
+	return sendJSON(w, http.StatusOK, map[string]string{})
+}
+
+// recordRefund records a refund that has been issued outside of gocommerce,
+// e.g. from the dashboard of the payment provider.
+func recordRefund(r *http.Request, tx *gorm.DB, log logrus.FieldLogger, trans *models.Transaction, amount uint64, processorID string) error {
+	if amount > trans.RefundableAmount() {
+		amount = trans.RefundableAmount()
+	}
+	if amount == 0 {
+		return nil
+	}
+
+	reserved, err := reserveRefund(tx, trans, amount)
+	if err != nil {
+		return err
+	}
+	if !reserved {
+		// a concurrent request booked the refund already
+		return nil
+	}
+
+	refund := models.NewRefund(trans, amount)
+	refund.Status = models.PaidState
+	refund.ProcessorID = processorID
+	if rsp := tx.Create(refund); rsp.Error != nil {
+		return rsp.Error
+	}
+	log.Infof("Recorded refund of %d", refund.Amount)
+
+	models.LogEvent(tx, r.RemoteAddr, "", trans.OrderID, models.EventRefunded, []string{refund.ID, refund.Status})
+	refundComplete(tx, trans, refund)
+	issueCreditNote(tx, log, refund)
+	reverseReferralReward(tx, log, refund.OrderID)
+
+	reportTaxRefund(tx, log, refund)
+	config := gcontext.GetConfig(r.Context())
+	if config.Webhooks.Refund != "" {
+		hook, err := models.NewHook("refund", config.SiteURL, config.Webhooks.Refund, refund.UserID, config.Webhooks.Secret, refund)
+		if err != nil {
+			log.WithError(err).Error("Failed to process webhook")
+		} else {
+			tx.Save(hook)
+		}
+	}
+	return nil
+}
+
+// recordDispute creates or updates the dispute with the provider's ID against
+// the transaction. The update function applies the data of the webhook event.
+// A decided dispute stays decided, as events can be redelivered or arrive out
+// of order.
+func recordDispute(tx *gorm.DB, log logrus.FieldLogger, trans *models.Transaction, provider, processorID string, update func(*models.Dispute)) (*models.Dispute, error) {
+	dispute := &models.Dispute{}
+	rsp := tx.Where("transaction_id = ? AND processor_id = ?", trans.ID, processorID).First(dispute)
+	if rsp.Error != nil && !rsp.RecordNotFound() {
+		return nil, rsp.Error
+	}
+
+	if rsp.RecordNotFound() {
+		dispute = models.NewDispute(trans, provider, processorID)
+		update(dispute)
+		log.WithField("dispute_id", dispute.ID).Info("Recorded new dispute")
+		return dispute, tx.Create(dispute).Error
+	}
+
+	status, providerStatus := dispute.Status, dispute.ProviderStatus
+	update(dispute)
+	if status != models.DisputeOpenState && dispute.Status == models.DisputeOpenState {
+		log.WithField("dispute_id", dispute.ID).Info("Ignoring an outdated status of a decided dispute")
+		dispute.Status, dispute.ProviderStatus = status, providerStatus
+	}
+	return dispute, tx.Save(dispute).Error
+}
+
+// applyDispute works out the payment state of the order from the status of
+// its dispute. Open and lost disputes mark the order as disputed and revoke
+// its downloads, a won dispute restores the payment and downloads of an order
+// it disputed.
+func applyDispute(tx *gorm.DB, ip string, order *models.Order, dispute *models.Dispute) {
+	switch dispute.Status {
+	case models.DisputeWonState:
+		if order.PaymentState == models.DisputedState {
+			order.PaymentState = models.PaidState
+			tx.Save(order)
+			restoreDownloads(tx, ip, order)
+		}
+	default:
+		if order.PaymentState != models.DisputedState {
+			order.PaymentState = models.DisputedState
+			tx.Save(order)
+			revokeDownloads(tx, ip, order.ID, models.DisputedState)
+		}
+	}
+}
+
+// stripeDisputeStatus maps the status of a Stripe dispute to the dispute state.
+func stripeDisputeStatus(status string) string {
+	switch stripe.DisputeStatus(status) {
+	case stripe.DisputeStatusWon:
+		return models.DisputeWonState
+	case stripe.DisputeStatusLost:
+		return models.DisputeLostState
+	}
+	return models.DisputeOpenState
+}
+
+// findWebhookTransaction finds the charge transaction of the instance matching
+// one of the provided processor or capture IDs along with its order. Webhooks are
+// verified with the secrets of the instance, so they can only ever settle its
+// own transactions.
+func findWebhookTransaction(tx *gorm.DB, instanceID string, processorIDs []string) (*models.Transaction, *models.Order, error) {
+	ids := []string{}
+	for _, id := range processorIDs {
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil, nil
+	}
+
+	trans := &models.Transaction{}
+	if rsp := tx.Where("instance_id = ? AND (processor_id IN (?) OR capture_id IN (?)) AND type = ?", instanceID, ids, ids, models.ChargeTransactionType).First(trans); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil, nil
+		}
+		return nil, nil, rsp.Error
+	}
+
+	order := &models.Order{}
+	if rsp := tx.First(order, "id = ? AND instance_id = ?", trans.OrderID, instanceID); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil, nil
+		}
+		return nil, nil, rsp.Error
+	}
+	return trans, order, nil
+}
+
+// PayPalWebhook receives webhook notifications from PayPal. Each notification is
+// validated against PayPal before the order payment state is updated.
+func (a *API) PayPalWebhook(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+
+	provider := gcontext.GetPaymentProviders(ctx)[payments.PayPalProvider]
+	verifier, ok := provider.(payments.WebhookVerifier)
+	if !ok {
+		return notFoundError("PayPal webhooks are not configured")
+	}
+
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodySize))
+	if err != nil {
+		return badRequestError("Error reading webhook body: %v", err)
+	}
+	if err := verifier.VerifyWebhook(r, payload); err != nil {
+		return badRequestError("Invalid PayPal webhook: %v", err)
+	}
+
+	event := paypalWebhookEvent{}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return badRequestError("Error reading PayPal event: %v", err)
+	}
+	log = log.WithField("paypal_event", event.ID).WithField("paypal_event_type", event.EventType)
+
+	res := event.Resource
+	var processorIDs []string
+	switch event.EventType {
+	case "PAYMENT.SALE.COMPLETED", "PAYMENT.SALE.DENIED":
+		processorIDs = []string{res.ID, res.ParentPayment}
+	case "PAYMENT.SALE.REFUNDED", "PAYMENT.SALE.REVERSED":
+		processorIDs = []string{res.SaleID, res.ParentPayment}
+	case "CUSTOMER.DISPUTE.CREATED", "CUSTOMER.DISPUTE.UPDATED", "CUSTOMER.DISPUTE.RESOLVED":
+		for _, t := range res.DisputedTransactions {
+			processorIDs = append(processorIDs, t.SellerTransactionID)
+		}
+	default:
+		log.Debug("Ignoring PayPal event")
+		return sendJSON(w, http.StatusOK, map[string]string{})
+	}
+
+	tx := a.DB(r).Begin()
+	trans, order, err := findWebhookTransaction(tx, gcontext.GetInstanceID(ctx), processorIDs)
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Error while querying for transactions").WithInternalError(err)
+	}
+	if trans == nil {
+		tx.Rollback()
+		log.Info("No transaction found for PayPal event")
+		return sendJSON(w, http.StatusOK, map[string]string{})
+	}
+	log = log.WithField("transaction_id", trans.ID).WithField("order_id", order.ID)
+
+	previousState := order.PaymentState
+	confirmed := false
+	var retry *models.PaymentRetry
+	switch event.EventType {
+	case "PAYMENT.SALE.COMPLETED":
+		// refunds and disputes reference the sale rather than the payment
+		if res.ID != "" && trans.CaptureID != res.ID {
+			trans.CaptureID = res.ID
+			tx.Model(trans).Update("capture_id", res.ID)
+		}
+		if res.TransactionFee != nil {
+			currency := res.TransactionFee.Currency
+			if currency == "" {
+				currency = trans.Currency
+			}
+			fee, err := parsePayPalAmount(res.TransactionFee.Value, currency)
+			if err != nil {
+				tx.Rollback()
+				return badRequestError("Invalid transaction fee: %v", err)
+			}
+			trans.Fee = fee
+			tx.Model(trans).Update("fee", fee)
+		}
+		claimed, err := claimPayment(tx, trans)
+		if err != nil {
+			tx.Rollback()
+			return internalServerError("Error claiming the payment").WithInternalError(err)
+		}
+		if claimed {
+			if trans.InvoiceNumber == 0 {
+				invoiceNumber, err := models.NextInvoiceNumber(tx, order.InstanceID)
+				if err != nil {
+					tx.Rollback()
+					return internalServerError("We failed to generate a valid invoice ID, please try again later: %v", err)
+				}
+				trans.InvoiceNumber = invoiceNumber
+			}
+			if confirmed, err = paymentComplete(r, tx, trans, order); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	case "PAYMENT.SALE.DENIED":
+		if trans.Status != models.PaidState && trans.Status != models.FailedState {
+			trans.Status = models.FailedState
+			trans.FailureCode = strconv.FormatInt(http.StatusPaymentRequired, 10)
+			trans.FailureDescription = "Payment denied by PayPal"
+			tx.Save(trans)
+			retry = paymentFailed(ctx, tx, log, order, trans.FailureDescription)
+		}
+	case "PAYMENT.SALE.REFUNDED", "PAYMENT.SALE.REVERSED":
+		var count int
+		tx.Model(&models.Transaction{}).Where("parent_id = ? AND processor_id = ?", trans.ID, res.ID).Count(&count)
+		if count == 0 {
+			amount := trans.RefundableAmount()
+			if res.Amount != nil {
+				amount, err = parsePayPalAmount(res.Amount.Total, res.Amount.Currency)
+				if err != nil {
+					tx.Rollback()
+					return badRequestError("Invalid refund amount: %v", err)
+				}
+			}
+			if err := recordRefund(r, tx, log, trans, amount, res.ID); err != nil {
+				tx.Rollback()
+				return internalServerError("Error recording PayPal refund").WithInternalError(err)
+			}
+			// refundComplete updates the order state in the database only
+			tx.First(order, "id = ?", order.ID)
+		}
+	case "CUSTOMER.DISPUTE.CREATED", "CUSTOMER.DISPUTE.UPDATED", "CUSTOMER.DISPUTE.RESOLVED":
+		var amount uint64
+		if res.DisputeAmount != nil {
+			amount, err = parsePayPalAmount(res.DisputeAmount.Value, res.DisputeAmount.CurrencyCode)
+			if err != nil {
+				tx.Rollback()
+				return badRequestError("Invalid dispute amount: %v", err)
+			}
+		}
+		dispute, err := recordDispute(tx, log, trans, payments.PayPalProvider, res.DisputeID, func(d *models.Dispute) {
+			if amount > 0 {
+				d.Amount = amount
+				d.Currency = res.DisputeAmount.CurrencyCode
+			}
+			if res.Reason != "" {
+				d.Reason = res.Reason
+			}
+			if res.Status != "" {
+				d.ProviderStatus = res.Status
+			}
+			if res.SellerResponseDueDate != nil {
+				d.EvidenceDueBy = res.SellerResponseDueDate
+			}
+			if res.DisputeOutcome != nil {
+				switch res.DisputeOutcome.OutcomeCode {
+				case "RESOLVED_SELLER_FAVOUR":
+					d.Status = models.DisputeWonState
+				case "RESOLVED_BUYER_FAVOUR":
+					d.Status = models.DisputeLostState
+				}
+			}
+		})
+		if err != nil {
+			tx.Rollback()
+			return internalServerError("Error recording PayPal dispute").WithInternalError(err)
+		}
+
+		applyDispute(tx, r.RemoteAddr, order, dispute)
+	}
+
+	if order.PaymentState != previousState {
+		log.Infof("Changed payment state from %s to %s", previousState, order.PaymentState)
+		models.LogEvent(tx, r.RemoteAddr, "", order.ID, models.EventUpdated, []string{"payment_state"})
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return internalServerError("Error saving webhook changes").WithInternalError(err)
+	}
+	if confirmed {
+		go sendOrderConfirmation(ctx, a.DB(r), log, trans)
+	}
+	if retry != nil {
+		go sendPaymentRetryMail(ctx, a.DB(r), log, order, retry)
+	}
+	return sendJSON(w, http.StatusOK, map[string]string{})
+}
+
+// coinbaseWebhookEvent holds the fields of Coinbase Commerce webhook events the
+// webhook receiver uses to match an event to a transaction.
+type coinbaseWebhookEvent struct {
+	Event struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		Data struct {
+			ID       string `json:"id"`
+			Code     string `json:"code"`
+			Payments []struct {
+				Status string `json:"status"`
+				Value  struct {
+					Local struct {
+						Amount   string `json:"amount"`
+						Currency string `json:"currency"`
+					} `json:"local"`
+				} `json:"value"`
+			} `json:"payments"`
+			Timeline []struct {
+				Status  string `json:"status"`
+				Context string `json:"context"`
+			} `json:"timeline"`
+		} `json:"data"`
+	} `json:"event"`
+}
+
+// receivedAmount sums up the confirmed payments of the charge in the local currency.
+func (e *coinbaseWebhookEvent) receivedAmount() (uint64, error) {
+	var received uint64
+	for _, payment := range e.Event.Data.Payments {
+		if payment.Status != "CONFIRMED" {
+			continue
+		}
+		amount, err := parsePayPalAmount(payment.Value.Local.Amount, payment.Value.Local.Currency)
+		if err != nil {
+			return 0, err
+		}
+		received += amount
+	}
+	return received, nil
+}
+
+// CoinbaseWebhook receives charge events from Coinbase Commerce. A charge is
+// confirmed once the on-chain payment settled. Underpaid charges fail when they
+// expire unless they are resolved from the Coinbase Commerce dashboard, while
+// overpaid charges are completed and the overpayment recorded on the transaction.
+func (a *API) CoinbaseWebhook(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+
+	provider := gcontext.GetPaymentProviders(ctx)[payments.CoinbaseProvider]
+	verifier, ok := provider.(payments.WebhookVerifier)
+	if !ok {
+		return notFoundError("Coinbase Commerce webhooks are not configured")
+	}
+
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodySize))
+	if err != nil {
+		return badRequestError("Error reading webhook body: %v", err)
+	}
+	if err := verifier.VerifyWebhook(r, payload); err != nil {
+		return badRequestError("Invalid Coinbase Commerce webhook: %v", err)
+	}
+
+	event := coinbaseWebhookEvent{}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return badRequestError("Error reading Coinbase Commerce event: %v", err)
+	}
+	log = log.WithField("coinbase_event", event.Event.ID).WithField("coinbase_event_type", event.Event.Type)
+
+	switch event.Event.Type {
+	case "charge:confirmed", "charge:failed", "charge:delayed", "charge:resolved":
+	default:
+		log.Debug("Ignoring Coinbase Commerce event")
+		return sendJSON(w, http.StatusOK, map[string]string{})
+	}
+	received, err := event.receivedAmount()
+	if err != nil {
+		return badRequestError("Invalid payment amount: %v", err)
+	}
+
+	tx := a.DB(r).Begin()
+	trans, order, err := findWebhookTransaction(tx, gcontext.GetInstanceID(ctx), []string{event.Event.Data.ID, event.Event.Data.Code})
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Error while querying for transactions").WithInternalError(err)
+	}
+	if trans == nil {
+		tx.Rollback()
+		log.Info("No transaction found for Coinbase Commerce event")
+		return sendJSON(w, http.StatusOK, map[string]string{})
+	}
+	log = log.WithField("transaction_id", trans.ID).WithField("order_id", order.ID)
+
+	if trans.ProviderMetadata == nil {
+		trans.ProviderMetadata = map[string]interface{}{}
+	}
+	trans.ProviderMetadata["received_amount"] = received
+
+	previousState := order.PaymentState
+	confirmed := false
+	var retry *models.PaymentRetry
+	switch event.Event.Type {
+	case "charge:confirmed", "charge:resolved":
+		claimed, err := claimPayment(tx, trans)
+		if err != nil {
+			tx.Rollback()
+			return internalServerError("Error claiming the payment").WithInternalError(err)
+		}
+		if claimed {
+			if received > trans.Amount {
+				log.Warnf("Charge overpaid by %d", received-trans.Amount)
+				trans.ProviderMetadata["overpaid_amount"] = received - trans.Amount
+			}
+			if confirmed, err = paymentComplete(r, tx, trans, order); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	case "charge:failed":
+		if trans.Status != models.PaidState && trans.Status != models.FailedState {
+			trans.Status = models.FailedState
+			trans.FailureCode = strconv.FormatInt(http.StatusPaymentRequired, 10)
+			trans.FailureDescription = "Coinbase Commerce charge expired without payment"
+			if received > 0 && received < trans.Amount {
+				trans.FailureDescription = fmt.Sprintf("Coinbase Commerce charge underpaid, received %d of %d", received, trans.Amount)
+				trans.ProviderMetadata["underpaid_amount"] = trans.Amount - received
+			}
+			tx.Save(trans)
+			retry = paymentFailed(ctx, tx, log, order, trans.FailureDescription)
+		}
+	case "charge:delayed":
+		// paid after the charge expired, it has to be resolved from the dashboard
+		log.Warn("Received payment for an expired charge")
+		trans.ProviderMetadata["delayed"] = true
+		tx.Save(trans)
+	}
+
+	if order.PaymentState != previousState {
+		log.Infof("Changed payment state from %s to %s", previousState, order.PaymentState)
+		models.LogEvent(tx, r.RemoteAddr, "", order.ID, models.EventUpdated, []string{"payment_state"})
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return internalServerError("Error saving webhook changes").WithInternalError(err)
+	}
+	if confirmed {
+		go sendOrderConfirmation(ctx, a.DB(r), log, trans)
+	}
+	if retry != nil {
+		go sendPaymentRetryMail(ctx, a.DB(r), log, order, retry)
+	}
+	return sendJSON(w, http.StatusOK, map[string]string{})
+}
+
+// klarnaNotification is the notification Klarna sends once it reviewed an order.
+type klarnaNotification struct {
+	OrderID   string `json:"order_id"`
+	EventType string `json:"event_type"`
+}
+
+// KlarnaWebhook receives the notifications Klarna sends once it approved or
+// rejected an order pending approval. Notifications aren't signed, so the
+// outcome of the review is looked up with Klarna instead of taken from the
+// notification.
+func (a *API) KlarnaWebhook(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+
+	provider := gcontext.GetPaymentProviders(ctx)[payments.KlarnaProvider]
+	reviewer, ok := provider.(payments.ReviewingProvider)
+	if !ok {
+		return notFoundError("Klarna notifications are not configured")
+	}
+
+	notification := klarnaNotification{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxWebhookBodySize)).Decode(&notification); err != nil {
+		return badRequestError("Error reading Klarna notification: %v", err)
+	}
+	if notification.OrderID == "" {
+		return badRequestError("Klarna notification is missing the order_id")
+	}
+	log = log.WithField("klarna_order_id", notification.OrderID).WithField("klarna_event_type", notification.EventType)
+
+	db := a.DB(r)
+	trans, order, err := findWebhookTransaction(db, gcontext.GetInstanceID(ctx), []string{notification.OrderID})
+	if err != nil {
+		return internalServerError("Error while querying for transactions").WithInternalError(err)
+	}
+	if trans == nil {
+		log.Info("No transaction found for Klarna notification")
+		return sendJSON(w, http.StatusOK, map[string]string{})
+	}
+	if trans.Status != models.PendingApprovalState {
+		log.Debug("Ignoring Klarna notification for a transaction that isn't pending approval")
+		return sendJSON(w, http.StatusOK, map[string]string{})
+	}
+	log = log.WithField("transaction_id", trans.ID).WithField("order_id", order.ID)
+
+	// the review is looked up outside of the database transaction, which
+	// only claims the transaction once the outcome is known
+	checkReview, err := reviewer.NewReviewChecker(ctx, log.WithField("component", "payment_provider"))
+	if err != nil {
+		return internalServerError("Error creating payment provider").WithInternalError(err)
+	}
+	state, err := checkReview(trans.ProcessorID)
+	if err != nil {
+		return internalServerError("Error looking up the Klarna order").WithInternalError(err)
+	}
+	if state != models.PaidState && state != models.FailedState {
+		log.Debug("Klarna order is still pending approval")
+		return sendJSON(w, http.StatusOK, map[string]string{})
+	}
+
+	tx := db.Begin()
+	rsp := tx.Model(&models.Transaction{}).Where("id = ? AND status = ?", trans.ID, models.PendingApprovalState).UpdateColumn("status", state)
+	if rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error claiming the transaction").WithInternalError(rsp.Error)
+	}
+	if rsp.RowsAffected == 0 {
+		tx.Rollback()
+		log.Debug("Ignoring Klarna notification for a transaction that has been reviewed already")
+		return sendJSON(w, http.StatusOK, map[string]string{})
+	}
+	if rsp := tx.First(order, "id = ?", order.ID); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error while querying for the order").WithInternalError(rsp.Error)
+	}
+
+	previousState := order.PaymentState
+	confirmed := false
+	var retry *models.PaymentRetry
+	switch state {
+	case models.PaidState:
+		var err error
+		if confirmed, err = paymentComplete(r, tx, trans, order); err != nil {
+			tx.Rollback()
+			return err
+		}
+	case models.FailedState:
+		trans.Status = models.FailedState
+		trans.FailureCode = strconv.FormatInt(http.StatusPaymentRequired, 10)
+		trans.FailureDescription = "Klarna rejected the order"
+		tx.Save(trans)
+		retry = paymentFailed(ctx, tx, log, order, trans.FailureDescription)
+	}
+
+	if order.PaymentState != previousState {
+		log.Infof("Changed payment state from %s to %s", previousState, order.PaymentState)
+		models.LogEvent(tx, r.RemoteAddr, "", order.ID, models.EventUpdated, []string{"payment_state"})
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return internalServerError("Error saving webhook changes").WithInternalError(err)
+	}
+	if confirmed {
+		go sendOrderConfirmation(ctx, a.DB(r), log, trans)
+	}
+	if retry != nil {
+		go sendPaymentRetryMail(ctx, a.DB(r), log, order, retry)
+	}
+	return sendJSON(w, http.StatusOK, map[string]string{})
+}
+
+// parsePayPalAmount converts a PayPal amount like "12.50" to the lowest unit of
+// the currency.
+func parsePayPalAmount(total, currency string) (uint64, error) {
+	value, err := strconv.ParseFloat(total, 64)
+	if err != nil {
+		return 0, err
+	}
+	if value < 0 {
+		return 0, fmt.Errorf("negative amount %s", total)
+	}
+	return uint64(math.Round(value * math.Pow10(payments.CurrencyExponent(currency)))), nil
+}
+
+// EasyPostWebhook receives the events EasyPost sends when the status of a
+// tracked shipment changes.
+func (a *API) EasyPostWebhook(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	config := gcontext.GetConfig(ctx)
+	if config.Shipping.TrackingProvider != easyPostProvider {
+		return notFoundError("EasyPost tracking is not configured")
+	}
+	tracker, err := newTracker(config, easyPostProvider)
+	if err != nil {
+		return internalServerError("Error creating tracking backend").WithInternalError(err)
+	}
+
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodySize))
+	if err != nil {
+		return badRequestError("Error reading webhook body: %v", err)
+	}
+	status, err := tracker.TrackingUpdate(r, payload)
+	if err != nil {
+		return badRequestError("Invalid EasyPost webhook: %v", err)
+	}
+	if status == nil {
+		log.Debug("Ignoring EasyPost event")
+		return sendJSON(w, http.StatusOK, map[string]string{})
+	}
+
+	if err := updateTrackingStatus(ctx, a.DB(r), log, status); err != nil {
+		return internalServerError("Error updating the shipment").WithInternalError(err)
+	}
+	return sendJSON(w, http.StatusOK, map[string]string{})
+}
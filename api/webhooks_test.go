@@ -0,0 +1,625 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/webhook"
+)
+
+const testStripeWebhookSecret = "whsec_test"
+
+func runStripeWebhook(test *RouteTest, eventType string, object string) *httptest.ResponseRecorder {
+	payload := []byte(fmt.Sprintf(`{"id":"evt_1","type":"%s","livemode":%t,"data":{"object":%s}}`, eventType, !test.Config.Payment.Sandbox, object))
+	now := time.Now()
+	signature := hex.EncodeToString(webhook.ComputeSignature(now, payload, testStripeWebhookSecret))
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, baseURL+"/webhooks/stripe", bytes.NewBuffer(payload))
+	req.Header.Set(stripeSignatureHeader, fmt.Sprintf("t=%d,v1=%s", now.Unix(), signature))
+
+	globalConfig := new(conf.GlobalConfiguration)
+	ctx, err := WithInstanceConfig(context.Background(), globalConfig.SMTP, test.Config, "")
+	require.NoError(test.T, err)
+	NewAPIWithVersion(ctx, test.GlobalConfig, logrus.StandardLogger(), test.DB, "").handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestStripeWebhook(t *testing.T) {
+	setup := func(t *testing.T, paymentState string) *RouteTest {
+		test := NewRouteTest(t)
+		test.Config.Payment.Stripe.WebhookSecret = testStripeWebhookSecret
+		test.Data.firstOrder.PaymentState = paymentState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+		test.Data.firstTransaction.Status = paymentState
+		test.Data.firstTransaction.ProcessorID = stripePaymentIntentID
+		require.NoError(t, test.DB.Save(test.Data.firstTransaction).Error)
+		return test
+	}
+	storedState := func(t *testing.T, test *RouteTest) (*models.Transaction, *models.Order) {
+		trans := &models.Transaction{}
+		require.NoError(t, test.DB.First(trans, "id = ?", test.Data.firstTransaction.ID).Error)
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		return trans, order
+	}
+
+	t.Run("InvalidSignature", func(t *testing.T) {
+		test := setup(t, models.PendingState)
+		test.Config.Payment.Stripe.WebhookSecret = "whsec_other"
+		recorder := runStripeWebhook(test, "payment_intent.succeeded", `{"id":"`+stripePaymentIntentID+`"}`)
+		validateError(t, http.StatusBadRequest, recorder, "Invalid Stripe webhook")
+	})
+	t.Run("NotConfigured", func(t *testing.T) {
+		test := setup(t, models.PendingState)
+		test.Config.Payment.Stripe.WebhookSecret = ""
+		recorder := runStripeWebhook(test, "payment_intent.succeeded", `{"id":"`+stripePaymentIntentID+`"}`)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+	t.Run("PaymentIntentSucceeded", func(t *testing.T) {
+		test := setup(t, models.PendingState)
+		recorder := runStripeWebhook(test, "payment_intent.succeeded", `{"id":"`+stripePaymentIntentID+`","object":"payment_intent"}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		trans, order := storedState(t, test)
+		assert.Equal(t, models.PaidState, trans.Status)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+	})
+	t.Run("PaymentIntentProcessing", func(t *testing.T) {
+		test := setup(t, models.PendingState)
+		recorder := runStripeWebhook(test, "payment_intent.processing", `{"id":"`+stripePaymentIntentID+`","object":"payment_intent"}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		trans, order := storedState(t, test)
+		assert.Equal(t, models.ProcessingState, trans.Status)
+		assert.Equal(t, models.ProcessingState, order.PaymentState)
+	})
+	t.Run("ProcessingSucceeded", func(t *testing.T) {
+		test := setup(t, models.ProcessingState)
+		recorder := runStripeWebhook(test, "payment_intent.succeeded", `{"id":"`+stripePaymentIntentID+`","object":"payment_intent"}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		trans, order := storedState(t, test)
+		assert.Equal(t, models.PaidState, trans.Status)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+	})
+	t.Run("ProcessingFailed", func(t *testing.T) {
+		test := setup(t, models.ProcessingState)
+		recorder := runStripeWebhook(test, "payment_intent.payment_failed", `{"id":"`+stripePaymentIntentID+`","last_payment_error":{"message":"The account has insufficient funds."}}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		trans, order := storedState(t, test)
+		assert.Equal(t, models.FailedState, trans.Status)
+		assert.Equal(t, models.FailedState, order.PaymentState)
+	})
+	t.Run("PaymentIntentFailed", func(t *testing.T) {
+		test := setup(t, models.PendingState)
+		recorder := runStripeWebhook(test, "payment_intent.payment_failed", `{"id":"`+stripePaymentIntentID+`","last_payment_error":{"message":"Your card was declined."}}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		trans, order := storedState(t, test)
+		assert.Equal(t, models.FailedState, trans.Status)
+		assert.Equal(t, "Your card was declined.", trans.FailureDescription)
+		assert.Equal(t, models.FailedState, order.PaymentState)
+	})
+	t.Run("PaymentIntentFailedWithRetries", func(t *testing.T) {
+		test := setup(t, models.PendingState)
+		test.Config.Payment.Dunning.RetrySchedule = []uint64{1, 3, 7}
+		test.Config.Webhooks.Dunning = "https://example.com/dunning"
+		recorder := runStripeWebhook(test, "payment_intent.payment_failed", `{"id":"`+stripePaymentIntentID+`","last_payment_error":{"message":"Your card was declined."}}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		_, order := storedState(t, test)
+		assert.Equal(t, models.PastDueState, order.PaymentState)
+
+		retry, err := models.FindPendingPaymentRetry(test.DB, order.ID)
+		require.NoError(t, err)
+		require.NotNil(t, retry)
+		assert.Equal(t, "Your card was declined.", retry.LastError)
+		assert.WithinDuration(t, retry.FailedAt.Add(24*time.Hour), *retry.NextAttemptAt, time.Second)
+
+		hook := &models.Hook{}
+		require.NoError(t, test.DB.First(hook, "type = ?", "dunning").Error)
+		assert.Equal(t, "https://example.com/dunning", hook.URL)
+	})
+	t.Run("ChargeRefunded", func(t *testing.T) {
+		test := setup(t, models.PaidState)
+		charge := fmt.Sprintf(`{"id":"ch_1","payment_intent":"%s","amount_refunded":%d,"refunds":{"data":[{"id":"re_1"}]}}`, stripePaymentIntentID, test.Data.firstTransaction.Amount)
+		recorder := runStripeWebhook(test, "charge.refunded", charge)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		trans, order := storedState(t, test)
+		assert.Equal(t, test.Data.firstTransaction.Amount, trans.RefundedAmount)
+		assert.Equal(t, models.RefundedState, order.PaymentState)
+
+		refund := &models.Transaction{}
+		require.NoError(t, test.DB.First(refund, "parent_id = ?", trans.ID).Error)
+		assert.Equal(t, "re_1", refund.ProcessorID)
+		assert.Equal(t, models.RefundTransactionType, refund.Type)
+
+		download := &models.Download{}
+		require.NoError(t, test.DB.First(download, "id = ?", "first-download").Error)
+		assert.True(t, download.Revoked)
+		var revoked int
+		require.NoError(t, test.DB.Model(&models.Event{}).Where("order_id = ? AND type = ?", order.ID, models.EventRevoked).Count(&revoked).Error)
+		assert.Equal(t, 1, revoked)
+
+		// replaying the event must not record the refund twice
+		recorder = runStripeWebhook(test, "charge.refunded", charge)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		var count int
+		require.NoError(t, test.DB.Model(&models.Transaction{}).Where("parent_id = ?", trans.ID).Count(&count).Error)
+		assert.Equal(t, 1, count)
+	})
+	t.Run("Dispute", func(t *testing.T) {
+		test := setup(t, models.PaidState)
+		dispute := `{"id":"dp_1","charge":"ch_1","payment_intent":"` + stripePaymentIntentID + `","status":"needs_response","amount":80,"currency":"usd","reason":"fraudulent","evidence_details":{"due_by":1893456000},"balance_transactions":[{"fee":15}]}`
+		recorder := runStripeWebhook(test, "charge.dispute.created", dispute)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		_, order := storedState(t, test)
+		assert.Equal(t, models.DisputedState, order.PaymentState)
+		download := &models.Download{}
+		require.NoError(t, test.DB.First(download, "id = ?", "first-download").Error)
+		assert.True(t, download.Revoked)
+
+		stored := &models.Dispute{}
+		require.NoError(t, test.DB.First(stored, "processor_id = ?", "dp_1").Error)
+		assert.Equal(t, test.Data.firstTransaction.ID, stored.TransactionID)
+		assert.Equal(t, models.DisputeOpenState, stored.Status)
+		assert.Equal(t, "fraudulent", stored.Reason)
+		assert.Equal(t, "USD", stored.Currency)
+		assert.EqualValues(t, 80, stored.Amount)
+		assert.EqualValues(t, 15, stored.Fee)
+		assert.EqualValues(t, 95, stored.FinancialImpact)
+		require.NotNil(t, stored.EvidenceDueBy)
+		assert.EqualValues(t, 1893456000, stored.EvidenceDueBy.Unix())
+
+		dispute = `{"id":"dp_1","charge":"ch_1","payment_intent":"` + stripePaymentIntentID + `","status":"won"}`
+		recorder = runStripeWebhook(test, "charge.dispute.closed", dispute)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		_, order = storedState(t, test)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+		require.NoError(t, test.DB.First(download, "id = ?", "first-download").Error)
+		assert.False(t, download.Revoked)
+
+		var count int
+		require.NoError(t, test.DB.Model(&models.Dispute{}).Count(&count).Error)
+		assert.Equal(t, 1, count)
+		require.NoError(t, test.DB.First(stored, "processor_id = ?", "dp_1").Error)
+		assert.Equal(t, models.DisputeWonState, stored.Status)
+		assert.EqualValues(t, 15, stored.FinancialImpact)
+		assert.NotNil(t, stored.ClosedAt)
+
+		// a redelivered created event doesn't reopen the decided dispute
+		dispute = `{"id":"dp_1","charge":"ch_1","payment_intent":"` + stripePaymentIntentID + `","status":"needs_response"}`
+		recorder = runStripeWebhook(test, "charge.dispute.created", dispute)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		_, order = storedState(t, test)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+		require.NoError(t, test.DB.First(download, "id = ?", "first-download").Error)
+		assert.False(t, download.Revoked)
+		require.NoError(t, test.DB.First(stored, "processor_id = ?", "dp_1").Error)
+		assert.Equal(t, models.DisputeWonState, stored.Status)
+	})
+	t.Run("DifferentMode", func(t *testing.T) {
+		test := setup(t, models.PendingState)
+		require.NoError(t, test.DB.Model(test.Data.firstTransaction).Update("test", true).Error)
+
+		recorder := runStripeWebhook(test, "payment_intent.succeeded", `{"id":"`+stripePaymentIntentID+`"}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		trans, order := storedState(t, test)
+		assert.Equal(t, models.PendingState, trans.Status)
+		assert.Equal(t, models.PendingState, order.PaymentState)
+	})
+	t.Run("ChargeSucceeded", func(t *testing.T) {
+		test := setup(t, models.PaidState)
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+			switch path {
+			case "/v1/payment_intents/" + stripePaymentIntentID:
+				intent := v.(*stripe.PaymentIntent)
+				intent.ID = stripePaymentIntentID
+				intent.Charges = &stripe.ChargeList{Data: []*stripe.Charge{
+					{ID: "ch_1", BalanceTransaction: &stripe.BalanceTransaction{Fee: 33}},
+				}}
+				return nil
+			default:
+				t.Fatalf("unknown Stripe API call to %s", path)
+				return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+			}
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		recorder := runStripeWebhook(test, "charge.succeeded", `{"id":"ch_1","payment_intent":"`+stripePaymentIntentID+`","balance_transaction":"txn_1"}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		trans, _ := storedState(t, test)
+		assert.EqualValues(t, 33, trans.Fee)
+	})
+	t.Run("UnknownTransaction", func(t *testing.T) {
+		test := setup(t, models.PendingState)
+		recorder := runStripeWebhook(test, "payment_intent.succeeded", `{"id":"pi_unknown"}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	})
+	t.Run("OtherInstance", func(t *testing.T) {
+		test := setup(t, models.PendingState)
+		require.NoError(t, test.DB.Model(test.Data.firstTransaction).UpdateColumn("instance_id", "other-instance").Error)
+		recorder := runStripeWebhook(test, "payment_intent.succeeded", `{"id":"`+stripePaymentIntentID+`","object":"payment_intent"}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		trans, order := storedState(t, test)
+		assert.Equal(t, models.PendingState, trans.Status)
+		assert.Equal(t, models.PendingState, order.PaymentState)
+	})
+}
+
+func runPayPalWebhook(test *RouteTest, payload string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, baseURL+"/webhooks/paypal", bytes.NewBufferString(payload))
+	req.Header.Set("Paypal-Transmission-Id", "b2384410-f8d2-11e9-8883-37ce8d2923e5")
+	req.Header.Set("Paypal-Transmission-Sig", "signature")
+
+	globalConfig := new(conf.GlobalConfiguration)
+	ctx, err := WithInstanceConfig(context.Background(), globalConfig.SMTP, test.Config, "")
+	require.NoError(test.T, err)
+	NewAPIWithVersion(ctx, test.GlobalConfig, logrus.StandardLogger(), test.DB, "").handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestPayPalWebhook(t *testing.T) {
+	setup := func(t *testing.T, verificationStatus string) (*RouteTest, *int, func()) {
+		test := NewRouteTest(t)
+		var verifyCount int
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Content-Type", "application/json")
+			switch r.URL.Path {
+			case "/v1/oauth2/token":
+				fmt.Fprint(w, `{"access_token":"EEwJ6tF9x5WCIZDYzyZGaz6Khbw7raYRIBV_WxVvgmsG","expires_in":100000}`)
+			case "/v1/notifications/verify-webhook-signature":
+				payload := map[string]interface{}{}
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+				assert.Equal(t, "webhook-id", payload["webhook_id"])
+				assert.Equal(t, "signature", payload["transmission_sig"])
+				assert.NotNil(t, payload["webhook_event"])
+				fmt.Fprint(w, `{"verification_status":"`+verificationStatus+`"}`)
+				verifyCount++
+			default:
+				w.WriteHeader(500)
+				t.Fatalf("unknown PayPal API call to %s", r.URL.Path)
+			}
+		}))
+		test.Config.Payment.PayPal.Enabled = true
+		test.Config.Payment.PayPal.ClientID = "clientid"
+		test.Config.Payment.PayPal.Secret = "secret"
+		test.Config.Payment.PayPal.Env = server.URL
+		test.Config.Payment.PayPal.WebhookID = "webhook-id"
+
+		test.Data.secondTransaction.Status = models.PaidState
+		test.Data.secondTransaction.ProcessorID = "PAY-1B56960729604235TKQQIYVY"
+		require.NoError(t, test.DB.Save(test.Data.secondTransaction).Error)
+		return test, &verifyCount, server.Close
+	}
+	storedOrder := func(t *testing.T, test *RouteTest) *models.Order {
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", test.Data.secondOrder.ID).Error)
+		return order
+	}
+
+	t.Run("InvalidSignature", func(t *testing.T) {
+		test, verifyCount, done := setup(t, "FAILURE")
+		defer done()
+		recorder := runPayPalWebhook(test, `{"id":"WH-1","event_type":"PAYMENT.SALE.REFUNDED","resource":{"id":"REF-1","parent_payment":"PAY-1B56960729604235TKQQIYVY"}}`)
+		validateError(t, http.StatusBadRequest, recorder, "Invalid PayPal webhook")
+		assert.Equal(t, 1, *verifyCount)
+		assert.Equal(t, models.PaidState, storedOrder(t, test).PaymentState)
+	})
+	t.Run("SaleCompleted", func(t *testing.T) {
+		test, verifyCount, done := setup(t, "SUCCESS")
+		defer done()
+		test.Data.secondTransaction.Status = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.secondTransaction).Error)
+
+		recorder := runPayPalWebhook(test, `{"id":"WH-5","event_type":"PAYMENT.SALE.COMPLETED","resource":{"id":"SALE-1","state":"completed","parent_payment":"PAY-1B56960729604235TKQQIYVY","transaction_fee":{"value":"1.90","currency":"USD"}}}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, 1, *verifyCount)
+
+		trans := &models.Transaction{}
+		require.NoError(t, test.DB.First(trans, "id = ?", test.Data.secondTransaction.ID).Error)
+		assert.Equal(t, models.PaidState, trans.Status)
+		assert.EqualValues(t, 190, trans.Fee)
+		assert.Equal(t, "SALE-1", trans.CaptureID)
+	})
+	t.Run("SaleCompletedZeroDecimal", func(t *testing.T) {
+		test, _, done := setup(t, "SUCCESS")
+		defer done()
+		test.Data.secondTransaction.Status = models.PendingState
+		test.Data.secondTransaction.Currency = "JPY"
+		require.NoError(t, test.DB.Save(test.Data.secondTransaction).Error)
+
+		recorder := runPayPalWebhook(test, `{"id":"WH-6","event_type":"PAYMENT.SALE.COMPLETED","resource":{"id":"SALE-1","state":"completed","parent_payment":"PAY-1B56960729604235TKQQIYVY","transaction_fee":{"value":"190","currency":"JPY"}}}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		trans := &models.Transaction{}
+		require.NoError(t, test.DB.First(trans, "id = ?", test.Data.secondTransaction.ID).Error)
+		assert.EqualValues(t, 190, trans.Fee)
+	})
+	t.Run("SaleRefunded", func(t *testing.T) {
+		test, verifyCount, done := setup(t, "SUCCESS")
+		defer done()
+		total := fmt.Sprintf("%.2f", float64(test.Data.secondTransaction.Amount)/100)
+		event := `{"id":"WH-2","event_type":"PAYMENT.SALE.REFUNDED","resource":{"id":"REF-1","sale_id":"SALE-1","parent_payment":"PAY-1B56960729604235TKQQIYVY","amount":{"total":"` + total + `","currency":"USD"}}}`
+		recorder := runPayPalWebhook(test, event)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, 1, *verifyCount)
+		assert.Equal(t, models.RefundedState, storedOrder(t, test).PaymentState)
+
+		refund := &models.Transaction{}
+		require.NoError(t, test.DB.First(refund, "parent_id = ?", test.Data.secondTransaction.ID).Error)
+		assert.Equal(t, "REF-1", refund.ProcessorID)
+		assert.Equal(t, test.Data.secondTransaction.Amount, refund.Amount)
+
+		var count int
+		require.NoError(t, test.DB.Model(&models.Event{}).Where("order_id = ? AND type = ?", test.Data.secondOrder.ID, models.EventUpdated).Count(&count).Error)
+		assert.Equal(t, 1, count)
+	})
+	t.Run("DisputeCreated", func(t *testing.T) {
+		test, _, done := setup(t, "SUCCESS")
+		defer done()
+		test.Data.secondTransaction.CaptureID = "SALE-1"
+		require.NoError(t, test.DB.Save(test.Data.secondTransaction).Error)
+		recorder := runPayPalWebhook(test, `{"id":"WH-3","event_type":"CUSTOMER.DISPUTE.CREATED","resource":{"dispute_id":"PP-D-1","reason":"MERCHANDISE_OR_SERVICE_NOT_RECEIVED","status":"OPEN","dispute_amount":{"currency_code":"USD","value":"0.50"},"disputed_transactions":[{"seller_transaction_id":"SALE-1"}]}}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, models.DisputedState, storedOrder(t, test).PaymentState)
+
+		stored := &models.Dispute{}
+		require.NoError(t, test.DB.First(stored, "processor_id = ?", "PP-D-1").Error)
+		assert.Equal(t, test.Data.secondTransaction.ID, stored.TransactionID)
+		assert.Equal(t, "MERCHANDISE_OR_SERVICE_NOT_RECEIVED", stored.Reason)
+		assert.EqualValues(t, 50, stored.Amount)
+
+		recorder = runPayPalWebhook(test, `{"id":"WH-4","event_type":"CUSTOMER.DISPUTE.RESOLVED","resource":{"dispute_id":"PP-D-1","status":"RESOLVED","dispute_outcome":{"outcome_code":"RESOLVED_BUYER_FAVOUR"},"disputed_transactions":[{"seller_transaction_id":"SALE-1"}]}}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		require.NoError(t, test.DB.First(stored, "processor_id = ?", "PP-D-1").Error)
+		assert.Equal(t, models.DisputeLostState, stored.Status)
+		assert.Equal(t, "RESOLVED", stored.ProviderStatus)
+		assert.Equal(t, models.DisputedState, storedOrder(t, test).PaymentState)
+	})
+	t.Run("DisputeOutOfOrder", func(t *testing.T) {
+		test, _, done := setup(t, "SUCCESS")
+		defer done()
+		test.Data.secondTransaction.CaptureID = "SALE-1"
+		require.NoError(t, test.DB.Save(test.Data.secondTransaction).Error)
+		require.NoError(t, test.DB.Model(test.Data.secondOrder).Update("payment_state", models.DisputedState).Error)
+
+		recorder := runPayPalWebhook(test, `{"id":"WH-4","event_type":"CUSTOMER.DISPUTE.RESOLVED","resource":{"dispute_id":"PP-D-1","status":"RESOLVED","dispute_outcome":{"outcome_code":"RESOLVED_SELLER_FAVOUR"},"disputed_transactions":[{"seller_transaction_id":"SALE-1"}]}}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, models.PaidState, storedOrder(t, test).PaymentState)
+
+		// the created event arriving after the resolution keeps the order paid
+		recorder = runPayPalWebhook(test, `{"id":"WH-3","event_type":"CUSTOMER.DISPUTE.CREATED","resource":{"dispute_id":"PP-D-1","status":"OPEN","disputed_transactions":[{"seller_transaction_id":"SALE-1"}]}}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, models.PaidState, storedOrder(t, test).PaymentState)
+		stored := &models.Dispute{}
+		require.NoError(t, test.DB.First(stored, "processor_id = ?", "PP-D-1").Error)
+		assert.Equal(t, models.DisputeWonState, stored.Status)
+	})
+	t.Run("NotConfigured", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := runPayPalWebhook(test, `{}`)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+}
+
+const testCoinbaseWebhookSecret = "coinbase-secret"
+
+func runCoinbaseWebhook(test *RouteTest, eventType string, data string) *httptest.ResponseRecorder {
+	payload := []byte(fmt.Sprintf(`{"event":{"id":"evt-1","type":"%s","data":%s}}`, eventType, data))
+	mac := hmac.New(sha256.New, []byte(testCoinbaseWebhookSecret))
+	mac.Write(payload)
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, baseURL+"/webhooks/coinbase", bytes.NewBuffer(payload))
+	req.Header.Set("X-CC-Webhook-Signature", hex.EncodeToString(mac.Sum(nil)))
+
+	globalConfig := new(conf.GlobalConfiguration)
+	ctx, err := WithInstanceConfig(context.Background(), globalConfig.SMTP, test.Config, "")
+	require.NoError(test.T, err)
+	NewAPIWithVersion(ctx, test.GlobalConfig, logrus.StandardLogger(), test.DB, "").handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestCoinbaseWebhook(t *testing.T) {
+	setup := func(t *testing.T) (*RouteTest, *models.Transaction, func()) {
+		test := NewRouteTest(t)
+		test.Data.secondOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.secondOrder).Error)
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "apikey", r.Header.Get("X-CC-Api-Key"))
+			payload := map[string]interface{}{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+
+			w.Header().Add("Content-Type", "application/json")
+			switch r.URL.Path {
+			case "/charges":
+				assert.Equal(t, "fixed_price", payload["pricing_type"])
+				assert.Equal(t, "https://example.com/thanks", payload["redirect_url"])
+				w.WriteHeader(http.StatusCreated)
+				fmt.Fprint(w, `{"data":{"id":"charge-1","code":"CODE1","hosted_url":"https://commerce.coinbase.com/charges/CODE1"}}`)
+			default:
+				w.WriteHeader(500)
+				t.Fatalf("unknown Coinbase Commerce API call to %s", r.URL.Path)
+			}
+		}))
+		test.Config.Payment.Coinbase.Enabled = true
+		test.Config.Payment.Coinbase.APIKey = "apikey"
+		test.Config.Payment.Coinbase.WebhookSecret = testCoinbaseWebhookSecret
+		test.Config.Payment.Coinbase.Env = server.URL
+
+		body, err := json.Marshal(&PaymentParams{
+			Amount:           test.Data.secondOrder.Total,
+			Currency:         test.Data.secondOrder.Currency,
+			ProviderType:     payments.CoinbaseProvider,
+			ProviderMetadata: map[string]interface{}{"redirect_url": "https://example.com/thanks"},
+		})
+		require.NoError(t, err)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/second-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+		trans := &models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, trans)
+		assert.Equal(t, models.PendingState, trans.Status)
+		assert.Equal(t, "charge-1", trans.ProcessorID)
+		assert.Equal(t, "https://commerce.coinbase.com/charges/CODE1", trans.ProviderMetadata["hosted_url"])
+		return test, trans, server.Close
+	}
+	charge := func(paid ...uint64) string {
+		payments := []string{}
+		for _, amount := range paid {
+			payments = append(payments, fmt.Sprintf(`{"status":"CONFIRMED","value":{"local":{"amount":"%.2f","currency":"USD"}}}`, float64(amount)/100))
+		}
+		return `{"id":"charge-1","code":"CODE1","payments":[` + strings.Join(payments, ",") + `]}`
+	}
+	stored := func(t *testing.T, test *RouteTest, trans *models.Transaction) (*models.Transaction, *models.Order) {
+		tr := &models.Transaction{}
+		require.NoError(t, test.DB.First(tr, "id = ?", trans.ID).Error)
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", trans.OrderID).Error)
+		return tr, order
+	}
+
+	t.Run("Confirmed", func(t *testing.T) {
+		test, trans, done := setup(t)
+		defer done()
+		recorder := runCoinbaseWebhook(test, "charge:confirmed", charge(trans.Amount))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		tr, order := stored(t, test, trans)
+		assert.Equal(t, models.PaidState, tr.Status)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+		assert.Nil(t, tr.ProviderMetadata["overpaid_amount"])
+	})
+	t.Run("Overpaid", func(t *testing.T) {
+		test, trans, done := setup(t)
+		defer done()
+		recorder := runCoinbaseWebhook(test, "charge:confirmed", charge(trans.Amount, 150))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		tr, order := stored(t, test, trans)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+		assert.EqualValues(t, 150, tr.ProviderMetadata["overpaid_amount"])
+	})
+	t.Run("UnderpaidAndResolved", func(t *testing.T) {
+		test, trans, done := setup(t)
+		defer done()
+		recorder := runCoinbaseWebhook(test, "charge:failed", charge(trans.Amount-5))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		tr, order := stored(t, test, trans)
+		assert.Equal(t, models.FailedState, tr.Status)
+		assert.Contains(t, tr.FailureDescription, "underpaid")
+		assert.EqualValues(t, 5, tr.ProviderMetadata["underpaid_amount"])
+		assert.Equal(t, models.FailedState, order.PaymentState)
+
+		// the merchant accepted the underpayment in the dashboard
+		recorder = runCoinbaseWebhook(test, "charge:resolved", charge(trans.Amount-5))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		tr, order = stored(t, test, trans)
+		assert.Equal(t, models.PaidState, tr.Status)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+	})
+	t.Run("InvalidSignature", func(t *testing.T) {
+		test, trans, done := setup(t)
+		defer done()
+		test.Config.Payment.Coinbase.WebhookSecret = "other-secret"
+		recorder := runCoinbaseWebhook(test, "charge:confirmed", charge(trans.Amount))
+		validateError(t, http.StatusBadRequest, recorder, "Invalid Coinbase Commerce webhook")
+
+		tr, _ := stored(t, test, trans)
+		assert.Equal(t, models.PendingState, tr.Status)
+	})
+}
+
+func runKlarnaWebhook(test *RouteTest, orderID, eventType string) *httptest.ResponseRecorder {
+	payload := fmt.Sprintf(`{"order_id":"%s","event_type":"%s"}`, orderID, eventType)
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, baseURL+"/webhooks/klarna", strings.NewReader(payload))
+
+	globalConfig := new(conf.GlobalConfiguration)
+	ctx, err := WithInstanceConfig(context.Background(), globalConfig.SMTP, test.Config, "")
+	require.NoError(test.T, err)
+	NewAPIWithVersion(ctx, test.GlobalConfig, logrus.StandardLogger(), test.DB, "").handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestKlarnaWebhook(t *testing.T) {
+	setup := func(t *testing.T, fraudStatus *string) (*RouteTest, func()) {
+		test := NewRouteTest(t)
+		closer := setupKlarna(t, test, fraudStatus)
+		trans := models.Transaction{}
+		extractPayload(t, http.StatusOK, authorizeKlarnaPayment(t, test), &trans)
+		require.Equal(t, models.PendingApprovalState, trans.Status)
+		return test, closer
+	}
+	paymentState := func(t *testing.T, test *RouteTest) (string, string) {
+		trans := &models.Transaction{}
+		require.NoError(t, test.DB.First(trans, "processor_id = ?", "klarna-order").Error)
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", trans.OrderID).Error)
+		return trans.Status, order.PaymentState
+	}
+
+	t.Run("Accepted", func(t *testing.T) {
+		fraudStatus := "PENDING"
+		test, closer := setup(t, &fraudStatus)
+		defer closer()
+
+		fraudStatus = "ACCEPTED"
+		recorder := runKlarnaWebhook(test, "klarna-order", "FRAUD_RISK_ACCEPTED")
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+		transState, orderState := paymentState(t, test)
+		assert.Equal(t, models.PaidState, transState)
+		assert.Equal(t, models.PaidState, orderState)
+	})
+	t.Run("Rejected", func(t *testing.T) {
+		fraudStatus := "PENDING"
+		test, closer := setup(t, &fraudStatus)
+		defer closer()
+
+		fraudStatus = "REJECTED"
+		recorder := runKlarnaWebhook(test, "klarna-order", "FRAUD_RISK_REJECTED")
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+		transState, orderState := paymentState(t, test)
+		assert.Equal(t, models.FailedState, transState)
+		assert.Equal(t, models.FailedState, orderState)
+	})
+	t.Run("NotificationNotMatchingReview", func(t *testing.T) {
+		fraudStatus := "PENDING"
+		test, closer := setup(t, &fraudStatus)
+		defer closer()
+
+		recorder := runKlarnaWebhook(test, "klarna-order", "FRAUD_RISK_ACCEPTED")
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+		transState, orderState := paymentState(t, test)
+		assert.Equal(t, models.PendingApprovalState, transState)
+		assert.Equal(t, models.PendingApprovalState, orderState)
+	})
+}
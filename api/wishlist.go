@@ -0,0 +1,264 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// WishlistItemParams are the parameters for saving a product to a wishlist:
+// the path of its product page, the SKU if the page lists several products,
+// and whether to be notified once it's back in stock.
+type WishlistItemParams struct {
+	Path          string `json:"path"`
+	Sku           string `json:"sku"`
+	NotifyInStock *bool  `json:"notify_in_stock"`
+}
+
+// wishlistOrderParams are the parameters of an order created from wishlist
+// items. They're the same as those of a new order, the line items are the
+// wishlist items with the IDs in Items, or all of them.
+type wishlistOrderParams struct {
+	orderRequestParams
+	Items []string `json:"items"`
+}
+
+// WishlistList lists the products on the wishlist of the user.
+func (a *API) WishlistList(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	userID := gcontext.GetUserID(ctx)
+	if gcontext.GetUser(ctx) == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+
+	items := []*models.WishlistItem{}
+	if rsp := a.DB(r).Where("user_id = ?", userID).Order("created_at").Find(&items); rsp.Error != nil {
+		return internalServerError("Error while querying for wishlist").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, items)
+}
+
+// WishlistItemCreate saves a product to the wishlist of the user, along with
+// the metadata of its product page.
+func (a *API) WishlistItemCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	userID := gcontext.GetUserID(ctx)
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+
+	params := &WishlistItemParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Failed to parse json body: %v", err)
+	}
+	if params.Path == "" {
+		return badRequestError("Wishlist items require the path of the product")
+	}
+
+	lineItem := &models.LineItem{Path: params.Path, Sku: params.Sku}
+	meta, err := lineItem.FetchMeta(gcontext.GetConfig(ctx).SiteURL)
+	if err != nil {
+		return badRequestError("Error loading the product: %v", err)
+	}
+
+	db := a.DB(r)
+	var saved int
+	if rsp := db.Model(&models.WishlistItem{}).Where("user_id = ? AND sku = ?", userID, meta.Sku).Count(&saved); rsp.Error != nil {
+		return internalServerError("Error while querying for wishlist").WithInternalError(rsp.Error)
+	}
+	if saved > 0 {
+		return badRequestError("This product is already on the wishlist")
+	}
+
+	item := models.NewWishlistItem(user, params.Path, meta)
+	if params.NotifyInStock != nil {
+		item.NotifyInStock = *params.NotifyInStock
+	}
+	if rsp := db.Create(item); rsp.Error != nil {
+		return internalServerError("Error saving wishlist item").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusCreated, item)
+}
+
+// WishlistItemUpdate opts a wishlist item into or out of the back in stock
+// notification. Opting in again after a notification was sent waits for the
+// next time the product is back in stock.
+func (a *API) WishlistItemUpdate(w http.ResponseWriter, r *http.Request) error {
+	params := &WishlistItemParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Failed to parse json body: %v", err)
+	}
+	if params.NotifyInStock == nil {
+		return badRequestError("Only notify_in_stock can be updated")
+	}
+
+	item, httpErr := a.loadWishlistItem(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	changes := map[string]interface{}{"notify_in_stock": *params.NotifyInStock, "notified_at": nil}
+	if rsp := a.DB(r).Model(item).Updates(changes); rsp.Error != nil {
+		return internalServerError("Error saving wishlist item").WithInternalError(rsp.Error)
+	}
+	item.NotifyInStock = *params.NotifyInStock
+	item.NotifiedAt = nil
+	return sendJSON(w, http.StatusOK, item)
+}
+
+// WishlistItemDelete removes a product from the wishlist of the user.
+func (a *API) WishlistItemDelete(w http.ResponseWriter, r *http.Request) error {
+	item, httpErr := a.loadWishlistItem(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if rsp := a.DB(r).Delete(item); rsp.Error != nil {
+		return internalServerError("Error deleting wishlist item").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, map[string]string{})
+}
+
+// WishlistOrder moves wishlist items to a new order: they're ordered once
+// each and removed from the wishlist. Only the user can order their
+// wishlist.
+func (a *API) WishlistOrder(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	userID := gcontext.GetUserID(ctx)
+	if gcontext.GetUser(ctx) == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+	if claims := gcontext.GetClaims(ctx); claims == nil || claims.Subject != userID {
+		return unauthorizedError("Only the user can order the items of their wishlist")
+	}
+
+	params := &wishlistOrderParams{orderRequestParams: orderRequestParams{Currency: "USD"}}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read Order params: %v", err)
+	}
+
+	query := a.DB(r).Where("user_id = ?", userID)
+	if len(params.Items) > 0 {
+		query = query.Where("id IN (?)", params.Items)
+	}
+	items := []*models.WishlistItem{}
+	if rsp := query.Order("created_at").Find(&items); rsp.Error != nil {
+		return internalServerError("Error while querying for wishlist").WithInternalError(rsp.Error)
+	}
+	if len(items) == 0 || (len(params.Items) > 0 && len(items) != len(params.Items)) {
+		return badRequestError("No wishlist items to order")
+	}
+
+	params.LineItems = make([]*orderLineItem, len(items))
+	ids := make([]string, len(items))
+	for i, item := range items {
+		params.LineItems[i] = &orderLineItem{Sku: item.Sku, Path: item.Path, Quantity: 1}
+		ids[i] = item.ID
+	}
+	order, err := a.createOrder(w, r, &params.orderRequestParams, nil)
+	if err != nil {
+		return err
+	}
+
+	if rsp := a.DB(r).Where("id IN (?)", ids).Delete(&models.WishlistItem{}); rsp.Error != nil {
+		log.WithError(rsp.Error).Errorf("Failed to remove the wishlist items ordered with order %s", order.ID)
+	}
+	return sendJSON(w, http.StatusCreated, order)
+}
+
+func (a *API) loadWishlistItem(r *http.Request) (*models.WishlistItem, *HTTPError) {
+	ctx := r.Context()
+	item := &models.WishlistItem{}
+	rsp := a.DB(r).First(item, "id = ? AND user_id = ?", chi.URLParam(r, "item_id"), gcontext.GetUserID(ctx))
+	if rsp.RecordNotFound() {
+		return nil, notFoundError("Wishlist item not found")
+	}
+	if rsp.Error != nil {
+		return nil, internalServerError("Error while querying for wishlist").WithInternalError(rsp.Error)
+	}
+	return item, nil
+}
+
+// notifyBackInStock marks the wishlist items waiting for the product as
+// notified and queues the emails to their users, sent once the transaction
+// restocking the product has been committed with a link to the unsubscribe
+// endpoint at unsubscribeBase.
+func notifyBackInStock(tx *gorm.DB, log logrus.FieldLogger, instanceID, sku, unsubscribeBase string) {
+	notifications, err := models.MarkBackInStock(tx, instanceID, sku, time.Now())
+	if err != nil {
+		log.WithError(err).Error("Error checking for wishlist notifications")
+		return
+	}
+	if len(notifications) == 0 {
+		return
+	}
+	payload := &backInStockPayload{UnsubscribeBase: unsubscribeBase}
+	for _, notification := range notifications {
+		payload.Items = append(payload.Items, notification.Item.ID)
+	}
+	// items are notified once, so the first one identifies the restock
+	if err := models.EnqueueJob(tx, instanceID, backInStockJob, payload.Items[0], payload); err != nil {
+		log.WithError(err).Error("Error queueing back in stock mails")
+	}
+}
+
+// backInStockJob emails the users of wishlist items that their product is
+// back in stock.
+const backInStockJob = "back_in_stock_mail"
+
+type backInStockPayload struct {
+	Items           []string `json:"items"`
+	UnsubscribeBase string   `json:"unsubscribe_base"`
+}
+
+// runBackInStockJob sends the back in stock mails for the wishlist items of
+// the job to the users that allow marketing emails. Failed mails are logged,
+// retrying the job would send the others twice.
+func runBackInStockJob(ctx context.Context, db *gorm.DB, log logrus.FieldLogger, job *models.Job) error {
+	payload := &backInStockPayload{}
+	if err := json.Unmarshal([]byte(job.Payload), payload); err != nil {
+		return errors.Wrap(err, "Error parsing job payload")
+	}
+	items := []*models.WishlistItem{}
+	if rsp := db.Where("instance_id = ? AND id IN (?)", job.InstanceID, payload.Items).Find(&items); rsp.Error != nil {
+		return rsp.Error
+	}
+	userIDs := make([]string, 0, len(items))
+	for _, item := range items {
+		userIDs = append(userIDs, item.UserID)
+	}
+	users := []*models.User{}
+	if rsp := db.Where("id IN (?)", userIDs).Find(&users); rsp.Error != nil {
+		return rsp.Error
+	}
+	emails := map[string]string{}
+	for _, user := range users {
+		emails[user.ID] = user.Email
+	}
+
+	mailer := gcontext.GetMailer(ctx)
+	for _, item := range items {
+		email := emails[item.UserID]
+		if email == "" || !notificationAllowed(db, log, item.InstanceID, item.UserID, email, models.MarketingNotification) {
+			continue
+		}
+		link, err := unsubscribeLink(db, item.InstanceID, item.UserID, email, payload.UnsubscribeBase)
+		if err != nil {
+			log.WithError(err).WithField("wishlist_item_id", item.ID).Error("Error creating unsubscribe link")
+			continue
+		}
+		if err := mailer.BackInStockMail(email, item, link); err != nil {
+			log.WithError(err).WithField("wishlist_item_id", item.ID).Error("Error sending back in stock mail")
+		}
+	}
+	return nil
+}
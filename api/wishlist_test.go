@@ -0,0 +1,119 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestWishlist(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	admin := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	newTest := func(t *testing.T) (*RouteTest, string) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		return test, "/users/" + test.Data.testUser.ID + "/wishlist"
+	}
+	save := func(test *RouteTest, url, body string) *models.WishlistItem {
+		recorder := test.TestEndpoint(http.MethodPost, url, strings.NewReader(body), test.Data.testUserToken)
+		item := &models.WishlistItem{}
+		extractPayload(t, http.StatusCreated, recorder, item)
+		return item
+	}
+
+	t.Run("Items", func(t *testing.T) {
+		test, url := newTest(t)
+		item := save(test, url, `{"path": "/simple-product"}`)
+		assert.Equal(t, "product-1", item.Sku)
+		assert.Equal(t, "Product 1", item.Title)
+		assert.Equal(t, "Book", item.Type)
+
+		recorder := test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{"path": "/simple-product"}`), test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "This product is already on the wishlist")
+
+		recorder = test.TestEndpoint(http.MethodGet, url, nil, test.Data.testUserToken)
+		items := []*models.WishlistItem{}
+		extractPayload(t, http.StatusOK, recorder, &items)
+		require.Len(t, items, 1)
+
+		recorder = test.TestEndpoint(http.MethodDelete, url+"/"+item.ID, nil, test.Data.testUserToken)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		recorder = test.TestEndpoint(http.MethodGet, url, nil, test.Data.testUserToken)
+		extractPayload(t, http.StatusOK, recorder, &items)
+		assert.Empty(t, items)
+	})
+	t.Run("Order", func(t *testing.T) {
+		test, url := newTest(t)
+		first := save(test, url, `{"path": "/simple-product"}`)
+		save(test, url, `{"path": "/heavy-product"}`)
+
+		body := `{"items": ["` + first.ID + `"], "shipping_address": {"name": "Test User", "address1": "610 22nd Street", "city": "San Francisco", "country": "USA", "zip": "94107"}}`
+		recorder := test.TestEndpoint(http.MethodPost, url+"/order", strings.NewReader(body), admin)
+		validateError(t, http.StatusUnauthorized, recorder)
+
+		recorder = test.TestEndpoint(http.MethodPost, url+"/order", strings.NewReader(body), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		require.Len(t, order.LineItems, 1)
+		assert.Equal(t, "product-1", order.LineItems[0].Sku)
+		assert.EqualValues(t, 1, order.LineItems[0].Quantity)
+
+		recorder = test.TestEndpoint(http.MethodGet, url, nil, test.Data.testUserToken)
+		items := []*models.WishlistItem{}
+		extractPayload(t, http.StatusOK, recorder, &items)
+		require.Len(t, items, 1)
+		assert.Equal(t, "product-heavy", items[0].Sku)
+	})
+	t.Run("BackInStock", func(t *testing.T) {
+		test, url := newTest(t)
+		setStock := func(quantity string) {
+			recorder := test.TestEndpoint(http.MethodPut, "/stock/product-1", strings.NewReader(`{"quantity": `+quantity+`}`), admin)
+			require.Equal(t, http.StatusOK, recorder.Code)
+		}
+		setStock("0")
+		item := save(test, url, `{"path": "/simple-product", "notify_in_stock": true}`)
+		assert.True(t, item.NotifyInStock)
+
+		setStock("0")
+		require.NoError(t, test.DB.First(item, "id = ?", item.ID).Error)
+		assert.Nil(t, item.NotifiedAt)
+
+		setStock("3")
+		require.NoError(t, test.DB.First(item, "id = ?", item.ID).Error)
+		require.NotNil(t, item.NotifiedAt)
+		job := &models.Job{}
+		require.NoError(t, test.DB.Where("type = ?", backInStockJob).First(job).Error)
+		assert.Contains(t, job.Payload, item.ID)
+		test.RunJobs()
+		require.NoError(t, test.DB.First(job, job.ID).Error)
+		assert.True(t, job.Done)
+		assert.False(t, job.Failed)
+
+		// opting in again waits for the next restock
+		recorder := test.TestEndpoint(http.MethodPut, url+"/"+item.ID, strings.NewReader(`{"notify_in_stock": true}`), test.Data.testUserToken)
+		updated := &models.WishlistItem{}
+		extractPayload(t, http.StatusOK, recorder, updated)
+		assert.Nil(t, updated.NotifiedAt)
+
+		// adding to stock that isn't sold out isn't a restock
+		setStock("5")
+		require.NoError(t, test.DB.First(item, "id = ?", item.ID).Error)
+		assert.Nil(t, item.NotifiedAt)
+		setStock("0")
+		setStock("2")
+		require.NoError(t, test.DB.First(item, "id = ?", item.ID).Error)
+		assert.NotNil(t, item.NotifiedAt)
+	})
+	t.Run("OtherUser", func(t *testing.T) {
+		test, url := newTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, testToken("magical-unicorn", ""))
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
@@ -0,0 +1,271 @@
+package assetstores
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	azureVersion          = "2020-12-06"
+	azureDefaultTTL       = 15 * time.Minute
+	azureDelegationKeyTTL = 24 * time.Hour
+	azureIdentityTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+	azureStorageResource  = "https://storage.azure.com/"
+	azureTimeFormat       = "2006-01-02T15:04:05Z"
+	azureEndpointSuffix   = "core.windows.net"
+)
+
+// azureProvider signs blob URLs with SAS tokens. It signs with the account key
+// of a connection string, or with a user delegation key requested with the
+// managed identity of the host if no connection string is configured.
+type azureProvider struct {
+	client   *http.Client
+	account  string
+	endpoint *url.URL
+	key      []byte
+	clientID string
+	ttl      time.Duration
+}
+
+// azureDelegationKeys caches the user delegation keys across the stores of
+// requests, keyed by account and identity.
+var azureDelegationKeys = struct {
+	sync.Mutex
+	keys map[string]*azureDelegationKey
+}{keys: map[string]*azureDelegationKey{}}
+
+type azureDelegationKey struct {
+	SignedOid     string `xml:"SignedOid"`
+	SignedTid     string `xml:"SignedTid"`
+	SignedStart   string `xml:"SignedStart"`
+	SignedExpiry  string `xml:"SignedExpiry"`
+	SignedService string `xml:"SignedService"`
+	SignedVersion string `xml:"SignedVersion"`
+	Value         string `xml:"Value"`
+
+	expiry time.Time
+	key    []byte
+}
+
+func newAzureProvider(connectionString, account, clientID string, ttl time.Duration) (*azureProvider, error) {
+	if ttl <= 0 {
+		ttl = azureDefaultTTL
+	}
+	provider := &azureProvider{
+		client:   &http.Client{Timeout: 30 * time.Second},
+		clientID: clientID,
+		ttl:      ttl,
+	}
+
+	settings := map[string]string{}
+	for _, part := range strings.Split(connectionString, ";") {
+		if kv := strings.SplitN(part, "=", 2); len(kv) == 2 {
+			settings[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+
+	if connectionString != "" {
+		account = settings["AccountName"]
+		if account == "" || settings["AccountKey"] == "" {
+			return nil, errors.New("Azure connection string is missing the account name or key")
+		}
+		key, err := base64.StdEncoding.DecodeString(settings["AccountKey"])
+		if err != nil {
+			return nil, errors.Wrap(err, "Error decoding Azure account key")
+		}
+		provider.key = key
+	} else if account == "" {
+		return nil, errors.New("No connection string or account name configured for Azure Blob Storage")
+	}
+	provider.account = account
+
+	endpoint := settings["BlobEndpoint"]
+	if endpoint == "" {
+		suffix := settings["EndpointSuffix"]
+		if suffix == "" {
+			suffix = azureEndpointSuffix
+		}
+		endpoint = fmt.Sprintf("https://%s.blob.%s", account, suffix)
+	}
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error parsing Azure blob endpoint")
+	}
+	provider.endpoint = parsed
+
+	return provider, nil
+}
+
+// SignURL returns the blob URL with a read only SAS token.
+func (a *azureProvider) SignURL(downloadURL string) (string, error) {
+	u, err := url.Parse(downloadURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Host != a.endpoint.Host {
+		return "", errors.New("Download URL didn't match the Azure Blob Storage account")
+	}
+	blobPath := strings.TrimPrefix(u.Path, strings.TrimSuffix(a.endpoint.Path, "/"))
+	if strings.Count(strings.Trim(blobPath, "/"), "/") < 1 {
+		return "", errors.New("Download URL is missing the container or blob")
+	}
+
+	now := time.Now().UTC()
+	start := now.Add(-5 * time.Minute).Format(azureTimeFormat)
+	expiry := now.Add(a.ttl).Format(azureTimeFormat)
+	resource := "/blob/" + a.account + blobPath
+
+	query := url.Values{}
+	query.Set("sv", azureVersion)
+	query.Set("sr", "b")
+	query.Set("sp", "r")
+	query.Set("st", start)
+	query.Set("se", expiry)
+	query.Set("spr", "https")
+
+	var stringToSign string
+	var key []byte
+	if a.key != nil {
+		key = a.key
+		stringToSign = strings.Join([]string{
+			"r", start, expiry, resource,
+			"", // signed identifier
+			"", // signed IP
+			"https", azureVersion, "b",
+			"",                 // snapshot time
+			"",                 // encryption scope
+			"", "", "", "", "", // response headers
+		}, "\n")
+	} else {
+		delegationKey, err := a.userDelegationKey(now)
+		if err != nil {
+			return "", err
+		}
+		key = delegationKey.key
+		query.Set("skoid", delegationKey.SignedOid)
+		query.Set("sktid", delegationKey.SignedTid)
+		query.Set("skt", delegationKey.SignedStart)
+		query.Set("ske", delegationKey.SignedExpiry)
+		query.Set("sks", delegationKey.SignedService)
+		query.Set("skv", delegationKey.SignedVersion)
+		stringToSign = strings.Join([]string{
+			"r", start, expiry, resource,
+			delegationKey.SignedOid, delegationKey.SignedTid,
+			delegationKey.SignedStart, delegationKey.SignedExpiry,
+			delegationKey.SignedService, delegationKey.SignedVersion,
+			"", // authorized user object ID
+			"", // unauthorized user object ID
+			"", // correlation ID
+			"", // signed IP
+			"https", azureVersion, "b",
+			"",                 // snapshot time
+			"",                 // encryption scope
+			"", "", "", "", "", // response headers
+		}, "\n")
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign))
+	query.Set("sig", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+
+	u.Scheme = "https"
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// userDelegationKey returns the cached user delegation key, or requests a new
+// one with the managed identity once it's about to expire.
+func (a *azureProvider) userDelegationKey(now time.Time) (*azureDelegationKey, error) {
+	azureDelegationKeys.Lock()
+	defer azureDelegationKeys.Unlock()
+
+	cacheKey := a.account + "/" + a.clientID
+	if key, ok := azureDelegationKeys.keys[cacheKey]; ok && key.expiry.After(now.Add(a.ttl+time.Hour)) {
+		return key, nil
+	}
+
+	token, err := a.identityToken()
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, `<?xml version="1.0" encoding="utf-8"?><KeyInfo><Start>%s</Start><Expiry>%s</Expiry></KeyInfo>`,
+		now.Add(-5*time.Minute).Format(azureTimeFormat), now.Add(azureDelegationKeyTTL).Format(azureTimeFormat))
+	keyURL := *a.endpoint
+	keyURL.Path = strings.TrimSuffix(keyURL.Path, "/") + "/"
+	keyURL.RawQuery = "restype=service&comp=userdelegationkey"
+	req, err := http.NewRequest("POST", keyURL.String(), &body)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error creating user delegation key request")
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("x-ms-version", azureVersion)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error requesting user delegation key")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error requesting user delegation key: %s", resp.Status)
+	}
+
+	key := &azureDelegationKey{}
+	if err := xml.NewDecoder(resp.Body).Decode(key); err != nil {
+		return nil, errors.Wrap(err, "Error parsing user delegation key")
+	}
+	if key.key, err = base64.StdEncoding.DecodeString(key.Value); err != nil {
+		return nil, errors.Wrap(err, "Error decoding user delegation key")
+	}
+	if key.expiry, err = time.Parse(azureTimeFormat, key.SignedExpiry); err != nil {
+		return nil, errors.Wrap(err, "Error parsing user delegation key expiry")
+	}
+	azureDelegationKeys.keys[cacheKey] = key
+	return key, nil
+}
+
+// identityToken requests a storage access token for the managed identity of
+// the host from the instance metadata service.
+func (a *azureProvider) identityToken() (string, error) {
+	query := url.Values{}
+	query.Set("api-version", "2018-02-01")
+	query.Set("resource", azureStorageResource)
+	if a.clientID != "" {
+		query.Set("client_id", a.clientID)
+	}
+	req, err := http.NewRequest("GET", azureIdentityTokenURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", errors.Wrap(err, "Error creating managed identity token request")
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "Error requesting managed identity token")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Error requesting managed identity token: %s", resp.Status)
+	}
+
+	token := struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", errors.Wrap(err, "Error parsing managed identity token")
+	}
+	return token.AccessToken, nil
+}
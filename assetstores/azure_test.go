@@ -0,0 +1,101 @@
+package assetstores
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func azureSignature(key []byte, stringToSign ...string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.Join(stringToSign, "\n")))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestAzureSignURL(t *testing.T) {
+	accountKey := []byte("the account key of wayne industries")
+	connectionString := "DefaultEndpointsProtocol=https;AccountName=wayneassets;AccountKey=" + base64.StdEncoding.EncodeToString(accountKey) + ";EndpointSuffix=core.windows.net"
+
+	t.Run("AccountKey", func(t *testing.T) {
+		store, err := newAzureProvider(connectionString, "", "", 10*time.Minute)
+		require.NoError(t, err)
+		signed, err := store.SignURL("https://wayneassets.blob.core.windows.net/ebooks/batwing.pdf")
+		require.NoError(t, err)
+
+		u, err := url.Parse(signed)
+		require.NoError(t, err)
+		assert.Equal(t, "wayneassets.blob.core.windows.net", u.Host)
+		assert.Equal(t, "/ebooks/batwing.pdf", u.Path)
+		query := u.Query()
+		assert.Equal(t, "r", query.Get("sp"))
+		assert.Equal(t, "b", query.Get("sr"))
+		assert.Equal(t, "https", query.Get("spr"))
+		start, err := time.Parse(azureTimeFormat, query.Get("st"))
+		require.NoError(t, err)
+		expiry, err := time.Parse(azureTimeFormat, query.Get("se"))
+		require.NoError(t, err)
+		assert.Equal(t, 15*time.Minute, expiry.Sub(start))
+
+		expected := azureSignature(accountKey,
+			"r", query.Get("st"), query.Get("se"), "/blob/wayneassets/ebooks/batwing.pdf",
+			"", "", "https", azureVersion, "b", "", "", "", "", "", "", "")
+		assert.Equal(t, expected, query.Get("sig"))
+	})
+	t.Run("UserDelegationKey", func(t *testing.T) {
+		delegationKey := []byte("the delegation key of the managed identity")
+		azureDelegationKeys.Lock()
+		azureDelegationKeys.keys["wayneassets/batcomputer"] = &azureDelegationKey{
+			SignedOid:     "oid",
+			SignedTid:     "tid",
+			SignedStart:   "2026-01-01T00:00:00Z",
+			SignedExpiry:  "2026-01-02T00:00:00Z",
+			SignedService: "b",
+			SignedVersion: azureVersion,
+			expiry:        time.Now().Add(azureDelegationKeyTTL),
+			key:           delegationKey,
+		}
+		azureDelegationKeys.Unlock()
+		defer func() {
+			azureDelegationKeys.Lock()
+			delete(azureDelegationKeys.keys, "wayneassets/batcomputer")
+			azureDelegationKeys.Unlock()
+		}()
+
+		store, err := newAzureProvider("", "wayneassets", "batcomputer", 0)
+		require.NoError(t, err)
+		signed, err := store.SignURL("https://wayneassets.blob.core.windows.net/ebooks/batwing.pdf")
+		require.NoError(t, err)
+
+		u, err := url.Parse(signed)
+		require.NoError(t, err)
+		query := u.Query()
+		assert.Equal(t, "oid", query.Get("skoid"))
+		assert.Equal(t, "tid", query.Get("sktid"))
+		expected := azureSignature(delegationKey,
+			"r", query.Get("st"), query.Get("se"), "/blob/wayneassets/ebooks/batwing.pdf",
+			"oid", "tid", "2026-01-01T00:00:00Z", "2026-01-02T00:00:00Z", "b", azureVersion,
+			"", "", "", "", "https", azureVersion, "b", "", "", "", "", "", "", "")
+		assert.Equal(t, expected, query.Get("sig"))
+	})
+	t.Run("OtherAccount", func(t *testing.T) {
+		store, err := newAzureProvider(connectionString, "", "", 0)
+		require.NoError(t, err)
+		_, err = store.SignURL("https://otherassets.blob.core.windows.net/ebooks/batwing.pdf")
+		assert.Error(t, err)
+		_, err = store.SignURL("https://wayneassets.blob.core.windows.net/batwing.pdf")
+		assert.Error(t, err)
+	})
+	t.Run("InvalidConnectionString", func(t *testing.T) {
+		_, err := newAzureProvider("AccountName=wayneassets", "", "", 0)
+		assert.Error(t, err)
+		_, err = newAzureProvider("", "", "", 0)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,151 @@
+package assetstores
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const cloudFrontDefaultTTL = 15 * time.Minute
+
+// cloudFrontProvider signs download URLs with a canned policy of a CloudFront
+// key pair, so the assets are served from the edge locations of the
+// distribution.
+type cloudFrontProvider struct {
+	domain    string
+	keyPairID string
+	key       *rsa.PrivateKey
+	ttl       time.Duration
+}
+
+type cloudFrontKey struct {
+	KeyPairID  string `json:"key_pair_id"`
+	PrivateKey string `json:"private_key"`
+}
+
+// cloudFrontKeyFiles caches the keys read from key files until the files are
+// modified, so keys can be rotated by replacing the file.
+var cloudFrontKeyFiles = struct {
+	sync.Mutex
+	keys map[string]*cloudFrontKeyFile
+}{keys: map[string]*cloudFrontKeyFile{}}
+
+type cloudFrontKeyFile struct {
+	modTime time.Time
+	key     *cloudFrontKey
+}
+
+func newCloudFrontProvider(domain, keyPairID, privateKey, keyFile string, ttl time.Duration) (*cloudFrontProvider, error) {
+	key := &cloudFrontKey{KeyPairID: keyPairID, PrivateKey: privateKey}
+	if keyFile != "" {
+		var err error
+		if key, err = readCloudFrontKeyFile(keyFile); err != nil {
+			return nil, err
+		}
+	}
+	if key.KeyPairID == "" || key.PrivateKey == "" {
+		return nil, errors.New("No key pair configured for CloudFront")
+	}
+
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return nil, errors.New("CloudFront private key is not PEM encoded")
+	}
+	rsaKey, err := parseRSAPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error parsing CloudFront private key")
+	}
+
+	if ttl <= 0 {
+		ttl = cloudFrontDefaultTTL
+	}
+	return &cloudFrontProvider{
+		domain:    domain,
+		keyPairID: key.KeyPairID,
+		key:       rsaKey,
+		ttl:       ttl,
+	}, nil
+}
+
+func readCloudFrontKeyFile(path string) (*cloudFrontKey, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading CloudFront key file")
+	}
+
+	cloudFrontKeyFiles.Lock()
+	defer cloudFrontKeyFiles.Unlock()
+	if cached, ok := cloudFrontKeyFiles.keys[path]; ok && cached.modTime.Equal(info.ModTime()) {
+		return cached.key, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading CloudFront key file")
+	}
+	key := &cloudFrontKey{}
+	if err := json.Unmarshal(data, key); err != nil {
+		return nil, errors.Wrap(err, "Error parsing CloudFront key file")
+	}
+	cloudFrontKeyFiles.keys[path] = &cloudFrontKeyFile{modTime: info.ModTime(), key: key}
+	return key, nil
+}
+
+// SignURL returns the URL signed with a canned policy. URLs of other hosts,
+// e.g. the S3 bucket behind the distribution, are moved to the domain of the
+// distribution if one is configured.
+func (c *cloudFrontProvider) SignURL(downloadURL string) (string, error) {
+	u, err := url.Parse(downloadURL)
+	if err != nil {
+		return "", err
+	}
+	if c.domain != "" {
+		u.Host = c.domain
+	}
+	if u.Host == "" {
+		return "", errors.New("Download URL is missing the host")
+	}
+	u.Scheme = "https"
+
+	resource := u.String()
+	quotedResource, err := json.Marshal(resource)
+	if err != nil {
+		return "", err
+	}
+	expires := time.Now().Add(c.ttl).Unix()
+	policy := fmt.Sprintf(`{"Statement":[{"Resource":%s,"Condition":{"DateLessThan":{"AWS:EpochTime":%d}}}]}`, quotedResource, expires)
+	digest := sha1.Sum([]byte(policy))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA1, digest[:])
+	if err != nil {
+		return "", errors.Wrap(err, "Error generating signature")
+	}
+
+	params := url.Values{}
+	params.Set("Expires", fmt.Sprintf("%d", expires))
+	params.Set("Signature", cloudFrontEncode(signature))
+	params.Set("Key-Pair-Id", c.keyPairID)
+	separator := "?"
+	if u.RawQuery != "" {
+		separator = "&"
+	}
+	return resource + separator + params.Encode(), nil
+}
+
+// cloudFrontEncode base64 encodes the signature with the characters that are
+// invalid in query strings replaced, as CloudFront expects it.
+func cloudFrontEncode(signature []byte) string {
+	return strings.NewReplacer("+", "-", "=", "_", "/", "~").Replace(base64.StdEncoding.EncodeToString(signature))
+}
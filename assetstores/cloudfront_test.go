@@ -0,0 +1,95 @@
+package assetstores
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// verifyCloudFrontURL checks the canned policy signature of the URL and
+// returns the URL without the signature.
+func verifyCloudFrontURL(t *testing.T, key *rsa.PrivateKey, keyPairID, signed string) string {
+	query := mustQuery(t, signed)
+	assert.Equal(t, keyPairID, query.Get("Key-Pair-Id"))
+
+	i := strings.LastIndex(signed, "Expires=")
+	require.True(t, i > 0)
+	resource := signed[:i-1]
+	quotedResource, err := json.Marshal(resource)
+	require.NoError(t, err)
+	policy := fmt.Sprintf(`{"Statement":[{"Resource":%s,"Condition":{"DateLessThan":{"AWS:EpochTime":%s}}}]}`, quotedResource, query.Get("Expires"))
+	digest := sha1.Sum([]byte(policy))
+
+	encoded := strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(query.Get("Signature"))
+	signature, err := base64.StdEncoding.DecodeString(encoded)
+	require.NoError(t, err)
+	assert.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA1, digest[:], signature))
+	return resource
+}
+
+func mustQuery(t *testing.T, rawURL string) url.Values {
+	u, err := url.Parse(rawURL)
+	require.NoError(t, err)
+	return u.Query()
+}
+
+func TestCloudFrontSignURL(t *testing.T) {
+	key, pemKey := testRSAKey(t)
+
+	t.Run("Domain", func(t *testing.T) {
+		store, err := newCloudFrontProvider("d111111abcdef8.cloudfront.net", "APKAWAYNE", pemKey, "", 10*time.Minute)
+		require.NoError(t, err)
+		before := time.Now()
+		signed, err := store.SignURL("https://wayne-assets.s3.amazonaws.com/ebooks/batwing.pdf")
+		require.NoError(t, err)
+
+		assert.Equal(t, "https://d111111abcdef8.cloudfront.net/ebooks/batwing.pdf", verifyCloudFrontURL(t, key, "APKAWAYNE", signed))
+		var expires int64
+		_, err = fmt.Sscan(mustQuery(t, signed).Get("Expires"), &expires)
+		require.NoError(t, err)
+		assert.InDelta(t, before.Add(10*time.Minute).Unix(), expires, 1)
+	})
+	t.Run("Query", func(t *testing.T) {
+		store, err := newCloudFrontProvider("", "APKAWAYNE", pemKey, "", 0)
+		require.NoError(t, err)
+		signed, err := store.SignURL("http://assets.wayneindustries.com/batwing.zip?version=2")
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(signed, "https://assets.wayneindustries.com/batwing.zip?version=2&"))
+		assert.Equal(t, "2", mustQuery(t, signed).Get("version"))
+		verifyCloudFrontURL(t, key, "APKAWAYNE", signed)
+	})
+	t.Run("KeyFile", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "cloudfront")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		keyFile := filepath.Join(dir, "key.json")
+		data, err := json.Marshal(cloudFrontKey{KeyPairID: "APKAROTATED", PrivateKey: pemKey})
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(keyFile, data, 0600))
+
+		store, err := newCloudFrontProvider("d111111abcdef8.cloudfront.net", "APKAWAYNE", "", keyFile, 0)
+		require.NoError(t, err)
+		signed, err := store.SignURL("https://wayne-assets.s3.amazonaws.com/batwing.zip")
+		require.NoError(t, err)
+		verifyCloudFrontURL(t, key, "APKAROTATED", signed)
+	})
+	t.Run("MissingKey", func(t *testing.T) {
+		_, err := newCloudFrontProvider("d111111abcdef8.cloudfront.net", "APKAWAYNE", "", "", 0)
+		assert.Error(t, err)
+		_, err = newCloudFrontProvider("d111111abcdef8.cloudfront.net", "APKAWAYNE", "not a key", "", 0)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,149 @@
+package assetstores
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	gcsHost       = "storage.googleapis.com"
+	gcsAlgorithm  = "GOOG4-RSA-SHA256"
+	gcsDefaultTTL = time.Hour
+	gcsMaxTTL     = 7 * 24 * time.Hour
+)
+
+type gcsProvider struct {
+	email string
+	key   *rsa.PrivateKey
+	ttl   time.Duration
+}
+
+type gcsCredentials struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+}
+
+func newGCSProvider(credentials string, ttl time.Duration) (*gcsProvider, error) {
+	if credentials == "" {
+		return nil, errors.New("No service account credentials configured for Google Cloud Storage")
+	}
+	creds := &gcsCredentials{}
+	if err := json.Unmarshal([]byte(credentials), creds); err != nil {
+		return nil, errors.Wrap(err, "Error parsing Google Cloud Storage credentials")
+	}
+	if creds.ClientEmail == "" {
+		return nil, errors.New("Google Cloud Storage credentials are missing the client email")
+	}
+
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return nil, errors.New("Google Cloud Storage credentials are missing the private key")
+	}
+	key, err := parseRSAPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error parsing Google Cloud Storage private key")
+	}
+
+	if ttl <= 0 {
+		ttl = gcsDefaultTTL
+	}
+	if ttl > gcsMaxTTL {
+		ttl = gcsMaxTTL
+	}
+
+	return &gcsProvider{
+		email: creds.ClientEmail,
+		key:   key,
+		ttl:   ttl,
+	}, nil
+}
+
+// SignURL returns a V4 signed URL for a gs://bucket/object or
+// https://storage.googleapis.com/bucket/object URL.
+func (g *gcsProvider) SignURL(downloadURL string) (string, error) {
+	u, err := url.Parse(downloadURL)
+	if err != nil {
+		return "", err
+	}
+	var path string
+	switch {
+	case u.Scheme == "gs":
+		path = "/" + u.Host + u.Path
+	case u.Host == gcsHost:
+		path = u.Path
+	default:
+		return "", errors.New("Download URL didn't match Google Cloud Storage")
+	}
+	if strings.Count(strings.Trim(path, "/"), "/") < 1 {
+		return "", errors.New("Download URL is missing the bucket or object")
+	}
+
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = gcsEscape(segment)
+	}
+	path = strings.Join(segments, "/")
+
+	now := time.Now().UTC()
+	datetime := now.Format("20060102T150405Z")
+	scope := fmt.Sprintf("%s/auto/storage/goog4_request", now.Format("20060102"))
+
+	query := map[string]string{
+		"X-Goog-Algorithm":     gcsAlgorithm,
+		"X-Goog-Credential":    g.email + "/" + scope,
+		"X-Goog-Date":          datetime,
+		"X-Goog-Expires":       fmt.Sprintf("%d", int64(g.ttl/time.Second)),
+		"X-Goog-SignedHeaders": "host",
+	}
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	params := make([]string, len(keys))
+	for i, key := range keys {
+		params[i] = gcsEscape(key) + "=" + gcsEscape(query[key])
+	}
+	canonicalQuery := strings.Join(params, "&")
+
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		path,
+		canonicalQuery,
+		"host:" + gcsHost + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		gcsAlgorithm,
+		datetime,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	digest := sha256.Sum256([]byte(stringToSign))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, g.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", errors.Wrap(err, "Error generating signature")
+	}
+
+	return "https://" + gcsHost + path + "?" + canonicalQuery + "&X-Goog-Signature=" + hex.EncodeToString(signature), nil
+}
+
+// gcsEscape percent-encodes everything but the unreserved characters of RFC 3986.
+func gcsEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
@@ -0,0 +1,93 @@
+package assetstores
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testRSAKey(t *testing.T) (*rsa.PrivateKey, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+func testGCSCredentials(t *testing.T) (*rsa.PrivateKey, string) {
+	key, pemKey := testRSAKey(t)
+	credentials, err := json.Marshal(gcsCredentials{ClientEmail: "downloads@wayne-industries.iam.gserviceaccount.com", PrivateKey: pemKey})
+	require.NoError(t, err)
+	return key, string(credentials)
+}
+
+func TestGCSSignURL(t *testing.T) {
+	key, credentials := testGCSCredentials(t)
+	store, err := newGCSProvider(credentials, 10*time.Minute)
+	require.NoError(t, err)
+
+	for _, downloadURL := range []string{
+		"gs://wayne-assets/ebooks/the plans of the batwing.pdf",
+		"https://storage.googleapis.com/wayne-assets/ebooks/the%20plans%20of%20the%20batwing.pdf",
+	} {
+		signed, err := store.SignURL(downloadURL)
+		require.NoError(t, err)
+
+		u, err := url.Parse(signed)
+		require.NoError(t, err)
+		assert.Equal(t, "https", u.Scheme)
+		assert.Equal(t, gcsHost, u.Host)
+		assert.Equal(t, "/wayne-assets/ebooks/the%20plans%20of%20the%20batwing.pdf", u.EscapedPath())
+
+		query := u.Query()
+		assert.Equal(t, gcsAlgorithm, query.Get("X-Goog-Algorithm"))
+		assert.Equal(t, "600", query.Get("X-Goog-Expires"))
+		assert.Equal(t, "host", query.Get("X-Goog-SignedHeaders"))
+		credential := strings.SplitN(query.Get("X-Goog-Credential"), "/", 2)
+		require.Len(t, credential, 2)
+		assert.Equal(t, "downloads@wayne-industries.iam.gserviceaccount.com", credential[0])
+
+		canonicalQuery := strings.Split(u.RawQuery, "&X-Goog-Signature=")[0]
+		canonicalRequest := strings.Join([]string{"GET", u.EscapedPath(), canonicalQuery, "host:" + gcsHost + "\n", "host", "UNSIGNED-PAYLOAD"}, "\n")
+		requestHash := sha256.Sum256([]byte(canonicalRequest))
+		stringToSign := strings.Join([]string{gcsAlgorithm, query.Get("X-Goog-Date"), credential[1], hex.EncodeToString(requestHash[:])}, "\n")
+		digest := sha256.Sum256([]byte(stringToSign))
+		signature, err := hex.DecodeString(query.Get("X-Goog-Signature"))
+		require.NoError(t, err)
+		assert.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature))
+	}
+
+	t.Run("MaxTTL", func(t *testing.T) {
+		store, err := newGCSProvider(credentials, 30*24*time.Hour)
+		require.NoError(t, err)
+		signed, err := store.SignURL("gs://wayne-assets/batwing.zip")
+		require.NoError(t, err)
+		u, err := url.Parse(signed)
+		require.NoError(t, err)
+		assert.Equal(t, "604800", u.Query().Get("X-Goog-Expires"))
+	})
+	t.Run("OtherHost", func(t *testing.T) {
+		_, err := store.SignURL("https://cdn.example.com/wayne-assets/batwing.zip")
+		assert.Error(t, err)
+		_, err = store.SignURL("gs://wayne-assets")
+		assert.Error(t, err)
+	})
+	t.Run("InvalidCredentials", func(t *testing.T) {
+		_, err := newGCSProvider("", 0)
+		assert.Error(t, err)
+		_, err = newGCSProvider(`{"client_email": "downloads@wayne-industries.iam.gserviceaccount.com", "private_key": "not a key"}`, 0)
+		assert.Error(t, err)
+	})
+}
@@ -1,7 +1,12 @@
 package assetstores
 
 import (
+	"crypto/rsa"
+	"crypto/x509"
 	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
 
 	"github.com/netlify/gocommerce/conf"
 )
@@ -16,9 +21,31 @@ func NewStore(config *conf.Configuration) (Store, error) {
 	switch config.Downloads.Provider {
 	case "netlify":
 		return newNetlifyProvider(config.Downloads.NetlifyToken)
+	case "azure":
+		azure := config.Downloads.Azure
+		return newAzureProvider(azure.ConnectionString, azure.AccountName, azure.ClientID, time.Duration(azure.TTL)*time.Second)
+	case "cloudfront":
+		cf := config.Downloads.CloudFront
+		return newCloudFrontProvider(cf.Domain, cf.KeyPairID, cf.PrivateKey, cf.KeyFile, time.Duration(cf.TTL)*time.Second)
+	case "gcs":
+		gcs := config.Downloads.GCS
+		return newGCSProvider(gcs.Credentials, time.Duration(gcs.TTL)*time.Second)
 	case "":
 		return newNoopProvider()
 	default:
 		return nil, fmt.Errorf("Unknown asset store provider '%v'", config.Downloads.Provider)
 	}
 }
+
+// parseRSAPrivateKey parses a PKCS #8 or PKCS #1 encoded RSA private key.
+func parseRSAPrivateKey(der []byte) (*rsa.PrivateKey, error) {
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return x509.ParsePKCS1PrivateKey(der)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("Private key is not an RSA key")
+	}
+	return key, nil
+}
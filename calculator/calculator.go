@@ -1,6 +1,7 @@
 package calculator
 
 import (
+	"encoding/json"
 	"math"
 	"strconv"
 
@@ -11,8 +12,10 @@ import (
 // DiscountItem provides details about a discount that was applied
 type DiscountItem struct {
 	Type       DiscountType `json:"type"`
+	Code       string       `json:"code,omitempty"`
 	Percentage uint64       `json:"percentage"`
 	Fixed      uint64       `json:"fixed"`
+	Amount     uint64       `json:"amount"`
 }
 
 // Price represents the total price of all line items.
@@ -24,12 +27,19 @@ type Price struct {
 	NetTotal uint64
 	Taxes    uint64
 	Total    int64
+
+	// Rules are the names of the cart rules that gave a discount.
+	Rules []string
 }
 
 // ItemPrice is the price of a single line item.
 type ItemPrice struct {
 	Quantity uint64
 
+	// UnitPrice is the price of a single unit the item was priced at, which
+	// is the price of its tier for items with quantity-break prices.
+	UnitPrice uint64
+
 	Subtotal uint64
 	Discount uint64
 	NetTotal uint64
@@ -37,6 +47,20 @@ type ItemPrice struct {
 	Total    int64
 
 	DiscountItems []DiscountItem
+
+	// TaxRates are the taxes charged on a single unit of the item, at the
+	// rates in effect when it was priced.
+	TaxRates []TaxRate
+}
+
+// TaxRate is a tax charged on an item at the Rate, in percent, of the
+// Jurisdiction the order is taxed in, which is its country for the taxes of
+// the settings. TaxableAmount is the part of the price taxed at the rate.
+type TaxRate struct {
+	Rate          float64 `json:"rate"`
+	Jurisdiction  string  `json:"jurisdiction"`
+	TaxableAmount uint64  `json:"taxable_amount"`
+	Amount        uint64  `json:"amount"`
 }
 
 // PaymentMethods settings
@@ -50,6 +74,21 @@ type PaymentMethods struct {
 		ClientID    string `json:"client_id,omitempty"`
 		Environment string `json:"environment,omitempty"`
 	} `json:"paypal"`
+	Adyen struct {
+		Enabled     bool   `json:"enabled"`
+		ClientKey   string `json:"client_key,omitempty"`
+		Environment string `json:"environment,omitempty"`
+	} `json:"adyen"`
+	Manual struct {
+		Enabled      bool   `json:"enabled"`
+		Instructions string `json:"instructions,omitempty"`
+	} `json:"manual"`
+	Coinbase struct {
+		Enabled bool `json:"enabled"`
+	} `json:"coinbase"`
+	Klarna struct {
+		Enabled bool `json:"enabled"`
+	} `json:"klarna"`
 }
 
 // Settings represent the site-wide settings for price calculation.
@@ -57,9 +96,38 @@ type Settings struct {
 	PricesIncludeTaxes bool              `json:"prices_include_taxes"`
 	Taxes              []*Tax            `json:"taxes,omitempty"`
 	MemberDiscounts    []*MemberDiscount `json:"member_discounts,omitempty"`
+	CartRules          []*CartRule       `json:"cart_rules,omitempty"`
 	PaymentMethods     *PaymentMethods   `json:"payment_methods,omitempty"`
+	ShippingMethods    []*ShippingMethod `json:"shipping_methods,omitempty"`
+	ShippingZones      []*ShippingZone   `json:"shipping_zones,omitempty"`
+	PickupLocations    []*PickupLocation `json:"pickup_locations,omitempty"`
+	CustomerGroups     []*CustomerGroup  `json:"customer_groups,omitempty"`
+
+	// CouponStacking decides how the discounts of orders with several
+	// coupons are combined. Defaults to CouponStackingBestOf.
+	CouponStacking string `json:"coupon_stacking,omitempty"`
+
+	// VATCountry is the code of the EU country the seller is registered for
+	// VAT in. Sales to businesses with a valid VAT number of another EU
+	// country are reverse charged if it's set.
+	VATCountry string `json:"vat_country,omitempty"`
+
+	// OrderMetaSchema is a JSON schema the meta of new orders must match.
+	OrderMetaSchema json.RawMessage `json:"order_meta_schema,omitempty"`
 }
 
+// Possible rules for combining the coupons of an order.
+const (
+	// CouponStackingBestOf applies only the coupon giving the highest discount.
+	CouponStackingBestOf = "best_of"
+	// CouponStackingAdditive applies all coupons, adding up their discounts.
+	CouponStackingAdditive = "additive"
+	// CouponStackingCategoryExclusive applies the coupon giving the highest
+	// discount for each product type, so coupons for different product types
+	// can be combined.
+	CouponStackingCategoryExclusive = "category_exclusive"
+)
+
 // Tax represents a tax, potentially specific to countries and product types.
 type Tax struct {
 	Percentage   uint64   `json:"percentage"`
@@ -94,6 +162,14 @@ type PriceParameters struct {
 	Currency string
 	Coupon   Coupon
 	Items    []Item
+	Coupons  []Coupon
+
+	// ReverseCharge zero-rates the order, the buyer accounts for the VAT.
+	ReverseCharge bool
+	// TaxExempt zero-rates the order of a customer exempt from taxes.
+	TaxExempt bool
+	// CustomerGroup is the name of the customer group the order is priced for.
+	CustomerGroup string
 }
 
 // ValidForType returns whether a member discount is valid for a product type.
@@ -139,6 +215,7 @@ type Coupon interface {
 	ValidForProduct(string) bool
 	PercentageDiscount() uint64
 	FixedDiscount(string) uint64
+	CouponCode() string
 }
 
 // FixedDiscount returns what the fixed discount amount is for a particular currency.
@@ -182,21 +259,22 @@ func (t *Tax) AppliesTo(country, productType string) bool {
 	return applies
 }
 
-func calculateAmountsForSingleItem(settings *Settings, lineLogger logrus.FieldLogger, jwtClaims map[string]interface{}, params PriceParameters, item Item, multiplier uint64) ItemPrice {
-	itemPrice := ItemPrice{Quantity: item.GetQuantity()}
+func calculateAmountsForSingleItem(settings *Settings, lineLogger logrus.FieldLogger, jwtClaims map[string]interface{}, params PriceParameters, item Item, group *CustomerGroup, coupons []Coupon, rules []*CartRule, multiplier uint64) ItemPrice {
+	itemPrice := ItemPrice{Quantity: item.GetQuantity(), UnitPrice: item.PriceInLowestUnit()}
 
 	singlePrice := item.PriceInLowestUnit() * multiplier
-	_, itemPrice.Subtotal = calculateTaxes(singlePrice, item, params, settings)
+	_, itemPrice.Subtotal, _ = calculateTaxes(singlePrice, item, params, settings)
 
 	// apply discount to original price
-	coupon := params.Coupon
-	if coupon != nil && coupon.ValidForType(item.ProductType()) && coupon.ValidForProduct(item.ProductSku()) {
+	for _, coupon := range coupons {
 		discountItem := DiscountItem{
 			Type:       DiscountTypeCoupon,
+			Code:       coupon.CouponCode(),
 			Percentage: coupon.PercentageDiscount(),
 			Fixed:      coupon.FixedDiscount(params.Currency) * multiplier,
 		}
-		itemPrice.Discount = calculateDiscount(singlePrice, discountItem.Percentage, discountItem.Fixed)
+		discountItem.Amount = calculateDiscount(singlePrice, discountItem.Percentage, discountItem.Fixed)
+		itemPrice.Discount += discountItem.Amount
 		itemPrice.DiscountItems = append(itemPrice.DiscountItems, discountItem)
 	}
 	if settings != nil && settings.MemberDiscounts != nil {
@@ -209,25 +287,54 @@ func calculateAmountsForSingleItem(settings *Settings, lineLogger logrus.FieldLo
 					Percentage: discount.Percentage,
 					Fixed:      discount.FixedDiscount(params.Currency) * multiplier,
 				}
-				itemPrice.Discount += calculateDiscount(singlePrice, discountItem.Percentage, discountItem.Fixed)
+				discountItem.Amount = calculateDiscount(singlePrice, discountItem.Percentage, discountItem.Fixed)
+				itemPrice.Discount += discountItem.Amount
 				itemPrice.DiscountItems = append(itemPrice.DiscountItems, discountItem)
 			}
 		}
 	}
+	if group != nil && group.Percentage > 0 {
+		discountItem := DiscountItem{
+			Type:       DiscountTypeGroup,
+			Code:       group.Name,
+			Percentage: group.Percentage,
+		}
+		discountItem.Amount = calculateDiscount(singlePrice, discountItem.Percentage, 0)
+		itemPrice.Discount += discountItem.Amount
+		itemPrice.DiscountItems = append(itemPrice.DiscountItems, discountItem)
+	}
+	for _, rule := range rules {
+		if !rule.appliesTo(item) {
+			continue
+		}
+		discountItem := DiscountItem{
+			Type:       DiscountTypeRule,
+			Code:       rule.Name,
+			Percentage: rule.Percentage,
+		}
+		if rule.FreeSku != "" {
+			discountItem.Percentage = 0
+			discountItem.Fixed = rule.freeDiscount(item, multiplier)
+		}
+		discountItem.Amount = calculateDiscount(singlePrice, discountItem.Percentage, discountItem.Fixed)
+		itemPrice.Discount += discountItem.Amount
+		itemPrice.DiscountItems = append(itemPrice.DiscountItems, discountItem)
+	}
 
 	discountedPrice := uint64(0)
 	if itemPrice.Discount < singlePrice {
 		discountedPrice = singlePrice - itemPrice.Discount
 	}
 
-	itemPrice.Taxes, itemPrice.NetTotal = calculateTaxes(discountedPrice, item, params, settings)
+	itemPrice.Taxes, itemPrice.NetTotal, itemPrice.TaxRates = calculateTaxes(discountedPrice, item, params, settings)
 	itemPrice.Total = int64(itemPrice.NetTotal + itemPrice.Taxes)
 
 	return itemPrice
 }
 
 // CalculatePrice will calculate the final total price. It takes into account
-// currency, country, coupons, and discounts.
+// currency, country, quantity-break prices, customer groups, coupons, and
+// discounts.
 func CalculatePrice(settings *Settings, jwtClaims map[string]interface{}, params PriceParameters, log logrus.FieldLogger) Price {
 	price := Price{}
 
@@ -240,13 +347,30 @@ func CalculatePrice(settings *Settings, jwtClaims map[string]interface{}, params
 		}
 	}
 
-	for _, item := range params.Items {
+	// items on the price list of the customer group get its price, the
+	// others its percentage discount
+	group := settings.CustomerGroup(params.CustomerGroup)
+	items := make([]Item, len(params.Items))
+	groupDiscounts := make([]*CustomerGroup, len(params.Items))
+	for i, item := range params.Items {
+		if groupItem, listed := applyGroupPrice(group, item, params.Currency); listed {
+			items[i] = groupItem
+		} else {
+			items[i] = applyPriceTiers(item)
+			groupDiscounts[i] = group
+		}
+	}
+	params.Items = items
+
+	itemCoupons := selectCoupons(settings, params)
+	rules := applicableCartRules(settings, params)
+	for i, item := range params.Items {
 		lineLogger := priceLogger.WithFields(logrus.Fields{
 			"product_type": item.ProductType(),
 			"product_sku":  item.ProductSku(),
 		})
 
-		itemPrice := calculateAmountsForSingleItem(settings, lineLogger, jwtClaims, params, item, 1)
+		itemPrice := calculateAmountsForSingleItem(settings, lineLogger, jwtClaims, params, item, groupDiscounts[i], itemCoupons[i], rules, 1)
 
 		lineLogger.WithFields(
 			logrus.Fields{
@@ -258,9 +382,14 @@ func CalculatePrice(settings *Settings, jwtClaims map[string]interface{}, params
 			}).Info("calculated item price")
 
 		price.Items = append(price.Items, itemPrice)
+		for _, discount := range itemPrice.DiscountItems {
+			if discount.Type == DiscountTypeRule && !hasString(price.Rules, discount.Code) {
+				price.Rules = append(price.Rules, discount.Code)
+			}
+		}
 
 		// avoid issues with rounding when multiplying by quantity before taxation
-		itemPriceMultiple := calculateAmountsForSingleItem(settings, lineLogger, jwtClaims, params, item, item.GetQuantity())
+		itemPriceMultiple := calculateAmountsForSingleItem(settings, lineLogger, jwtClaims, params, item, groupDiscounts[i], itemCoupons[i], rules, item.GetQuantity())
 		price.Subtotal += itemPriceMultiple.Subtotal
 		price.Discount += itemPriceMultiple.Discount
 		price.NetTotal += itemPriceMultiple.NetTotal
@@ -280,6 +409,84 @@ func CalculatePrice(settings *Settings, jwtClaims map[string]interface{}, params
 	return price
 }
 
+// selectCoupons returns the coupons applying to each item according to the
+// coupon stacking rule of the settings.
+func selectCoupons(settings *Settings, params PriceParameters) [][]Coupon {
+	candidates := params.Coupons
+	if params.Coupon != nil {
+		candidates = append([]Coupon{params.Coupon}, candidates...)
+	}
+	subtotal := uint64(0)
+	for _, item := range params.Items {
+		subtotal += item.PriceInLowestUnit() * item.GetQuantity()
+	}
+	coupons := []Coupon{}
+	for _, coupon := range candidates {
+		if coupon.ValidForPrice(params.Currency, subtotal) {
+			coupons = append(coupons, coupon)
+		}
+	}
+	appliesTo := func(coupon Coupon, item Item) bool {
+		return coupon.ValidForType(item.ProductType()) && coupon.ValidForProduct(item.ProductSku())
+	}
+
+	stacking := CouponStackingBestOf
+	if settings != nil && settings.CouponStacking != "" {
+		stacking = settings.CouponStacking
+	}
+
+	selected := make([][]Coupon, len(params.Items))
+	if stacking == CouponStackingAdditive {
+		for i, item := range params.Items {
+			for _, coupon := range coupons {
+				if appliesTo(coupon, item) {
+					selected[i] = append(selected[i], coupon)
+				}
+			}
+		}
+		return selected
+	}
+
+	// the best coupon is chosen for all items, or for the items of each
+	// product type if coupons are exclusive per category
+	groups := map[string][]int{}
+	for i, item := range params.Items {
+		group := ""
+		if stacking == CouponStackingCategoryExclusive {
+			group = item.ProductType()
+		}
+		groups[group] = append(groups[group], i)
+	}
+	for _, indexes := range groups {
+		var best Coupon
+		var bestDiscount uint64
+		for _, coupon := range coupons {
+			applies := false
+			discount := uint64(0)
+			for _, i := range indexes {
+				item := params.Items[i]
+				if appliesTo(coupon, item) {
+					applies = true
+					discount += calculateDiscount(item.PriceInLowestUnit()*item.GetQuantity(), coupon.PercentageDiscount(), coupon.FixedDiscount(params.Currency)*item.GetQuantity())
+				}
+			}
+			if applies && (best == nil || discount > bestDiscount) {
+				best = coupon
+				bestDiscount = discount
+			}
+		}
+		if best == nil {
+			continue
+		}
+		for _, i := range indexes {
+			if appliesTo(best, params.Items[i]) {
+				selected[i] = []Coupon{best}
+			}
+		}
+	}
+	return selected
+}
+
 func calculateDiscount(amountToDiscount, percentage, fixed uint64) uint64 {
 	var discount uint64
 	if percentage > 0 {
@@ -293,7 +500,7 @@ func calculateDiscount(amountToDiscount, percentage, fixed uint64) uint64 {
 	return discount
 }
 
-func calculateTaxes(amountToTax uint64, item Item, params PriceParameters, settings *Settings) (taxes uint64, subtotal uint64) {
+func calculateTaxes(amountToTax uint64, item Item, params PriceParameters, settings *Settings) (taxes uint64, subtotal uint64, rates []TaxRate) {
 	includeTaxes := settings != nil && settings.PricesIncludeTaxes
 	originalPrice := item.PriceInLowestUnit()
 
@@ -331,19 +538,47 @@ func calculateTaxes(amountToTax uint64, item Item, params PriceParameters, setti
 
 	subtotal = 0
 	for _, tax := range taxAmounts {
+		var taxAmount uint64
 		if includeTaxes {
-			taxAmount := rint(float64(tax.price) / float64(100+tax.percentage) * 100 * (float64(tax.percentage) / 100))
+			taxAmount = rint(float64(tax.price) / float64(100+tax.percentage) * 100 * (float64(tax.percentage) / 100))
 			tax.price -= taxAmount
-			taxes += taxAmount
 		} else {
-			taxes += rint(float64(tax.price) * float64(tax.percentage) / 100)
+			taxAmount = rint(float64(tax.price) * float64(tax.percentage) / 100)
 		}
+		taxes += taxAmount
 		subtotal += tax.price
+		rates = addTaxRate(rates, TaxRate{
+			Rate:          float64(tax.percentage),
+			Jurisdiction:  params.Country,
+			TaxableAmount: tax.price,
+			Amount:        taxAmount,
+		})
 	}
 
+	// reverse charged and tax exempt orders are sold at the net price
+	if params.ReverseCharge || params.TaxExempt {
+		taxes = 0
+		rates = nil
+	}
 	return
 }
 
+// addTaxRate adds the tax to the rates, merging it with the tax at the same
+// rate of the same jurisdiction. Untaxed amounts aren't listed.
+func addTaxRate(rates []TaxRate, tax TaxRate) []TaxRate {
+	if tax.Rate == 0 {
+		return rates
+	}
+	for i, rate := range rates {
+		if rate.Rate == tax.Rate && rate.Jurisdiction == tax.Jurisdiction {
+			rates[i].TaxableAmount += tax.TaxableAmount
+			rates[i].Amount += tax.Amount
+			return rates
+		}
+	}
+	return append(rates, tax)
+}
+
 // Nopes - no `round` method in go
 // See https://github.com/golang/go/blob/master/src/math/floor.go#L58
 
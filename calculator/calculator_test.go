@@ -49,16 +49,31 @@ func (t *TestItem) GetQuantity() uint64 {
 	return 1
 }
 
+type TestTieredItem struct {
+	TestItem
+	tiers []PriceTier
+}
+
+func (t *TestTieredItem) PriceTiers() []PriceTier {
+	return t.tiers
+}
+
 type TestCoupon struct {
+	code       string
 	itemSku    string
 	itemType   string
+	allTypes   bool
 	moreThan   uint64
 	percentage uint64
 	fixed      uint64
 }
 
+func (c *TestCoupon) CouponCode() string {
+	return c.code
+}
+
 func (c *TestCoupon) ValidForType(productType string) bool {
-	return c.itemType == productType
+	return c.allTypes || c.itemType == productType
 }
 
 func (c *TestCoupon) ValidForProduct(productSku string) bool {
@@ -88,7 +103,7 @@ func validatePrice(t *testing.T, actual Price, expected Price) {
 }
 
 func TestNoItems(t *testing.T) {
-	params := PriceParameters{"USA", "USD", nil, nil}
+	params := PriceParameters{Country: "USA", Currency: "USD"}
 	price := CalculatePrice(nil, nil, params, testLogger)
 	validatePrice(t, price, Price{
 		Subtotal: 0,
@@ -100,7 +115,7 @@ func TestNoItems(t *testing.T) {
 }
 
 func TestNoTaxes(t *testing.T) {
-	params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test"}}}
+	params := PriceParameters{Country: "USA", Currency: "USD", Items: []Item{&TestItem{price: 100, itemType: "test"}}}
 	price := CalculatePrice(nil, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -113,7 +128,7 @@ func TestNoTaxes(t *testing.T) {
 }
 
 func TestFixedVAT(t *testing.T) {
-	params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
+	params := PriceParameters{Country: "USA", Currency: "USD", Items: []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
 	price := CalculatePrice(nil, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -126,7 +141,7 @@ func TestFixedVAT(t *testing.T) {
 }
 
 func TestFixedVATWhenPricesIncludeTaxes(t *testing.T) {
-	params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
+	params := PriceParameters{Country: "USA", Currency: "USD", Items: []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
 	price := CalculatePrice(&Settings{PricesIncludeTaxes: true}, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -147,7 +162,7 @@ func TestCountryBasedVAT(t *testing.T) {
 		}},
 	}
 
-	params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test"}}}
+	params := PriceParameters{Country: "USA", Currency: "USD", Items: []Item{&TestItem{price: 100, itemType: "test"}}}
 	price := CalculatePrice(settings, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -161,7 +176,7 @@ func TestCountryBasedVAT(t *testing.T) {
 
 func TestCouponWithNoTaxes(t *testing.T) {
 	coupon := &TestCoupon{itemType: "test", percentage: 10}
-	params := PriceParameters{"USA", "USD", coupon, []Item{&TestItem{price: 100, itemType: "test"}}}
+	params := PriceParameters{Country: "USA", Currency: "USD", Coupon: coupon, Items: []Item{&TestItem{price: 100, itemType: "test"}}}
 	price := CalculatePrice(nil, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -175,7 +190,7 @@ func TestCouponWithNoTaxes(t *testing.T) {
 
 func TestCouponWithVAT(t *testing.T) {
 	coupon := &TestCoupon{itemType: "test", percentage: 10}
-	params := PriceParameters{"USA", "USD", coupon, []Item{&TestItem{price: 100, itemType: "test", vat: 10}}}
+	params := PriceParameters{Country: "USA", Currency: "USD", Coupon: coupon, Items: []Item{&TestItem{price: 100, itemType: "test", vat: 10}}}
 	price := CalculatePrice(nil, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -190,7 +205,7 @@ func TestCouponWithVAT(t *testing.T) {
 func TestCouponWithVATWhenPRiceIncludeTaxes(t *testing.T) {
 	coupon := &TestCoupon{itemType: "test", percentage: 10}
 	settings := &Settings{PricesIncludeTaxes: true}
-	params := PriceParameters{"USA", "USD", coupon, []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
+	params := PriceParameters{Country: "USA", Currency: "USD", Coupon: coupon, Items: []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
 	price := CalculatePrice(settings, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -205,7 +220,7 @@ func TestCouponWithVATWhenPRiceIncludeTaxes(t *testing.T) {
 func TestCouponWithVATWhenPRiceIncludeTaxesWithQuantity(t *testing.T) {
 	coupon := &TestCoupon{itemType: "test", percentage: 10}
 	settings := &Settings{PricesIncludeTaxes: true}
-	params := PriceParameters{"USA", "USD", coupon, []Item{&TestItem{quantity: 2, price: 100, itemType: "test", vat: 9}}}
+	params := PriceParameters{Country: "USA", Currency: "USD", Coupon: coupon, Items: []Item{&TestItem{quantity: 2, price: 100, itemType: "test", vat: 9}}}
 	price := CalculatePrice(settings, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -217,6 +232,333 @@ func TestCouponWithVATWhenPRiceIncludeTaxesWithQuantity(t *testing.T) {
 	})
 }
 
+func TestCouponStacking(t *testing.T) {
+	coupons := []Coupon{
+		&TestCoupon{code: "books", itemType: "book", percentage: 10},
+		&TestCoupon{code: "ebooks", itemType: "ebook", percentage: 20},
+		&TestCoupon{code: "all", allTypes: true, percentage: 15},
+	}
+	items := []Item{
+		&TestItem{price: 100, itemType: "book"},
+		&TestItem{price: 100, itemType: "ebook"},
+	}
+	codes := func(item ItemPrice) []string {
+		result := []string{}
+		for _, discount := range item.DiscountItems {
+			result = append(result, discount.Code)
+		}
+		return result
+	}
+
+	t.Run("BestOf", func(t *testing.T) {
+		params := PriceParameters{Country: "USA", Currency: "USD", Items: items, Coupons: coupons}
+		price := CalculatePrice(&Settings{}, nil, params, testLogger)
+		assert.Equal(t, uint64(30), price.Discount)
+		assert.Equal(t, []string{"all"}, codes(price.Items[0]))
+		assert.Equal(t, []string{"all"}, codes(price.Items[1]))
+		assert.Equal(t, uint64(15), price.Items[0].DiscountItems[0].Amount)
+	})
+	t.Run("Additive", func(t *testing.T) {
+		params := PriceParameters{Country: "USA", Currency: "USD", Items: items, Coupons: coupons}
+		price := CalculatePrice(&Settings{CouponStacking: CouponStackingAdditive}, nil, params, testLogger)
+		assert.Equal(t, uint64(60), price.Discount)
+		assert.Equal(t, int64(140), price.Total)
+		assert.Equal(t, []string{"books", "all"}, codes(price.Items[0]))
+		assert.Equal(t, []string{"ebooks", "all"}, codes(price.Items[1]))
+	})
+	t.Run("CategoryExclusive", func(t *testing.T) {
+		params := PriceParameters{Country: "USA", Currency: "USD", Items: items, Coupons: coupons}
+		price := CalculatePrice(&Settings{CouponStacking: CouponStackingCategoryExclusive}, nil, params, testLogger)
+		assert.Equal(t, uint64(35), price.Discount)
+		assert.Equal(t, []string{"all"}, codes(price.Items[0]))
+		assert.Equal(t, []string{"ebooks"}, codes(price.Items[1]))
+	})
+}
+
+func TestCouponMinimumAmount(t *testing.T) {
+	coupon := &TestCoupon{code: "OVER-20", allTypes: true, moreThan: 2000, percentage: 10}
+	item := &TestItem{price: 1000, itemType: "book", quantity: 2}
+
+	params := PriceParameters{Country: "USA", Currency: "USD", Coupon: coupon, Items: []Item{item}}
+	price := CalculatePrice(nil, nil, params, testLogger)
+	assert.Equal(t, uint64(0), price.Discount)
+
+	item.quantity = 3
+	price = CalculatePrice(nil, nil, params, testLogger)
+	assert.Equal(t, uint64(300), price.Discount)
+}
+
+func TestReverseCharge(t *testing.T) {
+	settings := &Settings{
+		VATCountry: "DE",
+		Taxes: []*Tax{&Tax{
+			Percentage:   21,
+			ProductTypes: []string{"test"},
+			Countries:    []string{"Netherlands"},
+		}},
+	}
+
+	params := PriceParameters{Country: "Netherlands", Currency: "EUR", Items: []Item{&TestItem{price: 100, itemType: "test", vat: 9}}, ReverseCharge: true}
+	price := CalculatePrice(settings, nil, params, testLogger)
+	validatePrice(t, price, Price{
+		Subtotal: 100,
+		NetTotal: 100,
+		Taxes:    0,
+		Total:    100,
+	})
+
+	settings.PricesIncludeTaxes = true
+	params.Items = []Item{&TestItem{price: 121, itemType: "test"}}
+	price = CalculatePrice(settings, nil, params, testLogger)
+	validatePrice(t, price, Price{
+		Subtotal: 100,
+		NetTotal: 100,
+		Taxes:    0,
+		Total:    100,
+	})
+
+	assert.True(t, ReverseChargeApplies(settings, "NL"))
+	assert.True(t, ReverseChargeApplies(&Settings{VATCountry: "gr"}, "DE"))
+	assert.False(t, ReverseChargeApplies(settings, "DE"))
+	assert.False(t, ReverseChargeApplies(settings, "NO"))
+	assert.False(t, ReverseChargeApplies(&Settings{}, "NL"))
+}
+
+func TestTaxExempt(t *testing.T) {
+	settings := &Settings{
+		Taxes: []*Tax{&Tax{
+			Percentage:   21,
+			ProductTypes: []string{"test"},
+			Countries:    []string{"USA"},
+		}},
+	}
+
+	params := PriceParameters{Country: "USA", Currency: "USD", Items: []Item{&TestItem{price: 100, itemType: "test"}}, TaxExempt: true}
+	price := CalculatePrice(settings, nil, params, testLogger)
+	validatePrice(t, price, Price{
+		Subtotal: 100,
+		NetTotal: 100,
+		Taxes:    0,
+		Total:    100,
+	})
+}
+
+func TestTaxRates(t *testing.T) {
+	settings := &Settings{
+		Taxes: []*Tax{&Tax{
+			Percentage:   7,
+			ProductTypes: []string{"Book"},
+			Countries:    []string{"Germany"},
+		}, &Tax{
+			Percentage:   19,
+			ProductTypes: []string{"E-Book"},
+			Countries:    []string{"Germany"},
+		}},
+	}
+	bundle := &TestItem{
+		price:    3000,
+		itemType: "Book",
+		quantity: 2,
+		items: []Item{
+			&TestItem{price: 2000, itemType: "Book"},
+			&TestItem{price: 1000, itemType: "E-Book"},
+		},
+	}
+
+	params := PriceParameters{Country: "Germany", Currency: "EUR", Items: []Item{bundle}}
+	price := CalculatePrice(settings, nil, params, testLogger)
+	require.Len(t, price.Items, 1)
+	assert.Equal(t, []TaxRate{
+		{Rate: 7, Jurisdiction: "Germany", TaxableAmount: 2000, Amount: 140},
+		{Rate: 19, Jurisdiction: "Germany", TaxableAmount: 1000, Amount: 190},
+	}, price.Items[0].TaxRates)
+	assert.Equal(t, uint64(330), price.Items[0].Taxes)
+
+	params.TaxExempt = true
+	price = CalculatePrice(settings, nil, params, testLogger)
+	assert.Empty(t, price.Items[0].TaxRates)
+}
+
+func TestShippingQuotes(t *testing.T) {
+	settings := &Settings{ShippingMethods: []*ShippingMethod{
+		&ShippingMethod{ID: "flat", Type: ShippingFlat, Rates: []*ShippingRate{
+			&ShippingRate{Currency: "USD", Amount: "4.90", FreeOver: "50.00"},
+		}},
+		&ShippingMethod{ID: "weight", Type: ShippingWeight, Rates: []*ShippingRate{
+			&ShippingRate{Currency: "USD", Tiers: []*ShippingTier{
+				&ShippingTier{MinWeight: 1000, Amount: "8.00"},
+				&ShippingTier{MinWeight: 0, Amount: "5.00"},
+			}},
+		}},
+		&ShippingMethod{ID: "price", Type: ShippingPrice, Countries: []string{"USA"}, Rates: []*ShippingRate{
+			&ShippingRate{Currency: "USD", Tiers: []*ShippingTier{
+				&ShippingTier{MinAmount: "20.00", Amount: "3.00"},
+				&ShippingTier{MinAmount: "40.00", Amount: "1.00"},
+			}},
+		}},
+	}}
+
+	quotes := ShippingQuotes(settings, ShippingParameters{Country: "USA", Currency: "USD", Weight: 1200, Amount: 4500})
+	require.Len(t, quotes, 3)
+	assert.Equal(t, uint64(490), quotes[0].Amount)
+	assert.Equal(t, uint64(800), quotes[1].Amount)
+	assert.Equal(t, uint64(100), quotes[2].Amount)
+
+	quotes = ShippingQuotes(settings, ShippingParameters{Country: "Germany", Currency: "USD", Weight: 200, Amount: 6000})
+	require.Len(t, quotes, 2)
+	assert.Equal(t, uint64(0), quotes[0].Amount)
+	assert.Equal(t, uint64(500), quotes[1].Amount)
+
+	_, ok := QuoteShipping(settings, ShippingParameters{Country: "USA", Currency: "USD", Amount: 1000}, "price")
+	assert.False(t, ok)
+	_, ok = QuoteShipping(settings, ShippingParameters{Country: "USA", Currency: "EUR", Amount: 1000}, "flat")
+	assert.False(t, ok)
+	quote, ok := QuoteShipping(settings, ShippingParameters{Country: "USA", Currency: "USD", Amount: 1000}, "flat")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(490), quote.Amount)
+}
+
+func TestShippingZones(t *testing.T) {
+	settings := &Settings{
+		ShippingMethods: []*ShippingMethod{
+			&ShippingMethod{ID: "standard", Rates: []*ShippingRate{&ShippingRate{Currency: "USD", Amount: "5.00"}}},
+			&ShippingMethod{ID: "express", Rates: []*ShippingRate{&ShippingRate{Currency: "USD", Amount: "15.00"}}},
+		},
+		ShippingZones: []*ShippingZone{
+			&ShippingZone{Name: "Domestic", Countries: []string{"USA"}, Regions: []string{"CA", "NV"}},
+			&ShippingZone{Name: "Europe", Countries: []string{"Germany"}, Methods: []string{"standard"}},
+		},
+	}
+
+	assert.True(t, ShipsTo(settings, ShippingParameters{Country: "USA", Region: "NV"}))
+	assert.False(t, ShipsTo(settings, ShippingParameters{Country: "USA", Region: "TX"}))
+	assert.True(t, ShipsTo(settings, ShippingParameters{Country: "Germany"}))
+	assert.False(t, ShipsTo(settings, ShippingParameters{Country: "Japan"}))
+	assert.True(t, ShipsTo(&Settings{}, ShippingParameters{Country: "Japan"}))
+
+	assert.Len(t, ShippingQuotes(settings, ShippingParameters{Country: "USA", Region: "CA", Currency: "USD"}), 2)
+	quotes := ShippingQuotes(settings, ShippingParameters{Country: "Germany", Currency: "USD"})
+	require.Len(t, quotes, 1)
+	assert.Equal(t, "standard", quotes[0].ID)
+	_, ok := QuoteShipping(settings, ShippingParameters{Country: "Germany", Currency: "USD"}, "express")
+	assert.False(t, ok)
+}
+
+func TestCartRules(t *testing.T) {
+	settings := &Settings{CartRules: []*CartRule{
+		&CartRule{Name: "10% over 100", MinimumAmount: []*CartRuleAmount{&CartRuleAmount{Amount: "100.00", Currency: "USD"}}, Percentage: 10},
+		&CartRule{Name: "Free bookmark", BuySkus: []string{"book"}, FreeSku: "bookmark"},
+	}}
+	book := &TestItem{sku: "book", price: 6000, itemType: "book", quantity: 2}
+	bookmark := &TestItem{sku: "bookmark", price: 300, itemType: "merch", quantity: 2}
+
+	t.Run("AllRules", func(t *testing.T) {
+		params := PriceParameters{Country: "USA", Currency: "USD", Items: []Item{book, bookmark}}
+		price := CalculatePrice(settings, nil, params, testLogger)
+		assert.Equal(t, uint64(1560), price.Discount)
+		assert.Equal(t, uint64(180), price.Items[1].Discount)
+		assert.Equal(t, []string{"10% over 100", "Free bookmark"}, price.Rules)
+		require.Len(t, price.Items[1].DiscountItems, 2)
+		assert.Equal(t, DiscountTypeRule, price.Items[1].DiscountItems[1].Type)
+	})
+	t.Run("MinimumAmountInOtherCurrency", func(t *testing.T) {
+		params := PriceParameters{Country: "USA", Currency: "EUR", Items: []Item{book, bookmark}}
+		price := CalculatePrice(settings, nil, params, testLogger)
+		assert.Equal(t, uint64(300), price.Discount)
+		assert.Equal(t, []string{"Free bookmark"}, price.Rules)
+	})
+	t.Run("NothingBought", func(t *testing.T) {
+		params := PriceParameters{Country: "USA", Currency: "USD", Items: []Item{bookmark}}
+		price := CalculatePrice(settings, nil, params, testLogger)
+		assert.Equal(t, uint64(0), price.Discount)
+		assert.Empty(t, price.Rules)
+	})
+}
+
+func TestPriceTiers(t *testing.T) {
+	settings := &Settings{Taxes: []*Tax{&Tax{
+		Percentage:   7,
+		ProductTypes: []string{"book"},
+		Countries:    []string{"DE"},
+	}, &Tax{
+		Percentage:   21,
+		ProductTypes: []string{"ebook"},
+		Countries:    []string{"DE"},
+	}}}
+	tiers := []PriceTier{{MinQuantity: 10, Price: 900}, {MinQuantity: 1, Price: 1000}, {MinQuantity: 50, Price: 750}}
+	item := func(quantity uint64) *TestTieredItem {
+		return &TestTieredItem{TestItem: TestItem{price: 1000, itemType: "book", quantity: quantity}, tiers: tiers}
+	}
+
+	for _, c := range []struct {
+		quantity  uint64
+		unitPrice uint64
+		taxes     uint64
+	}{{5, 1000, 350}, {10, 900, 630}, {49, 900, 3087}, {50, 750, 2625}} {
+		params := PriceParameters{Country: "DE", Currency: "USD", Items: []Item{item(c.quantity)}}
+		price := CalculatePrice(settings, nil, params, testLogger)
+		assert.Equal(t, c.unitPrice, price.Items[0].UnitPrice)
+		assert.Equal(t, c.unitPrice*c.quantity, price.Subtotal)
+		assert.Equal(t, c.taxes, price.Taxes)
+	}
+
+	t.Run("WithCoupon", func(t *testing.T) {
+		params := PriceParameters{Country: "DE", Currency: "USD", Coupon: &TestCoupon{itemType: "book", percentage: 10}, Items: []Item{item(10)}}
+		price := CalculatePrice(settings, nil, params, testLogger)
+		assert.Equal(t, uint64(900), price.Discount)
+		assert.Equal(t, uint64(8100), price.NetTotal)
+	})
+	t.Run("PriceItems", func(t *testing.T) {
+		tiered := item(10)
+		tiered.items = []Item{&TestItem{price: 800, itemType: "book"}, &TestItem{price: 200, itemType: "ebook"}}
+		params := PriceParameters{Country: "DE", Currency: "USD", Items: []Item{tiered}}
+		price := CalculatePrice(settings, nil, params, testLogger)
+		assert.Equal(t, uint64(9000), price.Subtotal)
+		assert.Equal(t, uint64(504+378), price.Taxes)
+	})
+}
+
+func TestCustomerGroups(t *testing.T) {
+	settings := &Settings{CustomerGroups: []*CustomerGroup{{
+		Name:       "wholesale",
+		Percentage: 10,
+		Prices:     []*GroupPrice{{Sku: "listed", Amount: "6.50", Currency: "USD"}},
+	}}}
+	tiers := []PriceTier{{MinQuantity: 2, Price: 900}}
+	items := func() []Item {
+		return []Item{
+			&TestTieredItem{TestItem: TestItem{sku: "listed", price: 1000, itemType: "book", quantity: 2}, tiers: tiers},
+			&TestTieredItem{TestItem: TestItem{sku: "other", price: 1000, itemType: "book", quantity: 2}, tiers: tiers},
+		}
+	}
+
+	t.Run("Member", func(t *testing.T) {
+		params := PriceParameters{Country: "USA", Currency: "USD", Items: items(), CustomerGroup: "wholesale"}
+		price := CalculatePrice(settings, nil, params, testLogger)
+		require.Len(t, price.Items, 2)
+		assert.Equal(t, uint64(650), price.Items[0].UnitPrice)
+		assert.Empty(t, price.Items[0].DiscountItems)
+		assert.Equal(t, uint64(900), price.Items[1].UnitPrice)
+		require.Len(t, price.Items[1].DiscountItems, 1)
+		assert.Equal(t, DiscountTypeGroup, price.Items[1].DiscountItems[0].Type)
+		assert.Equal(t, "wholesale", price.Items[1].DiscountItems[0].Code)
+		assert.Equal(t, uint64(1300+1800), price.Subtotal)
+		assert.Equal(t, uint64(180), price.Discount)
+	})
+	t.Run("OtherCurrency", func(t *testing.T) {
+		params := PriceParameters{Country: "USA", Currency: "EUR", Items: items(), CustomerGroup: "wholesale"}
+		price := CalculatePrice(settings, nil, params, testLogger)
+		assert.Equal(t, uint64(900), price.Items[0].UnitPrice)
+		assert.Equal(t, uint64(360), price.Discount)
+	})
+	t.Run("UnknownGroup", func(t *testing.T) {
+		params := PriceParameters{Country: "USA", Currency: "USD", Items: items(), CustomerGroup: "staff"}
+		price := CalculatePrice(settings, nil, params, testLogger)
+		assert.Equal(t, uint64(3600), price.Subtotal)
+		assert.Equal(t, uint64(0), price.Discount)
+	})
+}
+
 func TestPricingItems(t *testing.T) {
 	settings := &Settings{Taxes: []*Tax{&Tax{
 		Percentage:   7,
@@ -238,7 +580,7 @@ func TestPricingItems(t *testing.T) {
 			itemType: "ebook",
 		}},
 	}
-	params := PriceParameters{"DE", "USD", nil, []Item{item}}
+	params := PriceParameters{Country: "DE", Currency: "USD", Items: []Item{item}}
 	price := CalculatePrice(settings, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -255,7 +597,7 @@ func TestMemberDiscounts(t *testing.T) {
 		Claims:     map[string]string{"app_metadata.plan": "member"},
 		Percentage: 10,
 	}}}
-	params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
+	params := PriceParameters{Country: "USA", Currency: "USD", Items: []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
 	price := CalculatePrice(settings, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -269,7 +611,7 @@ func TestMemberDiscounts(t *testing.T) {
 	claims := map[string]interface{}{}
 	require.NoError(t, json.Unmarshal([]byte(`{"app_metadata": {"plan": "member"}}`), &claims))
 
-	params = PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
+	params = PriceParameters{Country: "USA", Currency: "USD", Items: []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
 	price = CalculatePrice(settings, claims, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -290,7 +632,7 @@ func TestFixedMemberDiscounts(t *testing.T) {
 		}},
 	}}}
 
-	params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
+	params := PriceParameters{Country: "USA", Currency: "USD", Items: []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
 	price := CalculatePrice(settings, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -304,7 +646,7 @@ func TestFixedMemberDiscounts(t *testing.T) {
 	claims := map[string]interface{}{}
 	require.NoError(t, json.Unmarshal([]byte(`{"app_metadata": {"plan": "member"}}`), &claims))
 
-	params = PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
+	params = PriceParameters{Country: "USA", Currency: "USD", Items: []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
 	price = CalculatePrice(settings, claims, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -331,7 +673,7 @@ func TestMixedDiscounts(t *testing.T) {
 		price:    3490,
 	}
 
-	params := PriceParameters{"USA", "USD", nil, []Item{item}}
+	params := PriceParameters{Country: "USA", Currency: "USD", Items: []Item{item}}
 	price := CalculatePrice(&settings, nil, params, testLogger)
 	assert.Equal(t, 3490, int(price.Total))
 
@@ -374,7 +716,7 @@ func TestRealWorldTaxCalculations(t *testing.T) {
 			Countries:    []string{"USA"},
 		}}
 
-		params := PriceParameters{"USA", "USD", nil, []Item{item1}}
+		params := PriceParameters{Country: "USA", Currency: "USD", Items: []Item{item1}}
 		price := CalculatePrice(settings, nil, params, testLogger)
 
 		validatePrice(t, price, Price{
@@ -409,7 +751,7 @@ func TestRealWorldTaxCalculations(t *testing.T) {
 			}},
 		}
 
-		params := PriceParameters{"USA", "USD", nil, []Item{item1, item2}}
+		params := PriceParameters{Country: "USA", Currency: "USD", Items: []Item{item1, item2}}
 		price := CalculatePrice(settings, nil, params, testLogger)
 
 		validatePrice(t, price, Price{
@@ -449,7 +791,7 @@ func TestRealWorldRelativeDiscountWithTaxes(t *testing.T) {
 	}
 
 	coupon := &TestCoupon{itemType: "book", percentage: 25}
-	params := PriceParameters{"Germany", "EUR", coupon, []Item{item}}
+	params := PriceParameters{Country: "Germany", Currency: "EUR", Coupon: coupon, Items: []Item{item}}
 	price := CalculatePrice(settings, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -504,7 +846,7 @@ func TestRealWorldFixedDiscountWithTaxes(t *testing.T) {
 			},
 		},
 	}
-	params := PriceParameters{"Germany", "EUR", nil, []Item{item}}
+	params := PriceParameters{Country: "Germany", Currency: "EUR", Items: []Item{item}}
 	price := CalculatePrice(settings, claims, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -0,0 +1,116 @@
+package calculator
+
+import "strconv"
+
+// CartRule is a discount applied without a code to orders meeting its
+// conditions. It either gives a percentage off the items it applies to, or
+// makes units of the FreeSku free when buying any of the BuySkus.
+type CartRule struct {
+	Name string `json:"name"`
+
+	// MinimumAmount is the subtotal per currency an order must reach.
+	MinimumAmount []*CartRuleAmount `json:"minimum_amount,omitempty"`
+	// BuySkus are the products of which the order must contain any.
+	BuySkus []string `json:"buy,omitempty"`
+
+	Percentage   uint64   `json:"percentage,omitempty"`
+	ProductTypes []string `json:"product_types,omitempty"`
+	Products     []string `json:"products,omitempty"`
+
+	FreeSku      string `json:"free,omitempty"`
+	FreeQuantity uint64 `json:"free_quantity,omitempty"`
+}
+
+// CartRuleAmount is an amount in a currency.
+type CartRuleAmount struct {
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// applicableCartRules returns the cart rules of the settings whose conditions
+// the order meets.
+func applicableCartRules(settings *Settings, params PriceParameters) []*CartRule {
+	if settings == nil || len(settings.CartRules) == 0 {
+		return nil
+	}
+
+	subtotal := uint64(0)
+	skus := []string{}
+	for _, item := range params.Items {
+		subtotal += item.PriceInLowestUnit() * item.GetQuantity()
+		skus = append(skus, item.ProductSku())
+	}
+
+	rules := []*CartRule{}
+	for _, rule := range settings.CartRules {
+		if len(rule.MinimumAmount) > 0 {
+			minimum, ok := rule.minimumAmount(params.Currency)
+			if !ok || subtotal < minimum {
+				continue
+			}
+		}
+		if len(rule.BuySkus) > 0 {
+			bought := false
+			for _, sku := range rule.BuySkus {
+				if hasString(skus, sku) {
+					bought = true
+					break
+				}
+			}
+			if !bought {
+				continue
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func (r *CartRule) minimumAmount(currency string) (uint64, bool) {
+	for _, minimum := range r.MinimumAmount {
+		if minimum.Currency == currency {
+			amount, _ := strconv.ParseFloat(minimum.Amount, 64)
+			return rint(amount * 100), true
+		}
+	}
+	return 0, false
+}
+
+// appliesTo returns whether the rule gives a discount on the item.
+func (r *CartRule) appliesTo(item Item) bool {
+	if r.FreeSku != "" {
+		return item.ProductSku() == r.FreeSku
+	}
+	if r.Percentage == 0 {
+		return false
+	}
+	if len(r.ProductTypes) > 0 && !hasString(r.ProductTypes, item.ProductType()) {
+		return false
+	}
+	if len(r.Products) > 0 && !hasString(r.Products, item.ProductSku()) {
+		return false
+	}
+	return true
+}
+
+// freeDiscount returns the discount making the free units of the item free,
+// spread over the units priced with the multiplier.
+func (r *CartRule) freeDiscount(item Item, multiplier uint64) uint64 {
+	free := r.FreeQuantity
+	if free == 0 {
+		free = 1
+	}
+	if free > item.GetQuantity() {
+		free = item.GetQuantity()
+	}
+	return rint(float64(item.PriceInLowestUnit()*free*multiplier) / float64(item.GetQuantity()))
+}
+
+func hasString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
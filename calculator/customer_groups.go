@@ -0,0 +1,62 @@
+package calculator
+
+import "strconv"
+
+// CustomerGroup gives the customers of a group, like wholesale buyers, VIPs
+// or staff, the prices of its price list or a percentage off the products
+// that aren't on it.
+type CustomerGroup struct {
+	Name       string        `json:"name"`
+	Percentage uint64        `json:"percentage"`
+	Prices     []*GroupPrice `json:"prices"`
+}
+
+// GroupPrice is the price of a product for the customers of a group.
+type GroupPrice struct {
+	Sku      string `json:"sku"`
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// CustomerGroup returns the customer group of the settings with the name, or
+// nil if there's none.
+func (s *Settings) CustomerGroup(name string) *CustomerGroup {
+	if s == nil || name == "" {
+		return nil
+	}
+	for _, group := range s.CustomerGroups {
+		if group.Name == name {
+			return group
+		}
+	}
+	return nil
+}
+
+// price returns the price of the product on the price list of the group in
+// the currency, in the lowest unit.
+func (g *CustomerGroup) price(sku, currency string) (uint64, bool) {
+	for _, price := range g.Prices {
+		if price.Sku == sku && price.Currency == currency {
+			amount, err := strconv.ParseFloat(price.Amount, 64)
+			if err != nil {
+				return 0, false
+			}
+			return rint(amount * 100), true
+		}
+	}
+	return 0, false
+}
+
+// applyGroupPrice returns the item priced at the price of the group's price
+// list, which replaces both its own price and its quantity-break prices. The
+// second return value is false for items that aren't on the price list.
+func applyGroupPrice(group *CustomerGroup, item Item, currency string) (Item, bool) {
+	if group == nil {
+		return item, false
+	}
+	price, ok := group.price(item.ProductSku(), currency)
+	if !ok {
+		return item, false
+	}
+	return &tieredItem{Item: item, price: price}, true
+}
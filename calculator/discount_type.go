@@ -12,6 +12,8 @@ type DiscountType int
 const (
 	DiscountTypeCoupon DiscountType = iota + 1
 	DiscountTypeMember
+	DiscountTypeRule
+	DiscountTypeGroup
 )
 
 func (t DiscountType) String() string {
@@ -20,6 +22,10 @@ func (t DiscountType) String() string {
 		return "coupon"
 	case DiscountTypeMember:
 		return "member"
+	case DiscountTypeRule:
+		return "rule"
+	case DiscountTypeGroup:
+		return "group"
 	}
 	return "unknown"
 }
@@ -45,6 +51,10 @@ func (t *DiscountType) UnmarshalJSON(b []byte) error {
 		*t = DiscountTypeCoupon
 	case "member":
 		*t = DiscountTypeMember
+	case "rule":
+		*t = DiscountTypeRule
+	case "group":
+		*t = DiscountTypeGroup
 	default:
 		*t = 0
 	}
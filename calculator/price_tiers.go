@@ -0,0 +1,75 @@
+package calculator
+
+// PriceTier is a quantity-break price, the unit price of an item ordered at
+// least MinQuantity times.
+type PriceTier struct {
+	MinQuantity uint64 `json:"min_quantity"`
+	Price       uint64 `json:"price"`
+}
+
+// TieredItem is an Item with quantity-break prices. It's priced at the tier
+// with the highest minimum quantity its quantity reaches, or at its own price
+// if it reaches none.
+type TieredItem interface {
+	Item
+	PriceTiers() []PriceTier
+}
+
+// tieredItem is an item priced at the unit price of a tier, or of the price
+// list of a customer group.
+type tieredItem struct {
+	Item
+	price uint64
+}
+
+func (i *tieredItem) PriceInLowestUnit() uint64 {
+	return i.price
+}
+
+// TaxableItems scales the price components of the item to its new price, so
+// they still add up to the unit price.
+func (i *tieredItem) TaxableItems() []Item {
+	original := i.Item.PriceInLowestUnit()
+	taxable := i.Item.TaxableItems()
+	if len(taxable) == 0 || original == 0 {
+		return taxable
+	}
+	items := make([]Item, len(taxable))
+	for index, item := range taxable {
+		items[index] = &scaledItem{Item: item, price: rint(float64(item.PriceInLowestUnit()) * float64(i.price) / float64(original))}
+	}
+	return items
+}
+
+// scaledItem is a price component of a tiered item.
+type scaledItem struct {
+	Item
+	price uint64
+}
+
+func (i *scaledItem) PriceInLowestUnit() uint64 {
+	return i.price
+}
+
+// applyPriceTiers returns the item priced at the tier its quantity reaches.
+func applyPriceTiers(item Item) Item {
+	tiered, ok := item.(TieredItem)
+	if !ok {
+		return item
+	}
+
+	var tier *PriceTier
+	for _, t := range tiered.PriceTiers() {
+		if t.MinQuantity > item.GetQuantity() {
+			continue
+		}
+		if tier == nil || t.MinQuantity > tier.MinQuantity {
+			t := t
+			tier = &t
+		}
+	}
+	if tier == nil {
+		return item
+	}
+	return &tieredItem{Item: item, price: tier.Price}
+}
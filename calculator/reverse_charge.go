@@ -0,0 +1,48 @@
+package calculator
+
+import "strings"
+
+// euVATCountries are the country codes of EU VAT numbers. Greek VAT numbers
+// use EL instead of the ISO code GR.
+var euVATCountries = map[string]bool{
+	"AT": true, "BE": true, "BG": true, "CY": true, "CZ": true, "DE": true, "DK": true,
+	"EE": true, "EL": true, "ES": true, "FI": true, "FR": true, "HR": true, "HU": true,
+	"IE": true, "IT": true, "LT": true, "LU": true, "LV": true, "MT": true, "NL": true,
+	"PL": true, "PT": true, "RO": true, "SE": true, "SI": true, "SK": true,
+}
+
+// euCountryNames maps the English names of the EU member states, as used in
+// addresses, to their VAT country codes.
+var euCountryNames = map[string]string{
+	"Austria": "AT", "Belgium": "BE", "Bulgaria": "BG", "Croatia": "HR", "Cyprus": "CY",
+	"Czech Republic": "CZ", "Czechia": "CZ", "Denmark": "DK", "Estonia": "EE", "Finland": "FI",
+	"France": "FR", "Germany": "DE", "Greece": "EL", "Hungary": "HU", "Ireland": "IE",
+	"Italy": "IT", "Latvia": "LV", "Lithuania": "LT", "Luxembourg": "LU", "Malta": "MT",
+	"Netherlands": "NL", "Poland": "PL", "Portugal": "PT", "Romania": "RO", "Slovakia": "SK",
+	"Slovenia": "SI", "Spain": "ES", "Sweden": "SE",
+}
+
+// EUVATCountryCode returns the VAT country code of an EU member state given
+// by name or country code, and whether the country is a member state.
+func EUVATCountryCode(country string) (string, bool) {
+	if code, ok := euCountryNames[country]; ok {
+		return code, true
+	}
+	code := strings.ToUpper(country)
+	if code == "GR" {
+		code = "EL"
+	}
+	return code, euVATCountries[code]
+}
+
+// ReverseChargeApplies returns whether a sale to a business with a valid VAT
+// number of the country is reverse charged, which is the case for cross-border
+// sales within the EU.
+func ReverseChargeApplies(settings *Settings, vatCountry string) bool {
+	if settings == nil || settings.VATCountry == "" {
+		return false
+	}
+	seller, sellerInEU := EUVATCountryCode(settings.VATCountry)
+	buyer, buyerInEU := EUVATCountryCode(vatCountry)
+	return sellerInEU && buyerInEU && seller != buyer
+}
@@ -0,0 +1,231 @@
+package calculator
+
+import "strconv"
+
+// Types of shipping methods.
+const (
+	// ShippingFlat charges the same amount for every order.
+	ShippingFlat = "flat"
+	// ShippingWeight charges by the total weight of the items.
+	ShippingWeight = "weight"
+	// ShippingPrice charges by the subtotal of the items after discounts.
+	ShippingPrice = "price"
+)
+
+// ShippingMethod is a way of shipping orders to its Countries, or anywhere if
+// it lists none. It's only available in the currencies it has a rate for.
+type ShippingMethod struct {
+	ID        string          `json:"id"`
+	Name      string          `json:"name"`
+	Type      string          `json:"type"`
+	Countries []string        `json:"countries,omitempty"`
+	Rates     []*ShippingRate `json:"rates"`
+}
+
+// ShippingRate is the price of a shipping method in a currency. Flat rates
+// charge the Amount, weight and price based rates the amount of the tier with
+// the highest minimum the order reaches. Orders whose subtotal after
+// discounts reaches FreeOver ship for free.
+type ShippingRate struct {
+	Currency string          `json:"currency"`
+	Amount   string          `json:"amount,omitempty"`
+	Tiers    []*ShippingTier `json:"tiers,omitempty"`
+	FreeOver string          `json:"free_over,omitempty"`
+}
+
+// ShippingTier is the price of shipping orders weighing at least MinWeight
+// grams for weight based rates, or with a subtotal of at least MinAmount for
+// price based rates.
+type ShippingTier struct {
+	MinWeight uint64 `json:"min_weight,omitempty"`
+	MinAmount string `json:"min_amount,omitempty"`
+	Amount    string `json:"amount"`
+}
+
+// ShippingZone is an area orders ship to: its Countries, or only their
+// Regions, as named in addresses, if it lists any. Its Methods are the IDs of
+// the shipping methods available in it, all of them if it lists none.
+type ShippingZone struct {
+	Name      string   `json:"name"`
+	Countries []string `json:"countries"`
+	Regions   []string `json:"regions,omitempty"`
+	Methods   []string `json:"methods,omitempty"`
+}
+
+// PickupLocation is a store or pickup point customers collect their orders
+// at instead of having them shipped.
+type PickupLocation struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Address1     string `json:"address1"`
+	Address2     string `json:"address2,omitempty"`
+	City         string `json:"city"`
+	Country      string `json:"country"`
+	State        string `json:"state,omitempty"`
+	Zip          string `json:"zip"`
+	Instructions string `json:"instructions,omitempty"`
+}
+
+// ShippingParameters describe the order to ship.
+type ShippingParameters struct {
+	Country  string
+	Region   string
+	Currency string
+	// Weight is the weight of all items in grams.
+	Weight uint64
+	// Amount is the subtotal of the items after discounts.
+	Amount uint64
+}
+
+// ShippingQuote is the price of shipping an order with a shipping method.
+type ShippingQuote struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Amount   uint64 `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// ShippingQuotes returns the prices of the shipping methods of the settings
+// that are available for the order.
+func ShippingQuotes(settings *Settings, params ShippingParameters) []ShippingQuote {
+	quotes := []ShippingQuote{}
+	if settings == nil {
+		return quotes
+	}
+	for _, method := range settings.ShippingMethods {
+		if !ShippingMethodAllowed(settings, params, method.ID) {
+			continue
+		}
+		if quote, ok := method.Quote(params); ok {
+			quotes = append(quotes, quote)
+		}
+	}
+	return quotes
+}
+
+// QuoteShipping returns the price of shipping the order with the shipping
+// method of the settings with the ID, or false if it isn't available for the
+// order.
+func QuoteShipping(settings *Settings, params ShippingParameters, id string) (ShippingQuote, bool) {
+	if settings == nil || !ShippingMethodAllowed(settings, params, id) {
+		return ShippingQuote{}, false
+	}
+	for _, method := range settings.ShippingMethods {
+		if method.ID == id {
+			return method.Quote(params)
+		}
+	}
+	return ShippingQuote{}, false
+}
+
+// FindPickupLocation returns the pickup location of the settings with the ID,
+// or nil if there is none.
+func FindPickupLocation(settings *Settings, id string) *PickupLocation {
+	if settings == nil {
+		return nil
+	}
+	for _, location := range settings.PickupLocations {
+		if location.ID == id {
+			return location
+		}
+	}
+	return nil
+}
+
+// ShipsTo returns whether the destination of the order lies within one of
+// the shipping zones of the settings. Settings without zones ship anywhere.
+func ShipsTo(settings *Settings, params ShippingParameters) bool {
+	if settings == nil || len(settings.ShippingZones) == 0 {
+		return true
+	}
+	for _, zone := range settings.ShippingZones {
+		if zone.Contains(params.Country, params.Region) {
+			return true
+		}
+	}
+	return false
+}
+
+// ShippingMethodAllowed returns whether the shipping method with the ID is
+// available in any of the shipping zones of the settings the order ships to.
+// All methods are available with settings without zones.
+func ShippingMethodAllowed(settings *Settings, params ShippingParameters, id string) bool {
+	if settings == nil || len(settings.ShippingZones) == 0 {
+		return true
+	}
+	for _, zone := range settings.ShippingZones {
+		if zone.Contains(params.Country, params.Region) && (len(zone.Methods) == 0 || hasString(zone.Methods, id)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains returns whether the region of the country lies within the zone.
+func (z *ShippingZone) Contains(country, region string) bool {
+	if !hasString(z.Countries, country) {
+		return false
+	}
+	return len(z.Regions) == 0 || hasString(z.Regions, region)
+}
+
+// Quote returns the price of shipping the order with the method, or false if
+// the method doesn't ship to its country, has no rate in its currency or no
+// tier the order reaches.
+func (m *ShippingMethod) Quote(params ShippingParameters) (ShippingQuote, bool) {
+	quote := ShippingQuote{ID: m.ID, Name: m.Name, Currency: params.Currency}
+	if len(m.Countries) > 0 && !hasString(m.Countries, params.Country) {
+		return quote, false
+	}
+	var rate *ShippingRate
+	for _, r := range m.Rates {
+		if r.Currency == params.Currency {
+			rate = r
+			break
+		}
+	}
+	if rate == nil {
+		return quote, false
+	}
+
+	switch m.Type {
+	case ShippingFlat, "":
+		quote.Amount = lowestUnit(rate.Amount)
+	case ShippingWeight, ShippingPrice:
+		var tier *ShippingTier
+		for _, t := range rate.Tiers {
+			reached := t.MinWeight <= params.Weight
+			if m.Type == ShippingPrice {
+				reached = lowestUnit(t.MinAmount) <= params.Amount
+			}
+			if reached && (tier == nil || m.tierMinimum(t) > m.tierMinimum(tier)) {
+				tier = t
+			}
+		}
+		if tier == nil {
+			return quote, false
+		}
+		quote.Amount = lowestUnit(tier.Amount)
+	default:
+		return quote, false
+	}
+
+	if rate.FreeOver != "" && params.Amount >= lowestUnit(rate.FreeOver) {
+		quote.Amount = 0
+	}
+	return quote, true
+}
+
+func (m *ShippingMethod) tierMinimum(tier *ShippingTier) uint64 {
+	if m.Type == ShippingPrice {
+		return lowestUnit(tier.MinAmount)
+	}
+	return tier.MinWeight
+}
+
+// lowestUnit converts a decimal amount of the settings to the lowest unit of
+// its currency.
+func lowestUnit(amount string) uint64 {
+	value, _ := strconv.ParseFloat(amount, 64)
+	return rint(value * 100)
+}
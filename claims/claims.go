@@ -1,6 +1,8 @@
 package claims
 
 import (
+	"encoding/json"
+	"fmt"
 	"strings"
 
 	jwt "github.com/dgrijalva/jwt-go"
@@ -11,7 +13,61 @@ type JWTClaims struct {
 	Email        string                 `json:"email"`
 	AppMetaData  map[string]interface{} `json:"app_metadata"`
 	UserMetaData map[string]interface{} `json:"user_metadata"`
+
+	// EmailVerified is only set by identity providers that also issue tokens
+	// for users that haven't confirmed their email yet.
+	EmailVerified *bool `json:"email_verified,omitempty"`
 	jwt.StandardClaims
+
+	// Audiences are the audiences of the token, which may have one audience
+	// or a list of them. The Audience is the first of them.
+	Audiences []string `json:"-"`
+}
+
+// UnmarshalJSON reads the claims of a token, with an audience that's either
+// a string or a list of strings.
+func (c *JWTClaims) UnmarshalJSON(data []byte) error {
+	type plainClaims JWTClaims
+	aux := struct {
+		*plainClaims
+		Audience interface{} `json:"aud,omitempty"`
+	}{plainClaims: (*plainClaims)(c)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	c.Audience = ""
+	c.Audiences = nil
+	switch aud := aux.Audience.(type) {
+	case nil:
+	case string:
+		c.Audiences = []string{aud}
+	case []interface{}:
+		for _, a := range aud {
+			name, ok := a.(string)
+			if !ok {
+				return fmt.Errorf("Invalid audience %v", a)
+			}
+			c.Audiences = append(c.Audiences, name)
+		}
+	default:
+		return fmt.Errorf("Invalid audience %v", aud)
+	}
+	if len(c.Audiences) > 0 {
+		c.Audience = c.Audiences[0]
+	}
+	return nil
+}
+
+// HasAudience reports whether the audience is one of the audiences of the
+// token.
+func (c *JWTClaims) HasAudience(audience string) bool {
+	for _, a := range c.Audiences {
+		if a == audience {
+			return true
+		}
+	}
+	return false
 }
 
 // HasClaims is used to determine if a set of userClaims matches the requiredClaims
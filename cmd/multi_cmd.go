@@ -45,6 +45,15 @@ func multi(cmd *cobra.Command, args []string) {
 	logrus.Infof("GoCommerce API started on: %s", l)
 
 	models.RunHooks(bgDB, logrus.WithField("component", "hooks"))
+	api.RunJobs(context.Background(), bgDB, logrus.WithField("component", "jobs"))
+	api.RunAuthorizationVoider(context.Background(), bgDB, logrus.WithField("component", "authorizations"))
+	api.RunSubscriptionRenewer(context.Background(), bgDB, logrus.WithField("component", "subscriptions"))
+	api.RunPaymentRetrier(context.Background(), bgDB, logrus.WithField("component", "dunning"))
+	api.RunPendingOrderSweeper(context.Background(), bgDB, logrus.WithField("component", "sweeper"))
+	api.RunAbandonedOrderNotifier(context.Background(), bgDB, logrus.WithField("component", "abandoned"))
+	api.RunRetentionJob(context.Background(), bgDB, logrus.WithField("component", "retention"))
+	api.RunSalesRollups(context.Background(), bgDB, logrus.WithField("component", "rollups"))
+	api.RunReportScheduler(context.Background(), bgDB, logrus.WithField("component", "reports"))
 
 	api.ListenAndServe(l)
 }
@@ -42,6 +42,15 @@ func serve(globalConfig *conf.GlobalConfiguration, log logrus.FieldLogger, confi
 	log.Infof("GoCommerce API started on: %s", l)
 
 	models.RunHooks(bgDB, log.WithField("component", "hooks"))
+	api.RunJobs(ctx, bgDB, log.WithField("component", "jobs"))
+	api.RunAuthorizationVoider(ctx, bgDB, log.WithField("component", "authorizations"))
+	api.RunSubscriptionRenewer(ctx, bgDB, log.WithField("component", "subscriptions"))
+	api.RunPaymentRetrier(ctx, bgDB, log.WithField("component", "dunning"))
+	api.RunPendingOrderSweeper(ctx, bgDB, log.WithField("component", "sweeper"))
+	api.RunAbandonedOrderNotifier(ctx, bgDB, log.WithField("component", "abandoned"))
+	api.RunRetentionJob(ctx, bgDB, log.WithField("component", "retention"))
+	api.RunSalesRollups(ctx, bgDB, log.WithField("component", "rollups"))
+	api.RunReportScheduler(ctx, bgDB, log.WithField("component", "reports"))
 
 	api.ListenAndServe(l)
 }
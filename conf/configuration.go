@@ -2,6 +2,8 @@ package conf
 
 import (
 	"os"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/kelseyhightower/envconfig"
@@ -17,10 +19,24 @@ type DBConfiguration struct {
 	Automigrate bool
 }
 
-// JWTConfiguration holds all the JWT related configuration.
+// JWTConfiguration holds all the JWT related configuration. Roles maps the
+// roles of gocommerce, support, fulfillment, finance and superadmin, to the
+// roles of the claims granting them. Roles that aren't mapped aren't granted,
+// except for superadmin, which the AdminGroupName always grants.
+//
+// HS256 tokens are verified with the Secret and RS256 tokens with the keys of
+// the JWKSURL. Tokens must have the Audience and Issuer, if set.
 type JWTConfiguration struct {
-	Secret         string `json:"secret"`
-	AdminGroupName string `json:"admin_group_name" split_words:"true"`
+	Secret         string              `json:"secret"`
+	AdminGroupName string              `json:"admin_group_name" split_words:"true"`
+	Roles          map[string][]string `json:"roles,omitempty"`
+	JWKSURL        string              `json:"jwks_url" envconfig:"JWKS_URL"`
+	Audience       string              `json:"audience"`
+	Issuer         string              `json:"issuer"`
+	// AssumeEmailVerified lets tokens without an email_verified claim claim
+	// orders, for identity providers that only issue tokens for confirmed
+	// emails.
+	AssumeEmailVerified bool `json:"assume_email_verified" split_words:"true"`
 }
 
 type SMTPConfiguration struct {
@@ -43,12 +59,97 @@ type GlobalConfiguration struct {
 	OperatorToken     string        `split_words:"true"`
 	MultiInstanceMode bool
 	SMTP              SMTPConfiguration `json:"smtp"`
+
+	// Sweeper configures the background job expiring stale pending orders.
+	Sweeper struct {
+		Interval time.Duration `default:"10m"`
+	}
+
+	// Rollups configures the background job rolling up the daily sales for
+	// the sales report and the customers for the cohorts report. Refresh is how far back days are rolled up again
+	// once a day.
+	Rollups struct {
+		Interval time.Duration `default:"1h"`
+		Refresh  time.Duration `default:"720h"`
+	}
+
+	// RateLimit configures where the requests counting towards the rate
+	// limits of the instances are stored: memory, or redis to share the
+	// limits between servers, at the RedisURL. Behind proxies, the IP address
+	// of a client is taken from the ClientIPHeader the proxies set, skipping
+	// the addresses or CIDR ranges of the TrustedProxies.
+	RateLimit struct {
+		Store          string   `default:"memory"`
+		RedisURL       string   `envconfig:"REDIS_URL"`
+		ClientIPHeader string   `split_words:"true"`
+		TrustedProxies []string `split_words:"true"`
+	} `split_words:"true"`
+}
+
+// PaymentProviderConfiguration holds the configuration for a registered payment provider.
+type PaymentProviderConfiguration struct {
+	Enabled bool                   `json:"enabled"`
+	Config  map[string]interface{} `json:"config"`
 }
 
 // EmailContentConfiguration holds the configuration for emails, both subjects and template URLs.
 type EmailContentConfiguration struct {
 	OrderConfirmation string `json:"order_confirmation" split_words:"true"`
 	OrderReceived     string `json:"order_received" split_words:"true"`
+	PaymentRetry      string `json:"payment_retry" split_words:"true"`
+	AbandonedOrder    string `json:"abandoned_order" split_words:"true"`
+	ShipmentDelivered string `json:"shipment_delivered" split_words:"true"`
+	ReadyForPickup    string `json:"ready_for_pickup" split_words:"true"`
+	LowStock          string `json:"low_stock" split_words:"true"`
+	BackInStock       string `json:"back_in_stock" split_words:"true"`
+	ScheduledReport   string `json:"scheduled_report" split_words:"true"`
+	ReportFailed      string `json:"report_failed" split_words:"true"`
+}
+
+// ReportSchedule exports a report for the previous day or week as a CSV file
+// and delivers it to an email address, a webhook or an S3 bucket. Report is
+// sales or taxes, Interval day or week.
+type ReportSchedule struct {
+	Name     string `json:"name"`
+	Report   string `json:"report"`
+	Interval string `json:"interval"`
+
+	Email   string                      `json:"email,omitempty"`
+	Webhook string                      `json:"webhook,omitempty"`
+	S3      *S3DestinationConfiguration `json:"s3,omitempty"`
+}
+
+// RateLimitConfiguration limits the requests to a group of routes in every
+// Window of seconds, a minute by default. Requests made with an API key
+// count towards the APIKey limit of the key, requests with a JWT towards the
+// User limit of its subject and other requests towards the IP limit of their
+// IP address. A limit of zero disables it.
+type RateLimitConfiguration struct {
+	IP     uint64 `json:"ip"`
+	User   uint64 `json:"user"`
+	APIKey uint64 `json:"api_key"`
+	Window uint64 `json:"window"`
+}
+
+// WindowDuration returns the window the requests of the limits are counted
+// in.
+func (c RateLimitConfiguration) WindowDuration() time.Duration {
+	if c.Window == 0 {
+		return time.Minute
+	}
+	return time.Duration(c.Window) * time.Second
+}
+
+// S3DestinationConfiguration is an S3 bucket reports are uploaded to, under the
+// Prefix. Endpoint replaces the AWS endpoint for S3 compatible stores, with
+// the bucket in the path.
+type S3DestinationConfiguration struct {
+	Bucket          string `json:"bucket"`
+	Region          string `json:"region"`
+	Prefix          string `json:"prefix"`
+	Endpoint        string `json:"endpoint"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
 }
 
 // Configuration holds all the per-tenant configuration for gocommerce
@@ -68,31 +169,340 @@ type Configuration struct {
 			Enabled   bool   `json:"enabled"`
 			PublicKey string `json:"public_key" split_words:"true"`
 			SecretKey string `json:"secret_key" split_words:"true"`
+
+			// ApplePayDomainAssociation is the content of the Apple Pay domain
+			// verification file served under /.well-known.
+			ApplePayDomainAssociation string `json:"apple_pay_domain_association" split_words:"true"`
+
+			// WebhookSecret is the signing secret used to verify events sent to /webhooks/stripe.
+			WebhookSecret string `json:"webhook_secret" split_words:"true"`
 		} `json:"stripe"`
 		PayPal struct {
 			Enabled  bool   `json:"enabled"`
 			ClientID string `json:"client_id" split_words:"true"`
 			Secret   string `json:"secret"`
 			Env      string `json:"env"`
+
+			// WebhookID is used to verify events sent to /webhooks/paypal.
+			WebhookID string `json:"webhook_id" split_words:"true"`
 		} `json:"paypal"`
+		Adyen struct {
+			Enabled         bool   `json:"enabled"`
+			APIKey          string `json:"api_key" split_words:"true"`
+			MerchantAccount string `json:"merchant_account" split_words:"true"`
+			ClientKey       string `json:"client_key" split_words:"true"`
+			Env             string `json:"env"`
+			LiveURLPrefix   string `json:"live_url_prefix" split_words:"true"`
+		} `json:"adyen"`
+		Manual struct {
+			Enabled      bool   `json:"enabled"`
+			Instructions string `json:"instructions"`
+		} `json:"manual"`
+		Coinbase struct {
+			Enabled bool   `json:"enabled"`
+			APIKey  string `json:"api_key" split_words:"true"`
+			Env     string `json:"env"`
+
+			// WebhookSecret is the shared secret used to verify events sent to /webhooks/coinbase.
+			WebhookSecret string `json:"webhook_secret" split_words:"true"`
+		} `json:"coinbase"`
+		Klarna struct {
+			Enabled  bool   `json:"enabled"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+			Env      string `json:"env"`
+			Region   string `json:"region"`
+
+			// NotificationURL is where Klarna reports the approval of reviewed
+			// orders, i.e. the URL of /webhooks/klarna.
+			NotificationURL string `json:"notification_url" split_words:"true"`
+		} `json:"klarna"`
+
+		// Dunning configures the retries of failed payments. RetrySchedule
+		// holds the days after the failure at which the payment is retried,
+		// e.g. [1, 3, 7]. Failed payments aren't retried if it's empty.
+		Dunning struct {
+			RetrySchedule []uint64 `json:"retry_schedule" split_words:"true"`
+		} `json:"dunning"`
+
+		// Sandbox marks the orders and transactions of the instance as test
+		// data, i.e. the payment providers are configured with test keys.
+		// Test data is left out of reports unless requested explicitly.
+		Sandbox bool `json:"sandbox"`
+
+		// Countries restricts the payment providers available for orders
+		// billed or shipped to a country, keyed by the country of the
+		// address. Providers aren't restricted for countries without an entry.
+		Countries map[string][]string `json:"countries"`
+
+		// Providers configures additional payment providers registered
+		// through payments.Register, keyed by provider name.
+		Providers map[string]PaymentProviderConfiguration `json:"providers"`
 	} `json:"payment"`
 
+	// Orders configures the expiry of orders that haven't been paid and their
+	// numbers. PendingTTL is the number of hours after which pending and
+	// authorized orders expire and their authorizations are voided. Orders
+	// don't expire if it's zero. NumberPrefix starts the human readable
+	// numbers of new orders, it defaults to SO. AbandonedAfter is the number
+	// of hours after which pending orders with a contact email are marked as
+	// abandoned, it defaults to 1. Orders older than AbandonedMaxAge hours,
+	// 168 by default, aren't marked anymore. EnableRecovery opts the instance
+	// in to the webhook and email sent for abandoned orders.
+	Orders struct {
+		PendingTTL      uint64 `json:"pending_ttl" split_words:"true"`
+		NumberPrefix    string `json:"number_prefix" split_words:"true"`
+		AbandonedAfter  uint64 `json:"abandoned_after" split_words:"true"`
+		AbandonedMaxAge uint64 `json:"abandoned_max_age" split_words:"true"`
+		EnableRecovery  bool   `json:"enable_recovery" split_words:"true"`
+	} `json:"orders"`
+
+	// Stock configures the reservations holding the stock of tracked products
+	// for unpaid orders. ReservationTTL is how long, in minutes, an order
+	// holds its items before they're available to other orders again, 15 by
+	// default. LowStockThreshold is the quantity below which products are low
+	// on stock if their stock item doesn't set one, and LowStockEmail emails
+	// the store admin about them besides triggering the low_stock webhook.
+	Stock struct {
+		ReservationTTL    uint64 `json:"reservation_ttl" split_words:"true"`
+		LowStockThreshold uint64 `json:"low_stock_threshold" split_words:"true"`
+		LowStockEmail     bool   `json:"low_stock_email" split_words:"true"`
+	} `json:"stock"`
+
+	// Invoices configures the numbering of the invoices issued for paid
+	// orders. PerCountry numbers them in a separate series for each billing
+	// country instead of a single series for the instance.
+	Invoices struct {
+		PerCountry bool `json:"per_country" split_words:"true"`
+	} `json:"invoices"`
+
+	// Retention configures how long the personal data of orders is kept.
+	// Orders older than Months are anonymized: the email and IP of the order
+	// and the names and streets of its addresses are removed and its events
+	// are deleted, while the amounts and tax data are kept. Orders are kept
+	// as they are if it's zero.
+	Retention struct {
+		Months uint64 `json:"months"`
+	} `json:"retention"`
+
+	// Export configures the exports of the personal data of users. Accounts
+	// with up to SyncOrderLimit orders, 50 by default, are exported within the
+	// request and larger ones in the background. LinkTTL is how many hours the
+	// download links of background exports are valid, 24 by default.
+	Export struct {
+		SyncOrderLimit uint64 `json:"sync_order_limit" split_words:"true"`
+		LinkTTL        uint64 `json:"link_ttl" split_words:"true"`
+	} `json:"export"`
+
+	// Reports configures the reports exported on a schedule, like a daily
+	// sales CSV or a weekly tax summary. Timezone is the IANA time zone the
+	// reports group their days, weeks, months and quarters in by default,
+	// UTC if it's not set.
+	Reports struct {
+		Timezone  string           `json:"timezone"`
+		Schedules []ReportSchedule `json:"schedules"`
+	} `json:"reports"`
+
+	// RateLimits configures the rate limits of creating orders, looking up
+	// coupons and accessing downloads.
+	RateLimits struct {
+		Orders    RateLimitConfiguration `json:"orders"`
+		Coupons   RateLimitConfiguration `json:"coupons"`
+		Downloads RateLimitConfiguration `json:"downloads"`
+	} `json:"rate_limits" split_words:"true"`
+
+	// Downloads configures the asset store of downloads and how often they
+	// can be used. MaxIPsPerDay limits the IPs an order's downloads can be
+	// accessed from within a day, it defaults to 50. MaxDownloads limits how
+	// often each download can be accessed, it's unlimited if zero. Products
+	// can override both limits in their metadata. OneTimeTokens hands out
+	// single use tokens redeemed at /downloads/redeem/{token} instead of
+	// signed URLs.
 	Downloads struct {
 		Provider     string `json:"provider"`
 		NetlifyToken string `json:"netlify_token" split_words:"true"`
+		MaxIPsPerDay uint64 `json:"max_ips_per_day" split_words:"true"`
+		MaxDownloads uint64 `json:"max_downloads" split_words:"true"`
+
+		OneTimeTokens bool `json:"one_time_tokens" split_words:"true"`
+
+		// Proxy streams the assets through the API instead of redirecting to
+		// signed URLs, for asset stores that can't sign URLs. Range requests
+		// are passed on, so downloads can be resumed. Assets are only fetched
+		// from the ProxyHosts of the asset store. ProxyAuthorization is sent
+		// as the Authorization header to the asset store.
+		Proxy              bool     `json:"proxy"`
+		ProxyHosts         []string `json:"proxy_hosts" split_words:"true"`
+		ProxyAuthorization string   `json:"proxy_authorization" split_words:"true"`
+
+		// CountryHeader is the header of the CDN in front of the API with the
+		// country of the client, e.g. CF-IPCountry, which is logged with the
+		// accesses of downloads.
+		CountryHeader string `json:"country_header" split_words:"true"`
+
+		// WatermarkURL is the service that stamps the downloads marked for
+		// watermarking with the email and number of their order. It's sent
+		// a signed URL of the asset and responds with the URL of the copy.
+		WatermarkURL string `json:"watermark_url" split_words:"true"`
+
+		// GCS configures the gcs provider, which signs the URLs of assets
+		// hosted on Google Cloud Storage. Credentials is the JSON key of the
+		// service account to sign with, TTL the seconds signed URLs are
+		// valid for. TTL defaults to an hour and is at most 7 days.
+		GCS struct {
+			Credentials string `json:"credentials"`
+			TTL         uint64 `json:"ttl"`
+		} `json:"gcs"`
+
+		// Azure configures the azure provider, which signs the URLs of
+		// assets hosted on Azure Blob Storage with SAS tokens. They're signed
+		// with the account key of ConnectionString, or with the managed
+		// identity of the host for AccountName if there's no connection
+		// string. ClientID selects a user assigned identity. TTL is the
+		// seconds the tokens are valid for, it defaults to 15 minutes.
+		Azure struct {
+			ConnectionString string `json:"connection_string" split_words:"true"`
+			AccountName      string `json:"account_name" split_words:"true"`
+			ClientID         string `json:"client_id" split_words:"true"`
+			TTL              uint64 `json:"ttl"`
+		} `json:"azure"`
+
+		// CloudFront configures the cloudfront provider, which signs download
+		// URLs for a CloudFront distribution with a canned policy. Domain is
+		// the domain of the distribution the URLs are moved to. The key pair
+		// is either KeyPairID and PrivateKey or read from KeyFile, a JSON file
+		// with key_pair_id and private_key that is read again once it's
+		// modified, so the key can be rotated without a restart. TTL is the
+		// seconds signed URLs are valid for, it defaults to 15 minutes.
+		CloudFront struct {
+			Domain     string `json:"domain"`
+			KeyPairID  string `json:"key_pair_id" split_words:"true"`
+			PrivateKey string `json:"private_key" split_words:"true"`
+			KeyFile    string `json:"key_file" split_words:"true"`
+			TTL        uint64 `json:"ttl"`
+		} `json:"cloudfront"`
 	} `json:"downloads"`
 
+	// Licenses configures how the license keys of products that require a
+	// license are generated. Generator is random, the default, or vendor,
+	// which requests the keys from VendorURL or the license_url of the
+	// product. Products can pick their own license_generator.
+	Licenses struct {
+		Generator string `json:"generator"`
+		VendorURL string `json:"vendor_url" split_words:"true"`
+	} `json:"licenses"`
+
 	Coupons struct {
 		URL      string `json:"url"`
 		User     string `json:"user"`
 		Password string `json:"password"`
 	} `json:"coupons"`
 
+	// Referrals configures the reward referrers get once an order created
+	// with their referral code is paid. Reward is credit, which books
+	// CreditAmount in the lowest unit of the order currency to their store
+	// credit, or coupon, which gives them a single use coupon for
+	// CouponPercentage off that is valid for CouponValidDays, or forever if
+	// zero. Referrals aren't rewarded if Reward is empty.
+	Referrals struct {
+		Reward           string `json:"reward"`
+		CreditAmount     uint64 `json:"credit_amount" split_words:"true"`
+		CouponPercentage uint64 `json:"coupon_percentage" split_words:"true"`
+		CouponValidDays  int    `json:"coupon_valid_days" split_words:"true"`
+	} `json:"referrals"`
+
+	// Tax configures an external backend calculating the taxes of orders
+	// shipping to one of the Countries, as named in the addresses of orders,
+	// instead of the tax rates of the site settings. Provider is taxjar or
+	// avatax, and the settings are used if it's empty. From is the address
+	// orders ship from. The backend isn't used for sites with prices
+	// including taxes.
+	Tax struct {
+		Provider  string   `json:"provider"`
+		Countries []string `json:"countries"`
+
+		From struct {
+			Country string `json:"country"`
+			Zip     string `json:"zip"`
+			State   string `json:"state"`
+			City    string `json:"city"`
+			Street  string `json:"street"`
+		} `json:"from"`
+
+		TaxJar struct {
+			APIKey string `json:"api_key" split_words:"true"`
+			URL    string `json:"url"`
+		} `json:"taxjar"`
+
+		AvaTax struct {
+			AccountID   string `json:"account_id" split_words:"true"`
+			LicenseKey  string `json:"license_key" split_words:"true"`
+			CompanyCode string `json:"company_code" split_words:"true"`
+			Sandbox     bool   `json:"sandbox"`
+			URL         string `json:"url"`
+		} `json:"avatax"`
+	} `json:"tax"`
+
+	// Shipping configures a carrier backend quoting live shipping rates next
+	// to the shipping methods of the site settings. Provider is easypost, and
+	// only the settings are used if it's empty. From is the address parcels
+	// ship from. Quotes can be picked at checkout for RateTTL seconds, 10
+	// minutes by default. TrackingProvider is the backend tracking the
+	// delivery of shipments, easypost.
+	Shipping struct {
+		Provider         string `json:"provider"`
+		RateTTL          int    `json:"rate_ttl" split_words:"true"`
+		TrackingProvider string `json:"tracking_provider" split_words:"true"`
+
+		From struct {
+			Name    string `json:"name"`
+			Country string `json:"country"`
+			Zip     string `json:"zip"`
+			State   string `json:"state"`
+			City    string `json:"city"`
+			Street  string `json:"street"`
+		} `json:"from"`
+
+		EasyPost struct {
+			APIKey        string `json:"api_key" split_words:"true"`
+			WebhookSecret string `json:"webhook_secret" split_words:"true"`
+			URL           string `json:"url"`
+		} `json:"easypost"`
+	} `json:"shipping"`
+
+	// AddressValidation configures a backend validating, normalizing and
+	// geocoding the shipping addresses of orders. Provider is google, and
+	// addresses aren't validated if it's empty. Orders shipping to addresses
+	// the backend finds undeliverable are rejected with RejectUndeliverable,
+	// and only flagged otherwise.
+	AddressValidation struct {
+		Provider            string `json:"provider"`
+		RejectUndeliverable bool   `json:"reject_undeliverable" split_words:"true"`
+
+		Google struct {
+			APIKey string `json:"api_key" split_words:"true"`
+			URL    string `json:"url"`
+		} `json:"google"`
+	} `json:"address_validation" split_words:"true"`
+
+	// TaxExemption exempts all orders of the instance from taxes, like those
+	// of a reseller, referencing its exemption certificate.
+	TaxExemption struct {
+		Exempt      bool   `json:"exempt"`
+		Certificate string `json:"certificate"`
+	} `json:"tax_exemption" split_words:"true"`
+
 	Webhooks struct {
-		Order   string `json:"order"`
-		Payment string `json:"payment"`
-		Update  string `json:"update"`
-		Refund  string `json:"refund"`
+		Order     string `json:"order"`
+		Payment   string `json:"payment"`
+		Update    string `json:"update"`
+		Refund    string `json:"refund"`
+		Dunning   string `json:"dunning"`
+		Cancelled string `json:"cancelled"`
+		Abandoned string `json:"abandoned"`
+		LowStock  string `json:"low_stock" split_words:"true"`
+
+		ReportFailed string `json:"report_failed" split_words:"true"`
 
 		Secret string `json:"secret"`
 	} `json:"webhooks"`
@@ -102,6 +512,95 @@ func (c *Configuration) SettingsURL() string {
 	return c.SiteURL + "/gocommerce/settings.json"
 }
 
+// PaymentRetrySchedule returns the delays after a failed payment at which it is retried.
+func (c *Configuration) PaymentRetrySchedule() []time.Duration {
+	schedule := make([]time.Duration, len(c.Payment.Dunning.RetrySchedule))
+	for i, days := range c.Payment.Dunning.RetrySchedule {
+		schedule[i] = time.Duration(days) * 24 * time.Hour
+	}
+	return schedule
+}
+
+// PendingOrderTTL returns how long orders can stay unpaid before they expire.
+func (c *Configuration) PendingOrderTTL() time.Duration {
+	return time.Duration(c.Orders.PendingTTL) * time.Hour
+}
+
+// StockReservationTTL returns how long unpaid orders hold the stock of their
+// items.
+func (c *Configuration) StockReservationTTL() time.Duration {
+	if c.Stock.ReservationTTL == 0 {
+		return 15 * time.Minute
+	}
+	return time.Duration(c.Stock.ReservationTTL) * time.Minute
+}
+
+// ExportSyncOrderLimit returns the number of orders up to which the personal
+// data of users is exported within the request.
+func (c *Configuration) ExportSyncOrderLimit() int {
+	if c.Export.SyncOrderLimit == 0 {
+		return 50
+	}
+	return int(c.Export.SyncOrderLimit)
+}
+
+// ExportLinkTTL returns how long the download links of background exports are
+// valid.
+func (c *Configuration) ExportLinkTTL() time.Duration {
+	if c.Export.LinkTTL == 0 {
+		return 24 * time.Hour
+	}
+	return time.Duration(c.Export.LinkTTL) * time.Hour
+}
+
+// RetentionCutoff returns the time before which the personal data of orders is
+// removed. It reports false if the personal data is kept forever.
+func (c *Configuration) RetentionCutoff(now time.Time) (time.Time, bool) {
+	if c.Retention.Months == 0 {
+		return time.Time{}, false
+	}
+	return now.AddDate(0, -int(c.Retention.Months), 0), true
+}
+
+// AbandonedOrderDelay returns how long pending orders can stay unpaid before
+// they are considered abandoned.
+func (c *Configuration) AbandonedOrderDelay() time.Duration {
+	if c.Orders.AbandonedAfter == 0 {
+		return time.Hour
+	}
+	return time.Duration(c.Orders.AbandonedAfter) * time.Hour
+}
+
+// AbandonedOrderMaxAge returns how old pending orders can be at most to be
+// considered abandoned, so orders that have been pending for long aren't
+// recovered.
+func (c *Configuration) AbandonedOrderMaxAge() time.Duration {
+	if c.Orders.AbandonedMaxAge == 0 {
+		return 7 * 24 * time.Hour
+	}
+	return time.Duration(c.Orders.AbandonedMaxAge) * time.Hour
+}
+
+// PaymentProviderAllowed reports whether the payment provider can be used for
+// payments of orders from the country.
+func (c *Configuration) PaymentProviderAllowed(provider, country string) bool {
+	if country == "" {
+		return true
+	}
+	for name, providers := range c.Payment.Countries {
+		if !strings.EqualFold(name, country) {
+			continue
+		}
+		for _, p := range providers {
+			if strings.EqualFold(p, provider) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
 func loadEnvironment(filename string) error {
 	var err error
 	if filename != "" {
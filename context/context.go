@@ -1,7 +1,8 @@
 package context
 
 import (
-	"fmt"
+	"encoding/json"
+	"strings"
 
 	"context"
 
@@ -29,6 +30,8 @@ const (
 	couponsKey         = contextKey("coupons")
 	requestIDKey       = contextKey("request_id")
 	adminFlagKey       = contextKey("is_admin")
+	rolesKey           = contextKey("roles")
+	permissionsKey     = contextKey("permissions")
 	mailerKey          = contextKey("mailer")
 	assetStoreKey      = contextKey("asset_store")
 	paymentProviderKey = contextKey("payment-provider")
@@ -153,26 +156,25 @@ func GetClaims(ctx context.Context) *claims.JWTClaims {
 }
 
 // GetClaimsAsMap reads the claims contained with the JWT token stored in the
-// context, as a map.
+// context, as a map. The token has been verified when it was stored, with
+// either the JWT secret or the keys of the JWKS URL.
 func GetClaimsAsMap(ctx context.Context) map[string]interface{} {
 	token := GetToken(ctx)
 	if token == nil {
 		return nil
 	}
-	config := GetConfig(ctx)
-	if config == nil {
+	parts := strings.Split(token.Raw, ".")
+	if len(parts) != 3 {
 		return nil
 	}
-	claims := jwt.MapClaims{}
-	_, err := jwt.ParseWithClaims(token.Raw, &claims, func(token *jwt.Token) (interface{}, error) {
-		if token.Header["alg"] != jwt.SigningMethodHS256.Name {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(config.JWT.Secret), nil
-	})
+	data, err := jwt.DecodeSegment(parts[1])
 	if err != nil {
 		return nil
 	}
+	claims := jwt.MapClaims{}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil
+	}
 
 	return map[string]interface{}(claims)
 }
@@ -191,6 +193,28 @@ func IsAdmin(ctx context.Context) bool {
 	return obj.(bool)
 }
 
+// WithRoles adds the roles of the claims to the context.
+func WithRoles(ctx context.Context, roles []string) context.Context {
+	return context.WithValue(ctx, rolesKey, roles)
+}
+
+// GetRoles reads the roles of the claims from the context.
+func GetRoles(ctx context.Context) []string {
+	roles, _ := ctx.Value(rolesKey).([]string)
+	return roles
+}
+
+// WithPermissions adds the permissions an API key is scoped to to the context.
+func WithPermissions(ctx context.Context, permissions []string) context.Context {
+	return context.WithValue(ctx, permissionsKey, permissions)
+}
+
+// GetPermissions reads the permissions of the API key from the context.
+func GetPermissions(ctx context.Context) []string {
+	permissions, _ := ctx.Value(permissionsKey).([]string)
+	return permissions
+}
+
 // GetUserID reads the user ID from the context.
 func GetUserID(ctx context.Context) string {
 	id, _ := ctx.Value(userIDKey).(string)
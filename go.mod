@@ -7,7 +7,9 @@ require (
 	github.com/denisenkom/go-mssqldb v0.0.0-20190906004059-62cf760a6c9e // indirect
 	github.com/dgrijalva/jwt-go v3.0.0+incompatible
 	github.com/go-chi/chi v3.1.0+incompatible
+	github.com/go-pdf/fpdf v0.6.0
 	github.com/go-sql-driver/mysql v1.4.1
+	github.com/gomodule/redigo v1.8.5
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
 	github.com/jinzhu/gorm v1.9.10
 	github.com/joho/godotenv v0.0.0-20161216230537-726cc8b906e3
@@ -22,20 +24,20 @@ require (
 	github.com/netlify/mailme v0.0.0-20170821082834-c4a76ce443c1
 	github.com/pariz/gountries v0.0.0-20171019111738-adb00f6513a3
 	github.com/pborman/uuid v0.0.0-20160209185913-a97ce2ca70fa
-	github.com/pkg/errors v0.8.0
+	github.com/pkg/errors v0.9.1
 	github.com/plutov/paypal v2.0.5+incompatible // indirect
 	github.com/rs/cors v0.0.0-20170608165155-8dd4211afb5d
 	github.com/sebest/xff v0.0.0-20160910043805-6c115e0ffa35
 	github.com/sirupsen/logrus v1.4.2
 	github.com/spf13/cobra v0.0.0-20170228191748-fcd0c5a1df88
 	github.com/spf13/pflag v1.0.0 // indirect
-	github.com/stretchr/testify v1.2.2
+	github.com/stretchr/testify v1.5.1
 	github.com/stripe/stripe-go v62.9.0+incompatible
 	golang.org/x/net v0.0.0-20190620200207-3b0461eec859 // indirect
 	golang.org/x/sync v0.0.0-20190423024810-112230192c58 // indirect
 	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
-	gopkg.in/gomail.v2 v2.0.0-20150902115704-41f357289737 // indirect
+	gopkg.in/gomail.v2 v2.0.0-20150902115704-41f357289737
 )
 
 go 1.13
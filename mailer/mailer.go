@@ -1,13 +1,17 @@
 package mailer
 
 import (
+	"bytes"
 	"fmt"
+	"html/template"
+	"io"
 	"log"
 	"time"
 
 	"github.com/netlify/gocommerce/conf"
 	"github.com/netlify/gocommerce/models"
 	"github.com/netlify/mailme"
+	gomail "gopkg.in/gomail.v2"
 )
 
 // Mailer will send mail and use templates from the site for easy mail styling
@@ -15,6 +19,14 @@ type Mailer interface {
 	OrderConfirmationMail(transaction *models.Transaction) error
 	OrderReceivedMail(transaction *models.Transaction) error
 	OrderConfirmationMailBody(transaction *models.Transaction, templateURL string) (string, error)
+	PaymentRetryMail(order *models.Order, retry *models.PaymentRetry) error
+	AbandonedOrderMail(order *models.Order, unsubscribeURL string) error
+	ShipmentDeliveredMail(order *models.Order, shipment *models.Shipment) error
+	ReadyForPickupMail(order *models.Order) error
+	LowStockMail(items []*models.StockItem) error
+	BackInStockMail(email string, item *models.WishlistItem, unsubscribeURL string) error
+	ScheduledReportMail(to string, run *models.ReportRun, filename string, report []byte) error
+	ReportFailedMail(run *models.ReportRun) error
 }
 
 type mailer struct {
@@ -97,6 +109,9 @@ func hasProductType(order *models.Order, productType string) bool {
 }
 
 const defaultConfirmationTemplate = `<h2>Thank you for your order!</h2>
+{{ if .Order.Number }}
+<p>Order number: <strong>{{ .Order.Number }}</strong></p>
+{{ end }}
 
 <ul>
 {{ range .Order.LineItems }}
@@ -105,6 +120,16 @@ const defaultConfirmationTemplate = `<h2>Thank you for your order!</h2>
 </ul>
 
 <p>Total amount: <strong>{{ .Order.Total }}</strong></p>
+{{ if .Order.Licenses }}
+
+<p>Your license keys:</p>
+
+<ul>
+{{ range .Order.Licenses }}
+<li>{{ .Title }}: <strong>{{ .Key }}</strong></li>
+{{ end }}
+</ul>
+{{ end }}
 `
 
 // OrderConfirmationMail sends an order confirmation to the user
@@ -124,6 +149,9 @@ func (m *mailer) OrderConfirmationMail(transaction *models.Transaction) error {
 }
 
 const defaultReceivedTemplate = `<h2>Order Received From {{ .Order.Email }}</h2>
+{{ if .Order.Number }}
+<p>Order number: <strong>{{ .Order.Number }}</strong></p>
+{{ end }}
 
 <ul>
 {{ range .Order.LineItems }}
@@ -161,6 +189,278 @@ func (m *mailer) OrderConfirmationMailBody(transaction *models.Transaction, temp
 	})
 }
 
+const defaultPaymentRetryTemplate = `{{ if eq .Retry.Status "pending" }}
+<h2>We couldn't process the payment for your order</h2>
+
+<p>We will try to charge {{ .Order.Total }} again on {{ dateFormat "January 2, 2006" .NextAttemptAt }}.</p>
+{{ else if eq .Retry.Status "succeeded" }}
+<h2>Your payment went through</h2>
+
+<p>Thank you, the payment of {{ .Order.Total }} for your order has been processed.</p>
+{{ else }}
+<h2>We couldn't process the payment for your order</h2>
+
+<p>We gave up retrying to charge {{ .Order.Total }} for your order.</p>
+{{ end }}
+`
+
+// PaymentRetryMail notifies the user about a step of retrying a failed payment
+func (m *mailer) PaymentRetryMail(order *models.Order, retry *models.PaymentRetry) error {
+	var nextAttemptAt time.Time
+	if retry.NextAttemptAt != nil {
+		nextAttemptAt = *retry.NextAttemptAt
+	}
+	return m.TemplateMailer.Mail(
+		order.Email,
+		withDefault(m.Config.Mailer.Subjects.PaymentRetry, "Payment for your order"),
+		m.Config.Mailer.Templates.PaymentRetry,
+		defaultPaymentRetryTemplate,
+		map[string]interface{}{
+			"SiteURL":       m.Config.SiteURL,
+			"Order":         order,
+			"Retry":         retry,
+			"NextAttemptAt": nextAttemptAt,
+		},
+	)
+}
+
+const defaultAbandonedOrderTemplate = `<h2>You left something behind</h2>
+
+<p>Your order hasn't been paid yet, these items are still waiting for you:</p>
+
+<ul>
+{{ range .Order.LineItems }}
+<li>{{ .Title }} <strong>{{ .Quantity }} x {{ .Price }}</strong></li>
+{{ end }}
+</ul>
+
+<p>Total amount: <strong>{{ .Order.Total }}</strong></p>
+
+<p><a href="{{ .SiteURL }}">Complete your order</a></p>
+
+<p><small><a href="{{ .UnsubscribeURL }}">Unsubscribe</a> from these emails.</small></p>
+`
+
+// AbandonedOrderMail reminds the user of an order that was left unpaid
+func (m *mailer) AbandonedOrderMail(order *models.Order, unsubscribeURL string) error {
+	return m.marketingMail(
+		order.Email,
+		withDefault(m.Config.Mailer.Subjects.AbandonedOrder, "Complete your order"),
+		m.Config.Mailer.Templates.AbandonedOrder,
+		defaultAbandonedOrderTemplate,
+		map[string]interface{}{
+			"SiteURL":        m.Config.SiteURL,
+			"Order":          order,
+			"UnsubscribeURL": unsubscribeURL,
+		},
+	)
+}
+
+const defaultShipmentDeliveredTemplate = `<h2>Your order has been delivered</h2>
+
+<p>{{ .Shipment.Carrier }} delivered your shipment {{ .Shipment.TrackingNumber }} of order {{ .Order.Number }}:</p>
+
+<ul>
+{{ range .Shipment.Items }}
+<li>{{ .Quantity }} x {{ .Sku }}</li>
+{{ end }}
+</ul>
+`
+
+// ShipmentDeliveredMail notifies the user that a shipment of an order has
+// been delivered
+func (m *mailer) ShipmentDeliveredMail(order *models.Order, shipment *models.Shipment) error {
+	return m.TemplateMailer.Mail(
+		order.Email,
+		withDefault(m.Config.Mailer.Subjects.ShipmentDelivered, "Your order has been delivered"),
+		m.Config.Mailer.Templates.ShipmentDelivered,
+		defaultShipmentDeliveredTemplate,
+		map[string]interface{}{
+			"SiteURL":  m.Config.SiteURL,
+			"Order":    order,
+			"Shipment": shipment,
+		},
+	)
+}
+
+const defaultReadyForPickupTemplate = `<h2>Your order is ready for pickup</h2>
+
+<p>Order {{ .Order.Number }} is waiting for you at:</p>
+
+<p>
+{{ .Order.ShippingAddress.Name }}<br>
+{{ .Order.ShippingAddress.Address1 }}<br>
+{{ if .Order.ShippingAddress.Address2 }}{{ .Order.ShippingAddress.Address2 }}<br>{{ end }}
+{{ .Order.ShippingAddress.Zip }} {{ .Order.ShippingAddress.City }}
+</p>
+`
+
+// ReadyForPickupMail notifies the user that an order can be picked up at its
+// pickup location
+func (m *mailer) ReadyForPickupMail(order *models.Order) error {
+	return m.TemplateMailer.Mail(
+		order.Email,
+		withDefault(m.Config.Mailer.Subjects.ReadyForPickup, "Your order is ready for pickup"),
+		m.Config.Mailer.Templates.ReadyForPickup,
+		defaultReadyForPickupTemplate,
+		map[string]interface{}{
+			"SiteURL": m.Config.SiteURL,
+			"Order":   order,
+		},
+	)
+}
+
+const defaultLowStockTemplate = `<h2>Products running low on stock</h2>
+
+<ul>
+{{ range .Items }}
+<li>{{ .Sku }}: <strong>{{ .Quantity }} left</strong></li>
+{{ end }}
+</ul>
+`
+
+// LowStockMail notifies the shop admin about products that dropped below
+// their low stock threshold
+func (m *mailer) LowStockMail(items []*models.StockItem) error {
+	return m.TemplateMailer.Mail(
+		m.TemplateMailer.From,
+		withDefault(m.Config.Mailer.Subjects.LowStock, "Products running low on stock"),
+		m.Config.Mailer.Templates.LowStock,
+		defaultLowStockTemplate,
+		map[string]interface{}{
+			"SiteURL": m.Config.SiteURL,
+			"Items":   items,
+		},
+	)
+}
+
+const defaultBackInStockTemplate = `<h2>{{ .Item.Title }} is back in stock</h2>
+
+<p>A product on your wishlist is available again:</p>
+
+<p><a href="{{ .SiteURL }}{{ .Item.Path }}">{{ .Item.Title }}</a></p>
+
+<p><small><a href="{{ .UnsubscribeURL }}">Unsubscribe</a> from these emails.</small></p>
+`
+
+// BackInStockMail notifies a user that a product on their wishlist is back
+// in stock
+func (m *mailer) BackInStockMail(email string, item *models.WishlistItem, unsubscribeURL string) error {
+	return m.marketingMail(
+		email,
+		withDefault(m.Config.Mailer.Subjects.BackInStock, "A product on your wishlist is back in stock"),
+		m.Config.Mailer.Templates.BackInStock,
+		defaultBackInStockTemplate,
+		map[string]interface{}{
+			"SiteURL":        m.Config.SiteURL,
+			"Item":           item,
+			"UnsubscribeURL": unsubscribeURL,
+		},
+	)
+}
+
+const defaultScheduledReportTemplate = `<h2>Your {{ .Run.Report }} report</h2>
+
+<p>The {{ .Run.Schedule }} report from {{ .Run.PeriodStart | dateFormat "2006-01-02" }} to {{ .Run.PeriodEnd | dateFormat "2006-01-02" }} is attached as {{ .Filename }}.</p>
+`
+
+// ScheduledReportMail delivers the CSV file of a scheduled report as an
+// attachment
+func (m *mailer) ScheduledReportMail(to string, run *models.ReportRun, filename string, report []byte) error {
+	return m.mailWithAttachment(
+		to,
+		withDefault(m.Config.Mailer.Subjects.ScheduledReport, "Your {{ .Run.Report }} report"),
+		m.Config.Mailer.Templates.ScheduledReport,
+		defaultScheduledReportTemplate,
+		map[string]interface{}{
+			"SiteURL":  m.Config.SiteURL,
+			"Run":      run,
+			"Filename": filename,
+		},
+		filename,
+		report,
+	)
+}
+
+const defaultReportFailedTemplate = `<h2>The {{ .Run.Schedule }} report failed</h2>
+
+<p>Exporting the {{ .Run.Report }} report from {{ .Run.PeriodStart | dateFormat "2006-01-02" }} to {{ .Run.PeriodEnd | dateFormat "2006-01-02" }} failed {{ .Run.Attempts }} times:</p>
+
+<p>{{ .Run.Error }}</p>
+`
+
+// ReportFailedMail alerts the shop admin about a scheduled report that
+// couldn't be delivered
+func (m *mailer) ReportFailedMail(run *models.ReportRun) error {
+	return m.TemplateMailer.Mail(
+		m.TemplateMailer.From,
+		withDefault(m.Config.Mailer.Subjects.ReportFailed, "The {{ .Run.Schedule }} report failed"),
+		m.Config.Mailer.Templates.ReportFailed,
+		defaultReportFailedTemplate,
+		map[string]interface{}{
+			"SiteURL": m.Config.SiteURL,
+			"Run":     run,
+		},
+	)
+}
+
+// mailWithAttachment sends a templated mail like the template mailer, with
+// the content attached as a file, which the template mailer can't do.
+func (m *mailer) mailWithAttachment(to, subjectTemplate, templateURL, defaultTemplate string, templateData map[string]interface{}, filename string, content []byte) error {
+	mail, err := m.message(to, subjectTemplate, templateURL, defaultTemplate, templateData)
+	if err != nil {
+		return err
+	}
+	mail.Attach(filename, gomail.SetCopyFunc(func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	}))
+	return m.send(mail)
+}
+
+// marketingMail sends a templated marketing mail with the List-Unsubscribe
+// headers for the UnsubscribeURL of the template data, so mail clients can
+// unsubscribe the recipient with a single click.
+func (m *mailer) marketingMail(to, subjectTemplate, templateURL, defaultTemplate string, templateData map[string]interface{}) error {
+	mail, err := m.message(to, subjectTemplate, templateURL, defaultTemplate, templateData)
+	if err != nil {
+		return err
+	}
+	if unsubscribeURL, ok := templateData["UnsubscribeURL"].(string); ok && unsubscribeURL != "" {
+		mail.SetHeader("List-Unsubscribe", "<"+unsubscribeURL+">")
+		mail.SetHeader("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+	}
+	return m.send(mail)
+}
+
+// message renders a templated mail like the template mailer.
+func (m *mailer) message(to, subjectTemplate, templateURL, defaultTemplate string, templateData map[string]interface{}) (*gomail.Message, error) {
+	tmp, err := template.New("Subject").Funcs(template.FuncMap(m.TemplateMailer.FuncMap)).Parse(subjectTemplate)
+	if err != nil {
+		return nil, err
+	}
+	subject := &bytes.Buffer{}
+	if err := tmp.Execute(subject, templateData); err != nil {
+		return nil, err
+	}
+	body, err := m.TemplateMailer.MailBody(templateURL, defaultTemplate, templateData)
+	if err != nil {
+		return nil, err
+	}
+
+	mail := gomail.NewMessage()
+	mail.SetHeader("From", m.TemplateMailer.From)
+	mail.SetHeader("To", to)
+	mail.SetHeader("Subject", subject.String())
+	mail.SetBody("text/html", body)
+	return mail, nil
+}
+
+func (m *mailer) send(mail *gomail.Message) error {
+	dial := gomail.NewPlainDialer(m.TemplateMailer.Host, m.TemplateMailer.Port, m.TemplateMailer.User, m.TemplateMailer.Pass)
+	return dial.DialAndSend(mail)
+}
+
 func withDefault(value string, defaultValue string) string {
 	if value == "" {
 		return defaultValue
@@ -18,3 +18,35 @@ func (m *noopMailer) OrderReceivedMail(transaction *models.Transaction) error {
 func (m *noopMailer) OrderConfirmationMailBody(transaction *models.Transaction, templateURL string) (string, error) {
 	return "Order Confirmed", nil
 }
+
+func (m *noopMailer) PaymentRetryMail(order *models.Order, retry *models.PaymentRetry) error {
+	return nil
+}
+
+func (m *noopMailer) AbandonedOrderMail(order *models.Order, unsubscribeURL string) error {
+	return nil
+}
+
+func (m *noopMailer) ShipmentDeliveredMail(order *models.Order, shipment *models.Shipment) error {
+	return nil
+}
+
+func (m *noopMailer) ReadyForPickupMail(order *models.Order) error {
+	return nil
+}
+
+func (m *noopMailer) LowStockMail(items []*models.StockItem) error {
+	return nil
+}
+
+func (m *noopMailer) BackInStockMail(email string, item *models.WishlistItem, unsubscribeURL string) error {
+	return nil
+}
+
+func (m *noopMailer) ScheduledReportMail(to string, run *models.ReportRun, filename string, report []byte) error {
+	return nil
+}
+
+func (m *noopMailer) ReportFailedMail(run *models.ReportRun) error {
+	return nil
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"strings"
 	"time"
+
+	"github.com/jinzhu/gorm"
 )
 
 // AddressRequest is the raw address data
@@ -29,9 +31,21 @@ type Address struct {
 
 	ID string `json:"id"`
 
+	// Verdict is the verdict of the address validation backend on the
+	// address, empty if it hasn't been validated. Latitude and Longitude are
+	// its coordinates, if the backend geocoded it.
+	Verdict   string  `json:"verdict,omitempty"`
+	Latitude  float64 `json:"latitude,omitempty"`
+	Longitude float64 `json:"longitude,omitempty"`
+
 	User   *User  `json:"-"`
 	UserID string `json:"-"`
 
+	// DefaultBilling and DefaultShipping mark the addresses of the user that
+	// orders are billed and shipped to by default.
+	DefaultBilling  bool `json:"default_billing"`
+	DefaultShipping bool `json:"default_shipping"`
+
 	CreatedAt time.Time  `json:"created_at"`
 	DeletedAt *time.Time `json:"deleted_at"`
 }
@@ -41,6 +55,54 @@ func (Address) TableName() string {
 	return tableName("addresses")
 }
 
+// SetDefault marks the address as the default billing or shipping address of
+// its user, or unmarks it, leaving the flags that are nil as they are. The
+// user's other addresses lose the flags the address gets.
+func (a *Address) SetDefault(tx *gorm.DB, billing, shipping *bool) error {
+	flags := []struct {
+		column string
+		value  *bool
+		field  *bool
+	}{
+		{"default_billing", billing, &a.DefaultBilling},
+		{"default_shipping", shipping, &a.DefaultShipping},
+	}
+	for _, flag := range flags {
+		if flag.value == nil {
+			continue
+		}
+		if *flag.value {
+			rsp := tx.Model(&Address{}).Where("user_id = ? AND id <> ?", a.UserID, a.ID).UpdateColumn(flag.column, false)
+			if rsp.Error != nil {
+				return rsp.Error
+			}
+		}
+		if rsp := tx.Model(a).UpdateColumn(flag.column, *flag.value); rsp.Error != nil {
+			return rsp.Error
+		}
+		*flag.field = *flag.value
+	}
+	return nil
+}
+
+// DefaultAddresses returns the default billing and shipping addresses of the
+// user, nil for the ones they haven't marked.
+func DefaultAddresses(db *gorm.DB, userID string) (billing, shipping *Address, err error) {
+	addrs := []*Address{}
+	if rsp := db.Where("user_id = ? AND (default_billing = ? OR default_shipping = ?)", userID, true, true).Find(&addrs); rsp.Error != nil {
+		return nil, nil, rsp.Error
+	}
+	for _, addr := range addrs {
+		if addr.DefaultBilling {
+			billing = addr
+		}
+		if addr.DefaultShipping {
+			shipping = addr
+		}
+	}
+	return billing, shipping, nil
+}
+
 // Validate validates the AddressRequest model
 func (a AddressRequest) Validate() error {
 	a.combineNames()
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// APIKeyPrefix starts every API key, so they can be told apart from JWTs.
+const APIKeyPrefix = "gck_"
+
+// APIKey authenticates server to server integrations of an instance with the
+// permissions it's scoped to. Only the SHA-256 hash of the key is stored,
+// along with its first characters to recognize it by.
+type APIKey struct {
+	InstanceID string `json:"-" sql:"index"`
+	ID         string `json:"id"`
+
+	Name        string   `json:"name"`
+	Hint        string   `json:"hint"`
+	KeyHash     string   `json:"-" sql:"unique_index"`
+	Permissions []string `json:"permissions" sql:"-"`
+	// CreatedBy is the subject of the claims of the admin that created the
+	// key.
+	CreatedBy string `json:"created_by,omitempty"`
+
+	RawPermissions string `json:"-" sql:"type:text"`
+
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RotatedAt  *time.Time `json:"rotated_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// TableName returns the database table name for the APIKey model.
+func (APIKey) TableName() string {
+	return tableName("api_keys")
+}
+
+// BeforeSave database callback.
+func (k *APIKey) BeforeSave() error {
+	data, err := json.Marshal(k.Permissions)
+	if err == nil {
+		k.RawPermissions = string(data)
+	}
+	return err
+}
+
+// AfterFind database callback.
+func (k *APIKey) AfterFind() error {
+	if k.RawPermissions == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(k.RawPermissions), &k.Permissions)
+}
+
+// NewAPIKey returns a new API key of the instance with the permissions, and
+// the key itself, which isn't stored.
+func NewAPIKey(instanceID, name string, permissions []string, createdBy string) (*APIKey, string, error) {
+	apiKey := &APIKey{
+		InstanceID:  instanceID,
+		ID:          uuid.NewRandom().String(),
+		Name:        name,
+		Permissions: permissions,
+		CreatedBy:   createdBy,
+	}
+	key, err := apiKey.Rotate()
+	if err != nil {
+		return nil, "", err
+	}
+	return apiKey, key, nil
+}
+
+// Rotate replaces the key with a new one and returns it.
+func (k *APIKey) Rotate() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	key := APIKeyPrefix + hex.EncodeToString(secret)
+	k.KeyHash = HashAPIKey(key)
+	k.Hint = key[:len(APIKeyPrefix)+6]
+	return key, nil
+}
+
+// Revoked reports whether the key has been revoked.
+func (k *APIKey) Revoked() bool {
+	return k.RevokedAt != nil
+}
+
+// HashAPIKey returns the hash an API key is stored as.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// FindAPIKey returns the unrevoked API key of the instance, or nil if the
+// key is unknown.
+func FindAPIKey(db *gorm.DB, instanceID, key string) (*APIKey, error) {
+	apiKey := &APIKey{}
+	rsp := db.Where("instance_id = ? AND key_hash = ? AND revoked_at IS NULL", instanceID, HashAPIKey(key)).First(apiKey)
+	if rsp.RecordNotFound() {
+		return nil, nil
+	}
+	if rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	return apiKey, nil
+}
@@ -0,0 +1,127 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// Cart holds the items of a customer before checkout. Its totals are priced
+// the same way as those of an order, so storefronts can show them before the
+// cart is converted into an order.
+type Cart struct {
+	InstanceID string `json:"-" sql:"index"`
+	ID         string `json:"id"`
+	UserID     string `json:"user_id,omitempty"`
+
+	Items    []*CartItem `json:"items" sql:"-"`
+	RawItems string      `json:"-" sql:"type:text"`
+
+	Currency   string `json:"currency"`
+	CouponCode string `json:"coupon_code,omitempty"`
+	// Country is the country the taxes of the cart are calculated for.
+	Country string `json:"country,omitempty"`
+
+	Taxes    uint64 `json:"taxes"`
+	SubTotal uint64 `json:"subtotal"`
+	Discount uint64 `json:"discount"`
+	NetTotal uint64 `json:"net_total"`
+	Total    uint64 `json:"total"`
+
+	// OrderID references the order the cart has been checked out with.
+	OrderID string `json:"order_id,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// CartItem is a product in a cart along with its current price.
+type CartItem struct {
+	Sku      string                 `json:"sku"`
+	Path     string                 `json:"path"`
+	Quantity uint64                 `json:"quantity"`
+	Addons   []CartAddon            `json:"addons,omitempty"`
+	MetaData map[string]interface{} `json:"meta,omitempty"`
+
+	Title      string             `json:"title"`
+	Price      uint64             `json:"price"`
+	AddonPrice uint64             `json:"addon_price"`
+	Detail     *CalculationDetail `json:"calculation,omitempty"`
+}
+
+// CartAddon is an addon of a cart item.
+type CartAddon struct {
+	Sku string `json:"sku"`
+}
+
+// TableName returns the database table name for the Cart model.
+func (Cart) TableName() string {
+	return tableName("carts")
+}
+
+// NewCart returns a new, empty cart.
+func NewCart(instanceID, userID, currency string) *Cart {
+	return &Cart{
+		InstanceID: instanceID,
+		ID:         uuid.NewRandom().String(),
+		UserID:     userID,
+		Currency:   currency,
+	}
+}
+
+// CheckedOut returns whether the cart has been converted into an order.
+func (c *Cart) CheckedOut() bool {
+	return c.OrderID != ""
+}
+
+// ApplyPrices copies the prices of a priced order back to the cart.
+func (c *Cart) ApplyPrices(order *Order) {
+	c.SubTotal = order.SubTotal
+	c.Taxes = order.Taxes
+	c.Discount = order.Discount
+	c.NetTotal = order.NetTotal
+	c.Total = order.Total
+
+	for i, item := range order.LineItems {
+		if i >= len(c.Items) {
+			break
+		}
+		c.Items[i].Sku = item.Sku
+		c.Items[i].Title = item.Title
+		c.Items[i].Price = item.Price
+		c.Items[i].AddonPrice = item.AddonPrice
+		c.Items[i].Detail = item.CalculationDetail
+	}
+}
+
+// BeforeSave database callback.
+func (c *Cart) BeforeSave() error {
+	data, err := json.Marshal(c.Items)
+	if err != nil {
+		return err
+	}
+	c.RawItems = string(data)
+	return nil
+}
+
+// AfterFind database callback.
+func (c *Cart) AfterFind() error {
+	if c.RawItems != "" {
+		return json.Unmarshal([]byte(c.RawItems), &c.Items)
+	}
+	return nil
+}
+
+// GetCart returns the cart with the given ID or nil if there is none.
+func GetCart(db *gorm.DB, id string) (*Cart, error) {
+	cart := &Cart{ID: id}
+	if rsp := db.First(cart); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, rsp.Error
+	}
+	return cart, nil
+}
@@ -63,17 +63,59 @@ func tableName(defaultName string) string {
 func AutoMigrate(db *gorm.DB) error {
 	db = db.AutoMigrate(Address{},
 		LineItem{},
+		DiscountItem{},
 		AddonItem{},
 		PriceItem{},
 		Hook{},
+		Job{},
 		Download{},
+		DownloadToken{},
+		DownloadLog{},
+		License{},
 		Order{},
 		OrderNote{},
+		OrderTag{},
 		Transaction{},
 		User{},
 		Event{},
 		Instance{},
 		InvoiceNumber{},
+		Invoice{},
+		InvoiceSeries{},
+		CreditNote{},
+		CreditNoteItem{},
+		OrderNumber{},
+		IdempotencyKey{},
+		PaymentMethod{},
+		Dispute{},
+		Subscription{},
+		PaymentRetry{},
+		UsageRecord{},
+		Return{},
+		ReturnItem{},
+		Cart{},
+		Coupon{},
+		CouponUse{},
+		CreditTransaction{},
+		CreditAccount{},
+		ReferralCode{},
+		Referral{},
+		Shipment{},
+		ShipmentItem{},
+		ShippingRate{},
+		StockItem{},
+		StockLocation{},
+		StockReservation{},
+		StockAllocation{},
+		UserExport{},
+		WishlistItem{},
+		NotificationPreferences{},
+		SalesRollup{},
+		SalesRollupState{},
+		ReportRun{},
+		CustomerMonth{},
+		CohortRollupState{},
+		APIKey{},
 	)
 	return db.Error
 }
@@ -1,9 +1,20 @@
 package models
 
 import (
+	"encoding/json"
 	"math"
 	"strconv"
 	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/pkg/errors"
+)
+
+// Errors returned when a coupon can't be redeemed anymore.
+var (
+	ErrCouponUsedUp       = errors.New("This coupon has already been used as often as it can be")
+	ErrCouponUserLimitHit = errors.New("You have already used this coupon as often as you can")
 )
 
 // FixedAmount represents an amount and currency pair
@@ -12,19 +23,225 @@ type FixedAmount struct {
 	Currency string `json:"currency"`
 }
 
-// Coupon represents a discount redeemable with a code.
+// Coupon represents a discount redeemable with a code. Coupons are either
+// stored in the database or read from the coupons settings file of the site.
 type Coupon struct {
-	Code string `json:"code"`
+	ID         int64  `json:"-"`
+	InstanceID string `json:"-" sql:"unique_index:idx_coupon_code"`
+	Code       string `json:"code" sql:"unique_index:idx_coupon_code"`
 
 	StartDate *time.Time `json:"start_date,omitempty"`
 	EndDate   *time.Time `json:"end_date,omitempty"`
 
 	Percentage  uint64         `json:"percentage,omitempty"`
-	FixedAmount []*FixedAmount `json:"fixed,omitempty"`
+	FixedAmount []*FixedAmount `json:"fixed,omitempty" sql:"-"`
+
+	// MinimumAmount is the subtotal per currency an order must reach for the
+	// coupon to apply.
+	MinimumAmount []*FixedAmount `json:"minimum_amount,omitempty" sql:"-"`
+
+	ProductTypes []string               `json:"product_types,omitempty" sql:"-"`
+	Products     []string               `json:"products,omitempty" sql:"-"`
+	Claims       map[string]interface{} `json:"claims,omitempty" sql:"-"`
+
+	// Uses counts the paid orders of a coupon stored in the database. MaxUses
+	// limits the orders that can be paid with the coupon, and MaxUsesPerUser
+	// the orders of each user or guest email. Both are unlimited if zero.
+	Uses           uint64 `json:"uses,omitempty"`
+	MaxUses        uint64 `json:"max_uses,omitempty"`
+	MaxUsesPerUser uint64 `json:"max_uses_per_user,omitempty"`
+
+	RawData string `json:"-" sql:"type:text"`
+
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// couponData holds the fields of a Coupon stored as JSON in the database.
+type couponData struct {
+	FixedAmount   []*FixedAmount         `json:"fixed,omitempty"`
+	MinimumAmount []*FixedAmount         `json:"minimum_amount,omitempty"`
+	ProductTypes  []string               `json:"product_types,omitempty"`
+	Products      []string               `json:"products,omitempty"`
+	Claims        map[string]interface{} `json:"claims,omitempty"`
+}
+
+// TableName returns the database table name for the Coupon model.
+func (Coupon) TableName() string {
+	return tableName("coupons")
+}
+
+// BeforeSave database callback.
+func (c *Coupon) BeforeSave() error {
+	data, err := json.Marshal(&couponData{
+		FixedAmount:   c.FixedAmount,
+		MinimumAmount: c.MinimumAmount,
+		ProductTypes:  c.ProductTypes,
+		Products:      c.Products,
+		Claims:        c.Claims,
+	})
+	if err == nil {
+		c.RawData = string(data)
+	}
+	return err
+}
+
+// AfterFind database callback.
+func (c *Coupon) AfterFind() error {
+	if c.RawData == "" {
+		return nil
+	}
+	data := &couponData{}
+	if err := json.Unmarshal([]byte(c.RawData), data); err != nil {
+		return err
+	}
+	c.FixedAmount = data.FixedAmount
+	c.MinimumAmount = data.MinimumAmount
+	c.ProductTypes = data.ProductTypes
+	c.Products = data.Products
+	c.Claims = data.Claims
+	return nil
+}
+
+// BeforeDelete database callback.
+func (c *Coupon) BeforeDelete(tx *gorm.DB) error {
+	if c.ID == 0 {
+		return nil
+	}
+	return tx.Delete(CouponUse{}, "coupon_id = ?", c.ID).Error
+}
+
+// CouponUse counts the orders a user paid with a coupon. UserID is the ID of
+// the user, or the email of guests.
+type CouponUse struct {
+	ID         int64  `json:"-"`
+	InstanceID string `json:"-" sql:"index"`
+	CouponID   int64  `json:"-" sql:"unique_index:idx_coupon_use"`
+	UserID     string `json:"-" sql:"unique_index:idx_coupon_use"`
+	Uses       uint64 `json:"-"`
+}
+
+// TableName returns the database table name for the CouponUse model.
+func (CouponUse) TableName() string {
+	return tableName("coupon_uses")
+}
+
+// CheckCouponUses returns ErrCouponUsedUp or ErrCouponUserLimitHit if the
+// coupon can't be used for another order of the user. Uses are only counted
+// once orders are paid, so orders that are never paid don't use up a coupon.
+func CheckCouponUses(db *gorm.DB, coupon *Coupon, user string) error {
+	if coupon.MaxUses > 0 && coupon.Uses >= coupon.MaxUses {
+		return ErrCouponUsedUp
+	}
+	if coupon.MaxUsesPerUser == 0 || user == "" {
+		return nil
+	}
+	uses, err := coupon.UsesBy(db, user)
+	if err != nil {
+		return err
+	}
+	if uses >= coupon.MaxUsesPerUser {
+		return ErrCouponUserLimitHit
+	}
+	return nil
+}
 
-	ProductTypes []string               `json:"product_types,omitempty"`
-	Products     []string               `json:"products,omitempty"`
-	Claims       map[string]interface{} `json:"claims,omitempty"`
+// RedeemCoupon counts a use of the coupon by the user within the transaction
+// that marks an order as paid. The counters are only incremented while
+// they're below the limits of the coupon, so concurrent payments can't exceed
+// them. It returns ErrCouponUsedUp or ErrCouponUserLimitHit if a limit has
+// been hit. The first use of a user creates the counter within a savepoint,
+// so a concurrent first use doesn't abort tx but increments that counter.
+func RedeemCoupon(tx *gorm.DB, coupon *Coupon, user string) error {
+	rsp := tx.Model(&Coupon{}).
+		Where("id = ? AND (max_uses = 0 OR uses < max_uses)", coupon.ID).
+		UpdateColumn("uses", gorm.Expr("uses + ?", 1))
+	if rsp.Error != nil {
+		return rsp.Error
+	}
+	if rsp.RowsAffected == 0 {
+		return ErrCouponUsedUp
+	}
+	coupon.Uses++
+
+	if coupon.MaxUsesPerUser == 0 || user == "" {
+		return nil
+	}
+	for attempt := 0; ; attempt++ {
+		rsp = tx.Model(&CouponUse{}).
+			Where("coupon_id = ? AND user_id = ? AND uses < ?", coupon.ID, user, coupon.MaxUsesPerUser).
+			UpdateColumn("uses", gorm.Expr("uses + ?", 1))
+		if rsp.Error != nil {
+			return rsp.Error
+		}
+		if rsp.RowsAffected > 0 {
+			return nil
+		}
+
+		var used int
+		if rsp := tx.Model(&CouponUse{}).Where("coupon_id = ? AND user_id = ?", coupon.ID, user).Count(&used); rsp.Error != nil {
+			return rsp.Error
+		}
+		if used > 0 || attempt > 0 {
+			return ErrCouponUserLimitHit
+		}
+
+		if err := tx.Exec("SAVEPOINT coupon_use").Error; err != nil {
+			return err
+		}
+		if rsp := tx.Create(&CouponUse{InstanceID: coupon.InstanceID, CouponID: coupon.ID, UserID: user, Uses: 1}); rsp.Error == nil {
+			return tx.Exec("RELEASE SAVEPOINT coupon_use").Error
+		}
+		// another payment created the counter, which is incremented instead
+		if err := tx.Exec("ROLLBACK TO SAVEPOINT coupon_use").Error; err != nil {
+			return err
+		}
+	}
+}
+
+// OrderCoupons returns the coupons stored in the database that gave a
+// discount on any of the line items of the order.
+func OrderCoupons(db *gorm.DB, order *Order) ([]*Coupon, error) {
+	discountsTable := db.NewScope(DiscountItem{}).QuotedTableName()
+	itemsTable := db.NewScope(LineItem{}).QuotedTableName()
+	codes := []string{}
+	err := db.Model(&DiscountItem{}).
+		Joins("JOIN "+itemsTable+" ON "+itemsTable+".id = "+discountsTable+".line_item_id").
+		Where(itemsTable+".order_id = ? AND "+discountsTable+".type = ?", order.ID, calculator.DiscountTypeCoupon).
+		Pluck("DISTINCT "+discountsTable+".code", &codes).Error
+	if err != nil || len(codes) == 0 {
+		return nil, err
+	}
+	coupons := []*Coupon{}
+	err = db.Where("instance_id = ? AND code IN (?)", order.InstanceID, codes).Order("id").Find(&coupons).Error
+	return coupons, err
+}
+
+// UsesBy returns how many orders the user or guest email created with the
+// coupon.
+func (c *Coupon) UsesBy(db *gorm.DB, user string) (uint64, error) {
+	use := &CouponUse{}
+	rsp := db.Where("coupon_id = ? AND user_id = ?", c.ID, user).First(use)
+	if rsp.RecordNotFound() {
+		return 0, nil
+	}
+	if rsp.Error != nil {
+		return 0, rsp.Error
+	}
+	return use.Uses, nil
+}
+
+// FindCoupon returns the coupon with the code stored for the instance, or nil
+// if there is none.
+func FindCoupon(db *gorm.DB, instanceID, code string) (*Coupon, error) {
+	coupon := &Coupon{}
+	if rsp := db.First(coupon, "instance_id = ? AND code = ?", instanceID, code); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, rsp.Error
+	}
+	return coupon, nil
 }
 
 // Valid returns whether a coupon is valid or not.
@@ -76,10 +293,24 @@ func (c *Coupon) ValidForType(productType string) bool {
 	return false
 }
 
-// ValidForPrice returns whether a coupon applies to a specific amount.
+// ValidForPrice returns whether a coupon applies to an order with the
+// subtotal in the currency.
 func (c *Coupon) ValidForPrice(currency string, price uint64) bool {
-	// TODO: Support for coupons based on amount
-	return true
+	if len(c.MinimumAmount) == 0 {
+		return true
+	}
+	for _, minimum := range c.MinimumAmount {
+		if minimum.Currency == currency {
+			amount, _ := strconv.ParseFloat(minimum.Amount, 64)
+			return price >= rint(amount*100)
+		}
+	}
+	return false
+}
+
+// CouponCode returns the code of a Coupon.
+func (c *Coupon) CouponCode() string {
+	return c.Code
 }
 
 // PercentageDiscount returns the percentage discount of a Coupon.
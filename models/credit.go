@@ -0,0 +1,159 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+// StoreCreditProvider is the provider of transactions paid with or refunded
+// to the store credit of a user.
+const StoreCreditProvider = "credit"
+
+// ErrInsufficientCredit is returned when spending more store credit than the
+// user has.
+var ErrInsufficientCredit = errors.New("The user doesn't have enough store credit")
+
+// CreditTransaction is an entry in the store credit ledger of a user. Credit
+// given to the user has a positive amount, credit spent a negative one.
+type CreditTransaction struct {
+	InstanceID string `json:"-" sql:"index"`
+	ID         string `json:"id"`
+
+	User   *User  `json:"-"`
+	UserID string `json:"user_id" sql:"index"`
+
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+
+	// OrderID and TransactionID reference the order and the payment
+	// transaction the credit was spent on or refunded from, if any.
+	OrderID       string `json:"order_id,omitempty"`
+	TransactionID string `json:"transaction_id,omitempty"`
+
+	Description string `json:"description,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the CreditTransaction model.
+func (CreditTransaction) TableName() string {
+	return tableName("credit_transactions")
+}
+
+// NewCreditTransaction returns a new entry booking the amount to the store
+// credit of the user, spending credit if the amount is negative.
+func NewCreditTransaction(instanceID, userID, currency string, amount int64) *CreditTransaction {
+	return &CreditTransaction{
+		InstanceID: instanceID,
+		ID:         uuid.NewRandom().String(),
+		UserID:     userID,
+		Amount:     amount,
+		Currency:   currency,
+	}
+}
+
+// CreditAccount holds the balance of the store credit of a user in a
+// currency, which is the sum of the ledger. Spending credit decrements it with
+// a conditional update, so concurrent payments can't spend more than it.
+// Accounts missing, e.g. after a merge of users, are created from the ledger.
+type CreditAccount struct {
+	ID         int64  `json:"-"`
+	InstanceID string `json:"-" sql:"index"`
+	UserID     string `json:"-" sql:"unique_index:idx_credit_account"`
+	Currency   string `json:"-" sql:"unique_index:idx_credit_account"`
+	Balance    int64  `json:"-"`
+}
+
+// TableName returns the database table name for the CreditAccount model.
+func (CreditAccount) TableName() string {
+	return tableName("credit_accounts")
+}
+
+// BookCredit creates the entry in the ledger and books its amount to the
+// account of the user. It returns ErrInsufficientCredit if the entry spends
+// more credit than the user has. The account of the first entry of a user is
+// created within a savepoint, so a concurrent entry creating it first doesn't
+// abort tx but books to the account it created.
+func BookCredit(tx *gorm.DB, credit *CreditTransaction) error {
+	for attempt := 0; ; attempt++ {
+		query := tx.Model(&CreditAccount{}).Where("user_id = ? AND currency = ?", credit.UserID, credit.Currency)
+		if credit.Amount < 0 {
+			query = query.Where("balance >= ?", -credit.Amount)
+		}
+		rsp := query.UpdateColumn("balance", gorm.Expr("balance + ?", credit.Amount))
+		if rsp.Error != nil {
+			return rsp.Error
+		}
+		if rsp.RowsAffected > 0 {
+			break
+		}
+
+		var accounts int
+		if rsp := tx.Model(&CreditAccount{}).Where("user_id = ? AND currency = ?", credit.UserID, credit.Currency).Count(&accounts); rsp.Error != nil {
+			return rsp.Error
+		}
+		if accounts > 0 || attempt > 0 {
+			return ErrInsufficientCredit
+		}
+
+		balance, err := CreditBalance(tx, credit.UserID, credit.Currency)
+		if err != nil {
+			return err
+		}
+		if err := tx.Exec("SAVEPOINT credit_account").Error; err != nil {
+			return err
+		}
+		account := &CreditAccount{InstanceID: credit.InstanceID, UserID: credit.UserID, Currency: credit.Currency, Balance: balance}
+		if rsp := tx.Create(account); rsp.Error == nil {
+			if err := tx.Exec("RELEASE SAVEPOINT credit_account").Error; err != nil {
+				return err
+			}
+			continue
+		}
+		// another entry created the account, which is booked to instead
+		if err := tx.Exec("ROLLBACK TO SAVEPOINT credit_account").Error; err != nil {
+			return err
+		}
+	}
+	return tx.Create(credit).Error
+}
+
+// CreditBalance returns the store credit the user has in the currency.
+func CreditBalance(db *gorm.DB, userID, currency string) (int64, error) {
+	var balance int64
+	row := db.Model(&CreditTransaction{}).
+		Where("user_id = ? AND currency = ?", userID, currency).
+		Select("COALESCE(SUM(amount), 0)").
+		Row()
+	if err := row.Scan(&balance); err != nil {
+		return 0, err
+	}
+	return balance, nil
+}
+
+// CreditBalances returns the store credit the user has per currency.
+func CreditBalances(db *gorm.DB, userID string) (map[string]int64, error) {
+	rows, err := db.Model(&CreditTransaction{}).
+		Where("user_id = ?", userID).
+		Select("currency, SUM(amount)").
+		Group("currency").
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	balances := map[string]int64{}
+	for rows.Next() {
+		var currency string
+		var balance int64
+		if err := rows.Scan(&currency, &balance); err != nil {
+			return nil, err
+		}
+		balances[currency] = balance
+	}
+	return balances, rows.Err()
+}
@@ -0,0 +1,175 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// CreditNote model which represents the accounting document issued for a
+// refund. It references the invoice of the refunded order and reverses the
+// refunded amounts and taxes with negative items. Credit notes are numbered
+// without gaps like invoices, in a series of their own.
+type CreditNote struct {
+	InstanceID string `json:"-" sql:"index"`
+	ID         string `json:"id"`
+	OrderID    string `json:"order_id" sql:"index"`
+	RefundID   string `json:"refund_id" sql:"unique_index"`
+
+	Series string `json:"series,omitempty"`
+	Number int64  `json:"number"`
+
+	InvoiceSeries string `json:"invoice_series,omitempty"`
+	InvoiceNumber int64  `json:"invoice_number,omitempty"`
+
+	Currency string            `json:"currency"`
+	Taxes    int64             `json:"taxes"`
+	Total    int64             `json:"total"`
+	Items    []*CreditNoteItem `json:"items" gorm:"foreignkey:CreditNoteID"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the CreditNote model.
+func (CreditNote) TableName() string {
+	return tableName("credit_notes")
+}
+
+// BeforeDelete database callback.
+func (n *CreditNote) BeforeDelete(tx *gorm.DB) error {
+	return tx.Delete(CreditNoteItem{}, "credit_note_id = ?", n.ID).Error
+}
+
+// CreditNoteItem is a reversed line of a credit note. Its amounts are negative.
+type CreditNoteItem struct {
+	ID           int64  `json:"-"`
+	CreditNoteID string `json:"-" sql:"index"`
+	LineItemID   int64  `json:"line_item_id,omitempty"`
+
+	Title    string `json:"title"`
+	Sku      string `json:"sku,omitempty"`
+	Quantity uint64 `json:"quantity"`
+
+	NetTotal int64 `json:"net_total"`
+	Taxes    int64 `json:"taxes"`
+	Total    int64 `json:"total"`
+}
+
+// TableName returns the database table name for the CreditNoteItem model.
+func (CreditNoteItem) TableName() string {
+	return tableName("credit_note_items")
+}
+
+// IssueCreditNote issues the credit note of a successful refund. Refunds of
+// the whole order reverse each of its line items, partial refunds are booked
+// as a single item with the taxes reversed in proportion to the order. Refunds
+// that already have a credit note keep it.
+func IssueCreditNote(tx *gorm.DB, refund *Transaction) (*CreditNote, error) {
+	note := &CreditNote{}
+	if rsp := tx.Preload("Items").Where("refund_id = ?", refund.ID).First(note); rsp.Error == nil {
+		return note, nil
+	} else if !rsp.RecordNotFound() {
+		return nil, rsp.Error
+	}
+
+	order := &Order{}
+	if rsp := tx.Preload("LineItems").Preload("Invoice").First(order, "id = ?", refund.OrderID); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+
+	note = &CreditNote{
+		InstanceID: order.InstanceID,
+		ID:         uuid.NewRandom().String(),
+		OrderID:    order.ID,
+		RefundID:   refund.ID,
+		Currency:   refund.Currency,
+		Total:      -int64(refund.Amount),
+	}
+	if order.Invoice != nil {
+		note.Series = order.Invoice.Series
+		note.InvoiceSeries = order.Invoice.Series
+		note.InvoiceNumber = order.Invoice.Number
+	}
+	if refund.Amount == order.Total {
+		note.Items = reversedLineItems(order)
+	} else {
+		taxes := int64(0)
+		if order.Total > 0 {
+			taxes = -int64((refund.Amount*order.Taxes + order.Total/2) / order.Total)
+		}
+		note.Items = []*CreditNoteItem{{
+			Title:    "Partial refund",
+			Quantity: 1,
+			NetTotal: note.Total - taxes,
+			Taxes:    taxes,
+			Total:    note.Total,
+		}}
+	}
+	for _, item := range note.Items {
+		note.Taxes += item.Taxes
+	}
+
+	number, err := nextSeriesNumber(tx, order.InstanceID, "credit_note:"+note.Series)
+	if err != nil {
+		return nil, err
+	}
+	note.Number = number
+	if rsp := tx.Create(note); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	return note, nil
+}
+
+// RefundsWithoutCreditNote returns up to limit successful refunds that don't
+// have a credit note yet, oldest first.
+func RefundsWithoutCreditNote(db *gorm.DB, limit int) ([]*Transaction, error) {
+	transactionsTable := db.NewScope(Transaction{}).QuotedTableName()
+	notesTable := db.NewScope(CreditNote{}).QuotedTableName()
+	refunds := []*Transaction{}
+	rsp := db.
+		Joins("LEFT JOIN "+notesTable+" ON "+notesTable+".refund_id = "+transactionsTable+".id").
+		Where(transactionsTable+".type = ? AND "+transactionsTable+".status = ? AND "+notesTable+".id IS NULL", RefundTransactionType, PaidState).
+		Order(transactionsTable + ".created_at asc").
+		Limit(limit).
+		Find(&refunds)
+	return refunds, rsp.Error
+}
+
+// reversedLineItems reverses the line items of the order. Charges that aren't
+// part of the line items, like shipping, are reversed as an item of their own
+// so the items add up to the order total.
+func reversedLineItems(order *Order) []*CreditNoteItem {
+	items := []*CreditNoteItem{}
+	var total, taxes int64
+	for _, item := range order.LineItems {
+		reversed := &CreditNoteItem{
+			LineItemID: item.ID,
+			Title:      item.Title,
+			Sku:        item.Sku,
+			Quantity:   item.Quantity,
+		}
+		// the calculation details are those of a single unit
+		if detail := item.CalculationDetail; detail != nil {
+			quantity := int64(item.Quantity)
+			reversed.NetTotal = -int64(detail.NetTotal) * quantity
+			reversed.Taxes = -int64(detail.Taxes) * quantity
+			reversed.Total = -detail.Total * quantity
+		}
+		total += reversed.Total
+		taxes += reversed.Taxes
+		items = append(items, reversed)
+	}
+
+	if rest := -int64(order.Total) - total; rest != 0 {
+		restTaxes := -int64(order.Taxes) - taxes
+		items = append(items, &CreditNoteItem{
+			Title:    "Other charges",
+			Quantity: 1,
+			NetTotal: rest - restTaxes,
+			Taxes:    restTaxes,
+			Total:    rest,
+		})
+	}
+	return items
+}
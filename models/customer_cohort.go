@@ -0,0 +1,181 @@
+package models
+
+import (
+	"sort"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// cohortBatchSize is how many customers are rolled up at once.
+const cohortBatchSize = 500
+
+// CustomerMonth sums up the paid orders of a customer in a currency placed in
+// a month of the timezone of the instance's reports. Cohort is the month of
+// the first of these orders, the customer's first purchase, and Repeated is
+// set on the month the customer placed their second order. Test orders are
+// left out.
+type CustomerMonth struct {
+	ID         int64     `json:"-"`
+	InstanceID string    `json:"-" sql:"unique_index:idx_customer_month"`
+	Customer   string    `json:"customer" sql:"unique_index:idx_customer_month"`
+	Currency   string    `json:"currency" sql:"unique_index:idx_customer_month"`
+	Month      time.Time `json:"month" sql:"unique_index:idx_customer_month"`
+	Cohort     time.Time `json:"cohort" sql:"index"`
+
+	Orders   uint64 `json:"orders"`
+	Revenue  uint64 `json:"revenue"`
+	Repeated bool   `json:"repeated"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the CustomerMonth model.
+func (CustomerMonth) TableName() string {
+	return tableName("customer_months")
+}
+
+// CohortRollupState tracks the customer months of an instance: orders
+// updated after LastRunAt haven't been rolled up yet, and the months are
+// those of the Timezone.
+type CohortRollupState struct {
+	ID         int64  `json:"-"`
+	InstanceID string `json:"-" sql:"unique_index"`
+
+	LastRunAt time.Time `json:"last_run_at"`
+	Timezone  string    `json:"timezone"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName returns the database table name for the CohortRollupState model.
+func (CohortRollupState) TableName() string {
+	return tableName("cohort_rollup_states")
+}
+
+// CohortMonth returns the start of the month of the time in the location,
+// in UTC.
+func CohortMonth(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc).UTC()
+}
+
+// customerColumn identifies the customer of an order: the user, or the email
+// address for guests.
+func customerColumn(tx *gorm.DB) string {
+	ordersTable := tx.NewScope(Order{}).QuotedTableName()
+	return "COALESCE(NULLIF(" + ordersTable + ".user_id, ''), LOWER(" + ordersTable + ".email))"
+}
+
+// RollupCustomers replaces the customer months of the customers with the
+// sums of their paid orders in the months of the location.
+func RollupCustomers(tx *gorm.DB, instanceID string, customers []string, loc *time.Location) error {
+	if len(customers) == 0 {
+		return nil
+	}
+	if rsp := tx.Delete(&CustomerMonth{}, "instance_id = ? AND customer IN (?)", instanceID, customers); rsp.Error != nil {
+		return rsp.Error
+	}
+
+	type customerKey struct {
+		customer string
+		currency string
+	}
+	months := map[customerKey][]*CustomerMonth{}
+	keys := []customerKey{}
+
+	rows, err := tx.Model(&Order{}).
+		Select(customerColumn(tx)+", currency, created_at, total").
+		Where("payment_state = ? AND instance_id = ? AND test = ?", PaidState, instanceID, false).
+		Where(customerColumn(tx)+" IN (?)", customers).
+		Order("created_at").
+		Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key customerKey
+		var createdAt time.Time
+		var total uint64
+		if err := rows.Scan(&key.customer, &key.currency, &createdAt, &total); err != nil {
+			return err
+		}
+		month := CohortMonth(createdAt, loc)
+		history, ok := months[key]
+		if !ok {
+			keys = append(keys, key)
+		}
+		if len(history) == 0 || !history[len(history)-1].Month.Equal(month) {
+			history = append(history, &CustomerMonth{InstanceID: instanceID, Customer: key.customer, Currency: key.currency, Month: month})
+			months[key] = history
+		}
+		history[len(history)-1].Orders++
+		history[len(history)-1].Revenue += total
+	}
+
+	for _, key := range keys {
+		history := months[key]
+		sort.Slice(history, func(i, j int) bool { return history[i].Month.Before(history[j].Month) })
+		var orders uint64
+		for _, month := range history {
+			month.Cohort = history[0].Month
+			month.Repeated = orders < 2 && orders+month.Orders >= 2
+			orders += month.Orders
+			if rsp := tx.Create(month); rsp.Error != nil {
+				return rsp.Error
+			}
+		}
+	}
+	return nil
+}
+
+// RollupCohorts rolls up the customers of the instance with orders updated
+// since the last run, or all of its customers on the first run and once the
+// timezone changed.
+func RollupCohorts(db *gorm.DB, instanceID string, loc *time.Location, now time.Time) (*CohortRollupState, error) {
+	state := &CohortRollupState{}
+	rsp := db.First(state, "instance_id = ?", instanceID)
+	if rsp.Error != nil && !rsp.RecordNotFound() {
+		return nil, rsp.Error
+	}
+	if rsp.RecordNotFound() {
+		state = &CohortRollupState{InstanceID: instanceID}
+	}
+
+	query := db.Unscoped().Model(&Order{}).Where("instance_id = ?", instanceID)
+	if !state.LastRunAt.IsZero() && state.Timezone == loc.String() {
+		query = query.Where("updated_at >= ?", state.LastRunAt)
+	}
+	customers := []string{}
+	if rsp := query.Pluck("DISTINCT "+customerColumn(db), &customers); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	// orders of guests claimed by a user move to the user, so the months of
+	// their email address are rolled up again as well
+	emails := []string{}
+	ordersTable := db.NewScope(Order{}).QuotedTableName()
+	if rsp := query.Where("user_id <> ''").Pluck("DISTINCT LOWER("+ordersTable+".email)", &emails); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	customers = append(customers, emails...)
+
+	tx := db.Begin()
+	for start := 0; start < len(customers); start += cohortBatchSize {
+		end := start + cohortBatchSize
+		if end > len(customers) {
+			end = len(customers)
+		}
+		if err := RollupCustomers(tx, instanceID, customers[start:end], loc); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	state.LastRunAt = now
+	state.Timezone = loc.String()
+	if rsp := tx.Save(state); rsp.Error != nil {
+		tx.Rollback()
+		return nil, rsp.Error
+	}
+	return state, tx.Commit().Error
+}
@@ -0,0 +1,112 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// DisputeOpenState is the state of a dispute that hasn't been decided yet
+const DisputeOpenState = "open"
+
+// DisputeWonState is the state of a dispute decided in favor of the merchant
+const DisputeWonState = "won"
+
+// DisputeLostState is the state of a dispute decided in favor of the customer
+const DisputeLostState = "lost"
+
+// Dispute is a chargeback or dispute a customer opened with the payment provider
+// against a charge transaction.
+type Dispute struct {
+	InstanceID    string       `json:"-" sql:"index"`
+	ID            string       `json:"id"`
+	Transaction   *Transaction `json:"-"`
+	TransactionID string       `json:"transaction_id" sql:"index"`
+	OrderID       string       `json:"order_id"`
+
+	Provider    string `json:"provider"`
+	ProcessorID string `json:"processor_id"`
+
+	Amount   uint64 `json:"amount"`
+	Currency string `json:"currency"`
+	// Fee is the fee the provider charged for handling the dispute.
+	Fee uint64 `json:"fee"`
+	// FinancialImpact is the amount the dispute currently costs: the disputed
+	// amount and the fee while it is open or after it was lost, only the fee if it was won.
+	FinancialImpact uint64 `json:"financial_impact"`
+
+	Reason         string `json:"reason"`
+	Status         string `json:"status"`
+	ProviderStatus string `json:"provider_status"`
+
+	EvidenceDueBy *time.Time             `json:"evidence_due_by,omitempty"`
+	Evidence      map[string]interface{} `json:"evidence,omitempty" sql:"-"`
+	RawEvidence   string                 `json:"-" sql:"type:text"`
+
+	ClosedAt  *time.Time `json:"closed_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// TableName returns the database table name for the Dispute model.
+func (Dispute) TableName() string {
+	return tableName("disputes")
+}
+
+// AfterFind database callback.
+func (d *Dispute) AfterFind() error {
+	if d.RawEvidence != "" {
+		return json.Unmarshal([]byte(d.RawEvidence), &d.Evidence)
+	}
+	return nil
+}
+
+// BeforeSave database callback.
+func (d *Dispute) BeforeSave() error {
+	if d.Evidence != nil {
+		data, err := json.Marshal(d.Evidence)
+		if err != nil {
+			return err
+		}
+		d.RawEvidence = string(data)
+	}
+
+	d.FinancialImpact = d.Fee
+	if d.Status != DisputeWonState {
+		d.FinancialImpact += d.Amount
+	}
+	if d.Status != DisputeOpenState && d.ClosedAt == nil {
+		now := time.Now()
+		d.ClosedAt = &now
+	}
+	return nil
+}
+
+// NewDispute returns a new open dispute against the transaction.
+func NewDispute(t *Transaction, provider, processorID string) *Dispute {
+	return &Dispute{
+		InstanceID:    t.InstanceID,
+		ID:            uuid.NewRandom().String(),
+		TransactionID: t.ID,
+		OrderID:       t.OrderID,
+		Provider:      provider,
+		ProcessorID:   processorID,
+		Amount:        t.Amount,
+		Currency:      t.Currency,
+		Status:        DisputeOpenState,
+	}
+}
+
+// GetDispute returns the dispute with the given ID or nil if there is none.
+func GetDispute(db *gorm.DB, id string) (*Dispute, error) {
+	dispute := &Dispute{ID: id}
+	if rsp := db.First(dispute); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, rsp.Error
+	}
+	return dispute, nil
+}
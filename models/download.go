@@ -3,6 +3,7 @@ package models
 import (
 	"time"
 
+	"github.com/jinzhu/gorm"
 	"github.com/netlify/gocommerce/assetstores"
 )
 
@@ -20,6 +21,37 @@ type Download struct {
 
 	DownloadCount uint64 `json:"downloads"`
 
+	// Size is the size of the asset in bytes, it's used to estimate the
+	// bandwidth of downloads.
+	Size uint64 `json:"size,omitempty"`
+
+	// MaxIPsPerDay and MaxDownloads override the download limits of the
+	// instance for the download if set.
+	MaxIPsPerDay uint64 `json:"max_ips_per_day,omitempty"`
+	MaxDownloads uint64 `json:"max_downloads,omitempty"`
+
+	// ExpiresAfterDays is how many days after the purchase the download can
+	// be accessed, it doesn't expire if zero. ExpiresAt is set from it once
+	// the order has been paid.
+	ExpiresAfterDays uint64     `json:"expires_after_days,omitempty"`
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+
+	// Watermark is set for downloads that are stamped with the email and
+	// number of the order. WatermarkedURL is the stamped copy of the asset.
+	Watermark      bool   `json:"watermark,omitempty"`
+	WatermarkedURL string `json:"-"`
+
+	// Token is the single use token to redeem the download with, if the
+	// instance hands out tokens instead of signed URLs.
+	Token string `json:"token,omitempty" sql:"-"`
+
+	// Licenses are the license keys issued for the product of the download.
+	Licenses []string `json:"licenses,omitempty" sql:"-"`
+
+	// Revoked is set once the order of the download has been cancelled,
+	// refunded or disputed.
+	Revoked bool `json:"revoked"`
+
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
 	DeletedAt *time.Time `json:"-" sql:"index"`
@@ -40,3 +72,30 @@ func (d *Download) SignURL(store assetstores.Store) error {
 
 	return nil
 }
+
+// Expired reports whether the download can't be accessed anymore.
+func (d *Download) Expired(now time.Time) bool {
+	return d.ExpiresAt != nil && now.After(*d.ExpiresAt)
+}
+
+// StartDownloadExpiry sets the expiry of the downloads of the order that
+// expire after the purchase and don't have an expiry yet. The loaded downloads
+// of the order are updated too, so saving the order keeps the expiry.
+func StartDownloadExpiry(tx *gorm.DB, order *Order, purchasedAt time.Time) error {
+	downloads := []*Download{}
+	if rsp := tx.Where("order_id = ? AND expires_after_days > 0 AND expires_at IS NULL", order.ID).Find(&downloads); rsp.Error != nil {
+		return rsp.Error
+	}
+	for _, download := range downloads {
+		expiresAt := purchasedAt.AddDate(0, 0, int(download.ExpiresAfterDays))
+		if rsp := tx.Model(download).Update("expires_at", expiresAt); rsp.Error != nil {
+			return rsp.Error
+		}
+		for i := range order.Downloads {
+			if order.Downloads[i].ID == download.ID {
+				order.Downloads[i].ExpiresAt = &expiresAt
+			}
+		}
+	}
+	return nil
+}
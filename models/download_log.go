@@ -0,0 +1,46 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// DownloadLog records an access of a download for the download reports. Day
+// is the UTC date of the access, so accesses can be grouped by day on every
+// database.
+type DownloadLog struct {
+	ID         int64  `json:"-"`
+	InstanceID string `json:"-" sql:"index"`
+	OrderID    string `json:"-" sql:"index"`
+	DownloadID string `json:"-" sql:"index"`
+
+	Sku     string `json:"sku"`
+	IP      string `json:"-"`
+	Country string `json:"country,omitempty"`
+	Bytes   uint64 `json:"bytes"`
+	Day     string `json:"day" sql:"index"`
+
+	CreatedAt time.Time `json:"-"`
+}
+
+// TableName returns the database table name for the DownloadLog model.
+func (DownloadLog) TableName() string {
+	return tableName("download_logs")
+}
+
+// LogDownload records an access of the download from the IP and country.
+func LogDownload(tx *gorm.DB, order *Order, download *Download, ip, country string) error {
+	now := time.Now()
+	return tx.Create(&DownloadLog{
+		InstanceID: order.InstanceID,
+		OrderID:    order.ID,
+		DownloadID: download.ID,
+		Sku:        download.Sku,
+		IP:         ip,
+		Country:    country,
+		Bytes:      download.Size,
+		Day:        now.UTC().Format("2006-01-02"),
+		CreatedAt:  now,
+	}).Error
+}
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// DownloadToken is a single use token to access a download. It's consumed
+// when it's redeemed, so unlike signed URLs it can't be shared.
+type DownloadToken struct {
+	Token      string `gorm:"primary_key"`
+	InstanceID string `sql:"index"`
+	DownloadID string `sql:"index"`
+
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	ConsumedAt *time.Time
+}
+
+// TableName returns the database table name for the DownloadToken model.
+func (DownloadToken) TableName() string {
+	return tableName("download_tokens")
+}
+
+// NewDownloadToken returns a new random token for the download that expires
+// after the TTL.
+func NewDownloadToken(instanceID string, download *Download, ttl time.Duration) (*DownloadToken, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	return &DownloadToken{
+		Token:      hex.EncodeToString(token),
+		InstanceID: instanceID,
+		DownloadID: download.ID,
+		ExpiresAt:  time.Now().Add(ttl),
+	}, nil
+}
+
+// FindDownloadToken returns the token without consuming it. It reports false
+// if the token doesn't exist, has expired or has already been consumed.
+func FindDownloadToken(tx *gorm.DB, instanceID, token string) (*DownloadToken, bool, error) {
+	downloadToken := &DownloadToken{}
+	rsp := tx.First(downloadToken, "token = ? AND instance_id = ? AND consumed_at IS NULL AND expires_at > ?", token, instanceID, time.Now())
+	if rsp.RecordNotFound() {
+		return nil, false, nil
+	}
+	if rsp.Error != nil {
+		return nil, false, rsp.Error
+	}
+	return downloadToken, true, nil
+}
+
+// ConsumeDownloadToken marks the token as consumed and returns it. It reports
+// false if the token doesn't exist, has expired or has already been consumed.
+func ConsumeDownloadToken(tx *gorm.DB, instanceID, token string) (*DownloadToken, bool, error) {
+	now := time.Now()
+	rsp := tx.Model(&DownloadToken{}).
+		Where("token = ? AND instance_id = ? AND consumed_at IS NULL AND expires_at > ?", token, instanceID, now).
+		Update("consumed_at", now)
+	if rsp.Error != nil {
+		return nil, false, rsp.Error
+	}
+	if rsp.RowsAffected == 0 {
+		return nil, false, nil
+	}
+
+	downloadToken := &DownloadToken{}
+	if rsp := tx.First(downloadToken, "token = ?", token); rsp.Error != nil {
+		return nil, false, rsp.Error
+	}
+	return downloadToken, true, nil
+}
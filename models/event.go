@@ -40,6 +40,15 @@ const (
 	EventUpdated EventType = "updated"
 	// EventDeleted is the EventType when an order is deleted.
 	EventDeleted EventType = "deleted"
+	// EventRefunded is the EventType when a payment of an order is refunded.
+	EventRefunded EventType = "refunded"
+	// EventEmailed is the EventType when an email about an order is sent.
+	EventEmailed EventType = "emailed"
+	// EventRevoked is the EventType when the downloads of an order are revoked.
+	EventRevoked EventType = "revoked"
+	// EventAnonymized is the EventType when the personal data of an order is
+	// erased on request of its user.
+	EventAnonymized EventType = "anonymized"
 )
 
 // LogEvent logs a new event
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"crypto/rand"
 	"fmt"
 	"reflect"
 
@@ -25,3 +26,21 @@ func cascadeDelete(tx *gorm.DB, query string, id interface{}, name string, cm in
 	}
 	return nil
 }
+
+// codeAlphabet leaves out characters that are easily mistaken for each other
+// when typing in a code.
+const codeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// GenerateCode returns a random code of the length, e.g. for referral or
+// coupon codes customers type in.
+func GenerateCode(length int) (string, error) {
+	random := make([]byte, length)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	code := make([]byte, length)
+	for i, b := range random {
+		code[i] = codeAlphabet[int(b)%len(codeAlphabet)]
+	}
+	return string(code), nil
+}
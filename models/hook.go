@@ -27,6 +27,10 @@ type Hook struct {
 
 	UserID string
 
+	// OrderID is set for hooks with an order as payload, their responses
+	// can tag the order.
+	OrderID string
+
 	Type string
 
 	Done   bool
@@ -73,13 +77,17 @@ func NewHook(hookType, siteURL, hookURL, userID, secret string, payload interfac
 	}
 
 	json, _ := json.Marshal(payload)
-	return &Hook{
+	hook := &Hook{
 		Type:    hookType,
 		UserID:  userID,
 		URL:     fullHookURL.String(),
 		Secret:  secret,
 		Payload: string(json),
-	}, nil
+	}
+	if order, ok := payload.(*Order); ok {
+		hook.OrderID = order.ID
+	}
+	return hook, nil
 }
 
 // Trigger creates and executes the HTTP request for a Hook.
@@ -148,6 +156,32 @@ func (h *Hook) handleSuccess(db *gorm.DB, log *logrus.Entry, resp *http.Response
 	h.ResponseBody = string(body)
 	h.CompletedAt = &now
 	db.Save(h)
+	h.applyResponse(db, log, body)
+}
+
+// hookResponse is the format of responses that change the order of a hook
+type hookResponse struct {
+	Tags []string `json:"tags"`
+}
+
+// applyResponse adds the tags of a JSON response to the order of the hook.
+func (h *Hook) applyResponse(db *gorm.DB, log *logrus.Entry, body []byte) {
+	if h.OrderID == "" || len(body) == 0 {
+		return
+	}
+	rsp := &hookResponse{}
+	if err := json.Unmarshal(body, rsp); err != nil || len(rsp.Tags) == 0 {
+		return
+	}
+
+	added, err := AddOrderTags(db, h.OrderID, rsp.Tags)
+	if err != nil {
+		log.WithError(err).Errorf("Failed to tag order %v from the response of hook %v", h.OrderID, h.ID)
+		return
+	}
+	if len(added) > 0 {
+		LogEvent(db, "", "", h.OrderID, EventUpdated, []string{"tags"})
+	}
 }
 
 // RunHooks creates a goroutine that triggers stored webhooks every 5 seconds.
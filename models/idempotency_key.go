@@ -0,0 +1,69 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// IdempotencyKeyExpiration is how long a stored response is replayed for an idempotency key.
+const IdempotencyKeyExpiration = 24 * time.Hour
+
+// IdempotencyKey stores the response of a request sent with an Idempotency-Key
+// header so retries of the same request get the same response.
+type IdempotencyKey struct {
+	InstanceID string `gorm:"primary_key"`
+	Key        string `gorm:"primary_key;column:idempotency_key"`
+
+	UserID      string
+	RequestHash string
+
+	// StatusCode is 0 while the original request is still in progress.
+	StatusCode int
+	Response   string `sql:"type:text"`
+
+	CreatedAt time.Time
+}
+
+// TableName returns the database table name for the IdempotencyKey model.
+func (IdempotencyKey) TableName() string {
+	return tableName("idempotency_keys")
+}
+
+// Completed reports whether the response of the original request has been stored.
+func (k *IdempotencyKey) Completed() bool {
+	return k.StatusCode != 0
+}
+
+// Expired reports whether the key is too old to be replayed.
+func (k *IdempotencyKey) Expired() bool {
+	return time.Since(k.CreatedAt) > IdempotencyKeyExpiration
+}
+
+// NewIdempotencyKey returns a new, not yet completed idempotency key.
+func NewIdempotencyKey(instanceID, key, userID, requestHash string) *IdempotencyKey {
+	if instanceID == "" {
+		instanceID = "global-instance"
+	}
+	return &IdempotencyKey{
+		InstanceID:  instanceID,
+		Key:         key,
+		UserID:      userID,
+		RequestHash: requestHash,
+	}
+}
+
+// GetIdempotencyKey returns the stored idempotency key for the instance or nil if there is none.
+func GetIdempotencyKey(db *gorm.DB, instanceID, key string) (*IdempotencyKey, error) {
+	if instanceID == "" {
+		instanceID = "global-instance"
+	}
+	k := &IdempotencyKey{}
+	if rsp := db.Where("instance_id = ? AND idempotency_key = ?", instanceID, key).First(k); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, rsp.Error
+	}
+	return k, nil
+}
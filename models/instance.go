@@ -109,8 +109,9 @@ func DeleteInstance(db *gorm.DB, instance *Instance) error {
 
 func (i *Instance) BeforeDelete(tx *gorm.DB) error {
 	cascadeModels := map[string]interface{}{
-		"order": &[]Order{},
-		"user":  &[]User{},
+		"order":       &[]Order{},
+		"user":        &[]User{},
+		"credit note": &[]CreditNote{},
 	}
 	for name, cm := range cascadeModels {
 		if err := cascadeDelete(tx, "instance_id = ?", i.ID, name, cm); err != nil {
@@ -121,6 +122,16 @@ func (i *Instance) BeforeDelete(tx *gorm.DB) error {
 	delModels := map[string]interface{}{
 		"transaction":    Transaction{},
 		"invoice number": InvoiceNumber{},
+		"invoice":        Invoice{},
+		"invoice series": InvoiceSeries{},
+		"download token": DownloadToken{},
+		"coupon":         Coupon{},
+		"coupon use":     CouponUse{},
+		"credit":         CreditTransaction{},
+		"credit account": CreditAccount{},
+		"referral code":  ReferralCode{},
+		"referral":       Referral{},
+		"shipping rate":  ShippingRate{},
 	}
 
 	for name, dm := range delModels {
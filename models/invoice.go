@@ -0,0 +1,123 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Invoice model which represents the invoice issued for a paid order. Invoices
+// are numbered per instance and series without gaps or duplicates, as required
+// for accounting. They're kept when their order is deleted.
+type Invoice struct {
+	ID         int64  `json:"-"`
+	InstanceID string `json:"-" sql:"unique_index:idx_invoice_number"`
+	Series     string `json:"series,omitempty" sql:"unique_index:idx_invoice_number"`
+	Number     int64  `json:"number" sql:"unique_index:idx_invoice_number"`
+	OrderID    string `json:"-" sql:"unique_index"`
+
+	// Note is a legal note printed on the invoice, like that of reverse
+	// charged orders.
+	Note string `json:"note,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the Invoice model.
+func (Invoice) TableName() string {
+	return tableName("invoices")
+}
+
+// InvoiceSeries holds the last invoice number issued in a series of an instance.
+type InvoiceSeries struct {
+	ID         int64  `json:"-"`
+	InstanceID string `json:"-" sql:"unique_index:idx_invoice_series"`
+	Series     string `json:"-" sql:"unique_index:idx_invoice_series"`
+	Last       int64  `json:"-"`
+}
+
+// TableName returns the database table name for the InvoiceSeries model.
+func (InvoiceSeries) TableName() string {
+	return tableName("invoice_series")
+}
+
+// ReverseChargeNote is the note on the invoices of reverse charged orders.
+const ReverseChargeNote = "Reverse charge: VAT to be accounted for by the recipient as per Article 196 of Council Directive 2006/112/EC."
+
+// TaxExemptionNote is the note on the invoices of tax exempt orders, with the
+// reference of the exemption certificate.
+const TaxExemptionNote = "Exempt from taxes, exemption certificate %s."
+
+// IssueInvoice issues the invoice of the order with the next number of the
+// series. Orders that already have an invoice keep it. The series counter is
+// incremented within the transaction tx, which locks it until tx is committed, so concurrent
+// payments are numbered one after another and a rollback doesn't leave a gap.
+func IssueInvoice(tx *gorm.DB, order *Order, series string) (*Invoice, error) {
+	invoice := &Invoice{}
+	if rsp := tx.Where("order_id = ?", order.ID).First(invoice); rsp.Error == nil {
+		order.Invoice = invoice
+		return invoice, nil
+	} else if !rsp.RecordNotFound() {
+		return nil, rsp.Error
+	}
+
+	number, err := nextSeriesNumber(tx, order.InstanceID, series)
+	if err != nil {
+		return nil, err
+	}
+
+	invoice = &Invoice{
+		InstanceID: order.InstanceID,
+		Series:     series,
+		Number:     number,
+		OrderID:    order.ID,
+	}
+	if order.TaxExempt {
+		invoice.Note = fmt.Sprintf(TaxExemptionNote, order.TaxExemptionCertificate)
+	} else if order.ReverseCharge {
+		invoice.Note = ReverseChargeNote
+	}
+	if rsp := tx.Create(invoice); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	order.Invoice = invoice
+	return invoice, nil
+}
+
+// nextSeriesNumber increments and returns the last number of the series. The
+// counter is locked by the update until tx is committed. The first number of
+// a series creates the counter within a savepoint, so a concurrent payment
+// creating it first doesn't abort tx but increments the counter it created.
+func nextSeriesNumber(tx *gorm.DB, instanceID, series string) (int64, error) {
+	counter := &InvoiceSeries{InstanceID: instanceID, Series: series}
+	for attempt := 0; ; attempt++ {
+		rsp := tx.Model(counter).Where("instance_id = ? AND series = ?", instanceID, series).Update("last", gorm.Expr("last + 1"))
+		if rsp.Error != nil {
+			return 0, rsp.Error
+		}
+		if rsp.RowsAffected > 0 {
+			break
+		}
+		if attempt > 0 {
+			return 0, fmt.Errorf("Failed to create invoice series %q", series)
+		}
+
+		if err := tx.Exec("SAVEPOINT invoice_series").Error; err != nil {
+			return 0, err
+		}
+		counter.Last = 1
+		if rsp := tx.Create(counter); rsp.Error == nil {
+			return counter.Last, tx.Exec("RELEASE SAVEPOINT invoice_series").Error
+		}
+		// another payment created the counter, which is incremented instead
+		counter.ID = 0
+		if err := tx.Exec("ROLLBACK TO SAVEPOINT invoice_series").Error; err != nil {
+			return 0, err
+		}
+	}
+	if rsp := tx.Where("instance_id = ? AND series = ?", instanceID, series).First(counter); rsp.Error != nil {
+		return 0, rsp.Error
+	}
+	return counter.Last, nil
+}
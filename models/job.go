@@ -0,0 +1,107 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const maxJobTries = 5
+const jobRetryPeriod = 30 * time.Second
+const jobLockTimeout = 5 * time.Minute
+
+// Job is work with side effects outside of the database, like calling the
+// API of a vendor, that's done once the transaction creating it has been
+// committed. Jobs are retried with a backoff until they succeed.
+type Job struct {
+	ID         uint64
+	InstanceID string `sql:"index"`
+
+	Type string
+	// Reference identifies what the job is about, e.g. an order, so the
+	// same work isn't queued twice while it's pending.
+	Reference string `sql:"index"`
+	Payload   string `sql:"type:text"`
+
+	Done         bool
+	Failed       bool
+	Tries        int
+	ErrorMessage *string `sql:"type:text"`
+
+	CreatedAt   time.Time
+	RunAfter    *time.Time
+	LockedAt    *time.Time
+	LockedBy    *string
+	CompletedAt *time.Time
+}
+
+// TableName returns the database table name for the Job model.
+func (Job) TableName() string {
+	return tableName("jobs")
+}
+
+// EnqueueJob creates a job of the type with the JSON encoded payload within
+// the transaction, unless a job of the type with the reference is still
+// pending.
+func EnqueueJob(tx *gorm.DB, instanceID, jobType, reference string, payload interface{}) error {
+	var pending int
+	rsp := tx.Model(&Job{}).Where("instance_id = ? AND type = ? AND reference = ? AND done = ?", instanceID, jobType, reference, false).Count(&pending)
+	if rsp.Error != nil {
+		return rsp.Error
+	}
+	if pending > 0 {
+		return nil
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return tx.Create(&Job{InstanceID: instanceID, Type: jobType, Reference: reference, Payload: string(data)}).Error
+}
+
+// ClaimJobs locks the jobs that are due for the worker and returns them.
+// Jobs locked by workers that stopped are claimed again after a while.
+func ClaimJobs(db *gorm.DB, workerID string) ([]*Job, error) {
+	now := time.Now()
+	tx := db.Begin()
+	rsp := tx.Model(&Job{}).
+		Where("done = ? AND (locked_at IS NULL OR locked_at < ?) AND (run_after IS NULL OR run_after < ?)", false, now.Add(-jobLockTimeout), now).
+		Updates(map[string]interface{}{"locked_at": now, "locked_by": workerID})
+	if rsp.Error != nil {
+		tx.Rollback()
+		return nil, rsp.Error
+	}
+	jobs := []*Job{}
+	if rsp := tx.Where("locked_by = ? AND done = ?", workerID, false).Find(&jobs); rsp.Error != nil {
+		tx.Rollback()
+		return nil, rsp.Error
+	}
+	return jobs, tx.Commit().Error
+}
+
+// Complete records the outcome of a run of the job. Failed jobs are retried
+// later until they failed too often, which is reported.
+func (j *Job) Complete(db *gorm.DB, err error) (bool, error) {
+	now := time.Now()
+	j.Tries++
+	j.LockedAt = nil
+	j.LockedBy = nil
+	if err == nil {
+		j.Done = true
+		j.ErrorMessage = nil
+		j.CompletedAt = &now
+	} else {
+		message := err.Error()
+		j.ErrorMessage = &message
+		if j.Tries >= maxJobTries {
+			j.Done = true
+			j.Failed = true
+			j.CompletedAt = &now
+		} else {
+			runAfter := now.Add(time.Duration(j.Tries) * jobRetryPeriod)
+			j.RunAfter = &runAfter
+		}
+	}
+	return j.Failed, db.Save(j).Error
+}
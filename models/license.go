@@ -0,0 +1,57 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// License is a license key issued for a unit of a paid line item.
+type License struct {
+	ID         string `json:"id"`
+	InstanceID string `json:"-" sql:"index"`
+	OrderID    string `json:"-" sql:"index"`
+	LineItemID int64  `json:"line_item_id"`
+
+	Sku   string `json:"sku"`
+	Title string `json:"title"`
+	Key   string `json:"key"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the License model.
+func (License) TableName() string {
+	return tableName("licenses")
+}
+
+// IssueLicenses stores the keys as the licenses of the line item. It does
+// nothing if licenses have already been issued for the line item.
+func IssueLicenses(tx *gorm.DB, order *Order, item *LineItem, keys []string) ([]*License, error) {
+	var issued int
+	if rsp := tx.Model(&License{}).Where("order_id = ? AND line_item_id = ?", order.ID, item.ID).Count(&issued); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	if issued > 0 {
+		return nil, nil
+	}
+
+	licenses := make([]*License, 0, len(keys))
+	for _, key := range keys {
+		license := &License{
+			ID:         uuid.NewRandom().String(),
+			InstanceID: order.InstanceID,
+			OrderID:    order.ID,
+			LineItemID: item.ID,
+			Sku:        item.Sku,
+			Title:      item.Title,
+			Key:        key,
+		}
+		if rsp := tx.Create(license); rsp.Error != nil {
+			return nil, rsp.Error
+		}
+		licenses = append(licenses, license)
+	}
+	return licenses, nil
+}
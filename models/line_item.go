@@ -29,9 +29,29 @@ func (DiscountItem) TableName() string {
 	return tableName("discount_items")
 }
 
+// SaveDiscountItems stores the discount items of the calculated prices of
+// the line items of the order, which aren't saved along with the line items.
+func SaveDiscountItems(tx *gorm.DB, order *Order) error {
+	for _, item := range order.LineItems {
+		if item.CalculationDetail == nil {
+			continue
+		}
+		for i := range item.DiscountItems {
+			discount := &item.DiscountItems[i]
+			discount.ID = 0
+			discount.LineItemID = item.ID
+			if err := tx.Create(discount).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // CalculationDetail holds details about pricing for line items
 type CalculationDetail struct {
-	Subtotal uint64 `json:"subtotal"`
+	UnitPrice uint64 `json:"unit_price"`
+	Subtotal  uint64 `json:"subtotal"`
 
 	Discount      uint64         `json:"discount"`
 	DiscountItems []DiscountItem `json:"discount_items" gorm:"foreignkey:LineItemID"`
@@ -39,6 +59,12 @@ type CalculationDetail struct {
 	NetTotal uint64 `json:"net_total"`
 	Taxes    uint64 `json:"taxes"`
 	Total    int64  `json:"total"`
+
+	// TaxRates are the taxes of a single unit at the rates of the time the
+	// item was priced, which refunds and reports use instead of the current
+	// rates.
+	TaxRates    []calculator.TaxRate `json:"tax_rates,omitempty" sql:"-"`
+	RawTaxRates string               `json:"-" sql:"type:text"`
 }
 
 // LineItem is a single item in an Order.
@@ -56,6 +82,18 @@ type LineItem struct {
 	Price uint64 `json:"price"`
 	VAT   uint64 `json:"vat"`
 
+	// TaxCode is the product tax code external tax backends categorize the
+	// item with.
+	TaxCode string `json:"tax_code,omitempty"`
+
+	// Weight is the weight of a single unit in grams, which weight based
+	// shipping methods charge by. Length, Width and Height are its dimensions
+	// in millimeters, which carriers quote live rates for.
+	Weight uint64 `json:"weight,omitempty"`
+	Length uint64 `json:"length,omitempty"`
+	Width  uint64 `json:"width,omitempty"`
+	Height uint64 `json:"height,omitempty"`
+
 	*CalculationDetail `json:"calculation" gorm:"embedded;embedded_prefix:calculation_"`
 
 	PriceItems []*PriceItem `json:"price_items"`
@@ -64,6 +102,19 @@ type LineItem struct {
 
 	Quantity uint64 `json:"quantity"`
 
+	// Tiers are the quantity-break prices of the item, the price of the tier
+	// the quantity reaches replacing Price.
+	Tiers    []calculator.PriceTier `json:"price_tiers,omitempty" sql:"-"`
+	RawTiers string                 `json:"-" sql:"type:text"`
+
+	// Metered line items are billed by the usage reported for subscriptions
+	// renewing them.
+	Metered bool `json:"metered,omitempty"`
+
+	RequiresLicense  bool   `json:"requires_license,omitempty"`
+	LicenseGenerator string `json:"-"`
+	LicenseURL       string `json:"-"`
+
 	MetaData    map[string]interface{} `sql:"-" json:"meta"`
 	RawMetaData string                 `json:"-" sql:"type:text"`
 
@@ -78,6 +129,25 @@ func (LineItem) TableName() string {
 
 // BeforeSave database callback.
 func (i *LineItem) BeforeSave() error {
+	i.RawTiers = ""
+	if len(i.Tiers) > 0 {
+		data, err := json.Marshal(i.Tiers)
+		if err != nil {
+			return err
+		}
+		i.RawTiers = string(data)
+	}
+	if detail := i.CalculationDetail; detail != nil {
+		detail.RawTaxRates = ""
+		if len(detail.TaxRates) > 0 {
+			data, err := json.Marshal(detail.TaxRates)
+			if err != nil {
+				return err
+			}
+			detail.RawTaxRates = string(data)
+		}
+	}
+
 	if len(i.MetaData) == 0 {
 		i.RawMetaData = ""
 		return nil
@@ -92,6 +162,16 @@ func (i *LineItem) BeforeSave() error {
 
 // AfterFind database callback.
 func (i *LineItem) AfterFind() error {
+	if i.RawTiers != "" {
+		if err := json.Unmarshal([]byte(i.RawTiers), &i.Tiers); err != nil {
+			return err
+		}
+	}
+	if detail := i.CalculationDetail; detail != nil && detail.RawTaxRates != "" {
+		if err := json.Unmarshal([]byte(detail.RawTaxRates), &detail.TaxRates); err != nil {
+			return err
+		}
+	}
 	if i.RawMetaData != "" {
 		return json.Unmarshal([]byte(i.RawMetaData), &i.MetaData)
 	}
@@ -179,6 +259,7 @@ type PriceMetadata struct {
 	VAT      string            `json:"vat"`
 	Items    []PriceMetaItem   `json:"items"`
 	Claims   map[string]string `json:"claims"`
+	Tiers    []PriceTierMeta   `json:"tiers"`
 
 	cents uint64
 }
@@ -190,6 +271,13 @@ type PriceMetaItem struct {
 	VAT    uint64 `json:"vat"`
 }
 
+// PriceTierMeta is a quantity-break price, the amount a unit costs when
+// ordering at least MinQuantity units.
+type PriceTierMeta struct {
+	MinQuantity uint64 `json:"min_quantity"`
+	Amount      string `json:"amount"`
+}
+
 // AddonMetaItem model
 type AddonMetaItem struct {
 	Sku         string          `json:"sku"`
@@ -206,10 +294,39 @@ type LineItemMetadata struct {
 	VAT         uint64          `json:"vat"`
 	Prices      []PriceMetadata `json:"prices"`
 	Type        string          `json:"type"`
+	TaxCode     string          `json:"tax_code"`
+	Weight      uint64          `json:"weight"`
+	Length      uint64          `json:"length"`
+	Width       uint64          `json:"width"`
+	Height      uint64          `json:"height"`
 
 	Downloads []Download      `json:"downloads"`
 	Addons    []AddonMetaItem `json:"addons"`
 
+	// MaxDownloadIPsPerDay and MaxDownloads set the download limits of all
+	// downloads of the product that don't set their own.
+	MaxDownloadIPsPerDay uint64 `json:"max_download_ips_per_day"`
+	MaxDownloads         uint64 `json:"max_downloads"`
+
+	// DownloadExpiryDays sets how many days after the purchase the downloads
+	// of the product that don't set their own expiry can be accessed.
+	DownloadExpiryDays uint64 `json:"download_expiry_days"`
+
+	// WatermarkDownloads stamps the downloads of the product with the email
+	// and number of the order.
+	WatermarkDownloads bool `json:"watermark_downloads"`
+
+	// Metered products are billed by usage instead of their ordered quantity
+	// when subscriptions renew them.
+	Metered bool `json:"metered"`
+
+	// RequiresLicense issues a license key for every unit of the product
+	// once the order has been paid. LicenseGenerator and LicenseURL override
+	// the license settings of the instance.
+	RequiresLicense  bool   `json:"requires_license"`
+	LicenseGenerator string `json:"license_generator"`
+	LicenseURL       string `json:"license_url"`
+
 	Webhook string `json:"webhook"`
 }
 
@@ -250,6 +367,16 @@ func (i *LineItem) GetQuantity() uint64 {
 	return i.Quantity
 }
 
+// PriceTiers implements the calculator.TieredItem interface. The addons are
+// priced on top of every tier.
+func (i *LineItem) PriceTiers() []calculator.PriceTier {
+	tiers := make([]calculator.PriceTier, len(i.Tiers))
+	for index, tier := range i.Tiers {
+		tiers[index] = calculator.PriceTier{MinQuantity: tier.MinQuantity, Price: tier.Price + i.AddonPrice}
+	}
+	return tiers
+}
+
 // Process calculates the price of a LineItem.
 func (i *LineItem) Process(config *conf.Configuration, userClaims map[string]interface{}, order *Order) error {
 	meta, err := i.FetchMeta(config.SiteURL)
@@ -262,6 +389,15 @@ func (i *LineItem) Process(config *conf.Configuration, userClaims map[string]int
 	i.Description = meta.Description
 	i.VAT = meta.VAT
 	i.Type = meta.Type
+	i.TaxCode = meta.TaxCode
+	i.Weight = meta.Weight
+	i.Length = meta.Length
+	i.Width = meta.Width
+	i.Height = meta.Height
+	i.Metered = meta.Metered
+	i.RequiresLicense = meta.RequiresLicense
+	i.LicenseGenerator = meta.LicenseGenerator
+	i.LicenseURL = meta.LicenseURL
 
 	for index, addon := range i.AddonItems {
 		var metaAddon *AddonMetaItem
@@ -353,6 +489,18 @@ func (i *LineItem) MissingDownloads(order *Order, meta *LineItemMetadata) []Down
 		orderDownload.ID = uuid.NewRandom().String()
 		orderDownload.OrderID = order.ID
 		orderDownload.Sku = i.Sku
+		if orderDownload.MaxIPsPerDay == 0 {
+			orderDownload.MaxIPsPerDay = meta.MaxDownloadIPsPerDay
+		}
+		if orderDownload.MaxDownloads == 0 {
+			orderDownload.MaxDownloads = meta.MaxDownloads
+		}
+		if orderDownload.ExpiresAfterDays == 0 {
+			orderDownload.ExpiresAfterDays = meta.DownloadExpiryDays
+		}
+		orderDownload.ExpiresAt = nil
+		orderDownload.Watermark = orderDownload.Watermark || meta.WatermarkDownloads
+		orderDownload.WatermarkedURL = ""
 		if orderDownload.Title == "" {
 			orderDownload.Title = i.Title
 		}
@@ -375,6 +523,14 @@ func (i *LineItem) calculatePrice(userClaims map[string]interface{}, prices []Pr
 		}
 		i.PriceItems[index] = &PriceItem{Amount: uint64(amount * 100), Type: item.Type, VAT: item.VAT}
 	}
+	i.Tiers = nil
+	for _, tier := range lowestPrice.Tiers {
+		amount, err := strconv.ParseFloat(tier.Amount, 64)
+		if err != nil {
+			return err
+		}
+		i.Tiers = append(i.Tiers, calculator.PriceTier{MinQuantity: tier.MinQuantity, Price: rint(amount * 100)})
+	}
 	for _, addon := range i.AddonItems {
 		i.AddonPrice += addon.Price
 	}
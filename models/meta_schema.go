@@ -0,0 +1,148 @@
+package models
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// MetaSchema is the subset of JSON schema the metadata of orders can be
+// validated against. It supports the type, properties, required,
+// additionalProperties, items, enum, pattern, minLength, maxLength, minimum
+// and maximum keywords.
+type MetaSchema struct {
+	Type                 string                 `json:"type"`
+	Properties           map[string]*MetaSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *MetaSchema            `json:"items"`
+	Enum                 []interface{}          `json:"enum"`
+	Pattern              string                 `json:"pattern"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+}
+
+// Validate checks decoded JSON metadata against the schema.
+func (s *MetaSchema) Validate(meta map[string]interface{}) error {
+	if meta == nil {
+		meta = map[string]interface{}{}
+	}
+	return s.validate("meta", meta)
+}
+
+func (s *MetaSchema) validate(path string, value interface{}) error {
+	if s.Type != "" && !hasSchemaType(s.Type, value) {
+		return fmt.Errorf("%s must be of type %s", path, s.Type)
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, allowed := range s.Enum {
+			if reflect.DeepEqual(allowed, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s must be one of %v", path, s.Enum)
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return s.validateObject(path, v)
+	case []interface{}:
+		if s.Items == nil {
+			return nil
+		}
+		for i, item := range v {
+			if err := s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+				return err
+			}
+		}
+	case string:
+		length := len([]rune(v))
+		if s.MinLength != nil && length < *s.MinLength {
+			return fmt.Errorf("%s must be at least %d characters long", path, *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			return fmt.Errorf("%s must be at most %d characters long", path, *s.MaxLength)
+		}
+		if s.Pattern != "" {
+			re, err := regexp.Compile(s.Pattern)
+			if err != nil {
+				return fmt.Errorf("%s has an invalid pattern in the schema: %v", path, err)
+			}
+			if !re.MatchString(v) {
+				return fmt.Errorf("%s must match the pattern %s", path, s.Pattern)
+			}
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			return fmt.Errorf("%s must be at least %v", path, *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			return fmt.Errorf("%s must be at most %v", path, *s.Maximum)
+		}
+	}
+	return nil
+}
+
+func (s *MetaSchema) validateObject(path string, object map[string]interface{}) error {
+	for _, key := range s.Required {
+		if _, ok := object[key]; !ok {
+			return fmt.Errorf("%s.%s is required", path, key)
+		}
+	}
+
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	unknown := []string{}
+	for _, key := range keys {
+		property, ok := s.Properties[key]
+		if !ok {
+			unknown = append(unknown, key)
+			continue
+		}
+		if err := property.validate(path+"."+key, object[key]); err != nil {
+			return err
+		}
+	}
+	if s.AdditionalProperties != nil && !*s.AdditionalProperties && len(unknown) > 0 {
+		return fmt.Errorf("%s has unknown keys: %s", path, strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+func hasSchemaType(schemaType string, value interface{}) bool {
+	switch schemaType {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		number, ok := value.(float64)
+		return ok && number == float64(int64(number))
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	}
+	return false
+}
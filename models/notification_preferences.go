@@ -0,0 +1,182 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// The kinds of emails a user can opt out of.
+const (
+	OrderEmailsNotification     = "order_emails"
+	MarketingNotification       = "marketing"
+	ShipmentUpdatesNotification = "shipment_updates"
+)
+
+// NotificationKinds are the kinds of emails a user can opt out of.
+var NotificationKinds = []string{OrderEmailsNotification, MarketingNotification, ShipmentUpdatesNotification}
+
+// NotificationPreferences are the kinds of emails a user agreed to receive.
+// Users without preferences receive all of them. The preferences of guests
+// are saved by the email of their orders, under a guest user ID.
+type NotificationPreferences struct {
+	ID         int64  `json:"-"`
+	InstanceID string `json:"-" sql:"index"`
+	UserID     string `json:"user_id" sql:"unique_index"`
+	Email      string `json:"email,omitempty"`
+
+	OrderEmails     bool `json:"order_emails"`
+	Marketing       bool `json:"marketing"`
+	ShipmentUpdates bool `json:"shipment_updates"`
+
+	// UnsubscribeToken lets the user opt out from a link in an email without
+	// signing in.
+	UnsubscribeToken string `json:"unsubscribe_token" sql:"unique_index"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName returns the database table name for the NotificationPreferences model.
+func (NotificationPreferences) TableName() string {
+	return tableName("notification_preferences")
+}
+
+// NewNotificationPreferences returns the default preferences of the user,
+// with all kinds of emails allowed, and a new random unsubscribe token.
+func NewNotificationPreferences(user *User) (*NotificationPreferences, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	return &NotificationPreferences{
+		InstanceID:       user.InstanceID,
+		UserID:           user.ID,
+		OrderEmails:      true,
+		Marketing:        true,
+		ShipmentUpdates:  true,
+		UnsubscribeToken: hex.EncodeToString(token),
+	}, nil
+}
+
+// ValidNotificationKind reports whether the kind is one of NotificationKinds.
+func ValidNotificationKind(kind string) bool {
+	for _, k := range NotificationKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether the user agreed to receive emails of the kind.
+func (p *NotificationPreferences) Allows(kind string) bool {
+	switch kind {
+	case OrderEmailsNotification:
+		return p.OrderEmails
+	case MarketingNotification:
+		return p.Marketing
+	case ShipmentUpdatesNotification:
+		return p.ShipmentUpdates
+	}
+	return true
+}
+
+// Set opts the user into or out of emails of the kind.
+func (p *NotificationPreferences) Set(kind string, allowed bool) {
+	switch kind {
+	case OrderEmailsNotification:
+		p.OrderEmails = allowed
+	case MarketingNotification:
+		p.Marketing = allowed
+	case ShipmentUpdatesNotification:
+		p.ShipmentUpdates = allowed
+	}
+}
+
+// LoadNotificationPreferences returns the preferences of the user, saving
+// the default ones if the user has none yet.
+func LoadNotificationPreferences(tx *gorm.DB, user *User) (*NotificationPreferences, error) {
+	prefs := &NotificationPreferences{}
+	rsp := tx.First(prefs, "user_id = ?", user.ID)
+	if rsp.Error == nil {
+		return prefs, nil
+	}
+	if !rsp.RecordNotFound() {
+		return nil, rsp.Error
+	}
+
+	prefs, err := NewNotificationPreferences(user)
+	if err != nil {
+		return nil, err
+	}
+	if rsp := tx.Create(prefs); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	return prefs, nil
+}
+
+// guestPreferencesID returns the user ID the preferences of the guest with
+// the email are saved under.
+func guestPreferencesID(instanceID, email string) string {
+	return "guest:" + instanceID + ":" + strings.ToLower(email)
+}
+
+// LoadRecipientPreferences returns the preferences of the recipient of an
+// email, the user or else the guest with the email, saving the default ones
+// if they have none yet.
+func LoadRecipientPreferences(tx *gorm.DB, instanceID, userID, email string) (*NotificationPreferences, error) {
+	if userID != "" {
+		return LoadNotificationPreferences(tx, &User{InstanceID: instanceID, ID: userID})
+	}
+	guest := &User{InstanceID: instanceID, ID: guestPreferencesID(instanceID, email)}
+	prefs, err := LoadNotificationPreferences(tx, guest)
+	if err != nil {
+		return nil, err
+	}
+	if prefs.Email == "" {
+		prefs.Email = email
+		if rsp := tx.Model(prefs).UpdateColumn("email", email); rsp.Error != nil {
+			return nil, rsp.Error
+		}
+	}
+	return prefs, nil
+}
+
+// FindUnsubscribeToken returns the preferences the unsubscribe token belongs
+// to. It reports false if the token doesn't exist.
+func FindUnsubscribeToken(tx *gorm.DB, instanceID, token string) (*NotificationPreferences, bool, error) {
+	prefs := &NotificationPreferences{}
+	rsp := tx.First(prefs, "unsubscribe_token = ? AND instance_id = ?", token, instanceID)
+	if rsp.RecordNotFound() {
+		return nil, false, nil
+	}
+	if rsp.Error != nil {
+		return nil, false, rsp.Error
+	}
+	return prefs, true, nil
+}
+
+// NotificationAllowed reports whether the user, or else the guest with the
+// email, agreed to receive emails of the kind. Recipients without
+// preferences receive all of them.
+func NotificationAllowed(db *gorm.DB, instanceID, userID, email, kind string) (bool, error) {
+	if userID == "" {
+		if email == "" {
+			return true, nil
+		}
+		userID = guestPreferencesID(instanceID, email)
+	}
+	prefs := &NotificationPreferences{}
+	rsp := db.First(prefs, "user_id = ?", userID)
+	if rsp.RecordNotFound() {
+		return true, nil
+	}
+	if rsp.Error != nil {
+		return false, rsp.Error
+	}
+	return prefs.Allows(kind), nil
+}
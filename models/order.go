@@ -3,6 +3,7 @@ package models
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"time"
 
 	"github.com/jinzhu/gorm"
@@ -16,23 +17,90 @@ import (
 // PendingState is the pending state of an Order
 const PendingState = "pending"
 
+// PendingPaymentState is the state of an Order awaiting a manual payment
+const PendingPaymentState = "pending_payment"
+
+// PendingApprovalState is the state of an Order whose payment has been
+// authorized but is still reviewed by the provider, e.g. a buy now pay later
+// credit check
+const PendingApprovalState = "pending_approval"
+
+// ProcessingState is the state of an Order whose payment has been initiated
+// but settles later on, e.g. a SEPA Direct Debit
+const ProcessingState = "processing"
+
 // PaidState is the paid state of an Order
 const PaidState = "paid"
 
+// PartiallyPaidState is the state of an Order paid with multiple transactions
+// whose paid transactions don't cover the order total yet
+const PartiallyPaidState = "partially_paid"
+
+// AuthorizedState is the state of an Order whose payment has been authorized but not captured yet
+const AuthorizedState = "authorized"
+
+// CapturingState is the state of a Transaction whose authorization is being
+// captured with the provider
+const CapturingState = "capturing"
+
+// FinalizingState is the state of a Transaction whose redirect based payment
+// is being finalized with the provider
+const FinalizingState = "finalizing"
+
+// VoidedState is the state of an Order whose payment authorization has been released
+const VoidedState = "voided"
+
+// PastDueState is the state of an Order whose failed payment is going to be retried
+const PastDueState = "past_due"
+
+// RefundedState is the state of an Order whose payment has been refunded completely
+const RefundedState = "refunded"
+
+// DisputedState is the state of an Order whose payment is disputed by the customer
+const DisputedState = "disputed"
+
 // ShippingState is the shipping state of an order
 const ShippingState = "shipping"
 
 // ShippedState is the shipped state of an Order
 const ShippedState = "shipped"
 
+// DeliveredState is the state of a shipped Order whose shipments have all been
+// delivered
+const DeliveredState = "delivered"
+
+// ReadyForPickupState is the state of an Order collected at a pickup location
+// that is waiting for the customer
+const ReadyForPickupState = "ready_for_pickup"
+
+// PickedUpState is the state of an Order collected at a pickup location that
+// the customer picked up
+const PickedUpState = "picked_up"
+
 // FailedState is the failed state of an Order
 const FailedState = "failed"
 
+// ExpiredState is the state of an Order that hasn't been paid in time
+const ExpiredState = "expired"
+
+// CancelledState is the state of an Order that has been cancelled
+const CancelledState = "cancelled"
+
 // PaymentState are the possible values for the PaymentState field
 var PaymentStates = []string{
 	PendingState,
+	PendingPaymentState,
+	PendingApprovalState,
+	ProcessingState,
+	PartiallyPaidState,
+	AuthorizedState,
 	PaidState,
+	VoidedState,
+	PastDueState,
 	FailedState,
+	ExpiredState,
+	RefundedState,
+	DisputedState,
 }
 
 // FulfillmentStates are the possible values for the FulfillmentState field
@@ -40,6 +108,9 @@ var FulfillmentStates = []string{
 	PendingState,
 	ShippingState,
 	ShippedState,
+	DeliveredState,
+	ReadyForPickupState,
+	PickedUpState,
 }
 
 // NumberType | StringType | BoolType are the different types supported in custom data for orders
@@ -55,6 +126,9 @@ type Order struct {
 	ID            string `json:"id"`
 	InvoiceNumber int64  `json:"invoice_number,omitempty"`
 
+	// Number is the human readable order number customers can refer to.
+	Number string `json:"number,omitempty" sql:"index"`
+
 	IP string `json:"ip"`
 
 	User      *User  `json:"user,omitempty"`
@@ -76,14 +150,56 @@ type Order struct {
 
 	Total uint64 `json:"total"`
 
+	// ShippingMethod is the ID of the shipping method of the settings the
+	// Shipping is charged for, or of the live rate of the ShippingProvider
+	// picked at checkout.
+	ShippingMethod   string `json:"shipping_method,omitempty"`
+	ShippingProvider string `json:"shipping_provider,omitempty"`
+
+	// PickupLocation is the ID of the pickup location of the settings the
+	// customer collects the order at, whose address is the shipping address.
+	PickupLocation string `json:"pickup_location,omitempty"`
+
 	PaymentState     string `json:"payment_state"`
 	FulfillmentState string `json:"fulfillment_state"`
 	State            string `json:"state"`
 
 	PaymentProcessor string `json:"payment_processor"`
 
+	// Oversold is set for paid orders whose items the stock didn't cover
+	// anymore once the payment succeeded. What was left of them has been
+	// taken out of stock, the rest has to be restocked or refunded.
+	Oversold bool `json:"oversold"`
+
+	// Test is set for orders placed with an instance in sandbox mode.
+	Test bool `json:"test"`
+
+	// SubscriptionID references the subscription a renewal order was created for.
+	SubscriptionID string `json:"subscription_id,omitempty"`
+
+	// AbandonedAt is set once the order has been left pending for longer
+	// than the abandonment delay of its instance.
+	AbandonedAt *time.Time `json:"abandoned_at,omitempty" sql:"index"`
+
+	// ArchivedAt is set for orders that are hidden from listings and reports
+	// unless requested explicitly.
+	ArchivedAt *time.Time `json:"archived_at,omitempty" sql:"index"`
+
+	// AnonymizedAt is set once the personal data of the order has been
+	// removed after the retention period of its instance.
+	AnonymizedAt *time.Time `json:"anonymized_at,omitempty" sql:"index"`
+
 	Transactions []*Transaction `json:"transactions"`
 	Notes        []*OrderNote   `json:"notes"`
+	Shipments    []*Shipment    `json:"shipments"`
+	Tags         []*OrderTag    `json:"tags"`
+
+	// Invoice is issued once the order has been paid.
+	Invoice *Invoice `json:"invoice,omitempty"`
+
+	// Licenses are issued for the line items that require a license once the
+	// order has been paid.
+	Licenses []*License `json:"licenses,omitempty"`
 
 	ShippingAddress   Address `json:"shipping_address" gorm:"ForeignKey:ShippingAddressID"`
 	ShippingAddressID string  `json:"shipping_address_id"`
@@ -93,6 +209,26 @@ type Order struct {
 
 	VATNumber string `json:"vatnumber"`
 
+	// The result of validating the VAT number with VIES. VATCountry is the
+	// country code of the VAT number.
+	VATCountry     string     `json:"vat_country,omitempty"`
+	VATCompany     string     `json:"vat_company,omitempty"`
+	VATAddress     string     `json:"vat_address,omitempty"`
+	VATValidatedAt *time.Time `json:"vat_validated_at,omitempty"`
+
+	// ReverseCharge is set for orders zero-rated as cross-border sales to
+	// businesses within the EU, for which the buyer accounts for the VAT.
+	ReverseCharge bool `json:"reverse_charge"`
+
+	// TaxExempt is set for orders of customers exempt from taxes, created
+	// with the reference of their exemption certificate.
+	TaxExempt               bool   `json:"tax_exempt"`
+	TaxExemptionCertificate string `json:"tax_exemption_certificate,omitempty"`
+
+	// CustomerGroup is the customer group of the user the order is priced
+	// for, set when it's created.
+	CustomerGroup string `json:"customer_group,omitempty"`
+
 	MetaData    map[string]interface{} `sql:"-" json:"meta"`
 	RawMetaData string                 `json:"-" sql:"type:text"`
 
@@ -101,6 +237,22 @@ type Order struct {
 	Coupon    *Coupon `json:"coupon,omitempty" sql:"-"`
 	RawCoupon string  `json:"-" sql:"type:text"`
 
+	// Coupons are all coupons of an order with several coupon codes, the
+	// first of them is also the Coupon of the order.
+	Coupons    []*Coupon `json:"coupons,omitempty" sql:"-"`
+	RawCoupons string    `json:"-" sql:"type:text"`
+
+	// CartRules are the names of the cart rules that gave a discount.
+	CartRules    []string `json:"cart_rules,omitempty" sql:"-"`
+	RawCartRules string   `json:"-" sql:"type:text"`
+
+	// TaxProvider is the external tax backend that calculated the taxes of
+	// the order, empty if they're calculated from the site settings.
+	TaxProvider string `json:"tax_provider,omitempty"`
+
+	// ReferralCode is the referral code the order was created with.
+	ReferralCode string `json:"referral_code,omitempty"`
+
 	CreatedAt time.Time  `json:"created_at" sql:"index"`
 	UpdatedAt time.Time  `json:"updated_at"`
 	DeletedAt *time.Time `json:"-" sql:"index"`
@@ -126,6 +278,18 @@ func (o *Order) AfterFind() error {
 			return err
 		}
 	}
+	if o.RawCoupons != "" {
+		err := json.Unmarshal([]byte(o.RawCoupons), &o.Coupons)
+		if err != nil {
+			return err
+		}
+	}
+	if o.RawCartRules != "" {
+		err := json.Unmarshal([]byte(o.RawCartRules), &o.CartRules)
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -146,6 +310,20 @@ func (o *Order) BeforeSave() error {
 		}
 		o.RawCoupon = string(data)
 	}
+	if len(o.Coupons) > 0 {
+		data, err := json.Marshal(o.Coupons)
+		if err != nil {
+			return err
+		}
+		o.RawCoupons = string(data)
+	}
+	if o.CartRules != nil {
+		data, err := json.Marshal(o.CartRules)
+		if err != nil {
+			return err
+		}
+		o.RawCartRules = string(data)
+	}
 
 	return nil
 }
@@ -172,22 +350,35 @@ func (o *Order) CalculateTotal(settings *calculator.Settings, claims map[string]
 		items[i] = item
 	}
 
-	params := calculator.PriceParameters{o.ShippingAddress.Country, o.Currency, o.Coupon, items}
+	o.ReverseCharge = o.VATValidatedAt != nil && calculator.ReverseChargeApplies(settings, o.VATCountry)
+
+	params := calculator.PriceParameters{Country: o.ShippingAddress.Country, Currency: o.Currency, Items: items, ReverseCharge: o.ReverseCharge, TaxExempt: o.TaxExempt, CustomerGroup: o.CustomerGroup}
+	if len(o.Coupons) > 0 {
+		for _, coupon := range o.Coupons {
+			params.Coupons = append(params.Coupons, coupon)
+		}
+	} else if o.Coupon != nil {
+		params.Coupon = o.Coupon
+	}
 	price := calculator.CalculatePrice(settings, claims, params, log)
 
 	o.SubTotal = price.Subtotal
 	o.Taxes = price.Taxes
+	o.TaxProvider = ""
 	o.Discount = price.Discount
 	o.NetTotal = price.NetTotal
+	o.CartRules = price.Rules
 
 	// apply price details to line items
 	for i, item := range price.Items {
 		o.LineItems[i].CalculationDetail = &CalculationDetail{
-			Discount: item.Discount,
-			Subtotal: item.Subtotal,
-			NetTotal: item.NetTotal,
-			Taxes:    item.Taxes,
-			Total:    item.Total,
+			UnitPrice: item.UnitPrice,
+			Discount:  item.Discount,
+			Subtotal:  item.Subtotal,
+			NetTotal:  item.NetTotal,
+			Taxes:     item.Taxes,
+			Total:     item.Total,
+			TaxRates:  item.TaxRates,
 		}
 
 		for _, discount := range item.DiscountItems {
@@ -198,9 +389,114 @@ func (o *Order) CalculateTotal(settings *calculator.Settings, claims map[string]
 		}
 	}
 
+	// live rates of a shipping provider are kept at the amount quoted
+	if o.ShippingProvider == "" {
+		o.Shipping = 0
+		if o.ShippingMethod != "" {
+			if quote, ok := calculator.QuoteShipping(settings, o.ShippingParameters(), o.ShippingMethod); ok {
+				o.Shipping = quote.Amount
+			}
+		}
+	}
+
 	if price.Total > 0 {
-		o.Total = uint64(price.Total)
+		o.Total = uint64(price.Total) + o.Shipping
+	} else if o.Shipping > 0 {
+		o.Total = o.Shipping
+	}
+}
+
+// FulfillmentStateAllowed returns whether the order can be moved to the
+// fulfillment state. Orders collected at a pickup location are ready for
+// pickup and picked up instead of being shipped and delivered.
+func (o *Order) FulfillmentStateAllowed(state string) bool {
+	switch state {
+	case ReadyForPickupState, PickedUpState:
+		return o.PickupLocation != ""
+	case ShippingState, ShippedState, DeliveredState:
+		return o.PickupLocation == ""
+	}
+	for _, s := range FulfillmentStates {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// ShippingParameters returns the weight and subtotal of a priced order as
+// shipping methods charge by them.
+func (o *Order) ShippingParameters() calculator.ShippingParameters {
+	params := calculator.ShippingParameters{Country: o.ShippingAddress.Country, Region: o.ShippingAddress.State, Currency: o.Currency}
+	for _, item := range o.LineItems {
+		params.Weight += item.Weight * item.Quantity
+	}
+	if o.SubTotal > o.Discount {
+		params.Amount = o.SubTotal - o.Discount
+	}
+	return params
+}
+
+// ApplyTaxes replaces the taxes of the line items with the taxes of their
+// whole quantity calculated by the external tax provider, at the combined
+// rate of the state and country the order ships to.
+func (o *Order) ApplyTaxes(provider string, taxes []uint64) {
+	o.TaxProvider = provider
+	o.Taxes = 0
+	for i, item := range o.LineItems {
+		if i >= len(taxes) || item.CalculationDetail == nil || item.Quantity == 0 {
+			continue
+		}
+		o.Taxes += taxes[i]
+		detail := item.CalculationDetail
+		detail.Taxes = rint(float64(taxes[i]) / float64(item.Quantity))
+		detail.Total = int64(detail.NetTotal + detail.Taxes)
+		detail.TaxRates = nil
+		if detail.Taxes > 0 && detail.NetTotal > 0 {
+			// the provider's combined rate, rounded to a thousandth of a percent
+			detail.TaxRates = []calculator.TaxRate{{
+				Rate:          math.Round(float64(detail.Taxes)*100000/float64(detail.NetTotal)) / 1000,
+				Jurisdiction:  o.taxJurisdiction(),
+				TaxableAmount: detail.NetTotal,
+				Amount:        detail.Taxes,
+			}}
+		}
+	}
+	o.Total = o.NetTotal + o.Taxes + o.Shipping
+}
+
+// taxJurisdiction returns the state and country the order ships to.
+func (o *Order) taxJurisdiction() string {
+	if o.ShippingAddress.State == "" {
+		return o.ShippingAddress.Country
 	}
+	return o.ShippingAddress.State + ", " + o.ShippingAddress.Country
+}
+
+// AppliedCoupons returns the coupons of the Order that gave a discount on any
+// of its line items.
+func (o *Order) AppliedCoupons() []*Coupon {
+	coupons := o.Coupons
+	if len(coupons) == 0 && o.Coupon != nil {
+		coupons = []*Coupon{o.Coupon}
+	}
+
+	applied := []*Coupon{}
+	for _, coupon := range coupons {
+	items:
+		for _, item := range o.LineItems {
+			if item.CalculationDetail == nil {
+				continue
+			}
+			for _, discount := range item.DiscountItems {
+				if discount.Type == calculator.DiscountTypeCoupon && discount.Code == coupon.Code {
+					applied = append(applied, coupon)
+					break items
+				}
+			}
+		}
+	}
+	return applied
 }
 
 // UpdateDownloads will refetch downloads for all line items in the order and
@@ -215,6 +511,22 @@ func (o *Order) UpdateDownloads(config *conf.Configuration, log logrus.FieldLogg
 	return err
 }
 
+// UpdateSkuDownloads refetches the downloads of the product with the sku and
+// adds the new ones to the orders. The metadata of the product is fetched once
+// for all orders. It returns the orders that got new downloads.
+func UpdateSkuDownloads(config *conf.Configuration, log logrus.FieldLogger, orders []*Order, sku string) ([]*Order, error) {
+	updateMap := downloadRefreshItemSet{}
+	for _, order := range orders {
+		for _, item := range order.LineItems {
+			if item.Sku == sku {
+				updateMap.Add(item, order)
+				break
+			}
+		}
+	}
+	return updateMap.Update(nil, config, log)
+}
+
 func (o *Order) BeforeDelete(tx *gorm.DB) error {
 	cascadeModels := map[string]interface{}{
 		"line item": &[]LineItem{},
@@ -226,9 +538,15 @@ func (o *Order) BeforeDelete(tx *gorm.DB) error {
 	}
 
 	delModels := map[string]interface{}{
-		"event":       Event{},
-		"transaction": Transaction{},
-		"download":    Download{},
+		"event":        Event{},
+		"transaction":  Transaction{},
+		"download":     Download{},
+		"order note":   OrderNote{},
+		"shipment":     Shipment{},
+		"order tag":    OrderTag{},
+		"license":      License{},
+		"download log": DownloadLog{},
+		"referral":     Referral{},
 	}
 	for name, dm := range delModels {
 		if result := tx.Delete(dm, "order_id = ?", o.ID); result.Error != nil {
@@ -2,13 +2,29 @@ package models
 
 import "time"
 
+// NoteInternalVisibility is the visibility of notes only shown to admins
+const NoteInternalVisibility = "internal"
+
+// NoteCustomerVisibility is the visibility of notes shown to the customer of the order
+const NoteCustomerVisibility = "customer"
+
+// NoteVisibilities are the possible values for the Visibility field
+var NoteVisibilities = []string{
+	NoteInternalVisibility,
+	NoteCustomerVisibility,
+}
+
 // OrderNote model which represent notes on a model.
 type OrderNote struct {
-	ID int64 `json:"-"`
+	ID      int64  `json:"id"`
+	OrderID string `json:"order_id" sql:"index"`
 
+	// UserID and Author identify the user who wrote the note.
 	UserID string `json:"user_id"`
+	Author string `json:"author"`
 
-	Text string `json:"text" sql:"type:text"`
+	Text       string `json:"text" sql:"type:text"`
+	Visibility string `json:"visibility"`
 
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
@@ -19,3 +35,17 @@ type OrderNote struct {
 func (OrderNote) TableName() string {
 	return tableName("orders_notes")
 }
+
+// NewOrderNote returns a new note on the order.
+func NewOrderNote(orderID, userID, author, text, visibility string) *OrderNote {
+	if visibility == "" {
+		visibility = NoteInternalVisibility
+	}
+	return &OrderNote{
+		OrderID:    orderID,
+		UserID:     userID,
+		Author:     author,
+		Text:       text,
+		Visibility: visibility,
+	}
+}
@@ -0,0 +1,54 @@
+package models
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// DefaultOrderNumberPrefix is the prefix of order numbers if the instance doesn't configure one
+const DefaultOrderNumberPrefix = "SO"
+
+// OrderNumber holds the last order number of an instance.
+type OrderNumber struct {
+	InstanceID string `gorm:"primary_key"`
+	Number     int64
+}
+
+// TableName returns the database table name for the OrderNumber model.
+func (OrderNumber) TableName() string {
+	return tableName("order_numbers")
+}
+
+// NextOrderNumber updates the order number sequence of the instance and
+// returns the next human readable order number, e.g. SO-2024-000123.
+func NextOrderNumber(tx *gorm.DB, instanceID, prefix string, now time.Time) (string, error) {
+	number := OrderNumber{}
+	if instanceID == "" {
+		instanceID = "global-instance"
+	}
+	if prefix == "" {
+		prefix = DefaultOrderNumberPrefix
+	}
+
+	if result := tx.Where(OrderNumber{InstanceID: instanceID}).Attrs(OrderNumber{Number: 0}).FirstOrCreate(&number); result.Error != nil {
+		return "", result.Error
+	}
+
+	numberTable := tx.NewScope(OrderNumber{}).QuotedTableName()
+	if result := tx.Raw("select number from "+numberTable+" where instance_id = ? for update", instanceID).Scan(&number); result.Error != nil {
+		if strings.Contains(result.Error.Error(), "syntax error") {
+			log.Println("This DB driver doesn't support select for update, hoping for the best...")
+		} else {
+			return "", result.Error
+		}
+	}
+	if result := tx.Model(number).Update("number", gorm.Expr("number + 1")); result.Error != nil {
+		return "", result.Error
+	}
+
+	return fmt.Sprintf("%s-%d-%06d", prefix, now.Year(), number.Number+1), nil
+}
@@ -0,0 +1,89 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// OrderTag model which represents a free-form label on an order, e.g. to mark
+// it for review or priority fulfillment. It's serialized as the plain tag.
+type OrderTag struct {
+	ID      int64  `json:"-"`
+	OrderID string `json:"-" sql:"index"`
+	Tag     string `json:"tag" sql:"index"`
+
+	CreatedAt time.Time `json:"-"`
+}
+
+// TableName returns the database table name for the OrderTag model.
+func (OrderTag) TableName() string {
+	return tableName("orders_tags")
+}
+
+// MarshalJSON serializes the tag as a string.
+func (t OrderTag) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.Tag)
+}
+
+// UnmarshalJSON reads the tag from a string.
+func (t *OrderTag) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &t.Tag)
+}
+
+// NormalizeTags trims and lower cases the tags and drops empty and duplicate ones.
+func NormalizeTags(tags []string) []string {
+	normalized := []string{}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
+
+// SetOrderTags replaces the tags of the order.
+func SetOrderTags(tx *gorm.DB, order *Order, tags []string) error {
+	if rsp := tx.Delete(OrderTag{}, "order_id = ?", order.ID); rsp.Error != nil {
+		return rsp.Error
+	}
+	order.Tags = []*OrderTag{}
+	for _, tag := range NormalizeTags(tags) {
+		orderTag := &OrderTag{OrderID: order.ID, Tag: tag}
+		if rsp := tx.Create(orderTag); rsp.Error != nil {
+			return rsp.Error
+		}
+		order.Tags = append(order.Tags, orderTag)
+	}
+	return nil
+}
+
+// AddOrderTags adds the tags the order doesn't have yet and returns them.
+func AddOrderTags(tx *gorm.DB, orderID string, tags []string) ([]string, error) {
+	existing := []string{}
+	if rsp := tx.Model(&OrderTag{}).Where("order_id = ?", orderID).Pluck("tag", &existing); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+
+	tagged := map[string]bool{}
+	for _, tag := range existing {
+		tagged[tag] = true
+	}
+	added := []string{}
+	for _, tag := range NormalizeTags(tags) {
+		if tagged[tag] {
+			continue
+		}
+		if rsp := tx.Create(&OrderTag{OrderID: orderID, Tag: tag}); rsp.Error != nil {
+			return nil, rsp.Error
+		}
+		added = append(added, tag)
+	}
+	return added, nil
+}
@@ -0,0 +1,66 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// PaymentMethod is a payment method stored with a payment provider, e.g. a card
+// attached to a Stripe customer, that can be reused for future payments.
+type PaymentMethod struct {
+	ID string `json:"id"`
+
+	User   *User  `json:"-"`
+	UserID string `json:"user_id"`
+
+	Provider string `json:"provider"`
+
+	// ProviderCustomerID identifies the customer with the provider.
+	ProviderCustomerID string `json:"-"`
+	// ProviderToken is the provider's reference to the stored payment method.
+	ProviderToken string `json:"-"`
+
+	Type     string `json:"type"`
+	Brand    string `json:"brand,omitempty"`
+	Last4    string `json:"last4,omitempty"`
+	ExpMonth uint64 `json:"exp_month,omitempty"`
+	ExpYear  uint64 `json:"exp_year,omitempty"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at"`
+}
+
+// TableName returns the table name used for the PaymentMethod model
+func (PaymentMethod) TableName() string {
+	return tableName("payment_methods")
+}
+
+// GetPaymentMethod returns the payment method of the user with the given ID or nil if there is none.
+func GetPaymentMethod(db *gorm.DB, userID, id string) (*PaymentMethod, error) {
+	method := &PaymentMethod{}
+	if rsp := db.Where("id = ? AND user_id = ?", id, userID).First(method); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, rsp.Error
+	}
+	return method, nil
+}
+
+// FindProviderCustomerID returns the customer ID the user already has with the provider, if any.
+func FindProviderCustomerID(db *gorm.DB, userID, provider string) (string, error) {
+	method := &PaymentMethod{}
+	rsp := db.Unscoped().
+		Where("user_id = ? AND provider = ? AND provider_customer_id <> ''", userID, provider).
+		Order("created_at desc").
+		First(method)
+	if rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return "", nil
+		}
+		return "", rsp.Error
+	}
+	return method.ProviderCustomerID, nil
+}
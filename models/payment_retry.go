@@ -0,0 +1,107 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// PaymentRetryPendingState is the state of a payment retry with attempts left
+const PaymentRetryPendingState = "pending"
+
+// PaymentRetrySucceededState is the state of a payment retry whose order has been paid
+const PaymentRetrySucceededState = "succeeded"
+
+// PaymentRetryFailedState is the state of a payment retry without any attempts left
+const PaymentRetryFailedState = "failed"
+
+// PaymentRetryCanceledState is the state of a payment retry whose subscription has been canceled
+const PaymentRetryCanceledState = "canceled"
+
+// PaymentRetry is an entry of the dunning queue. It retries the payment of an
+// order after a failed payment on a backoff schedule.
+type PaymentRetry struct {
+	InstanceID string `json:"-" sql:"index"`
+	ID         string `json:"id"`
+
+	Order          *Order `json:"-"`
+	OrderID        string `json:"order_id" sql:"index"`
+	SubscriptionID string `json:"subscription_id,omitempty"`
+	UserID         string `json:"user_id,omitempty"`
+
+	// Attempts counts the retries made so far.
+	Attempts  uint64 `json:"attempts"`
+	Status    string `json:"status"`
+	LastError string `json:"last_error,omitempty" sql:"type:text"`
+
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty" sql:"index"`
+	// FailedAt is the time of the failed payment the schedule is relative to.
+	FailedAt time.Time `json:"failed_at"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName returns the database table name for the PaymentRetry model.
+func (PaymentRetry) TableName() string {
+	return tableName("payment_retries")
+}
+
+// NewPaymentRetry returns a new pending payment retry for an order whose
+// payment failed with reason. The first attempt is due after schedule[0].
+func NewPaymentRetry(order *Order, reason string, schedule []time.Duration) *PaymentRetry {
+	retry := &PaymentRetry{
+		InstanceID:     order.InstanceID,
+		ID:             uuid.NewRandom().String(),
+		OrderID:        order.ID,
+		SubscriptionID: order.SubscriptionID,
+		UserID:         order.UserID,
+		Status:         PaymentRetryPendingState,
+		LastError:      reason,
+		FailedAt:       time.Now(),
+	}
+	retry.Schedule(schedule)
+	return retry
+}
+
+// Schedule sets the time of the next attempt according to schedule. It
+// reports whether there are attempts left.
+func (r *PaymentRetry) Schedule(schedule []time.Duration) bool {
+	if r.Attempts >= uint64(len(schedule)) {
+		r.NextAttemptAt = nil
+		return false
+	}
+	next := r.FailedAt.Add(schedule[r.Attempts])
+	r.NextAttemptAt = &next
+	return true
+}
+
+// ClaimPaymentRetry counts the next attempt of a pending retry, so concurrent
+// retriers can't make the same attempt twice. It reports whether the attempt
+// has been claimed.
+func ClaimPaymentRetry(db *gorm.DB, r *PaymentRetry) (bool, error) {
+	rsp := db.Model(&PaymentRetry{}).
+		Where("id = ? AND status = ? AND attempts = ?", r.ID, PaymentRetryPendingState, r.Attempts).
+		UpdateColumn("attempts", r.Attempts+1)
+	if rsp.Error != nil {
+		return false, rsp.Error
+	}
+	if rsp.RowsAffected == 0 {
+		return false, nil
+	}
+	r.Attempts++
+	return true, nil
+}
+
+// FindPendingPaymentRetry returns the pending payment retry of the order or nil if there is none.
+func FindPendingPaymentRetry(db *gorm.DB, orderID string) (*PaymentRetry, error) {
+	retry := &PaymentRetry{}
+	if rsp := db.Where("order_id = ? AND status = ?", orderID, PaymentRetryPendingState).First(retry); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, rsp.Error
+	}
+	return retry, nil
+}
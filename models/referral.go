@@ -0,0 +1,105 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// referralCodeLength is the length of generated referral codes.
+const referralCodeLength = 8
+
+// ReferralCode is the code a user shares to refer new customers.
+type ReferralCode struct {
+	ID         int64  `json:"-"`
+	InstanceID string `json:"-" sql:"unique_index:idx_referral_code_user"`
+	UserID     string `json:"user_id" sql:"unique_index:idx_referral_code_user"`
+	Code       string `json:"code" sql:"unique_index"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the ReferralCode model.
+func (ReferralCode) TableName() string {
+	return tableName("referral_codes")
+}
+
+// Referral attributes an order created with a referral code to the user the
+// code belongs to. The referrer is rewarded once the order is paid, and the
+// reward is reversed if it's refunded.
+type Referral struct {
+	InstanceID string `json:"-" sql:"index"`
+	ID         string `json:"id"`
+
+	Code       string `json:"code"`
+	ReferrerID string `json:"referrer_id" sql:"index"`
+	OrderID    string `json:"order_id" sql:"unique_index"`
+	Email      string `json:"email"`
+
+	// Reward is the kind of reward given to the referrer, and RewardReference
+	// the store credit transaction or coupon code it was given as.
+	Reward          string     `json:"reward,omitempty"`
+	RewardReference string     `json:"reward_reference,omitempty"`
+	RewardedAt      *time.Time `json:"rewarded_at,omitempty"`
+	// ReversedAt is set when the reward was taken back because the order
+	// was refunded.
+	ReversedAt *time.Time `json:"reversed_at,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the Referral model.
+func (Referral) TableName() string {
+	return tableName("referrals")
+}
+
+// NewReferral returns a new referral of the order to the owner of the code.
+func NewReferral(code *ReferralCode, order *Order) *Referral {
+	return &Referral{
+		InstanceID: order.InstanceID,
+		ID:         uuid.NewRandom().String(),
+		Code:       code.Code,
+		ReferrerID: code.UserID,
+		OrderID:    order.ID,
+		Email:      order.Email,
+	}
+}
+
+// ReferralCodeForUser returns the referral code of the user, generating one
+// the first time it is asked for.
+func ReferralCodeForUser(tx *gorm.DB, instanceID, userID string) (*ReferralCode, error) {
+	code := &ReferralCode{}
+	rsp := tx.Where("instance_id = ? AND user_id = ?", instanceID, userID).First(code)
+	if rsp.Error == nil {
+		return code, nil
+	}
+	if !rsp.RecordNotFound() {
+		return nil, rsp.Error
+	}
+
+	generated, err := GenerateCode(referralCodeLength)
+	if err != nil {
+		return nil, err
+	}
+	code = &ReferralCode{InstanceID: instanceID, UserID: userID, Code: generated}
+	if err := tx.Create(code).Error; err != nil {
+		return nil, err
+	}
+	return code, nil
+}
+
+// FindReferralCode returns the referral code with the code, or nil if there
+// is none.
+func FindReferralCode(db *gorm.DB, instanceID, code string) (*ReferralCode, error) {
+	referral := &ReferralCode{}
+	rsp := db.Where("instance_id = ? AND code = ?", instanceID, strings.ToUpper(code)).First(referral)
+	if rsp.RecordNotFound() {
+		return nil, nil
+	}
+	if rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	return referral, nil
+}
@@ -0,0 +1,120 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// ReportRunRunning is the status of a run that's claimed by a scheduler
+// exporting its report.
+const ReportRunRunning = "running"
+
+// ReportRunSucceeded is the status of a run that delivered its report to all
+// destinations.
+const ReportRunSucceeded = "succeeded"
+
+// ReportRunFailed is the status of a run that failed to build or deliver its
+// report.
+const ReportRunFailed = "failed"
+
+// reportRunLockTimeout is how long a run stays claimed by a scheduler that
+// may have stopped before it's claimed again.
+const reportRunLockTimeout = 15 * time.Minute
+
+// ReportRun exports the report of a schedule for a period. There's one run
+// per period, which is retried until it delivered the report to each
+// destination of the schedule.
+type ReportRun struct {
+	InstanceID string `json:"-" sql:"unique_index:idx_report_run"`
+	ID         string `json:"id"`
+
+	Schedule    string    `json:"schedule" sql:"unique_index:idx_report_run"`
+	Report      string    `json:"report"`
+	PeriodStart time.Time `json:"period_start" sql:"unique_index:idx_report_run"`
+	PeriodEnd   time.Time `json:"period_end"`
+	Attempts    int       `json:"attempts"`
+
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty" sql:"type:text"`
+	// Rows is the number of rows of the exported report.
+	Rows int `json:"rows"`
+
+	// The times the report was delivered to the destinations of the
+	// schedule, which aren't delivered to again when the run is retried.
+	EmailedAt  *time.Time `json:"emailed_at,omitempty"`
+	PostedAt   *time.Time `json:"posted_at,omitempty"`
+	UploadedAt *time.Time `json:"uploaded_at,omitempty"`
+
+	LockedAt  *time.Time `json:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// TableName returns the database table name for the ReportRun model.
+func (ReportRun) TableName() string {
+	return tableName("report_runs")
+}
+
+// ClaimReportRun claims the run of the schedule for the period starting at
+// start for another attempt, creating it on the first one. It returns nil if
+// the run succeeded, was tried maxAttempts times or is claimed by another
+// scheduler. The unique index of the period makes a concurrent first attempt
+// fail to be created.
+func ClaimReportRun(db *gorm.DB, instanceID, schedule, report string, start, end time.Time, maxAttempts int) (*ReportRun, error) {
+	now := time.Now()
+	run := &ReportRun{}
+	rsp := db.Where("instance_id = ? AND schedule = ? AND period_start = ?", instanceID, schedule, start).First(run)
+	if rsp.RecordNotFound() {
+		run = &ReportRun{
+			InstanceID:  instanceID,
+			ID:          uuid.NewRandom().String(),
+			Schedule:    schedule,
+			Report:      report,
+			PeriodStart: start,
+			PeriodEnd:   end,
+			Attempts:    1,
+			Status:      ReportRunRunning,
+			LockedAt:    &now,
+		}
+		if rsp := db.Create(run); rsp.Error != nil {
+			var created int
+			if db.Model(&ReportRun{}).Where("instance_id = ? AND schedule = ? AND period_start = ?", instanceID, schedule, start).Count(&created); created > 0 {
+				return nil, nil
+			}
+			return nil, rsp.Error
+		}
+		return run, nil
+	}
+	if rsp.Error != nil {
+		return nil, rsp.Error
+	}
+
+	rsp = db.Model(&ReportRun{}).
+		Where("id = ? AND attempts = ? AND attempts < ?", run.ID, run.Attempts, maxAttempts).
+		Where("status = ? OR (status = ? AND locked_at < ?)", ReportRunFailed, ReportRunRunning, now.Add(-reportRunLockTimeout)).
+		UpdateColumns(map[string]interface{}{"status": ReportRunRunning, "attempts": run.Attempts + 1, "locked_at": now})
+	if rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	if rsp.RowsAffected == 0 {
+		return nil, nil
+	}
+	run.Status = ReportRunRunning
+	run.Attempts++
+	run.LockedAt = &now
+	return run, nil
+}
+
+// Complete records the outcome of the attempt of the run and releases it.
+func (r *ReportRun) Complete(db *gorm.DB, err error) error {
+	r.Status = ReportRunSucceeded
+	r.Error = ""
+	if err != nil {
+		r.Status = ReportRunFailed
+		r.Error = err.Error()
+	}
+	r.LockedAt = nil
+	return db.Save(r).Error
+}
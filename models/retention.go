@@ -0,0 +1,149 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// anonymizedAddress is written over the personal data of the addresses of
+// anonymized orders. The country and state are kept for tax reporting.
+var anonymizedAddress = map[string]interface{}{
+	"name":       "",
+	"company":    "",
+	"address1":   "",
+	"address2":   "",
+	"city":       "",
+	"zip":        "",
+	"first_name": "",
+	"last_name":  "",
+	"latitude":   0,
+	"longitude":  0,
+}
+
+// AnonymizeOrder removes the personal data of the order and its addresses
+// while keeping its amounts and tax data. Addresses that are still used by
+// orders placed after the cutoff are left untouched.
+func AnonymizeOrder(tx *gorm.DB, order *Order, cutoff time.Time) error {
+	if err := anonymizeOrderData(tx, order); err != nil {
+		return err
+	}
+
+	for _, addressID := range []string{order.ShippingAddressID, order.BillingAddressID} {
+		if addressID == "" {
+			continue
+		}
+		var inUse int
+		rsp := tx.Model(&Order{}).
+			Where("(shipping_address_id = ? OR billing_address_id = ?) AND created_at >= ?", addressID, addressID, cutoff).
+			Count(&inUse)
+		if rsp.Error != nil {
+			return rsp.Error
+		}
+		if inUse > 0 {
+			continue
+		}
+		if rsp := tx.Model(&Address{}).Where("id = ?", addressID).Updates(anonymizedAddress); rsp.Error != nil {
+			return rsp.Error
+		}
+	}
+	return nil
+}
+
+// AnonymizeUser erases the personal data of a user on their request: their
+// name, email and tax exemption certificate, their data exports, all of their
+// addresses and the personal data of their orders, which are anonymized like
+// those past the retention period and lose their VAT numbers and exemption
+// certificates. The amounts, taxes and invoice numbers of the orders are
+// kept. It returns the anonymized orders.
+func AnonymizeUser(tx *gorm.DB, user *User) ([]*Order, error) {
+	now := time.Now()
+	rsp := tx.Model(&User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+		"email":                     "",
+		"name":                      "",
+		"tax_exemption_certificate": "",
+		"anonymized_at":             now,
+	})
+	if rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	user.Email = ""
+	user.Name = ""
+	user.TaxExemptionCertificate = ""
+	user.AnonymizedAt = &now
+	if rsp := tx.Delete(UserExport{}, "user_id = ?", user.ID); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+
+	orders := []*Order{}
+	if rsp := tx.Where("user_id = ?", user.ID).Find(&orders); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	addressIDs := []string{}
+	for _, order := range orders {
+		if err := anonymizeOrderData(tx, order); err != nil {
+			return nil, err
+		}
+		addressIDs = append(addressIDs, order.ShippingAddressID, order.BillingAddressID)
+	}
+	rsp = tx.Model(&Order{}).Where("user_id = ?", user.ID).Updates(map[string]interface{}{
+		"vat_number":                "",
+		"vat_company":               "",
+		"vat_address":               "",
+		"tax_exemption_certificate": "",
+	})
+	if rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	rsp = tx.Model(&Address{}).Where("user_id = ? OR id IN (?)", user.ID, addressIDs).Updates(anonymizedAddress)
+	if rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	return orders, nil
+}
+
+// anonymizeOrderData removes the email, IP and session of the order, deletes
+// its events, notes and carts, and clears the IPs of its downloads, the
+// reasons of its returns and the payloads of its webhooks.
+func anonymizeOrderData(tx *gorm.DB, order *Order) error {
+	now := time.Now()
+	rsp := tx.Model(&Order{}).Where("id = ? AND anonymized_at IS NULL", order.ID).Updates(map[string]interface{}{
+		"email":         "",
+		"ip":            "",
+		"session_id":    "",
+		"anonymized_at": now,
+	})
+	if rsp.Error != nil {
+		return rsp.Error
+	}
+	order.Email = ""
+	order.IP = ""
+	order.SessionID = ""
+	if order.AnonymizedAt == nil {
+		order.AnonymizedAt = &now
+	}
+
+	if rsp := tx.Model(&DownloadLog{}).Where("order_id = ?", order.ID).Update("ip", ""); rsp.Error != nil {
+		return rsp.Error
+	}
+	if rsp := tx.Model(&Return{}).Where("order_id = ?", order.ID).Update("reason", ""); rsp.Error != nil {
+		return rsp.Error
+	}
+	// webhooks that haven't been delivered yet aren't sent without their payload
+	rsp = tx.Model(&Hook{}).Where("order_id = ?", order.ID).Updates(map[string]interface{}{
+		"payload":          "",
+		"response_headers": "",
+		"response_body":    "",
+		"done":             true,
+	})
+	if rsp.Error != nil {
+		return rsp.Error
+	}
+	if rsp := tx.Unscoped().Delete(OrderNote{}, "order_id = ?", order.ID); rsp.Error != nil {
+		return rsp.Error
+	}
+	if rsp := tx.Delete(Cart{}, "order_id = ?", order.ID); rsp.Error != nil {
+		return rsp.Error
+	}
+	return tx.Delete(Event{}, "order_id = ?", order.ID).Error
+}
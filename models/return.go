@@ -0,0 +1,149 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// ReturnRequestedState is the state of a return awaiting the decision of an admin
+const ReturnRequestedState = "requested"
+
+// ReturnProcessingState is the state of a return whose approval is being
+// refunded
+const ReturnProcessingState = "processing"
+
+// ReturnApprovedState is the state of an approved return whose items have been refunded
+const ReturnApprovedState = "approved"
+
+// ReturnRejectedState is the state of a return that has been rejected
+const ReturnRejectedState = "rejected"
+
+// Return is a request to send back line items of a paid order. Approving it
+// refunds the returned items.
+type Return struct {
+	InstanceID string `json:"-" sql:"index"`
+	ID         string `json:"id"`
+	OrderID    string `json:"order_id" sql:"index"`
+	UserID     string `json:"user_id,omitempty"`
+
+	Reason string        `json:"reason" sql:"type:text"`
+	Items  []*ReturnItem `json:"items" gorm:"foreignkey:ReturnID"`
+
+	// Amount is the amount refunded for the returned items, RefundedAmount
+	// the part of it that has already been refunded with the provider.
+	Amount         uint64 `json:"amount"`
+	RefundedAmount uint64 `json:"refunded_amount"`
+	Currency       string `json:"currency"`
+
+	Status string `json:"status"`
+	// Resolution is the comment of the admin who approved or rejected the return.
+	Resolution string `json:"resolution,omitempty" sql:"type:text"`
+
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// TableName returns the database table name for the Return model.
+func (Return) TableName() string {
+	return tableName("returns")
+}
+
+// ReturnItem is a line item sent back with a return.
+type ReturnItem struct {
+	ID         int64  `json:"id"`
+	ReturnID   string `json:"-" sql:"index"`
+	LineItemID int64  `json:"line_item_id"`
+	Sku        string `json:"sku"`
+
+	Quantity uint64 `json:"quantity"`
+	// Amount is the amount paid for the returned quantity of the line item.
+	Amount uint64 `json:"amount"`
+	// Restock marks returned goods that go back into stock.
+	Restock bool `json:"restock"`
+}
+
+// TableName returns the database table name for the ReturnItem model.
+func (ReturnItem) TableName() string {
+	return tableName("return_items")
+}
+
+// NewReturn returns a new return request for the order.
+func NewReturn(order *Order, reason string) *Return {
+	return &Return{
+		InstanceID: order.InstanceID,
+		ID:         uuid.NewRandom().String(),
+		OrderID:    order.ID,
+		UserID:     order.UserID,
+		Reason:     reason,
+		Currency:   order.Currency,
+		Status:     ReturnRequestedState,
+	}
+}
+
+// AddItem adds the quantity of the line item to the return.
+func (r *Return) AddItem(item *LineItem, quantity uint64) {
+	price := item.Price + item.AddonPrice
+	if item.CalculationDetail != nil && item.CalculationDetail.Total > 0 {
+		price = uint64(item.CalculationDetail.Total)
+	}
+	returned := &ReturnItem{
+		LineItemID: item.ID,
+		Sku:        item.Sku,
+		Quantity:   quantity,
+		Amount:     price * quantity,
+	}
+	r.Items = append(r.Items, returned)
+	r.Amount += returned.Amount
+}
+
+// Resolve marks the return as approved or rejected.
+func (r *Return) Resolve(status, resolution string) {
+	now := time.Now()
+	r.Status = status
+	r.Resolution = resolution
+	r.ResolvedAt = &now
+}
+
+// ReturnedQuantities sums up the quantities of the line items of an order that
+// are returned with requested, processing or approved returns, keyed by line
+// item ID.
+func ReturnedQuantities(db *gorm.DB, orderID string) (map[int64]uint64, error) {
+	returnsTable := db.NewScope(Return{}).QuotedTableName()
+	itemsTable := db.NewScope(ReturnItem{}).QuotedTableName()
+	rows, err := db.Model(&ReturnItem{}).
+		Select(itemsTable+".line_item_id, sum("+itemsTable+".quantity)").
+		Joins("JOIN "+returnsTable+" ON "+returnsTable+".id = "+itemsTable+".return_id").
+		Where(returnsTable+".order_id = ? AND "+returnsTable+".status IN (?)", orderID, []string{ReturnRequestedState, ReturnProcessingState, ReturnApprovedState}).
+		Group(itemsTable + ".line_item_id").
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	quantities := map[int64]uint64{}
+	for rows.Next() {
+		var id int64
+		var quantity uint64
+		if err := rows.Scan(&id, &quantity); err != nil {
+			return nil, err
+		}
+		quantities[id] = quantity
+	}
+	return quantities, nil
+}
+
+// GetReturn returns the return with the given ID or nil if there is none.
+func GetReturn(db *gorm.DB, id string) (*Return, error) {
+	ret := &Return{ID: id}
+	if rsp := db.Preload("Items").First(ret); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, rsp.Error
+	}
+	return ret, nil
+}
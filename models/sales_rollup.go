@@ -0,0 +1,207 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// SalesRollup sums up the paid orders of an instance created on a day, in
+// UTC, per currency. Test and archived orders are rolled up separately, as
+// the sales report filters them.
+type SalesRollup struct {
+	ID         int64     `json:"-"`
+	InstanceID string    `json:"-" sql:"unique_index:idx_sales_rollup"`
+	Day        time.Time `json:"day" sql:"unique_index:idx_sales_rollup"`
+	Currency   string    `json:"currency" sql:"unique_index:idx_sales_rollup"`
+	Test       bool      `json:"test" sql:"unique_index:idx_sales_rollup"`
+	Archived   bool      `json:"archived" sql:"unique_index:idx_sales_rollup"`
+
+	Orders   uint64 `json:"orders"`
+	Total    uint64 `json:"total"`
+	SubTotal uint64 `json:"subtotal"`
+	Taxes    uint64 `json:"taxes"`
+	Fees     uint64 `json:"fees"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the SalesRollup model.
+func (SalesRollup) TableName() string {
+	return tableName("sales_rollups")
+}
+
+// SalesRollupState tracks the rollups of an instance: the days before
+// RolledUpTo are rolled up, and orders updated after LastRunAt haven't been
+// rolled up again yet.
+type SalesRollupState struct {
+	ID         int64  `json:"-"`
+	InstanceID string `json:"-" sql:"unique_index"`
+
+	RolledUpTo time.Time `json:"rolled_up_to"`
+	LastRunAt  time.Time `json:"last_run_at"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName returns the database table name for the SalesRollupState model.
+func (SalesRollupState) TableName() string {
+	return tableName("sales_rollup_states")
+}
+
+// RollupDay returns the start of the day of the time in UTC.
+func RollupDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// FindSalesRollupState returns the rollup state of the instance, or nil if
+// its sales haven't been rolled up yet.
+func FindSalesRollupState(db *gorm.DB, instanceID string) (*SalesRollupState, error) {
+	state := &SalesRollupState{}
+	rsp := db.First(state, "instance_id = ?", instanceID)
+	if rsp.RecordNotFound() {
+		return nil, nil
+	}
+	if rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	return state, nil
+}
+
+// RollupSalesDay replaces the rollups of the instance for the day with the
+// sums of its paid orders and the fees of their charges.
+func RollupSalesDay(tx *gorm.DB, instanceID string, day time.Time) error {
+	day = RollupDay(day)
+	next := day.Add(24 * time.Hour)
+	if rsp := tx.Delete(&SalesRollup{}, "instance_id = ? AND day = ?", instanceID, day); rsp.Error != nil {
+		return rsp.Error
+	}
+
+	ordersTable := tx.NewScope(Order{}).QuotedTableName()
+	transactionsTable := tx.NewScope(Transaction{}).QuotedTableName()
+	archived := "CASE WHEN " + ordersTable + ".archived_at IS NULL THEN 0 ELSE 1 END"
+	type rollupKey struct {
+		currency string
+		test     bool
+		archived bool
+	}
+	rollups := map[rollupKey]*SalesRollup{}
+	keys := []rollupKey{}
+
+	rows, err := tx.Model(&Order{}).
+		Select("currency, test, "+archived+" AS archived, count(*), sum(total), sum(sub_total), sum(taxes)").
+		Where("payment_state = ? AND instance_id = ? AND created_at >= ? AND created_at < ?", PaidState, instanceID, day, next).
+		Group("currency, test, " + archived).
+		Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		rollup := &SalesRollup{InstanceID: instanceID, Day: day}
+		var isArchived int
+		if err := rows.Scan(&rollup.Currency, &rollup.Test, &isArchived, &rollup.Orders, &rollup.Total, &rollup.SubTotal, &rollup.Taxes); err != nil {
+			return err
+		}
+		rollup.Archived = isArchived == 1
+		key := rollupKey{rollup.Currency, rollup.Test, rollup.Archived}
+		rollups[key] = rollup
+		keys = append(keys, key)
+	}
+
+	fees, err := tx.Model(&Transaction{}).
+		Select(ordersTable+".currency, "+ordersTable+".test, "+archived+" AS archived, sum("+transactionsTable+".fee)").
+		Joins("JOIN "+ordersTable+" ON "+ordersTable+".id = "+transactionsTable+".order_id").
+		Where(ordersTable+".payment_state = ? AND "+ordersTable+".instance_id = ?", PaidState, instanceID).
+		Where(ordersTable+".created_at >= ? AND "+ordersTable+".created_at < ?", day, next).
+		Where(transactionsTable+".type = ?", ChargeTransactionType).
+		Group(ordersTable + ".currency, " + ordersTable + ".test, " + archived).
+		Rows()
+	if err != nil {
+		return err
+	}
+	defer fees.Close()
+	for fees.Next() {
+		var key rollupKey
+		var isArchived int
+		var fee uint64
+		if err := fees.Scan(&key.currency, &key.test, &isArchived, &fee); err != nil {
+			return err
+		}
+		key.archived = isArchived == 1
+		if rollup, ok := rollups[key]; ok {
+			rollup.Fees = fee
+		}
+	}
+
+	for _, key := range keys {
+		if rsp := tx.Create(rollups[key]); rsp.Error != nil {
+			return rsp.Error
+		}
+	}
+	return nil
+}
+
+// RollupSales rolls up the days of the instance from the one of the first
+// order, or the last rolled up day, to the day before now, along with the
+// days of orders updated since the last run. The first run of a day also
+// rolls up the days within refresh again, to pick up changes that didn't
+// update their orders, like the fees of their charges.
+func RollupSales(db *gorm.DB, instanceID string, now time.Time, refresh time.Duration) (*SalesRollupState, error) {
+	state, err := FindSalesRollupState(db, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	today := RollupDay(now)
+	days := map[time.Time]bool{}
+
+	if state == nil {
+		state = &SalesRollupState{InstanceID: instanceID}
+		first := &Order{}
+		rsp := db.Select("created_at").Where("instance_id = ?", instanceID).Order("created_at").First(first)
+		if rsp.Error != nil && !rsp.RecordNotFound() {
+			return nil, rsp.Error
+		}
+		state.RolledUpTo = today
+		if !rsp.RecordNotFound() {
+			state.RolledUpTo = RollupDay(first.CreatedAt)
+		}
+	} else {
+		updated := []time.Time{}
+		rsp := db.Unscoped().Model(&Order{}).
+			Where("instance_id = ? AND updated_at >= ? AND created_at < ?", instanceID, state.LastRunAt, state.RolledUpTo).
+			Pluck("created_at", &updated)
+		if rsp.Error != nil {
+			return nil, rsp.Error
+		}
+		for _, t := range updated {
+			days[RollupDay(t)] = true
+		}
+	}
+
+	for day := RollupDay(state.RolledUpTo); day.Before(today); day = day.Add(24 * time.Hour) {
+		days[day] = true
+	}
+	if refresh > 0 && RollupDay(state.LastRunAt).Before(today) {
+		for day := RollupDay(now.Add(-refresh)); day.Before(today) && day.Before(state.RolledUpTo); day = day.Add(24 * time.Hour) {
+			days[day] = true
+		}
+	}
+
+	tx := db.Begin()
+	for day := range days {
+		if err := RollupSalesDay(tx, instanceID, day); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if today.After(state.RolledUpTo) {
+		state.RolledUpTo = today
+	}
+	state.LastRunAt = now
+	if rsp := tx.Save(state); rsp.Error != nil {
+		tx.Rollback()
+		return nil, rsp.Error
+	}
+	return state, tx.Commit().Error
+}
@@ -0,0 +1,157 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// Shipment is a parcel sent for an order. An order can be shipped with
+// multiple shipments, each containing some of its line items.
+type Shipment struct {
+	InstanceID string `json:"-" sql:"index"`
+	ID         string `json:"id"`
+	OrderID    string `json:"order_id" sql:"index"`
+
+	Carrier        string `json:"carrier"`
+	TrackingNumber string `json:"tracking_number"`
+	TrackingURL    string `json:"tracking_url,omitempty"`
+
+	// Location is the stock location the shipment is sent from, the default
+	// location if it's empty.
+	Location string `json:"location,omitempty"`
+
+	// TrackerID references the tracker of the tracking backend following the
+	// shipment, which updates its Status.
+	TrackerID    string     `json:"-"`
+	Status       string     `json:"status,omitempty"`
+	StatusDetail string     `json:"status_detail,omitempty"`
+	DeliveredAt  *time.Time `json:"delivered_at,omitempty"`
+
+	// LabelURL is the shipping label bought for the shipment, which cost
+	// LabelCost in the lowest unit of the LabelCurrency.
+	LabelURL      string `json:"label_url,omitempty"`
+	LabelCost     uint64 `json:"label_cost,omitempty"`
+	LabelCurrency string `json:"label_currency,omitempty"`
+	// LabelClaimedAt is set while a label is being bought for the shipment,
+	// so it's only bought once.
+	LabelClaimedAt *time.Time `json:"-"`
+
+	Items []*ShipmentItem `json:"items" gorm:"foreignkey:ShipmentID"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName returns the database table name for the Shipment model.
+func (Shipment) TableName() string {
+	return tableName("shipments")
+}
+
+// ShipmentItem is the shipped quantity of a line item.
+type ShipmentItem struct {
+	ID         int64  `json:"id"`
+	ShipmentID string `json:"-" sql:"index"`
+	LineItemID int64  `json:"line_item_id"`
+	Sku        string `json:"sku"`
+	Quantity   uint64 `json:"quantity"`
+}
+
+// TableName returns the database table name for the ShipmentItem model.
+func (ShipmentItem) TableName() string {
+	return tableName("shipment_items")
+}
+
+// NewShipment returns a new shipment for the order.
+func NewShipment(order *Order, carrier, trackingNumber, trackingURL string) *Shipment {
+	return &Shipment{
+		InstanceID:     order.InstanceID,
+		ID:             uuid.NewRandom().String(),
+		OrderID:        order.ID,
+		Carrier:        carrier,
+		TrackingNumber: trackingNumber,
+		TrackingURL:    trackingURL,
+	}
+}
+
+// AddItem adds the quantity of the line item to the shipment.
+func (s *Shipment) AddItem(item *LineItem, quantity uint64) {
+	s.Items = append(s.Items, &ShipmentItem{
+		LineItemID: item.ID,
+		Sku:        item.Sku,
+		Quantity:   quantity,
+	})
+}
+
+// ShippedQuantities sums up the quantities of the line items of an order that
+// have been shipped, keyed by line item ID.
+func ShippedQuantities(db *gorm.DB, orderID string) (map[int64]uint64, error) {
+	shipmentsTable := db.NewScope(Shipment{}).QuotedTableName()
+	itemsTable := db.NewScope(ShipmentItem{}).QuotedTableName()
+	rows, err := db.Model(&ShipmentItem{}).
+		Select(itemsTable+".line_item_id, sum("+itemsTable+".quantity)").
+		Joins("JOIN "+shipmentsTable+" ON "+shipmentsTable+".id = "+itemsTable+".shipment_id").
+		Where(shipmentsTable+".order_id = ?", orderID).
+		Group(itemsTable + ".line_item_id").
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	quantities := map[int64]uint64{}
+	for rows.Next() {
+		var id int64
+		var quantity uint64
+		if err := rows.Scan(&id, &quantity); err != nil {
+			return nil, err
+		}
+		quantities[id] = quantity
+	}
+	return quantities, nil
+}
+
+// Delivered returns whether the carrier delivered the shipment.
+func (s *Shipment) Delivered() bool {
+	return s.DeliveredAt != nil
+}
+
+// DeliveredStateFor returns the fulfillment state of an order whose shipments
+// have been delivered: delivered once it has been shipped completely and all
+// shipments have been delivered, its current state otherwise.
+func (o *Order) DeliveredStateFor(shipments []*Shipment) string {
+	if o.FulfillmentState != ShippedState || len(shipments) == 0 {
+		return o.FulfillmentState
+	}
+	for _, shipment := range shipments {
+		if !shipment.Delivered() {
+			return o.FulfillmentState
+		}
+	}
+	return DeliveredState
+}
+
+// FulfillmentStateFor returns the fulfillment state of an order with the
+// given shipped quantities: shipped once all line items have been shipped
+// completely, shipping once anything has been shipped.
+func (o *Order) FulfillmentStateFor(shipped map[int64]uint64) string {
+	complete := true
+	started := false
+	for _, item := range o.LineItems {
+		if shipped[item.ID] > 0 {
+			started = true
+		}
+		if shipped[item.ID] < item.Quantity {
+			complete = false
+		}
+	}
+	switch {
+	case complete && started:
+		return ShippedState
+	case started:
+		return ShippingState
+	default:
+		return PendingState
+	}
+}
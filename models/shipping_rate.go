@@ -0,0 +1,56 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ShippingRate is a live rate a carrier of the shipping backend quoted for a
+// parcel of Weight grams shipping to the Country and Zip. It's stored when the
+// rates of a cart are listed so it can be picked at checkout until it expires.
+type ShippingRate struct {
+	ID         uint64
+	InstanceID string `sql:"index"`
+	RateID     string `sql:"index"`
+
+	Provider     string
+	Carrier      string
+	Service      string
+	Name         string
+	Amount       uint64
+	Currency     string
+	DeliveryDays int
+
+	Country string
+	Zip     string
+	Weight  uint64
+
+	CreatedAt time.Time
+	ExpiresAt time.Time `sql:"index"`
+}
+
+// TableName returns the database table name for the ShippingRate model.
+func (ShippingRate) TableName() string {
+	return tableName("shipping_rates")
+}
+
+// GetShippingRate returns the live rate with the ID quoted for the instance,
+// or nil if there is none or it has expired.
+func GetShippingRate(db *gorm.DB, instanceID, rateID string) (*ShippingRate, error) {
+	rate := &ShippingRate{}
+	rsp := db.Where("instance_id = ? AND rate_id = ? AND expires_at > ?", instanceID, rateID, time.Now()).Last(rate)
+	if rsp.RecordNotFound() {
+		return nil, nil
+	}
+	if rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	return rate, nil
+}
+
+// DeleteExpiredShippingRates deletes the live rates that can't be picked
+// anymore.
+func DeleteExpiredShippingRates(db *gorm.DB) error {
+	return db.Where("expires_at <= ?", time.Now()).Delete(&ShippingRate{}).Error
+}
@@ -0,0 +1,490 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// StockLocation is a warehouse products are stocked at and shipped from.
+type StockLocation struct {
+	InstanceID string `json:"-" sql:"index"`
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Country    string `json:"country"`
+	Zip        string `json:"zip"`
+	State      string `json:"state,omitempty"`
+	City       string `json:"city"`
+	Street     string `json:"street"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName returns the database table name for the StockLocation model.
+func (StockLocation) TableName() string {
+	return tableName("stock_locations")
+}
+
+// StockItem is the quantity of a product in stock at a stock location, by
+// SKU. Items without a Location are stocked at the default location, the
+// address orders ship from. Products without a stock item aren't tracked and
+// never run out of stock.
+type StockItem struct {
+	InstanceID string `json:"-" sql:"index"`
+	ID         int64  `json:"-"`
+	Sku        string `json:"sku" sql:"index"`
+	Location   string `json:"location,omitempty"`
+	Quantity   uint64 `json:"quantity"`
+
+	// LowStockThreshold is the quantity below which the product is low on
+	// stock, LowStockAlertedAt when it was last alerted about.
+	LowStockThreshold uint64     `json:"low_stock_threshold"`
+	LowStockAlertedAt *time.Time `json:"low_stock_alerted_at,omitempty"`
+
+	// Reserved is the quantity of the product held by unpaid orders at all
+	// locations, filled in for listings.
+	Reserved uint64 `json:"reserved" sql:"-"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName returns the database table name for the StockItem model.
+func (StockItem) TableName() string {
+	return tableName("stock_items")
+}
+
+// Threshold returns the low stock threshold of the item, or the default
+// threshold if it doesn't set one.
+func (i *StockItem) Threshold(defaultThreshold uint64) uint64 {
+	if i.LowStockThreshold == 0 {
+		return defaultThreshold
+	}
+	return i.LowStockThreshold
+}
+
+// LowStock returns whether the quantity in stock is below the threshold of the
+// item.
+func (i *StockItem) LowStock(defaultThreshold uint64) bool {
+	return i.Quantity < i.Threshold(defaultThreshold)
+}
+
+// StockReservation holds a quantity of a tracked product for an unpaid order
+// until it expires.
+type StockReservation struct {
+	InstanceID string    `json:"-" sql:"index"`
+	ID         int64     `json:"id"`
+	OrderID    string    `json:"order_id" sql:"index"`
+	Sku        string    `json:"sku"`
+	Quantity   uint64    `json:"quantity"`
+	ExpiresAt  time.Time `json:"expires_at" sql:"index"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the StockReservation model.
+func (StockReservation) TableName() string {
+	return tableName("stock_reservations")
+}
+
+// StockAllocation is a quantity of a product taken out of stock at a
+// location for a paid order, of which Shipped have been shipped.
+type StockAllocation struct {
+	InstanceID string    `json:"-" sql:"index"`
+	ID         int64     `json:"id"`
+	OrderID    string    `json:"order_id" sql:"index"`
+	Sku        string    `json:"sku"`
+	Location   string    `json:"location,omitempty"`
+	Quantity   uint64    `json:"quantity"`
+	Shipped    uint64    `json:"shipped"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the StockAllocation model.
+func (StockAllocation) TableName() string {
+	return tableName("stock_allocations")
+}
+
+// OutOfStockError is returned when an order asks for more of a product than
+// is available.
+type OutOfStockError struct {
+	Sku       string
+	Available uint64
+}
+
+func (e *OutOfStockError) Error() string {
+	return fmt.Sprintf("Only %d of %s are in stock", e.Available, e.Sku)
+}
+
+// ReservedStock sums up the quantities of the SKUs held by reservations that
+// haven't expired, leaving out those of the order.
+func ReservedStock(tx *gorm.DB, instanceID string, skus []string, exceptOrderID string, now time.Time) (map[string]uint64, error) {
+	rows, err := tx.Model(&StockReservation{}).
+		Select("sku, sum(quantity)").
+		Where("instance_id = ? AND sku IN (?) AND order_id <> ? AND expires_at > ?", instanceID, skus, exceptOrderID, now).
+		Group("sku").
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reserved := map[string]uint64{}
+	for rows.Next() {
+		var sku string
+		var quantity uint64
+		if err := rows.Scan(&sku, &quantity); err != nil {
+			return nil, err
+		}
+		reserved[sku] = quantity
+	}
+	return reserved, rows.Err()
+}
+
+// orderQuantities sums up the quantities of the line items of an order by SKU,
+// keeping the SKUs in the order of the line items.
+func orderQuantities(items []*LineItem) ([]string, map[string]uint64) {
+	quantities := map[string]uint64{}
+	skus := []string{}
+	for _, item := range items {
+		if _, ok := quantities[item.Sku]; !ok {
+			skus = append(skus, item.Sku)
+		}
+		quantities[item.Sku] += item.Quantity
+	}
+	return skus, quantities
+}
+
+// lockStock touches the stock items of the SKUs, so concurrent transactions
+// reserving or taking out the same products wait for each other instead of
+// all counting on the same stock.
+func lockStock(tx *gorm.DB, instanceID string, skus []string, now time.Time) ([]*StockItem, error) {
+	rsp := tx.Model(&StockItem{}).Where("instance_id = ? AND sku IN (?)", instanceID, skus).UpdateColumn("updated_at", now)
+	if rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	stock := []*StockItem{}
+	if rsp := tx.Where("instance_id = ? AND sku IN (?)", instanceID, skus).Order("location").Find(&stock); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	return stock, nil
+}
+
+// ReserveStock replaces the stock reservations of an order by new ones for
+// the tracked products of its line items, held until the TTL passes. It
+// returns an OutOfStockError if the stock that isn't reserved for other orders
+// doesn't cover a line item.
+func ReserveStock(tx *gorm.DB, order *Order, ttl time.Duration) error {
+	skus, quantities := orderQuantities(order.LineItems)
+	if len(skus) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	stock, err := lockStock(tx, order.InstanceID, skus, now)
+	if err != nil {
+		return err
+	}
+	if len(stock) == 0 {
+		return nil
+	}
+	reserved, err := ReservedStock(tx, order.InstanceID, skus, order.ID, now)
+	if err != nil {
+		return err
+	}
+
+	if rsp := tx.Where("order_id = ?", order.ID).Delete(&StockReservation{}); rsp.Error != nil {
+		return rsp.Error
+	}
+	inStock := map[string]uint64{}
+	for _, item := range stock {
+		inStock[item.Sku] += item.Quantity
+	}
+	for _, sku := range skus {
+		quantity, tracked := inStock[sku]
+		if !tracked {
+			continue
+		}
+		var available uint64
+		if quantity > reserved[sku] {
+			available = quantity - reserved[sku]
+		}
+		if quantities[sku] > available {
+			return &OutOfStockError{Sku: sku, Available: available}
+		}
+		reservation := &StockReservation{
+			InstanceID: order.InstanceID,
+			OrderID:    order.ID,
+			Sku:        sku,
+			Quantity:   quantities[sku],
+			ExpiresAt:  now.Add(ttl),
+		}
+		if rsp := tx.Create(reservation); rsp.Error != nil {
+			return rsp.Error
+		}
+	}
+	return nil
+}
+
+// CommitStockReservations takes the tracked products of the line items of a
+// paid order out of stock and removes its reservations. The line items are
+// taken out whether their reservation is still held or not. Those the stock
+// doesn't cover anymore are oversold: what's left of them is taken out and an
+// OutOfStockError is returned for each of them, as the payment has been made
+// already. It returns the SKUs taken out of stock.
+func CommitStockReservations(tx *gorm.DB, order *Order) ([]string, []*OutOfStockError, error) {
+	items := []*LineItem{}
+	if rsp := tx.Where("order_id = ?", order.ID).Find(&items); rsp.Error != nil {
+		return nil, nil, rsp.Error
+	}
+	skus, quantities := orderQuantities(items)
+	if len(skus) == 0 {
+		return nil, nil, ReleaseStockReservations(tx, order.ID)
+	}
+	stock, err := lockStock(tx, order.InstanceID, skus, time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bySku := map[string][]*StockItem{}
+	for _, item := range stock {
+		bySku[item.Sku] = append(bySku[item.Sku], item)
+	}
+	committed := []string{}
+	oversold := []*OutOfStockError{}
+	for _, sku := range skus {
+		items, tracked := bySku[sku]
+		if !tracked {
+			continue
+		}
+		short, err := allocateStock(tx, order, sku, quantities[sku], items)
+		if err != nil {
+			return nil, nil, err
+		}
+		if short != nil {
+			oversold = append(oversold, short)
+		}
+		committed = append(committed, sku)
+	}
+	return committed, oversold, ReleaseStockReservations(tx, order.ID)
+}
+
+// allocateStock takes the quantity of a product out of the stock of the
+// locations stocking it. A single location stocking all of it is preferred,
+// the default location first. Otherwise it's split across the locations with
+// the most stock. Stock is only taken out where it's still there, so if it
+// doesn't cover the quantity, what's left is taken out and an
+// OutOfStockError with the quantity taken out is returned.
+func allocateStock(tx *gorm.DB, order *Order, sku string, quantity uint64, stock []*StockItem) (*OutOfStockError, error) {
+	remaining := quantity
+	sort.SliceStable(stock, func(i, j int) bool {
+		covers := stock[i].Quantity >= remaining
+		if covers != (stock[j].Quantity >= remaining) {
+			return covers
+		}
+		return !covers && stock[i].Quantity > stock[j].Quantity
+	})
+
+	for _, item := range stock {
+		quantity := remaining
+		if item.Quantity < quantity {
+			quantity = item.Quantity
+		}
+		if quantity == 0 {
+			continue
+		}
+		rsp := tx.Model(&StockItem{}).
+			Where("id = ? AND quantity >= ?", item.ID, quantity).
+			Update("quantity", gorm.Expr("quantity - ?", quantity))
+		if rsp.Error != nil {
+			return nil, rsp.Error
+		}
+		if rsp.RowsAffected == 0 {
+			continue
+		}
+		allocation := &StockAllocation{
+			InstanceID: order.InstanceID,
+			OrderID:    order.ID,
+			Sku:        sku,
+			Location:   item.Location,
+			Quantity:   quantity,
+		}
+		if rsp := tx.Create(allocation); rsp.Error != nil {
+			return nil, rsp.Error
+		}
+		remaining -= quantity
+		if remaining == 0 {
+			break
+		}
+	}
+	if remaining > 0 {
+		return &OutOfStockError{Sku: sku, Available: quantity - remaining}, nil
+	}
+	return nil, nil
+}
+
+// ShipFromLocation records the items of a shipment as shipped from its
+// location. Items of the order that were taken out of stock at other
+// locations are moved to the location of the shipment, returning them to the
+// stock of their location. It returns an OutOfStockError if the location of
+// the shipment doesn't stock the moved items, and the SKUs of the moved items
+// otherwise.
+func ShipFromLocation(tx *gorm.DB, shipment *Shipment) ([]string, error) {
+	quantities := map[string]uint64{}
+	skus := []string{}
+	for _, item := range shipment.Items {
+		if _, ok := quantities[item.Sku]; !ok {
+			skus = append(skus, item.Sku)
+		}
+		quantities[item.Sku] += item.Quantity
+	}
+
+	moved := []string{}
+	for _, sku := range skus {
+		allocations := []*StockAllocation{}
+		if rsp := tx.Where("order_id = ? AND sku = ? AND quantity > shipped", shipment.OrderID, sku).Order("id").Find(&allocations); rsp.Error != nil {
+			return nil, rsp.Error
+		}
+
+		remaining := quantities[sku]
+		for _, allocation := range allocations {
+			if allocation.Location != shipment.Location || remaining == 0 {
+				continue
+			}
+			quantity := allocation.shippable(remaining)
+			if rsp := tx.Model(allocation).UpdateColumn("shipped", allocation.Shipped+quantity); rsp.Error != nil {
+				return nil, rsp.Error
+			}
+			remaining -= quantity
+		}
+
+		var move uint64
+		for _, allocation := range allocations {
+			if allocation.Location == shipment.Location || remaining == 0 {
+				continue
+			}
+			quantity := allocation.shippable(remaining)
+			if rsp := tx.Model(allocation).UpdateColumn("quantity", allocation.Quantity-quantity); rsp.Error != nil {
+				return nil, rsp.Error
+			}
+			rsp := tx.Model(&StockItem{}).
+				Where("instance_id = ? AND sku = ? AND location = ?", allocation.InstanceID, sku, allocation.Location).
+				Update("quantity", gorm.Expr("quantity + ?", quantity))
+			if rsp.Error != nil {
+				return nil, rsp.Error
+			}
+			remaining -= quantity
+			move += quantity
+		}
+		if move == 0 {
+			continue
+		}
+
+		rsp := tx.Model(&StockItem{}).
+			Where("instance_id = ? AND sku = ? AND location = ? AND quantity >= ?", shipment.InstanceID, sku, shipment.Location, move).
+			Update("quantity", gorm.Expr("quantity - ?", move))
+		if rsp.Error != nil {
+			return nil, rsp.Error
+		}
+		if rsp.RowsAffected == 0 {
+			item := &StockItem{}
+			tx.Where("instance_id = ? AND sku = ? AND location = ?", shipment.InstanceID, sku, shipment.Location).First(item)
+			return nil, &OutOfStockError{Sku: sku, Available: item.Quantity}
+		}
+		allocation := &StockAllocation{
+			InstanceID: shipment.InstanceID,
+			OrderID:    shipment.OrderID,
+			Sku:        sku,
+			Location:   shipment.Location,
+			Quantity:   move,
+			Shipped:    move,
+		}
+		if rsp := tx.Create(allocation); rsp.Error != nil {
+			return nil, rsp.Error
+		}
+		moved = append(moved, sku)
+	}
+	return moved, nil
+}
+
+// shippable returns the part of the quantity the allocation has left to ship.
+func (a *StockAllocation) shippable(quantity uint64) uint64 {
+	if left := a.Quantity - a.Shipped; left < quantity {
+		return left
+	}
+	return quantity
+}
+
+// ReturnStockAllocations puts the items a cancelled order took out of stock
+// and hasn't shipped back into the stock of their locations. It returns the
+// SKUs put back.
+func ReturnStockAllocations(tx *gorm.DB, orderID string) ([]string, error) {
+	allocations := []*StockAllocation{}
+	if rsp := tx.Where("order_id = ? AND quantity > shipped", orderID).Order("id").Find(&allocations); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+
+	returned := []string{}
+	seen := map[string]bool{}
+	for _, allocation := range allocations {
+		rsp := tx.Model(&StockItem{}).
+			Where("instance_id = ? AND sku = ? AND location = ?", allocation.InstanceID, allocation.Sku, allocation.Location).
+			Update("quantity", gorm.Expr("quantity + ?", allocation.Quantity-allocation.Shipped))
+		if rsp.Error != nil {
+			return nil, rsp.Error
+		}
+		if allocation.Shipped == 0 {
+			rsp = tx.Delete(allocation)
+		} else {
+			rsp = tx.Model(allocation).UpdateColumn("quantity", allocation.Shipped)
+		}
+		if rsp.Error != nil {
+			return nil, rsp.Error
+		}
+		if !seen[allocation.Sku] {
+			seen[allocation.Sku] = true
+			returned = append(returned, allocation.Sku)
+		}
+	}
+	return returned, nil
+}
+
+// ReleaseStockReservations removes the stock reservations of an order that
+// won't be paid, making the stock available again.
+func ReleaseStockReservations(tx *gorm.DB, orderID string) error {
+	return tx.Where("order_id = ?", orderID).Delete(&StockReservation{}).Error
+}
+
+// DeleteExpiredStockReservations removes the reservations that expired before
+// now. Expired reservations don't hold any stock anymore.
+func DeleteExpiredStockReservations(db *gorm.DB, now time.Time) error {
+	return db.Where("expires_at <= ?", now).Delete(&StockReservation{}).Error
+}
+
+// MarkLowStock marks the stock items of the SKUs that are low on stock and
+// returns those that weren't marked yet. Items that are back at or above their
+// threshold are unmarked, so they are alerted about again when they run low.
+func MarkLowStock(tx *gorm.DB, instanceID string, skus []string, defaultThreshold uint64, now time.Time) ([]*StockItem, error) {
+	stock := []*StockItem{}
+	if rsp := tx.Where("instance_id = ? AND sku IN (?)", instanceID, skus).Find(&stock); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+
+	low := []*StockItem{}
+	for _, item := range stock {
+		switch {
+		case item.LowStock(defaultThreshold) && item.LowStockAlertedAt == nil:
+			item.LowStockAlertedAt = &now
+			low = append(low, item)
+		case !item.LowStock(defaultThreshold) && item.LowStockAlertedAt != nil:
+			item.LowStockAlertedAt = nil
+		default:
+			continue
+		}
+		if rsp := tx.Model(item).UpdateColumn("low_stock_alerted_at", item.LowStockAlertedAt); rsp.Error != nil {
+			return nil, rsp.Error
+		}
+	}
+	return low, nil
+}
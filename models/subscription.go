@@ -0,0 +1,309 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// SubscriptionActiveState is the state of a subscription that renews automatically
+const SubscriptionActiveState = "active"
+
+// SubscriptionPausedState is the state of a subscription whose renewals are on hold
+const SubscriptionPausedState = "paused"
+
+// SubscriptionPastDueState is the state of a subscription whose last renewal couldn't be charged yet
+const SubscriptionPastDueState = "past_due"
+
+// SubscriptionFailedState is the state of a subscription whose renewal couldn't be charged after all retries
+const SubscriptionFailedState = "failed"
+
+// SubscriptionCanceledState is the state of a subscription that has been canceled
+const SubscriptionCanceledState = "canceled"
+
+// DayInterval | WeekInterval | MonthInterval | YearInterval are the supported
+// billing intervals of a subscription
+const (
+	DayInterval   = "day"
+	WeekInterval  = "week"
+	MonthInterval = "month"
+	YearInterval  = "year"
+)
+
+// SubscriptionIntervals are the possible values for the Interval field
+var SubscriptionIntervals = []string{
+	DayInterval,
+	WeekInterval,
+	MonthInterval,
+	YearInterval,
+}
+
+// Subscription renews an order every billing interval by creating a renewal
+// order with the same line items and charging a saved payment method for it.
+type Subscription struct {
+	InstanceID string `json:"-" sql:"index"`
+	ID         string `json:"id"`
+
+	User   *User  `json:"-"`
+	UserID string `json:"user_id" sql:"index"`
+
+	// OrderID references the initial order whose line items are renewed.
+	Order   *Order `json:"-"`
+	OrderID string `json:"order_id"`
+	// LastOrderID references the order created by the latest renewal.
+	LastOrderID string `json:"last_order_id,omitempty"`
+
+	PaymentMethod   *PaymentMethod `json:"-"`
+	PaymentMethodID string         `json:"payment_method_id"`
+
+	Plan          string `json:"plan"`
+	Interval      string `json:"interval"`
+	IntervalCount uint64 `json:"interval_count"`
+
+	Amount   uint64 `json:"amount"`
+	Currency string `json:"currency"`
+
+	// MeteredSkus are the SKUs of line items that are billed by the usage
+	// reported during the billing interval rather than their ordered quantity.
+	MeteredSkus    []string `json:"metered_skus,omitempty" sql:"-"`
+	RawMeteredSkus string   `json:"-" sql:"type:text"`
+
+	Status string `json:"status"`
+
+	NextRenewalAt time.Time  `json:"next_renewal_at" sql:"index"`
+	PausedAt      *time.Time `json:"paused_at,omitempty"`
+	CanceledAt    *time.Time `json:"canceled_at,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName returns the database table name for the Subscription model.
+func (Subscription) TableName() string {
+	return tableName("subscriptions")
+}
+
+// AfterFind database callback.
+func (s *Subscription) AfterFind() error {
+	if s.RawMeteredSkus != "" {
+		return json.Unmarshal([]byte(s.RawMeteredSkus), &s.MeteredSkus)
+	}
+	return nil
+}
+
+// BeforeSave database callback.
+func (s *Subscription) BeforeSave() error {
+	if s.MeteredSkus != nil {
+		data, err := json.Marshal(s.MeteredSkus)
+		if err != nil {
+			return err
+		}
+		s.RawMeteredSkus = string(data)
+	}
+	return nil
+}
+
+// NewSubscription returns a new active subscription renewing the order. The
+// first renewal is due one billing interval from now.
+func NewSubscription(order *Order, paymentMethodID, plan, interval string, intervalCount uint64) *Subscription {
+	if intervalCount == 0 {
+		intervalCount = 1
+	}
+	sub := &Subscription{
+		InstanceID:      order.InstanceID,
+		ID:              uuid.NewRandom().String(),
+		UserID:          order.UserID,
+		OrderID:         order.ID,
+		PaymentMethodID: paymentMethodID,
+		Plan:            plan,
+		Interval:        interval,
+		IntervalCount:   intervalCount,
+		Amount:          order.Total,
+		Currency:        order.Currency,
+		Status:          SubscriptionActiveState,
+	}
+	sub.NextRenewalAt = sub.RenewalAfter(time.Now())
+	return sub
+}
+
+// ValidInterval reports whether interval is a supported billing interval.
+func ValidInterval(interval string) bool {
+	for _, i := range SubscriptionIntervals {
+		if i == interval {
+			return true
+		}
+	}
+	return false
+}
+
+// Metered reports whether line items with the SKU are billed by usage.
+func (s *Subscription) Metered(sku string) bool {
+	for _, metered := range s.MeteredSkus {
+		if metered == sku {
+			return true
+		}
+	}
+	return false
+}
+
+// RenewalAfter returns the time one billing interval after t.
+func (s *Subscription) RenewalAfter(t time.Time) time.Time {
+	count := int(s.IntervalCount)
+	switch s.Interval {
+	case DayInterval:
+		return t.AddDate(0, 0, count)
+	case WeekInterval:
+		return t.AddDate(0, 0, 7*count)
+	case YearInterval:
+		return t.AddDate(count, 0, 0)
+	default:
+		return t.AddDate(0, count, 0)
+	}
+}
+
+// NextRenewal returns when the subscription renews after the renewal that is
+// due. Renewals missed e.g. during downtime are skipped rather than charged at
+// once.
+func (s *Subscription) NextRenewal(now time.Time) time.Time {
+	next := s.RenewalAfter(s.NextRenewalAt)
+	if next.Before(now) {
+		next = s.RenewalAfter(now)
+	}
+	return next
+}
+
+// Renewed records a successful renewal with the order. The next renewal has
+// been scheduled when the renewal was claimed, renewals that fell due since,
+// e.g. while the payment was retried, are skipped.
+func (s *Subscription) Renewed(orderID string, now time.Time) {
+	s.LastOrderID = orderID
+	if s.NextRenewalAt.Before(now) {
+		s.NextRenewalAt = s.RenewalAfter(now)
+	}
+}
+
+// ClaimRenewal schedules the next renewal of the subscription if its renewal
+// is still due, so concurrent renewers can't renew it twice. It reports
+// whether the renewal has been claimed.
+func ClaimRenewal(db *gorm.DB, s *Subscription, now time.Time) (bool, error) {
+	next := s.NextRenewal(now)
+	rsp := db.Model(&Subscription{}).
+		Where("id = ? AND status = ? AND next_renewal_at <= ?", s.ID, SubscriptionActiveState, now).
+		UpdateColumn("next_renewal_at", next)
+	if rsp.Error != nil {
+		return false, rsp.Error
+	}
+	if rsp.RowsAffected == 0 {
+		return false, nil
+	}
+	s.NextRenewalAt = next
+	return true, nil
+}
+
+// NewRenewalOrder returns a new pending order for the next billing interval of
+// the subscription, copying the line items and addresses of order. The totals
+// are calculated again for the renewal, and coupons are only kept while they
+// are valid and not limited in their uses.
+func NewRenewalOrder(s *Subscription, order *Order) *Order {
+	renewal := NewOrder(order.InstanceID, order.SessionID, order.Email, order.Currency)
+	renewal.IP = order.IP
+	renewal.UserID = order.UserID
+	renewal.SubscriptionID = s.ID
+	renewal.Test = order.Test
+	renewal.ShippingMethod = order.ShippingMethod
+	renewal.ShippingProvider = order.ShippingProvider
+	if order.ShippingProvider != "" {
+		// live rates are kept at the amount quoted
+		renewal.Shipping = order.Shipping
+	}
+	renewal.PickupLocation = order.PickupLocation
+	renewal.ShippingAddress = order.ShippingAddress
+	renewal.ShippingAddressID = order.ShippingAddressID
+	renewal.BillingAddress = order.BillingAddress
+	renewal.BillingAddressID = order.BillingAddressID
+	renewal.VATNumber = order.VATNumber
+	renewal.VATCountry = order.VATCountry
+	renewal.VATCompany = order.VATCompany
+	renewal.VATAddress = order.VATAddress
+	renewal.VATValidatedAt = order.VATValidatedAt
+	renewal.TaxExempt = order.TaxExempt
+	renewal.TaxExemptionCertificate = order.TaxExemptionCertificate
+	renewal.CustomerGroup = order.CustomerGroup
+	renewal.MetaData = order.MetaData
+
+	for _, coupon := range order.Coupons {
+		if renewableCoupon(coupon) {
+			renewal.Coupons = append(renewal.Coupons, coupon)
+		}
+	}
+	if len(renewal.Coupons) > 0 {
+		renewal.Coupon = renewal.Coupons[0]
+	} else if len(order.Coupons) == 0 && renewableCoupon(order.Coupon) {
+		renewal.Coupon = order.Coupon
+	}
+	if renewal.Coupon != nil {
+		renewal.CouponCode = renewal.Coupon.Code
+	}
+
+	for _, item := range order.LineItems {
+		copied := *item
+		copied.ID = 0
+		copied.OrderID = renewal.ID
+		copied.PriceItems = nil
+		copied.AddonItems = nil
+		copied.CalculationDetail = nil
+		renewal.LineItems = append(renewal.LineItems, &copied)
+	}
+	return renewal
+}
+
+// renewableCoupon reports whether the coupon of an order applies to its
+// renewals as well. Coupons limited in their uses have been redeemed by the
+// order already.
+func renewableCoupon(coupon *Coupon) bool {
+	return coupon != nil && coupon.Valid() && coupon.MaxUses == 0 && coupon.MaxUsesPerUser == 0
+}
+
+// BillUsage sets the quantity of the metered line items of a renewal order to
+// the usage billed for their SKU, before the totals of the order are
+// calculated. Metered line items without usage are removed from the order.
+func (s *Subscription) BillUsage(renewal *Order, usage map[string]uint64) {
+	items := []*LineItem{}
+	for _, item := range renewal.LineItems {
+		if !s.Metered(item.Sku) {
+			items = append(items, item)
+			continue
+		}
+		if quantity := usage[item.Sku]; quantity > 0 {
+			item.Quantity = quantity
+			items = append(items, item)
+		}
+	}
+	renewal.LineItems = items
+}
+
+// GetSubscription returns the subscription of the user with the given ID or nil if there is none.
+func GetSubscription(db *gorm.DB, userID, id string) (*Subscription, error) {
+	sub := &Subscription{}
+	if rsp := db.Where("id = ? AND user_id = ?", id, userID).First(sub); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, rsp.Error
+	}
+	return sub, nil
+}
+
+// GetSubscriptionByID returns the subscription with the given ID or nil if there is none.
+func GetSubscriptionByID(db *gorm.DB, id string) (*Subscription, error) {
+	sub := &Subscription{}
+	if rsp := db.Where("id = ?", id).First(sub); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, rsp.Error
+	}
+	return sub, nil
+}
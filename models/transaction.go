@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/jinzhu/gorm"
@@ -22,12 +23,21 @@ type Transaction struct {
 	InvoiceNumber int64  `json:"invoice_number"`
 
 	ProcessorID string `json:"processor_id"`
+	// CaptureID is the ID the provider settles the charge under when it differs
+	// from the processor ID, like the sale of a PayPal payment.
+	CaptureID string `json:"capture_id,omitempty"`
+	// Provider is the payment provider that processed the transaction.
+	Provider string `json:"provider,omitempty"`
 
 	User   *User  `json:"-"`
 	UserID string `json:"user_id,omitempty"`
 
 	Amount   uint64 `json:"amount"`
 	Currency string `json:"currency"`
+	// Fee is the processing fee the payment provider charged, if it's known.
+	Fee uint64 `json:"fee"`
+	// Test is set for payments made with the test keys of a provider.
+	Test bool `json:"test"`
 
 	FailureCode        string `json:"failure_code,omitempty"`
 	FailureDescription string `json:"failure_description,omitempty" sql:"type:text"`
@@ -35,10 +45,23 @@ type Transaction struct {
 	Status string `json:"status"`
 	Type   string `json:"type"`
 
+	// ParentID references the charge transaction a refund belongs to.
+	ParentID       string         `json:"parent_id,omitempty"`
+	RefundedAmount uint64         `json:"refunded_amount"`
+	Refunds        []*Transaction `json:"refunds,omitempty" gorm:"foreignkey:ParentID"`
+
+	Disputes []*Dispute `json:"disputes,omitempty" gorm:"foreignkey:TransactionID"`
+
+	// AuthorizedAmount is the amount held by an authorization that is captured
+	// later on, AuthorizationExpiresAt the time the provider releases the hold.
+	AuthorizedAmount       uint64     `json:"authorized_amount,omitempty"`
+	AuthorizationExpiresAt *time.Time `json:"authorization_expires_at,omitempty"`
+
 	CreatedAt time.Time  `json:"created_at"`
 	DeletedAt *time.Time `json:"-"`
 
-	ProviderMetadata map[string]interface{} `json:"provider_metadata,omitempty" sql:"-"`
+	ProviderMetadata    map[string]interface{} `json:"provider_metadata,omitempty" sql:"-"`
+	RawProviderMetadata string                 `json:"-" sql:"type:text"`
 }
 
 // TableName returns the database table name for the Transaction model.
@@ -46,6 +69,99 @@ func (Transaction) TableName() string {
 	return tableName("transactions")
 }
 
+// AfterFind database callback.
+func (t *Transaction) AfterFind() error {
+	if t.RawProviderMetadata != "" {
+		return json.Unmarshal([]byte(t.RawProviderMetadata), &t.ProviderMetadata)
+	}
+	return nil
+}
+
+// BeforeSave database callback.
+func (t *Transaction) BeforeSave() error {
+	if t.ProviderMetadata != nil {
+		data, err := json.Marshal(t.ProviderMetadata)
+		if err != nil {
+			return err
+		}
+		t.RawProviderMetadata = string(data)
+	}
+	return nil
+}
+
+// RefundableAmount returns the amount of the transaction that has not been refunded yet.
+func (t *Transaction) RefundableAmount() uint64 {
+	if t.RefundedAmount >= t.Amount {
+		return 0
+	}
+	return t.Amount - t.RefundedAmount
+}
+
+// SettledAmount returns the part of the order total settled by the transaction.
+// A partially captured authorization settles the whole authorized amount since
+// the rest has been released on purpose.
+func (t *Transaction) SettledAmount() uint64 {
+	if t.AuthorizedAmount > t.Amount {
+		return t.AuthorizedAmount
+	}
+	return t.Amount
+}
+
+// OrderSettledAmount returns the part of the order total settled by the paid
+// charge transactions of the order.
+func OrderSettledAmount(db *gorm.DB, orderID string) (uint64, error) {
+	charges := []*Transaction{}
+	if rsp := db.Where("order_id = ? AND type = ? AND status = ?", orderID, ChargeTransactionType, PaidState).Find(&charges); rsp.Error != nil {
+		return 0, rsp.Error
+	}
+
+	var settled uint64
+	for _, t := range charges {
+		settled += t.SettledAmount()
+	}
+	return settled, nil
+}
+
+// OrderPaidAt returns when the order was paid: when its first paid charge
+// was made, or when the order was created if it has none.
+func OrderPaidAt(db *gorm.DB, order *Order) (time.Time, error) {
+	charge := &Transaction{}
+	rsp := db.Where("order_id = ? AND type = ? AND status = ?", order.ID, ChargeTransactionType, PaidState).Order("created_at asc").First(charge)
+	if rsp.RecordNotFound() {
+		return order.CreatedAt, nil
+	}
+	if rsp.Error != nil {
+		return time.Time{}, rsp.Error
+	}
+	return charge.CreatedAt, nil
+}
+
+// IsAuthorization reports whether the transaction authorizes a payment that is captured separately.
+func (t *Transaction) IsAuthorization() bool {
+	return t.AuthorizationExpiresAt != nil
+}
+
+// AuthorizationExpired reports whether the authorization has been released by the provider.
+func (t *Transaction) AuthorizationExpired() bool {
+	return t.AuthorizationExpiresAt != nil && t.AuthorizationExpiresAt.Before(time.Now())
+}
+
+// NewRefund returns a new pending refund transaction for the given amount of the transaction.
+func NewRefund(t *Transaction, amount uint64) *Transaction {
+	return &Transaction{
+		InstanceID: t.InstanceID,
+		ID:         uuid.NewRandom().String(),
+		Amount:     amount,
+		Currency:   t.Currency,
+		UserID:     t.UserID,
+		OrderID:    t.OrderID,
+		ParentID:   t.ID,
+		Test:       t.Test,
+		Type:       RefundTransactionType,
+		Status:     PendingState,
+	}
+}
+
 // NewTransaction returns a new transaction for an order
 func NewTransaction(order *Order) *Transaction {
 	return &Transaction{
@@ -57,6 +173,7 @@ func NewTransaction(order *Order) *Transaction {
 		UserID:     order.UserID,
 		Currency:   order.Currency,
 		Amount:     order.Total,
+		Test:       order.Test,
 		Type:       ChargeTransactionType,
 	}
 }
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// UsageRecord is usage of a metered line item of a subscription reported
+// during a billing interval. It is billed with the next renewal order.
+type UsageRecord struct {
+	InstanceID string `json:"-" sql:"index"`
+	ID         string `json:"id"`
+
+	Subscription   *Subscription `json:"-"`
+	SubscriptionID string        `json:"subscription_id" sql:"index"`
+
+	Sku      string `json:"sku"`
+	Quantity uint64 `json:"quantity"`
+
+	// OrderID references the renewal order the usage has been billed with.
+	OrderID string `json:"order_id,omitempty" sql:"index"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the UsageRecord model.
+func (UsageRecord) TableName() string {
+	return tableName("usage_records")
+}
+
+// NewUsageRecord returns a new unbilled usage record for a metered line item of the subscription.
+func NewUsageRecord(sub *Subscription, sku string, quantity uint64) *UsageRecord {
+	return &UsageRecord{
+		InstanceID:     sub.InstanceID,
+		ID:             uuid.NewRandom().String(),
+		SubscriptionID: sub.ID,
+		Sku:            sku,
+		Quantity:       quantity,
+	}
+}
+
+// BillUsage assigns the unbilled usage records of the subscription to the
+// renewal order and returns the billed quantity per SKU.
+func BillUsage(tx *gorm.DB, subscriptionID, orderID string) (map[string]uint64, error) {
+	rsp := tx.Model(&UsageRecord{}).
+		Where("subscription_id = ? AND (order_id = '' OR order_id IS NULL)", subscriptionID).
+		Update("order_id", orderID)
+	if rsp.Error != nil {
+		return nil, rsp.Error
+	}
+
+	rows, err := tx.Model(&UsageRecord{}).
+		Select("sku, sum(quantity) as quantity").
+		Where("subscription_id = ? AND order_id = ?", subscriptionID, orderID).
+		Group("sku").
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := map[string]uint64{}
+	for rows.Next() {
+		var sku string
+		var quantity uint64
+		if err := rows.Scan(&sku, &quantity); err != nil {
+			return nil, err
+		}
+		usage[sku] = quantity
+	}
+	return usage, rows.Err()
+}
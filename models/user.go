@@ -17,12 +17,28 @@ type User struct {
 	Email      string `json:"email"`
 	Name       string `json:"name"`
 
+	// TaxExempt users, like nonprofits and resellers, aren't charged taxes.
+	// TaxExemptionCertificate references their exemption certificate.
+	TaxExempt               bool   `json:"tax_exempt"`
+	TaxExemptionCertificate string `json:"tax_exemption_certificate,omitempty"`
+
+	// CustomerGroup is the name of the customer group the user is priced
+	// for, like wholesale or staff.
+	CustomerGroup string `json:"customer_group,omitempty"`
+
+	// AnonymizedAt is when the personal data of the user was erased on their
+	// request.
+	AnonymizedAt *time.Time `json:"anonymized_at,omitempty"`
+
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
 	DeletedAt *time.Time `json:"-"`
 
 	OrderCount  int64          `json:"order_count" gorm:"-"`
 	LastOrderAt *HackyNullTime `json:"last_order_at" gorm:"-"`
+
+	// Profile sums up the purchase history of the user for admins.
+	Profile *UserProfile `json:"profile,omitempty" gorm:"-"`
 }
 
 // @todo: replace with mysql.NullTime once the tests no longer use SQLite
@@ -107,10 +123,15 @@ func (u *User) BeforeDelete(tx *gorm.DB) error {
 	}
 
 	delModels := map[string]interface{}{
-		"address":     Address{},
-		"hook":        Hook{},
-		"transaction": Transaction{},
-		"order note":  OrderNote{},
+		"address":                  Address{},
+		"hook":                     Hook{},
+		"transaction":              Transaction{},
+		"order note":               OrderNote{},
+		"credit":                   CreditTransaction{},
+		"credit account":           CreditAccount{},
+		"referral code":            ReferralCode{},
+		"wishlist item":            WishlistItem{},
+		"notification preferences": NotificationPreferences{},
 	}
 	for name, dm := range delModels {
 		if result := tx.Delete(dm, "user_id = ?", u.ID); result.Error != nil {
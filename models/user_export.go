@@ -0,0 +1,100 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// UserExportPendingState is the state of an export that is still being built
+const UserExportPendingState = "pending"
+
+// UserExportReadyState is the state of an export that can be downloaded
+const UserExportReadyState = "ready"
+
+// UserExportFailedState is the state of an export that couldn't be built
+const UserExportFailedState = "failed"
+
+// UserData is the personal data of a user, as exported for them.
+type UserData struct {
+	ExportedAt   time.Time       `json:"exported_at"`
+	User         *User           `json:"user"`
+	Addresses    []*Address      `json:"addresses"`
+	Orders       []*Order        `json:"orders"`
+	Transactions []*Transaction  `json:"transactions"`
+	Downloads    []*Download     `json:"downloads"`
+	Events       []*Event        `json:"events"`
+	Wishlist     []*WishlistItem `json:"wishlist"`
+}
+
+// UserExport is an export of the personal data of a user built in the
+// background, for accounts too large to export within a request.
+type UserExport struct {
+	InstanceID string `json:"-" sql:"index"`
+	ID         string `json:"id"`
+	UserID     string `json:"user_id" sql:"index"`
+	State      string `json:"state"`
+
+	// Archive is the exported UserData as JSON, once the export is ready.
+	Archive string `json:"-" sql:"type:text"`
+	// DownloadURL is the signed link to the archive, filled in for responses.
+	DownloadURL string `json:"download_url,omitempty" sql:"-"`
+
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty" sql:"index"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// TableName returns the database table name for the UserExport model.
+func (UserExport) TableName() string {
+	return tableName("user_exports")
+}
+
+// NewUserExport returns a new pending export of the personal data of the
+// user.
+func NewUserExport(user *User) *UserExport {
+	return &UserExport{
+		InstanceID: user.InstanceID,
+		ID:         uuid.NewRandom().String(),
+		UserID:     user.ID,
+		State:      UserExportPendingState,
+	}
+}
+
+// CollectUserData loads the personal data of the user: their addresses,
+// orders with their line items, transactions, downloads, the events of their
+// orders and their wishlist.
+func CollectUserData(db *gorm.DB, user *User) (*UserData, error) {
+	data := &UserData{ExportedAt: time.Now(), User: user}
+	if rsp := db.Where("user_id = ?", user.ID).Find(&data.Addresses); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	if rsp := db.Preload("LineItems").Where("user_id = ?", user.ID).Order("created_at").Find(&data.Orders); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	if rsp := db.Where("user_id = ?", user.ID).Order("created_at").Find(&data.Transactions); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+
+	orderIDs := make([]string, 0, len(data.Orders))
+	for _, order := range data.Orders {
+		orderIDs = append(orderIDs, order.ID)
+	}
+	if rsp := db.Where("order_id IN (?)", orderIDs).Order("created_at").Find(&data.Downloads); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	if rsp := db.Where("user_id = ? OR order_id IN (?)", user.ID, orderIDs).Order("created_at").Find(&data.Events); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	if rsp := db.Where("user_id = ?", user.ID).Order("created_at").Find(&data.Wishlist); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	return data, nil
+}
+
+// DeleteExpiredUserExports removes the exports whose download links expired
+// before now.
+func DeleteExpiredUserExports(db *gorm.DB, now time.Time) error {
+	return db.Where("expires_at <= ?", now).Delete(&UserExport{}).Error
+}
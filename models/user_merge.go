@@ -0,0 +1,182 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// UserMerge lists the records of a duplicate account moved onto a user, or
+// that would be moved for a dry run.
+type UserMerge struct {
+	SourceID string `json:"source_id,omitempty"`
+	Email    string `json:"email,omitempty"`
+	DryRun   bool   `json:"dry_run"`
+
+	Orders       []string `json:"orders"`
+	Addresses    []string `json:"addresses"`
+	Transactions []string `json:"transactions"`
+	Downloads    []string `json:"downloads"`
+	Credits      []string `json:"credits"`
+
+	Subscriptions  []string `json:"subscriptions"`
+	PaymentMethods []string `json:"payment_methods"`
+	Referrals      []string `json:"referrals"`
+	// ReferralCode is the referral code of the source user moved onto the
+	// target, unless the target already has one.
+	ReferralCode string `json:"referral_code,omitempty"`
+}
+
+// MergeUser moves the orders, addresses, transactions, store credit,
+// subscriptions, payment methods and referrals of the user with the source
+// ID, and the guest orders placed with the email, onto the target user. The
+// downloads of the orders move along with them. The referral code of the
+// source user is moved if the target has none and dropped otherwise, and the
+// source user is deleted. A dry run only lists the records that would move.
+func MergeUser(tx *gorm.DB, target *User, sourceID, email string, dryRun bool) (*UserMerge, error) {
+	merge := &UserMerge{
+		SourceID:     sourceID,
+		Email:        email,
+		DryRun:       dryRun,
+		Orders:       []string{},
+		Addresses:    []string{},
+		Transactions: []string{},
+		Downloads:    []string{},
+		Credits:      []string{},
+
+		Subscriptions:  []string{},
+		PaymentMethods: []string{},
+		Referrals:      []string{},
+	}
+
+	orders := tx.Model(&Order{}).Where("instance_id = ?", target.InstanceID)
+	switch {
+	case sourceID != "" && email != "":
+		orders = orders.Where("user_id = ? OR ((user_id = '' OR user_id IS NULL) AND LOWER(email) = LOWER(?))", sourceID, email)
+	case sourceID != "":
+		orders = orders.Where("user_id = ?", sourceID)
+	default:
+		orders = orders.Where("(user_id = '' OR user_id IS NULL) AND LOWER(email) = LOWER(?)", email)
+	}
+	found := []*Order{}
+	if rsp := orders.Find(&found); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	addressIDs := []string{}
+	for _, order := range found {
+		merge.Orders = append(merge.Orders, order.ID)
+		addressIDs = append(addressIDs, order.BillingAddressID, order.ShippingAddressID)
+	}
+
+	// records of the source user, or of the merged orders, not already owned
+	// by the target
+	movable := func(column string, ids []string) *gorm.DB {
+		query := tx.Where("user_id <> ? OR user_id IS NULL", target.ID)
+		if sourceID == "" {
+			return query.Where(column+" IN (?)", ids)
+		}
+		return query.Where("user_id = ? OR "+column+" IN (?)", sourceID, ids)
+	}
+	if rsp := movable("id", addressIDs).Model(&Address{}).Pluck("id", &merge.Addresses); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	if rsp := movable("order_id", merge.Orders).Model(&Transaction{}).Pluck("id", &merge.Transactions); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	if rsp := tx.Model(&Download{}).Where("order_id IN (?)", merge.Orders).Pluck("id", &merge.Downloads); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	var code *ReferralCode
+	if sourceID != "" {
+		if rsp := tx.Model(&CreditTransaction{}).Where("user_id = ?", sourceID).Pluck("id", &merge.Credits); rsp.Error != nil {
+			return nil, rsp.Error
+		}
+		if rsp := tx.Model(&Subscription{}).Where("user_id = ?", sourceID).Pluck("id", &merge.Subscriptions); rsp.Error != nil {
+			return nil, rsp.Error
+		}
+		if rsp := tx.Model(&PaymentMethod{}).Where("user_id = ?", sourceID).Pluck("id", &merge.PaymentMethods); rsp.Error != nil {
+			return nil, rsp.Error
+		}
+		if rsp := tx.Model(&Referral{}).Where("referrer_id = ?", sourceID).Pluck("id", &merge.Referrals); rsp.Error != nil {
+			return nil, rsp.Error
+		}
+		var err error
+		if code, err = mergedReferralCode(tx, target, sourceID); err != nil {
+			return nil, err
+		}
+		if code != nil {
+			merge.ReferralCode = code.Code
+		}
+	}
+	if dryRun {
+		return merge, nil
+	}
+
+	moves := []struct {
+		model interface{}
+		ids   []string
+	}{
+		{&Order{}, merge.Orders},
+		{&Address{}, merge.Addresses},
+		{&Transaction{}, merge.Transactions},
+		{&CreditTransaction{}, merge.Credits},
+		{&Subscription{}, merge.Subscriptions},
+		{&PaymentMethod{}, merge.PaymentMethods},
+	}
+	for _, move := range moves {
+		if len(move.ids) == 0 {
+			continue
+		}
+		if rsp := tx.Model(move.model).Where("id IN (?)", move.ids).UpdateColumn("user_id", target.ID); rsp.Error != nil {
+			return nil, rsp.Error
+		}
+	}
+	if len(merge.Credits) > 0 {
+		// the accounts are created again from the merged ledger
+		if rsp := tx.Delete(CreditAccount{}, "user_id IN (?)", []string{sourceID, target.ID}); rsp.Error != nil {
+			return nil, rsp.Error
+		}
+	}
+	if sourceID == "" {
+		return merge, nil
+	}
+
+	if len(merge.Referrals) > 0 {
+		if rsp := tx.Model(&Referral{}).Where("id IN (?)", merge.Referrals).UpdateColumn("referrer_id", target.ID); rsp.Error != nil {
+			return nil, rsp.Error
+		}
+	}
+	if code != nil {
+		if rsp := tx.Model(code).UpdateColumn("user_id", target.ID); rsp.Error != nil {
+			return nil, rsp.Error
+		}
+	}
+	if rsp := tx.Delete(ReferralCode{}, "instance_id = ? AND user_id = ?", target.InstanceID, sourceID); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	// the duplicate account is deactivated like a deleted user
+	if rsp := tx.Delete(&User{}, "id = ? AND instance_id = ?", sourceID, target.InstanceID); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	return merge, nil
+}
+
+// mergedReferralCode returns the referral code of the source user that moves
+// onto the target, or nil if the source has none or the target already has
+// its own.
+func mergedReferralCode(tx *gorm.DB, target *User, sourceID string) (*ReferralCode, error) {
+	var own int
+	if rsp := tx.Model(&ReferralCode{}).Where("instance_id = ? AND user_id = ?", target.InstanceID, target.ID).Count(&own); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	if own > 0 {
+		return nil, nil
+	}
+	code := &ReferralCode{}
+	rsp := tx.Where("instance_id = ? AND user_id = ?", target.InstanceID, sourceID).First(code)
+	if rsp.RecordNotFound() {
+		return nil, nil
+	}
+	if rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	return code, nil
+}
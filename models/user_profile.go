@@ -0,0 +1,141 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// UserProfileTopSkus is the number of most purchased products in the profile
+// of a user.
+const UserProfileTopSkus = 5
+
+// UserProfile sums up the purchase history of a user for admins.
+type UserProfile struct {
+	// LifetimeValue is the total of the paid orders of the user less their
+	// refunds, per currency.
+	LifetimeValue []*LifetimeValue `json:"lifetime_value"`
+
+	OrderCount   int64      `json:"order_count"`
+	PaidOrders   int64      `json:"paid_orders"`
+	FirstOrderAt *time.Time `json:"first_order_at,omitempty"`
+	LastOrderAt  *time.Time `json:"last_order_at,omitempty"`
+
+	// RefundRate is the share of the paid orders of the user that were
+	// refunded, partially or completely.
+	RefundRate float64 `json:"refund_rate"`
+
+	TopSkus []*PurchasedSku `json:"top_skus"`
+}
+
+// LifetimeValue is the value of the orders of a user in a currency.
+type LifetimeValue struct {
+	Currency string `json:"currency"`
+	Total    uint64 `json:"total"`
+	Refunded uint64 `json:"refunded"`
+	Net      int64  `json:"net"`
+}
+
+// PurchasedSku is a product the user bought, with the quantity they bought
+// in paid orders.
+type PurchasedSku struct {
+	Sku      string `json:"sku"`
+	Quantity uint64 `json:"quantity"`
+}
+
+// LoadUserProfile computes the profile of the user with aggregate queries
+// over their orders, refunds and line items.
+func LoadUserProfile(db *gorm.DB, userID string) (*UserProfile, error) {
+	profile := &UserProfile{LifetimeValue: []*LifetimeValue{}, TopSkus: []*PurchasedSku{}}
+	ordersTable := db.NewScope(Order{}).QuotedTableName()
+	paidStates := []string{PaidState, RefundedState}
+
+	var first, last HackyNullTime
+	row := db.Model(&Order{}).
+		Select("COUNT(*), MIN(created_at), MAX(created_at)").
+		Where("user_id = ?", userID).
+		Row()
+	if err := row.Scan(&profile.OrderCount, &first, &last); err != nil {
+		return nil, err
+	}
+	if first.Valid {
+		profile.FirstOrderAt = &first.Time
+	}
+	if last.Valid {
+		profile.LastOrderAt = &last.Time
+	}
+
+	values := map[string]*LifetimeValue{}
+	rows, err := db.Model(&Order{}).
+		Select("currency, SUM(total), COUNT(*)").
+		Where("user_id = ? AND payment_state IN (?)", userID, paidStates).
+		Group("currency").
+		Order("currency").
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		value := &LifetimeValue{}
+		var orders int64
+		if err := rows.Scan(&value.Currency, &value.Total, &orders); err != nil {
+			return nil, err
+		}
+		profile.PaidOrders += orders
+		values[value.Currency] = value
+		profile.LifetimeValue = append(profile.LifetimeValue, value)
+	}
+
+	refunds, err := db.Model(&Transaction{}).
+		Select("currency, SUM(amount), COUNT(DISTINCT order_id)").
+		Where("user_id = ? AND type = ? AND status = ?", userID, RefundTransactionType, PaidState).
+		Group("currency").
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer refunds.Close()
+	var refundedOrders int64
+	for refunds.Next() {
+		var currency string
+		var amount uint64
+		var orders int64
+		if err := refunds.Scan(&currency, &amount, &orders); err != nil {
+			return nil, err
+		}
+		refundedOrders += orders
+		if value, ok := values[currency]; ok {
+			value.Refunded = amount
+		}
+	}
+	for _, value := range profile.LifetimeValue {
+		value.Net = int64(value.Total) - int64(value.Refunded)
+	}
+	if profile.PaidOrders > 0 {
+		profile.RefundRate = float64(refundedOrders) / float64(profile.PaidOrders)
+	}
+
+	itemsTable := db.NewScope(LineItem{}).QuotedTableName()
+	skus, err := db.Model(&LineItem{}).
+		Select(itemsTable+".sku, SUM("+itemsTable+".quantity) AS purchased").
+		Joins("JOIN "+ordersTable+" ON "+ordersTable+".id = "+itemsTable+".order_id").
+		Where(ordersTable+".user_id = ? AND "+ordersTable+".payment_state IN (?)", userID, paidStates).
+		Group(itemsTable + ".sku").
+		Order("purchased DESC").
+		Order(itemsTable + ".sku").
+		Limit(UserProfileTopSkus).
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer skus.Close()
+	for skus.Next() {
+		sku := &PurchasedSku{}
+		if err := skus.Scan(&sku.Sku, &sku.Quantity); err != nil {
+			return nil, err
+		}
+		profile.TopSkus = append(profile.TopSkus, sku)
+	}
+	return profile, nil
+}
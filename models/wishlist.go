@@ -0,0 +1,92 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// WishlistItem is a product a user saved for later, with the metadata of the
+// product at the time it was saved.
+type WishlistItem struct {
+	InstanceID string `json:"-" sql:"index"`
+	ID         string `json:"id"`
+	UserID     string `json:"user_id" sql:"index"`
+
+	Sku         string `json:"sku" sql:"index"`
+	Path        string `json:"path"`
+	Title       string `json:"title"`
+	Description string `json:"description" sql:"type:text"`
+	Type        string `json:"type"`
+
+	// NotifyInStock opts into an email once the product is back in stock,
+	// NotifiedAt is when it was sent.
+	NotifyInStock bool       `json:"notify_in_stock"`
+	NotifiedAt    *time.Time `json:"notified_at,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName returns the database table name for the WishlistItem model.
+func (WishlistItem) TableName() string {
+	return tableName("wishlist_items")
+}
+
+// NewWishlistItem returns a new wishlist item for the product of the
+// metadata.
+func NewWishlistItem(user *User, path string, meta *LineItemMetadata) *WishlistItem {
+	return &WishlistItem{
+		InstanceID:  user.InstanceID,
+		ID:          uuid.NewRandom().String(),
+		UserID:      user.ID,
+		Sku:         meta.Sku,
+		Path:        path,
+		Title:       meta.Title,
+		Description: meta.Description,
+		Type:        meta.Type,
+	}
+}
+
+// WishlistNotification is a back in stock notification for a wishlist item,
+// sent to the email of its user.
+type WishlistNotification struct {
+	Email string
+	Item  *WishlistItem
+}
+
+// MarkBackInStock marks the wishlist items of the SKU waiting for a back in
+// stock notification as notified and returns the notifications to send.
+func MarkBackInStock(tx *gorm.DB, instanceID, sku string, now time.Time) ([]*WishlistNotification, error) {
+	items := []*WishlistItem{}
+	rsp := tx.Where("instance_id = ? AND sku = ? AND notify_in_stock = ? AND notified_at IS NULL", instanceID, sku, true).Find(&items)
+	if rsp.Error != nil {
+		return nil, rsp.Error
+	}
+
+	userIDs := make([]string, 0, len(items))
+	for _, item := range items {
+		userIDs = append(userIDs, item.UserID)
+	}
+	users := []*User{}
+	if rsp := tx.Where("id IN (?)", userIDs).Find(&users); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	emails := map[string]string{}
+	for _, user := range users {
+		emails[user.ID] = user.Email
+	}
+
+	notifications := []*WishlistNotification{}
+	for _, item := range items {
+		if rsp := tx.Model(item).UpdateColumn("notified_at", now); rsp.Error != nil {
+			return nil, rsp.Error
+		}
+		item.NotifiedAt = &now
+		if email := emails[item.UserID]; email != "" {
+			notifications = append(notifications, &WishlistNotification{Email: email, Item: item})
+		}
+	}
+	return notifications, nil
+}
@@ -0,0 +1,312 @@
+package adyen
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+	"github.com/pariz/gountries"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const apiVersion = "v52"
+
+// Adyen result codes, see https://docs.adyen.com/development-resources/response-handling
+const (
+	resultAuthorised       = "Authorised"
+	resultRedirectShopper  = "RedirectShopper"
+	resultIdentifyShopper  = "IdentifyShopper"
+	resultChallengeShopper = "ChallengeShopper"
+	resultPending          = "Pending"
+	resultReceived         = "Received"
+)
+
+// supportedPaymentMethods maps the Adyen payment method types to the
+// payment methods they represent.
+var supportedPaymentMethods = map[string]string{
+	"scheme":         "card",
+	"ideal":          "iDEAL",
+	"bcmc":           "Bancontact",
+	"bcmc_mobile":    "Bancontact mobile",
+	"directEbanking": "SOFORT",
+}
+
+type adyenPaymentProvider struct {
+	client          *http.Client
+	apiKey          string
+	merchantAccount string
+	checkoutURL     string
+	paymentURL      string
+}
+
+type adyenBodyParams struct {
+	ProviderMetadata struct {
+		PaymentMethod map[string]interface{} `json:"payment_method"`
+		BrowserInfo   map[string]interface{} `json:"browser_info"`
+		ReturnURL     string                 `json:"return_url"`
+		Details       map[string]interface{} `json:"details"`
+	} `json:"provider_metadata"`
+}
+
+// Config contains the Adyen-specific configuration for payment providers.
+type Config struct {
+	APIKey          string `mapstructure:"api_key" json:"api_key"`
+	MerchantAccount string `mapstructure:"merchant_account" json:"merchant_account"`
+	Env             string `mapstructure:"env" json:"env"`
+	LiveURLPrefix   string `mapstructure:"live_url_prefix" json:"live_url_prefix"`
+}
+
+func init() {
+	payments.Register(payments.AdyenProvider, func(raw map[string]interface{}) (payments.Provider, error) {
+		config := Config{}
+		if err := mapstructure.Decode(raw, &config); err != nil {
+			return nil, errors.Wrap(err, "Error decoding Adyen configuration")
+		}
+		return NewPaymentProvider(config)
+	})
+}
+
+// NewPaymentProvider creates a new Adyen payment provider using the provided configuration.
+func NewPaymentProvider(config Config) (payments.Provider, error) {
+	if config.APIKey == "" || config.MerchantAccount == "" {
+		return nil, errors.New("missing Adyen api_key and/or merchant_account")
+	}
+
+	p := &adyenPaymentProvider{
+		client:          &http.Client{},
+		apiKey:          config.APIKey,
+		merchantAccount: config.MerchantAccount,
+	}
+	switch config.Env {
+	case "live":
+		if config.LiveURLPrefix == "" {
+			return nil, errors.New("Adyen live environment requires a live_url_prefix")
+		}
+		p.checkoutURL = "https://" + config.LiveURLPrefix + "-checkout-live.adyenpayments.com/checkout/" + apiVersion
+		p.paymentURL = "https://" + config.LiveURLPrefix + "-pal-live.adyenpayments.com/pal/servlet/Payment/" + apiVersion
+	case "test", "":
+		p.checkoutURL = "https://checkout-test.adyen.com/" + apiVersion
+		p.paymentURL = "https://pal-test.adyen.com/pal/servlet/Payment/" + apiVersion
+	default:
+		// used for testing
+		p.checkoutURL = config.Env + "/" + apiVersion
+		p.paymentURL = config.Env + "/pal/servlet/Payment/" + apiVersion
+	}
+	return p, nil
+}
+
+func (p *adyenPaymentProvider) Name() string {
+	return payments.AdyenProvider
+}
+
+func readBodyParams(r *http.Request) (*adyenBodyParams, error) {
+	bp := &adyenBodyParams{}
+	bod, err := r.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	if err := json.NewDecoder(bod).Decode(bp); err != nil {
+		return nil, err
+	}
+	return bp, nil
+}
+
+func (p *adyenPaymentProvider) NewCharger(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Charger, error) {
+	bp, err := readBodyParams(r)
+	if err != nil {
+		return nil, err
+	}
+
+	pm := bp.ProviderMetadata.PaymentMethod
+	methodType, _ := pm["type"].(string)
+	if _, ok := supportedPaymentMethods[methodType]; !ok {
+		return nil, fmt.Errorf("Adyen requires a provider_metadata.payment_method with a supported type, got '%s'", methodType)
+	}
+	if methodType != "scheme" && bp.ProviderMetadata.ReturnURL == "" {
+		return nil, fmt.Errorf("Adyen requires a provider_metadata.return_url for %s payments", supportedPaymentMethods[methodType])
+	}
+
+	return func(amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
+		return p.charge(bp, amount, currency, order, invoiceNumber)
+	}, nil
+}
+
+type adyenAmount struct {
+	Value    uint64 `json:"value"`
+	Currency string `json:"currency"`
+}
+
+type adyenPaymentResponse struct {
+	PSPReference  string                 `json:"pspReference"`
+	ResultCode    string                 `json:"resultCode"`
+	RefusalReason string                 `json:"refusalReason"`
+	Action        map[string]interface{} `json:"action"`
+	PaymentData   string                 `json:"paymentData"`
+	Details       []interface{}          `json:"details"`
+}
+
+func countryCode(country string) string {
+	if len(country) == 2 {
+		return strings.ToUpper(country)
+	}
+	c, err := gountries.New().FindCountryByName(strings.ToLower(country))
+	if err != nil {
+		return ""
+	}
+	return c.Codes.Alpha2
+}
+
+func (p *adyenPaymentProvider) charge(bp *adyenBodyParams, amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
+	payload := map[string]interface{}{
+		"merchantAccount": p.merchantAccount,
+		"amount":          adyenAmount{Value: amount, Currency: currency},
+		"reference":       order.ID,
+		"paymentMethod":   bp.ProviderMetadata.PaymentMethod,
+		"shopperEmail":    order.Email,
+		"metadata": map[string]string{
+			"order_id":       order.ID,
+			"invoice_number": fmt.Sprintf("%d", invoiceNumber),
+		},
+	}
+	if bp.ProviderMetadata.ReturnURL != "" {
+		payload["returnUrl"] = bp.ProviderMetadata.ReturnURL
+	}
+	if bp.ProviderMetadata.BrowserInfo != nil {
+		payload["browserInfo"] = bp.ProviderMetadata.BrowserInfo
+	}
+	if code := countryCode(order.BillingAddress.Country); code != "" {
+		payload["countryCode"] = code
+	}
+
+	rsp := &adyenPaymentResponse{}
+	if err := p.call(p.checkoutURL+"/payments", payload, rsp); err != nil {
+		return "", err
+	}
+	return handlePaymentResponse(rsp)
+}
+
+func handlePaymentResponse(rsp *adyenPaymentResponse) (string, error) {
+	switch rsp.ResultCode {
+	case resultAuthorised:
+		return rsp.PSPReference, nil
+	case resultRedirectShopper, resultIdentifyShopper, resultChallengeShopper, resultPending, resultReceived:
+		return rsp.PSPReference, payments.NewPaymentPendingError(map[string]interface{}{
+			"result_code":  rsp.ResultCode,
+			"action":       rsp.Action,
+			"payment_data": rsp.PaymentData,
+		})
+	}
+
+	if rsp.RefusalReason != "" {
+		return "", payments.NewPaymentConfirmFailError(fmt.Sprintf("Adyen payment %s: %s", rsp.ResultCode, rsp.RefusalReason))
+	}
+	return "", payments.NewPaymentConfirmFailError(fmt.Sprintf("Invalid Adyen result code: %s", rsp.ResultCode))
+}
+
+func (p *adyenPaymentProvider) NewFinalizer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Finalizer, error) {
+	bp, err := readBodyParams(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(bp.ProviderMetadata.Details) == 0 {
+		return nil, errors.New("Adyen requires the redirect result in provider_metadata.details")
+	}
+
+	return func(paymentID string, metadata map[string]interface{}) (string, error) {
+		return p.finalize(bp.ProviderMetadata.Details, metadata)
+	}, nil
+}
+
+func (p *adyenPaymentProvider) finalize(details map[string]interface{}, metadata map[string]interface{}) (string, error) {
+	paymentData, _ := metadata["payment_data"].(string)
+	payload := map[string]interface{}{
+		"details": details,
+	}
+	if paymentData != "" {
+		payload["paymentData"] = paymentData
+	}
+
+	rsp := &adyenPaymentResponse{}
+	if err := p.call(p.checkoutURL+"/payments/details", payload, rsp); err != nil {
+		return "", err
+	}
+	return handlePaymentResponse(rsp)
+}
+
+func (p *adyenPaymentProvider) NewRefunder(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Refunder, error) {
+	return p.refund, nil
+}
+
+type adyenModificationResponse struct {
+	PSPReference string `json:"pspReference"`
+	Response     string `json:"response"`
+}
+
+func (p *adyenPaymentProvider) refund(transactionID string, amount uint64, currency string) (string, error) {
+	payload := map[string]interface{}{
+		"merchantAccount":    p.merchantAccount,
+		"originalReference":  transactionID,
+		"modificationAmount": adyenAmount{Value: amount, Currency: currency},
+	}
+
+	rsp := &adyenModificationResponse{}
+	if err := p.call(p.paymentURL+"/refund", payload, rsp); err != nil {
+		return "", err
+	}
+	return rsp.PSPReference, nil
+}
+
+func (p *adyenPaymentProvider) NewPreauthorizer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Preauthorizer, error) {
+	return nil, errors.New("Adyen does not require preauthorization")
+}
+
+func (p *adyenPaymentProvider) NewConfirmer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Confirmer, error) {
+	return nil, errors.New("Adyen payments are finalized through the payment callback")
+}
+
+type adyenError struct {
+	Status    int    `json:"status"`
+	ErrorCode string `json:"errorCode"`
+	Message   string `json:"message"`
+}
+
+func (p *adyenPaymentProvider) call(url string, payload interface{}, v interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "Error creating Adyen request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", p.apiKey)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "Error calling Adyen")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		apiErr := &adyenError{}
+		if json.Unmarshal(data, apiErr) == nil && apiErr.Message != "" {
+			if resp.StatusCode < http.StatusInternalServerError {
+				return payments.NewPaymentConfirmFailError(apiErr.Message)
+			}
+			return fmt.Errorf("Adyen returned %d: %s", resp.StatusCode, apiErr.Message)
+		}
+		return fmt.Errorf("Adyen returned %d: %s", resp.StatusCode, string(data))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,219 @@
+package coinbase
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	apiURL     = "https://api.commerce.coinbase.com"
+	apiVersion = "2018-03-22"
+
+	signatureHeader = "X-CC-Webhook-Signature"
+)
+
+type coinbasePaymentProvider struct {
+	client        *http.Client
+	apiKey        string
+	webhookSecret string
+	url           string
+}
+
+type coinbaseBodyParams struct {
+	ProviderMetadata struct {
+		RedirectURL string `json:"redirect_url"`
+		CancelURL   string `json:"cancel_url"`
+	} `json:"provider_metadata"`
+}
+
+// Config contains the Coinbase Commerce specific configuration for payment providers.
+type Config struct {
+	APIKey        string `mapstructure:"api_key" json:"api_key"`
+	WebhookSecret string `mapstructure:"webhook_secret" json:"webhook_secret"`
+	Env           string `mapstructure:"env" json:"env"`
+}
+
+func init() {
+	payments.Register(payments.CoinbaseProvider, func(raw map[string]interface{}) (payments.Provider, error) {
+		config := Config{}
+		if err := mapstructure.Decode(raw, &config); err != nil {
+			return nil, errors.Wrap(err, "Error decoding Coinbase Commerce configuration")
+		}
+		return NewPaymentProvider(config)
+	})
+}
+
+// NewPaymentProvider creates a new Coinbase Commerce payment provider using the provided configuration.
+func NewPaymentProvider(config Config) (payments.Provider, error) {
+	if config.APIKey == "" {
+		return nil, errors.New("Coinbase Commerce configuration missing api_key")
+	}
+
+	p := &coinbasePaymentProvider{
+		client:        &http.Client{},
+		apiKey:        config.APIKey,
+		webhookSecret: config.WebhookSecret,
+		url:           apiURL,
+	}
+	if config.Env != "" && config.Env != "live" {
+		// used for testing
+		p.url = config.Env
+	}
+	return p, nil
+}
+
+func (p *coinbasePaymentProvider) Name() string {
+	return payments.CoinbaseProvider
+}
+
+type money struct {
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+type coinbaseCharge struct {
+	ID        string `json:"id"`
+	Code      string `json:"code"`
+	HostedURL string `json:"hosted_url"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+func (p *coinbasePaymentProvider) NewCharger(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Charger, error) {
+	bp := &coinbaseBodyParams{}
+	if r.GetBody != nil {
+		bod, err := r.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		if err := json.NewDecoder(bod).Decode(bp); err != nil {
+			return nil, err
+		}
+	}
+
+	return func(amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
+		return p.charge(bp, amount, currency, order, invoiceNumber)
+	}, nil
+}
+
+// charge creates a Coinbase Commerce charge. The payment stays pending until
+// the customer paid on the hosted payment page and the payment has been
+// confirmed on-chain, which is reported through the webhook.
+func (p *coinbasePaymentProvider) charge(bp *coinbaseBodyParams, amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
+	payload := map[string]interface{}{
+		"name":         fmt.Sprintf("Order %d", invoiceNumber),
+		"description":  "Order " + order.ID,
+		"pricing_type": "fixed_price",
+		"local_price":  money{Amount: formatAmount(amount), Currency: currency},
+		"metadata": map[string]string{
+			"order_id":       order.ID,
+			"invoice_number": strconv.FormatInt(invoiceNumber, 10),
+		},
+	}
+	if bp.ProviderMetadata.RedirectURL != "" {
+		payload["redirect_url"] = bp.ProviderMetadata.RedirectURL
+	}
+	if bp.ProviderMetadata.CancelURL != "" {
+		payload["cancel_url"] = bp.ProviderMetadata.CancelURL
+	}
+
+	rsp := struct {
+		Data coinbaseCharge `json:"data"`
+	}{}
+	if err := p.call(http.MethodPost, "/charges", payload, &rsp); err != nil {
+		return "", err
+	}
+	return rsp.Data.ID, payments.NewPaymentPendingError(map[string]interface{}{
+		"hosted_url": rsp.Data.HostedURL,
+		"code":       rsp.Data.Code,
+		"expires_at": rsp.Data.ExpiresAt,
+	})
+}
+
+func (p *coinbasePaymentProvider) NewRefunder(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Refunder, error) {
+	return nil, errors.New("Coinbase Commerce payments have to be refunded from the Coinbase Commerce dashboard")
+}
+
+func (p *coinbasePaymentProvider) NewPreauthorizer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Preauthorizer, error) {
+	return nil, errors.New("Coinbase Commerce does not require preauthorization")
+}
+
+func (p *coinbasePaymentProvider) NewConfirmer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Confirmer, error) {
+	return nil, errors.New("Coinbase Commerce payments are confirmed through the webhook")
+}
+
+// VerifyWebhook validates the signature of a webhook event sent by Coinbase Commerce.
+func (p *coinbasePaymentProvider) VerifyWebhook(r *http.Request, payload []byte) error {
+	if p.webhookSecret == "" {
+		return errors.New("Coinbase Commerce configuration missing webhook_secret")
+	}
+	signature, err := hex.DecodeString(r.Header.Get(signatureHeader))
+	if err != nil || len(signature) == 0 {
+		return errors.New("Missing or malformed webhook signature")
+	}
+
+	mac := hmac.New(sha256.New, []byte(p.webhookSecret))
+	mac.Write(payload)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return errors.New("Webhook signature doesn't match")
+	}
+	return nil
+}
+
+func formatAmount(amount uint64) string {
+	return strconv.FormatFloat(float64(amount)/100, 'f', 2, 64)
+}
+
+type coinbaseError struct {
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (p *coinbasePaymentProvider) call(method, path string, payload interface{}, v interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, p.url+path, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "Error creating Coinbase Commerce request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-CC-Api-Key", p.apiKey)
+	req.Header.Set("X-CC-Version", apiVersion)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "Error calling Coinbase Commerce")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		data, _ := ioutil.ReadAll(resp.Body)
+		apiErr := &coinbaseError{}
+		if json.Unmarshal(data, apiErr) == nil && apiErr.Error.Message != "" {
+			if resp.StatusCode < http.StatusInternalServerError {
+				return payments.NewPaymentConfirmFailError(apiErr.Error.Message)
+			}
+			return fmt.Errorf("Coinbase Commerce returned %d: %s", resp.StatusCode, apiErr.Error.Message)
+		}
+		return fmt.Errorf("Coinbase Commerce returned %d: %s", resp.StatusCode, string(data))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,409 @@
+package klarna
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+	"github.com/pariz/gountries"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Klarna fraud states, see https://docs.klarna.com/klarna-payments/
+const (
+	fraudAccepted = "ACCEPTED"
+	fraudPending  = "PENDING"
+	fraudRejected = "REJECTED"
+)
+
+// Klarna order states of the order management API
+const (
+	orderCancelled = "CANCELLED"
+	orderExpired   = "EXPIRED"
+)
+
+const defaultLocale = "en-US"
+
+type klarnaPaymentProvider struct {
+	client          *http.Client
+	username        string
+	password        string
+	notificationURL string
+	url             string
+}
+
+type klarnaBodyParams struct {
+	ProviderMetadata struct {
+		Locale             string `json:"locale"`
+		AuthorizationToken string `json:"authorization_token"`
+	} `json:"provider_metadata"`
+}
+
+// Config contains the Klarna specific configuration for payment providers.
+type Config struct {
+	Username        string `mapstructure:"username" json:"username"`
+	Password        string `mapstructure:"password" json:"password"`
+	Env             string `mapstructure:"env" json:"env"`
+	Region          string `mapstructure:"region" json:"region"`
+	NotificationURL string `mapstructure:"notification_url" json:"notification_url"`
+}
+
+func init() {
+	payments.Register(payments.KlarnaProvider, func(raw map[string]interface{}) (payments.Provider, error) {
+		config := Config{}
+		if err := mapstructure.Decode(raw, &config); err != nil {
+			return nil, errors.Wrap(err, "Error decoding Klarna configuration")
+		}
+		return NewPaymentProvider(config)
+	})
+}
+
+// NewPaymentProvider creates a new Klarna payment provider using the provided configuration.
+func NewPaymentProvider(config Config) (payments.Provider, error) {
+	if config.Username == "" || config.Password == "" {
+		return nil, errors.New("missing Klarna username and/or password")
+	}
+
+	var host string
+	switch config.Region {
+	case "eu", "":
+		host = "api"
+	case "na", "oc":
+		host = "api-" + config.Region
+	default:
+		return nil, fmt.Errorf("Unknown Klarna region '%s'", config.Region)
+	}
+
+	p := &klarnaPaymentProvider{
+		client:          &http.Client{},
+		username:        config.Username,
+		password:        config.Password,
+		notificationURL: config.NotificationURL,
+	}
+	switch config.Env {
+	case "live":
+		p.url = "https://" + host + ".klarna.com"
+	case "playground", "test", "":
+		p.url = "https://" + host + ".playground.klarna.com"
+	default:
+		// used for testing
+		p.url = config.Env
+	}
+	return p, nil
+}
+
+func (p *klarnaPaymentProvider) Name() string {
+	return payments.KlarnaProvider
+}
+
+func readBodyParams(r *http.Request) (*klarnaBodyParams, error) {
+	bp := &klarnaBodyParams{}
+	if r.GetBody == nil {
+		return bp, nil
+	}
+	bod, err := r.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	if err := json.NewDecoder(bod).Decode(bp); err != nil {
+		return nil, err
+	}
+	return bp, nil
+}
+
+type orderLine struct {
+	Reference      string `json:"reference,omitempty" mapstructure:"reference"`
+	Name           string `json:"name" mapstructure:"name"`
+	Quantity       uint64 `json:"quantity" mapstructure:"quantity"`
+	UnitPrice      int64  `json:"unit_price" mapstructure:"unit_price"`
+	TaxRate        int64  `json:"tax_rate" mapstructure:"tax_rate"`
+	TotalAmount    int64  `json:"total_amount" mapstructure:"total_amount"`
+	TotalTaxAmount int64  `json:"total_tax_amount" mapstructure:"total_tax_amount"`
+}
+
+// orderDetails are the details of a purchase Klarna requires both for the
+// payment session and the order placed once the customer authorized it.
+type orderDetails struct {
+	PurchaseCountry    string       `json:"purchase_country" mapstructure:"purchase_country"`
+	PurchaseCurrency   string       `json:"purchase_currency" mapstructure:"purchase_currency"`
+	Locale             string       `json:"locale" mapstructure:"locale"`
+	OrderAmount        int64        `json:"order_amount" mapstructure:"order_amount"`
+	OrderTaxAmount     int64        `json:"order_tax_amount" mapstructure:"order_tax_amount"`
+	OrderLines         []*orderLine `json:"order_lines" mapstructure:"order_lines"`
+	MerchantReference1 string       `json:"merchant_reference1" mapstructure:"merchant_reference1"`
+	MerchantReference2 string       `json:"merchant_reference2" mapstructure:"merchant_reference2"`
+}
+
+func countryCode(country string) string {
+	if len(country) == 2 {
+		return strings.ToUpper(country)
+	}
+	c, err := gountries.New().FindCountryByName(strings.ToLower(country))
+	if err != nil {
+		return ""
+	}
+	return c.Codes.Alpha2
+}
+
+// newOrderDetails describes the order with its line items. Klarna rejects
+// orders whose lines don't add up to the order amount, so partial payments or
+// rounding differences are described by a single line for the whole amount.
+func newOrderDetails(locale string, amount uint64, currency string, order *models.Order, invoiceNumber int64) (*orderDetails, error) {
+	country := countryCode(order.BillingAddress.Country)
+	if country == "" {
+		return nil, payments.NewPaymentConfirmFailError("Klarna requires a billing address with a valid country")
+	}
+	if locale == "" {
+		locale = defaultLocale
+	}
+
+	details := &orderDetails{
+		PurchaseCountry:    country,
+		PurchaseCurrency:   currency,
+		Locale:             locale,
+		OrderAmount:        int64(amount),
+		MerchantReference1: order.ID,
+		MerchantReference2: fmt.Sprintf("%d", invoiceNumber),
+	}
+
+	var total, taxes int64
+	for _, item := range order.LineItems {
+		if item.CalculationDetail == nil {
+			total = -1
+			break
+		}
+		line := &orderLine{
+			Reference:      item.Sku,
+			Name:           item.Title,
+			Quantity:       item.Quantity,
+			UnitPrice:      item.CalculationDetail.Total,
+			TotalAmount:    item.CalculationDetail.Total * int64(item.Quantity),
+			TotalTaxAmount: int64(item.CalculationDetail.Taxes * item.Quantity),
+		}
+		if item.CalculationDetail.NetTotal > 0 {
+			line.TaxRate = int64(item.CalculationDetail.Taxes * 10000 / item.CalculationDetail.NetTotal)
+		}
+		details.OrderLines = append(details.OrderLines, line)
+		total += line.TotalAmount
+		taxes += line.TotalTaxAmount
+	}
+
+	if total != details.OrderAmount {
+		details.OrderLines = []*orderLine{{
+			Name:        fmt.Sprintf("Order %d", invoiceNumber),
+			Quantity:    1,
+			UnitPrice:   details.OrderAmount,
+			TotalAmount: details.OrderAmount,
+		}}
+		taxes = 0
+	}
+	details.OrderTaxAmount = taxes
+	return details, nil
+}
+
+type klarnaSession struct {
+	SessionID               string        `json:"session_id"`
+	ClientToken             string        `json:"client_token"`
+	PaymentMethodCategories []interface{} `json:"payment_method_categories"`
+}
+
+func (p *klarnaPaymentProvider) NewCharger(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Charger, error) {
+	bp, err := readBodyParams(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
+		return p.createSession(bp, amount, currency, order, invoiceNumber)
+	}, nil
+}
+
+// createSession starts a Klarna payment session. The payment stays pending
+// until the customer authorized it in the Klarna widget and the client passed
+// the authorization token to the payment callback.
+func (p *klarnaPaymentProvider) createSession(bp *klarnaBodyParams, amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
+	details, err := newOrderDetails(bp.ProviderMetadata.Locale, amount, currency, order, invoiceNumber)
+	if err != nil {
+		return "", err
+	}
+
+	rsp := &klarnaSession{}
+	if err := p.call(http.MethodPost, "/payments/v1/sessions", details, rsp); err != nil {
+		return "", err
+	}
+	return rsp.SessionID, payments.NewPaymentPendingError(map[string]interface{}{
+		"session_id":                rsp.SessionID,
+		"client_token":              rsp.ClientToken,
+		"payment_method_categories": rsp.PaymentMethodCategories,
+		"order_details":             details,
+	})
+}
+
+type klarnaOrder struct {
+	OrderID     string `json:"order_id"`
+	RedirectURL string `json:"redirect_url"`
+	FraudStatus string `json:"fraud_status"`
+	Status      string `json:"status"`
+}
+
+func (p *klarnaPaymentProvider) NewFinalizer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Finalizer, error) {
+	bp, err := readBodyParams(r)
+	if err != nil {
+		return nil, err
+	}
+	if bp.ProviderMetadata.AuthorizationToken == "" {
+		return nil, errors.New("Klarna requires the provider_metadata.authorization_token of the authorized session")
+	}
+
+	return func(paymentID string, metadata map[string]interface{}) (string, error) {
+		return p.placeOrder(bp.ProviderMetadata.AuthorizationToken, metadata)
+	}, nil
+}
+
+// placeOrder turns an authorized payment session into a Klarna order. Orders
+// Klarna hasn't approved right away are reviewed and approved or rejected
+// later on, which is reported through the notification URL.
+func (p *klarnaPaymentProvider) placeOrder(authorizationToken string, metadata map[string]interface{}) (string, error) {
+	details := &orderDetails{}
+	if err := mapstructure.Decode(metadata["order_details"], details); err != nil || details.OrderAmount == 0 {
+		return "", errors.New("Klarna payment is missing the order details of the session")
+	}
+
+	payload := map[string]interface{}{
+		"purchase_country":    details.PurchaseCountry,
+		"purchase_currency":   details.PurchaseCurrency,
+		"locale":              details.Locale,
+		"order_amount":        details.OrderAmount,
+		"order_tax_amount":    details.OrderTaxAmount,
+		"order_lines":         details.OrderLines,
+		"merchant_reference1": details.MerchantReference1,
+		"merchant_reference2": details.MerchantReference2,
+		"auto_capture":        true,
+	}
+	if p.notificationURL != "" {
+		payload["merchant_urls"] = map[string]string{"notification": p.notificationURL}
+	}
+
+	rsp := &klarnaOrder{}
+	if err := p.call(http.MethodPost, "/payments/v1/authorizations/"+authorizationToken+"/order", payload, rsp); err != nil {
+		return "", err
+	}
+
+	switch rsp.FraudStatus {
+	case fraudAccepted:
+		return rsp.OrderID, nil
+	case fraudPending:
+		return rsp.OrderID, payments.NewPaymentReviewError(map[string]interface{}{
+			"order_id":     rsp.OrderID,
+			"redirect_url": rsp.RedirectURL,
+			"fraud_status": rsp.FraudStatus,
+		})
+	}
+	return "", payments.NewPaymentConfirmFailError(fmt.Sprintf("Klarna rejected the order with fraud status %s", rsp.FraudStatus))
+}
+
+func (p *klarnaPaymentProvider) NewReviewChecker(ctx context.Context, log logrus.FieldLogger) (payments.ReviewChecker, error) {
+	return p.checkReview, nil
+}
+
+func (p *klarnaPaymentProvider) checkReview(orderID string) (string, error) {
+	rsp := &klarnaOrder{}
+	if err := p.call(http.MethodGet, "/ordermanagement/v1/orders/"+orderID, nil, rsp); err != nil {
+		return "", err
+	}
+	if rsp.Status == orderCancelled || rsp.Status == orderExpired {
+		return models.FailedState, nil
+	}
+	switch rsp.FraudStatus {
+	case fraudAccepted:
+		return models.PaidState, nil
+	case fraudRejected:
+		return models.FailedState, nil
+	}
+	return models.PendingApprovalState, nil
+}
+
+func (p *klarnaPaymentProvider) NewRefunder(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Refunder, error) {
+	return p.refund, nil
+}
+
+func (p *klarnaPaymentProvider) refund(transactionID string, amount uint64, currency string) (string, error) {
+	payload := map[string]interface{}{
+		"refunded_amount": amount,
+	}
+	resp, err := p.do(http.MethodPost, "/ordermanagement/v1/orders/"+transactionID+"/refunds", payload)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("Refund-Id"), nil
+}
+
+func (p *klarnaPaymentProvider) NewPreauthorizer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Preauthorizer, error) {
+	return nil, errors.New("Klarna does not require preauthorization")
+}
+
+func (p *klarnaPaymentProvider) NewConfirmer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Confirmer, error) {
+	return nil, errors.New("Klarna payments are finalized through the payment callback")
+}
+
+type klarnaError struct {
+	ErrorCode     string   `json:"error_code"`
+	ErrorMessages []string `json:"error_messages"`
+}
+
+func (p *klarnaPaymentProvider) call(method, path string, payload interface{}, v interface{}) error {
+	resp, err := p.do(method, path, payload)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (p *klarnaPaymentProvider) do(method, path string, payload interface{}) (*http.Response, error) {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, p.url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "Error creating Klarna request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(p.username, p.password)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error calling Klarna")
+	}
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		apiErr := &klarnaError{}
+		if json.Unmarshal(data, apiErr) == nil && apiErr.ErrorCode != "" {
+			msg := apiErr.ErrorCode
+			if len(apiErr.ErrorMessages) > 0 {
+				msg += ": " + strings.Join(apiErr.ErrorMessages, ", ")
+			}
+			if resp.StatusCode < http.StatusInternalServerError {
+				return nil, payments.NewPaymentConfirmFailError(msg)
+			}
+			return nil, fmt.Errorf("Klarna returned %d: %s", resp.StatusCode, msg)
+		}
+		return nil, fmt.Errorf("Klarna returned %d: %s", resp.StatusCode, string(data))
+	}
+	return resp, nil
+}
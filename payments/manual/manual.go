@@ -0,0 +1,100 @@
+package manual
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// supportedMethods lists the offline payment methods an order can be settled with.
+var supportedMethods = map[string]bool{
+	"bank_transfer":    true,
+	"cash_on_delivery": true,
+	"invoice":          true,
+}
+
+type manualPaymentProvider struct {
+	instructions string
+}
+
+type manualBodyParams struct {
+	PaymentMethod string `json:"payment_method"`
+}
+
+// Config contains the configuration for the manual payment provider.
+type Config struct {
+	Instructions string `mapstructure:"instructions" json:"instructions"`
+}
+
+func init() {
+	payments.Register(payments.ManualProvider, func(raw map[string]interface{}) (payments.Provider, error) {
+		config := Config{}
+		if err := mapstructure.Decode(raw, &config); err != nil {
+			return nil, errors.Wrap(err, "Error decoding manual payment configuration")
+		}
+		return NewPaymentProvider(config)
+	})
+}
+
+// NewPaymentProvider creates a new manual payment provider using the provided configuration.
+// Payments created with it stay pending until an admin confirms them.
+func NewPaymentProvider(config Config) (payments.Provider, error) {
+	return &manualPaymentProvider{instructions: config.Instructions}, nil
+}
+
+func (m *manualPaymentProvider) Name() string {
+	return payments.ManualProvider
+}
+
+func (m *manualPaymentProvider) NewCharger(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Charger, error) {
+	var bp manualBodyParams
+	bod, err := r.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	if err := json.NewDecoder(bod).Decode(&bp); err != nil {
+		return nil, err
+	}
+
+	if bp.PaymentMethod == "" {
+		bp.PaymentMethod = "bank_transfer"
+	}
+	if !supportedMethods[bp.PaymentMethod] {
+		return nil, fmt.Errorf("Unsupported manual payment method '%s'", bp.PaymentMethod)
+	}
+
+	return func(amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
+		metadata := map[string]interface{}{
+			"payment_method": bp.PaymentMethod,
+		}
+		if m.instructions != "" {
+			metadata["instructions"] = m.instructions
+		}
+		return "manual-" + uuid.NewRandom().String(), payments.NewPaymentDeferredError(metadata)
+	}, nil
+}
+
+func (m *manualPaymentProvider) NewRefunder(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Refunder, error) {
+	return m.refund, nil
+}
+
+// refund only records the refund, the money has to be paid back offline.
+func (m *manualPaymentProvider) refund(transactionID string, amount uint64, currency string) (string, error) {
+	return "manual-refund-" + uuid.NewRandom().String(), nil
+}
+
+func (m *manualPaymentProvider) NewPreauthorizer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Preauthorizer, error) {
+	return nil, errors.New("Manual payments do not require preauthorization")
+}
+
+func (m *manualPaymentProvider) NewConfirmer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Confirmer, error) {
+	return nil, errors.New("Manual payments have to be confirmed by an admin")
+}
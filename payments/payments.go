@@ -3,6 +3,8 @@ package payments
 import (
 	"context"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/netlify/gocommerce/models"
 	"github.com/sirupsen/logrus"
@@ -13,8 +15,35 @@ const (
 	StripeProvider = "stripe"
 	// PayPalProvider is the string identifier for the PayPal payment provider.
 	PayPalProvider = "paypal"
+	// AdyenProvider is the string identifier for the Adyen payment provider.
+	AdyenProvider = "adyen"
+	// ManualProvider is the string identifier for the manual/offline payment provider.
+	ManualProvider = "manual"
+	// CoinbaseProvider is the string identifier for the Coinbase Commerce payment provider.
+	CoinbaseProvider = "coinbase"
+	// KlarnaProvider is the string identifier for the Klarna payment provider.
+	KlarnaProvider = "klarna"
 )
 
+// currencyExponents lists the ISO 4217 currencies whose lowest unit isn't a
+// hundredth of the currency, by the number of decimals in their amounts.
+var currencyExponents = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0,
+	"KRW": 0, "PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0,
+	"XOF": 0, "XPF": 0,
+	"BHD": 3, "JOD": 3, "KWD": 3, "OMR": 3, "TND": 3,
+}
+
+// CurrencyExponent returns the number of decimals of amounts in the currency,
+// which is how many places an amount is shifted to express it in the lowest
+// currency unit.
+func CurrencyExponent(currency string) int {
+	if exp, ok := currencyExponents[strings.ToUpper(currency)]; ok {
+		return exp
+	}
+	return 2
+}
+
 // Provider represents a payment provider that can optionally charge, refund,
 // preauthorize payments.
 type Provider interface {
@@ -43,6 +72,115 @@ type PreauthorizationResult struct {
 // Confirmer wraps a confirm method used for checking two-step payments in a synchronous flow
 type Confirmer func(paymentID string) error
 
+// Finalizer wraps the Finalize method which completes a pending payment once the
+// customer returned from a redirect flow. It receives the processor ID and the
+// provider metadata stored with the pending transaction and returns the
+// processor ID of the completed payment.
+type Finalizer func(paymentID string, metadata map[string]interface{}) (string, error)
+
+// FinalizingProvider is implemented by providers supporting redirect flows that
+// have to be finalized through a callback.
+type FinalizingProvider interface {
+	NewFinalizer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (Finalizer, error)
+}
+
+// WebhookVerifier is implemented by providers that can verify the authenticity
+// of webhook notifications sent by the provider.
+type WebhookVerifier interface {
+	VerifyWebhook(r *http.Request, payload []byte) error
+}
+
+// Capturer wraps the Capture method which captures the amount of a previously
+// authorized payment. It returns the processor ID of the captured payment.
+type Capturer func(authorizationID string, amount uint64, currency string) (string, error)
+
+// Voider wraps the Void method which releases a previously authorized payment.
+type Voider func(authorizationID string) error
+
+// CapturingProvider is implemented by providers that can authorize payments at
+// checkout and capture them later on, e.g. when the order ships.
+type CapturingProvider interface {
+	// NewAuthorizer returns a Charger that only authorizes the amount.
+	NewAuthorizer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (Charger, error)
+	NewCapturer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (Capturer, error)
+	NewVoider(ctx context.Context, log logrus.FieldLogger) (Voider, error)
+	// AuthorizationPeriod is how long the provider holds an authorization.
+	AuthorizationPeriod() time.Duration
+}
+
+// VaultedPaymentMethod describes a payment method stored with the provider.
+type VaultedPaymentMethod struct {
+	CustomerID string
+	Token      string
+
+	Type     string
+	Brand    string
+	Last4    string
+	ExpMonth uint64
+	ExpYear  uint64
+}
+
+// Vaulter wraps the Vault method which stores a payment method with the provider
+// for future payments. If customerID is empty a new customer is created with the
+// provided email.
+type Vaulter func(customerID, email string) (*VaultedPaymentMethod, error)
+
+// Detacher wraps the Detach method which removes a stored payment method from
+// the provider so it can't be charged anymore.
+type Detacher func(method *models.PaymentMethod) error
+
+// VaultingProvider is implemented by providers that can store payment methods
+// and charge them again later on.
+type VaultingProvider interface {
+	NewVaulter(ctx context.Context, r *http.Request, log logrus.FieldLogger) (Vaulter, error)
+	NewSavedMethodCharger(ctx context.Context, method *models.PaymentMethod, log logrus.FieldLogger) (Charger, error)
+	NewDetacher(ctx context.Context, log logrus.FieldLogger) (Detacher, error)
+}
+
+// GatewayCharge describes a charge as it is recorded by the provider.
+type GatewayCharge struct {
+	// ID is the processor ID the charge is stored with in a transaction.
+	ID       string
+	Amount   uint64
+	Refunded uint64
+	Fee      uint64
+	Currency string
+	// Status is the state of the charge as a transaction state, e.g. paid.
+	Status    string
+	CreatedAt time.Time
+}
+
+// ChargeLister wraps the ListCharges method which lists the charges made with
+// the provider within a period.
+type ChargeLister func(from, to time.Time) ([]*GatewayCharge, error)
+
+// ReconcilingProvider is implemented by providers that can list their charges
+// to reconcile them with the local transactions.
+type ReconcilingProvider interface {
+	NewChargeLister(ctx context.Context, log logrus.FieldLogger) (ChargeLister, error)
+}
+
+// ReviewChecker wraps the CheckReview method which looks up the outcome of the
+// provider's review of a payment awaiting approval. It returns the resulting
+// transaction state, i.e. paid, failed or still pending_approval.
+type ReviewChecker func(paymentID string) (string, error)
+
+// ReviewingProvider is implemented by providers that review payments before
+// approving them, e.g. buy now pay later providers running a credit check.
+type ReviewingProvider interface {
+	NewReviewChecker(ctx context.Context, log logrus.FieldLogger) (ReviewChecker, error)
+}
+
+// FeeLookup wraps the LookupFee method which returns the processing fee the
+// provider charged for a payment.
+type FeeLookup func(paymentID string) (uint64, error)
+
+// FeeReportingProvider is implemented by providers that can report the fees of
+// their payments.
+type FeeReportingProvider interface {
+	NewFeeLookup(ctx context.Context, log logrus.FieldLogger) (FeeLookup, error)
+}
+
 // PaymentPendingError is returned when the payment provider requests additional action
 // e.g. 2-step authorization through 3D secure
 type PaymentPendingError struct {
@@ -64,6 +202,68 @@ func (p *PaymentPendingError) Metadata() map[string]interface{} {
 	return p.metadata
 }
 
+// PaymentDeferredError is returned when the payment is settled outside of the
+// provider, e.g. by bank transfer, and has to be confirmed manually later on.
+type PaymentDeferredError struct {
+	metadata map[string]interface{}
+}
+
+// NewPaymentDeferredError creates an error for a payment awaiting manual confirmation
+func NewPaymentDeferredError(metadata map[string]interface{}) error {
+	return &PaymentDeferredError{metadata}
+}
+
+func (p *PaymentDeferredError) Error() string {
+	return "The payment has to be confirmed manually."
+}
+
+// Metadata returns fields that should be passed to the client,
+// e.g. payment instructions
+func (p *PaymentDeferredError) Metadata() map[string]interface{} {
+	return p.metadata
+}
+
+// PaymentReviewError is returned when the payment has been authorized but the
+// provider has to approve it first, which is checked through a ReviewChecker.
+type PaymentReviewError struct {
+	metadata map[string]interface{}
+}
+
+// NewPaymentReviewError creates an error for a payment awaiting approval by the provider
+func NewPaymentReviewError(metadata map[string]interface{}) error {
+	return &PaymentReviewError{metadata}
+}
+
+func (p *PaymentReviewError) Error() string {
+	return "The payment is awaiting approval by the payment provider."
+}
+
+// Metadata returns fields that should be passed to the client
+func (p *PaymentReviewError) Metadata() map[string]interface{} {
+	return p.metadata
+}
+
+// PaymentProcessingError is returned when the payment has been initiated but
+// settles days later, e.g. a SEPA Direct Debit. The provider reports the
+// outcome through its webhook.
+type PaymentProcessingError struct {
+	metadata map[string]interface{}
+}
+
+// NewPaymentProcessingError creates an error for a payment that hasn't settled yet
+func NewPaymentProcessingError(metadata map[string]interface{}) error {
+	return &PaymentProcessingError{metadata}
+}
+
+func (p *PaymentProcessingError) Error() string {
+	return "The payment is processed by the payment provider."
+}
+
+// Metadata returns fields that should be passed to the client
+func (p *PaymentProcessingError) Metadata() map[string]interface{} {
+	return p.metadata
+}
+
 // PaymentConfirmFailError is returned when the confirmation request got a negative response
 type PaymentConfirmFailError struct {
 	message string
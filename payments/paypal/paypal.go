@@ -4,11 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/mitchellh/mapstructure"
 	"github.com/netlify/gocommerce/models"
 	"github.com/pariz/gountries"
 	"github.com/sirupsen/logrus"
@@ -23,6 +27,7 @@ import (
 
 type paypalPaymentProvider struct {
 	client       *paypalsdk.Client
+	webhookID    string
 	profile      *paypalsdk.WebProfile
 	profileMutex sync.Mutex
 }
@@ -37,6 +42,20 @@ type Config struct {
 	ClientID string `mapstructure:"client_id" json:"client_id"`
 	Secret   string `mapstructure:"secret" json:"secret"`
 	Env      string `mapstructure:"env" json:"env"`
+
+	// WebhookID is the ID of the webhook registered with PayPal, needed to
+	// verify webhook notifications.
+	WebhookID string `mapstructure:"webhook_id" json:"webhook_id"`
+}
+
+func init() {
+	payments.Register(payments.PayPalProvider, func(raw map[string]interface{}) (payments.Provider, error) {
+		config := Config{}
+		if err := mapstructure.Decode(raw, &config); err != nil {
+			return nil, errors.Wrap(err, "Error decoding PayPal configuration")
+		}
+		return NewPaymentProvider(config)
+	})
 }
 
 // NewPaymentProvider creates a new PayPal payment provider using the provided configuration.
@@ -69,7 +88,8 @@ func NewPaymentProvider(config Config) (payments.Provider, error) {
 	}
 
 	return &paypalPaymentProvider{
-		client: paypal,
+		client:    paypal,
+		webhookID: config.WebhookID,
 	}, nil
 }
 
@@ -279,6 +299,131 @@ func formatAmount(amount uint64) string {
 	return strconv.FormatFloat(float64(amount)/100, 'f', 2, 64)
 }
 
+func parseAmount(amount string) uint64 {
+	value, err := strconv.ParseFloat(amount, 64)
+	if err != nil || value < 0 {
+		return 0
+	}
+	return uint64(math.Round(value * 100))
+}
+
+type paypalPaymentList struct {
+	Payments []paypalsdk.Payment `json:"payments"`
+	NextID   string              `json:"next_id"`
+}
+
+func (p *paypalPaymentProvider) NewChargeLister(ctx context.Context, log logrus.FieldLogger) (payments.ChargeLister, error) {
+	return p.listCharges, nil
+}
+
+func (p *paypalPaymentProvider) listCharges(from, to time.Time) ([]*payments.GatewayCharge, error) {
+	query := url.Values{}
+	query.Set("start_time", from.UTC().Format(time.RFC3339))
+	query.Set("end_time", to.UTC().Format(time.RFC3339))
+	query.Set("count", "20")
+
+	charges := []*payments.GatewayCharge{}
+	for {
+		req, err := p.client.NewRequest(http.MethodGet, p.client.APIBase+"/v1/payments/payment?"+query.Encode(), nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error creating PayPal payment list request")
+		}
+		list := &paypalPaymentList{}
+		if err := p.client.SendWithAuth(req, list); err != nil {
+			return nil, errors.Wrap(err, "Error listing PayPal payments")
+		}
+
+		for _, payment := range list.Payments {
+			charges = append(charges, gatewayCharge(payment))
+		}
+		if list.NextID == "" || len(list.Payments) == 0 {
+			return charges, nil
+		}
+		query.Set("start_id", list.NextID)
+	}
+}
+
+// gatewayCharge describes a PayPal payment by its sale, if the payment has
+// been executed already.
+func gatewayCharge(payment paypalsdk.Payment) *payments.GatewayCharge {
+	charge := &payments.GatewayCharge{ID: payment.ID, Status: models.PendingState}
+	if payment.CreateTime != nil {
+		charge.CreatedAt = *payment.CreateTime
+	}
+	if payment.State == "failed" {
+		charge.Status = models.FailedState
+	}
+	if len(payment.Transactions) == 0 || payment.Transactions[0].Amount == nil {
+		return charge
+	}
+
+	transaction := payment.Transactions[0]
+	charge.Amount = parseAmount(transaction.Amount.Total)
+	charge.Currency = transaction.Amount.Currency
+	for _, related := range transaction.RelatedResources {
+		if related.Sale != nil {
+			sale := related.Sale
+			switch sale.State {
+			case "completed", "refunded", "partially_refunded":
+				charge.Status = models.PaidState
+			case "denied":
+				charge.Status = models.FailedState
+			}
+			if sale.TransactionFee != nil {
+				charge.Fee = parseAmount(sale.TransactionFee.Value)
+			}
+		}
+		if related.Refund != nil && related.Refund.Amount != nil {
+			charge.Refunded += parseAmount(related.Refund.Amount.Total)
+		}
+	}
+	return charge
+}
+
 func (p *paypalPaymentProvider) NewConfirmer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Confirmer, error) {
 	return nil, errors.New("Paypal does not provide manual 2-step confirmation")
 }
+
+type paypalWebhookVerification struct {
+	AuthAlgo         string          `json:"auth_algo"`
+	CertURL          string          `json:"cert_url"`
+	TransmissionID   string          `json:"transmission_id"`
+	TransmissionSig  string          `json:"transmission_sig"`
+	TransmissionTime string          `json:"transmission_time"`
+	WebhookID        string          `json:"webhook_id"`
+	WebhookEvent     json.RawMessage `json:"webhook_event"`
+}
+
+type paypalWebhookVerificationResult struct {
+	VerificationStatus string `json:"verification_status"`
+}
+
+// VerifyWebhook validates a webhook notification against PayPal.
+func (p *paypalPaymentProvider) VerifyWebhook(r *http.Request, payload []byte) error {
+	if p.webhookID == "" {
+		return errors.New("PayPal configuration missing webhook_id")
+	}
+
+	verification := &paypalWebhookVerification{
+		AuthAlgo:         r.Header.Get("Paypal-Auth-Algo"),
+		CertURL:          r.Header.Get("Paypal-Cert-Url"),
+		TransmissionID:   r.Header.Get("Paypal-Transmission-Id"),
+		TransmissionSig:  r.Header.Get("Paypal-Transmission-Sig"),
+		TransmissionTime: r.Header.Get("Paypal-Transmission-Time"),
+		WebhookID:        p.webhookID,
+		WebhookEvent:     json.RawMessage(payload),
+	}
+	req, err := p.client.NewRequest(http.MethodPost, p.client.APIBase+"/v1/notifications/verify-webhook-signature", verification)
+	if err != nil {
+		return errors.Wrap(err, "Error creating PayPal webhook verification")
+	}
+
+	result := &paypalWebhookVerificationResult{}
+	if err := p.client.SendWithAuth(req, result); err != nil {
+		return errors.Wrap(err, "Error verifying PayPal webhook")
+	}
+	if result.VerificationStatus != "SUCCESS" {
+		return fmt.Errorf("PayPal webhook verification status: %s", result.VerificationStatus)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package payments
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ProviderFactory creates a Provider from its raw per-instance configuration.
+type ProviderFactory func(config map[string]interface{}) (Provider, error)
+
+var (
+	factoriesMutex sync.RWMutex
+	factories      = make(map[string]ProviderFactory)
+)
+
+// Register makes a payment provider available under the provided name. It is
+// meant to be called from the init function of the package implementing the
+// provider. Register panics if it is called twice with the same name or if
+// the factory is nil.
+func Register(name string, factory ProviderFactory) {
+	factoriesMutex.Lock()
+	defer factoriesMutex.Unlock()
+
+	if factory == nil {
+		panic("payments: Register factory is nil")
+	}
+	if _, dup := factories[name]; dup {
+		panic("payments: Register called twice for provider " + name)
+	}
+	factories[name] = factory
+}
+
+// Registered returns the sorted names of all registered payment providers.
+func Registered() []string {
+	factoriesMutex.RLock()
+	defer factoriesMutex.RUnlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewProvider creates a new instance of the registered provider with the given name.
+func NewProvider(name string, config map[string]interface{}) (Provider, error) {
+	factoriesMutex.RLock()
+	factory, ok := factories[name]
+	factoriesMutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Unknown payment provider '%s'", name)
+	}
+	return factory(config)
+}
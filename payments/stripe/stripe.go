@@ -3,10 +3,14 @@ package stripe
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"strings"
+	"time"
 
 	"encoding/json"
 
+	"github.com/mitchellh/mapstructure"
 	"github.com/netlify/gocommerce/models"
 	"github.com/netlify/gocommerce/payments"
 	"github.com/pkg/errors"
@@ -22,6 +26,35 @@ type stripePaymentProvider struct {
 type stripeBodyParams struct {
 	StripeToken           string `json:"stripe_token"`
 	StripePaymentMethodID string `json:"stripe_payment_method_id"`
+	StripeWalletToken     string `json:"stripe_wallet_token"`
+	StripeWalletType      string `json:"stripe_wallet_type"`
+
+	StripePaymentMethodType string `json:"stripe_payment_method_type"`
+}
+
+// sepaDebitType is the type of SEPA Direct Debit payment methods, which settle
+// days after the payment has been confirmed.
+const sepaDebitType = "sepa_debit"
+
+// sepaMandate is the customer's acceptance of the SEPA Direct Debit mandate
+// given when paying online.
+type sepaMandate struct {
+	ip        string
+	userAgent string
+}
+
+func newSEPAMandate(r *http.Request) *sepaMandate {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return &sepaMandate{ip: ip, userAgent: r.UserAgent()}
+}
+
+// supportedWallets lists the card wallets a stripe_wallet_token can originate from.
+var supportedWallets = map[string]bool{
+	string(stripe.PaymentMethodCardWalletTypeApplePay):  true,
+	string(stripe.PaymentMethodCardWalletTypeGooglePay): true,
 }
 
 // Config contains the Stripe-specific configuration for payment providers.
@@ -29,6 +62,16 @@ type Config struct {
 	SecretKey string `mapstructure:"secret_key" json:"secret_key"`
 }
 
+func init() {
+	payments.Register(payments.StripeProvider, func(raw map[string]interface{}) (payments.Provider, error) {
+		config := Config{}
+		if err := mapstructure.Decode(raw, &config); err != nil {
+			return nil, errors.Wrap(err, "Error decoding Stripe configuration")
+		}
+		return NewPaymentProvider(config)
+	})
+}
+
 // NewPaymentProvider creates a new Stripe payment provider using the provided configuration.
 func NewPaymentProvider(config Config) (payments.Provider, error) {
 	if config.SecretKey == "" {
@@ -47,6 +90,14 @@ func (s *stripePaymentProvider) Name() string {
 }
 
 func (s *stripePaymentProvider) NewCharger(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Charger, error) {
+	return s.newCharger(r, stripe.PaymentIntentCaptureMethodAutomatic)
+}
+
+func (s *stripePaymentProvider) NewAuthorizer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Charger, error) {
+	return s.newCharger(r, stripe.PaymentIntentCaptureMethodManual)
+}
+
+func (s *stripePaymentProvider) newCharger(r *http.Request, captureMethod stripe.PaymentIntentCaptureMethod) (payments.Charger, error) {
 	var bp stripeBodyParams
 	bod, err := r.GetBody()
 	if err != nil {
@@ -57,14 +108,130 @@ func (s *stripePaymentProvider) NewCharger(ctx context.Context, r *http.Request,
 		return nil, err
 	}
 
+	if bp.StripeWalletToken != "" {
+		if !supportedWallets[bp.StripeWalletType] {
+			return nil, fmt.Errorf("Stripe requires a stripe_wallet_type of apple_pay or google_pay for wallet tokens, got '%s'", bp.StripeWalletType)
+		}
+		return func(amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
+			paymentMethodID, err := s.walletPaymentMethod(bp.StripeWalletToken, bp.StripeWalletType)
+			if err != nil {
+				return "", err
+			}
+			return s.chargePaymentIntent(paymentMethodID, "", "", nil, captureMethod, amount, currency, order, invoiceNumber)
+		}, nil
+	}
+
 	if bp.StripePaymentMethodID == "" {
-		return nil, errors.New("Stripe requires a stripe_payment_method_id for creating a payment intent")
+		return nil, errors.New("Stripe requires a stripe_payment_method_id or stripe_wallet_token for creating a payment intent")
+	}
+	var mandate *sepaMandate
+	switch bp.StripePaymentMethodType {
+	case "", string(stripe.PaymentMethodTypeCard):
+	case sepaDebitType:
+		if captureMethod == stripe.PaymentIntentCaptureMethodManual {
+			return nil, errors.New("SEPA Direct Debit payments can't be authorized only")
+		}
+		mandate = newSEPAMandate(r)
+	default:
+		return nil, fmt.Errorf("Unsupported stripe_payment_method_type '%s'", bp.StripePaymentMethodType)
 	}
 	return func(amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
-		return s.chargePaymentIntent(bp.StripePaymentMethodID, amount, currency, order, invoiceNumber)
+		return s.chargePaymentIntent(bp.StripePaymentMethodID, "", bp.StripePaymentMethodType, mandate, captureMethod, amount, currency, order, invoiceNumber)
 	}, nil
 }
 
+func (s *stripePaymentProvider) NewVaulter(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Vaulter, error) {
+	var bp stripeBodyParams
+	bod, err := r.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	err = json.NewDecoder(bod).Decode(&bp)
+	if err != nil {
+		return nil, err
+	}
+
+	if bp.StripePaymentMethodID == "" {
+		return nil, errors.New("Stripe requires a stripe_payment_method_id for saving a payment method")
+	}
+	return func(customerID, email string) (*payments.VaultedPaymentMethod, error) {
+		return s.vault(bp.StripePaymentMethodID, customerID, email)
+	}, nil
+}
+
+// vault attaches the PaymentMethod to a Stripe customer, which is created first
+// if the user doesn't have one yet, so it can be charged again later on.
+func (s *stripePaymentProvider) vault(paymentMethodID, customerID, email string) (*payments.VaultedPaymentMethod, error) {
+	if customerID == "" {
+		cus, err := s.client.Customers.New(&stripe.CustomerParams{
+			Email: stripe.String(email),
+		})
+		if err != nil {
+			return nil, err
+		}
+		customerID = cus.ID
+	}
+
+	pm, err := s.client.PaymentMethods.Attach(paymentMethodID, &stripe.PaymentMethodAttachParams{
+		Customer: stripe.String(customerID),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	vaulted := &payments.VaultedPaymentMethod{
+		CustomerID: customerID,
+		Token:      pm.ID,
+		Type:       string(pm.Type),
+	}
+	if pm.Card != nil {
+		vaulted.Brand = string(pm.Card.Brand)
+		vaulted.Last4 = pm.Card.Last4
+		vaulted.ExpMonth = pm.Card.ExpMonth
+		vaulted.ExpYear = pm.Card.ExpYear
+	}
+	return vaulted, nil
+}
+
+func (s *stripePaymentProvider) NewSavedMethodCharger(ctx context.Context, method *models.PaymentMethod, log logrus.FieldLogger) (payments.Charger, error) {
+	return func(amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
+		return s.chargePaymentIntent(method.ProviderToken, method.ProviderCustomerID, method.Type, nil, stripe.PaymentIntentCaptureMethodAutomatic, amount, currency, order, invoiceNumber)
+	}, nil
+}
+
+func (s *stripePaymentProvider) NewDetacher(ctx context.Context, log logrus.FieldLogger) (payments.Detacher, error) {
+	return s.detach, nil
+}
+
+// detach removes the PaymentMethod from its Stripe customer. PaymentMethods
+// that are already gone are considered detached.
+func (s *stripePaymentProvider) detach(method *models.PaymentMethod) error {
+	_, err := s.client.PaymentMethods.Detach(method.ProviderToken, nil)
+	if stripeErr, ok := err.(*stripe.Error); ok && stripeErr.Code == stripe.ErrorCodeResourceMissing {
+		return nil
+	}
+	return err
+}
+
+// walletPaymentMethod creates a card PaymentMethod from an Apple Pay or Google Pay
+// token and makes sure the token actually originates from the expected wallet.
+func (s *stripePaymentProvider) walletPaymentMethod(token, walletType string) (string, error) {
+	pm, err := s.client.PaymentMethods.New(&stripe.PaymentMethodParams{
+		Type: stripe.String(string(stripe.PaymentMethodTypeCard)),
+		Card: &stripe.PaymentMethodCardParams{
+			Token: stripe.String(token),
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if pm.Card == nil || pm.Card.Wallet == nil || string(pm.Card.Wallet.Type) != walletType {
+		return "", payments.NewPaymentConfirmFailError(fmt.Sprintf("Stripe token is not a %s wallet token", walletType))
+	}
+	return pm.ID, nil
+}
+
 func prepareShippingAddress(addr models.Address) *stripe.ShippingDetailsParams {
 	return &stripe.ShippingDetailsParams{
 		Address: &stripe.AddressParams{
@@ -79,23 +246,41 @@ func prepareShippingAddress(addr models.Address) *stripe.ShippingDetailsParams {
 	}
 }
 
-func (s *stripePaymentProvider) chargePaymentIntent(paymentMethodID string, amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
+// chargePaymentIntent creates and confirms a PaymentIntent. SEPA Direct Debits
+// are processing after the confirmation and settle or fail days later, which is
+// reported through the webhook.
+func (s *stripePaymentProvider) chargePaymentIntent(paymentMethodID, customerID, paymentMethodType string, mandate *sepaMandate, captureMethod stripe.PaymentIntentCaptureMethod, amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
 	params := &stripe.PaymentIntentParams{
 		PaymentMethod: stripe.String(paymentMethodID),
 		Amount:        stripe.Int64(int64(amount)),
 		Currency:      stripe.String(currency),
-		Description:   stripe.String(fmt.Sprintf("Invoice No. %d", invoiceNumber)),
 		Shipping:      prepareShippingAddress(order.ShippingAddress),
 		Params: stripe.Params{
 			Metadata: map[string]string{
-				"order_id":       order.ID,
-				"invoice_number": fmt.Sprintf("%d", invoiceNumber),
+				"order_id": order.ID,
 			},
 		},
 		ConfirmationMethod: stripe.String(string(
 			stripe.PaymentIntentConfirmationMethodManual,
 		)),
-		Confirm: stripe.Bool(true),
+		Confirm:       stripe.Bool(true),
+		CaptureMethod: stripe.String(string(captureMethod)),
+	}
+	// renewals are only given an invoice number once they're paid
+	if invoiceNumber != 0 {
+		params.Description = stripe.String(fmt.Sprintf("Invoice No. %d", invoiceNumber))
+		params.Metadata["invoice_number"] = fmt.Sprintf("%d", invoiceNumber)
+	}
+	if customerID != "" {
+		params.Customer = stripe.String(customerID)
+	}
+	if paymentMethodType == sepaDebitType {
+		params.PaymentMethodTypes = stripe.StringSlice([]string{sepaDebitType})
+		if mandate != nil {
+			params.AddExtra("mandate_data[customer_acceptance][type]", "online")
+			params.AddExtra("mandate_data[customer_acceptance][online][ip_address]", mandate.ip)
+			params.AddExtra("mandate_data[customer_acceptance][online][user_agent]", mandate.userAgent)
+		}
 	}
 	intent, err := s.client.PaymentIntents.New(params)
 	if err != nil {
@@ -112,6 +297,16 @@ func (s *stripePaymentProvider) chargePaymentIntent(paymentMethodID string, amou
 		return intent.ID, nil
 	}
 
+	if intent.Status == stripe.PaymentIntentStatusProcessing {
+		return intent.ID, payments.NewPaymentProcessingError(map[string]interface{}{
+			"payment_method_types": intent.PaymentMethodTypes,
+		})
+	}
+
+	if intent.Status == stripe.PaymentIntentStatusRequiresCapture && captureMethod == stripe.PaymentIntentCaptureMethodManual {
+		return intent.ID, nil
+	}
+
 	return "", fmt.Errorf("Invalid PaymentIntent status: %s", intent.Status)
 }
 
@@ -132,6 +327,114 @@ func (s *stripePaymentProvider) refund(transactionID string, amount uint64, curr
 	return ref.ID, err
 }
 
+func (s *stripePaymentProvider) NewCapturer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Capturer, error) {
+	return s.capture, nil
+}
+
+func (s *stripePaymentProvider) capture(authorizationID string, amount uint64, currency string) (string, error) {
+	intent, err := s.client.PaymentIntents.Capture(authorizationID, &stripe.PaymentIntentCaptureParams{
+		AmountToCapture: stripe.Int64(int64(amount)),
+	})
+	if err != nil {
+		return "", err
+	}
+	if intent.Status != stripe.PaymentIntentStatusSucceeded {
+		return "", fmt.Errorf("Invalid PaymentIntent status after capture: %s", intent.Status)
+	}
+	return intent.ID, nil
+}
+
+func (s *stripePaymentProvider) NewVoider(ctx context.Context, log logrus.FieldLogger) (payments.Voider, error) {
+	return s.void, nil
+}
+
+func (s *stripePaymentProvider) void(authorizationID string) error {
+	_, err := s.client.PaymentIntents.Cancel(authorizationID, nil)
+	return err
+}
+
+// AuthorizationPeriod returns how long Stripe holds uncaptured card payments.
+func (s *stripePaymentProvider) AuthorizationPeriod() time.Duration {
+	return 7 * 24 * time.Hour
+}
+
+func (s *stripePaymentProvider) NewChargeLister(ctx context.Context, log logrus.FieldLogger) (payments.ChargeLister, error) {
+	return s.listCharges, nil
+}
+
+func (s *stripePaymentProvider) listCharges(from, to time.Time) ([]*payments.GatewayCharge, error) {
+	params := &stripe.ChargeListParams{
+		CreatedRange: &stripe.RangeQueryParams{
+			GreaterThanOrEqual: from.Unix(),
+			LesserThanOrEqual:  to.Unix(),
+		},
+	}
+	params.AddExpand("data.balance_transaction")
+
+	charges := []*payments.GatewayCharge{}
+	iter := s.client.Charges.List(params)
+	for iter.Next() {
+		ch := iter.Charge()
+		charge := &payments.GatewayCharge{
+			ID:        ch.ID,
+			Amount:    uint64(ch.Amount),
+			Refunded:  uint64(ch.AmountRefunded),
+			Currency:  strings.ToUpper(string(ch.Currency)),
+			Status:    chargeStatus(ch),
+			CreatedAt: time.Unix(ch.Created, 0),
+		}
+		// charges of payment intents are stored with the ID of the intent
+		if ch.PaymentIntent != "" {
+			charge.ID = ch.PaymentIntent
+		}
+		if ch.BalanceTransaction != nil {
+			charge.Fee = uint64(ch.BalanceTransaction.Fee)
+		}
+		charges = append(charges, charge)
+	}
+	return charges, iter.Err()
+}
+
+func chargeStatus(ch *stripe.Charge) string {
+	switch {
+	case ch.Status == "failed":
+		return models.FailedState
+	case ch.Status == "pending":
+		return models.ProcessingState
+	case !ch.Captured && ch.Refunded:
+		return models.VoidedState
+	case !ch.Captured:
+		return models.AuthorizedState
+	default:
+		return models.PaidState
+	}
+}
+
+func (s *stripePaymentProvider) NewFeeLookup(ctx context.Context, log logrus.FieldLogger) (payments.FeeLookup, error) {
+	return s.lookupFee, nil
+}
+
+// lookupFee sums up the fees of the balance transactions of the charges of a
+// PaymentIntent.
+func (s *stripePaymentProvider) lookupFee(paymentID string) (uint64, error) {
+	params := &stripe.PaymentIntentParams{}
+	params.AddExpand("charges.data.balance_transaction")
+	intent, err := s.client.PaymentIntents.Get(paymentID, params)
+	if err != nil {
+		return 0, err
+	}
+
+	var fee uint64
+	if intent.Charges != nil {
+		for _, ch := range intent.Charges.Data {
+			if ch.BalanceTransaction != nil {
+				fee += uint64(ch.BalanceTransaction.Fee)
+			}
+		}
+	}
+	return fee, nil
+}
+
 func (s *stripePaymentProvider) NewPreauthorizer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Preauthorizer, error) {
 	return nil, errors.New("Stripe does not require preauthorization")
 }
@@ -141,11 +444,28 @@ func (s *stripePaymentProvider) NewConfirmer(ctx context.Context, r *http.Reques
 }
 
 func (s *stripePaymentProvider) confirm(paymentID string) error {
-	_, err := s.client.PaymentIntents.Confirm(paymentID, nil)
+	intent, err := s.client.PaymentIntents.Confirm(paymentID, nil)
 
 	if stripeErr, ok := err.(*stripe.Error); ok {
 		return payments.NewPaymentConfirmFailError(stripeErr.Msg)
 	}
+	if err != nil {
+		return err
+	}
 
-	return err
+	switch intent.Status {
+	case stripe.PaymentIntentStatusSucceeded, stripe.PaymentIntentStatusRequiresCapture:
+		return nil
+	case stripe.PaymentIntentStatusProcessing:
+		return payments.NewPaymentProcessingError(map[string]interface{}{
+			"payment_method_types": intent.PaymentMethodTypes,
+		})
+	case stripe.PaymentIntentStatusRequiresAction:
+		// the customer has to complete another authentication challenge
+		return payments.NewPaymentPendingError(map[string]interface{}{
+			"payment_intent_secret": intent.ClientSecret,
+		})
+	}
+
+	return payments.NewPaymentConfirmFailError(fmt.Sprintf("Invalid PaymentIntent status: %s", intent.Status))
 }
@@ -0,0 +1,349 @@
+// Package easypost quotes live carrier rates for shipping parcels with
+// EasyPost and tracks the delivery of shipments with its trackers.
+package easypost
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/netlify/gocommerce/shipping"
+)
+
+const (
+	apiURL = "https://api.easypost.com/v2"
+
+	signatureHeader = "X-Hmac-Signature"
+	signaturePrefix = "hmac-sha256-hex="
+)
+
+// Config contains the EasyPost specific configuration. WebhookSecret is the
+// secret the tracking webhooks are signed with.
+type Config struct {
+	APIKey        string `json:"api_key"`
+	WebhookSecret string `json:"webhook_secret"`
+	// URL replaces the URL of the EasyPost API, used for testing.
+	URL string `json:"url"`
+}
+
+// Client calls the EasyPost API. It implements shipping.RateProvider,
+// shipping.LabelProvider and shipping.Tracker.
+type Client struct {
+	client        *http.Client
+	apiKey        string
+	webhookSecret string
+	url           string
+}
+
+// NewClient creates a new EasyPost client using the provided configuration.
+func NewClient(config Config) (*Client, error) {
+	if config.APIKey == "" {
+		return nil, errors.New("EasyPost configuration missing api_key")
+	}
+	c := &Client{
+		client:        &http.Client{Timeout: 10 * time.Second},
+		apiKey:        config.APIKey,
+		webhookSecret: config.WebhookSecret,
+		url:           apiURL,
+	}
+	if config.URL != "" {
+		c.url = config.URL
+	}
+	return c, nil
+}
+
+type addressParams struct {
+	Name    string `json:"name,omitempty"`
+	Street1 string `json:"street1,omitempty"`
+	City    string `json:"city,omitempty"`
+	State   string `json:"state,omitempty"`
+	Zip     string `json:"zip,omitempty"`
+	Country string `json:"country"`
+}
+
+// parcelParams are the dimensions of a parcel in inches and its weight in
+// ounces.
+type parcelParams struct {
+	Length float64 `json:"length,omitempty"`
+	Width  float64 `json:"width,omitempty"`
+	Height float64 `json:"height,omitempty"`
+	Weight float64 `json:"weight"`
+}
+
+type shipmentOptions struct {
+	LabelFormat string `json:"label_format,omitempty"`
+}
+
+type shipmentParams struct {
+	Shipment struct {
+		FromAddress addressParams   `json:"from_address"`
+		ToAddress   addressParams   `json:"to_address"`
+		Parcel      parcelParams    `json:"parcel"`
+		Options     shipmentOptions `json:"options"`
+	} `json:"shipment"`
+}
+
+type rateResponse struct {
+	ID           string `json:"id"`
+	Carrier      string `json:"carrier"`
+	Service      string `json:"service"`
+	Rate         string `json:"rate"`
+	Currency     string `json:"currency"`
+	DeliveryDays *int   `json:"delivery_days"`
+}
+
+func (r *rateResponse) rate() (shipping.Rate, error) {
+	amount, err := strconv.ParseFloat(r.Rate, 64)
+	if err != nil {
+		return shipping.Rate{}, errors.Wrapf(err, "Error parsing EasyPost rate %s", r.ID)
+	}
+	rate := shipping.Rate{
+		ID:       r.ID,
+		Carrier:  r.Carrier,
+		Service:  r.Service,
+		Amount:   uint64(math.Round(amount * 100)),
+		Currency: r.Currency,
+	}
+	if r.DeliveryDays != nil {
+		rate.DeliveryDays = *r.DeliveryDays
+	}
+	return rate, nil
+}
+
+type shipmentResponse struct {
+	ID           string          `json:"id"`
+	TrackingCode string          `json:"tracking_code"`
+	Rates        []*rateResponse `json:"rates"`
+	SelectedRate *rateResponse   `json:"selected_rate"`
+	PostageLabel *struct {
+		LabelURL    string `json:"label_url"`
+		LabelPDFURL string `json:"label_pdf_url"`
+	} `json:"postage_label"`
+	Tracker *tracker `json:"tracker"`
+}
+
+// createShipment creates a shipment EasyPost quotes rates for, with PDF
+// labels.
+func (c *Client) createShipment(shipment *shipping.Shipment) (*shipmentResponse, error) {
+	params := &shipmentParams{}
+	params.Shipment.FromAddress = newAddressParams(shipment.From)
+	params.Shipment.ToAddress = newAddressParams(shipment.To)
+	params.Shipment.Parcel = parcelParams{
+		Length: inches(shipment.Parcel.Length),
+		Width:  inches(shipment.Parcel.Width),
+		Height: inches(shipment.Parcel.Height),
+		Weight: math.Ceil(float64(shipment.Parcel.Weight)/28.3495*10) / 10,
+	}
+	params.Shipment.Options.LabelFormat = "PDF"
+
+	rsp := &shipmentResponse{}
+	if err := c.call(http.MethodPost, "/shipments", params, rsp); err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
+// Rates creates a shipment and returns the rates EasyPost quotes for it.
+func (c *Client) Rates(shipment *shipping.Shipment) ([]shipping.Rate, error) {
+	rsp, err := c.createShipment(shipment)
+	if err != nil {
+		return nil, err
+	}
+
+	rates := make([]shipping.Rate, 0, len(rsp.Rates))
+	for _, r := range rsp.Rates {
+		rate, err := r.rate()
+		if err != nil {
+			return nil, err
+		}
+		rates = append(rates, rate)
+	}
+	return rates, nil
+}
+
+// BuyLabel creates a shipment and buys the label of the rate EasyPost quotes
+// for the service of the carrier, or of its cheapest rate. EasyPost tracks
+// the parcels it bought labels for.
+func (c *Client) BuyLabel(shipment *shipping.Shipment, carrier, service string) (*shipping.Label, error) {
+	created, err := c.createShipment(shipment)
+	if err != nil {
+		return nil, err
+	}
+
+	var selected *shipping.Rate
+	for _, r := range created.Rates {
+		rate, err := r.rate()
+		if err != nil {
+			return nil, err
+		}
+		if (carrier != "" && !strings.EqualFold(rate.Carrier, carrier)) || (service != "" && !strings.EqualFold(rate.Service, service)) {
+			continue
+		}
+		if selected == nil || rate.Amount < selected.Amount {
+			selected = &rate
+		}
+	}
+	if selected == nil {
+		return nil, fmt.Errorf("EasyPost quoted no rate for %s %s", carrier, service)
+	}
+
+	params := map[string]map[string]string{"rate": {"id": selected.ID}}
+	rsp := &shipmentResponse{}
+	if err := c.call(http.MethodPost, "/shipments/"+created.ID+"/buy", params, rsp); err != nil {
+		return nil, err
+	}
+	if rsp.PostageLabel == nil {
+		return nil, fmt.Errorf("EasyPost returned no label for shipment %s", created.ID)
+	}
+
+	label := &shipping.Label{
+		ID:             created.ID,
+		Carrier:        selected.Carrier,
+		Service:        selected.Service,
+		TrackingNumber: rsp.TrackingCode,
+		URL:            rsp.PostageLabel.LabelPDFURL,
+		Amount:         selected.Amount,
+		Currency:       selected.Currency,
+	}
+	if label.URL == "" {
+		label.URL = rsp.PostageLabel.LabelURL
+	}
+	if rsp.Tracker != nil {
+		label.TrackerID = rsp.Tracker.ID
+	}
+	return label, nil
+}
+
+// VoidLabel requests a refund of the label bought for the shipment from
+// EasyPost, which voids it with the carrier.
+func (c *Client) VoidLabel(label *shipping.Label) error {
+	rsp := &shipmentResponse{}
+	return c.call(http.MethodPost, "/shipments/"+label.ID+"/refund", struct{}{}, rsp)
+}
+
+type tracker struct {
+	ID           string `json:"id"`
+	TrackingCode string `json:"tracking_code"`
+	Carrier      string `json:"carrier"`
+	Status       string `json:"status"`
+	StatusDetail string `json:"status_detail"`
+}
+
+func (t *tracker) trackingStatus() *shipping.TrackingStatus {
+	return &shipping.TrackingStatus{
+		ID:             t.ID,
+		Carrier:        t.Carrier,
+		TrackingNumber: t.TrackingCode,
+		Status:         t.Status,
+		Detail:         t.StatusDetail,
+	}
+}
+
+// Track creates a tracker for the shipment, which EasyPost sends webhooks
+// for when its status changes.
+func (c *Client) Track(carrier, trackingNumber string) (*shipping.TrackingStatus, error) {
+	params := map[string]map[string]string{"tracker": {"tracking_code": trackingNumber, "carrier": carrier}}
+	rsp := &tracker{}
+	if err := c.call(http.MethodPost, "/trackers", params, rsp); err != nil {
+		return nil, err
+	}
+	if rsp.ID == "" {
+		return nil, errors.New("EasyPost returned a tracker without an id")
+	}
+	return rsp.trackingStatus(), nil
+}
+
+// TrackingUpdate verifies the signature of an EasyPost webhook event and
+// returns the status of the tracker of tracker.updated events.
+func (c *Client) TrackingUpdate(r *http.Request, payload []byte) (*shipping.TrackingStatus, error) {
+	if c.webhookSecret == "" {
+		return nil, errors.New("EasyPost configuration missing webhook_secret")
+	}
+	signature, err := hex.DecodeString(strings.TrimPrefix(r.Header.Get(signatureHeader), signaturePrefix))
+	if err != nil || len(signature) == 0 {
+		return nil, errors.New("Missing or malformed webhook signature")
+	}
+	mac := hmac.New(sha256.New, []byte(c.webhookSecret))
+	mac.Write(payload)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errors.New("Webhook signature doesn't match")
+	}
+
+	event := struct {
+		Description string  `json:"description"`
+		Result      tracker `json:"result"`
+	}{}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, errors.Wrap(err, "Error parsing EasyPost event")
+	}
+	if event.Description != "tracker.updated" && event.Description != "tracker.created" {
+		return nil, nil
+	}
+	if event.Result.ID == "" {
+		return nil, errors.New("EasyPost event without a tracker_id")
+	}
+	return event.Result.trackingStatus(), nil
+}
+
+func newAddressParams(address shipping.Address) addressParams {
+	return addressParams{
+		Name:    address.Name,
+		Street1: address.Street,
+		City:    address.City,
+		State:   address.State,
+		Zip:     address.Zip,
+		Country: address.Country,
+	}
+}
+
+func inches(millimeters uint64) float64 {
+	return math.Ceil(float64(millimeters)/25.4*10) / 10
+}
+
+type easypostError struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (c *Client) call(method, path string, payload interface{}, v interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, c.url+path, bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "Error creating EasyPost request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(c.apiKey, "")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "Error calling EasyPost")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		data, _ := ioutil.ReadAll(resp.Body)
+		apiErr := &easypostError{}
+		if json.Unmarshal(data, apiErr) == nil && apiErr.Error.Message != "" {
+			return fmt.Errorf("EasyPost returned %d: %s", resp.StatusCode, apiErr.Error.Message)
+		}
+		return fmt.Errorf("EasyPost returned %d: %s", resp.StatusCode, string(data))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
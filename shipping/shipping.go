@@ -0,0 +1,104 @@
+// Package shipping defines the interface of the carrier backends quoting live
+// shipping rates next to the shipping methods of the site settings, buying
+// shipping labels and tracking the delivery of shipments.
+package shipping
+
+import "net/http"
+
+// RateProvider quotes the rates of carriers for shipping a parcel.
+type RateProvider interface {
+	// Rates returns the quotes of the carriers for the shipment.
+	Rates(shipment *Shipment) ([]Rate, error)
+}
+
+// Address is the address a parcel ships from or to. Country is the ISO 3166
+// country code.
+type Address struct {
+	Name    string `json:"name"`
+	Country string `json:"country"`
+	Zip     string `json:"zip"`
+	State   string `json:"state"`
+	City    string `json:"city"`
+	Street  string `json:"street"`
+}
+
+// Parcel is a package to ship, weighing Weight grams. Its dimensions are in
+// millimeters and zero if they're unknown.
+type Parcel struct {
+	Weight uint64
+	Length uint64
+	Width  uint64
+	Height uint64
+}
+
+// Shipment is a parcel to ship between two addresses.
+type Shipment struct {
+	From   Address
+	To     Address
+	Parcel Parcel
+}
+
+// Rate is the quote of a carrier for a service. The Amount is in the lowest
+// unit of the currency.
+type Rate struct {
+	ID           string
+	Carrier      string
+	Service      string
+	Amount       uint64
+	Currency     string
+	DeliveryDays int
+}
+
+// LabelProvider buys shipping labels from carriers.
+type LabelProvider interface {
+	// BuyLabel buys a label for the shipment with the service of the
+	// carrier, or with the cheapest rate if they're empty.
+	BuyLabel(shipment *Shipment, carrier, service string) (*Label, error)
+	// VoidLabel voids a label that won't be used, refunding its cost.
+	VoidLabel(label *Label) error
+}
+
+// Label is a shipping label bought for a parcel. URL is the PDF to print, the
+// Amount its cost in the lowest unit of the currency. TrackerID references
+// the tracker of the backend following the parcel, if it created one.
+type Label struct {
+	ID             string
+	Carrier        string
+	Service        string
+	TrackingNumber string
+	URL            string
+	Amount         uint64
+	Currency       string
+	TrackerID      string
+}
+
+// Tracking statuses of shipments.
+const (
+	StatusUnknown        = "unknown"
+	StatusPreTransit     = "pre_transit"
+	StatusInTransit      = "in_transit"
+	StatusOutForDelivery = "out_for_delivery"
+	StatusDelivered      = "delivered"
+	StatusReturned       = "return_to_sender"
+	StatusFailure        = "failure"
+)
+
+// Tracker follows the delivery of shipments by their carriers.
+type Tracker interface {
+	// Track starts tracking the shipment with the tracking number and returns
+	// its current status.
+	Track(carrier, trackingNumber string) (*TrackingStatus, error)
+	// TrackingUpdate verifies and parses a webhook notifying of the new
+	// status of a tracked shipment. It returns nil for other notifications.
+	TrackingUpdate(r *http.Request, payload []byte) (*TrackingStatus, error)
+}
+
+// TrackingStatus is the delivery status of a tracked shipment. ID is the
+// reference of the tracker of the backend.
+type TrackingStatus struct {
+	ID             string
+	Carrier        string
+	TrackingNumber string
+	Status         string
+	Detail         string
+}
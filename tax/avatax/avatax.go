@@ -0,0 +1,297 @@
+// Package avatax calculates taxes with Avalara AvaTax and records the
+// transactions of paid orders and refunds as committed AvaTax documents for
+// filing.
+package avatax
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/netlify/gocommerce/tax"
+)
+
+const (
+	apiURL     = "https://rest.avatax.com/api/v2"
+	sandboxURL = "https://sandbox-rest.avatax.com/api/v2"
+
+	documentSalesOrder    = "SalesOrder"
+	documentSalesInvoice  = "SalesInvoice"
+	documentReturnInvoice = "ReturnInvoice"
+
+	// freightTaxCode is the tax code of shipping charges.
+	freightTaxCode = "FR"
+)
+
+// Config contains the AvaTax specific configuration.
+type Config struct {
+	AccountID   string `json:"account_id"`
+	LicenseKey  string `json:"license_key"`
+	CompanyCode string `json:"company_code"`
+	Sandbox     bool   `json:"sandbox"`
+	// URL replaces the URL of the AvaTax API, used for testing.
+	URL string `json:"url"`
+}
+
+// Client calls the AvaTax API. It implements tax.Calculator.
+type Client struct {
+	client      *http.Client
+	accountID   string
+	licenseKey  string
+	companyCode string
+	url         string
+}
+
+// NewClient creates a new AvaTax client using the provided configuration.
+func NewClient(config Config) (*Client, error) {
+	if config.AccountID == "" || config.LicenseKey == "" {
+		return nil, errors.New("AvaTax configuration missing account_id or license_key")
+	}
+	if config.CompanyCode == "" {
+		return nil, errors.New("AvaTax configuration missing company_code")
+	}
+	c := &Client{
+		client:      &http.Client{Timeout: 10 * time.Second},
+		accountID:   config.AccountID,
+		licenseKey:  config.LicenseKey,
+		companyCode: config.CompanyCode,
+		url:         apiURL,
+	}
+	if config.Sandbox {
+		c.url = sandboxURL
+	}
+	if config.URL != "" {
+		c.url = config.URL
+	}
+	return c, nil
+}
+
+type addressParams struct {
+	Line1      string `json:"line1,omitempty"`
+	City       string `json:"city,omitempty"`
+	Region     string `json:"region,omitempty"`
+	Country    string `json:"country"`
+	PostalCode string `json:"postalCode,omitempty"`
+}
+
+type lineParams struct {
+	Number      string  `json:"number"`
+	Quantity    uint64  `json:"quantity"`
+	Amount      float64 `json:"amount"`
+	ItemCode    string  `json:"itemCode,omitempty"`
+	Description string  `json:"description,omitempty"`
+	TaxCode     string  `json:"taxCode,omitempty"`
+}
+
+type taxOverrideParams struct {
+	Type      string  `json:"type"`
+	TaxAmount float64 `json:"taxAmount"`
+	Reason    string  `json:"reason"`
+}
+
+type transactionParams struct {
+	Type          string             `json:"type"`
+	Code          string             `json:"code,omitempty"`
+	CompanyCode   string             `json:"companyCode"`
+	Date          string             `json:"date"`
+	CustomerCode  string             `json:"customerCode"`
+	CurrencyCode  string             `json:"currencyCode,omitempty"`
+	ReferenceCode string             `json:"referenceCode,omitempty"`
+	Commit        bool               `json:"commit"`
+	TaxOverride   *taxOverrideParams `json:"taxOverride,omitempty"`
+	Addresses     struct {
+		ShipFrom addressParams `json:"shipFrom"`
+		ShipTo   addressParams `json:"shipTo"`
+	} `json:"addresses"`
+	Lines []lineParams `json:"lines"`
+}
+
+func (c *Client) newTransactionParams(documentType string, order *tax.Order, date time.Time) *transactionParams {
+	params := &transactionParams{
+		Type:         documentType,
+		CompanyCode:  c.companyCode,
+		Date:         date.Format("2006-01-02"),
+		CustomerCode: order.Customer,
+		CurrencyCode: order.Currency,
+	}
+	if params.CustomerCode == "" {
+		params.CustomerCode = order.ID
+	}
+	params.Addresses.ShipFrom = newAddressParams(order.From)
+	params.Addresses.ShipTo = newAddressParams(order.To)
+	for i, item := range order.Items {
+		params.Lines = append(params.Lines, lineParams{
+			Number:      strconv.Itoa(i + 1),
+			Quantity:    item.Quantity,
+			Amount:      toAmount(item.UnitPrice*item.Quantity) - toAmount(item.Discount),
+			ItemCode:    item.Sku,
+			Description: item.Description,
+			TaxCode:     item.TaxCode,
+		})
+	}
+	return params
+}
+
+func newAddressParams(address tax.Address) addressParams {
+	return addressParams{
+		Line1:      address.Street,
+		City:       address.City,
+		Region:     address.State,
+		Country:    address.Country,
+		PostalCode: address.Zip,
+	}
+}
+
+type transactionResponse struct {
+	TotalTax float64 `json:"totalTax"`
+	Lines    []struct {
+		LineNumber string  `json:"lineNumber"`
+		Tax        float64 `json:"tax"`
+	} `json:"lines"`
+}
+
+// TaxForOrder returns the tax to collect for each of the line items of the
+// order. The calculation is a sales order, which AvaTax doesn't record.
+func (c *Client) TaxForOrder(order *tax.Order) ([]uint64, error) {
+	params := c.newTransactionParams(documentSalesOrder, order, time.Now())
+	rsp := &transactionResponse{}
+	if err := c.call(http.MethodPost, "/transactions/create", params, rsp); err != nil {
+		return nil, err
+	}
+
+	taxes := make([]uint64, len(order.Items))
+	for _, line := range rsp.Lines {
+		i, err := strconv.Atoi(line.LineNumber)
+		if err != nil || i < 1 || i > len(taxes) {
+			continue
+		}
+		taxes[i-1] = fromAmount(line.Tax)
+	}
+	return taxes, nil
+}
+
+// RateForAddress returns the combined tax rate of the address, in percent.
+func (c *Client) RateForAddress(address tax.Address) (float64, error) {
+	rsp := struct {
+		TotalRate float64 `json:"totalRate"`
+	}{}
+	query := url.Values{}
+	query.Set("line1", address.Street)
+	query.Set("city", address.City)
+	query.Set("region", address.State)
+	query.Set("postalCode", address.Zip)
+	query.Set("country", address.Country)
+	if err := c.call(http.MethodGet, "/taxrates/byaddress?"+query.Encode(), nil, &rsp); err != nil {
+		return 0, err
+	}
+	return rsp.TotalRate * 100, nil
+}
+
+// RecordOrder records a paid order as a committed sales invoice with the
+// taxes collected at checkout. The shipping is a line of its own.
+func (c *Client) RecordOrder(order *tax.Order) error {
+	params := c.newTransactionParams(documentSalesInvoice, order, order.Date)
+	params.Code = order.ID
+	params.Commit = true
+	if order.Shipping > 0 {
+		params.Lines = append(params.Lines, lineParams{
+			Number:      strconv.Itoa(len(params.Lines) + 1),
+			Quantity:    1,
+			Amount:      toAmount(order.Shipping),
+			ItemCode:    "shipping",
+			Description: "Shipping",
+			TaxCode:     freightTaxCode,
+		})
+	}
+	var salesTax uint64
+	for _, item := range order.Items {
+		salesTax += item.SalesTax
+	}
+	params.TaxOverride = &taxOverrideParams{
+		Type:      "TaxAmount",
+		TaxAmount: toAmount(salesTax),
+		Reason:    "Collected at checkout",
+	}
+	return c.call(http.MethodPost, "/transactions/create", params, &transactionResponse{})
+}
+
+// RecordRefund records a refund of a recorded order as a committed return
+// invoice referencing it.
+func (c *Client) RecordRefund(refund *tax.Refund) error {
+	order := *refund.Order
+	order.Items = nil
+	params := c.newTransactionParams(documentReturnInvoice, &order, refund.Date)
+	params.Code = refund.ID
+	params.ReferenceCode = order.ID
+	params.Commit = true
+	params.TaxOverride = &taxOverrideParams{
+		Type:      "TaxAmount",
+		TaxAmount: -toAmount(refund.SalesTax),
+		Reason:    "Refund",
+	}
+	params.Lines = []lineParams{{
+		Number:      "1",
+		Quantity:    1,
+		Amount:      -toAmount(refund.Amount - refund.SalesTax),
+		Description: "Refund of order " + order.ID,
+	}}
+	return c.call(http.MethodPost, "/transactions/create", params, &transactionResponse{})
+}
+
+type avataxError struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (c *Client) call(method, path string, payload interface{}, v interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.url+path, body)
+	if err != nil {
+		return errors.Wrap(err, "Error creating AvaTax request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(c.accountID, c.licenseKey)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "Error calling AvaTax")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		data, _ := ioutil.ReadAll(resp.Body)
+		apiErr := &avataxError{}
+		if json.Unmarshal(data, apiErr) == nil && apiErr.Error.Message != "" {
+			return fmt.Errorf("AvaTax returned %d: %s", resp.StatusCode, apiErr.Error.Message)
+		}
+		return fmt.Errorf("AvaTax returned %d: %s", resp.StatusCode, string(data))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func toAmount(amount uint64) float64 {
+	return float64(amount) / 100
+}
+
+func fromAmount(amount float64) uint64 {
+	return uint64(math.Round(amount * 100))
+}
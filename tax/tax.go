@@ -0,0 +1,67 @@
+// Package tax defines the interface of the external backends calculating the
+// taxes of orders instead of the tax rates of the site settings.
+package tax
+
+import "time"
+
+// Calculator calculates the taxes of orders and records the transactions of
+// paid orders and refunds for filing.
+type Calculator interface {
+	// TaxForOrder returns the tax to collect for each of the line items of
+	// the order, for their whole quantity.
+	TaxForOrder(order *Order) ([]uint64, error)
+	// RateForAddress returns the combined tax rate, in percent, of the
+	// address.
+	RateForAddress(address Address) (float64, error)
+	// RecordOrder records a paid order.
+	RecordOrder(order *Order) error
+	// RecordRefund records a refund of a paid order.
+	RecordRefund(refund *Refund) error
+}
+
+// Address is the address an order ships from or to. Country is the ISO 3166
+// country code.
+type Address struct {
+	Country string `json:"country"`
+	Zip     string `json:"zip"`
+	State   string `json:"state"`
+	City    string `json:"city"`
+	Street  string `json:"street"`
+}
+
+// LineItem is a line item of an order. Amounts are in the lowest unit of the
+// currency, Discount and SalesTax for the whole quantity.
+type LineItem struct {
+	ID          string
+	Sku         string
+	Description string
+	TaxCode     string
+	Quantity    uint64
+	UnitPrice   uint64
+	Discount    uint64
+	SalesTax    uint64
+}
+
+// Order is an order to tax or record. Shipping is the shipping cost charged
+// for the order, in the lowest unit of the currency.
+type Order struct {
+	ID       string
+	Customer string
+	Currency string
+	Date     time.Time
+	From     Address
+	To       Address
+	Items    []LineItem
+	Shipping uint64
+}
+
+// Refund is a refund of the Amount, including the SalesTax and the share of
+// the Shipping, of a recorded order.
+type Refund struct {
+	ID       string
+	Order    *Order
+	Date     time.Time
+	Amount   uint64
+	SalesTax uint64
+	Shipping uint64
+}
@@ -0,0 +1,240 @@
+// Package taxjar calculates US sales tax with TaxJar and reports the
+// transactions of paid orders and refunds to TaxJar for filing.
+package taxjar
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/netlify/gocommerce/tax"
+)
+
+const apiURL = "https://api.taxjar.com/v2"
+
+// Config contains the TaxJar specific configuration.
+type Config struct {
+	APIKey string `json:"api_key"`
+	// URL replaces the URL of the TaxJar API, used for testing.
+	URL string `json:"url"`
+}
+
+// Client calls the TaxJar API. It implements tax.Calculator.
+type Client struct {
+	client *http.Client
+	apiKey string
+	url    string
+}
+
+// NewClient creates a new TaxJar client using the provided configuration.
+func NewClient(config Config) (*Client, error) {
+	if config.APIKey == "" {
+		return nil, errors.New("TaxJar configuration missing api_key")
+	}
+	c := &Client{
+		client: &http.Client{Timeout: 10 * time.Second},
+		apiKey: config.APIKey,
+		url:    apiURL,
+	}
+	if config.URL != "" {
+		c.url = config.URL
+	}
+	return c, nil
+}
+
+type lineItemParams struct {
+	ID                string  `json:"id"`
+	Quantity          uint64  `json:"quantity"`
+	ProductIdentifier string  `json:"product_identifier,omitempty"`
+	Description       string  `json:"description,omitempty"`
+	ProductTaxCode    string  `json:"product_tax_code,omitempty"`
+	UnitPrice         float64 `json:"unit_price"`
+	Discount          float64 `json:"discount"`
+	SalesTax          float64 `json:"sales_tax,omitempty"`
+}
+
+type orderParams struct {
+	TransactionID          string           `json:"transaction_id,omitempty"`
+	TransactionReferenceID string           `json:"transaction_reference_id,omitempty"`
+	TransactionDate        string           `json:"transaction_date,omitempty"`
+	FromCountry            string           `json:"from_country"`
+	FromZip                string           `json:"from_zip"`
+	FromState              string           `json:"from_state"`
+	FromCity               string           `json:"from_city,omitempty"`
+	FromStreet             string           `json:"from_street,omitempty"`
+	ToCountry              string           `json:"to_country"`
+	ToZip                  string           `json:"to_zip"`
+	ToState                string           `json:"to_state"`
+	ToCity                 string           `json:"to_city,omitempty"`
+	ToStreet               string           `json:"to_street,omitempty"`
+	Amount                 float64          `json:"amount"`
+	Shipping               float64          `json:"shipping"`
+	SalesTax               float64          `json:"sales_tax,omitempty"`
+	LineItems              []lineItemParams `json:"line_items,omitempty"`
+}
+
+func newOrderParams(from, to tax.Address, items []tax.LineItem) *orderParams {
+	params := &orderParams{
+		FromCountry: from.Country,
+		FromZip:     from.Zip,
+		FromState:   from.State,
+		FromCity:    from.City,
+		FromStreet:  from.Street,
+		ToCountry:   to.Country,
+		ToZip:       to.Zip,
+		ToState:     to.State,
+		ToCity:      to.City,
+		ToStreet:    to.Street,
+	}
+	for _, item := range items {
+		params.Amount += toAmount(item.UnitPrice*item.Quantity) - toAmount(item.Discount)
+		params.LineItems = append(params.LineItems, lineItemParams{
+			ID:                item.ID,
+			Quantity:          item.Quantity,
+			ProductIdentifier: item.Sku,
+			Description:       item.Description,
+			ProductTaxCode:    item.TaxCode,
+			UnitPrice:         toAmount(item.UnitPrice),
+			Discount:          toAmount(item.Discount),
+			SalesTax:          toAmount(item.SalesTax),
+		})
+	}
+	return params
+}
+
+// TaxForOrder returns the sales tax to collect for each of the line items of
+// the order.
+func (c *Client) TaxForOrder(order *tax.Order) ([]uint64, error) {
+	rsp := struct {
+		Tax struct {
+			AmountToCollect float64 `json:"amount_to_collect"`
+			Breakdown       struct {
+				LineItems []struct {
+					ID             string  `json:"id"`
+					TaxCollectable float64 `json:"tax_collectable"`
+				} `json:"line_items"`
+			} `json:"breakdown"`
+		} `json:"tax"`
+	}{}
+	if err := c.call(http.MethodPost, "/taxes", newOrderParams(order.From, order.To, order.Items), &rsp); err != nil {
+		return nil, err
+	}
+
+	taxes := make([]uint64, len(order.Items))
+	for _, line := range rsp.Tax.Breakdown.LineItems {
+		for i, item := range order.Items {
+			if item.ID == line.ID {
+				taxes[i] = fromAmount(line.TaxCollectable)
+			}
+		}
+	}
+	return taxes, nil
+}
+
+// RateForAddress returns the combined sales tax rate of the address, in
+// percent.
+func (c *Client) RateForAddress(address tax.Address) (float64, error) {
+	rsp := struct {
+		Rate struct {
+			CombinedRate json.RawMessage `json:"combined_rate"`
+		} `json:"rate"`
+	}{}
+	query := url.Values{}
+	query.Set("country", address.Country)
+	query.Set("state", address.State)
+	query.Set("city", address.City)
+	query.Set("street", address.Street)
+	if err := c.call(http.MethodGet, "/rates/"+url.PathEscape(address.Zip)+"?"+query.Encode(), nil, &rsp); err != nil {
+		return 0, err
+	}
+
+	// Older API versions return the rate as a string
+	rate, err := strconv.ParseFloat(strings.Trim(string(rsp.Rate.CombinedRate), `"`), 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "Error parsing TaxJar rate")
+	}
+	return rate * 100, nil
+}
+
+// RecordOrder reports a paid order to TaxJar. The amount of transactions
+// includes the shipping.
+func (c *Client) RecordOrder(order *tax.Order) error {
+	params := newOrderParams(order.From, order.To, order.Items)
+	params.Shipping = toAmount(order.Shipping)
+	params.Amount += params.Shipping
+	params.TransactionID = order.ID
+	params.TransactionDate = order.Date.Format(time.RFC3339)
+	for _, item := range order.Items {
+		params.SalesTax += toAmount(item.SalesTax)
+	}
+	return c.call(http.MethodPost, "/transactions/orders", params, &struct{}{})
+}
+
+// RecordRefund reports a refund of a reported order to TaxJar.
+func (c *Client) RecordRefund(refund *tax.Refund) error {
+	params := newOrderParams(refund.Order.From, refund.Order.To, nil)
+	params.TransactionID = refund.ID
+	params.TransactionReferenceID = refund.Order.ID
+	params.TransactionDate = refund.Date.Format(time.RFC3339)
+	params.Shipping = -toAmount(refund.Shipping)
+	params.Amount = -toAmount(refund.Amount - refund.SalesTax)
+	params.SalesTax = -toAmount(refund.SalesTax)
+	return c.call(http.MethodPost, "/transactions/refunds", params, &struct{}{})
+}
+
+type taxjarError struct {
+	Error  string `json:"error"`
+	Detail string `json:"detail"`
+}
+
+func (c *Client) call(method, path string, payload interface{}, v interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.url+path, body)
+	if err != nil {
+		return errors.Wrap(err, "Error creating TaxJar request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "Error calling TaxJar")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		data, _ := ioutil.ReadAll(resp.Body)
+		apiErr := &taxjarError{}
+		if json.Unmarshal(data, apiErr) == nil && apiErr.Detail != "" {
+			return fmt.Errorf("TaxJar returned %d: %s", resp.StatusCode, apiErr.Detail)
+		}
+		return fmt.Errorf("TaxJar returned %d: %s", resp.StatusCode, string(data))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func toAmount(amount uint64) float64 {
+	return float64(amount) / 100
+}
+
+func fromAmount(amount float64) uint64 {
+	return uint64(math.Round(amount * 100))
+}